@@ -10,7 +10,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
 	sendmail "github.com/axllent/mailpit/sendmail/cmd"
 	"github.com/spf13/cobra"
 	"golang.org/x/text/language"
@@ -18,7 +20,8 @@ import (
 )
 
 var (
-	ingestRecent int
+	ingestRecent   int
+	ingestDatabase string
 )
 
 // ingestCmd represents the ingest command
@@ -29,7 +32,10 @@ var ingestCmd = &cobra.Command{
 
 This command will scan the folder for emails and deliver them via SMTP to a running 
 Mailpit server. Each email must be a separate file (eg: Maildir format, not mbox).
-The --recent flag will only consider files with a modification date within the last X days.`,
+The --recent flag will only consider files with a modification date within the last X days.
+
+With --database the emails are stored directly in the database instead, and are recorded
+as imported (see the via:import search filter).`,
 	// Hidden: true,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -38,6 +44,16 @@ The --recent flag will only consider files with a modification date within the l
 		var per100start = time.Now()
 		p := message.NewPrinter(language.English)
 
+		if ingestDatabase != "" {
+			config.Database = ingestDatabase
+			config.MaxMessages = 0
+
+			if err := storage.InitDB(); err != nil {
+				logger.Log().Error(err)
+				os.Exit(1)
+			}
+		}
+
 		for _, a := range args {
 			err := filepath.Walk(a,
 				func(path string, info os.FileInfo, err error) error {
@@ -108,8 +124,13 @@ The --recent flag will only consider files with a modification date within the l
 						}
 					}
 
-					err = smtp.SendMail(sendmail.SMTPAddr, nil, returnPath, recipients, body)
-					if err != nil {
+					if ingestDatabase != "" {
+						opts := storage.StoreOptions{Via: storage.ViaImport, From: returnPath, To: recipients}
+						if _, err := storage.StoreWithOptions(&body, opts); err != nil {
+							logger.Log().Errorf("error storing mail: %s (%s)", err.Error(), path)
+							return nil
+						}
+					} else if err := smtp.SendMail(sendmail.SMTPAddr, nil, returnPath, recipients, body); err != nil {
 						logger.Log().Errorf("error sending mail: %s (%s)", err.Error(), path)
 						return nil
 					}
@@ -138,6 +159,7 @@ func init() {
 
 	ingestCmd.Flags().StringVarP(&sendmail.SMTPAddr, "smtp-addr", "S", sendmail.SMTPAddr, "SMTP server address")
 	ingestCmd.Flags().IntVarP(&ingestRecent, "recent", "r", 0, "Only ingest messages from the last X days (default all)")
+	ingestCmd.Flags().StringVarP(&ingestDatabase, "database", "d", "", "Store messages directly in a database file, recorded as imported")
 }
 
 // IsFile returns if a path is a file
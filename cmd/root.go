@@ -8,6 +8,7 @@ import (
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/htmlcheck"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/internal/tools"
@@ -33,6 +34,14 @@ Documentation:
 			logger.Log().Error(err.Error())
 			os.Exit(1)
 		}
+		if err := htmlcheck.SetDefaultFilter(config.HTMLCheckClients, config.HTMLCheckPlatforms); err != nil {
+			logger.Log().Errorf("[html-check] %s", err.Error())
+			os.Exit(1)
+		}
+		if err := webhook.Init(); err != nil {
+			logger.Log().Error(err.Error())
+			os.Exit(1)
+		}
 		if err := storage.InitDB(); err != nil {
 			logger.Log().Fatal(err.Error())
 			os.Exit(1)
@@ -40,6 +49,14 @@ Documentation:
 
 		go server.Listen()
 
+		go func() {
+			if err := smtpd.ListenLMTP(); err != nil {
+				storage.Close()
+				logger.Log().Fatal(err.Error())
+				os.Exit(1)
+			}
+		}()
+
 		if err := smtpd.Listen(); err != nil {
 			storage.Close()
 			logger.Log().Fatal(err.Error())
@@ -83,12 +100,23 @@ func init() {
 
 	rootCmd.Flags().StringVarP(&config.Database, "database", "d", config.Database, "Database to store persistent data")
 	rootCmd.Flags().StringVar(&config.TenantID, "tenant-id", config.TenantID, "Database tenant ID to isolate data")
+	rootCmd.Flags().StringVar(&config.EncryptionKeyFile, "encryption-key-file", config.EncryptionKeyFile, "File containing a key to encrypt stored messages (hex or base64 AES key)")
+	rootCmd.Flags().BoolVar(&config.DisableBodyIndex, "disable-body-index", config.DisableBodyIndex, "Do not store message bodies in the search index or snippets")
+	rootCmd.Flags().StringVar(&config.Label, "label", config.Label, "Optional label to identify this Mailpit instance")
 	rootCmd.Flags().IntVarP(&config.MaxMessages, "max", "m", config.MaxMessages, "Max number of messages to store")
 	rootCmd.Flags().BoolVar(&config.UseMessageDates, "use-message-dates", config.UseMessageDates, "Use message dates as the received dates")
+	rootCmd.Flags().StringVar(&config.PruneAttachmentsAfter, "prune-attachments-after", config.PruneAttachmentsAfter, "Strip attachment data from messages older than a duration (eg: 30d)")
+	rootCmd.Flags().BoolVar(&config.PruneAttachmentsKeepInline, "prune-attachments-keep-inline", config.PruneAttachmentsKeepInline, "Keep inline attachments (eg: images) when pruning attachments")
+	rootCmd.Flags().BoolVar(&config.Trash, "trash", config.Trash, "Move deleted messages to the trash instead of deleting them")
+	rootCmd.Flags().StringVar(&config.TrashPurgeAfter, "trash-purge-after", config.TrashPurgeAfter, "Permanently delete messages in the trash after a duration (eg: 7d)")
 	rootCmd.Flags().BoolVar(&config.IgnoreDuplicateIDs, "ignore-duplicate-ids", config.IgnoreDuplicateIDs, "Ignore duplicate messages (by Message-Id)")
 	rootCmd.Flags().StringVar(&logger.LogFile, "log-file", logger.LogFile, "Log output to file instead of stdout")
+	rootCmd.Flags().StringVar(&logger.LogFormat, "log-format", logger.LogFormat, "Log format (text or json)")
 	rootCmd.Flags().BoolVarP(&logger.QuietLogging, "quiet", "q", logger.QuietLogging, "Quiet logging (errors only)")
 	rootCmd.Flags().BoolVarP(&logger.VerboseLogging, "verbose", "v", logger.VerboseLogging, "Verbose logging")
+	rootCmd.Flags().StringVar(&logger.SyslogAddress, "syslog", logger.SyslogAddress, "Also log to syslog (\"local\", a unix socket path, or udp:// or tcp:// address)")
+	rootCmd.Flags().StringVar(&logger.SyslogFacility, "syslog-facility", logger.SyslogFacility, "Syslog facility")
+	rootCmd.Flags().StringVar(&logger.SyslogTag, "syslog-tag", logger.SyslogTag, "Syslog tag")
 
 	// Web UI / API
 	rootCmd.Flags().StringVarP(&config.HTTPListen, "listen", "l", config.HTTPListen, "HTTP bind interface & port for UI")
@@ -99,26 +127,52 @@ func init() {
 	rootCmd.Flags().StringVar(&server.AccessControlAllowOrigin, "api-cors", server.AccessControlAllowOrigin, "Set API CORS Access-Control-Allow-Origin header")
 	rootCmd.Flags().BoolVar(&config.BlockRemoteCSSAndFonts, "block-remote-css-and-fonts", config.BlockRemoteCSSAndFonts, "Block access to remote CSS & fonts")
 	rootCmd.Flags().StringVar(&config.EnableSpamAssassin, "enable-spamassassin", config.EnableSpamAssassin, "Enable integration with SpamAssassin")
+	rootCmd.Flags().StringVar(&config.EnableClamAV, "enable-clamav", config.EnableClamAV, "Enable integration with ClamAV (clamd <host>:<port> or unix:<socket>)")
+	rootCmd.Flags().StringVar(&config.HTMLCheckClients, "html-check-clients", config.HTMLCheckClients, "Limit the HTML check to these email clients by default (comma-separated)")
+	rootCmd.Flags().StringVar(&config.HTMLCheckPlatforms, "html-check-platforms", config.HTMLCheckPlatforms, "Limit the HTML check to these platforms by default (comma-separated)")
+	rootCmd.Flags().StringVar(&config.TrackingDomains, "tracking-domains", config.TrackingDomains, "Additional known tracking domains for the tracking check (comma-separated)")
 	rootCmd.Flags().BoolVar(&config.AllowUntrustedTLS, "allow-untrusted-tls", config.AllowUntrustedTLS, "Do not verify HTTPS certificates (link checker & screenshots)")
+	rootCmd.Flags().StringVar(&config.OutboundProxy, "outbound-proxy", config.OutboundProxy, "Proxy URL for outbound HTTP requests (default HTTP_PROXY/HTTPS_PROXY)")
+	rootCmd.Flags().StringVar(&config.OutboundNoProxy, "outbound-no-proxy", config.OutboundNoProxy, "Comma-separated hosts not to proxy (default NO_PROXY)")
+	rootCmd.Flags().StringVar(&config.OutboundBind, "outbound-bind", config.OutboundBind, "Local IP address or interface for outbound HTTP requests")
+	rootCmd.Flags().StringVar(&config.OutboundCACert, "outbound-ca-cert", config.OutboundCACert, "PEM file of additional CA certificates for outbound HTTPS requests")
 
 	// SMTP server
 	rootCmd.Flags().StringVarP(&config.SMTPListen, "smtp", "s", config.SMTPListen, "SMTP bind interface and port")
+	rootCmd.Flags().StringVar(&config.LMTPListen, "lmtp", config.LMTPListen, "Optional LMTP bind interface and port, or unix socket (unix:<path> or an absolute path)")
+	rootCmd.Flags().StringVar(&config.LMTPTLSCert, "lmtp-tls-cert", config.LMTPTLSCert, "TLS certificate for LMTP (STARTTLS) - requires lmtp-tls-key")
+	rootCmd.Flags().StringVar(&config.LMTPTLSKey, "lmtp-tls-key", config.LMTPTLSKey, "TLS key for LMTP (STARTTLS) - requires lmtp-tls-cert")
+	rootCmd.Flags().BoolVar(&config.LMTPRequireSTARTTLS, "lmtp-require-starttls", config.LMTPRequireSTARTTLS, "Require LMTP client use STARTTLS")
 	rootCmd.Flags().StringVar(&config.SMTPAuthFile, "smtp-auth-file", config.SMTPAuthFile, "A password file for SMTP authentication")
 	rootCmd.Flags().BoolVar(&config.SMTPAuthAcceptAny, "smtp-auth-accept-any", config.SMTPAuthAcceptAny, "Accept any SMTP username and password, including none")
 	rootCmd.Flags().StringVar(&config.SMTPTLSCert, "smtp-tls-cert", config.SMTPTLSCert, "TLS certificate for SMTP (STARTTLS) - requires smtp-tls-key")
 	rootCmd.Flags().StringVar(&config.SMTPTLSKey, "smtp-tls-key", config.SMTPTLSKey, "TLS key for SMTP (STARTTLS) - requires smtp-tls-cert")
 	rootCmd.Flags().BoolVar(&config.SMTPRequireSTARTTLS, "smtp-require-starttls", config.SMTPRequireSTARTTLS, "Require SMTP client use STARTTLS")
 	rootCmd.Flags().BoolVar(&config.SMTPRequireTLS, "smtp-require-tls", config.SMTPRequireTLS, "Require client use SSL/TLS")
+	rootCmd.Flags().BoolVar(&config.SMTPRequireTLSAuth, "smtp-require-tls-auth", config.SMTPRequireTLSAuth, "Only allow SMTP authentication once STARTTLS or TLS is in use")
 	rootCmd.Flags().BoolVar(&config.SMTPAuthAllowInsecure, "smtp-auth-allow-insecure", config.SMTPAuthAllowInsecure, "Allow insecure PLAIN & LOGIN SMTP authentication")
 	rootCmd.Flags().BoolVar(&config.SMTPStrictRFCHeaders, "smtp-strict-rfc-headers", config.SMTPStrictRFCHeaders, "Return SMTP error if message headers contain <CR><CR><LF>")
+	rootCmd.Flags().BoolVar(&config.SMTPStrictLineEndings, "smtp-strict-line-endings", config.SMTPStrictLineEndings, "Return SMTP error if message contains bare <CR> or <LF> line endings")
 	rootCmd.Flags().IntVar(&config.SMTPMaxRecipients, "smtp-max-recipients", config.SMTPMaxRecipients, "Maximum SMTP recipients allowed")
+	rootCmd.Flags().StringVar(&config.MaxMessageSize, "max-message-size", config.MaxMessageSize, "Maximum SMTP message size in bytes, eg: 512K or 25M (0 = unlimited)")
+	rootCmd.Flags().IntVar(&config.SMTPMaxConnections, "smtp-max-connections", config.SMTPMaxConnections, "Maximum concurrent SMTP connections (0 = unlimited)")
+	rootCmd.Flags().IntVar(&config.SMTPMaxConnectionsPerIP, "smtp-max-connections-per-ip", config.SMTPMaxConnectionsPerIP, "Maximum concurrent SMTP connections per IP address (0 = unlimited)")
+	rootCmd.Flags().IntVar(&config.SMTPMaxMessagesPerConnection, "smtp-max-messages-per-connection", config.SMTPMaxMessagesPerConnection, "Maximum messages per SMTP connection (0 = unlimited)")
 	rootCmd.Flags().StringVar(&config.SMTPAllowedRecipients, "smtp-allowed-recipients", config.SMTPAllowedRecipients, "Only allow SMTP recipients matching a regular expression (default allow all)")
+	rootCmd.Flags().StringVar(&config.SMTPDeniedRecipients, "smtp-denied-recipients", config.SMTPDeniedRecipients, "Reject SMTP recipients matching a regular expression, even if allowed")
+	rootCmd.Flags().IntVar(&config.SMTPSenderQuota, "smtp-sender-quota", config.SMTPSenderQuota, "Maximum messages per sender within the sender quota window (0 = unlimited)")
+	rootCmd.Flags().StringVar(&config.SMTPSenderQuotaWindow, "smtp-sender-quota-window", config.SMTPSenderQuotaWindow, "Rolling sender quota window (eg: 1h or 1d)")
+	rootCmd.Flags().StringVar(&config.SMTPSenderQuotaBy, "smtp-sender-quota-by", config.SMTPSenderQuotaBy, "Apply sender quota per sender address or domain")
+	rootCmd.Flags().StringVar(&config.SMTPSenderQuotaExempt, "smtp-sender-quota-exempt", config.SMTPSenderQuotaExempt, "Exempt senders matching a regular expression from the sender quota")
 	rootCmd.Flags().BoolVar(&smtpd.DisableReverseDNS, "smtp-disable-rdns", smtpd.DisableReverseDNS, "Disable SMTP reverse DNS lookups")
 
 	// SMTP relay
 	rootCmd.Flags().StringVar(&config.SMTPRelayConfigFile, "smtp-relay-config", config.SMTPRelayConfigFile, "SMTP relay configuration file to allow releasing messages")
 	rootCmd.Flags().BoolVar(&config.SMTPRelayAll, "smtp-relay-all", config.SMTPRelayAll, "Auto-relay all new messages via external SMTP server (caution!)")
 	rootCmd.Flags().StringVar(&config.SMTPRelayMatching, "smtp-relay-matching", config.SMTPRelayMatching, "Auto-relay new messages to only matching recipients (regular expression)")
+	rootCmd.Flags().StringVar(&config.SMTPRelayConfig.AllowedRecipients, "smtp-relay-allowed-recipients", config.SMTPRelayConfig.AllowedRecipients, "Only relay to recipients matching a regular expression (default allow all)")
+	rootCmd.Flags().StringVar(&config.SMTPRelayConfig.BlockedRecipients, "smtp-relay-blocked-recipients", config.SMTPRelayConfig.BlockedRecipients, "Never relay to recipients matching a regular expression, even if allowed")
+	rootCmd.Flags().BoolVar(&config.SMTPForwardingPaused, "smtp-forwarding-paused", config.SMTPForwardingPaused, "Disable all forwarding rules (can be changed at runtime)")
 
 	// POP3 server
 	rootCmd.Flags().StringVar(&config.POP3Listen, "pop3", config.POP3Listen, "POP3 server bind interface and port")
@@ -129,10 +183,17 @@ func init() {
 	// Tagging
 	rootCmd.Flags().StringVarP(&config.SMTPCLITags, "tag", "t", config.SMTPCLITags, "Tag new messages matching filters")
 	rootCmd.Flags().BoolVar(&tools.TagsTitleCase, "tags-title-case", tools.TagsTitleCase, "Convert new tags automatically to TitleCase")
+	rootCmd.Flags().StringVar(&config.TagRetention, "tag-retention", config.TagRetention, "Delete messages with a tag once older than a duration, eg: loadtest=1h,ci=2d")
+	rootCmd.Flags().BoolVar(&config.TagsFromPlusAddress, "tags-from-plus-address", config.TagsFromPlusAddress, "Tag new SMTP messages with the plus part of envelope recipients, eg: user+tagname@example.com")
+
+	rootCmd.Flags().StringVar(&config.MetadataHeaderPrefix, "metadata-header-prefix", config.MetadataHeaderPrefix, "Store & strip message headers with this prefix as message metadata, eg: X-Mailpit-Meta-")
 
 	// Webhook
 	rootCmd.Flags().StringVar(&config.WebhookURL, "webhook-url", config.WebhookURL, "Send a webhook request for new messages")
-	rootCmd.Flags().IntVar(&webhook.RateLimit, "webhook-limit", webhook.RateLimit, "Limit webhook requests per second")
+	rootCmd.Flags().IntVar(&webhook.RateLimit, "webhook-limit", webhook.RateLimit, "Limit --webhook-url requests per second")
+	rootCmd.Flags().StringVar(&config.WebhookSecret, "webhook-secret", config.WebhookSecret, "Optional secret to sign webhook requests")
+	rootCmd.Flags().IntVar(&config.WebhookRetries, "webhook-retries", config.WebhookRetries, "Number of times to retry failed webhook requests")
+	rootCmd.Flags().StringVar(&config.WebhooksConfigFile, "webhooks-config", config.WebhooksConfigFile, "YAML config file of webhook endpoints & subscribed events")
 
 	// DEPRECATED FLAG 2024/04/12 - but will not be removed to maintain backwards compatibility
 	rootCmd.Flags().StringVar(&config.Database, "db-file", config.Database, "Database file to store persistent data")
@@ -169,26 +230,64 @@ func initConfigFromEnv() {
 		config.Database = os.Getenv("MP_DATABASE")
 	}
 
+	if len(os.Getenv("MP_ENCRYPTION_KEY")) > 0 {
+		config.EncryptionKey = os.Getenv("MP_ENCRYPTION_KEY")
+	}
+	if len(os.Getenv("MP_ENCRYPTION_KEY_FILE")) > 0 {
+		config.EncryptionKeyFile = os.Getenv("MP_ENCRYPTION_KEY_FILE")
+	}
+	if getEnabledFromEnv("MP_DISABLE_BODY_INDEX") {
+		config.DisableBodyIndex = true
+	}
+
 	config.TenantID = os.Getenv("MP_TENANT_ID")
 
+	if len(os.Getenv("MP_LABEL")) > 0 {
+		config.Label = os.Getenv("MP_LABEL")
+	}
+
 	if len(os.Getenv("MP_MAX_MESSAGES")) > 0 {
 		config.MaxMessages, _ = strconv.Atoi(os.Getenv("MP_MAX_MESSAGES"))
 	}
 	if getEnabledFromEnv("MP_USE_MESSAGE_DATES") {
 		config.UseMessageDates = true
 	}
+	if len(os.Getenv("MP_PRUNE_ATTACHMENTS_AFTER")) > 0 {
+		config.PruneAttachmentsAfter = os.Getenv("MP_PRUNE_ATTACHMENTS_AFTER")
+	}
+	if getEnabledFromEnv("MP_PRUNE_ATTACHMENTS_KEEP_INLINE") {
+		config.PruneAttachmentsKeepInline = true
+	}
+	if getEnabledFromEnv("MP_TRASH") {
+		config.Trash = true
+	}
+	if len(os.Getenv("MP_TRASH_PURGE_AFTER")) > 0 {
+		config.TrashPurgeAfter = os.Getenv("MP_TRASH_PURGE_AFTER")
+	}
 	if getEnabledFromEnv("MP_IGNORE_DUPLICATE_IDS") {
 		config.IgnoreDuplicateIDs = true
 	}
 	if len(os.Getenv("MP_LOG_FILE")) > 0 {
 		logger.LogFile = os.Getenv("MP_LOG_FILE")
 	}
+	if len(os.Getenv("MP_LOG_FORMAT")) > 0 {
+		logger.LogFormat = os.Getenv("MP_LOG_FORMAT")
+	}
 	if getEnabledFromEnv("MP_QUIET") {
 		logger.QuietLogging = true
 	}
 	if getEnabledFromEnv("MP_VERBOSE") {
 		logger.VerboseLogging = true
 	}
+	if len(os.Getenv("MP_SYSLOG")) > 0 {
+		logger.SyslogAddress = os.Getenv("MP_SYSLOG")
+	}
+	if len(os.Getenv("MP_SYSLOG_FACILITY")) > 0 {
+		logger.SyslogFacility = os.Getenv("MP_SYSLOG_FACILITY")
+	}
+	if len(os.Getenv("MP_SYSLOG_TAG")) > 0 {
+		logger.SyslogTag = os.Getenv("MP_SYSLOG_TAG")
+	}
 
 	// Web UI & API
 	if len(os.Getenv("MP_UI_BIND_ADDR")) > 0 {
@@ -212,14 +311,46 @@ func initConfigFromEnv() {
 	if len(os.Getenv("MP_ENABLE_SPAMASSASSIN")) > 0 {
 		config.EnableSpamAssassin = os.Getenv("MP_ENABLE_SPAMASSASSIN")
 	}
+	if len(os.Getenv("MP_ENABLE_CLAMAV")) > 0 {
+		config.EnableClamAV = os.Getenv("MP_ENABLE_CLAMAV")
+	}
+	if len(os.Getenv("MP_HTML_CHECK_CLIENTS")) > 0 {
+		config.HTMLCheckClients = os.Getenv("MP_HTML_CHECK_CLIENTS")
+	}
+	if len(os.Getenv("MP_HTML_CHECK_PLATFORMS")) > 0 {
+		config.HTMLCheckPlatforms = os.Getenv("MP_HTML_CHECK_PLATFORMS")
+	}
+	if len(os.Getenv("MP_TRACKING_DOMAINS")) > 0 {
+		config.TrackingDomains = os.Getenv("MP_TRACKING_DOMAINS")
+	}
 	if getEnabledFromEnv("MP_ALLOW_UNTRUSTED_TLS") {
 		config.AllowUntrustedTLS = true
 	}
+	if len(os.Getenv("MP_OUTBOUND_PROXY")) > 0 {
+		config.OutboundProxy = os.Getenv("MP_OUTBOUND_PROXY")
+	}
+	if len(os.Getenv("MP_OUTBOUND_NO_PROXY")) > 0 {
+		config.OutboundNoProxy = os.Getenv("MP_OUTBOUND_NO_PROXY")
+	}
+	if len(os.Getenv("MP_OUTBOUND_BIND")) > 0 {
+		config.OutboundBind = os.Getenv("MP_OUTBOUND_BIND")
+	}
+	if len(os.Getenv("MP_OUTBOUND_CA_CERT")) > 0 {
+		config.OutboundCACert = os.Getenv("MP_OUTBOUND_CA_CERT")
+	}
 
 	// SMTP server
 	if len(os.Getenv("MP_SMTP_BIND_ADDR")) > 0 {
 		config.SMTPListen = os.Getenv("MP_SMTP_BIND_ADDR")
 	}
+	if len(os.Getenv("MP_LMTP_BIND_ADDR")) > 0 {
+		config.LMTPListen = os.Getenv("MP_LMTP_BIND_ADDR")
+	}
+	config.LMTPTLSCert = os.Getenv("MP_LMTP_TLS_CERT")
+	config.LMTPTLSKey = os.Getenv("MP_LMTP_TLS_KEY")
+	if getEnabledFromEnv("MP_LMTP_REQUIRE_STARTTLS") {
+		config.LMTPRequireSTARTTLS = true
+	}
 	config.SMTPAuthFile = os.Getenv("MP_SMTP_AUTH_FILE")
 	if err := auth.SetSMTPAuth(os.Getenv("MP_SMTP_AUTH")); err != nil {
 		logger.Log().Errorf(err.Error())
@@ -235,18 +366,51 @@ func initConfigFromEnv() {
 	if getEnabledFromEnv("MP_SMTP_REQUIRE_TLS") {
 		config.SMTPRequireTLS = true
 	}
+	if getEnabledFromEnv("MP_SMTP_REQUIRE_TLS_AUTH") {
+		config.SMTPRequireTLSAuth = true
+	}
 	if getEnabledFromEnv("MP_SMTP_AUTH_ALLOW_INSECURE") {
 		config.SMTPAuthAllowInsecure = true
 	}
 	if getEnabledFromEnv("MP_SMTP_STRICT_RFC_HEADERS") {
 		config.SMTPStrictRFCHeaders = true
 	}
+	if getEnabledFromEnv("MP_SMTP_STRICT_LINE_ENDINGS") {
+		config.SMTPStrictLineEndings = true
+	}
 	if len(os.Getenv("MP_SMTP_MAX_RECIPIENTS")) > 0 {
 		config.SMTPMaxRecipients, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_RECIPIENTS"))
 	}
+	if len(os.Getenv("MP_MAX_MESSAGE_SIZE")) > 0 {
+		config.MaxMessageSize = os.Getenv("MP_MAX_MESSAGE_SIZE")
+	}
+	if len(os.Getenv("MP_SMTP_MAX_CONNECTIONS")) > 0 {
+		config.SMTPMaxConnections, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_CONNECTIONS"))
+	}
+	if len(os.Getenv("MP_SMTP_MAX_CONNECTIONS_PER_IP")) > 0 {
+		config.SMTPMaxConnectionsPerIP, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_CONNECTIONS_PER_IP"))
+	}
+	if len(os.Getenv("MP_SMTP_MAX_MESSAGES_PER_CONNECTION")) > 0 {
+		config.SMTPMaxMessagesPerConnection, _ = strconv.Atoi(os.Getenv("MP_SMTP_MAX_MESSAGES_PER_CONNECTION"))
+	}
 	if len(os.Getenv("MP_SMTP_ALLOWED_RECIPIENTS")) > 0 {
 		config.SMTPAllowedRecipients = os.Getenv("MP_SMTP_ALLOWED_RECIPIENTS")
 	}
+	if len(os.Getenv("MP_SMTP_DENIED_RECIPIENTS")) > 0 {
+		config.SMTPDeniedRecipients = os.Getenv("MP_SMTP_DENIED_RECIPIENTS")
+	}
+	if len(os.Getenv("MP_SMTP_SENDER_QUOTA")) > 0 {
+		config.SMTPSenderQuota, _ = strconv.Atoi(os.Getenv("MP_SMTP_SENDER_QUOTA"))
+	}
+	if len(os.Getenv("MP_SMTP_SENDER_QUOTA_WINDOW")) > 0 {
+		config.SMTPSenderQuotaWindow = os.Getenv("MP_SMTP_SENDER_QUOTA_WINDOW")
+	}
+	if len(os.Getenv("MP_SMTP_SENDER_QUOTA_BY")) > 0 {
+		config.SMTPSenderQuotaBy = os.Getenv("MP_SMTP_SENDER_QUOTA_BY")
+	}
+	if len(os.Getenv("MP_SMTP_SENDER_QUOTA_EXEMPT")) > 0 {
+		config.SMTPSenderQuotaExempt = os.Getenv("MP_SMTP_SENDER_QUOTA_EXEMPT")
+	}
 	if getEnabledFromEnv("MP_SMTP_DISABLE_RDNS") {
 		smtpd.DisableReverseDNS = true
 	}
@@ -256,6 +420,9 @@ func initConfigFromEnv() {
 	if getEnabledFromEnv("MP_SMTP_RELAY_ALL") {
 		config.SMTPRelayAll = true
 	}
+	if getEnabledFromEnv("MP_SMTP_FORWARDING_PAUSED") {
+		config.SMTPForwardingPaused = true
+	}
 	config.SMTPRelayMatching = os.Getenv("MP_SMTP_RELAY_MATCHING")
 	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{}
 	config.SMTPRelayConfig.Host = os.Getenv("MP_SMTP_RELAY_HOST")
@@ -270,6 +437,7 @@ func initConfigFromEnv() {
 	config.SMTPRelayConfig.Secret = os.Getenv("MP_SMTP_RELAY_SECRET")
 	config.SMTPRelayConfig.ReturnPath = os.Getenv("MP_SMTP_RELAY_RETURN_PATH")
 	config.SMTPRelayConfig.AllowedRecipients = os.Getenv("MP_SMTP_RELAY_ALLOWED_RECIPIENTS")
+	config.SMTPRelayConfig.BlockedRecipients = os.Getenv("MP_SMTP_RELAY_BLOCKED_RECIPIENTS")
 
 	// POP3 server
 	if len(os.Getenv("MP_POP3_BIND_ADDR")) > 0 {
@@ -289,6 +457,16 @@ func initConfigFromEnv() {
 	if getEnabledFromEnv("MP_TAGS_TITLE_CASE") {
 		tools.TagsTitleCase = getEnabledFromEnv("MP_TAGS_TITLE_CASE")
 	}
+	if len(os.Getenv("MP_TAG_RETENTION")) > 0 {
+		config.TagRetention = os.Getenv("MP_TAG_RETENTION")
+	}
+	if getEnabledFromEnv("MP_TAGS_FROM_PLUS_ADDRESS") {
+		config.TagsFromPlusAddress = true
+	}
+
+	if len(os.Getenv("MP_METADATA_HEADER_PREFIX")) > 0 {
+		config.MetadataHeaderPrefix = os.Getenv("MP_METADATA_HEADER_PREFIX")
+	}
 
 	// Webhook
 	if len(os.Getenv("MP_WEBHOOK_URL")) > 0 {
@@ -297,6 +475,15 @@ func initConfigFromEnv() {
 	if len(os.Getenv("MP_WEBHOOK_LIMIT")) > 0 {
 		webhook.RateLimit, _ = strconv.Atoi(os.Getenv("MP_WEBHOOK_LIMIT"))
 	}
+	if len(os.Getenv("MP_WEBHOOK_SECRET")) > 0 {
+		config.WebhookSecret = os.Getenv("MP_WEBHOOK_SECRET")
+	}
+	if len(os.Getenv("MP_WEBHOOK_RETRIES")) > 0 {
+		config.WebhookRetries, _ = strconv.Atoi(os.Getenv("MP_WEBHOOK_RETRIES"))
+	}
+	if len(os.Getenv("MP_WEBHOOKS_CONFIG")) > 0 {
+		config.WebhooksConfigFile = os.Getenv("MP_WEBHOOKS_CONFIG")
+	}
 }
 
 // load deprecated settings from environment and warn
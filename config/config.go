@@ -10,9 +10,16 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/axllent/mailpit/internal/antivirus"
 	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/dkim"
+	"github.com/axllent/mailpit/internal/httpclient"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/spamassassin"
 	"github.com/axllent/mailpit/internal/tools"
@@ -23,22 +30,69 @@ var (
 	// SMTPListen to listen on <interface>:<port>
 	SMTPListen = "[::]:1025"
 
+	// LMTPListen to listen on <interface>:<port> or a unix socket (unix:<path> or an absolute path) - if set then
+	// Mailpit will also start an LMTP server, sharing the SMTP server configuration
+	LMTPListen string
+
+	// LMTPNetwork is the network of LMTPListen, either tcp or unix
+	LMTPNetwork = "tcp"
+
+	// LMTPTLSCert file, the LMTP server does not use the SMTP TLS settings
+	LMTPTLSCert string
+
+	// LMTPTLSKey file
+	LMTPTLSKey string
+
+	// LMTPRequireSTARTTLS to require LMTP clients to use STARTTLS
+	LMTPRequireSTARTTLS bool
+
 	// HTTPListen to listen on <interface>:<port>
 	HTTPListen = "[::]:8025"
 
 	// Database for mail (optional)
 	Database string
 
+	// EncryptionKey is an optional hex or base64-encoded AES key to encrypt stored raw messages.
+	// Note that the search index, subjects, addresses & snippets are not encrypted.
+	EncryptionKey string
+
+	// EncryptionKeyFile is an optional file containing the EncryptionKey
+	EncryptionKeyFile string
+
+	// DisableBodyIndex excludes message bodies from the search index & snippets
+	DisableBodyIndex bool
+
 	// TenantID is an optional prefix to be applied to all database tables,
 	// allowing multiple isolated instances of Mailpit to share a database.
 	TenantID = ""
 
+	// Label is an optional label to identify this Mailpit instance in the UI, API & events
+	Label string
+
 	// MaxMessages is the maximum number of messages a mailbox can have (auto-pruned every minute)
 	MaxMessages = 500
 
 	// UseMessageDates sets the Created date using the message date, not the delivered date
 	UseMessageDates bool
 
+	// PruneAttachmentsAfter will strip attachment data from messages older than this duration, eg: 30d (auto-pruned every minute)
+	PruneAttachmentsAfter string
+
+	// PruneAttachmentsAfterDuration is the parsed PruneAttachmentsAfter duration
+	PruneAttachmentsAfterDuration time.Duration
+
+	// PruneAttachmentsKeepInline will not strip inline attachments (eg: images) when pruning attachments
+	PruneAttachmentsKeepInline bool
+
+	// Trash moves deleted messages to the trash instead of deleting them
+	Trash bool
+
+	// TrashPurgeAfter permanently deletes messages once they have been in the trash for this duration, eg: 7d (auto-pruned every minute)
+	TrashPurgeAfter = "7d"
+
+	// TrashPurgeAfterDuration is the parsed TrashPurgeAfter duration
+	TrashPurgeAfterDuration time.Duration
+
 	// UITLSCert file
 	UITLSCert string
 
@@ -66,6 +120,9 @@ var (
 	//
 	SMTPRequireTLS bool
 
+	// SMTPRequireTLSAuth to only advertise & accept SMTP authentication once TLS is in use
+	SMTPRequireTLSAuth bool
+
 	// SMTPAuthFile for SMTP authentication
 	SMTPAuthFile string
 
@@ -80,6 +137,23 @@ var (
 	// however some servers accept more.
 	SMTPMaxRecipients = 100
 
+	// MaxMessageSize is the maximum size of a message accepted via SMTP, in bytes with optional K, M or G suffixes (0 = unlimited)
+	MaxMessageSize = "0"
+
+	// MaxMessageSizeBytes is the parsed MaxMessageSize
+	MaxMessageSizeBytes int
+
+	// SMTPMaxConnections is the maximum number of concurrent SMTP sessions (0 = unlimited).
+	// This defaults to 1000 (previously unlimited), set to 0 to restore the previous behaviour.
+	SMTPMaxConnections = 1000
+
+	// SMTPMaxConnectionsPerIP is the maximum number of concurrent SMTP sessions per IP address (0 = unlimited).
+	// This defaults to 100 (previously unlimited).
+	SMTPMaxConnectionsPerIP = 100
+
+	// SMTPMaxMessagesPerConnection is the maximum number of messages sent in a single SMTP session (0 = unlimited)
+	SMTPMaxMessagesPerConnection = 1000
+
 	// IgnoreDuplicateIDs will skip messages with the same ID
 	IgnoreDuplicateIDs bool
 
@@ -95,6 +169,17 @@ var (
 	// SMTPTags are expressions to apply tags to new mail
 	SMTPTags []AutoTag
 
+	// TagsFromPlusAddress will tag messages received via SMTP with the plus part of the envelope
+	// recipient addresses (RCPT TO), eg: user+tagname@example.com is tagged "tagname"
+	TagsFromPlusAddress bool
+
+	// TagRetention are comma-separated tag=duration pairs, messages with the tag are auto-deleted once
+	// older than the duration, eg: loadtest=1h,ci=2d (auto-pruned every minute)
+	TagRetention string
+
+	// TagRetentionRules are the parsed TagRetention rules
+	TagRetentionRules []TagRetentionRule
+
 	// SMTPRelayConfigFile to parse a yaml file and store config of relay SMTP server
 	SMTPRelayConfigFile string
 
@@ -105,12 +190,40 @@ var (
 	// @see https://github.com/axllent/mailpit/issues/87 & https://github.com/axllent/mailpit/issues/153
 	SMTPStrictRFCHeaders bool
 
+	// SMTPStrictLineEndings will reject messages containing bare <CR> or <LF> line endings,
+	// instead of normalising them to <CR><LF>
+	SMTPStrictLineEndings bool
+
 	// SMTPAllowedRecipients if set, will only accept recipients matching this regular expression
 	SMTPAllowedRecipients string
 
 	// SMTPAllowedRecipientsRegexp is the compiled version of SMTPAllowedRecipients
 	SMTPAllowedRecipientsRegexp *regexp.Regexp
 
+	// SMTPDeniedRecipients if set, will reject recipients matching this regular expression, even if allowed
+	SMTPDeniedRecipients string
+
+	// SMTPDeniedRecipientsRegexp is the compiled version of SMTPDeniedRecipients
+	SMTPDeniedRecipientsRegexp *regexp.Regexp
+
+	// SMTPSenderQuota is the maximum number of messages accepted per sender within SMTPSenderQuotaWindow (0 = unlimited)
+	SMTPSenderQuota = 0
+
+	// SMTPSenderQuotaWindow is the rolling sender quota window, eg: 1h or 1d
+	SMTPSenderQuotaWindow = "1h"
+
+	// SMTPSenderQuotaWindowDuration is the parsed SMTPSenderQuotaWindow duration
+	SMTPSenderQuotaWindowDuration time.Duration
+
+	// SMTPSenderQuotaBy is whether sender quotas apply per sender "address" (default) or "domain"
+	SMTPSenderQuotaBy = "address"
+
+	// SMTPSenderQuotaExempt if set, senders matching this regular expression are exempt from the sender quota
+	SMTPSenderQuotaExempt string
+
+	// SMTPSenderQuotaExemptRegexp is the compiled version of SMTPSenderQuotaExempt
+	SMTPSenderQuotaExemptRegexp *regexp.Regexp
+
 	// ReleaseEnabled is whether message releases are enabled, requires a valid SMTPRelayConfigFile
 	ReleaseEnabled = false
 
@@ -139,15 +252,54 @@ var (
 	// EnableSpamAssassin must be either <host>:<port> or "postmark"
 	EnableSpamAssassin string
 
+	// EnableClamAV must be either <host>:<port> or unix:<socket> of a clamd service
+	EnableClamAV string
+
+	// HTMLCheckClients is an optional comma-separated list of email clients to limit the HTML check to by default, eg: gmail,outlook
+	HTMLCheckClients string
+
+	// HTMLCheckPlatforms is an optional comma-separated list of platforms to limit the HTML check to by default, eg: desktop-app,webmail
+	HTMLCheckPlatforms string
+
+	// TrackingDomains is an optional comma-separated list of additional tracking domains for the tracking check
+	TrackingDomains string
+
+	// MetadataHeaderPrefix if set, will store message headers with this prefix as message metadata (eg: X-Mailpit-Meta-)
+	MetadataHeaderPrefix string
+
 	// WebhookURL for calling
 	WebhookURL string
 
+	// WebhookSecret is an optional secret used to sign WebhookURL requests (HMAC-SHA256)
+	WebhookSecret string
+
+	// WebhookRetries is the number of times a failed webhook delivery is retried
+	WebhookRetries = 3
+
+	// WebhooksConfigFile to parse a yaml file of webhook endpoints & their subscribed events
+	WebhooksConfigFile string
+
+	// Webhooks are the webhook endpoints parsed from WebhooksConfigFile
+	Webhooks []WebhookConfig
+
 	// ContentSecurityPolicy for HTTP server - set via VerifyConfig()
 	ContentSecurityPolicy string
 
 	// AllowUntrustedTLS allows untrusted HTTPS connections link checking & screenshot generation
 	AllowUntrustedTLS bool
 
+	// OutboundProxy is an optional proxy URL for outbound HTTP requests, overriding HTTP_PROXY & HTTPS_PROXY
+	OutboundProxy string
+
+	// OutboundNoProxy is an optional comma-separated list of hosts not to proxy, overriding NO_PROXY
+	OutboundNoProxy string
+
+	// OutboundBind is an optional local IP address or interface name for outbound HTTP requests
+	OutboundBind string
+
+	// OutboundCACert is an optional PEM file of additional CA certificates for outbound HTTPS requests
+	OutboundCACert string
+
 	// Version is the default application version, updated on release
 	Version = "dev"
 
@@ -161,12 +313,35 @@ var (
 	DisableHTMLCheck = false
 )
 
+// maximum length of the instance label
+const maxLabelLength = 32
+
 // AutoTag struct for auto-tagging
 type AutoTag struct {
 	Tag   string
 	Match string
 }
 
+// TagRetentionRule deletes messages with the tag once they are older than the duration
+type TagRetentionRule struct {
+	// Tag name
+	Tag string
+	// Retention as configured, eg: 1h or 2d
+	Retention string
+	// Duration is the parsed Retention
+	Duration time.Duration
+}
+
+// WebhookConfig is a webhook endpoint & the events it is subscribed to
+type WebhookConfig struct {
+	URL    string   `yaml:"url"`
+	Events []string `yaml:"events"` // subscribed event types, all events if empty
+	Secret string   `yaml:"secret"` // optional secret to sign requests (HMAC-SHA256)
+}
+
+// DefaultRelayProfile is the name of the main relay configuration
+const DefaultRelayProfile = "default"
+
 // SMTPRelayConfigStruct struct for parsing yaml & storing variables
 type SMTPRelayConfigStruct struct {
 	Host                    string         `yaml:"host"`
@@ -180,6 +355,25 @@ type SMTPRelayConfigStruct struct {
 	ReturnPath              string         `yaml:"return-path"`        // allow overriding the bounce address
 	AllowedRecipients       string         `yaml:"allowed-recipients"` // regex, if set needs to match for mails to be relayed
 	AllowedRecipientsRegexp *regexp.Regexp // compiled regexp using AllowedRecipients
+	BlockedRecipients       string         `yaml:"blocked-recipients"` // regex, if set and matching then mails are never relayed, even if allowed
+	BlockedRecipientsRegexp *regexp.Regexp // compiled regexp using BlockedRecipients
+	AllowedSenders          string         `yaml:"allowed-senders"` // regex, if set needs to match a release From override
+	AllowedSendersRegexp    *regexp.Regexp // compiled regexp using AllowedSenders
+	PoolSize                int            `yaml:"pool-size"`            // maximum number of reused connections, 0 to disable pooling
+	PoolIdleTimeout         int            `yaml:"pool-idle-timeout"`    // seconds before an idle pooled connection is closed
+	DeleteAfterRelease      bool           `yaml:"delete-after-release"` // delete messages once successfully released
+	ReleaseRateLimit        int            `yaml:"release-rate-limit"`   // maximum messages per second when releasing multiple messages, 0 for no limit
+	KeepReleaseHistory      bool           `yaml:"keep-release-history"` // keep the release history of messages after they are deleted
+	RetryCount              int            `yaml:"retry-count"`          // retries of temporary failures when releasing messages (not when auto-relaying)
+	DKIMDomain              string         `yaml:"dkim-domain"`          // DKIM signing domain (d=) of released messages
+	DKIMSelector            string         `yaml:"dkim-selector"`        // DKIM selector (s=) of released messages
+	DKIMPrivateKey          string         `yaml:"dkim-private-key"`     // path to the PEM encoded DKIM private key (RSA or Ed25519)
+	DKIMSigner              *dkim.Signer   `yaml:"-"`                    // DKIM signer, set if DKIM signing is configured
+	// additional named relay profiles, selected when releasing a message (not for auto-relaying). The
+	// release-rate-limit, delete-after-release & keep-release-history options only apply to the main config.
+	Profiles map[string]*SMTPRelayConfigStruct `yaml:"profiles"`
+	// Name of the relay profile, "default" for the main relay config
+	Name string `yaml:"-"`
 	// DEPRECATED 2024/03/12
 	RecipientAllowlist string `yaml:"recipient-allowlist"`
 }
@@ -195,6 +389,25 @@ func VerifyConfig() error {
 		cssFontRestriction, cssFontRestriction,
 	)
 
+	if EncryptionKeyFile != "" {
+		EncryptionKeyFile = filepath.Clean(EncryptionKeyFile)
+
+		if !isFile(EncryptionKeyFile) {
+			return fmt.Errorf("[db] encryption key file not found or readable: %s", EncryptionKeyFile)
+		}
+
+		b, err := os.ReadFile(EncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+
+		EncryptionKey = strings.TrimSpace(string(b))
+	}
+
+	if logger.LogFormat != "text" && logger.LogFormat != "json" {
+		return fmt.Errorf("[logger] invalid log format: %s (must be text or json)", logger.LogFormat)
+	}
+
 	if Database != "" && isDir(Database) {
 		Database = filepath.Join(Database, "mailpit.db")
 	}
@@ -209,6 +422,14 @@ func VerifyConfig() error {
 		}
 	}
 
+	Label = strings.TrimSpace(Label)
+	if utf8.RuneCountInString(Label) > maxLabelLength {
+		return fmt.Errorf("[ui] label cannot be longer than %d characters", maxLabelLength)
+	}
+	if strings.IndexFunc(Label, unicode.IsControl) > -1 {
+		return errors.New("[ui] label cannot contain control characters")
+	}
+
 	re := regexp.MustCompile(`.*:\d+$`)
 	if !re.MatchString(SMTPListen) {
 		return errors.New("[smtp] bind should be in the format of <ip>:<port>")
@@ -277,6 +498,12 @@ func VerifyConfig() error {
 	if SMTPRequireSTARTTLS && SMTPRequireTLS {
 		return errors.New("[smtp] TLS & STARTTLS cannot be required together")
 	}
+	if SMTPRequireTLSAuth && SMTPTLSCert == "" {
+		return errors.New("[smtp] TLS cannot be required for authentication without an SMTP TLS certificate and key")
+	}
+	if SMTPRequireTLSAuth && SMTPAuthAllowInsecure {
+		return errors.New("[smtp] TLS cannot be required for authentication with --smtp-auth-allow-insecure")
+	}
 
 	if SMTPAuthFile != "" {
 		SMTPAuthFile = filepath.Clean(SMTPAuthFile)
@@ -315,6 +542,42 @@ func VerifyConfig() error {
 		return errors.New("[smtp] authentication requires STARTTLS or TLS encryption, run with `--smtp-auth-allow-insecure` to allow insecure authentication")
 	}
 
+	// LMTP server
+	if strings.HasPrefix(LMTPListen, "unix:") || filepath.IsAbs(LMTPListen) {
+		LMTPNetwork = "unix"
+		LMTPListen = filepath.Clean(strings.TrimPrefix(LMTPListen, "unix:"))
+	} else if LMTPListen != "" {
+		if _, err := net.ResolveTCPAddr("tcp", LMTPListen); err != nil {
+			return fmt.Errorf("[lmtp] %s", err.Error())
+		}
+	}
+
+	if LMTPTLSCert != "" && LMTPTLSKey == "" || LMTPTLSCert == "" && LMTPTLSKey != "" {
+		return errors.New("[lmtp] You must provide both an LMTP TLS certificate and a key")
+	}
+
+	if LMTPTLSCert != "" {
+		LMTPTLSCert = filepath.Clean(LMTPTLSCert)
+		LMTPTLSKey = filepath.Clean(LMTPTLSKey)
+
+		if !isFile(LMTPTLSCert) {
+			return fmt.Errorf("[lmtp] TLS certificate not found or readable: %s", LMTPTLSCert)
+		}
+
+		if !isFile(LMTPTLSKey) {
+			return fmt.Errorf("[lmtp] TLS key not found or readable: %s", LMTPTLSKey)
+		}
+
+		if auth.SMTPCredentials != nil && !SMTPAuthAllowInsecure {
+			// as with SMTP, plaintext passwords are only accepted once STARTTLS has been negotiated
+			LMTPRequireSTARTTLS = true
+		}
+	} else if LMTPRequireSTARTTLS {
+		return errors.New("[lmtp] STARTTLS cannot be required without an LMTP TLS certificate and key")
+	} else if LMTPNetwork == "tcp" && LMTPListen != "" && (auth.SMTPCredentials != nil || SMTPAuthAcceptAny) && !SMTPAuthAllowInsecure {
+		return errors.New("[lmtp] authentication requires STARTTLS, set an LMTP TLS certificate and key, use a unix socket, or run with `--smtp-auth-allow-insecure` to allow insecure authentication")
+	}
+
 	// POP3 server
 	if POP3TLSCert != "" {
 		POP3TLSCert = filepath.Clean(POP3TLSCert)
@@ -363,10 +626,70 @@ func VerifyConfig() error {
 	s := strings.TrimRight(path.Join("/", Webroot, "/"), "/") + "/"
 	Webroot = s
 
+	if PruneAttachmentsAfter != "" {
+		d, err := tools.ParseDuration(PruneAttachmentsAfter)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid prune-attachments-after duration (%s), eg: 30d or 12h", PruneAttachmentsAfter)
+		}
+
+		PruneAttachmentsAfterDuration = d
+		logger.Log().Infof("[db] pruning attachments from messages older than %s", PruneAttachmentsAfter)
+	}
+
+	if TrashPurgeAfter != "" {
+		d, err := tools.ParseDuration(TrashPurgeAfter)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid trash-purge-after duration (%s), eg: 7d or 12h", TrashPurgeAfter)
+		}
+
+		TrashPurgeAfterDuration = d
+	}
+
+	if Trash {
+		logger.Log().Infof("[db] deleted messages are moved to the trash, purged after %s", TrashPurgeAfter)
+	}
+
+	if TagRetention != "" {
+		rules, err := ParseTagRetention(TagRetention)
+		if err != nil {
+			return err
+		}
+
+		TagRetentionRules = rules
+		logger.Log().Infof("[db] pruning tagged messages: %s", TagRetention)
+	}
+
 	if WebhookURL != "" && !isValidURL(WebhookURL) {
 		return fmt.Errorf("webhook URL does not appear to be a valid URL (%s)", WebhookURL)
 	}
 
+	if WebhookRetries < 0 {
+		return errors.New("webhook retries must be 0 or greater")
+	}
+
+	if err := parseWebhooksConfig(WebhooksConfigFile); err != nil {
+		return err
+	}
+
+	if err := httpclient.Configure(httpclient.Options{
+		Proxy:   OutboundProxy,
+		NoProxy: OutboundNoProxy,
+		Bind:    OutboundBind,
+		CACert:  OutboundCACert,
+	}); err != nil {
+		return fmt.Errorf("[http] %s", err.Error())
+	}
+
+	if OutboundProxy != "" {
+		if u, err := url.Parse(OutboundProxy); err == nil {
+			logger.Log().Infof("[http] outbound requests via proxy %s", u.Redacted())
+		}
+	}
+
+	if OutboundBind != "" {
+		logger.Log().Infof("[http] outbound requests from %s", OutboundBind)
+	}
+
 	// DEPRECATED 2024/04/13
 	if DisableHTMLCheck {
 		logger.Log().Warn("--disable-html-check has been deprecated and is no longer used")
@@ -381,6 +704,15 @@ func VerifyConfig() error {
 		}
 	}
 
+	if EnableClamAV != "" {
+		antivirus.SetService(EnableClamAV)
+		logger.Log().Infof("[clamav] enabled via %s", EnableClamAV)
+
+		if err := antivirus.Ping(); err != nil {
+			logger.Log().Warnf("[clamav] ping: %s", err.Error())
+		}
+	}
+
 	SMTPTags = []AutoTag{}
 
 	if SMTPCLITags != "" {
@@ -404,6 +736,23 @@ func VerifyConfig() error {
 		}
 	}
 
+	if SMTPMaxConnections < 0 || SMTPMaxConnectionsPerIP < 0 {
+		return errors.New("[smtp] max connections cannot be negative")
+	}
+
+	if SMTPMaxMessagesPerConnection < 0 {
+		return errors.New("[smtp] max messages per connection cannot be negative")
+	}
+
+	size, err := tools.ParseSize(MaxMessageSize)
+	if err != nil {
+		return fmt.Errorf("[smtp] invalid max-message-size (%s), eg: 512K or 25M", MaxMessageSize)
+	}
+	MaxMessageSizeBytes = size
+	if MaxMessageSizeBytes > 0 {
+		logger.Log().Infof("[smtp] limiting message size to %s", MaxMessageSize)
+	}
+
 	if SMTPAllowedRecipients != "" {
 		restrictRegexp, err := regexp.Compile(SMTPAllowedRecipients)
 		if err != nil {
@@ -414,6 +763,44 @@ func VerifyConfig() error {
 		logger.Log().Infof("[smtp] only allowing recipients matching regexp: %s", SMTPAllowedRecipients)
 	}
 
+	if SMTPDeniedRecipients != "" {
+		denyRegexp, err := regexp.Compile(SMTPDeniedRecipients)
+		if err != nil {
+			return fmt.Errorf("[smtp] failed to compile smtp-denied-recipients regexp: %s", err.Error())
+		}
+
+		SMTPDeniedRecipientsRegexp = denyRegexp
+		logger.Log().Infof("[smtp] rejecting recipients matching regexp: %s", SMTPDeniedRecipients)
+	}
+
+	if SMTPSenderQuota < 0 {
+		return errors.New("[smtp] sender quota cannot be negative")
+	}
+
+	SMTPSenderQuotaExemptRegexp = nil
+	if SMTPSenderQuota > 0 {
+		d, err := tools.ParseDuration(SMTPSenderQuotaWindow)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("[smtp] invalid smtp-sender-quota-window duration (%s), eg: 1h or 1d", SMTPSenderQuotaWindow)
+		}
+		SMTPSenderQuotaWindowDuration = d
+
+		if SMTPSenderQuotaBy != "address" && SMTPSenderQuotaBy != "domain" {
+			return fmt.Errorf("[smtp] invalid smtp-sender-quota-by (%s), must be address or domain", SMTPSenderQuotaBy)
+		}
+
+		if SMTPSenderQuotaExempt != "" {
+			exemptRegexp, err := regexp.Compile(SMTPSenderQuotaExempt)
+			if err != nil {
+				return fmt.Errorf("[smtp] failed to compile smtp-sender-quota-exempt regexp: %s", err.Error())
+			}
+
+			SMTPSenderQuotaExemptRegexp = exemptRegexp
+		}
+
+		logger.Log().Infof("[smtp] limiting senders to %d messages per %s (by %s)", SMTPSenderQuota, SMTPSenderQuotaWindow, SMTPSenderQuotaBy)
+	}
+
 	if err := parseRelayConfig(SMTPRelayConfigFile); err != nil {
 		return err
 	}
@@ -450,6 +837,44 @@ func VerifyConfig() error {
 	return nil
 }
 
+// ParseTagRetention parses comma-separated tag=duration pairs, eg: loadtest=1h,ci=2d
+func ParseTagRetention(s string) ([]TagRetentionRule, error) {
+	rules := []TagRetentionRule{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		tag, retention, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("[tag] invalid tag retention (%s), eg: loadtest=1h", pair)
+		}
+
+		tag = tools.CleanTag(tag)
+		if !ValidTagRegexp.MatchString(tag) {
+			return nil, fmt.Errorf("[tag] invalid tag (%s) - can only contain spaces, letters, numbers, - & _", tag)
+		}
+
+		retention = strings.TrimSpace(retention)
+		d, err := tools.ParseDuration(retention)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("[tag] invalid retention duration for %s (%s), eg: 30d or 12h", tag, retention)
+		}
+
+		for _, r := range rules {
+			if strings.EqualFold(r.Tag, tag) {
+				return nil, fmt.Errorf("[tag] duplicate tag retention for %s", tag)
+			}
+		}
+
+		rules = append(rules, TagRetentionRule{Tag: tag, Retention: retention, Duration: d})
+	}
+
+	return rules, nil
+}
+
 // Parse the SMTPRelayConfigFile (if set)
 func parseRelayConfig(c string) error {
 	if c == "" {
@@ -486,56 +911,225 @@ func parseRelayConfig(c string) error {
 	return nil
 }
 
-// Validate the SMTPRelayConfig (if Host is set)
+// Parse the WebhooksConfigFile (if set)
+func parseWebhooksConfig(c string) error {
+	if c == "" {
+		return nil
+	}
+
+	c = filepath.Clean(c)
+
+	if !isFile(c) {
+		return fmt.Errorf("[webhook] configuration not found or readable: %s", c)
+	}
+
+	data, err := os.ReadFile(c)
+	if err != nil {
+		return err
+	}
+
+	Webhooks = []WebhookConfig{}
+
+	if err := yaml.Unmarshal(data, &Webhooks); err != nil {
+		return fmt.Errorf("[webhook] %s", err.Error())
+	}
+
+	for _, w := range Webhooks {
+		if !isValidURL(w.URL) {
+			return fmt.Errorf("[webhook] URL does not appear to be a valid URL (%s)", w.URL)
+		}
+	}
+
+	return nil
+}
+
+// Validate the SMTPRelayConfig (if Host is set), including any named relay profiles
 func validateRelayConfig() error {
 	if SMTPRelayConfig.Host == "" {
 		return nil
 	}
 
-	if SMTPRelayConfig.Port == 0 {
-		SMTPRelayConfig.Port = 25 // default
+	SMTPRelayConfig.Name = DefaultRelayProfile
+
+	if err := validateRelayProfile(&SMTPRelayConfig); err != nil {
+		return err
 	}
 
-	SMTPRelayConfig.Auth = strings.ToLower(SMTPRelayConfig.Auth)
+	if SMTPRelayConfig.ReleaseRateLimit < 0 {
+		return fmt.Errorf("[smtp] relay release-rate-limit must be 0 or greater")
+	}
 
-	if SMTPRelayConfig.Auth == "" || SMTPRelayConfig.Auth == "none" || SMTPRelayConfig.Auth == "false" {
-		SMTPRelayConfig.Auth = "none"
-	} else if SMTPRelayConfig.Auth == "plain" {
-		if SMTPRelayConfig.Username == "" || SMTPRelayConfig.Password == "" {
-			return fmt.Errorf("[smtp] relay host username or password not set for PLAIN authentication")
+	for name, p := range SMTPRelayConfig.Profiles {
+		if name == DefaultRelayProfile {
+			return fmt.Errorf("[smtp] relay profile name %q is reserved for the main relay configuration", name)
 		}
-	} else if SMTPRelayConfig.Auth == "login" {
-		SMTPRelayConfig.Auth = "login"
-		if SMTPRelayConfig.Username == "" || SMTPRelayConfig.Password == "" {
-			return fmt.Errorf("[smtp] relay host username or password not set for LOGIN authentication")
+
+		if p == nil || p.Host == "" {
+			return fmt.Errorf("[smtp] relay profile %q host not set", name)
 		}
-	} else if strings.HasPrefix(SMTPRelayConfig.Auth, "cram") {
-		SMTPRelayConfig.Auth = "cram-md5"
-		if SMTPRelayConfig.Username == "" || SMTPRelayConfig.Secret == "" {
-			return fmt.Errorf("[smtp] relay host username or secret not set for CRAM-MD5 authentication")
+
+		if len(p.Profiles) > 0 {
+			return fmt.Errorf("[smtp] relay profile %q cannot contain profiles", name)
+		}
+
+		p.Name = name
+
+		if err := validateRelayProfile(p); err != nil {
+			return err
 		}
-	} else {
-		return fmt.Errorf("[smtp] relay authentication method not supported: %s", SMTPRelayConfig.Auth)
 	}
 
 	ReleaseEnabled = true
 
 	logger.Log().Infof("[smtp] enabling message relaying via %s:%d", SMTPRelayConfig.Host, SMTPRelayConfig.Port)
 
-	if SMTPRelayConfig.AllowedRecipients != "" {
-		allowlistRegexp, err := regexp.Compile(SMTPRelayConfig.AllowedRecipients)
+	for _, name := range RelayProfileNames()[1:] {
+		p := SMTPRelayConfig.Profiles[name]
+		logger.Log().Infof("[smtp] relay profile %q relays via %s:%d", name, p.Host, p.Port)
+	}
+
+	if SMTPRelayConfig.DeleteAfterRelease {
+		logger.Log().Info("[smtp] released messages will be deleted after sending")
+	}
+
+	if SMTPRelayConfig.ReleaseRateLimit > 0 {
+		logger.Log().Infof("[smtp] releasing multiple messages is limited to %d messages per second", SMTPRelayConfig.ReleaseRateLimit)
+	}
+
+	return nil
+}
+
+// ValidateRelayProfile validates the connection, authentication & address restrictions of a relay profile
+func validateRelayProfile(c *SMTPRelayConfigStruct) error {
+	// log & error prefix
+	prefix := "[smtp] relay"
+	if c.Name != DefaultRelayProfile {
+		prefix = fmt.Sprintf("[smtp] relay profile %q", c.Name)
+	}
+
+	if c.Port == 0 {
+		c.Port = 25 // default
+	}
+
+	c.Auth = strings.ToLower(c.Auth)
+
+	if c.Auth == "" || c.Auth == "none" || c.Auth == "false" {
+		c.Auth = "none"
+	} else if c.Auth == "plain" {
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("%s host username or password not set for PLAIN authentication", prefix)
+		}
+	} else if c.Auth == "login" {
+		c.Auth = "login"
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("%s host username or password not set for LOGIN authentication", prefix)
+		}
+	} else if strings.HasPrefix(c.Auth, "cram") {
+		c.Auth = "cram-md5"
+		if c.Username == "" || c.Secret == "" {
+			return fmt.Errorf("%s host username or secret not set for CRAM-MD5 authentication", prefix)
+		}
+	} else {
+		return fmt.Errorf("%s authentication method not supported: %s", prefix, c.Auth)
+	}
+
+	if c.PoolSize < 0 {
+		return fmt.Errorf("%s pool-size must be 0 or greater", prefix)
+	}
+
+	if c.PoolIdleTimeout < 0 {
+		return fmt.Errorf("%s pool-idle-timeout must be 0 or greater", prefix)
+	}
+
+	if c.PoolIdleTimeout == 0 {
+		c.PoolIdleTimeout = 30 // default
+	}
+
+	if c.RetryCount < 0 {
+		return fmt.Errorf("%s retry-count must be 0 or greater", prefix)
+	}
+
+	if c.RetryCount > 0 {
+		logger.Log().Infof("%s retrying temporary release failures up to %d times", prefix, c.RetryCount)
+	}
+
+	if c.PoolSize > 0 {
+		logger.Log().Infof("%s reusing up to %d relay connections (idle timeout %ds)", prefix, c.PoolSize, c.PoolIdleTimeout)
+	}
+
+	if c.AllowedRecipients != "" {
+		allowlistRegexp, err := regexp.Compile(c.AllowedRecipients)
 		if err != nil {
-			return fmt.Errorf("[smtp] failed to compile relay recipient allowlist regexp: %s", err.Error())
+			return fmt.Errorf("%s failed to compile recipient allowlist regexp: %s", prefix, err.Error())
+		}
+
+		c.AllowedRecipientsRegexp = allowlistRegexp
+		logger.Log().Infof("%s recipient allowlist is active with the following regexp: %s", prefix, c.AllowedRecipients)
+	}
+
+	if c.BlockedRecipients != "" {
+		blocklistRegexp, err := regexp.Compile(c.BlockedRecipients)
+		if err != nil {
+			return fmt.Errorf("%s failed to compile recipient blocklist regexp: %s", prefix, err.Error())
+		}
+
+		c.BlockedRecipientsRegexp = blocklistRegexp
+		logger.Log().Infof("%s recipient blocklist is active with the following regexp: %s", prefix, c.BlockedRecipients)
+	}
+
+	if c.AllowedSenders != "" {
+		sendersRegexp, err := regexp.Compile(c.AllowedSenders)
+		if err != nil {
+			return fmt.Errorf("%s failed to compile allowed-senders regexp: %s", prefix, err.Error())
+		}
+
+		c.AllowedSendersRegexp = sendersRegexp
+		logger.Log().Infof("%s From overrides are restricted to the following regexp: %s", prefix, c.AllowedSenders)
+	}
+
+	if c.DKIMDomain != "" || c.DKIMSelector != "" || c.DKIMPrivateKey != "" {
+		if c.DKIMDomain == "" || c.DKIMSelector == "" || c.DKIMPrivateKey == "" {
+			return fmt.Errorf("%s dkim-domain, dkim-selector & dkim-private-key must all be set for DKIM signing", prefix)
 		}
 
-		SMTPRelayConfig.AllowedRecipientsRegexp = allowlistRegexp
-		logger.Log().Infof("[smtp] relay recipient allowlist is active with the following regexp: %s", SMTPRelayConfig.AllowedRecipients)
+		signer, err := dkim.LoadSigner(c.DKIMDomain, c.DKIMSelector, filepath.Clean(c.DKIMPrivateKey))
+		if err != nil {
+			return fmt.Errorf("%s %s", prefix, err.Error())
+		}
 
+		c.DKIMSigner = signer
+		logger.Log().Infof("%s released messages are DKIM signed for %s (selector %s)", prefix, c.DKIMDomain, c.DKIMSelector)
 	}
 
 	return nil
 }
 
+// RelayProfile returns a relay profile by name, or the main relay configuration if the name is
+// empty or "default". An error listing the valid profile names is returned if the profile does not exist.
+func RelayProfile(name string) (*SMTPRelayConfigStruct, error) {
+	if name == "" || name == DefaultRelayProfile {
+		return &SMTPRelayConfig, nil
+	}
+
+	if p, ok := SMTPRelayConfig.Profiles[name]; ok && p != nil {
+		return p, nil
+	}
+
+	return nil, fmt.Errorf("Unknown relay profile %q, valid profiles are: %s", name, strings.Join(RelayProfileNames(), ", "))
+}
+
+// RelayProfileNames returns the names of the relay profiles, starting with "default" followed by
+// the named profiles in alphabetical order
+func RelayProfileNames() []string {
+	names := []string{}
+	for name := range SMTPRelayConfig.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return append([]string{DefaultRelayProfile}, names...)
+}
+
 // IsFile returns whether a file exists and is readable
 func isFile(path string) bool {
 	f, err := os.Open(filepath.Clean(path))
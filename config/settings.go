@@ -0,0 +1,376 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/tools"
+)
+
+// SMTPRelayPaused temporarily disables auto-relaying (SMTPRelayAll & SMTPRelayMatching),
+// this is a runtime setting only
+var SMTPRelayPaused bool
+
+// SMTPForwardingPaused disables all forwarding rules, including pending retries
+var SMTPForwardingPaused bool
+
+// ConnectionLimitsChanged is an optional callback when the SMTP connection limits are changed at runtime,
+// used by the SMTP server to apply the new limits to new connections
+var ConnectionLimitsChanged func(max, perIP int)
+
+// runtimeSettingsMu ensures runtime setting changes are validated & applied one at a time, and that
+// readers (see Runtime) never see a partially applied change
+var runtimeSettingsMu sync.RWMutex
+
+// RuntimeSnapshot is a consistent copy of the settings which can be changed at runtime. Code which runs while
+// the settings API is available (SMTP sessions, relaying, forwarding, webhooks & cron jobs) must read these
+// settings via Runtime() rather than the package variables, which are only safe to read during startup.
+type RuntimeSnapshot struct {
+	MaxMessages                 int
+	PruneAttachmentsAfter       time.Duration
+	SMTPAllowedRecipientsRegexp *regexp.Regexp
+	SMTPDeniedRecipientsRegexp  *regexp.Regexp
+	SMTPSenderQuota             int
+	SMTPSenderQuotaWindow       time.Duration
+	SMTPRelayAll                bool
+	SMTPRelayMatchingRegexp     *regexp.Regexp
+	SMTPRelayPaused             bool
+	SMTPForwardingPaused        bool
+	TagRetention                string
+	TagRetentionRules           []TagRetentionRule
+	WebhookRetries              int
+	SMTPMaxConnections          int
+	SMTPMaxConnectionsPerIP     int
+}
+
+// Runtime returns a snapshot of the current runtime settings
+func Runtime() RuntimeSnapshot {
+	runtimeSettingsMu.RLock()
+	defer runtimeSettingsMu.RUnlock()
+
+	return RuntimeSnapshot{
+		MaxMessages:                 MaxMessages,
+		PruneAttachmentsAfter:       PruneAttachmentsAfterDuration,
+		SMTPAllowedRecipientsRegexp: SMTPAllowedRecipientsRegexp,
+		SMTPDeniedRecipientsRegexp:  SMTPDeniedRecipientsRegexp,
+		SMTPSenderQuota:             SMTPSenderQuota,
+		SMTPSenderQuotaWindow:       SMTPSenderQuotaWindowDuration,
+		SMTPRelayAll:                SMTPRelayAll,
+		SMTPRelayMatchingRegexp:     SMTPRelayMatchingRegexp,
+		SMTPRelayPaused:             SMTPRelayPaused,
+		SMTPForwardingPaused:        SMTPForwardingPaused,
+		TagRetention:                TagRetention,
+		TagRetentionRules:           TagRetentionRules,
+		WebhookRetries:              WebhookRetries,
+		SMTPMaxConnections:          SMTPMaxConnections,
+		SMTPMaxConnectionsPerIP:     SMTPMaxConnectionsPerIP,
+	}
+}
+
+// RuntimeSetting is a setting which can be changed at runtime
+type runtimeSetting struct {
+	// get returns the current value
+	get func() interface{}
+	// parse validates a new value, returning a function to apply it. Derived values
+	// such as compiled regular expressions are prepared before being swapped in.
+	parse func(v interface{}) (func(), error)
+}
+
+// RuntimeSettings is the allowlist of settings which can be changed at runtime.
+// Settings containing secrets (eg: relay passwords) must never be added.
+var runtimeSettings = map[string]runtimeSetting{
+	"max-messages": {
+		get: func() interface{} { return MaxMessages },
+		parse: func(v interface{}) (func(), error) {
+			n, err := settingInt(v)
+			if err != nil || n < 0 {
+				return nil, errors.New("must be a number greater than or equal to 0")
+			}
+
+			return func() { MaxMessages = n }, nil
+		},
+	},
+	"prune-attachments-after": {
+		get: func() interface{} { return PruneAttachmentsAfter },
+		parse: func(v interface{}) (func(), error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("must be a string")
+			}
+
+			s = strings.TrimSpace(s)
+			if s == "" {
+				return func() { PruneAttachmentsAfter, PruneAttachmentsAfterDuration = "", 0 }, nil
+			}
+
+			d, err := tools.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid duration (%s), eg: 30d or 12h", s)
+			}
+
+			return func() { PruneAttachmentsAfter, PruneAttachmentsAfterDuration = s, d }, nil
+		},
+	},
+	"smtp-allowed-recipients": {
+		get: func() interface{} { return SMTPAllowedRecipients },
+		parse: func(v interface{}) (func(), error) {
+			s, re, err := settingRegexp(v)
+			if err != nil {
+				return nil, err
+			}
+
+			return func() { SMTPAllowedRecipients, SMTPAllowedRecipientsRegexp = s, re }, nil
+		},
+	},
+	"smtp-denied-recipients": {
+		get: func() interface{} { return SMTPDeniedRecipients },
+		parse: func(v interface{}) (func(), error) {
+			s, re, err := settingRegexp(v)
+			if err != nil {
+				return nil, err
+			}
+
+			return func() { SMTPDeniedRecipients, SMTPDeniedRecipientsRegexp = s, re }, nil
+		},
+	},
+	"smtp-sender-quota": {
+		get: func() interface{} { return SMTPSenderQuota },
+		parse: func(v interface{}) (func(), error) {
+			n, err := settingInt(v)
+			if err != nil || n < 0 {
+				return nil, errors.New("must be a number greater than or equal to 0")
+			}
+
+			// the window is only parsed at startup if a quota was set
+			d, err := tools.ParseDuration(SMTPSenderQuotaWindow)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid smtp-sender-quota-window duration (%s)", SMTPSenderQuotaWindow)
+			}
+
+			return func() { SMTPSenderQuota, SMTPSenderQuotaWindowDuration = n, d }, nil
+		},
+	},
+	"smtp-sender-quota-window": {
+		get: func() interface{} { return SMTPSenderQuotaWindow },
+		parse: func(v interface{}) (func(), error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("must be a string")
+			}
+
+			s = strings.TrimSpace(s)
+			d, err := tools.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid duration (%s), eg: 1h or 1d", s)
+			}
+
+			return func() { SMTPSenderQuotaWindow, SMTPSenderQuotaWindowDuration = s, d }, nil
+		},
+	},
+	"smtp-relay-all": {
+		get: func() interface{} { return SMTPRelayAll },
+		parse: func(v interface{}) (func(), error) {
+			b, ok := v.(bool)
+			if !ok {
+				return nil, errors.New("must be a boolean")
+			}
+
+			if b && !ReleaseEnabled {
+				return nil, errors.New("a relay configuration must be set to auto-relay any messages")
+			}
+
+			return func() { SMTPRelayAll = b }, nil
+		},
+	},
+	"smtp-relay-matching": {
+		get: func() interface{} { return SMTPRelayMatching },
+		parse: func(v interface{}) (func(), error) {
+			s, re, err := settingRegexp(v)
+			if err != nil {
+				return nil, err
+			}
+
+			if s != "" && !ReleaseEnabled {
+				return nil, errors.New("a relay configuration must be set to auto-relay any messages")
+			}
+
+			return func() { SMTPRelayMatching, SMTPRelayMatchingRegexp = s, re }, nil
+		},
+	},
+	"smtp-relay-paused": {
+		get: func() interface{} { return SMTPRelayPaused },
+		parse: func(v interface{}) (func(), error) {
+			b, ok := v.(bool)
+			if !ok {
+				return nil, errors.New("must be a boolean")
+			}
+
+			return func() { SMTPRelayPaused = b }, nil
+		},
+	},
+	"smtp-forwarding-paused": {
+		get: func() interface{} { return SMTPForwardingPaused },
+		parse: func(v interface{}) (func(), error) {
+			b, ok := v.(bool)
+			if !ok {
+				return nil, errors.New("must be a boolean")
+			}
+
+			return func() { SMTPForwardingPaused = b }, nil
+		},
+	},
+	"tag-retention": {
+		get: func() interface{} { return TagRetention },
+		parse: func(v interface{}) (func(), error) {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("must be a string")
+			}
+
+			rules, err := ParseTagRetention(s)
+			if err != nil {
+				return nil, errors.New(strings.TrimPrefix(err.Error(), "[tag] "))
+			}
+
+			return func() { TagRetention, TagRetentionRules = strings.TrimSpace(s), rules }, nil
+		},
+	},
+	"smtp-max-connections": {
+		get: func() interface{} { return SMTPMaxConnections },
+		parse: func(v interface{}) (func(), error) {
+			n, err := settingInt(v)
+			if err != nil || n < 0 {
+				return nil, errors.New("must be a number greater than or equal to 0")
+			}
+
+			return func() {
+				SMTPMaxConnections = n
+				if ConnectionLimitsChanged != nil {
+					ConnectionLimitsChanged(SMTPMaxConnections, SMTPMaxConnectionsPerIP)
+				}
+			}, nil
+		},
+	},
+	"smtp-max-connections-per-ip": {
+		get: func() interface{} { return SMTPMaxConnectionsPerIP },
+		parse: func(v interface{}) (func(), error) {
+			n, err := settingInt(v)
+			if err != nil || n < 0 {
+				return nil, errors.New("must be a number greater than or equal to 0")
+			}
+
+			return func() {
+				SMTPMaxConnectionsPerIP = n
+				if ConnectionLimitsChanged != nil {
+					ConnectionLimitsChanged(SMTPMaxConnections, SMTPMaxConnectionsPerIP)
+				}
+			}, nil
+		},
+	},
+	"webhook-retries": {
+		get: func() interface{} { return WebhookRetries },
+		parse: func(v interface{}) (func(), error) {
+			n, err := settingInt(v)
+			if err != nil || n < 0 {
+				return nil, errors.New("must be a number greater than or equal to 0")
+			}
+
+			return func() { WebhookRetries = n }, nil
+		},
+	},
+}
+
+// RuntimeSettings returns the current values of all runtime settings
+func RuntimeSettings() map[string]interface{} {
+	runtimeSettingsMu.RLock()
+	defer runtimeSettingsMu.RUnlock()
+
+	res := map[string]interface{}{}
+	for k, s := range runtimeSettings {
+		res[k] = s.get()
+	}
+
+	return res
+}
+
+// ApplyRuntimeSettings validates & applies runtime setting changes. Either all changes
+// are applied, or none if any setting is unknown or invalid.
+func ApplyRuntimeSettings(changes map[string]interface{}) error {
+	runtimeSettingsMu.Lock()
+	defer runtimeSettingsMu.Unlock()
+
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	apply := []func(){}
+
+	for _, k := range keys {
+		s, ok := runtimeSettings[k]
+		if !ok {
+			return fmt.Errorf("%s is not a runtime setting", k)
+		}
+
+		fn, err := s.parse(changes[k])
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", k, err.Error())
+		}
+
+		apply = append(apply, fn)
+	}
+
+	for i, fn := range apply {
+		old := runtimeSettings[keys[i]].get()
+		fn()
+		logger.Log().Infof("[settings] %s changed from %v to %v", keys[i], old, runtimeSettings[keys[i]].get())
+	}
+
+	return nil
+}
+
+// SettingInt returns an integer from a JSON number
+func settingInt(v interface{}) (int, error) {
+	f, ok := v.(float64)
+	if !ok {
+		if n, ok := v.(int); ok {
+			return n, nil
+		}
+
+		return 0, errors.New("must be a number")
+	}
+
+	if f != math.Trunc(f) || f > math.MaxInt32 || f < math.MinInt32 {
+		return 0, errors.New("must be a whole number")
+	}
+
+	return int(f), nil
+}
+
+// SettingRegexp returns a compiled regular expression from a string, nil if empty
+func settingRegexp(v interface{}) (string, *regexp.Regexp, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", nil, errors.New("must be a string")
+	}
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil, nil
+	}
+
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid regular expression: %s", err.Error())
+	}
+
+	return s, re, nil
+}
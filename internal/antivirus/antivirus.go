@@ -0,0 +1,214 @@
+// Package antivirus scans messages & attachments for viruses using ClamAV (clamd)
+package antivirus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// the maximum size of each INSTREAM chunk
+const chunkSize = 64 * 1024
+
+var (
+	// Service to use, either "<host>:<port>" or "unix:<socket>"
+	service string
+
+	// Timeout in seconds
+	timeout = 30
+)
+
+// Result is a ClamAV result
+//
+// swagger:model AntivirusResponse
+type Result struct {
+	// Whether the message & all parts are clean
+	Clean bool
+	// If populated will return an error string, eg: if clamd is unavailable
+	Error string
+	// Verdicts of the raw message (PartID "raw") followed by each part
+	Parts []PartResult
+}
+
+// PartResult is the verdict of a scanned message or part
+type PartResult struct {
+	// Part ID, or "raw" for the raw message
+	PartID string
+	// File name
+	FileName string
+	// Whether the part is clean
+	Clean bool
+	// Virus signature if not clean
+	Signature string
+}
+
+// SetService defines the clamd service, either "<host>:<port>" or "unix:<socket>"
+func SetService(s string) {
+	service = s
+}
+
+// SetTimeout defines the timeout
+func SetTimeout(t int) {
+	if t > 0 {
+		timeout = t
+	}
+}
+
+// Ping returns whether the clamd service is active or not
+func Ping() error {
+	res, err := command("zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+
+	if res != "PONG" {
+		return fmt.Errorf("unexpected clamd response: %s", res)
+	}
+
+	return nil
+}
+
+// Check streams the raw message, and then each part, to clamd returning a Result
+func Check(msg []byte, parts []*enmime.Part) (Result, error) {
+	r := Result{Clean: true, Parts: []PartResult{}}
+
+	if service == "" {
+		return r, errors.New("no ClamAV service defined")
+	}
+
+	raw, err := scan(msg)
+	if err != nil {
+		r.Clean = false
+		r.Error = err.Error()
+		return r, nil
+	}
+	raw.PartID = "raw"
+	r.Parts = append(r.Parts, raw)
+
+	for _, p := range parts {
+		res, err := scan(p.Content)
+		if err != nil {
+			r.Clean = false
+			r.Error = fmt.Sprintf("part %s: %s", p.PartID, err.Error())
+			return r, nil
+		}
+
+		res.PartID = p.PartID
+		res.FileName = p.FileName
+		r.Parts = append(r.Parts, res)
+	}
+
+	for _, p := range r.Parts {
+		if !p.Clean {
+			r.Clean = false
+		}
+	}
+
+	return r, nil
+}
+
+// Scan returns the verdict of data using the INSTREAM command
+func scan(data []byte) (PartResult, error) {
+	r := PartResult{}
+
+	if data == nil {
+		// an empty stream still requires the terminating chunk
+		data = []byte{}
+	}
+
+	res, err := command("zINSTREAM\x00", data)
+	if err != nil {
+		return r, err
+	}
+
+	// responses are "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	res = strings.TrimPrefix(res, "stream: ")
+
+	switch {
+	case res == "OK":
+		r.Clean = true
+	case strings.HasSuffix(res, " FOUND"):
+		r.Signature = strings.TrimSuffix(res, " FOUND")
+	case strings.HasSuffix(res, " ERROR"):
+		return r, fmt.Errorf("clamd error: %s", strings.TrimSuffix(res, " ERROR"))
+	default:
+		return r, fmt.Errorf("unexpected clamd response: %s", res)
+	}
+
+	return r, nil
+}
+
+// Command sends a null-terminated command to clamd, streaming the data (if set) in chunks,
+// and returns the response. The whole exchange is limited by the timeout.
+func command(cmd string, data []byte) (string, error) {
+	conn, err := dial()
+	if err != nil {
+		return "", fmt.Errorf("unable to connect to clamd: %s", err.Error())
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
+		return "", err
+	}
+
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return "", wrapError(err)
+	}
+
+	if data != nil {
+		size := make([]byte, 4)
+		for len(data) > 0 {
+			chunk := data
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+			data = data[len(chunk):]
+
+			binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+			if _, err := conn.Write(append(size, chunk...)); err != nil {
+				return "", wrapError(err)
+			}
+		}
+
+		// a zero-length chunk terminates the stream
+		if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return "", wrapError(err)
+		}
+	}
+
+	// responses are null-terminated
+	res, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || res == "") {
+		return "", wrapError(err)
+	}
+
+	return strings.TrimRight(res, "\x00\n"), nil
+}
+
+// Dial connects to clamd through TCP or a Unix socket
+func dial() (net.Conn, error) {
+	d := time.Duration(timeout) * time.Second
+
+	if strings.HasPrefix(service, "unix:") {
+		return net.DialTimeout("unix", strings.TrimPrefix(service, "unix:"), d)
+	}
+
+	return net.DialTimeout("tcp", service, d)
+}
+
+// WrapError returns a clear error for timeouts
+func wrapError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("clamd did not respond within %d seconds", timeout)
+	}
+
+	return err
+}
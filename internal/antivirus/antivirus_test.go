@@ -0,0 +1,164 @@
+package antivirus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// fakeClamd starts a clamd server which detects "EICAR" in the stream, or never responds if hang is set
+func fakeClamd(t *testing.T, hang bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil {
+					return
+				}
+
+				if hang {
+					time.Sleep(3 * time.Second)
+					return
+				}
+
+				if cmd == "zPING\x00" {
+					_, _ = conn.Write([]byte("PONG\x00"))
+					return
+				}
+
+				data := []byte{}
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(r, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+
+				if bytes.Contains(data, []byte("EICAR")) {
+					_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					_, _ = conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestCheck(t *testing.T) {
+	SetService(fakeClamd(t, false))
+	defer SetService("")
+
+	if err := Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	parts := []*enmime.Part{
+		{PartID: "2", FileName: "report.pdf", Content: []byte("clean")},
+		// larger than a single chunk
+		{PartID: "3", FileName: "virus.com", Content: append(bytes.Repeat([]byte("x"), chunkSize*2), []byte("EICAR")...)},
+		{PartID: "4", FileName: "empty.txt"},
+	}
+
+	res, err := Check([]byte("Subject: test\r\n\r\nclean"), parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+
+	if res.Clean || len(res.Parts) != 4 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	if res.Parts[0].PartID != "raw" || !res.Parts[0].Clean {
+		t.Errorf("unexpected raw message verdict: %+v", res.Parts[0])
+	}
+
+	if !res.Parts[1].Clean || res.Parts[1].FileName != "report.pdf" {
+		t.Errorf("unexpected part verdict: %+v", res.Parts[1])
+	}
+
+	if res.Parts[2].Clean || res.Parts[2].Signature != "Eicar-Test-Signature" {
+		t.Errorf("unexpected part verdict: %+v", res.Parts[2])
+	}
+
+	if !res.Parts[3].Clean {
+		t.Errorf("unexpected part verdict: %+v", res.Parts[3])
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	defer SetService("")
+
+	if _, err := Check([]byte("test"), nil); err == nil {
+		t.Error("expected an error without a service")
+	}
+
+	// unreachable
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	SetService(addr)
+	res, err := Check([]byte("test"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.Error, "unable to connect to clamd") || res.Clean {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	// timeout
+	defer SetTimeout(timeout)
+	SetTimeout(1)
+	SetService(fakeClamd(t, true))
+
+	start := time.Now()
+	res, err = Check([]byte("test"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error != "clamd did not respond within 1 seconds" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("timeout was not applied")
+	}
+}
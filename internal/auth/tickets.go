@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+var (
+	// WebsocketTicketTTL is how long a websocket ticket remains valid
+	WebsocketTicketTTL = 30 * time.Second
+
+	ticketsMu sync.Mutex
+	tickets   = map[string]time.Time{}
+)
+
+// NewWebsocketTicket returns a new single-use ticket for authenticating a websocket connection,
+// as browsers cannot set authentication headers when opening a websocket
+func NewWebsocketTicket() (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+
+	ticket := hex.EncodeToString(b)
+	expires := time.Now().Add(WebsocketTicketTTL)
+
+	ticketsMu.Lock()
+	defer ticketsMu.Unlock()
+
+	// remove expired tickets
+	for t, exp := range tickets {
+		if time.Now().After(exp) {
+			delete(tickets, t)
+		}
+	}
+
+	tickets[ticket] = expires
+
+	return ticket, expires, nil
+}
+
+// ValidWebsocketTicket returns whether a websocket ticket is valid. Tickets can only be used once.
+func ValidWebsocketTicket(ticket string) bool {
+	if ticket == "" {
+		return false
+	}
+
+	ticketsMu.Lock()
+	defer ticketsMu.Unlock()
+
+	expires, ok := tickets[ticket]
+	if !ok {
+		return false
+	}
+
+	delete(tickets, ticket)
+
+	return time.Now().Before(expires)
+}
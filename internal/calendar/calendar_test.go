@@ -0,0 +1,140 @@
+package calendar
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testInvite = strings.ReplaceAll(`BEGIN:VCALENDAR
+PRODID:-//Microsoft Corporation//Outlook 16.0 MIMEDIR//EN
+VERSION:2.0
+METHOD:REQUEST
+BEGIN:VTIMEZONE
+TZID:W. Europe Standard Time
+BEGIN:STANDARD
+DTSTART:16011028T030000
+RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=10
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:16010325T020000
+RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=3
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+END:DAYLIGHT
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:040000008200E00074C5B7101A82E008
+SUMMARY:Project kick-off\, planning
+DESCRIPTION:Agenda:\n1. Introductions\n2. Time
+ line
+ORGANIZER;CN="Smith, Jane":mailto:jane@example.com
+ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE;CN=John Doe:
+ MAILTO:john@example.com
+ATTENDEE;ROLE=OPT-PARTICIPANT;PARTSTAT=ACCEPTED;CN=Sam:mailto:sam@example.com
+DTSTART;TZID=W. Europe Standard Time:20240704T100000
+DTEND;TZID=W. Europe Standard Time:20240704T113000
+RRULE:FREQ=WEEKLY;COUNT=4
+SEQUENCE:2
+END:VEVENT
+BEGIN:VTODO
+UID:todo-1
+SUMMARY:Send minutes
+DTSTART;TZID=America/New_York:20240110T090000
+DURATION:PT1H30M
+END:VTODO
+END:VCALENDAR
+`, "\n", "\r\n")
+
+func TestParse(t *testing.T) {
+	cal, err := Parse([]byte(testInvite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, cal.Method, "REQUEST", "method")
+	assertEqual(t, len(cal.Events), 2, "events")
+
+	e := cal.Events[0]
+	assertEqual(t, e.Type, "VEVENT", "type")
+	assertEqual(t, e.Summary, "Project kick-off, planning", "summary")
+	assertEqual(t, e.Description, "Agenda:\n1. Introductions\n2. Timeline", "description")
+	assertEqual(t, e.Sequence, 2, "sequence")
+	assertEqual(t, e.RRule, "FREQ=WEEKLY;COUNT=4", "rrule")
+	assertEqual(t, e.Organizer.Name, "Smith, Jane", "organizer name")
+	assertEqual(t, e.Organizer.Email, "jane@example.com", "organizer email")
+	assertEqual(t, len(e.Attendees), 2, "attendees")
+	assertEqual(t, e.Attendees[0].Email, "john@example.com", "attendee email")
+	assertEqual(t, e.Attendees[0].RSVP, true, "attendee rsvp")
+	assertEqual(t, e.Attendees[1].PartStat, "ACCEPTED", "attendee partstat")
+	// daylight saving time
+	assertEqual(t, e.Start.Format(time.RFC3339), "2024-07-04T10:00:00+02:00", "start")
+	assertEqual(t, e.End.Format(time.RFC3339), "2024-07-04T11:30:00+02:00", "end")
+
+	todo := cal.Events[1]
+	assertEqual(t, todo.Type, "VTODO", "type")
+	assertEqual(t, todo.Start.Format(time.RFC3339), "2024-01-10T09:00:00-05:00", "start")
+	assertEqual(t, todo.End.Format(time.RFC3339), "2024-01-10T10:30:00-05:00", "end")
+}
+
+func TestTimezoneResolve(t *testing.T) {
+	cal, err := Parse([]byte(strings.ReplaceAll(testInvite, "20240704T100000", "20241215T100000")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// standard time
+	assertEqual(t, cal.Events[0].Start.Format(time.RFC3339), "2024-12-15T10:00:00+01:00", "start")
+
+	tests := map[string]string{
+		"20240330T120000": "+01:00",
+		"20240331T120000": "+02:00",
+		"20241026T120000": "+02:00",
+		"20241027T120000": "+01:00",
+	}
+
+	for local, offset := range tests {
+		cal, err := Parse([]byte(strings.ReplaceAll(testInvite, "20240704T100000", local)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, cal.Events[0].Start.Format("-07:00"), offset, local)
+	}
+}
+
+func TestParseAllDay(t *testing.T) {
+	cal, err := Parse([]byte("BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART;VALUE=DATE:20240101\nDTEND;VALUE=DATE:20240102\nEND:VEVENT\nEND:VCALENDAR\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, cal.Events[0].AllDay, true, "all day")
+	assertEqual(t, cal.Events[0].Start.Format(time.RFC3339), "2024-01-01T00:00:00Z", "start")
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"BEGIN:VEVENT\nEND:VEVENT\n":                                                                       "missing BEGIN:VCALENDAR",
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nEND:VCALENDAR\n":                                                   "unexpected END:VCALENDAR",
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\n":                                                                  "missing END:VEVENT",
+		"BEGIN:VCALENDAR\nthis is not a calendar\nEND:VCALENDAR\n":                                         "expected NAME:value",
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART:2024-01-01\nEND:VEVENT\nEND:VCALENDAR\n":                   "invalid DTSTART time",
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART;TZID=Nowhere:20240101T100000\nEND:VEVENT\nEND:VCALENDAR\n": "unknown DTSTART timezone",
+	}
+
+	for ics, expected := range tests {
+		_, err := Parse([]byte(ics))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing \"%s\", got %v", expected, err)
+		}
+	}
+}
+
+func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
+	if a == b {
+		return
+	}
+	t.Fatalf("%s: \"%v\" != \"%v\"", message, a, b)
+}
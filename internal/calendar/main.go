@@ -0,0 +1,363 @@
+// Package calendar parses iCalendar (RFC 5545) data, such as meeting invitations
+package calendar
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationRe = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Property is a single content line, eg: `DTSTART;TZID=Europe/London:20240101T090000`
+type property struct {
+	// uppercase name
+	name string
+	// parameters with uppercase names & unquoted values
+	params map[string]string
+	value  string
+}
+
+// Component is a BEGIN/END block and its properties & sub-components
+type component struct {
+	name       string
+	properties []property
+	children   []*component
+}
+
+// Get returns the first property with the name
+func (c *component) get(name string) (property, bool) {
+	for _, p := range c.properties {
+		if p.name == name {
+			return p, true
+		}
+	}
+
+	return property{}, false
+}
+
+// Value returns the value of the first property with the name, empty if not set
+func (c *component) value(name string) string {
+	p, _ := c.get(name)
+
+	return p.value
+}
+
+// Parse parses iCalendar data, returning the VEVENT & VTODO components of the first VCALENDAR.
+// Times with a TZID are resolved using the IANA timezone database, or the calendar's VTIMEZONE
+// definitions (eg: Windows timezone names). Floating times (without a timezone) are treated as UTC.
+func Parse(data []byte) (Calendar, error) {
+	cal := Calendar{Events: []Event{}}
+
+	components, err := parseComponents(unfold(string(data)))
+	if err != nil {
+		return cal, err
+	}
+
+	var vcalendar *component
+	for _, c := range components {
+		if c.name == "VCALENDAR" {
+			vcalendar = c
+			break
+		}
+	}
+
+	if vcalendar == nil {
+		return cal, fmt.Errorf("invalid calendar: missing BEGIN:VCALENDAR")
+	}
+
+	cal.Method = strings.ToUpper(vcalendar.value("METHOD"))
+	cal.ProdID = unescape(vcalendar.value("PRODID"))
+
+	timezones := map[string]*vtimezone{}
+	for _, c := range vcalendar.children {
+		if c.name == "VTIMEZONE" {
+			tz, err := parseTimezone(c)
+			if err != nil {
+				return cal, err
+			}
+			timezones[tz.id] = tz
+		}
+	}
+
+	for _, c := range vcalendar.children {
+		if c.name != "VEVENT" && c.name != "VTODO" {
+			continue
+		}
+
+		e, err := parseEvent(c, timezones)
+		if err != nil {
+			return cal, err
+		}
+
+		cal.Events = append(cal.Events, e)
+	}
+
+	return cal, nil
+}
+
+// Unfold joins folded lines (lines starting with a space or tab continue the previous line)
+// and returns the non-empty lines
+func unfold(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\n ", "")
+	s = strings.ReplaceAll(s, "\n\t", "")
+
+	lines := []string{}
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimRight(l, "\r"); strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	return lines
+}
+
+// ParseComponents returns the top-level components of the lines
+func parseComponents(lines []string) ([]*component, error) {
+	root := &component{}
+	stack := []*component{root}
+
+	for i, l := range lines {
+		p, err := parseProperty(l)
+		if err != nil {
+			return nil, fmt.Errorf("invalid calendar: line %d: %s", i+1, err.Error())
+		}
+
+		current := stack[len(stack)-1]
+
+		switch p.name {
+		case "BEGIN":
+			c := &component{name: strings.ToUpper(p.value)}
+			current.children = append(current.children, c)
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 1 || current.name != strings.ToUpper(p.value) {
+				return nil, fmt.Errorf("invalid calendar: line %d: unexpected END:%s", i+1, p.value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("invalid calendar: line %d: property %s outside of a component", i+1, p.name)
+			}
+			current.properties = append(current.properties, p)
+		}
+	}
+
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("invalid calendar: missing END:%s", stack[len(stack)-1].name)
+	}
+
+	return root.children, nil
+}
+
+// ParseProperty parses a content line, eg: `ATTENDEE;CN="Smith, John";RSVP=TRUE:mailto:john@example.com`
+func parseProperty(l string) (property, error) {
+	p := property{params: map[string]string{}}
+
+	i := strings.IndexAny(l, ";:")
+	if i < 1 {
+		return p, fmt.Errorf("expected NAME:value, got \"%s\"", l)
+	}
+
+	p.name = strings.ToUpper(l[:i])
+
+	// parameters, values may be quoted & contain ; or :
+	for l[i] == ';' {
+		rest := l[i+1:]
+		eq := strings.Index(rest, "=")
+		if eq < 1 {
+			return p, fmt.Errorf("invalid parameter in %s", p.name)
+		}
+
+		name := strings.ToUpper(rest[:eq])
+		j := i + 1 + eq + 1
+		value := ""
+
+		if j < len(l) && l[j] == '"' {
+			end := strings.Index(l[j+1:], `"`)
+			if end < 0 {
+				return p, fmt.Errorf("unterminated quoted parameter %s in %s", name, p.name)
+			}
+			value = l[j+1 : j+1+end]
+			j = j + 1 + end + 1
+		} else {
+			end := strings.IndexAny(l[j:], ";:")
+			if end < 0 {
+				return p, fmt.Errorf("missing value of %s", p.name)
+			}
+			value = l[j : j+end]
+			j = j + end
+		}
+
+		if j >= len(l) {
+			return p, fmt.Errorf("missing value of %s", p.name)
+		}
+
+		p.params[name] = value
+		i = j
+	}
+
+	if l[i] != ':' {
+		return p, fmt.Errorf("missing value of %s", p.name)
+	}
+
+	p.value = l[i+1:]
+
+	return p, nil
+}
+
+// ParseEvent returns an event from a VEVENT or VTODO component
+func parseEvent(c *component, timezones map[string]*vtimezone) (Event, error) {
+	e := Event{
+		Type:        c.name,
+		UID:         c.value("UID"),
+		Summary:     unescape(c.value("SUMMARY")),
+		Description: unescape(c.value("DESCRIPTION")),
+		Location:    unescape(c.value("LOCATION")),
+		Status:      strings.ToUpper(c.value("STATUS")),
+		RRule:       c.value("RRULE"),
+		Attendees:   []Attendee{},
+	}
+
+	if s := c.value("SEQUENCE"); s != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return e, fmt.Errorf("invalid calendar: invalid SEQUENCE \"%s\"", s)
+		}
+		e.Sequence = n
+	}
+
+	if p, ok := c.get("ORGANIZER"); ok {
+		a := parseAttendee(p)
+		e.Organizer = &a
+	}
+
+	for _, p := range c.properties {
+		if p.name == "ATTENDEE" {
+			e.Attendees = append(e.Attendees, parseAttendee(p))
+		}
+	}
+
+	if p, ok := c.get("DTSTART"); ok {
+		t, allDay, err := parseTime(p, timezones)
+		if err != nil {
+			return e, err
+		}
+		e.Start, e.AllDay = &t, allDay
+	}
+
+	end, ok := c.get("DTEND")
+	if !ok {
+		end, ok = c.get("DUE")
+	}
+
+	if ok {
+		t, _, err := parseTime(end, timezones)
+		if err != nil {
+			return e, err
+		}
+		e.End = &t
+	} else if d := c.value("DURATION"); d != "" && e.Start != nil {
+		dur, err := parseDuration(d)
+		if err != nil {
+			return e, err
+		}
+		t := e.Start.Add(dur)
+		e.End = &t
+	}
+
+	return e, nil
+}
+
+// ParseAttendee returns an attendee from an ORGANIZER or ATTENDEE property
+func parseAttendee(p property) Attendee {
+	email := p.value
+	if strings.HasPrefix(strings.ToLower(email), "mailto:") {
+		email = email[7:]
+	}
+
+	return Attendee{
+		Name:     p.params["CN"],
+		Email:    email,
+		Role:     strings.ToUpper(p.params["ROLE"]),
+		PartStat: strings.ToUpper(p.params["PARTSTAT"]),
+		RSVP:     strings.EqualFold(p.params["RSVP"], "TRUE"),
+	}
+}
+
+// ParseTime returns the time of a DTSTART, DTEND or DUE property, and whether it is a date
+func parseTime(p property, timezones map[string]*vtimezone) (time.Time, bool, error) {
+	v := strings.TrimSpace(p.value)
+
+	if strings.EqualFold(p.params["VALUE"], "DATE") || len(v) == 8 {
+		t, err := time.Parse("20060102", v)
+		if err != nil {
+			return t, true, fmt.Errorf("invalid calendar: invalid %s date \"%s\"", p.name, v)
+		}
+
+		return t, true, nil
+	}
+
+	if strings.HasSuffix(v, "Z") {
+		t, err := time.Parse("20060102T150405Z", v)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid calendar: invalid %s time \"%s\"", p.name, v)
+		}
+
+		return t, false, nil
+	}
+
+	local, err := time.Parse("20060102T150405", v)
+	if err != nil {
+		return local, false, fmt.Errorf("invalid calendar: invalid %s time \"%s\"", p.name, v)
+	}
+
+	tzid := strings.TrimSpace(p.params["TZID"])
+	if tzid == "" {
+		return local, false, nil
+	}
+
+	// the calendar timezone definitions take precedence, as they may differ from the IANA names
+	if tz, ok := timezones[tzid]; ok {
+		return tz.resolve(local), false, nil
+	}
+
+	loc, err := time.LoadLocation(strings.TrimPrefix(tzid, "/"))
+	if err != nil {
+		return local, false, fmt.Errorf("invalid calendar: unknown %s timezone \"%s\"", p.name, tzid)
+	}
+
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, loc), false, nil
+}
+
+// ParseDuration parses a DURATION value, eg: PT1H30M or P1D
+func parseDuration(s string) (time.Duration, error) {
+	m := durationRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("invalid calendar: invalid DURATION \"%s\"", s)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+
+	var d time.Duration
+	for i, u := range units {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d = d + time.Duration(n)*u
+		}
+	}
+
+	if m[1] == "-" {
+		d = -d
+	}
+
+	return d, nil
+}
+
+// Unescape returns the value of a TEXT property
+func unescape(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
@@ -0,0 +1,65 @@
+package calendar
+
+import "time"
+
+// Calendar is a parsed iCalendar object
+//
+// swagger:model Calendar
+type Calendar struct {
+	// Message part ID of the calendar
+	PartID string
+	// Calendar method, eg: REQUEST, CANCEL or REPLY (empty if not set)
+	Method string
+	// Product identifier of the application which created the calendar
+	ProdID string
+	// Events & to-dos
+	Events []Event
+}
+
+// Event is a VEVENT or VTODO component
+//
+// swagger:model CalendarEvent
+type Event struct {
+	// Component type, either VEVENT or VTODO
+	Type string
+	// Unique identifier
+	UID string
+	// Summary (title)
+	Summary string
+	// Description
+	Description string
+	// Location
+	Location string
+	// Status, eg: CONFIRMED, TENTATIVE or CANCELLED
+	Status string
+	// Sequence number of the revision
+	Sequence int
+	// Organizer, null if not set
+	Organizer *Attendee
+	// Attendees
+	Attendees []Attendee
+	// Start time (RFC3339), null if not set
+	Start *time.Time
+	// End time (RFC3339), or the due time of a to-do, null if not set
+	End *time.Time
+	// Whether the start & end are dates without a time
+	AllDay bool
+	// Recurrence rule, eg: FREQ=WEEKLY;COUNT=10
+	RRule string
+}
+
+// Attendee is an organizer or attendee of an event
+//
+// swagger:model CalendarAttendee
+type Attendee struct {
+	// Common name
+	Name string
+	// Email address
+	Email string
+	// Participation role, eg: REQ-PARTICIPANT
+	Role string
+	// Participation status, eg: NEEDS-ACTION, ACCEPTED or DECLINED
+	PartStat string
+	// Whether a reply is requested
+	RSVP bool
+}
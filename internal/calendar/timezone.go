@@ -0,0 +1,191 @@
+package calendar
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	offsetRe = regexp.MustCompile(`^([+-])(\d{2})(\d{2})(\d{2})?$`)
+	byDayRe  = regexp.MustCompile(`^([+-]?\d)?(SU|MO|TU|WE|TH|FR|SA)$`)
+
+	weekdays = map[string]time.Weekday{
+		"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+		"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+	}
+)
+
+// Vtimezone is a VTIMEZONE definition of a calendar
+type vtimezone struct {
+	id       string
+	standard *tzRule
+	daylight *tzRule
+}
+
+// TzRule is a STANDARD or DAYLIGHT observance of a VTIMEZONE
+type tzRule struct {
+	// UTC offset in seconds (TZOFFSETTO)
+	offset int
+	// local time of the first onset (DTSTART)
+	start time.Time
+	// yearly onset, eg: the last (-1) Sunday of March, month is 0 if the observance does not recur
+	month   time.Month
+	week    int
+	weekday time.Weekday
+}
+
+// ParseTimezone returns a timezone from a VTIMEZONE component. Only the most recent
+// STANDARD & DAYLIGHT observances are used.
+func parseTimezone(c *component) (*vtimezone, error) {
+	tz := &vtimezone{id: strings.TrimSpace(c.value("TZID"))}
+	if tz.id == "" {
+		return nil, fmt.Errorf("invalid calendar: VTIMEZONE missing TZID")
+	}
+
+	for _, o := range c.children {
+		if o.name != "STANDARD" && o.name != "DAYLIGHT" {
+			continue
+		}
+
+		rule, err := parseTzRule(o)
+		if err != nil {
+			return nil, fmt.Errorf("invalid calendar: VTIMEZONE %s: %s", tz.id, err.Error())
+		}
+
+		if o.name == "STANDARD" {
+			if tz.standard == nil || rule.start.After(tz.standard.start) {
+				tz.standard = rule
+			}
+		} else if tz.daylight == nil || rule.start.After(tz.daylight.start) {
+			tz.daylight = rule
+		}
+	}
+
+	return tz, nil
+}
+
+// ParseTzRule returns the rule of a STANDARD or DAYLIGHT component
+func parseTzRule(c *component) (*tzRule, error) {
+	rule := &tzRule{}
+
+	offset, err := parseOffset(c.value("TZOFFSETTO"))
+	if err != nil {
+		return nil, err
+	}
+	rule.offset = offset
+
+	if v := strings.TrimSpace(c.value("DTSTART")); v != "" {
+		if rule.start, err = time.Parse("20060102T150405", v); err != nil {
+			return nil, fmt.Errorf("invalid %s DTSTART \"%s\"", c.name, v)
+		}
+	}
+
+	rrule := c.value("RRULE")
+	if rrule == "" {
+		return rule, nil
+	}
+
+	for _, part := range strings.Split(rrule, ";") {
+		k, v, _ := strings.Cut(part, "=")
+
+		switch strings.ToUpper(k) {
+		case "BYMONTH":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 12 {
+				return nil, fmt.Errorf("invalid %s RRULE \"%s\"", c.name, rrule)
+			}
+			rule.month = time.Month(n)
+		case "BYDAY":
+			m := byDayRe.FindStringSubmatch(strings.ToUpper(v))
+			if m == nil {
+				return nil, fmt.Errorf("invalid %s RRULE \"%s\"", c.name, rrule)
+			}
+			rule.weekday = weekdays[m[2]]
+			if m[1] != "" {
+				rule.week, _ = strconv.Atoi(m[1])
+			}
+		case "BYMONTHDAY":
+			// eg: BYDAY=SU;BYMONTHDAY=8,9,10,11,12,13,14 is the second Sunday
+			day, _, _ := strings.Cut(v, ",")
+			if n, err := strconv.Atoi(day); err == nil && n > 0 && rule.week == 0 {
+				rule.week = (n-1)/7 + 1
+			}
+		}
+	}
+
+	if rule.week == 0 {
+		rule.week = 1
+	}
+
+	return rule, nil
+}
+
+// ParseOffset returns the seconds of a UTC offset, eg: -0500 or +0530
+func parseOffset(s string) (int, error) {
+	m := offsetRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid UTC offset \"%s\"", s)
+	}
+
+	h, _ := strconv.Atoi(m[2])
+	min, _ := strconv.Atoi(m[3])
+	sec, _ := strconv.Atoi(m[4])
+
+	offset := h*3600 + min*60 + sec
+	if m[1] == "-" {
+		offset = -offset
+	}
+
+	return offset, nil
+}
+
+// Resolve returns the local time in the timezone, using the daylight offset if
+// the time falls within daylight saving time
+func (tz *vtimezone) resolve(local time.Time) time.Time {
+	offset := 0
+
+	switch {
+	case tz.standard == nil && tz.daylight == nil:
+	case tz.daylight == nil:
+		offset = tz.standard.offset
+	case tz.standard == nil:
+		offset = tz.daylight.offset
+	case tz.standard.month == 0 || tz.daylight.month == 0:
+		// no yearly transitions
+		offset = tz.standard.offset
+	default:
+		offset = tz.standard.offset
+		dstStart := tz.daylight.onset(local.Year())
+		dstEnd := tz.standard.onset(local.Year())
+
+		if dstStart.Before(dstEnd) {
+			// northern hemisphere
+			if !local.Before(dstStart) && local.Before(dstEnd) {
+				offset = tz.daylight.offset
+			}
+		} else if !local.Before(dstStart) || local.Before(dstEnd) {
+			// southern hemisphere
+			offset = tz.daylight.offset
+		}
+	}
+
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, time.FixedZone(tz.id, offset))
+}
+
+// Onset returns the local time the observance begins in the year
+func (r *tzRule) onset(year int) time.Time {
+	var d time.Time
+
+	if r.week > 0 {
+		d = time.Date(year, r.month, 1, 0, 0, 0, 0, time.UTC)
+		d = d.AddDate(0, 0, (int(r.weekday)-int(d.Weekday())+7)%7+(r.week-1)*7)
+	} else {
+		d = time.Date(year, r.month+1, 0, 0, 0, 0, 0, time.UTC)
+		d = d.AddDate(0, 0, -((int(d.Weekday())-int(r.weekday)+7)%7)+(r.week+1)*7)
+	}
+
+	return time.Date(d.Year(), d.Month(), d.Day(), r.start.Hour(), r.start.Minute(), r.start.Second(), 0, time.UTC)
+}
@@ -0,0 +1,208 @@
+// Package dkim signs messages with a DKIM signature (RFC 6376) using relaxed/relaxed canonicalization
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SignedHeaders are the headers included in the signature, if present in the message
+var SignedHeaders = []string{"From", "To", "Subject", "Date", "Message-Id"}
+
+// consecutive whitespace, reduced to a single space by relaxed canonicalization
+var wspRe = regexp.MustCompile(`[ \t]+`)
+
+// Signer signs messages for a domain & selector
+type Signer struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	algo     string
+}
+
+// NewSigner returns a signer for a domain & selector using an RSA or Ed25519 private key
+func NewSigner(domain, selector string, key crypto.Signer) (*Signer, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("DKIM domain and selector are required")
+	}
+
+	s := &Signer{domain: domain, selector: selector, key: key}
+
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		s.algo = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.algo = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("unsupported DKIM private key type %T", key)
+	}
+
+	return s, nil
+}
+
+// LoadSigner returns a signer for a domain & selector using a PEM encoded private key file
+// (PKCS#1 RSA, or PKCS#8 RSA or Ed25519)
+func LoadSigner(domain, selector, keyFile string) (*Signer, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read DKIM private key: %s", err.Error())
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("DKIM private key is not PEM encoded: %s", keyFile)
+	}
+
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse DKIM private key: %s", err.Error())
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported DKIM private key type %T", key)
+	}
+
+	return NewSigner(domain, selector, signer)
+}
+
+// Sign returns the message with a DKIM-Signature header prepended, signing the body & SignedHeaders.
+// The message must not be modified after signing.
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+	// normalize line endings as the message is sent with CRLF
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+
+	var body []byte
+	if i := bytes.Index(msg, []byte("\n\n")); i > -1 {
+		body = msg[i+2:]
+	}
+
+	headers := headerFields(msg)
+
+	// the last instance of each header is signed (RFC 6376 5.4.2)
+	signed := []string{}
+	canonical := ""
+	for _, name := range SignedHeaders {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.EqualFold(headers[i].name, name) {
+				signed = append(signed, strings.ToLower(name))
+				canonical += relaxedHeader(headers[i].raw)
+				break
+			}
+		}
+	}
+
+	if len(signed) == 0 || signed[0] != "from" {
+		return nil, errors.New("unable to DKIM sign a message without a From header")
+	}
+
+	bh := sha256.Sum256(relaxedBody(body))
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algo, s.domain, s.selector, time.Now().Unix(), strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+
+	// the signature header is signed without its trailing CRLF (RFC 6376 3.7)
+	canonical += strings.TrimSuffix(relaxedHeader("DKIM-Signature: "+value), "\r\n")
+	hash := sha256.Sum256([]byte(canonical))
+
+	var sig []byte
+	var err error
+	if s.algo == "rsa-sha256" {
+		sig, err = s.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	} else {
+		// Ed25519 signs the SHA-256 hash (RFC 8463)
+		sig, err = s.key.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := "DKIM-Signature: " + value + base64.StdEncoding.EncodeToString(sig) + "\r\n"
+
+	return append([]byte(header), bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))...), nil
+}
+
+type headerField struct {
+	name string
+	raw  string
+}
+
+// HeaderFields returns the raw header fields of a message, including folded lines. Unlike
+// tools.ParseOrderedHeaders, malformed headers are tolerated: whitespace before the colon
+// is removed by relaxed canonicalization, and lines which are not a header are skipped.
+func headerFields(msg []byte) []headerField {
+	fields := []headerField{}
+	for _, line := range strings.SplitAfter(string(msg), "\n") {
+		if strings.TrimRight(line, "\r\n") == "" {
+			// end of the headers
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) > 0 {
+				fields[len(fields)-1].raw += line
+			}
+			continue
+		}
+
+		name, _, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			// not a header, skip any continuation lines too
+			fields = append(fields, headerField{})
+			continue
+		}
+
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+	}
+
+	return fields
+}
+
+// RelaxedHeader returns the relaxed canonicalization of a raw header (RFC 6376 3.4.2)
+func relaxedHeader(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+
+	// unfold
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(wspRe.ReplaceAllString(value, " "))
+
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// RelaxedBody returns the relaxed canonicalization of a message body (RFC 6376 3.4.4)
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(wspRe.ReplaceAllString(l, " "), " ")
+	}
+
+	// ignore all empty lines at the end of the body
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return []byte{}
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,327 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testMessage = "From: Sender <sender@example.com>\n" +
+	"To: recipient@example.net\n" +
+	"Subject: Test\n" +
+	"  message\n" +
+	"Date: Mon, 01 Jan 2024 00:00:00 +0000\n" +
+	"Message-Id: <test@example.com>\n" +
+	"X-Unsigned: value\n" +
+	"\n" +
+	"Hello  world \t\n" +
+	"\n\n"
+
+func TestRelaxedCanonicalization(t *testing.T) {
+	// examples from RFC 6376 3.4.5
+	headers := relaxedHeader("A: X") + relaxedHeader("B : Y\t\r\n\tZ  ")
+	if headers != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected relaxed headers: %q", headers)
+	}
+
+	body := relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))
+	if string(body) != " C\r\nD E\r\n" {
+		t.Errorf("unexpected relaxed body: %q", body)
+	}
+
+	if body := relaxedBody([]byte("\r\n\r\n")); len(body) != 0 {
+		t.Errorf("unexpected relaxed empty body: %q", body)
+	}
+
+	// the verifier's own canonicalization
+	if h := canonicalHeader("A: X") + "\r\n" + canonicalHeader("B : Y\t\r\n\tZ  "); h != "a:X\r\nb:Y Z" {
+		t.Errorf("unexpected verifier headers: %q", h)
+	}
+
+	if body := canonicalBody([]byte(" C \r\nD \t E\r\n\r\n\r\n")); string(body) != " C\r\nD E\r\n" {
+		t.Errorf("unexpected verifier body: %q", body)
+	}
+}
+
+func TestSignRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadSigner("example.com", "mail", keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := s.Sign([]byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := verify(signed, &key.PublicKey)
+	if err != nil {
+		t.Errorf("invalid signature: %s", err)
+	}
+
+	if tags["a"] != "rsa-sha256" || tags["c"] != "relaxed/relaxed" || tags["d"] != "example.com" || tags["s"] != "mail" {
+		t.Errorf("unexpected signature tags: %v", tags)
+	}
+
+	if tags["h"] != "from:to:subject:date:message-id" {
+		t.Errorf("unexpected signed headers: %s", tags["h"])
+	}
+
+	// the message itself must not be modified (other than line endings)
+	if !bytes.HasSuffix(signed, []byte(strings.ReplaceAll(testMessage, "\n", "\r\n"))) {
+		t.Error("message was modified")
+	}
+
+	// a modified message must not validate
+	tampered := bytes.Replace(signed, []byte("Subject: Test"), []byte("Subject: Tset"), 1)
+	if _, err := verify(tampered, &key.PublicKey); err == nil {
+		t.Error("modified message should not validate")
+	}
+}
+
+func TestSignEd25519(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSigner("example.com", "ed", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := s.Sign([]byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verify(signed, pub); err != nil {
+		t.Errorf("invalid signature: %s", err)
+	}
+
+	// a modified body must not validate
+	tampered := bytes.Replace(signed, []byte("Hello  world"), []byte("Hello world!"), 1)
+	if _, err := verify(tampered, pub); err == nil {
+		t.Error("modified message should not validate")
+	}
+}
+
+func TestSignMalformedHeaders(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSigner("example.com", "ed", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "From: Sender <sender@example.com>\n" +
+		"Subject : Test\n" +
+		"not a header\n" +
+		"X-Empty:\n" +
+		"\n" +
+		"Hello\n"
+
+	signed, err := s.Sign([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := verify(signed, pub)
+	if err != nil {
+		t.Errorf("invalid signature: %s", err)
+	}
+
+	if tags["h"] != "from:subject" {
+		t.Errorf("unexpected signed headers: %s", tags["h"])
+	}
+}
+
+func TestLoadSignerErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := LoadSigner("example.com", "mail", filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadSigner("example.com", "mail", invalid); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := NewSigner("", "mail", key); err == nil {
+		t.Error("expected an error without a domain")
+	}
+}
+
+// Verify is an independent DKIM verifier (RFC 6376 & RFC 8463) for relaxed/relaxed signatures, returning
+// the DKIM-Signature tags. It deliberately shares no canonicalization code with the signer.
+func verify(signed []byte, pub crypto.PublicKey) (map[string]string, error) {
+	head, body, ok := bytes.Cut(signed, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("missing header/body separator")
+	}
+
+	// header fields, including any folded lines
+	fields := []string{}
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+
+	sigField := ""
+	for _, f := range fields {
+		if fieldName(f) == "dkim-signature" {
+			sigField = f
+			break
+		}
+	}
+	if sigField == "" {
+		return nil, errors.New("missing DKIM-Signature header")
+	}
+
+	tags := map[string]string{}
+	_, value, _ := strings.Cut(sigField, ":")
+	for _, tag := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+
+	if tags["c"] != "relaxed/relaxed" {
+		return nil, fmt.Errorf("unsupported canonicalization %q", tags["c"])
+	}
+
+	bh := sha256.Sum256(canonicalBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+		return tags, errors.New("body hash does not match")
+	}
+
+	// signed headers are selected from the bottom up, each instance only once (RFC 6376 5.4.2)
+	var data strings.Builder
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && fieldName(fields[i]) == name {
+				used[i] = true
+				data.WriteString(canonicalHeader(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+
+	// the signature header with an empty b= value, without a trailing CRLF
+	data.WriteString(canonicalHeader(bTagRe.ReplaceAllString(sigField, "$1")))
+	hash := sha256.Sum256([]byte(data.String()))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return tags, err
+	}
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return tags, fmt.Errorf("unexpected algorithm %q", tags["a"])
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+			return tags, err
+		}
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return tags, fmt.Errorf("unexpected algorithm %q", tags["a"])
+		}
+		if !ed25519.Verify(key, hash[:], sig) {
+			return tags, errors.New("ed25519 verification failure")
+		}
+	default:
+		return tags, fmt.Errorf("unsupported public key %T", pub)
+	}
+
+	return tags, nil
+}
+
+var bTagRe = regexp.MustCompile(`([:;][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.ToLower(strings.TrimRight(name, " \t"))
+}
+
+// CanonicalHeader returns the relaxed canonicalization of a header field, without a trailing CRLF
+func canonicalHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ")
+}
+
+// CanonicalBody returns the relaxed canonicalization of a CRLF message body
+func canonicalBody(body []byte) []byte {
+	var out bytes.Buffer
+	blank := 0
+	for _, line := range strings.Split(string(body), "\r\n") {
+		var l strings.Builder
+		wsp := false
+		for _, c := range line {
+			if isWSP(c) {
+				wsp = true
+				continue
+			}
+			if wsp {
+				l.WriteByte(' ')
+				wsp = false
+			}
+			l.WriteRune(c)
+		}
+
+		// trailing whitespace is removed, and empty lines are only written if followed by content
+		if l.Len() == 0 {
+			blank++
+			continue
+		}
+
+		out.WriteString(strings.Repeat("\r\n", blank) + l.String() + "\r\n")
+		blank = 0
+	}
+
+	return out.Bytes()
+}
+
+func isWSP(c rune) bool {
+	return c == ' ' || c == '\t'
+}
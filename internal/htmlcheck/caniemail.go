@@ -6,6 +6,7 @@ import (
 	"embed"
 	"encoding/json"
 	"regexp"
+	"sync"
 )
 
 //go:embed caniemail-data.json
@@ -14,12 +15,15 @@ var embeddedFS embed.FS
 var (
 	cie = CanIEmail{}
 
+	// cieMu ensures the JSON data is loaded once, as tests may run concurrently
+	cieMu sync.Mutex
+
 	noteMatch = regexp.MustCompile(` #(\d)+$`)
 
-	// LimitFamilies will limit results to families if set
+	// LimitFamilies will limit results to families (email clients) by default if set
 	LimitFamilies = []string{}
 
-	// LimitPlatforms will limit results to platforms if set
+	// LimitPlatforms will limit results to platforms by default if set
 	LimitPlatforms = []string{}
 
 	// LimitClients will limit results to clients if set
@@ -59,6 +63,9 @@ type JSONResult struct {
 
 // Load the JSON data
 func loadJSONData() error {
+	cieMu.Lock()
+	defer cieMu.Unlock()
+
 	if cie.APIVersion != "" {
 		return nil
 	}
@@ -68,7 +75,13 @@ func loadJSONData() error {
 		return err
 	}
 
-	cie = CanIEmail{}
+	// the data is only set once fully loaded
+	data := CanIEmail{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	cie = data
 
-	return json.Unmarshal(b, &cie)
+	return nil
 }
@@ -3,13 +3,13 @@ package htmlcheck
 import (
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/httpclient"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/tools"
 	"github.com/vanng822/go-premailer/premailer"
@@ -19,7 +19,7 @@ import (
 
 // Go cannot calculate any rendered CSS attributes, so we merge all styles
 // into the HTML and detect elements with styles containing the keywords.
-func runCSSTests(html string) ([]Warning, int, error) {
+func runCSSTests(html string, filter Filter) ([]Warning, int, error) {
 	results := []Warning{}
 	totalTests := 0
 
@@ -46,7 +46,7 @@ func runCSSTests(html string) ([]Warning, int, error) {
 		totalTests++
 		found := len(doc.Find(test).Nodes)
 		if found > 0 {
-			result, err := cie.getTest(key)
+			result, err := cie.getTest(key, filter)
 			if err != nil {
 				return results, totalTests, err
 			}
@@ -66,7 +66,7 @@ func runCSSTests(html string) ([]Warning, int, error) {
 
 	for key, re := range cssRegexpUnitTests {
 		totalTests++
-		result, err := cie.getTest(key)
+		result, err := cie.getTest(key, filter)
 		if err != nil {
 			return results, totalTests, err
 		}
@@ -98,7 +98,7 @@ func runCSSTests(html string) ([]Warning, int, error) {
 
 	for key, re := range cssRegexpTests {
 		totalTests++
-		result, err := cie.getTest(key)
+		result, err := cie.getTest(key, filter)
 		if err != nil {
 			return results, totalTests, err
 		}
@@ -186,9 +186,7 @@ func inlineRemoteCSS(h string) (string, error) {
 
 // DownloadToBytes returns a []byte slice from a URL
 func downloadToBytes(url string) ([]byte, error) {
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
+	client := httpclient.Client(5*time.Second, false)
 
 	// Get the link response data
 	resp, err := client.Get(url)
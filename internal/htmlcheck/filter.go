@@ -0,0 +1,114 @@
+package htmlcheck
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Filter limits the email clients & platforms which are tested and scored
+//
+// swagger:model HTMLCheckFilter
+type Filter struct {
+	// Email client identifiers eg: gmail, outlook, apple-mail (all clients if empty)
+	Clients []string `json:"Clients"`
+	// Platform identifiers eg: desktop-app, webmail, ios (all platforms if empty)
+	Platforms []string `json:"Platforms"`
+}
+
+// DefaultFilter returns the default filter set via LimitFamilies & LimitPlatforms
+func DefaultFilter() Filter {
+	return Filter{
+		Clients:   append([]string{}, LimitFamilies...),
+		Platforms: append([]string{}, LimitPlatforms...),
+	}
+}
+
+// SetDefaultFilter sets the default clients & platforms (LimitFamilies & LimitPlatforms)
+// from comma-separated identifiers
+func SetDefaultFilter(clients, platforms string) error {
+	f, err := ParseFilter(clients, platforms)
+	if err != nil {
+		return err
+	}
+
+	LimitFamilies = f.Clients
+	LimitPlatforms = f.Platforms
+
+	return nil
+}
+
+// ParseFilter returns a Filter from comma-separated client & platform identifiers.
+// An error listing the valid identifiers is returned if any identifiers are unknown.
+func ParseFilter(clients, platforms string) (Filter, error) {
+	f := Filter{Clients: []string{}, Platforms: []string{}}
+
+	if err := loadJSONData(); err != nil {
+		return f, err
+	}
+
+	validClients, validPlatforms := identifiers()
+
+	for _, c := range splitIdentifiers(clients) {
+		if !inArray(c, validClients) {
+			return f, fmt.Errorf("unknown HTML check client \"%s\", valid clients are: %s", c, strings.Join(validClients, ", "))
+		}
+		if !inArray(c, f.Clients) {
+			f.Clients = append(f.Clients, c)
+		}
+	}
+
+	for _, p := range splitIdentifiers(platforms) {
+		if !inArray(p, validPlatforms) {
+			return f, fmt.Errorf("unknown HTML check platform \"%s\", valid platforms are: %s", p, strings.Join(validPlatforms, ", "))
+		}
+		if !inArray(p, f.Platforms) {
+			f.Platforms = append(f.Platforms, p)
+		}
+	}
+
+	return f, nil
+}
+
+// Whether the client family & platform are included by the filter
+func (f Filter) includes(family, platform string) bool {
+	return (len(f.Clients) == 0 || inArray(family, f.Clients)) &&
+		(len(f.Platforms) == 0 || inArray(platform, f.Platforms))
+}
+
+// Return all known client & platform identifiers, sorted alphabetically
+func identifiers() ([]string, []string) {
+	clients := []string{}
+	platforms := []string{}
+
+	for _, t := range cie.Data {
+		for family, stats := range t.Stats {
+			if !inArray(family, clients) {
+				clients = append(clients, family)
+			}
+			for platform := range stats.(map[string]interface{}) {
+				if !inArray(platform, platforms) {
+					platforms = append(platforms, platform)
+				}
+			}
+		}
+	}
+
+	sort.Strings(clients)
+	sort.Strings(platforms)
+
+	return clients, platforms
+}
+
+// Split a comma-separated list of identifiers, returning lowercase values
+func splitIdentifiers(s string) []string {
+	ids := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v != "" {
+			ids = append(ids, v)
+		}
+	}
+
+	return ids
+}
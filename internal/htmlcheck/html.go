@@ -9,7 +9,7 @@ import (
 )
 
 // HTML tests
-func runHTMLTests(html string) ([]Warning, int, error) {
+func runHTMLTests(html string, filter Filter) ([]Warning, int, error) {
 	results := []Warning{}
 	totalTests := 0
 
@@ -45,7 +45,7 @@ func runHTMLTests(html string) ([]Warning, int, error) {
 		if test == "body" {
 			re := regexp.MustCompile(`(?im)</body>`)
 			if re.MatchString(html) {
-				result, err := cie.getTest(key)
+				result, err := cie.getTest(key, filter)
 				if err != nil {
 					return results, totalTests, err
 				}
@@ -54,7 +54,7 @@ func runHTMLTests(html string) ([]Warning, int, error) {
 				results = append(results, result)
 			}
 		} else if len(doc.Find(test).Nodes) > 0 {
-			result, err := cie.getTest(key)
+			result, err := cie.getTest(key, filter)
 			if err != nil {
 				return results, totalTests, err
 			}
@@ -90,7 +90,7 @@ func runHTMLTests(html string) ([]Warning, int, error) {
 	}
 
 	for key, found := range imageResults {
-		result, err := cie.getTest(key)
+		result, err := cie.getTest(key, filter)
 		if err != nil {
 			return results, totalTests, err
 		}
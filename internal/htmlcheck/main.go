@@ -12,11 +12,13 @@ import (
 	"github.com/gomarkdown/markdown/parser"
 )
 
-// RunTests will run all tests on an HTML string
-func RunTests(html string) (Response, error) {
+// RunTests will run all tests on an HTML string. Only the email clients & platforms
+// included by the filter are tested, and the scores are calculated from these alone.
+func RunTests(html string, filter Filter) (Response, error) {
 	s := Response{}
 	s.Warnings = []Warning{}
-	if platforms, err := Platforms(); err == nil {
+	s.Filter = filter
+	if platforms, err := filteredPlatforms(filter); err == nil {
 		s.Platforms = platforms
 	}
 
@@ -43,7 +45,7 @@ func RunTests(html string) (Response, error) {
 	}
 
 	// HTML tests
-	htmlResults, totalTests, err := runHTMLTests(html)
+	htmlResults, totalTests, err := runHTMLTests(html, filter)
 	if err != nil {
 		return s, err
 	}
@@ -54,7 +56,7 @@ func RunTests(html string) (Response, error) {
 	s.Warnings = append(s.Warnings, htmlResults...)
 
 	// CSS tests
-	cssResults, totalTests, err := runCSSTests(html)
+	cssResults, totalTests, err := runCSSTests(html, filter)
 	if err != nil {
 		return s, err
 	}
@@ -64,6 +66,15 @@ func RunTests(html string) (Response, error) {
 	// add css test totals
 	s.Warnings = append(s.Warnings, cssResults...)
 
+	// remove warnings with no test results for the filtered clients & platforms
+	warnings := []Warning{}
+	for _, w := range s.Warnings {
+		if w.Score.Supported+w.Score.Partial+w.Score.Unsupported > 0 {
+			warnings = append(warnings, w)
+		}
+	}
+	s.Warnings = warnings
+
 	// calculate total score
 	var partial, unsupported float32
 	partial = 0
@@ -102,8 +113,8 @@ func RunTests(html string) (Response, error) {
 	return s, nil
 }
 
-// Test returns a test
-func (c CanIEmail) getTest(k string) (Warning, error) {
+// Test returns a test, with results limited to the filtered clients & platforms
+func (c CanIEmail) getTest(k string, filter Filter) (Warning, error) {
 	warning := Warning{}
 	exists := false
 	found := JSONResult{}
@@ -136,12 +147,8 @@ func (c CanIEmail) getTest(k string) (Warning, error) {
 	var y, n, p float32
 
 	for family, stats := range found.Stats {
-		if len(LimitFamilies) != 0 && !inArray(family, LimitFamilies) {
-			continue
-		}
-
 		for platform, clients := range stats.(map[string]interface{}) {
-			if len(LimitPlatforms) != 0 && !inArray(platform, LimitPlatforms) {
+			if !filter.includes(family, platform) {
 				continue
 			}
 			for version, support := range clients.(map[string]interface{}) {
@@ -175,6 +182,11 @@ func (c CanIEmail) getTest(k string) (Warning, error) {
 	}
 
 	total := y + n + p
+	if total == 0 {
+		// no results for the filtered clients & platforms
+		return warning, nil
+	}
+
 	warning.Score.Supported = y / total * 100
 	warning.Score.Unsupported = n / total * 100
 	warning.Score.Partial = p / total * 100
@@ -4,6 +4,11 @@ import "sort"
 
 // Platforms returns all platforms with their respective email clients
 func Platforms() (map[string][]string, error) {
+	return filteredPlatforms(Filter{})
+}
+
+// Return all platforms with their respective email clients included by the filter
+func filteredPlatforms(filter Filter) (map[string][]string, error) {
 	// [platform]clients
 	data := make(map[string][]string)
 
@@ -15,6 +20,9 @@ func Platforms() (map[string][]string, error) {
 		for family, stats := range t.Stats {
 			niceFamily := cie.NiceNames.Family[family]
 			for platform := range stats.(map[string]interface{}) {
+				if !filter.includes(family, platform) {
+					continue
+				}
 				c, found := data[platform]
 				if !found {
 					data[platform] = []string{}
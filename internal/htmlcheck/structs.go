@@ -10,6 +10,8 @@ type Response struct {
 	Platforms map[string][]string `json:"Platforms"`
 	// Total overall score
 	Total Total `json:"Total"`
+	// The email clients & platforms tested
+	Filter Filter `json:"Filter"`
 }
 
 // Warning represents a failed test
@@ -0,0 +1,138 @@
+package httpclient
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	defer func() { _ = Configure(Options{}) }()
+
+	var host, auth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.URL.Host
+		auth = r.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	proxyURL := "http://user:secret@" + proxy.Listener.Addr().String()
+
+	if err := Configure(Options{Proxy: proxyURL}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := Client(5*time.Second, false).Get("http://mailpit.invalid/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusNoContent, "request not proxied")
+	assertEqual(t, host, "mailpit.invalid", "wrong proxied host")
+	assertEqual(t, auth, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")), "wrong proxy authorization")
+
+	t.Log("No proxy")
+	if err := Configure(Options{Proxy: proxyURL, NoProxy: "mailpit.invalid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("http://mailpit.invalid/test")
+	p, err := Proxy(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, p == nil, true, "host should not be proxied")
+
+	t.Log("Invalid proxy")
+	if err := Configure(Options{Proxy: "ftp://proxy.invalid"}); err == nil {
+		t.Error("expected an error for an unsupported proxy scheme")
+	}
+}
+
+func TestCACert(t *testing.T) {
+	defer func() { _ = Configure(Options{}) }()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	if err := Configure(Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Client(5*time.Second, false).Get(ts.URL); err == nil {
+		t.Error("expected an error for an untrusted certificate")
+	}
+
+	resp, err := Client(5*time.Second, true).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Configure(Options{CACert: caFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = Client(5*time.Second, false).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+
+	if err := Configure(Options{CACert: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("expected an error for a missing CA file")
+	}
+}
+
+func TestBind(t *testing.T) {
+	defer func() { _ = Configure(Options{}) }()
+
+	var remote string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	if err := Configure(Options{Bind: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := Client(5*time.Second, false).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	host, _, _ := net.SplitHostPort(remote)
+	assertEqual(t, host, "127.0.0.1", "wrong local address")
+
+	if err := Configure(Options{Bind: "mailpit-invalid0"}); err == nil {
+		t.Error("expected an error for an invalid interface")
+	}
+}
+
+func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
+	if a == b {
+		return
+	}
+	t.Fatalf("%s: \"%v\" != \"%v\"", message, a, b)
+}
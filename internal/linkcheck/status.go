@@ -1,13 +1,13 @@
 package linkcheck
 
 import (
-	"crypto/tls"
 	"net/http"
 	"regexp"
 	"sync"
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/httpclient"
 	"github.com/axllent/mailpit/internal/logger"
 )
 
@@ -57,18 +57,25 @@ func getHTTPStatuses(links []string, followRedirects bool) []Link {
 
 // Do a HEAD request to return HTTP status code
 func doHead(link string, followRedirects bool) (int, error) {
+	res, err := head(link, followRedirects)
+	if err != nil {
+		if res != nil {
+			return res.StatusCode, err
+		}
 
-	timeout := time.Duration(10 * time.Second)
+		return 0, err
+	}
 
-	tr := &http.Transport{}
+	return res.StatusCode, nil
+}
 
-	if config.AllowUntrustedTLS {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // #nosec
-	}
+// Do a HEAD request, returning the response
+func head(link string, followRedirects bool) (*http.Response, error) {
+	timeout := time.Duration(10 * time.Second)
 
 	client := http.Client{
 		Timeout:   timeout,
-		Transport: tr,
+		Transport: httpclient.Transport(config.AllowUntrustedTLS),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if followRedirects {
 				return nil
@@ -80,22 +87,17 @@ func doHead(link string, followRedirects bool) (int, error) {
 	req, err := http.NewRequest("HEAD", link, nil)
 	if err != nil {
 		logger.Log().Errorf("[link-check] %s", err.Error())
-		return 0, err
+		return nil, err
 	}
 
 	req.Header.Set("User-Agent", "Mailpit/"+config.Version)
 
 	res, err := client.Do(req)
-	if err != nil {
-		if res != nil {
-			return res.StatusCode, err
-		}
-
-		return 0, err
-
+	if res != nil {
+		res.Body.Close()
 	}
 
-	return res.StatusCode, nil
+	return res, err
 }
 
 // HTTP errors include a lot more info that just the actual error, so this
@@ -0,0 +1,252 @@
+package linkcheck
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tools"
+	"golang.org/x/net/html"
+)
+
+// the maximum size (bytes) of an image response to be considered a tracking pixel, a 1x1 GIF is 43 bytes
+const trackingPixelMaxSize = 100
+
+var (
+	// known open-tracking domains, including subdomains
+	trackingDomains = []string{
+		"list-manage.com", "sendgrid.net", "mandrillapp.com", "mailgun.org", "mjt.lu", "awstrack.me",
+		"pstmrk.it", "sparkpostmail.com", "exct.net", "hubspotemail.net", "hubspotlinks.com", "hs-analytics.net",
+		"klclick.com", "klaviyomail.com", "customer.io", "pardot.com", "mktoresp.com", "emltrk.com",
+		"mailtrack.io", "bananatag.com", "yesware.com", "getnotify.com", "google-analytics.com", "doubleclick.net",
+	}
+
+	// common tracking URL parameters, those ending with _ are prefixes
+	trackingParams = []string{
+		"utm_", "mc_eid", "mc_cid", "_hsenc", "_hsmi", "mkt_tok", "vero_id", "oly_enc_id", "oly_anon_id", "ss_email_id",
+	}
+)
+
+// TrackingResponse represents the tracking check response
+//
+// swagger:model TrackCheckResponse
+type TrackingResponse struct {
+	// Total number of suspected trackers
+	Total int
+	// Suspected trackers
+	Trackers []Tracker
+}
+
+// Tracker is a suspected tracking image
+type Tracker struct {
+	// Image URL
+	URL string
+	// Reasons the image was flagged
+	Reasons []string
+	// HTTP status code, only set if resolved
+	StatusCode int
+	// HTTP status definition or error, only set if resolved
+	Status string
+	// Response Content-Type, only set if resolved
+	ContentType string
+	// Response Content-Length, only set if resolved (-1 if unknown)
+	Size int64
+}
+
+// RunTrackingTests detects suspected tracking images (eg: open-tracking pixels) in the message HTML:
+// 1x1 or hidden images, images hosted on known tracking domains, and image URLs containing common
+// tracking parameters. If resolve is set then each image URL is also requested (HEAD) to detect tiny images.
+func RunTrackingTests(msg *storage.Message, resolve bool) (TrackingResponse, error) {
+	s := TrackingResponse{Trackers: []Tracker{}}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(msg.HTML))
+	if err != nil {
+		return s, err
+	}
+
+	domains := append([]string{}, trackingDomains...)
+	for _, d := range strings.Split(config.TrackingDomains, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			domains = append(domains, d)
+		}
+	}
+
+	images := []Tracker{}
+	seen := map[string]int{}
+	for _, n := range doc.Find("img[src]").Nodes {
+		src, err := tools.GetHTMLAttributeVal(n, "src")
+		if err != nil || !linkRe.MatchString(src) {
+			continue
+		}
+
+		i, ok := seen[src]
+		if !ok {
+			i = len(images)
+			seen[src] = i
+			images = append(images, Tracker{URL: src, Reasons: []string{}})
+		}
+
+		for _, reason := range trackingReasons(n, src, domains) {
+			if !inArray(reason, images[i].Reasons) {
+				images[i].Reasons = append(images[i].Reasons, reason)
+			}
+		}
+	}
+
+	if resolve {
+		resolveTrackers(images)
+	}
+
+	for _, t := range images {
+		if len(t.Reasons) > 0 {
+			s.Trackers = append(s.Trackers, t)
+		}
+	}
+
+	s.Total = len(s.Trackers)
+
+	return s, nil
+}
+
+// TrackingReasons returns the reasons an image is suspected to be a tracker
+func trackingReasons(n *html.Node, src string, domains []string) []string {
+	reasons := []string{}
+
+	style := map[string]string{}
+	if v, err := tools.GetHTMLAttributeVal(n, "style"); err == nil {
+		for _, decl := range strings.Split(v, ";") {
+			if k, v, ok := strings.Cut(decl, ":"); ok {
+				style[strings.ToLower(strings.TrimSpace(k))] = strings.ToLower(strings.TrimSpace(v))
+			}
+		}
+	}
+
+	width, hasWidth := imageDimension(n, "width", style)
+	height, hasHeight := imageDimension(n, "height", style)
+
+	if (hasWidth && width == 0) || (hasHeight && height == 0) {
+		reasons = append(reasons, "hidden image (zero size)")
+	} else if hasWidth && hasHeight && width <= 1 && height <= 1 {
+		reasons = append(reasons, "1x1 image")
+	}
+
+	if _, err := tools.GetHTMLAttributeVal(n, "hidden"); err == nil {
+		reasons = append(reasons, "hidden image (hidden attribute)")
+	}
+
+	if style["display"] == "none" {
+		reasons = append(reasons, "hidden image (display:none)")
+	}
+
+	if style["visibility"] == "hidden" {
+		reasons = append(reasons, "hidden image (visibility:hidden)")
+	}
+
+	if o, err := strconv.ParseFloat(style["opacity"], 64); err == nil && o == 0 {
+		reasons = append(reasons, "hidden image (opacity:0)")
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return reasons
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			reasons = append(reasons, "tracking domain: "+d)
+			break
+		}
+	}
+
+	params := []string{}
+	for param := range u.Query() {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	for _, param := range params {
+		p := strings.ToLower(param)
+		for _, t := range trackingParams {
+			if p == t || (strings.HasSuffix(t, "_") && strings.HasPrefix(p, t)) {
+				reasons = append(reasons, "tracking parameter: "+param)
+				break
+			}
+		}
+	}
+
+	return reasons
+}
+
+// ImageDimension returns the size in pixels of an image dimension set via the attribute or inline style
+func imageDimension(n *html.Node, name string, style map[string]string) (int, bool) {
+	v, err := tools.GetHTMLAttributeVal(n, name)
+	if s, ok := style[name]; ok {
+		v, err = s, nil
+	}
+
+	if err != nil {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "px"))
+	if err != nil {
+		return 0, false
+	}
+
+	return i, true
+}
+
+// ResolveTrackers requests each image URL (HEAD), flagging tiny images, using the same
+// timeout & concurrency as the link check
+func resolveTrackers(images []Tracker) {
+	// allow 5 threads
+	threads := make(chan int, 5)
+
+	var wg sync.WaitGroup
+
+	for i := range images {
+		wg.Add(1)
+		go func(t *Tracker) {
+			threads <- 1 // will block if MAX threads
+			defer wg.Done()
+
+			res, err := head(t.URL, true)
+			if err != nil {
+				t.Status = httpErrorSummary(err)
+			} else {
+				t.StatusCode = res.StatusCode
+				t.Status = http.StatusText(res.StatusCode)
+				t.ContentType = res.Header.Get("Content-Type")
+				t.Size = res.ContentLength
+
+				if res.StatusCode < 400 && strings.HasPrefix(strings.ToLower(t.ContentType), "image/") &&
+					res.ContentLength >= 0 && res.ContentLength <= trackingPixelMaxSize {
+					t.Reasons = append(t.Reasons, fmt.Sprintf("tiny image (%d bytes)", res.ContentLength))
+				}
+			}
+
+			<-threads // remove from threads
+		}(&images[i])
+	}
+
+	wg.Wait()
+}
+
+// inArray tests if a string is within an array
+func inArray(s string, arr []string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+package linkcheck
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+func TestRunTrackingTests(t *testing.T) {
+	config.TrackingDomains = "tracker.example.com"
+	defer func() { config.TrackingDomains = "" }()
+
+	msg := &storage.Message{HTML: `<p>Hello</p>
+		<img src="https://example.com/logo.png" width="200" height="50">
+		<img src="https://example.com/pixel.gif" width="1" height="1">
+		<img src="https://example.com/pixel.gif" width="1" height="1">
+		<img src="https://example.com/hidden.gif" style="display: none">
+		<img src="https://example.com/zero.gif" style="width:0px; height:0px">
+		<img src="https://u123.ct.sendgrid.net/wf/open?upn=abc">
+		<img src="https://open.tracker.example.com/o.gif">
+		<img src="https://example.com/banner.png?utm_source=newsletter&mc_eid=123">
+		<img src="cid:logo@example.com" width="1" height="1">`}
+
+	res, err := RunTrackingTests(msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"https://example.com/pixel.gif":                                   "1x1 image",
+		"https://example.com/hidden.gif":                                  "hidden image (display:none)",
+		"https://example.com/zero.gif":                                    "hidden image (zero size)",
+		"https://u123.ct.sendgrid.net/wf/open?upn=abc":                    "tracking domain: sendgrid.net",
+		"https://open.tracker.example.com/o.gif":                          "tracking domain: tracker.example.com",
+		"https://example.com/banner.png?utm_source=newsletter&mc_eid=123": "tracking parameter: mc_eid, tracking parameter: utm_source",
+	}
+
+	if res.Total != len(expected) || len(res.Trackers) != len(expected) {
+		t.Fatalf("expected %d trackers, got %d: %+v", len(expected), res.Total, res.Trackers)
+	}
+
+	for _, tr := range res.Trackers {
+		reasons := strings.Join(tr.Reasons, ", ")
+		if expected[tr.URL] != reasons {
+			t.Errorf("%s: expected \"%s\", got \"%s\"", tr.URL, expected[tr.URL], reasons)
+		}
+		if tr.StatusCode != 0 {
+			t.Errorf("%s: should not be resolved", tr.URL)
+		}
+	}
+}
+
+func TestRunTrackingTestsResolve(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("unexpected %s request", r.Method)
+		}
+
+		w.Header().Set("Content-Type", "image/gif")
+		if r.URL.Path == "/open.gif" {
+			w.Header().Set("Content-Length", "43")
+		} else {
+			w.Header().Set("Content-Length", "20480")
+		}
+	}))
+	defer ts.Close()
+
+	msg := &storage.Message{HTML: `<img src="` + ts.URL + `/open.gif"><img src="` + ts.URL + `/photo.gif">`}
+
+	res, err := RunTrackingTests(msg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Total != 1 {
+		t.Fatalf("expected 1 tracker, got %d: %+v", res.Total, res.Trackers)
+	}
+
+	tr := res.Trackers[0]
+	if tr.URL != ts.URL+"/open.gif" || tr.StatusCode != 200 || tr.Size != 43 || tr.Reasons[0] != "tiny image (43 bytes)" {
+		t.Errorf("unexpected tracker: %+v", tr)
+	}
+}
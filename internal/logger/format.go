@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Structured log field names
+const (
+	// FieldComponent is the application component, eg: smtpd
+	FieldComponent = "component"
+	// FieldMessageID is the message database ID
+	FieldMessageID = "message_id"
+	// FieldClientIP is the IP address of the SMTP or HTTP client
+	FieldClientIP = "client_ip"
+	// FieldRequestID is the HTTP request ID (from the X-Request-Id header)
+	FieldRequestID = "request_id"
+	// FieldError is the error message
+	FieldError = "error"
+)
+
+// Fields are structured log fields, only included in the JSON log format
+type Fields = logrus.Fields
+
+// component prefix of log messages, eg: "[smtpd] "
+var componentRe = regexp.MustCompile(`^\[([a-z0-9\-]+)\] `)
+
+// WithFields returns a log entry with structured fields. Fields are only included in the JSON log format,
+// so messages should still include any relevant values for the default text format.
+func WithFields(f Fields) *logrus.Entry {
+	return Log().WithFields(f)
+}
+
+// TextFormatter is the default human-readable log format. Structured fields are omitted
+// so the output is unchanged by call sites adding fields.
+type textFormatter struct {
+	logrus.TextFormatter
+}
+
+// Format an entry without its fields
+func (f *textFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	if len(e.Data) == 0 {
+		return f.TextFormatter.Format(e)
+	}
+
+	clone := &logrus.Entry{
+		Logger:  e.Logger,
+		Data:    logrus.Fields{},
+		Time:    e.Time,
+		Level:   e.Level,
+		Caller:  e.Caller,
+		Message: e.Message,
+		Buffer:  e.Buffer,
+		Context: e.Context,
+	}
+
+	return f.TextFormatter.Format(clone)
+}
+
+// JSONFormatter emits one JSON object per line with the timestamp, level, message & fields.
+// The message component prefix (eg: "[smtpd] ") is moved to the component field.
+type jsonFormatter struct {
+	logrus.JSONFormatter
+}
+
+func newJSONFormatter() *jsonFormatter {
+	return &jsonFormatter{logrus.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  "timestamp",
+			logrus.FieldKeyLevel: "level",
+			logrus.FieldKeyMsg:   "message",
+		},
+	}}
+}
+
+// Format an entry as JSON
+func (f *jsonFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	m := componentRe.FindStringSubmatch(e.Message)
+	if m == nil {
+		return f.JSONFormatter.Format(e)
+	}
+
+	data := logrus.Fields{}
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	if _, ok := data[FieldComponent]; !ok {
+		data[FieldComponent] = m[1]
+	}
+
+	clone := &logrus.Entry{
+		Logger:  e.Logger,
+		Data:    data,
+		Time:    e.Time,
+		Level:   e.Level,
+		Caller:  e.Caller,
+		Message: e.Message[len(m[0]):],
+		Buffer:  e.Buffer,
+		Context: e.Context,
+	}
+
+	return f.JSONFormatter.Format(clone)
+}
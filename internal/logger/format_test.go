@@ -0,0 +1,98 @@
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.SetLevel(logrus.DebugLevel)
+	l.SetFormatter(newJSONFormatter())
+
+	l.Info("[smtpd] starting on 0.0.0.0:1025")
+	l.WithFields(Fields{FieldComponent: "smtpd", FieldClientIP: "127.0.0.1", FieldMessageID: "abc"}).Debugf("[smtpd] received (%s)", "127.0.0.1")
+	l.WithFields(Fields{FieldRequestID: "req-1", FieldError: "multi\nline \"error\""}).Errorf("[db] %s", "multi\nline \"error\"")
+	l.Warn("no component")
+
+	lines := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		lines++
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %s", scanner.Text(), err.Error())
+		}
+
+		for _, k := range []string{"timestamp", "level", "message"} {
+			if _, ok := entry[k]; !ok {
+				t.Errorf("missing %s in %q", k, scanner.Text())
+			}
+		}
+
+		switch lines {
+		case 1:
+			if entry[FieldComponent] != "smtpd" || entry["message"] != "starting on 0.0.0.0:1025" {
+				t.Errorf("component not extracted from %q", scanner.Text())
+			}
+		case 2:
+			if entry[FieldClientIP] != "127.0.0.1" || entry[FieldMessageID] != "abc" || entry["level"] != "debug" {
+				t.Errorf("missing fields in %q", scanner.Text())
+			}
+		case 3:
+			if entry[FieldComponent] != "db" || entry[FieldRequestID] != "req-1" {
+				t.Errorf("missing fields in %q", scanner.Text())
+			}
+		case 4:
+			if _, ok := entry[FieldComponent]; ok {
+				t.Errorf("unexpected component in %q", scanner.Text())
+			}
+		}
+	}
+
+	if lines != 4 {
+		t.Errorf("expected 4 log lines, got %d", lines)
+	}
+}
+
+func TestTextFormatUnchanged(t *testing.T) {
+	f := &textFormatter{logrus.TextFormatter{
+		FullTimestamp:   true,
+		TimestampFormat: "2006/01/02 15:04:05",
+	}}
+
+	original := &logrus.TextFormatter{
+		FullTimestamp:   true,
+		TimestampFormat: "2006/01/02 15:04:05",
+	}
+
+	l := logrus.New()
+	e := logrus.NewEntry(l)
+	e.Level = logrus.InfoLevel
+	e.Message = "[smtpd] received (127.0.0.1) from:test@example.com"
+
+	expected, err := original.Format(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withFields := e.WithFields(Fields{FieldComponent: "smtpd", FieldClientIP: "127.0.0.1"})
+	withFields.Level = e.Level
+	withFields.Message = e.Message
+	withFields.Time = e.Time
+
+	b, err := f.Format(withFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, expected) {
+		t.Errorf("text format changed: %q != %q", b, expected)
+	}
+}
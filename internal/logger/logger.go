@@ -21,6 +21,8 @@ var (
 	NoLogging bool
 	// LogFile sets a log file
 	LogFile string
+	// LogFormat is the log format, either "text" (default) or "json"
+	LogFormat = "text"
 )
 
 // Log returns the logger instance
@@ -51,10 +53,23 @@ func Log() *logrus.Logger {
 			log.Out = os.Stdout
 		}
 
-		log.SetFormatter(&logrus.TextFormatter{
-			FullTimestamp:   true,
-			TimestampFormat: "2006/01/02 15:04:05",
-		})
+		if LogFormat == "json" {
+			log.SetFormatter(newJSONFormatter())
+		} else {
+			log.SetFormatter(&textFormatter{logrus.TextFormatter{
+				FullTimestamp:   true,
+				TimestampFormat: "2006/01/02 15:04:05",
+			}})
+		}
+
+		if SyslogAddress != "" {
+			hook, err := newSyslogHook(SyslogAddress, SyslogFacility, SyslogTag)
+			if err == nil {
+				log.AddHook(hook)
+			} else {
+				log.Warnf("Failed to log to syslog: %s", err.Error())
+			}
+		}
 	}
 
 	return log
@@ -0,0 +1,230 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// number of log entries buffered while the syslog target is slow or unavailable
+	syslogBufferSize = 1000
+	// timeout for connecting & writing to the syslog target
+	syslogTimeout = 5 * time.Second
+	// minimum delay between reconnection attempts to an unavailable syslog target
+	syslogRetryDelay = 5 * time.Second
+)
+
+var (
+	// SyslogAddress enables logging to syslog, either "local" for the local syslog socket, a unix socket path,
+	// or a network address (eg: udp://localhost:514 or tcp://localhost:514)
+	SyslogAddress string
+	// SyslogFacility is the syslog facility, eg: user, daemon or local0
+	SyslogFacility = "user"
+	// SyslogTag is the syslog tag (program name)
+	SyslogTag = "mailpit"
+
+	syslogDropped uint64
+
+	syslogFacilities = map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+		"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+		"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+
+	// default local syslog sockets
+	syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+)
+
+// SyslogDropped returns the number of log entries dropped because the syslog target was unavailable
+func SyslogDropped() uint64 {
+	return atomic.LoadUint64(&syslogDropped)
+}
+
+// SyslogHook is a logrus hook which sends log entries to syslog. Entries are written asynchronously
+// so a slow or unavailable syslog target never blocks the application. If the buffer fills up then
+// entries are dropped and counted.
+type syslogHook struct {
+	network  string
+	address  string
+	facility int
+	tag      string
+	hostname string
+	entries  chan syslogEntry
+
+	mu        sync.Mutex
+	conn      net.Conn
+	lastRetry time.Time
+}
+
+type syslogEntry struct {
+	severity int
+	time     time.Time
+	message  string
+}
+
+// NewSyslogHook returns a syslog hook for the configured address, facility & tag
+func newSyslogHook(addr, facility, tag string) (*syslogHook, error) {
+	f, ok := syslogFacilities[strings.ToLower(strings.TrimSpace(facility))]
+	if !ok {
+		return nil, fmt.Errorf("invalid syslog facility: %s", facility)
+	}
+
+	network, address, err := parseSyslogAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag == "" {
+		tag = filepath.Base(os.Args[0])
+	}
+
+	hostname, _ := os.Hostname()
+
+	h := &syslogHook{
+		network:  network,
+		address:  address,
+		facility: f,
+		tag:      tag,
+		hostname: hostname,
+		entries:  make(chan syslogEntry, syslogBufferSize),
+	}
+
+	go h.run()
+
+	return h, nil
+}
+
+// ParseSyslogAddress returns the network & address of a syslog target
+func parseSyslogAddress(addr string) (string, string, error) {
+	addr = strings.TrimSpace(addr)
+
+	switch {
+	case addr == "local":
+		for _, s := range syslogLocalSockets {
+			if _, err := os.Stat(s); err == nil {
+				return "unixgram", s, nil
+			}
+		}
+		return "", "", fmt.Errorf("no local syslog socket found")
+	case strings.HasPrefix(addr, "unix://"):
+		return "unixgram", strings.TrimPrefix(addr, "unix://"), nil
+	case strings.HasPrefix(addr, "/"):
+		return "unixgram", addr, nil
+	case strings.HasPrefix(addr, "udp://"), strings.HasPrefix(addr, "tcp://"):
+		network, address, _ := strings.Cut(addr, "://")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid syslog address %s: %s", addr, err.Error())
+		}
+		return network, address, nil
+	default:
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("invalid syslog address %s: %s", addr, err.Error())
+		}
+		return "udp", addr, nil
+	}
+}
+
+// Levels returns all log levels, the logger level determines what is logged
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues a log entry, dropping it if the buffer is full
+func (h *syslogHook) Fire(e *logrus.Entry) error {
+	select {
+	case h.entries <- syslogEntry{severity: syslogSeverity(e.Level), time: e.Time, message: e.Message}:
+	default:
+		atomic.AddUint64(&syslogDropped, 1)
+	}
+
+	return nil
+}
+
+func (h *syslogHook) run() {
+	for e := range h.entries {
+		if err := h.write(e); err != nil {
+			atomic.AddUint64(&syslogDropped, 1)
+		}
+	}
+}
+
+// Write an entry, reconnecting once if the connection has been lost
+func (h *syslogHook) write(e syslogEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if h.conn == nil {
+			if time.Since(h.lastRetry) < syslogRetryDelay {
+				return fmt.Errorf("syslog unavailable")
+			}
+
+			conn, err := h.dial()
+			if err != nil {
+				h.lastRetry = time.Now()
+				return err
+			}
+			h.conn = conn
+		}
+
+		_ = h.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := h.conn.Write(h.format(e)); err == nil {
+			return nil
+		}
+
+		_ = h.conn.Close()
+		h.conn = nil
+	}
+
+	return fmt.Errorf("syslog write failed")
+}
+
+func (h *syslogHook) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(h.network, h.address, syslogTimeout)
+	if err != nil && h.network == "unixgram" {
+		// some systems only provide a stream socket
+		return net.DialTimeout("unix", h.address, syslogTimeout)
+	}
+
+	return conn, err
+}
+
+// Format an entry in the traditional BSD syslog format (RFC 3164). The hostname is omitted for local sockets.
+func (h *syslogHook) format(e syslogEntry) []byte {
+	pri := h.facility*8 + e.severity
+	ts := e.time.Format(time.Stamp)
+	msg := strings.TrimRight(e.message, "\n")
+
+	if strings.HasPrefix(h.network, "unix") {
+		return []byte(fmt.Sprintf("<%d>%s %s[%d]: %s\n", pri, ts, h.tag, os.Getpid(), msg))
+	}
+
+	return []byte(fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", pri, ts, h.hostname, h.tag, os.Getpid(), msg))
+}
+
+// SyslogSeverity maps the log level to a syslog severity
+func syslogSeverity(l logrus.Level) int {
+	switch l {
+	case logrus.PanicLevel:
+		return 0 // emerg
+	case logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
@@ -0,0 +1,85 @@
+package logger
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSyslogHook(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	hook, err := newSyslogHook("udp://"+pc.LocalAddr().String(), "local0", "mailpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := logrus.New()
+	l.SetLevel(logrus.DebugLevel)
+	l.AddHook(hook)
+	l.Out = &strings.Builder{}
+
+	l.Warn("[smtpd] test warning")
+
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := string(buf[:n])
+	// local0 (16) * 8 + warning (4)
+	if !strings.HasPrefix(msg, "<132>") || !strings.Contains(msg, " mailpit[") || !strings.HasSuffix(msg, ": [smtpd] test warning\n") {
+		t.Errorf("unexpected syslog message %q", msg)
+	}
+}
+
+func TestSyslogUnavailable(t *testing.T) {
+	if _, err := newSyslogHook("localhost:514", "invalid", ""); err == nil {
+		t.Error("expected an error for an invalid facility")
+	}
+
+	if _, err := newSyslogHook("localhost", "user", ""); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+
+	// closed port, connection refused
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	hook, err := newSyslogHook("tcp://"+addr, "user", "mailpit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := SyslogDropped()
+
+	start := time.Now()
+	for i := 0; i < syslogBufferSize*2; i++ {
+		_ = hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Time: time.Now(), Message: "test"})
+	}
+
+	if time.Since(start) > time.Second {
+		t.Error("logging blocked while syslog was unavailable")
+	}
+
+	for i := 0; i < 100 && SyslogDropped()-dropped < syslogBufferSize; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if SyslogDropped()-dropped < syslogBufferSize {
+		t.Errorf("expected at least %d dropped entries, got %d", syslogBufferSize, SyslogDropped()-dropped)
+	}
+}
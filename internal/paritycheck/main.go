@@ -0,0 +1,219 @@
+// Package paritycheck compares a message's HTML and plain text content
+package paritycheck
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/axllent/mailpit/internal/html2text"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tools"
+	"github.com/jhillyerd/enmime"
+)
+
+var (
+	urlRe = regexp.MustCompile(`(?i)\b(https?|ftp):\/\/[^\s<>"'\)\]]+`)
+
+	// common placeholder text parts sent by HTML-only templates
+	placeholderRe = regexp.MustCompile(`(?i)(requires? an? html|html[\s\-](viewer|capable|compatible|enabled)|does not support html|(enable|switch to) html|view (this|the) (email|message) (in|with) (a|your) (web )?browser|not displaying correctly)`)
+
+	// elements treated as text blocks when comparing content
+	blockSelector = "p, h1, h2, h3, h4, h5, h6, li, td, th, div, blockquote"
+
+	// call-to-action elements, compared individually
+	ctaSelector = "a, button"
+)
+
+// RunTests will compare the HTML part (converted to text) against the text part
+func RunTests(msg *storage.Message, raw []byte) (Response, error) {
+	s := Response{}
+	s.HTMLOnlyLinks = []string{}
+	s.HTMLOnlyText = []string{}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return s, err
+	}
+
+	plain := plainText(env)
+	htmlText := normalise(html2text.Strip(msg.HTML, false))
+	text := normalise(plain)
+
+	s.TextEmpty = text == ""
+	s.TextPlaceholder = !s.TextEmpty && len(text) < 300 && placeholderRe.MatchString(plain)
+	s.Similarity = similarity(htmlText, text)
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(msg.HTML))
+	if err != nil {
+		return s, err
+	}
+
+	s.HTMLOnlyLinks = missingLinks(doc, plain)
+	s.HTMLOnlyText = missingText(doc, text)
+	s.TextAfterHTML = textAfterHTML(env.Root)
+
+	return s, nil
+}
+
+// Return the message's text/plain content, ignoring the text enmime generates from the HTML
+// when the text part is missing or empty
+func plainText(env *enmime.Envelope) string {
+	for _, e := range env.Errors {
+		if e.Name == enmime.ErrorPlainTextFromHTML {
+			return ""
+		}
+	}
+
+	return env.Text
+}
+
+// Normalise a string for comparison by lowercasing, removing URLs & punctuation, and collapsing whitespace
+func normalise(s string) string {
+	s = urlRe.ReplaceAllString(strings.ToLower(s), " ")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return r
+		}
+		return ' '
+	}, s)
+
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Similarity returns the Sørensen–Dice coefficient of the words in both strings as a percentage
+func similarity(a, b string) float64 {
+	aWords := strings.Fields(a)
+	bWords := strings.Fields(b)
+
+	if len(aWords) == 0 && len(bWords) == 0 {
+		return 100
+	}
+
+	counts := make(map[string]int, len(aWords))
+	for _, w := range aWords {
+		counts[w]++
+	}
+
+	matches := 0
+	for _, w := range bWords {
+		if counts[w] > 0 {
+			counts[w]--
+			matches++
+		}
+	}
+
+	score := float64(2*matches) / float64(len(aWords)+len(bWords)) * 100
+
+	return math.Round(score*100) / 100
+}
+
+// Return all HTTP links in the HTML which do not appear in the text part
+func missingLinks(doc *goquery.Document, text string) []string {
+	links := []string{}
+	textLinks := make(map[string]bool)
+	for _, l := range urlRe.FindAllString(text, -1) {
+		textLinks[strings.TrimRight(strings.TrimRight(l, ".,;:!?"), "/")] = true
+	}
+
+	for _, link := range doc.Find("a[href]").Nodes {
+		href, err := tools.GetHTMLAttributeVal(link, "href")
+		if err != nil || !urlRe.MatchString(href) {
+			continue
+		}
+
+		href = strings.TrimSpace(href)
+		if !textLinks[strings.TrimRight(href, "/")] && !inArray(href, links) {
+			links = append(links, href)
+		}
+	}
+
+	return links
+}
+
+// Return the innermost HTML text blocks & calls-to-action which do not appear in the normalised text part
+func missingText(doc *goquery.Document, text string) []string {
+	blocks := []string{}
+
+	add := func(_ int, sel *goquery.Selection) {
+		h, err := goquery.OuterHtml(sel)
+		if err != nil {
+			return
+		}
+
+		block := html2text.Strip(h, false)
+		n := normalise(block)
+		// ignore empty blocks & single characters/separators
+		if len(n) < 2 || strings.Contains(text, n) || inArray(block, blocks) {
+			return
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	doc.Find(blockSelector).Each(func(i int, sel *goquery.Selection) {
+		// only compare the innermost blocks
+		if sel.Find(blockSelector).Length() == 0 {
+			add(i, sel)
+		}
+	})
+
+	doc.Find(ctaSelector).Each(add)
+
+	return blocks
+}
+
+// Detect whether any multipart/alternative contains the text part after the HTML part.
+// Clients display the last supported alternative, so the text part should come first (RFC 2046).
+func textAfterHTML(p *enmime.Part) bool {
+	if p == nil {
+		return false
+	}
+
+	if strings.EqualFold(p.ContentType, "multipart/alternative") {
+		seenHTML := false
+		for c := p.FirstChild; c != nil; c = c.NextSibling {
+			if containsHTML(c) {
+				seenHTML = true
+			} else if strings.EqualFold(c.ContentType, "text/plain") && seenHTML {
+				return true
+			}
+		}
+	}
+
+	for c := p.FirstChild; c != nil; c = c.NextSibling {
+		if textAfterHTML(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the part is, or contains, a text/html part
+func containsHTML(p *enmime.Part) bool {
+	if strings.EqualFold(p.ContentType, "text/html") {
+		return true
+	}
+
+	for c := p.FirstChild; c != nil; c = c.NextSibling {
+		if containsHTML(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func inArray(n string, h []string) bool {
+	for _, v := range h {
+		if v == n {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,275 @@
+package paritycheck
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/jhillyerd/enmime"
+)
+
+func TestNormalise(t *testing.T) {
+	tests := map[string]string{}
+	tests["Hello  World"] = "hello world"
+	tests["Hello, World!"] = "hello world"
+	tests["Visit https://example.com/path?a=1 today."] = "visit today"
+	tests["Price: $10.99"] = "price 10 99"
+	tests["Grüße aus Zürich"] = "grüße aus zürich"
+	tests["line one\r\n\r\n  line two"] = "line one line two"
+	tests["---"] = ""
+
+	for str, expected := range tests {
+		res := normalise(str)
+		if res != expected {
+			t.Log("error:", res, "!=", expected)
+			t.Fail()
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected float64
+	}{
+		{"", "", 100},
+		{"hello world", "hello world", 100},
+		{"hello world", "world hello", 100},
+		{"hello world", "", 0},
+		{"", "hello world", 0},
+		{"hello world", "goodbye moon", 0},
+		{"hello world", "hello moon", 50},
+		{"the cat sat", "the cat", 80},
+		{"a a a", "a", 50},
+		{"one two three", "one", 50},
+		{"one two three four five six", "one two", 50},
+		{"one two", "one three four", 40},
+		{"a b c", "a b d", 66.67},
+	}
+
+	for _, test := range tests {
+		res := similarity(test.a, test.b)
+		if res != test.expected {
+			t.Errorf("\"%s\" & \"%s\": expected %v, got %v", test.a, test.b, test.expected, res)
+		}
+	}
+}
+
+func TestMissingLinks(t *testing.T) {
+	tests := []struct {
+		html     string
+		text     string
+		expected []string
+	}{
+		{
+			`<a href="https://example.com">Example</a>`,
+			"Example https://example.com",
+			[]string{},
+		},
+		{
+			`<a href="https://example.com/">Example</a>`,
+			"Example (https://example.com).",
+			[]string{},
+		},
+		{
+			`<a href="https://example.com/path">Example</a>`,
+			"Example https://example.com/path/",
+			[]string{},
+		},
+		{
+			`<a href="https://example.com/one">One</a><a href="https://example.com/two">Two</a>`,
+			"One https://example.com/one",
+			[]string{"https://example.com/two"},
+		},
+		{
+			`<a href="https://example.com/one">One</a><a href="https://example.com/one">Again</a>`,
+			"",
+			[]string{"https://example.com/one"},
+		},
+		{
+			`<a href="mailto:test@example.com">Email</a><a href="#top">Top</a><a href="/relative">Relative</a>`,
+			"",
+			[]string{},
+		},
+		{
+			`<a href=" https://example.com/spaced ">Spaced</a>`,
+			"",
+			[]string{"https://example.com/spaced"},
+		},
+	}
+
+	for _, test := range tests {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(test.html))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := missingLinks(doc, test.text)
+		if strings.Join(res, ", ") != strings.Join(test.expected, ", ") {
+			t.Errorf("%s: expected %v, got %v", test.html, test.expected, res)
+		}
+	}
+}
+
+func TestMissingText(t *testing.T) {
+	tests := []struct {
+		html     string
+		text     string
+		expected []string
+	}{
+		{
+			`<h1>Welcome</h1><p>Thanks for signing up.</p>`,
+			"Welcome! Thanks for signing up.",
+			[]string{},
+		},
+		{
+			`<h1>Welcome</h1><p>Thanks for signing up.</p><p>Your code is 1234.</p>`,
+			"Welcome! Thanks for signing up.",
+			[]string{"Your code is 1234."},
+		},
+		{
+			// only the innermost blocks are compared
+			`<div><div><p>First</p></div><p>Second</p></div>`,
+			"First",
+			[]string{"Second"},
+		},
+		{
+			// calls-to-action are compared individually
+			`<p>Click <a href="https://example.com">Confirm email</a> to continue</p>`,
+			"Click to continue",
+			[]string{"Click Confirm email to continue", "Confirm email"},
+		},
+		{
+			`<button>Buy now</button>`,
+			"Buy now",
+			[]string{},
+		},
+		{
+			// empty blocks & separators are ignored
+			`<p></p><p>|</p><td>&nbsp;</td>`,
+			"",
+			[]string{},
+		},
+		{
+			// duplicate blocks are only returned once
+			`<p>Missing</p><p>Missing</p>`,
+			"",
+			[]string{"Missing"},
+		},
+	}
+
+	for _, test := range tests {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(test.html))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := missingText(doc, normalise(test.text))
+		if strings.Join(res, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("%s: expected %q, got %q", test.html, test.expected, res)
+		}
+	}
+}
+
+func TestTextAfterHTML(t *testing.T) {
+	textPart := "--b1\r\nContent-Type: text/plain\r\n\r\nHello\r\n"
+	htmlPart := "--b1\r\nContent-Type: text/html\r\n\r\n<p>Hello</p>\r\n"
+
+	tests := map[string]bool{}
+	tests["multipart/alternative; boundary=\"b1\"\r\n\r\n"+textPart+htmlPart+"--b1--\r\n"] = false
+	tests["multipart/alternative; boundary=\"b1\"\r\n\r\n"+htmlPart+textPart+"--b1--\r\n"] = true
+	// text & HTML parts of a multipart/mixed message are not alternatives
+	tests["multipart/mixed; boundary=\"b1\"\r\n\r\n"+htmlPart+textPart+"--b1--\r\n"] = false
+	// a nested multipart/related containing the HTML part
+	tests["multipart/alternative; boundary=\"b1\"\r\n\r\n"+
+		"--b1\r\nContent-Type: multipart/related; boundary=\"b2\"\r\n\r\n"+
+		"--b2\r\nContent-Type: text/html\r\n\r\n<p>Hello</p>\r\n--b2--\r\n"+
+		textPart+"--b1--\r\n"] = true
+	// an alternative nested inside a multipart/mixed
+	tests["multipart/mixed; boundary=\"b0\"\r\n\r\n"+
+		"--b0\r\nContent-Type: multipart/alternative; boundary=\"b1\"\r\n\r\n"+htmlPart+textPart+"--b1--\r\n"+
+		"--b0--\r\n"] = true
+
+	for contentType, expected := range tests {
+		raw := "From: sender@example.com\r\nMIME-Version: 1.0\r\nContent-Type: " + contentType
+
+		env, err := enmime.ReadEnvelope(bytes.NewReader([]byte(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res := textAfterHTML(env.Root); res != expected {
+			t.Errorf("%s: expected %v, got %v", contentType, expected, res)
+		}
+	}
+
+	if textAfterHTML(nil) {
+		t.Error("nil part should return false")
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	alternative := func(text string) string {
+		return "From: sender@example.com\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"b1\"\r\n\r\n" +
+			"--b1\r\nContent-Type: text/plain\r\n\r\n" + text + "\r\n" +
+			"--b1\r\nContent-Type: text/html\r\n\r\n<p>Hello world</p>\r\n--b1--\r\n"
+	}
+
+	tests := []struct {
+		name     string
+		raw      string
+		expected Response
+	}{
+		{
+			"matching",
+			alternative("Hello world"),
+			Response{Similarity: 100},
+		},
+		{
+			"empty text part",
+			alternative(" "),
+			Response{Similarity: 0, TextEmpty: true},
+		},
+		{
+			"missing text part",
+			"From: sender@example.com\r\nMIME-Version: 1.0\r\nContent-Type: text/html\r\n\r\n<p>Hello world</p>\r\n",
+			Response{Similarity: 0, TextEmpty: true},
+		},
+		{
+			"placeholder",
+			alternative("This email requires an HTML viewer."),
+			Response{Similarity: 0, TextPlaceholder: true},
+		},
+	}
+
+	for _, test := range tests {
+		raw := []byte(test.raw)
+		env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// storage.Message is populated from the parsed envelope, including any text generated from the HTML
+		msg := &storage.Message{HTML: env.HTML, Text: env.Text}
+
+		res, err := RunTests(msg, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Similarity != test.expected.Similarity {
+			t.Errorf("%s: expected similarity %v, got %v", test.name, test.expected.Similarity, res.Similarity)
+		}
+		if res.TextEmpty != test.expected.TextEmpty {
+			t.Errorf("%s: expected TextEmpty %v, got %v", test.name, test.expected.TextEmpty, res.TextEmpty)
+		}
+		if res.TextPlaceholder != test.expected.TextPlaceholder {
+			t.Errorf("%s: expected TextPlaceholder %v, got %v", test.name, test.expected.TextPlaceholder, res.TextPlaceholder)
+		}
+		if res.TextAfterHTML {
+			t.Errorf("%s: unexpected TextAfterHTML", test.name)
+		}
+	}
+}
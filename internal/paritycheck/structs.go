@@ -0,0 +1,19 @@
+package paritycheck
+
+// Response represents the HTML & text parity check response
+//
+// swagger:model ParityCheckResponse
+type Response struct {
+	// Similarity percentage (0-100) between the converted HTML and the text part
+	Similarity float64 `json:"Similarity"`
+	// Links found in the HTML part which are missing from the text part
+	HTMLOnlyLinks []string `json:"HTMLOnlyLinks"`
+	// Text blocks found in the HTML part which are missing from the text part
+	HTMLOnlyText []string `json:"HTMLOnlyText"`
+	// The text part is missing or empty
+	TextEmpty bool `json:"TextEmpty"`
+	// The text part only contains a placeholder, eg: "This email requires an HTML viewer"
+	TextPlaceholder bool `json:"TextPlaceholder"`
+	// A multipart/alternative contains the text part after the HTML part
+	TextAfterHTML bool `json:"TextAfterHTML"`
+}
@@ -6,10 +6,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/axllent/mailpit/internal/httpclient"
 )
 
 // Response struct
@@ -48,9 +49,7 @@ func Check(email []byte, timeout int) (Response, error) {
 		return r, err
 	}
 
-	client := http.Client{
-		Timeout: time.Duration(timeout) * time.Second,
-	}
+	client := httpclient.Client(time.Duration(timeout)*time.Second, false)
 
 	resp, err := client.Post("https://spamcheck.postmarkapp.com/filter", "application/json",
 		bytes.NewBuffer(data))
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/internal/updater"
 )
@@ -24,6 +25,17 @@ var (
 	smtpAcceptedSize float64
 	smtpRejected     float64
 	smtpIgnored      float64
+
+	smtpConnectionsRejected float64
+	smtpQuotaRejected       float64
+	smtpOversize            float64
+
+	// returns the open SMTP connections, set once the SMTP server is started
+	smtpConnections func() (open, ips, maxPerIP int)
+
+	relayConnections float64
+	relayReused      float64
+	relayReconnects  float64
 )
 
 // AppInformation struct
@@ -31,6 +43,8 @@ var (
 type AppInformation struct {
 	// Current Mailpit version
 	Version string
+	// Optional label to identify the Mailpit instance
+	Label string
 	// Latest Mailpit version
 	LatestVersion string
 	// Database path
@@ -41,6 +55,8 @@ type AppInformation struct {
 	Messages float64
 	// Total number of messages in the database
 	Unread float64
+	// Total number of pinned messages in the database
+	Pinned float64
 	// Tags and message totals per tag
 	Tags map[string]int64
 	// Runtime statistics
@@ -59,6 +75,26 @@ type AppInformation struct {
 		SMTPRejected float64
 		// Ignored runtime SMTP messages (when using --ignore-duplicate-ids)
 		SMTPIgnored float64
+		// Open SMTP & LMTP connections
+		SMTPConnections float64
+		// Remote IP addresses with open SMTP & LMTP connections
+		SMTPConnectionIPs float64
+		// Highest number of open SMTP & LMTP connections from a single remote IP address
+		SMTPConnectionsMaxPerIP float64
+		// Rejected runtime SMTP connections (when exceeding the connection or message limits)
+		SMTPConnectionsRejected float64
+		// Rejected runtime SMTP messages (when exceeding the sender quota)
+		SMTPQuotaRejected float64
+		// Rejected runtime SMTP messages (when exceeding the maximum message size)
+		SMTPOversize float64
+		// Open pooled SMTP relay connections (when relay connection pooling is enabled)
+		RelayConnections float64
+		// Runtime messages relayed via a reused SMTP relay connection
+		RelayReused float64
+		// Runtime SMTP relay reconnections after a pooled connection was closed by the relay
+		RelayReconnects float64
+		// Runtime log entries dropped because the syslog target was unavailable (when logging to syslog)
+		SyslogDropped float64
 	}
 }
 
@@ -66,6 +102,7 @@ type AppInformation struct {
 func Load() AppInformation {
 	info := AppInformation{}
 	info.Version = config.Version
+	info.Label = config.Label
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -77,6 +114,19 @@ func Load() AppInformation {
 	info.RuntimeStats.SMTPAcceptedSize = smtpAcceptedSize
 	info.RuntimeStats.SMTPRejected = smtpRejected
 	info.RuntimeStats.SMTPIgnored = smtpIgnored
+	info.RuntimeStats.SMTPConnectionsRejected = smtpConnectionsRejected
+	if smtpConnections != nil {
+		open, ips, maxPerIP := smtpConnections()
+		info.RuntimeStats.SMTPConnections = float64(open)
+		info.RuntimeStats.SMTPConnectionIPs = float64(ips)
+		info.RuntimeStats.SMTPConnectionsMaxPerIP = float64(maxPerIP)
+	}
+	info.RuntimeStats.SMTPQuotaRejected = smtpQuotaRejected
+	info.RuntimeStats.SMTPOversize = smtpOversize
+	info.RuntimeStats.RelayConnections = relayConnections
+	info.RuntimeStats.RelayReused = relayReused
+	info.RuntimeStats.RelayReconnects = relayReconnects
+	info.RuntimeStats.SyslogDropped = float64(logger.SyslogDropped())
 
 	if latestVersionCache != "" {
 		info.LatestVersion = latestVersionCache
@@ -98,6 +148,7 @@ func Load() AppInformation {
 	info.DatabaseSize = storage.DbSize()
 	info.Messages = storage.CountTotal()
 	info.Unread = storage.CountUnread()
+	info.Pinned = storage.CountPinned()
 	info.Tags = storage.GetAllTagsCount()
 
 	return info
@@ -129,3 +180,52 @@ func LogSMTPIgnored() {
 	smtpIgnored = smtpIgnored + 1
 	mu.Unlock()
 }
+
+// TrackSMTPConnections sets the function returning the open SMTP & LMTP connections, see smtpd.Server.ConnectionCounts()
+func TrackSMTPConnections(f func() (open, ips, maxPerIP int)) {
+	mu.Lock()
+	smtpConnections = f
+	mu.Unlock()
+}
+
+// LogSMTPConnectionRejected logs a rejected SMTP connection
+func LogSMTPConnectionRejected() {
+	mu.Lock()
+	smtpConnectionsRejected = smtpConnectionsRejected + 1
+	mu.Unlock()
+}
+
+// LogSMTPQuotaRejected logs a message rejected for exceeding the sender quota
+func LogSMTPQuotaRejected() {
+	mu.Lock()
+	smtpQuotaRejected = smtpQuotaRejected + 1
+	mu.Unlock()
+}
+
+// LogSMTPOversize logs a message rejected for exceeding the maximum message size
+func LogSMTPOversize() {
+	mu.Lock()
+	smtpOversize = smtpOversize + 1
+	mu.Unlock()
+}
+
+// SetRelayConnections sets the number of open pooled SMTP relay connections
+func SetRelayConnections(n int) {
+	mu.Lock()
+	relayConnections = float64(n)
+	mu.Unlock()
+}
+
+// LogRelayReused logs a message relayed via a reused SMTP relay connection
+func LogRelayReused() {
+	mu.Lock()
+	relayReused = relayReused + 1
+	mu.Unlock()
+}
+
+// LogRelayReconnect logs a reconnection to the SMTP relay after a pooled connection was closed
+func LogRelayReconnect() {
+	mu.Lock()
+	relayReconnects = relayReconnects + 1
+	mu.Unlock()
+}
@@ -0,0 +1,556 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/jhillyerd/enmime"
+	"github.com/leporo/sqlf"
+)
+
+// the number of messages processed per transaction when pruning attachments
+const pruneAttachmentsChunkSize = 100
+
+// PruneAttachmentsResult is the summary of a PruneAttachments() run
+//
+// swagger:model PruneAttachmentsResult
+type PruneAttachmentsResult struct {
+	// Number of messages processed
+	Messages int
+	// Number of attachment parts removed
+	Attachments int
+	// Total bytes reclaimed (uncompressed message size)
+	BytesReclaimed float64
+	// Number of matching messages still to be processed (when a limit is set)
+	Remaining int
+}
+
+// PruneAttachments will strip the content of attachments from messages older than the given age,
+// replacing each part with a text placeholder recording the original filename, content type & size.
+// Inline parts (such as images referenced in the HTML) are kept if keepInline is true. Pinned messages
+// are never pruned.
+//
+// Messages are processed in small chunks, each in its own transaction, and every processed message
+// is flagged, so the operation can be interrupted and resumed. A limit of 0 processes all messages.
+func PruneAttachments(olderThan time.Duration, keepInline bool, limit int) (PruneAttachmentsResult, error) {
+	result := PruneAttachmentsResult{}
+	start := time.Now()
+	cutoff := start.Add(-olderThan).UnixMilli()
+
+	// 1 = attachments pruned, 2 = attachments & inline parts pruned
+	level := 2
+	if keepInline {
+		level = 1
+	}
+
+	for limit == 0 || result.Messages < limit {
+		chunk := pruneAttachmentsChunkSize
+		if limit > 0 && limit-result.Messages < chunk {
+			chunk = limit - result.Messages
+		}
+
+		ids, err := pruneAttachmentsCandidates(cutoff, level, keepInline, chunk)
+		if err != nil {
+			return result, err
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		removed, reclaimed, err := pruneAttachmentsChunk(ids, level, keepInline)
+		if err != nil {
+			return result, err
+		}
+
+		result.Messages = result.Messages + len(ids)
+		result.Attachments = result.Attachments + removed
+		result.BytesReclaimed = result.BytesReclaimed + reclaimed
+	}
+
+	if limit > 0 {
+		var remaining int
+		q := pruneAttachmentsQuery(cutoff, level, keepInline).Select("COUNT(*)").To(&remaining)
+		if err := q.QueryRowAndClose(context.TODO(), db); err != nil {
+			return result, err
+		}
+		result.Remaining = remaining
+	}
+
+	if result.BytesReclaimed > 0 {
+		addDeletedSize(int64(result.BytesReclaimed))
+		dbLastAction = time.Now()
+	}
+
+	logger.Log().Debugf("[db] pruned %d attachments from %d messages in %s, reclaiming %.0f bytes", result.Attachments, result.Messages, time.Since(start), result.BytesReclaimed)
+
+	return result, nil
+}
+
+// Query for unpinned messages which have not yet been pruned to the given level
+func pruneAttachmentsQuery(cutoff int64, level int, keepInline bool) *sqlf.Stmt {
+	q := sqlf.From(tenant("mailbox")).
+		Where("Created < ?", cutoff).
+		Where("AttachmentsPruned < ?", level).
+		Where("Pinned = 0")
+
+	if keepInline {
+		q.Where("Attachments > 0")
+	} else {
+		q.Where("(Attachments > 0 OR Inline > 0)")
+	}
+
+	return q
+}
+
+// Return the next set of message IDs to be processed, oldest first
+func pruneAttachmentsCandidates(cutoff int64, level int, keepInline bool, limit int) ([]string, error) {
+	ids := []string{}
+
+	q := pruneAttachmentsQuery(cutoff, level, keepInline).
+		Select("ID").
+		OrderBy("Created ASC").
+		Limit(limit)
+
+	err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		var id string
+		if err := row.Scan(&id); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+		ids = append(ids, id)
+	})
+
+	return ids, err
+}
+
+// Prune the attachments of a set of messages, saving the changes in a single transaction.
+// Returns the number of parts removed & the bytes reclaimed.
+func pruneAttachmentsChunk(ids []string, level int, keepInline bool) (int, float64, error) {
+	type pruned struct {
+		id          string
+		raw         []byte
+		size        float64
+		inline      int
+		attachments int
+		metadata    string
+		removed     int
+	}
+
+	removed := 0
+	var reclaimed float64
+	messages := []pruned{}
+
+	// messages are processed before the transaction as the database only allows a single connection
+	for _, id := range ids {
+		raw, err := GetMessageRaw(id)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		p := pruned{id: id}
+
+		stripped, n, err := stripAttachments(raw, keepInline)
+		if err != nil {
+			// flag the message as processed so it does not get processed again
+			logger.Log().Warnf("[db] unable to prune attachments from %s: %s", id, err.Error())
+		} else if n > 0 {
+			env, err := enmime.ReadEnvelope(bytes.NewReader(stripped))
+			if err != nil {
+				return 0, 0, err
+			}
+
+			p.raw = stripped
+			p.size = float64(len(stripped))
+			p.inline = len(env.Inlines)
+			p.attachments = len(env.Attachments)
+			p.removed = n
+
+			// update the attachments size & parts in the stored summary
+			obj := DBMailSummary{}
+			var metadata string
+			if err := sqlf.From(tenant("mailbox")).Select("Metadata").To(&metadata).Where("ID = ?", id).
+				QueryRowAndClose(context.TODO(), db); err != nil {
+				return 0, 0, err
+			}
+			if err := json.Unmarshal([]byte(metadata), &obj); err != nil {
+				return 0, 0, err
+			}
+			obj.AttachmentsSize = attachmentsSize(env)
+			obj.Parts = messageParts(env)
+			b, err := json.Marshal(obj)
+			if err != nil {
+				return 0, 0, err
+			}
+			p.metadata = string(b)
+
+			removed = removed + n
+			reclaimed = reclaimed + float64(len(raw)) - p.size
+		}
+
+		messages = append(messages, p)
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	for _, p := range messages {
+		if p.removed == 0 {
+			if _, err := tx.Exec(`UPDATE `+tenant("mailbox")+` SET AttachmentsPruned = ? WHERE ID = ?`, level, p.id); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+
+		encoded, err := encodeMessage(p.raw)
+		if err != nil {
+			return 0, 0, err
+		}
+		hexStr := hex.EncodeToString(encoded)
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET Email = x'%s' WHERE ID = ?`, tenant("mailbox_data"), hexStr), p.id); err != nil { // #nosec
+			return 0, 0, err
+		}
+
+		if _, err := tx.Exec(`UPDATE `+tenant("mailbox")+` SET Size = ?, Inline = ?, Attachments = ?, Metadata = ?, AttachmentsPruned = ? WHERE ID = ?`,
+			p.size, p.inline, p.attachments, p.metadata, level, p.id); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return removed, reclaimed, tx.Commit()
+}
+
+// Strip the content of all attachments (and optionally inline parts) from a raw message,
+// returning the new message and the number of parts removed
+func stripAttachments(raw []byte, keepInline bool) ([]byte, int, error) {
+	headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	sepLen := 4
+	if i := bytes.Index(raw, []byte("\n\n")); i > -1 && (headerEnd == -1 || i < headerEnd) {
+		headerEnd = i
+		sepLen = 2
+	}
+	if headerEnd == -1 {
+		return raw, 0, nil
+	}
+
+	headers := raw[:headerEnd+sepLen]
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(headers))).ReadMIMEHeader()
+	if err != nil {
+		return raw, 0, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		// single part messages are not processed
+		return raw, 0, nil
+	}
+
+	body, n, err := stripMultipart(raw[headerEnd+sepLen:], params["boundary"], keepInline)
+	if err != nil || n == 0 {
+		return raw, 0, err
+	}
+
+	b := make([]byte, 0, len(headers)+len(body))
+	b = append(b, headers...)
+
+	return append(b, body...), n, nil
+}
+
+// Strip the content of attachments from a multipart body, returning the original
+// body if no parts were removed
+func stripMultipart(body []byte, boundary string, keepInline bool) ([]byte, int, error) {
+	if boundary == "" {
+		return body, 0, errors.New("multipart boundary not found")
+	}
+
+	var b bytes.Buffer
+	removed := 0
+
+	// retain the preamble
+	if i := bytes.Index(body, []byte("--"+boundary)); i > 0 {
+		b.Write(body[:i])
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body, 0, err
+		}
+
+		data, err := io.ReadAll(p)
+		if err != nil {
+			return body, 0, err
+		}
+
+		header, data, n, err := stripPart(p.Header, data, keepInline)
+		if err != nil {
+			return body, 0, err
+		}
+
+		removed = removed + n
+
+		b.WriteString("--" + boundary + "\r\n")
+		writeMIMEHeader(&b, header)
+		b.WriteString("\r\n")
+		b.Write(data)
+		b.WriteString("\r\n")
+	}
+
+	if removed == 0 {
+		return body, 0, nil
+	}
+
+	b.WriteString("--" + boundary + "--\r\n")
+
+	return b.Bytes(), removed, nil
+}
+
+// Replace an attachment part with a placeholder, recursing into nested multiparts
+func stripPart(header textproto.MIMEHeader, data []byte, keepInline bool) (textproto.MIMEHeader, []byte, int, error) {
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		d, n, err := stripMultipart(data, params["boundary"], keepInline)
+		return header, d, n, err
+	}
+
+	// already pruned
+	if header.Get("X-Mailpit-Pruned") != "" {
+		return header, data, 0, nil
+	}
+
+	disposition, dParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	fileName := dParams["filename"]
+	if fileName == "" {
+		fileName = params["name"]
+	}
+
+	isAttachment := strings.EqualFold(disposition, "attachment")
+	isInline := !isAttachment && (fileName != "" || header.Get("Content-ID") != "" || !strings.HasPrefix(mediaType, "text/"))
+
+	if !isAttachment && (!isInline || keepInline) {
+		return header, data, 0, nil
+	}
+
+	size := decodedPartSize(header.Get("Content-Transfer-Encoding"), data)
+	date := time.Now().Format(time.RFC3339)
+
+	placeholder := textproto.MIMEHeader{}
+	placeholder.Set("Content-Type", "text/plain; charset=utf-8")
+	placeholder.Set("Content-Transfer-Encoding", "quoted-printable")
+	placeholder.Set("X-Mailpit-Pruned", mime.FormatMediaType(mediaType, map[string]string{"size": fmt.Sprintf("%d", size), "date": date}))
+	if cid := header.Get("Content-ID"); cid != "" {
+		placeholder.Set("Content-ID", cid)
+	}
+
+	label := "attachment"
+	if !isAttachment {
+		disposition = "inline"
+		label = "inline part"
+	}
+	if fileName != "" {
+		placeholder.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	} else {
+		placeholder.Set("Content-Disposition", disposition)
+		fileName = "unnamed"
+	}
+
+	var b bytes.Buffer
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := fmt.Fprintf(qp, "This %s (%s, %s, %d bytes) was removed by Mailpit on %s.", label, fileName, mediaType, size, date); err != nil {
+		return header, data, 0, err
+	}
+	if err := qp.Close(); err != nil {
+		return header, data, 0, err
+	}
+
+	return placeholder, b.Bytes(), 1, nil
+}
+
+// Return the decoded size of a part's content
+func decodedPartSize(encoding string, data []byte) int {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		if d, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), "")); err == nil {
+			return len(d)
+		}
+	case "quoted-printable":
+		if d, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data))); err == nil {
+			return len(d)
+		}
+	}
+
+	return len(data)
+}
+
+// Write MIME headers sorted by key
+func writeMIMEHeader(b *bytes.Buffer, h textproto.MIMEHeader) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range h[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+}
+
+// ListAttachments returns the inline parts & attachments of all messages, ordered by the messages from newest to
+// oldest, and the total number of matching parts. If contentType is set then only parts with a content type
+// containing it are returned (case-insensitive). Parts of messages stored by older versions are only listed once
+// their part IDs have been set by a background migration.
+func ListAttachments(contentType string, start, limit int) ([]MessageAttachment, float64, error) {
+	results := []MessageAttachment{}
+	tsStart := time.Now()
+
+	from := tenant("mailbox") + " m, json_each(m.Metadata, '$.Parts') p"
+
+	q := sqlf.From(from).
+		Select(`m.ID, m.Created, m.Subject, IFNULL(json_extract(m.Metadata, '$.From'), 'null'), p.value`).
+		Where(`json_extract(p.value, '$.PartID') IS NOT NULL`).
+		Where("m.Deleted = 0").
+		OrderBy("m.Created DESC, m.rowid DESC, p.key ASC").
+		Limit(limit).
+		Offset(start)
+
+	var total float64
+	c := sqlf.From(from).
+		Select("COUNT(*)").To(&total).
+		Where(`json_extract(p.value, '$.PartID') IS NOT NULL`).
+		Where("m.Deleted = 0")
+
+	if contentType = strings.TrimSpace(contentType); contentType != "" {
+		like := "%" + escPercentChar(contentType) + "%"
+		q.Where(`json_extract(p.value, '$.ContentType') LIKE ?`, like)
+		c.Where(`json_extract(p.value, '$.ContentType') LIKE ?`, like)
+	}
+
+	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		var id, subject, fromJSON, partJSON string
+		var created float64
+
+		if err := row.Scan(&id, &created, &subject, &fromJSON, &partJSON); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		part := DBPart{}
+		if err := json.Unmarshal([]byte(partJSON), &part); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		a := MessageAttachment{
+			MessageID:   id,
+			PartID:      part.PartID,
+			FileName:    part.FileName,
+			ContentType: part.ContentType,
+			Size:        part.Size,
+			Created:     time.UnixMilli(int64(created)),
+			Subject:     subject,
+		}
+		if a.FileName == "" {
+			a.FileName = part.ContentID
+		}
+
+		if err := json.Unmarshal([]byte(fromJSON), &a.From); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+		}
+
+		results = append(results, a)
+	}); err != nil {
+		c.Close()
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(context.TODO(), db); err != nil {
+		return results, 0, err
+	}
+
+	dbLastAction = time.Now()
+
+	logger.Log().Debugf("[db] list attachments in %s", time.Since(tsStart))
+
+	return results, total, nil
+}
+
+// GetAttachmentChecksum returns the size & digests of an inline part or attachment. The digests are stored
+// when the message is received, and are calculated from the part for messages stored by older versions.
+func GetAttachmentChecksum(id, partID string) (AttachmentChecksum, error) {
+	var metadata string
+	if err := sqlf.From(tenant("mailbox")).
+		Select("Metadata").To(&metadata).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		if err == sql.ErrNoRows {
+			return AttachmentChecksum{}, ErrMessageNotFound
+		}
+		return AttachmentChecksum{}, err
+	}
+
+	obj := DBMailSummary{}
+	if err := json.Unmarshal([]byte(metadata), &obj); err != nil {
+		return AttachmentChecksum{}, err
+	}
+
+	for _, p := range obj.Parts {
+		if p.PartID == partID && p.SHA256 != "" {
+			return AttachmentChecksum{Size: p.Size, MD5: p.MD5, SHA1: p.SHA1, SHA256: p.SHA256}, nil
+		}
+	}
+
+	a, err := GetAttachmentPart(id, partID)
+	if err != nil {
+		return AttachmentChecksum{}, err
+	}
+
+	return partChecksum(a.Content), nil
+}
+
+// PartChecksum returns the size & digests of part content
+func partChecksum(content []byte) AttachmentChecksum {
+	md5Sum := md5.Sum(content)
+	sha1Sum := sha1.Sum(content)
+	sha256Sum := sha256.Sum256(content)
+
+	return AttachmentChecksum{
+		Size:   float64(len(content)),
+		MD5:    hex.EncodeToString(md5Sum[:]),
+		SHA1:   hex.EncodeToString(sha1Sum[:]),
+		SHA256: hex.EncodeToString(sha256Sum[:]),
+	}
+}
@@ -0,0 +1,438 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/jhillyerd/enmime"
+	"github.com/leporo/sqlf"
+)
+
+// BackfillJob is a background migration which processes all messages stored before the job was
+// introduced, for data which is otherwise set when a message is stored. Jobs run one at a time after
+// startup at a throttled rate, and their progress is saved so they resume after a restart.
+type backfillJob struct {
+	// Name of the job, used to save its progress, must never change
+	Name string
+	// Search prefixes (eg: "larger") with results depending on the backfilled data
+	SearchPrefixes []string
+	// Process a single message by its database ID
+	Process func(id string) error
+}
+
+// BackfillStatus is the progress of a background migration
+//
+// swagger:model BackfillStatus
+type BackfillStatus struct {
+	// Migration name
+	Name string
+	// Number of messages processed
+	Processed float64
+	// Total number of messages to process
+	Total float64
+	// Whether the migration has completed
+	Complete bool
+	// Estimated number of seconds until the migration completes, 0 if complete or unknown
+	ETA float64
+}
+
+// BackfillProgress is the saved progress of a job
+type backfillProgress struct {
+	// Row ID of the last processed message
+	Last int64
+	// Row ID of the last message stored before the job was added, newer messages do not need processing
+	Until int64
+	// Whether the job has completed
+	Done bool
+}
+
+// BackfillRun is the progress of a job since startup, used to estimate the time remaining
+type backfillRun struct {
+	started   time.Time
+	processed int
+}
+
+var (
+	// BackfillJobs are the registered jobs, in the order they run
+	backfillJobs = []backfillJob{
+		{Name: "attachments-size", Process: backfillAttachmentsSize},
+		{Name: "attachment-parts", SearchPrefixes: []string{"attachment", "attachment-type"}, Process: backfillAttachmentParts},
+		{Name: "message-references", Process: backfillMessageReferences},
+		{Name: "attachment-part-ids", Process: backfillAttachmentPartIDs},
+	}
+
+	// number of messages processed per batch, and the pause between batches
+	backfillBatchSize = 100
+	backfillInterval  = time.Second
+
+	backfillMu   sync.Mutex
+	backfillRuns = map[string]*backfillRun{}
+)
+
+// Run any incomplete jobs in the background
+func initBackfills() {
+	if prepareBackfills() {
+		go runBackfills(db)
+	}
+}
+
+// Set the initial progress of new jobs, returning whether any jobs are incomplete
+func prepareBackfills() bool {
+	pending := false
+
+	for _, job := range backfillJobs {
+		p, ok := getBackfillProgress(job.Name)
+		if !ok {
+			// only messages which already exist need processing
+			var until sql.NullInt64
+			if err := db.QueryRow(`SELECT MAX(rowid) FROM ` + tenant("mailbox")).Scan(&until); err != nil { // #nosec
+				logger.Log().Errorf("[migration] %s", err.Error())
+				return false
+			}
+
+			p = backfillProgress{Until: until.Int64, Done: until.Int64 == 0}
+			if err := putBackfillProgress(job.Name, p); err != nil {
+				return false
+			}
+		}
+
+		if !p.Done {
+			pending = true
+		}
+	}
+
+	return pending
+}
+
+// Run all incomplete jobs, stopping if the database is closed or replaced
+func runBackfills(conn *sql.DB) {
+	for _, job := range backfillJobs {
+		logged := false
+
+		for {
+			if db != conn {
+				return
+			}
+
+			done, err := backfillStep(job)
+			if err != nil {
+				logger.Log().Errorf("[migration] %s: %s", job.Name, err.Error())
+				return
+			}
+
+			if done {
+				if logged {
+					logger.Log().Infof("[migration] %s completed", job.Name)
+				}
+				break
+			}
+
+			if !logged {
+				logger.Log().Infof("[migration] %s running in background", job.Name)
+				logged = true
+			}
+
+			time.Sleep(backfillInterval)
+		}
+	}
+}
+
+// BackfillStep processes the next batch of messages of a job, saving the progress.
+// Returns true once the job has completed.
+func backfillStep(job backfillJob) (bool, error) {
+	p, ok := getBackfillProgress(job.Name)
+	if !ok || p.Done {
+		return true, nil
+	}
+
+	type row struct {
+		rowID int64
+		id    string
+	}
+
+	rows := []row{}
+	if err := sqlf.From(tenant("mailbox")).
+		Select("rowid, ID").
+		Where("rowid > ? AND rowid <= ?", p.Last, p.Until).
+		OrderBy("rowid").
+		Limit(backfillBatchSize).
+		QueryAndClose(context.TODO(), db, func(r *sql.Rows) {
+			var rw row
+			if err := r.Scan(&rw.rowID, &rw.id); err == nil {
+				rows = append(rows, rw)
+			}
+		}); err != nil {
+		return false, err
+	}
+
+	if len(rows) == 0 {
+		p.Done = true
+		return true, putBackfillProgress(job.Name, p)
+	}
+
+	for _, rw := range rows {
+		if err := job.Process(rw.id); err != nil {
+			// the message is skipped so a single message cannot block the job
+			logger.Log().Warnf("[migration] %s: error processing %s: %s", job.Name, rw.id, err.Error())
+		}
+		p.Last = rw.rowID
+	}
+
+	if err := putBackfillProgress(job.Name, p); err != nil {
+		return false, err
+	}
+
+	backfillMu.Lock()
+	r, ok := backfillRuns[job.Name]
+	if !ok {
+		r = &backfillRun{started: time.Now()}
+		backfillRuns[job.Name] = r
+	}
+	r.processed = r.processed + len(rows)
+	backfillMu.Unlock()
+
+	return false, nil
+}
+
+// BackfillStatuses returns the progress of all background migrations
+func BackfillStatuses() []BackfillStatus {
+	results := []BackfillStatus{}
+
+	for _, job := range backfillJobs {
+		p, ok := getBackfillProgress(job.Name)
+		if !ok {
+			continue
+		}
+
+		s := BackfillStatus{Name: job.Name, Complete: p.Done}
+
+		if err := sqlf.From(tenant("mailbox")).
+			Select("COUNT(*)").To(&s.Total).
+			Where("rowid <= ?", p.Until).
+			QueryRowAndClose(context.TODO(), db); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+		}
+
+		if p.Done {
+			s.Processed = s.Total
+		} else {
+			if err := sqlf.From(tenant("mailbox")).
+				Select("COUNT(*)").To(&s.Processed).
+				Where("rowid <= ?", p.Last).
+				QueryRowAndClose(context.TODO(), db); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+			}
+
+			backfillMu.Lock()
+			if r, ok := backfillRuns[job.Name]; ok && r.processed > 0 {
+				rate := float64(r.processed) / time.Since(r.started).Seconds()
+				s.ETA = float64(int((s.Total - s.Processed) / rate))
+			}
+			backfillMu.Unlock()
+		}
+
+		results = append(results, s)
+	}
+
+	return results
+}
+
+// SearchPendingBackfills returns the names of incomplete background migrations
+// which the results of a search depend on
+func SearchPendingBackfills(search string) []string {
+	results := []string{}
+
+	terms, err := parseSearchQuery(search)
+	if err != nil {
+		return results
+	}
+
+	for _, job := range backfillJobs {
+		dependent := false
+		for _, t := range terms {
+			if t.prefix != "" && inArray(t.prefix, job.SearchPrefixes) {
+				dependent = true
+				break
+			}
+		}
+
+		if !dependent {
+			continue
+		}
+
+		if p, ok := getBackfillProgress(job.Name); ok && !p.Done {
+			results = append(results, job.Name)
+		}
+	}
+
+	return results
+}
+
+// The saved progress of a job
+func getBackfillProgress(name string) (backfillProgress, bool) {
+	p := backfillProgress{}
+
+	v := SettingGet("Backfill:" + name)
+	if v == "" {
+		return p, false
+	}
+
+	if err := json.Unmarshal([]byte(v), &p); err != nil {
+		logger.Log().Errorf("[migration] %s", err.Error())
+		return p, false
+	}
+
+	return p, true
+}
+
+// Save the progress of a job
+func putBackfillProgress(name string, p backfillProgress) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return SettingPut("Backfill:"+name, string(b))
+}
+
+// Set the attachments size of messages stored by older versions.
+// Migration task implemented 10/2026
+func backfillAttachmentsSize(id string) error {
+	var attachments int
+	var metadata string
+	if err := sqlf.From(tenant("mailbox")).
+		Select("Attachments").To(&attachments).
+		Select("Metadata").To(&metadata).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return err
+	}
+
+	if attachments == 0 {
+		return nil
+	}
+
+	obj := DBMailSummary{}
+	if err := json.Unmarshal([]byte(metadata), &obj); err != nil {
+		return err
+	}
+
+	if obj.AttachmentsSize > 0 {
+		return nil
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	obj.AttachmentsSize = attachmentsSize(env)
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE `+tenant("mailbox")+` SET Metadata = ? WHERE ID = ?`, string(b), id)
+
+	return err
+}
+
+// Set the inline parts & attachments of messages stored by older versions.
+// Migration task implemented 10/2026
+func backfillAttachmentParts(id string) error {
+	var metadata string
+	if err := sqlf.From(tenant("mailbox")).
+		Select("Metadata").To(&metadata).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return err
+	}
+
+	obj := DBMailSummary{}
+	if err := json.Unmarshal([]byte(metadata), &obj); err != nil {
+		return err
+	}
+
+	if obj.Parts != nil {
+		return nil
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	obj.Parts = messageParts(env)
+	if len(obj.Parts) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE `+tenant("mailbox")+` SET Metadata = ? WHERE ID = ?`, string(b), id)
+
+	return err
+}
+
+// Set the part IDs, Content IDs & sizes of the inline parts & attachments of messages stored by
+// older versions, for listing attachments.
+// Migration task implemented 10/2026
+func backfillAttachmentPartIDs(id string) error {
+	var metadata string
+	if err := sqlf.From(tenant("mailbox")).
+		Select("Metadata").To(&metadata).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return err
+	}
+
+	obj := DBMailSummary{}
+	if err := json.Unmarshal([]byte(metadata), &obj); err != nil {
+		return err
+	}
+
+	// messages without parts are set by the attachment-parts migration
+	if len(obj.Parts) == 0 || obj.Parts[0].PartID != "" {
+		return nil
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	obj.Parts = messageParts(env)
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE `+tenant("mailbox")+` SET Metadata = ? WHERE ID = ?`, string(b), id)
+
+	return err
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/htmlcheck"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/spamassassin"
+	"github.com/leporo/sqlf"
+)
+
+var (
+	// messages waiting to be checked after being stored, messages are skipped if the queue is full
+	// and are checked when the check is first requested instead
+	messageChecksQueue = make(chan string, 100)
+	messageChecksOnce  sync.Once
+)
+
+// SpamCheck returns the SpamAssassin result of a message, running & storing the check if the message
+// has not been checked yet. Results containing an error (eg: the service is unavailable) are not stored.
+func SpamCheck(id string) (spamassassin.Result, error) {
+	res := spamassassin.Result{}
+
+	var check sql.NullString
+	if err := sqlf.From(tenant("mailbox")).
+		Select("SpamCheck").To(&check).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		if err == sql.ErrNoRows {
+			return res, ErrMessageNotFound
+		}
+		return res, err
+	}
+
+	if check.Valid {
+		err := json.Unmarshal([]byte(check.String), &res)
+		return res, err
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return res, err
+	}
+
+	res, err = spamassassin.Check(raw)
+	if err != nil || res.Error != "" {
+		return res, err
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return res, err
+	}
+
+	if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET SpamScore = ?, SpamCheck = ? WHERE ID = ? AND SpamCheck IS NULL`, res.Score, string(b), id); err != nil {
+		return res, err
+	}
+
+	AddMessageEvent(id, EventSpamScored, map[string]string{
+		"score": strconv.FormatFloat(res.Score, 'f', -1, 64),
+		"spam":  strconv.FormatBool(res.IsSpam),
+	})
+
+	return res, nil
+}
+
+// HTMLCheck returns the HTML check result of a message using the default filter, running & storing
+// the check if the message has not been checked yet. The message must contain HTML.
+func HTMLCheck(msg *Message) (htmlcheck.Response, error) {
+	res := htmlcheck.Response{}
+
+	var check sql.NullString
+	if err := sqlf.From(tenant("mailbox")).
+		Select("HTMLCheck").To(&check).
+		Where("ID = ?", msg.ID).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		if err == sql.ErrNoRows {
+			return res, ErrMessageNotFound
+		}
+		return res, err
+	}
+
+	if check.Valid {
+		err := json.Unmarshal([]byte(check.String), &res)
+		return res, err
+	}
+
+	res, err := htmlcheck.RunTests(msg.HTML, htmlcheck.DefaultFilter())
+	if err != nil {
+		return res, err
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return res, err
+	}
+
+	_, err = db.Exec(`UPDATE `+tenant("mailbox")+` SET HTMLScore = ?, HTMLCheck = ? WHERE ID = ? AND HTMLCheck IS NULL`, float64(res.Total.Supported), string(b), msg.ID)
+
+	return res, err
+}
+
+// Queue a stored message to be checked in the background
+func queueMessageChecks(id string) {
+	messageChecksOnce.Do(func() {
+		go func() {
+			for id := range messageChecksQueue {
+				runMessageChecks(id)
+			}
+		}()
+	})
+
+	select {
+	case messageChecksQueue <- id:
+	default:
+		logger.Log().Debugf("[checks] queue is full, skipping checks of %s", id)
+	}
+}
+
+// Run the HTML check & SpamAssassin check (if enabled) of a message
+func runMessageChecks(id string) {
+	msg, err := GetMessagePeek(id)
+	if err != nil {
+		// the message may have been deleted since being queued
+		return
+	}
+
+	if msg.HTML != "" {
+		if _, err := HTMLCheck(msg); err != nil {
+			logger.Log().Warnf("[checks] html check of %s: %s", id, err.Error())
+		}
+	}
+
+	if config.EnableSpamAssassin != "" {
+		if res, err := SpamCheck(id); err != nil {
+			logger.Log().Warnf("[checks] spam check of %s: %s", id, err.Error())
+		} else if res.Error != "" {
+			logger.Log().Warnf("[checks] spam check of %s: %s", id, res.Error)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// matches cid: references in HTML attributes & CSS url() values
+var cidRefRe = regexp.MustCompile(`(?i)(=\s*["']?|url\(\s*["']?)cid:([^"'\s>;\)]+)`)
+
+// CIDMap returns a map of Content-IDs to part IDs for all inline parts & attachments which have a Content-ID
+func CIDMap(msg *Message) map[string]string {
+	m := make(map[string]string)
+
+	for _, a := range append(append([]Attachment{}, msg.Inline...), msg.Attachments...) {
+		if a.ContentID != "" {
+			if _, ok := m[a.ContentID]; !ok {
+				m[a.ContentID] = a.PartID
+			}
+		}
+	}
+
+	return m
+}
+
+// GetCIDParts returns all inline parts & attachments of a message which have a Content-ID,
+// as well as inline parts without a Content-ID, in the order they appear in the message
+func GetCIDParts(id string) ([]CIDPart, error) {
+	results := []CIDPart{}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return results, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return results, err
+	}
+
+	// the message body parts are not included
+	inline := make(map[*enmime.Part]bool)
+	for _, p := range append(append([]*enmime.Part{}, env.Inlines...), env.OtherParts...) {
+		inline[p] = true
+	}
+	for _, p := range env.Attachments {
+		inline[p] = false
+	}
+
+	var walk func(p *enmime.Part)
+	walk = func(p *enmime.Part) {
+		for ; p != nil; p = p.NextSibling {
+			if isInline, ok := inline[p]; ok && (p.ContentID != "" || isInline) {
+				c := CIDPart{
+					PartID:      p.PartID,
+					ContentType: p.ContentType,
+					Size:        float64(len(p.Content)),
+					Inline:      isInline,
+				}
+				if p.ContentID != "" {
+					cid := p.ContentID
+					c.ContentID = &cid
+				}
+
+				results = append(results, c)
+			}
+
+			walk(p.FirstChild)
+		}
+	}
+
+	walk(env.Root)
+
+	return results, nil
+}
+
+// ReplaceCIDs returns the message HTML with all cid: references replaced with the value returned by fn,
+// which is passed the matching inline part or attachment. Content-IDs are matched case-insensitively.
+// References which cannot be resolved, or where fn returns false, are left untouched.
+func ReplaceCIDs(msg *Message, fn func(a Attachment) (string, bool)) string {
+	parts := make(map[string]Attachment)
+	for _, a := range append(append([]Attachment{}, msg.Inline...), msg.Attachments...) {
+		k := strings.ToLower(a.ContentID)
+		if _, ok := parts[k]; a.ContentID != "" && !ok {
+			parts[k] = a
+		}
+	}
+
+	if len(parts) == 0 {
+		return msg.HTML
+	}
+
+	return cidRefRe.ReplaceAllStringFunc(msg.HTML, func(match string) string {
+		m := cidRefRe.FindStringSubmatch(match)
+		cid := m[2]
+		// cid URLs should be URL-encoded (RFC 2392)
+		if u, err := url.PathUnescape(cid); err == nil {
+			cid = u
+		}
+
+		a, ok := parts[strings.ToLower(cid)]
+		if !ok {
+			return match
+		}
+
+		v, ok := fn(a)
+		if !ok {
+			return match
+		}
+
+		return m[1] + v
+	})
+}
+
+// EmbedCIDs returns the message HTML with all resolvable cid: references replaced with base64 data URIs
+func EmbedCIDs(msg *Message) (string, error) {
+	if len(CIDMap(msg)) == 0 {
+		return msg.HTML, nil
+	}
+
+	raw, err := GetMessageRaw(msg.ID)
+	if err != nil {
+		return "", err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+
+	content := make(map[string]*enmime.Part)
+	for _, p := range append(append(append([]*enmime.Part{}, env.Inlines...), env.OtherParts...), env.Attachments...) {
+		content[p.PartID] = p
+	}
+
+	return ReplaceCIDs(msg, func(a Attachment) (string, bool) {
+		p, ok := content[a.PartID]
+		if !ok {
+			return "", false
+		}
+
+		return "data:" + p.ContentType + ";base64," + base64.StdEncoding.EncodeToString(p.Content), true
+	}), nil
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/webhook"
 	"github.com/axllent/mailpit/server/websockets"
 	"github.com/leporo/sqlf"
 )
@@ -42,13 +43,35 @@ func dbCron() {
 		}
 
 		pruneMessages()
+
+		if _, err := pruneTaggedMessages(); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+		}
+
+		if _, err := deleteExpiredMessages(); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+		}
+
+		if config.TrashPurgeAfterDuration > 0 {
+			if _, err := purgeExpiredTrash(config.TrashPurgeAfterDuration); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+			}
+		}
+
+		if d := config.Runtime().PruneAttachmentsAfter; d > 0 {
+			if _, err := PruneAttachments(d, config.PruneAttachmentsKeepInline, 0); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+			}
+		}
 	}
 }
 
 // PruneMessages will auto-delete the oldest messages if messages > config.MaxMessages.
+// Pinned messages are never pruned, and are not counted towards the limit.
 // Set config.MaxMessages to 0 to disable.
 func pruneMessages() {
-	if config.MaxMessages < 1 {
+	maxMessages := config.Runtime().MaxMessages
+	if maxMessages < 1 {
 		return
 	}
 
@@ -56,9 +79,10 @@ func pruneMessages() {
 
 	q := sqlf.Select("ID, Size").
 		From(tenant("mailbox")).
+		Where("Pinned = 0").
 		OrderBy("Created DESC").
 		Limit(5000).
-		Offset(config.MaxMessages)
+		Offset(maxMessages)
 
 	ids := []string{}
 	var prunedSize int64
@@ -105,6 +129,26 @@ func pruneMessages() {
 		return
 	}
 
+	_, err = tx.Exec(`DELETE FROM `+tenant("message_events")+` WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM `+tenant("message_references")+` WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	if !config.SMTPRelayConfig.KeepReleaseHistory {
+		_, err = tx.Exec(`DELETE FROM `+tenant("release_history")+` WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
+		if err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+	}
+
 	_, err = tx.Exec(`DELETE FROM `+tenant("mailbox")+` WHERE ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...) // #nosec
 	if err != nil {
 		logger.Log().Errorf("[db] %s", err.Error())
@@ -132,9 +176,139 @@ func pruneMessages() {
 
 	logMessagesDeleted(len(ids))
 
+	webhook.Dispatch(webhook.MessagesPruned, webhook.PrunedData{IDs: ids, Count: len(ids)})
+
 	websockets.Broadcast("prune", nil)
 }
 
+// PruneTaggedMessages will auto-delete messages older than the retention of their tags (config.TagRetentionRules).
+// Messages with multiple retention tags are kept for the longest retention, and pinned messages are kept. Returns the number of
+// deleted messages per tag.
+func pruneTaggedMessages() (map[string]int, error) {
+	rules := config.Runtime().TagRetentionRules
+	deleted := map[string]int{}
+
+	if len(rules) == 0 {
+		return deleted, nil
+	}
+
+	now := time.Now()
+
+	names := make([]interface{}, len(rules))
+	shortest := rules[0].Duration
+	for i, r := range rules {
+		names[i] = r.Tag
+		if r.Duration < shortest {
+			shortest = r.Duration
+		}
+	}
+
+	// the longest retention rule & created timestamp of each message older than the shortest retention
+	longest := map[string]int{}
+	created := map[string]int64{}
+	ids := []string{}
+
+	if err := sqlf.From(tenant("mailbox")+" m").
+		Select("m.ID, m.Created, t.Name").
+		Join(tenant("message_tags")+" mt", "mt.ID = m.ID").
+		Join(tenant("tags")+" t", "t.ID = mt.TagID").
+		Where("t.Name IN (?"+strings.Repeat(",?", len(names)-1)+")", names...).
+		Where("m.Created < ?", now.Add(-shortest).UnixMilli()).
+		Where("m.Pinned = 0").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var id, name string
+			var ts float64
+
+			if err := row.Scan(&id, &ts, &name); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			for i, r := range rules {
+				if !strings.EqualFold(r.Tag, name) {
+					continue
+				}
+
+				if j, ok := longest[id]; !ok {
+					ids = append(ids, id)
+					longest[id] = i
+				} else if r.Duration > rules[j].Duration {
+					longest[id] = i
+				}
+			}
+
+			created[id] = int64(ts)
+		}); err != nil {
+		return deleted, err
+	}
+
+	prune := make([][]string, len(rules))
+	for _, id := range ids {
+		i := longest[id]
+		if created[id] < now.Add(-rules[i].Duration).UnixMilli() {
+			prune[i] = append(prune[i], id)
+		}
+	}
+
+	for i, r := range rules {
+		if len(prune[i]) == 0 {
+			continue
+		}
+
+		n, _, err := deleteMessages(prune[i])
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted[r.Tag] = n
+		logger.Log().Infof("[db] tag retention %s=%s deleted %d messages", r.Tag, r.Retention, n)
+	}
+
+	if len(deleted) > 0 {
+		websockets.Broadcast("prune", nil)
+	}
+
+	return deleted, nil
+}
+
+// DeleteExpiredMessages will delete all messages which have passed their expiry time (set via the X-Mailpit-TTL header),
+// excluding pinned messages. Returns the number of deleted messages.
+func deleteExpiredMessages() (int, error) {
+	ids := []string{}
+
+	if err := sqlf.From(tenant("mailbox")).
+		Select("ID").
+		Where("Expires > 0").
+		Where("Expires <= ?", time.Now().UnixMilli()).
+		Where("Pinned = 0").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var id string
+			if err := row.Scan(&id); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+			ids = append(ids, id)
+		}); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, chunk := range chunkIDs(ids, 1000) {
+		n, _, err := deleteMessages(chunk)
+		if err != nil {
+			return total, err
+		}
+		total = total + n
+	}
+
+	if total > 0 {
+		logger.Log().Infof("[db] deleted %d expired messages", total)
+		websockets.Broadcast("prune", nil)
+	}
+
+	return total, nil
+}
+
 // Vacuum the database to reclaim space from deleted messages
 func vacuumDb() {
 	if sqlDriver == "rqlite" {
@@ -108,6 +108,12 @@ func InitDB() error {
 		return err
 	}
 
+	if err := initEncryption(); err != nil {
+		return err
+	}
+
+	loadRuntimeSettings()
+
 	dbFile = p
 	dbLastAction = time.Now()
 
@@ -120,7 +126,7 @@ func InitDB() error {
 	// method invoked upon seeing signal
 	go func() {
 		s := <-sigs
-		fmt.Printf("[db] got %s signal, shutting down\n", s)
+		logger.Log().Infof("[db] got %s signal, shutting down", s)
 		Close()
 		os.Exit(0)
 	}()
@@ -140,6 +146,8 @@ func tenant(table string) string {
 
 // Close will close the database, and delete if temporary
 func Close() {
+	closeNewMessageSubscribers()
+
 	// on a fatal exit (eg: ports blocked), allow Mailpit to run migration tasks before closing the DB
 	time.Sleep(200 * time.Millisecond)
 
@@ -170,6 +178,7 @@ func StatsGet() MailboxStats {
 	var (
 		total  = CountTotal()
 		unread = CountUnread()
+		pinned = CountPinned()
 		tags   = GetAllTags()
 	)
 
@@ -178,16 +187,18 @@ func StatsGet() MailboxStats {
 	return MailboxStats{
 		Total:  total,
 		Unread: unread,
+		Pinned: pinned,
 		Tags:   tags,
 	}
 }
 
-// CountTotal returns the number of emails in the database
+// CountTotal returns the number of emails in the database, excluding trashed messages
 func CountTotal() float64 {
 	var total float64
 
 	_ = sqlf.From(tenant("mailbox")).
 		Select("COUNT(*)").To(&total).
+		Where("Deleted = 0").
 		QueryRowAndClose(context.TODO(), db)
 
 	return total
@@ -200,6 +211,7 @@ func CountUnread() float64 {
 	_ = sqlf.From(tenant("mailbox")).
 		Select("COUNT(*)").To(&total).
 		Where("Read = ?", 0).
+		Where("Deleted = 0").
 		QueryRowAndClose(context.TODO(), db)
 
 	return total
@@ -212,6 +224,7 @@ func CountRead() float64 {
 	_ = sqlf.From(tenant("mailbox")).
 		Select("COUNT(*)").To(&total).
 		Where("Read = ?", 1).
+		Where("Deleted = 0").
 		QueryRowAndClose(context.TODO(), db)
 
 	return total
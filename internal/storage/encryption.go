@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+var (
+	// encryptedMarker prefixes encrypted raw messages, followed by the nonce & AES-GCM sealed compressed message.
+	// Raw messages without the marker are unencrypted (zstd compressed) messages.
+	encryptedMarker = []byte("MPENC1:")
+
+	// message encryption, nil if encryption is disabled
+	dbCipher cipher.AEAD
+
+	// ErrMessageEncrypted is returned when an encrypted message cannot be decrypted
+	ErrMessageEncrypted = errors.New("message is encrypted and no valid encryption key is set")
+
+	// encryptionKeyCheckValue is encrypted & stored in the settings to verify the encryption key on startup
+	encryptionKeyCheckValue = []byte("mailpit encryption key check")
+)
+
+// encryptionKeyCheckSetting is the settings key of the encrypted key check value
+const encryptionKeyCheckSetting = "EncryptionKeyCheck"
+
+// ParseEncryptionKey returns the AES key from a hex or base64-encoded 16, 24 or 32-byte key
+func parseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("encryption key must be hex or base64 encoded")
+		}
+	}
+
+	if l := len(key); l != 16 && l != 24 && l != 32 {
+		return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes (AES-128, AES-192 or AES-256), got %d bytes", l)
+	}
+
+	return key, nil
+}
+
+// InitEncryption sets up message encryption from config.EncryptionKey. It returns an error if
+// encrypted messages exist in the database but no key is set, or if the key cannot decrypt them.
+func initEncryption() error {
+	dbCipher = nil
+
+	if config.EncryptionKey != "" {
+		key, err := parseEncryptionKey(config.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("[db] %s", err.Error())
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("[db] %s", err.Error())
+		}
+
+		dbCipher, err = cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("[db] %s", err.Error())
+		}
+	}
+
+	// the key check is only set once messages may have been encrypted, so databases without encryption
+	// are never scanned for encrypted messages on startup
+	check := SettingGet(encryptionKeyCheckSetting)
+
+	if dbCipher == nil {
+		if check == "" {
+			return nil
+		}
+
+		encrypted, err := firstEncryptedMessage()
+		if err != nil {
+			return err
+		}
+
+		if encrypted != nil {
+			return errors.New("[db] the database contains encrypted messages, but no encryption key is set")
+		}
+
+		// no encrypted messages remain
+		return SettingPut(encryptionKeyCheckSetting, "")
+	}
+
+	if check == "" {
+		// first start with encryption, check existing encrypted messages (if any) can be decrypted before
+		// storing the key check
+		encrypted, err := firstEncryptedMessage()
+		if err != nil {
+			return err
+		}
+
+		if encrypted != nil {
+			if _, err := decodeMessage(encrypted); err != nil {
+				return fmt.Errorf("[db] unable to decrypt messages with the encryption key: %s", err.Error())
+			}
+		}
+
+		data, err := encodeMessage(encryptionKeyCheckValue)
+		if err != nil {
+			return err
+		}
+
+		if err := SettingPut(encryptionKeyCheckSetting, base64.StdEncoding.EncodeToString(data)); err != nil {
+			return err
+		}
+	} else {
+		data, err := base64.StdEncoding.DecodeString(check)
+		if err != nil {
+			return fmt.Errorf("[db] invalid encryption key check: %s", err.Error())
+		}
+
+		if decrypted, err := decodeMessage(data); err != nil || !bytes.Equal(decrypted, encryptionKeyCheckValue) {
+			return errors.New("[db] unable to decrypt messages with the encryption key")
+		}
+	}
+
+	if dbCipher != nil {
+		if config.DisableBodyIndex {
+			logger.Log().Info("[db] message encryption enabled, message bodies are not indexed")
+		} else {
+			logger.Log().Info("[db] message encryption enabled (note: the search index, subjects, addresses & snippets are stored in plaintext)")
+		}
+	}
+
+	return nil
+}
+
+// FirstEncryptedMessage returns the stored data of an encrypted message, or nil if there are none
+func firstEncryptedMessage() ([]byte, error) {
+	var email string
+	if err := sqlf.From(tenant("mailbox_data")).
+		Select(`Email`).To(&email).
+		Where(`hex(substr(Email, 1, ?)) = ?`, len(encryptedMarker), strings.ToUpper(hex.EncodeToString(encryptedMarker))).
+		Limit(1).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return dbBlob(email)
+}
+
+// EncodeMessage compresses, and if enabled encrypts, a raw message for storage
+func encodeMessage(raw []byte) ([]byte, error) {
+	compressed := dbEncoder.EncodeAll(raw, make([]byte, 0, len(raw)))
+
+	if dbCipher == nil {
+		return compressed, nil
+	}
+
+	nonce := make([]byte, dbCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(encryptedMarker)+len(nonce)+len(compressed)+dbCipher.Overhead())
+	out = append(out, encryptedMarker...)
+	out = append(out, nonce...)
+
+	return dbCipher.Seal(out, nonce, compressed, nil), nil
+}
+
+// DecodeMessage decrypts (if encrypted) & decompresses a stored raw message
+func decodeMessage(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, encryptedMarker) {
+		if dbCipher == nil {
+			return nil, ErrMessageEncrypted
+		}
+
+		data = data[len(encryptedMarker):]
+		if len(data) < dbCipher.NonceSize() {
+			return nil, errors.New("invalid encrypted message")
+		}
+
+		nonce := data[:dbCipher.NonceSize()]
+		decrypted, err := dbCipher.Open(nil, nonce, data[dbCipher.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting message: %s", err.Error())
+		}
+
+		data = decrypted
+	}
+
+	raw, err := dbDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing message: %s", err.Error())
+	}
+
+	return raw, nil
+}
+
+// DbBlob returns the bytes of a stored blob, which rqlite returns base64 encoded
+func dbBlob(s string) ([]byte, error) {
+	if sqlDriver == "rqlite" {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding base64 message: %w", err)
+		}
+		return data, nil
+	}
+
+	return []byte(s), nil
+}
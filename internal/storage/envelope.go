@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// EnvelopeColumns returns the EnvelopeFrom, EnvelopeTo (JSON array), ClientIP, Helo & AuthUser column values of a new message.
+// Values are null if not set, eg: messages which were not received via SMTP.
+func envelopeColumns(opts StoreOptions) (from, to, clientIP, helo, authUser sql.NullString, err error) {
+	if opts.From != "" || len(opts.To) > 0 {
+		from = sql.NullString{String: opts.From, Valid: true}
+	}
+
+	if len(opts.To) > 0 {
+		b, err := json.Marshal(opts.To)
+		if err != nil {
+			return from, to, clientIP, helo, authUser, err
+		}
+		to = sql.NullString{String: string(b), Valid: true}
+	}
+
+	clientIP = sql.NullString{String: opts.ClientIP, Valid: opts.ClientIP != ""}
+	helo = sql.NullString{String: opts.Helo, Valid: opts.Helo != ""}
+	authUser = sql.NullString{String: opts.AuthUser, Valid: opts.AuthUser != ""}
+
+	return from, to, clientIP, helo, authUser, nil
+}
+
+// GetMessageEnvelope returns the SMTP envelope & connection details of a message.
+// ErrMessageNotFound is returned if the message does not exist.
+func GetMessageEnvelope(id string) (MessageEnvelope, error) {
+	var metadata, from, to, clientIP, helo, authUser string
+
+	if err := sqlf.From(tenant("mailbox")).
+		Select(`Metadata`).To(&metadata).
+		Select(`IFNULL(EnvelopeFrom, '')`).To(&from).
+		Select(`IFNULL(EnvelopeTo, '[]')`).To(&to).
+		Select(`IFNULL(ClientIP, '')`).To(&clientIP).
+		Select(`IFNULL(Helo, '')`).To(&helo).
+		Select(`IFNULL(AuthUser, '')`).To(&authUser).
+		Where(`ID = ?`, id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return MessageEnvelope{}, ErrMessageNotFound
+	}
+
+	summary := DBMailSummary{}
+	if err := json.Unmarshal([]byte(metadata), &summary); err != nil {
+		return MessageEnvelope{}, err
+	}
+
+	e := MessageEnvelope{
+		ID:            id,
+		From:          from,
+		To:            []string{},
+		ClientIP:      clientIP,
+		Helo:          helo,
+		AuthUser:      authUser,
+		TLS:           summary.TLS,
+		Authenticated: summary.Authenticated,
+		Via:           summary.Via,
+	}
+
+	if e.Via == "" {
+		e.Via = ViaUnknown
+	}
+
+	if err := json.Unmarshal([]byte(to), &e.To); err != nil {
+		return MessageEnvelope{}, err
+	}
+
+	dbLastAction = time.Now()
+
+	return e, nil
+}
+
+// SetEnvelopeRecipients sets the EnvelopeTo of each message summary to the SMTP envelope recipients.
+// Messages without a recorded envelope are left unchanged.
+func SetEnvelopeRecipients(messages []MessageSummary) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := []interface{}{}
+	index := map[string]int{}
+	for i, m := range messages {
+		ids = append(ids, m.ID)
+		index[m.ID] = i
+	}
+
+	q := sqlf.From(tenant("mailbox")).
+		Select(`ID, EnvelopeTo`).
+		Where(`EnvelopeTo IS NOT NULL`).
+		Where(`ID IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, ids...)
+
+	return q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		var id, to string
+
+		if err := row.Scan(&id, &to); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		recipients := []string{}
+		if err := json.Unmarshal([]byte(to), &recipients); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		messages[index[id]].EnvelopeTo = recipients
+	})
+}
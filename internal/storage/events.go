@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/webhook"
+	"github.com/leporo/sqlf"
+)
+
+// MaxMessageEvents is the maximum number of events kept per message, the oldest events are removed first
+const MaxMessageEvents = 100
+
+// Message event types, see AddMessageEvent
+const (
+	// EventReceived is a message being received, including the envelope details
+	EventReceived = "received"
+	// EventTagRule is a tag applied by a tag rule (--tag or a tag rule set via the API)
+	EventTagRule = "tag-rule"
+	// EventTagsChanged is the message tags being changed
+	EventTagsChanged = "tags-changed"
+	// EventRead is the message being marked as read
+	EventRead = "read"
+	// EventUnread is the message being marked as unread
+	EventUnread = "unread"
+	// EventSpamScored is the message being scored by SpamAssassin
+	EventSpamScored = "spam-scored"
+	// EventWebhookDelivered is the new message webhook being delivered to an endpoint
+	EventWebhookDelivered = "webhook-delivered"
+	// EventWebhookFailed is the new message webhook failing to be delivered to an endpoint
+	EventWebhookFailed = "webhook-failed"
+	// EventRelayed is the message being auto-relayed
+	EventRelayed = "relayed"
+	// EventRelayFailed is the message failing to be auto-relayed
+	EventRelayFailed = "relay-failed"
+	// EventReleased is the message being released
+	EventReleased = "released"
+	// EventReleaseFailed is the message failing to be released
+	EventReleaseFailed = "release-failed"
+	// EventTrashed is the message being moved to the trash
+	EventTrashed = "trashed"
+	// EventRestored is the message being restored from the trash
+	EventRestored = "restored"
+)
+
+// MessageEvent is a processing step of a message
+type MessageEvent struct {
+	// Time of the event
+	Created time.Time
+	// Event type, eg: received, tag-rule, read, released
+	Type string
+	// Event details
+	Details map[string]string
+}
+
+func init() {
+	webhook.OnDelivery = webhookDelivered
+}
+
+// AddMessageEvent appends an event to the events of a message. Errors are logged only
+// as events are informational.
+func AddMessageEvent(id, eventType string, details map[string]string) {
+	addMessageEvents([]string{id}, eventType, details)
+}
+
+// AddMessageEvents appends the same event to the events of multiple messages in a single transaction
+func addMessageEvents(ids []string, eventType string, details map[string]string) {
+	if len(ids) == 0 || db == nil {
+		return
+	}
+
+	if details == nil {
+		details = map[string]string{}
+	}
+
+	b, err := json.Marshal(details)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	created := time.Now().UnixMilli()
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		// ignore events of messages which have since been deleted
+		if _, err := tx.Exec(`INSERT INTO `+tenant("message_events")+` (ID, Created, Type, Details)
+			SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM `+tenant("mailbox")+` WHERE ID = ?)`, id, created, eventType, string(b), id); err != nil { // #nosec
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		if _, err := tx.Exec(`DELETE FROM `+tenant("message_events")+` WHERE ID = ? AND Key NOT IN
+			(SELECT Key FROM `+tenant("message_events")+` WHERE ID = ? ORDER BY Key DESC LIMIT ?)`, id, id, MaxMessageEvents); err != nil { // #nosec
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+	}
+}
+
+// AddReadStatusEvents adds a read or unread event to all messages which currently have the opposite status,
+// used before bulk status changes of the whole mailbox
+func addReadStatusEvents(read bool) {
+	eventType, oldStatus := EventUnread, 1
+	if read {
+		eventType, oldStatus = EventRead, 0
+	}
+
+	if _, err := db.Exec(`INSERT INTO `+tenant("message_events")+` (ID, Created, Type, Details)
+		SELECT ID, ?, ?, '{}' FROM `+tenant("mailbox")+` WHERE Read = ?`, time.Now().UnixMilli(), eventType, oldStatus); err != nil { // #nosec
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	// remove the oldest events of any messages exceeding the limit
+	if _, err := db.Exec(`DELETE FROM `+tenant("message_events")+` WHERE Key IN
+		(SELECT Key FROM (SELECT Key, ROW_NUMBER() OVER (PARTITION BY ID ORDER BY Key DESC) AS n FROM `+tenant("message_events")+`)
+		WHERE n > ?)`, MaxMessageEvents); err != nil { // #nosec
+		logger.Log().Errorf("[db] %s", err.Error())
+	}
+}
+
+// GetMessageEvents returns the events of a message in chronological order.
+// ErrMessageNotFound is returned if the message does not exist.
+func GetMessageEvents(id string) ([]MessageEvent, error) {
+	events := []MessageEvent{}
+
+	var exists int
+	if err := sqlf.From(tenant("mailbox")).
+		Select("COUNT(*)").To(&exists).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return events, err
+	}
+
+	if exists == 0 {
+		return events, ErrMessageNotFound
+	}
+
+	if err := sqlf.From(tenant("message_events")).
+		Select("Created, Type, Details").
+		Where("ID = ?", id).
+		OrderBy("Key ASC").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var created int64
+			var eventType, details string
+			if err := row.Scan(&created, &eventType, &details); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			e := MessageEvent{Created: time.UnixMilli(created), Type: eventType, Details: map[string]string{}}
+			if err := json.Unmarshal([]byte(details), &e.Details); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+			}
+
+			events = append(events, e)
+		}); err != nil {
+		return events, err
+	}
+
+	return events, nil
+}
+
+// ReceivedEventDetails returns the details of a received event from the store options
+func receivedEventDetails(opts StoreOptions) map[string]string {
+	details := map[string]string{}
+
+	if opts.Via != "" {
+		details["via"] = opts.Via
+	}
+	if opts.Listener != "" {
+		details["listener"] = opts.Listener
+	}
+	if opts.ClientIP != "" {
+		details["client"] = opts.ClientIP
+	}
+	if opts.Helo != "" {
+		details["helo"] = opts.Helo
+	}
+	if opts.From != "" {
+		details["from"] = opts.From
+	}
+	if len(opts.To) > 0 {
+		details["to"] = strings.Join(opts.To, ", ")
+	}
+	if opts.TLS {
+		details["tls"] = "true"
+	}
+	if opts.Authenticated {
+		details["authenticated"] = "true"
+	}
+
+	return details
+}
+
+// WebhookDelivered records the result of new message webhook deliveries
+func webhookDelivered(ev webhook.Event, url string, err error) {
+	if ev.Type != webhook.MessageReceived {
+		return
+	}
+
+	msg, ok := ev.Data.(*MessageSummary)
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		AddMessageEvent(msg.ID, EventWebhookFailed, map[string]string{"url": url, "error": err.Error()})
+		return
+	}
+
+	AddMessageEvent(msg.ID, EventWebhookDelivered, map[string]string{"url": url})
+}
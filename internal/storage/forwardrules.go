@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// ErrForwardRuleNotFound is returned when a forwarding rule does not exist
+var ErrForwardRuleNotFound = errors.New("forwarding rule not found")
+
+// GetForwardRules returns all forwarding rules
+func GetForwardRules() ([]ForwardRule, error) {
+	rules := []ForwardRule{}
+
+	if err := sqlf.From(tenant("forward_rules")).
+		Select("ID, Query, Recipients, Profile, Forwarded").
+		OrderBy("ID").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var r ForwardRule
+			var recipients string
+
+			if err := row.Scan(&r.ID, &r.Query, &recipients, &r.Profile, &r.Forwarded); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			if err := json.Unmarshal([]byte(recipients), &r.To); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			rules = append(rules, r)
+		}); err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+// AddForwardRule adds a forwarding rule, returning the stored rule with its ID set.
+// An error is returned if the search query is invalid or there are no recipients.
+func AddForwardRule(rule ForwardRule) (ForwardRule, error) {
+	r, err := validateForwardRule(rule)
+	if err != nil {
+		return r, err
+	}
+
+	b, err := json.Marshal(r.To)
+	if err != nil {
+		return r, err
+	}
+
+	res, err := db.Exec(`INSERT INTO `+tenant("forward_rules")+` (Query, Recipients, Profile) VALUES (?, ?, ?)`, r.Query, string(b), r.Profile)
+	if err != nil {
+		return r, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return r, err
+	}
+
+	r.ID = int(id)
+
+	return r, nil
+}
+
+// UpdateForwardRule updates the search query, recipients & relay profile of a forwarding rule, preserving its
+// forwarded count. ErrForwardRuleNotFound is returned if the rule does not exist, or an error if the rule is invalid.
+func UpdateForwardRule(id int, rule ForwardRule) (ForwardRule, error) {
+	r, err := validateForwardRule(rule)
+	if err != nil {
+		return r, err
+	}
+
+	r.ID = id
+
+	b, err := json.Marshal(r.To)
+	if err != nil {
+		return r, err
+	}
+
+	res, err := db.Exec(`UPDATE `+tenant("forward_rules")+` SET Query = ?, Recipients = ?, Profile = ? WHERE ID = ?`, r.Query, string(b), r.Profile, id)
+	if err != nil {
+		return r, err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return r, ErrForwardRuleNotFound
+	}
+
+	if err := sqlf.From(tenant("forward_rules")).
+		Select("Forwarded").To(&r.Forwarded).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// DeleteForwardRule deletes a forwarding rule, ErrForwardRuleNotFound is returned if the rule does not exist
+func DeleteForwardRule(id int) error {
+	res, err := db.Exec(`DELETE FROM `+tenant("forward_rules")+` WHERE ID = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrForwardRuleNotFound
+	}
+
+	return nil
+}
+
+// IncrementForwardRuleCount increments the number of messages forwarded by a forwarding rule
+func IncrementForwardRuleCount(id int) error {
+	_, err := db.Exec(`UPDATE `+tenant("forward_rules")+` SET Forwarded = Forwarded + 1 WHERE ID = ?`, id)
+
+	return err
+}
+
+// MatchingForwardRules returns the forwarding rules matching a message
+func MatchingForwardRules(id string) ([]ForwardRule, error) {
+	matches := []ForwardRule{}
+
+	rules, err := GetForwardRules()
+	if err != nil || len(rules) == 0 {
+		return matches, err
+	}
+
+	for _, r := range rules {
+		match, err := messageMatchesQuery(id, r.Query)
+		if err != nil {
+			logger.Log().Warnf("[forward] invalid forwarding rule %d: %s", r.ID, err.Error())
+			continue
+		}
+
+		if match {
+			matches = append(matches, r)
+		}
+	}
+
+	return matches, nil
+}
+
+// ValidateForwardRule returns a forwarding rule with the trimmed search query, recipients & relay
+// profile, or an error if the search query is invalid or there are no recipients
+func validateForwardRule(rule ForwardRule) (ForwardRule, error) {
+	r := ForwardRule{Query: strings.TrimSpace(rule.Query), Profile: strings.TrimSpace(rule.Profile), To: []string{}}
+
+	if r.Query == "" {
+		return r, errors.New("no search query")
+	}
+
+	q, err := searchQueryBuilder(r.Query, "")
+	if err != nil {
+		return r, err
+	}
+	q.Close()
+
+	for _, t := range rule.To {
+		if t = strings.TrimSpace(t); t != "" {
+			r.To = append(r.To, t)
+		}
+	}
+
+	if len(r.To) == 0 {
+		return r, errors.New("no recipients")
+	}
+
+	return r, nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -27,6 +26,17 @@ import (
 // Store will save an email to the database tables.
 // Returns the database ID of the saved message.
 func Store(body *[]byte) (string, error) {
+	return StoreWithOptions(body, StoreOptions{})
+}
+
+// StoreWithOptions will save an email to the database tables, including additional
+// details about how the message was received.
+// Returns the database ID of the saved message.
+func StoreWithOptions(body *[]byte, opts StoreOptions) (string, error) {
+	// harvest & strip any metadata headers
+	b, meta := harvestMetadataHeaders(*body)
+	*body = b
+
 	// Parse message body with enmime
 	env, err := enmime.ReadEnvelope(bytes.NewReader(*body))
 	if err != nil {
@@ -48,6 +58,19 @@ func Store(body *[]byte) (string, error) {
 		Cc:      addressToSlice(env, "Cc"),
 		Bcc:     addressToSlice(env, "Bcc"),
 		ReplyTo: addressToSlice(env, "Reply-To"),
+
+		AttachmentsSize: attachmentsSize(env),
+		Parts:           messageParts(env),
+
+		BareLineEndings: opts.BareLineEndings,
+		TLS:             opts.TLS,
+		Authenticated:   opts.Authenticated,
+		Via:             opts.Via,
+		Listener:        opts.Listener,
+	}
+
+	if len(meta) > 0 {
+		obj.Metadata = meta
 	}
 
 	messageID := strings.Trim(env.Root.Header.Get("Message-ID"), "<>")
@@ -72,10 +95,19 @@ func Store(body *[]byte) (string, error) {
 	}
 
 	// extract tags from body matches based on --tag, plus addresses & X-Tags header
-	tagStr := findTagsInRawMessage(body) + "," +
+	tagRules := findTagRulesInRawMessage(body)
+	tagStr := ""
+	for _, t := range tagRules {
+		tagStr += "," + t.Tag
+	}
+	tagStr += "," +
 		obj.tagsFromPlusAddresses() + "," +
 		strings.TrimSpace(env.Root.Header.Get("X-Tags"))
 
+	if config.TagsFromPlusAddress {
+		tagStr += "," + tagsFromEnvelopeRecipients(opts.To)
+	}
+
 	tagData := uniqueTagsFromString(tagStr)
 
 	// begin a transaction to ensure both the message
@@ -93,22 +125,43 @@ func Store(body *[]byte) (string, error) {
 	size := float64(len(*body))
 	inline := len(env.Inlines)
 	attachments := len(env.Attachments)
-	snippet := tools.CreateSnippet(env.Text, env.HTML)
+	snippet := ""
+	if !config.DisableBodyIndex {
+		snippet = createSnippet(env)
+	}
+
+	envelopeFrom, envelopeTo, clientIP, helo, authUser, err := envelopeColumns(opts)
+	if err != nil {
+		return "", err
+	}
+
+	var expires int64
+	if !opts.Expires.IsZero() {
+		expires = opts.Expires.UnixMilli()
+	}
 
 	sql := fmt.Sprintf(`INSERT INTO %s 
-		(Created, ID, MessageID, Subject, Metadata, Size, Inline, Attachments, SearchText, Read, Snippet) 
-		VALUES(?,?,?,?,?,?,?,?,?,0,?)`,
+		(Created, ID, MessageID, Subject, Metadata, Size, Inline, Attachments, SearchText, Read, Snippet, EnvelopeFrom, EnvelopeTo, ClientIP, Helo, AuthUser, Expires) 
+		VALUES(?,?,?,?,?,?,?,?,?,0,?,?,?,?,?,?,?)`,
 		tenant("mailbox"),
 	) // #nosec
 
 	// insert mail summary data
-	_, err = tx.Exec(sql, created.UnixMilli(), id, messageID, subject, string(summaryJSON), size, inline, attachments, searchText, snippet)
+	_, err = tx.Exec(sql, created.UnixMilli(), id, messageID, subject, string(summaryJSON), size, inline, attachments, searchText, snippet,
+		envelopeFrom, envelopeTo, clientIP, helo, authUser, expires)
 	if err != nil {
 		return "", err
 	}
 
-	// insert compressed raw message
-	encoded := dbEncoder.EncodeAll(*body, make([]byte, 0, int(size)))
+	if err := storeMessageReferences(tx, id, messageReferences(env, messageID)); err != nil {
+		return "", err
+	}
+
+	// insert compressed (and optionally encrypted) raw message
+	encoded, err := encodeMessage(*body)
+	if err != nil {
+		return "", err
+	}
 	hexStr := hex.EncodeToString(encoded)
 	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s (ID, Email) VALUES(?, x'%s')`, tenant("mailbox_data"), hexStr), id) // #nosec
 	if err != nil {
@@ -121,11 +174,41 @@ func Store(body *[]byte) (string, error) {
 
 	if len(tagData) > 0 {
 		// set tags after tx.Commit()
-		if err := SetMessageTags(id, tagData); err != nil {
+		if _, err := setMessageTags(id, tagData); err != nil {
+			return "", err
+		}
+	}
+
+	// tag rules are matched against the stored message, so can also match the tags set above
+	matchedRules, err := matchingTagRules(id)
+	if err != nil {
+		logger.Log().Errorf("[tags] %s", err.Error())
+	}
+
+	if len(matchedRules) > 0 {
+		for _, r := range matchedRules {
+			for _, t := range r.Tags {
+				if !inArray(t, tagData) {
+					tagData = append(tagData, t)
+				}
+			}
+		}
+
+		if _, err := setMessageTags(id, tagData); err != nil {
 			return "", err
 		}
 	}
 
+	AddMessageEvent(id, EventReceived, receivedEventDetails(opts))
+
+	for _, t := range tagRules {
+		AddMessageEvent(id, EventTagRule, map[string]string{"tag": t.Tag, "match": t.Match})
+	}
+
+	for _, r := range matchedRules {
+		AddMessageEvent(id, EventTagRule, map[string]string{"tag": strings.Join(r.Tags, ", "), "match": r.Query})
+	}
+
 	c := &MessageSummary{}
 	if err := json.Unmarshal(summaryJSON, c); err != nil {
 		return "", err
@@ -139,8 +222,13 @@ func Store(body *[]byte) (string, error) {
 	c.Size = size
 	c.Tags = tagData
 	c.Snippet = snippet
+	if c.Metadata == nil {
+		c.Metadata = map[string]string{}
+	}
 
 	websockets.Broadcast("new", c)
+	notifyNewMessage()
+	queueMessageChecks(id)
 	webhook.Send(c)
 
 	dbLastAction = time.Now()
@@ -150,56 +238,109 @@ func Store(body *[]byte) (string, error) {
 	return id, nil
 }
 
-// List returns a subset of messages from the mailbox,
-// sorted latest to oldest
-func List(start, limit int) ([]MessageSummary, error) {
+// List returns a subset of messages from the mailbox, sorted latest to oldest
+// unless a sort order (created:asc or created:desc) is specified
+func List(start, limit int, sort string) ([]MessageSummary, error) {
+	results, _, err := ListFiltered(start, limit, "all", sort, TagFilter{})
+
+	return results, err
+}
+
+// ListFiltered returns a subset of messages from the mailbox matching the read filter (all, read or unread)
+// and tag filter, as well as the total number of messages matching the filters. Messages are sorted latest
+// to oldest unless a sort order (created:asc or created:desc) is specified.
+func ListFiltered(start, limit int, filter, sort string, tags TagFilter) ([]MessageSummary, float64, error) {
+	return listMessages(start, "", limit, filter, sort, tags)
+}
+
+// ListAfter returns a subset of messages like ListFiltered, however instead of an offset it returns
+// the messages following the message ID afterID (the last message of the previous page). This seeks
+// on the Created index, so unlike an offset it is equally fast for any position in the mailbox.
+// ErrMessageNotFound is returned if the afterID message does not exist.
+func ListAfter(afterID string, limit int, filter, sort string, tags TagFilter) ([]MessageSummary, float64, error) {
+	return listMessages(0, afterID, limit, filter, sort, tags)
+}
+
+// ListMessages returns a subset of messages using either an offset or the ID of the preceding message
+func listMessages(start int, afterID string, limit int, filter, sort string, tags TagFilter) ([]MessageSummary, float64, error) {
 	results := []MessageSummary{}
 	tsStart := time.Now()
 
+	orderBy, err := sortOrderBy(sort)
+	if err != nil {
+		return results, 0, err
+	}
+
 	q := sqlf.From(tenant("mailbox") + " m").
-		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Snippet`).
-		OrderBy("m.Created DESC").
-		Limit(limit).
-		Offset(start)
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Snippet, m.FirstOpened, m.SpamScore, m.HTMLScore, m.Pinned, m.Starred, m.ReleaseCount`).
+		Where("m.Deleted = 0").
+		OrderBy(orderBy).
+		Limit(limit)
 
-	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
-		var created float64
-		var id string
-		var messageID string
-		var subject string
-		var metadata string
-		var size float64
-		var attachments int
-		var read int
-		var snippet string
-		em := MessageSummary{}
+	var total float64
+	c := sqlf.From(tenant("mailbox") + " m").
+		Select("COUNT(*)").To(&total).
+		Where("m.Deleted = 0")
+
+	switch strings.ToLower(strings.TrimSpace(filter)) {
+	case "", "all":
+	case "read":
+		q.Where("m.Read = ?", 1)
+		c.Where("m.Read = ?", 1)
+	case "unread":
+		q.Where("m.Read = ?", 0)
+		c.Where("m.Read = ?", 0)
+	default:
+		q.Close()
+		c.Close()
+		return results, 0, fmt.Errorf("invalid filter %q, expected all, read or unread", filter)
+	}
 
-		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet); err != nil {
-			logger.Log().Errorf("[db] %s", err.Error())
-			return
+	if where, args := tags.where(); where != "" {
+		q.Where(where, args...)
+		c.Where(where, args...)
+	}
+
+	if afterID != "" {
+		var created, rowID int64
+		if err := sqlf.From(tenant("mailbox")).
+			Select("Created").To(&created).
+			Select("rowid").To(&rowID).
+			Where("ID = ?", afterID).
+			QueryRowAndClose(context.TODO(), db); err != nil {
+			q.Close()
+			c.Close()
+			if err == sql.ErrNoRows {
+				return results, 0, ErrMessageNotFound
+			}
+			return results, 0, err
 		}
 
-		if err := json.Unmarshal([]byte(metadata), &em); err != nil {
-			logger.Log().Errorf("[json] %s", err.Error())
-			return
+		// row values compare Created first & the row ID for messages received at the same time
+		if strings.HasSuffix(orderBy, "ASC") {
+			q.Where("(m.Created, m.rowid) > (?, ?)", created, rowID)
+		} else {
+			q.Where("(m.Created, m.rowid) < (?, ?)", created, rowID)
 		}
+	} else {
+		q.Offset(start)
+	}
 
-		em.Created = time.UnixMilli(int64(created))
-		em.ID = id
-		em.MessageID = messageID
-		em.Subject = subject
-		em.Size = size
-		em.Attachments = attachments
-		em.Read = read == 1
-		em.Snippet = snippet
-		// artificially generate ReplyTo if legacy data is missing Reply-To field
-		if em.ReplyTo == nil {
-			em.ReplyTo = []*mail.Address{}
+	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		em, err := scanMessageSummary(row)
+		if err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
 		}
 
 		results = append(results, em)
 	}); err != nil {
-		return results, err
+		c.Close()
+		return results, 0, err
+	}
+
+	if err := c.QueryRowAndClose(context.TODO(), db); err != nil {
+		return results, 0, err
 	}
 
 	// set tags for listed messages only
@@ -213,12 +354,149 @@ func List(start, limit int) ([]MessageSummary, error) {
 
 	logger.Log().Debugf("[db] list INBOX in %s", elapsed)
 
+	return results, total, nil
+}
+
+// SortOrderBy translates a sort parameter (eg: created:asc) into the ORDER BY clause,
+// defaulting to newest first if not set. Messages received at the same time are ordered by insertion.
+func sortOrderBy(sort string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(sort)) {
+	case "", "created:desc":
+		return "m.Created DESC, m.rowid DESC", nil
+	case "created:asc":
+		return "m.Created ASC, m.rowid ASC", nil
+	}
+
+	return "", fmt.Errorf("invalid sort order %q, expected created:asc or created:desc", sort)
+}
+
+// GetMessageSummariesByMessageID returns the summaries of all messages matching the
+// Message-ID header (without angle brackets), sorted latest to oldest
+func GetMessageSummariesByMessageID(messageID string) ([]MessageSummary, error) {
+	results := []MessageSummary{}
+
+	q := sqlf.From(tenant("mailbox")+" m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Snippet, m.FirstOpened, m.SpamScore, m.HTMLScore, m.Pinned, m.Starred, m.ReleaseCount`).
+		Where("m.MessageID = ?", messageID).
+		Where("m.Deleted = 0").
+		OrderBy("m.Created DESC")
+
+	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		em, err := scanMessageSummary(row)
+		if err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		results = append(results, em)
+	}); err != nil {
+		return results, err
+	}
+
+	for i, m := range results {
+		results[i].Tags = getMessageTags(m.ID)
+	}
+
+	dbLastAction = time.Now()
+
 	return results, nil
 }
 
-// GetMessage returns a Message generated from the mailbox_data collection.
+// GetMessageSummary returns the summary of a message by database ID
+func GetMessageSummary(id string) (MessageSummary, error) {
+	results := []MessageSummary{}
+
+	q := sqlf.From(tenant("mailbox")+" m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Snippet, m.FirstOpened, m.SpamScore, m.HTMLScore, m.Pinned, m.Starred, m.ReleaseCount`).
+		Where("m.ID = ?", id)
+
+	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		em, err := scanMessageSummary(row)
+		if err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		results = append(results, em)
+	}); err != nil {
+		return MessageSummary{}, err
+	}
+
+	if len(results) == 0 {
+		return MessageSummary{}, ErrMessageNotFound
+	}
+
+	results[0].Tags = getMessageTags(id)
+
+	dbLastAction = time.Now()
+
+	return results[0], nil
+}
+
+// Scan a message summary row of Created, ID, MessageID, Subject, Metadata, Size, Attachments, Read, Snippet, FirstOpened,
+// SpamScore, HTMLScore, Pinned, Starred & ReleaseCount, followed by any extra columns scanned into extra
+func scanMessageSummary(row *sql.Rows, extra ...interface{}) (MessageSummary, error) {
+	var created float64
+	var id string
+	var messageID string
+	var subject string
+	var metadata string
+	var size float64
+	var attachments int
+	var read int
+	var snippet string
+	var firstOpened float64
+	var spamScore, htmlScore sql.NullFloat64
+	var pinned, starred, releaseCount int
+	em := MessageSummary{}
+
+	dest := []interface{}{&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet, &firstOpened, &spamScore, &htmlScore, &pinned, &starred, &releaseCount}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return em, err
+	}
+
+	if err := json.Unmarshal([]byte(metadata), &em); err != nil {
+		return em, err
+	}
+
+	em.Created = time.UnixMilli(int64(created))
+	em.ID = id
+	em.MessageID = messageID
+	em.Subject = subject
+	em.Size = size
+	em.Attachments = attachments
+	em.Read = read == 1
+	em.Snippet = snippet
+	em.FirstOpened = firstOpenedTime(firstOpened)
+	em.SpamScore = nullFloat(spamScore)
+	em.HTMLScore = nullFloat(htmlScore)
+	em.Pinned = pinned == 1
+	em.Starred = starred == 1
+	em.ReleaseCount = releaseCount
+	if em.Metadata == nil {
+		em.Metadata = map[string]string{}
+	}
+	// artificially generate ReplyTo if legacy data is missing Reply-To field
+	if em.ReplyTo == nil {
+		em.ReplyTo = []*mail.Address{}
+	}
+
+	return em, nil
+}
+
+// GetMessage returns a Message generated from the mailbox_data collection, marking the message as read.
 // If the message lacks a date header, then the received datetime is used.
 func GetMessage(id string) (*Message, error) {
+	return getMessage(id, true)
+}
+
+// GetMessagePeek returns a Message like GetMessage, without marking the message as read
+func GetMessagePeek(id string) (*Message, error) {
+	return getMessage(id, false)
+}
+
+// Return a Message generated from the mailbox_data collection, optionally marking the message as read
+func getMessage(id string, markRead bool) (*Message, error) {
 	raw, err := GetMessageRaw(id)
 	if err != nil {
 		return nil, err
@@ -307,6 +585,54 @@ func GetMessage(id string) (*Message, error) {
 		}
 	}
 
+	obj.CIDMap = CIDMap(&obj)
+
+	obj.Metadata = map[string]string{}
+	obj.Via = ViaUnknown
+
+	q := sqlf.From(tenant("mailbox")).
+		Select(`FirstOpened, Metadata, Pinned, Expires, Starred, ReleaseCount,
+			IFNULL(ClientIP, ''), IFNULL(Helo, ''), IFNULL(AuthUser, '')`).
+		Where(`ID = ?`, id)
+
+	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		var firstOpened float64
+		var metadata string
+		var pinned, starred, releaseCount int
+		var expires int64
+
+		if err := row.Scan(&firstOpened, &metadata, &pinned, &expires, &starred, &releaseCount,
+			&obj.ServerInfo.ClientIP, &obj.ServerInfo.Helo, &obj.ServerInfo.AuthUser); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		obj.FirstOpened = firstOpenedTime(firstOpened)
+		obj.Pinned = pinned == 1
+		obj.Starred = starred == 1
+		obj.ReleaseCount = releaseCount
+		if expires > 0 {
+			t := time.UnixMilli(expires)
+			obj.Expires = &t
+		}
+
+		summary := DBMailSummary{}
+		if err := json.Unmarshal([]byte(metadata), &summary); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		if summary.Metadata != nil {
+			obj.Metadata = summary.Metadata
+		}
+		if summary.Via != "" {
+			obj.Via = summary.Via
+		}
+		obj.Listener = summary.Listener
+	}); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+	}
+
 	// get List-Unsubscribe links if set
 	obj.ListUnsubscribe = ListUnsubscribe{}
 	obj.ListUnsubscribe.Links = []string{}
@@ -321,9 +647,18 @@ func GetMessage(id string) (*Message, error) {
 		obj.ListUnsubscribe.HeaderPost = env.GetHeader("List-Unsubscribe-Post")
 	}
 
-	// mark message as read
-	if err := MarkRead(id); err != nil {
-		return &obj, err
+	// parse any upstream spam & authentication results
+	obj.Upstream = Upstream{}
+	obj.Upstream.Spam = tools.UpstreamSpamParser(env.GetHeader("X-Spam-Status"), env.GetHeader("X-Spam-Score"), env.GetHeader("X-Spam-Flag"))
+	obj.Upstream.AuthenticationResults = []tools.AuthenticationResults{}
+	for _, h := range env.GetHeaderValues("Authentication-Results") {
+		obj.Upstream.AuthenticationResults = append(obj.Upstream.AuthenticationResults, tools.AuthenticationResultsParser(h))
+	}
+
+	if markRead {
+		if err := MarkRead(id); err != nil {
+			return &obj, err
+		}
 	}
 
 	dbLastAction = time.Now()
@@ -348,19 +683,14 @@ func GetMessageRaw(id string) ([]byte, error) {
 		return nil, errors.New("message not found")
 	}
 
-	var data []byte
-	if sqlDriver == "rqlite" {
-		data, err = base64.StdEncoding.DecodeString(msg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding base64 message: %w", err)
-		}
-	} else {
-		data = []byte(msg)
+	data, err := dbBlob(msg)
+	if err != nil {
+		return nil, err
 	}
 
-	raw, err := dbDecoder.DecodeAll(data, nil)
+	raw, err := decodeMessage(data)
 	if err != nil {
-		return nil, fmt.Errorf("error decompressing message: %s", err.Error())
+		return nil, err
 	}
 
 	dbLastAction = time.Now()
@@ -368,7 +698,24 @@ func GetMessageRaw(id string) ([]byte, error) {
 	return raw, err
 }
 
-// GetAttachmentPart returns an *enmime.Part (attachment or inline) from a message
+// GetMessageCreated returns the time a message was received
+func GetMessageCreated(id string) (time.Time, error) {
+	var created float64
+	if err := sqlf.From(tenant("mailbox")).
+		Select("Created").To(&created).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, ErrMessageNotFound
+		}
+		return time.Time{}, err
+	}
+
+	return time.UnixMilli(int64(created)), nil
+}
+
+// GetAttachmentPart returns an *enmime.Part (attachment or inline) from a message. Other non-multipart
+// parts of the message tree (eg: the HTML body) can also be returned using their part ID.
 func GetAttachmentPart(id, partID string) (*enmime.Part, error) {
 	raw, err := GetMessageRaw(id)
 	if err != nil {
@@ -400,36 +747,128 @@ func GetAttachmentPart(id, partID string) (*enmime.Part, error) {
 		}
 	}
 
+	// any other (non-multipart) part of the message tree, eg: the text or HTML body
+	if p := env.Root.BreadthMatchFirst(func(p *enmime.Part) bool {
+		return p.PartID == partID && p.FirstChild == nil
+	}); p != nil {
+		return p, nil
+	}
+
 	dbLastAction = time.Now()
 
 	return nil, errors.New("attachment not found")
 }
 
+// GetAttachmentParts returns the attachments of a message, and the inline parts if inline is true,
+// in the same order as the message summary. Parts without a file name or Content-ID are excluded.
+func GetAttachmentParts(id string, inline bool) ([]*enmime.Part, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := env.Attachments
+	if inline {
+		candidates = append(append(append([]*enmime.Part{}, env.Inlines...), env.OtherParts...), env.Attachments...)
+	}
+
+	parts := []*enmime.Part{}
+	for _, p := range candidates {
+		if p.FileName != "" || p.ContentID != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	return parts, nil
+}
+
+// GetCalendarParts returns the text/calendar (or application/ics) parts of a message, whether they are
+// attachments or inline (eg: a meeting invitation alternative), in the order they appear in the message
+func GetCalendarParts(id string) ([]*enmime.Part, error) {
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := []*enmime.Part{}
+
+	var walk func(p *enmime.Part)
+	walk = func(p *enmime.Part) {
+		for ; p != nil; p = p.NextSibling {
+			ct := strings.ToLower(p.ContentType)
+			if ct == "text/calendar" || ct == "application/ics" {
+				parts = append(parts, p)
+			}
+			walk(p.FirstChild)
+		}
+	}
+
+	walk(env.Root)
+
+	return parts, nil
+}
+
 // LatestID returns the latest message ID
 //
 // If a query argument is set in the request the function will return the
 // latest message matching the search
 func LatestID(r *http.Request) (string, error) {
-	var messages []MessageSummary
-	var err error
+	id, _, err := LatestMessage(strings.TrimSpace(r.URL.Query().Get("query")), r.URL.Query().Get("tz"))
+	if err == ErrMessageNotFound {
+		return "", errors.New("Message not found")
+	}
+
+	return id, err
+}
+
+// LatestMessage returns the database ID & received time of the latest message, or the latest
+// message matching a search if set, without building the message summary.
+// ErrMessageNotFound is returned if there are no (matching) messages.
+func LatestMessage(search, timezone string) (string, time.Time, error) {
+	var id string
+	var created float64
 
-	search := strings.TrimSpace(r.URL.Query().Get("query"))
 	if search != "" {
-		messages, _, err = Search(search, r.URL.Query().Get("tz"), 0, 1)
+		q, err := searchQueryBuilder(search, timezone)
 		if err != nil {
-			return "", err
+			return "", time.Time{}, err
+		}
+		q.Limit(1)
+		defer q.Close()
+
+		if err := db.QueryRow(`SELECT s.ID, s.Created FROM (`+q.String()+`) s`, q.Args()...).Scan(&id, &created); err != nil { // #nosec
+			if err == sql.ErrNoRows {
+				return "", time.Time{}, ErrMessageNotFound
+			}
+			return "", time.Time{}, err
 		}
 	} else {
-		messages, err = List(0, 1)
-		if err != nil {
-			return "", err
+		orderBy, _ := sortOrderBy("")
+		if err := sqlf.From(tenant("mailbox")+" m").
+			Select("m.ID").To(&id).
+			Select("m.Created").To(&created).
+			Where("m.Deleted = 0").
+			OrderBy(orderBy).
+			Limit(1).
+			QueryRowAndClose(context.TODO(), db); err != nil {
+			if err == sql.ErrNoRows {
+				return "", time.Time{}, ErrMessageNotFound
+			}
+			return "", time.Time{}, err
 		}
 	}
-	if len(messages) == 0 {
-		return "", errors.New("Message not found")
-	}
 
-	return messages[0].ID, nil
+	return id, time.UnixMilli(int64(created)), nil
 }
 
 // MarkRead will mark a message as read
@@ -445,6 +884,8 @@ func MarkRead(id string) error {
 
 	if err == nil {
 		logger.Log().Debugf("[db] marked message %s as read", id)
+		AddMessageEvent(id, EventRead, nil)
+		webhook.Dispatch(webhook.MessageRead, webhook.ReadData{IDs: []string{id}, Read: true, Count: 1})
 	}
 
 	BroadcastMailboxStats()
@@ -452,14 +893,123 @@ func MarkRead(id string) error {
 	return err
 }
 
+// MarkOpened will record when a message was first opened, if it has not been opened before.
+// This is independent of the read status.
+func MarkOpened(id string) error {
+	_, err := sqlf.Update(tenant("mailbox")).
+		Set("FirstOpened", time.Now().UnixMilli()).
+		Where("ID = ?", id).
+		Where("FirstOpened = ?", 0).
+		ExecAndClose(context.Background(), db)
+
+	return err
+}
+
+// Return the FirstOpened time from a database timestamp, or nil if the message has not been opened
+func firstOpenedTime(ts float64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+
+	t := time.UnixMilli(int64(ts))
+
+	return &t
+}
+
+// MarkReadIDs will mark messages as read, returning the number of changed messages.
+// Notifications & stats are sent once for all messages.
+func MarkReadIDs(ids []string) (int, error) {
+	return setReadStatus(ids, true)
+}
+
+// MarkUnreadIDs will mark messages as unread, returning the number of changed messages.
+// Notifications & stats are sent once for all messages.
+func MarkUnreadIDs(ids []string) (int, error) {
+	return setReadStatus(ids, false)
+}
+
+// SetReadStatus sets the read status of messages in a single transaction
+func setReadStatus(ids []string, read bool) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+
+	newStatus, oldStatus := 0, 1
+	if read {
+		newStatus, oldStatus = 1, 0
+	}
+
+	chunks := chunkIDs(ids, 1000)
+
+	// find the messages which will change, the query is closed before the transaction begins
+	changed := []string{}
+	for _, chunk := range chunks {
+		in, args := sqlPlaceholders(chunk)
+		if err := sqlf.From(tenant("mailbox")).
+			Select("ID").
+			Where("Read = ?", oldStatus).
+			Where("ID IN "+in, args...).
+			QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+				var id string
+				if err := row.Scan(&id); err != nil {
+					logger.Log().Errorf("[db] %s", err.Error())
+					return
+				}
+				changed = append(changed, id)
+			}); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(changed) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	for _, chunk := range chunkIDs(changed, 1000) {
+		in, args := sqlPlaceholders(chunk)
+		if _, err := tx.Exec(`UPDATE `+tenant("mailbox")+` SET Read = ? WHERE ID IN `+in, append([]interface{}{newStatus}, args...)...); err != nil { // #nosec
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	status := "unread"
+	if read {
+		status = "read"
+	}
+	logger.Log().Debugf("[db] marked %d messages as %s in %s", len(changed), status, time.Since(start))
+
+	addMessageEvents(changed, status, nil)
+
+	webhook.Dispatch(webhook.MessageRead, webhook.ReadData{IDs: changed, Read: read, Count: len(changed)})
+
+	dbLastAction = time.Now()
+
+	BroadcastMailboxStats()
+
+	return len(changed), nil
+}
+
 // MarkAllRead will mark all messages as read
 func MarkAllRead() error {
-	var (
-		start = time.Now()
-		total = CountUnread()
-	)
+	start := time.Now()
 
-	_, err := sqlf.Update(tenant("mailbox")).
+	addReadStatusEvents(true)
+
+	res, err := sqlf.Update(tenant("mailbox")).
 		Set("Read", 1).
 		Where("Read = ?", 0).
 		ExecAndClose(context.Background(), db)
@@ -467,9 +1017,15 @@ func MarkAllRead() error {
 		return err
 	}
 
+	total, _ := res.RowsAffected()
+
 	elapsed := time.Since(start)
 	logger.Log().Debugf("[db] marked %v messages as read in %s", total, elapsed)
 
+	if total > 0 {
+		webhook.Dispatch(webhook.MessageRead, webhook.ReadData{IDs: []string{}, Read: true, Count: int(total), All: true})
+	}
+
 	BroadcastMailboxStats()
 
 	dbLastAction = time.Now()
@@ -479,12 +1035,11 @@ func MarkAllRead() error {
 
 // MarkAllUnread will mark all messages as unread
 func MarkAllUnread() error {
-	var (
-		start = time.Now()
-		total = CountRead()
-	)
+	start := time.Now()
 
-	_, err := sqlf.Update(tenant("mailbox")).
+	addReadStatusEvents(false)
+
+	res, err := sqlf.Update(tenant("mailbox")).
 		Set("Read", 0).
 		Where("Read = ?", 1).
 		ExecAndClose(context.Background(), db)
@@ -492,9 +1047,15 @@ func MarkAllUnread() error {
 		return err
 	}
 
+	total, _ := res.RowsAffected()
+
 	elapsed := time.Since(start)
 	logger.Log().Debugf("[db] marked %v messages as unread in %s", total, elapsed)
 
+	if total > 0 {
+		webhook.Dispatch(webhook.MessageRead, webhook.ReadData{IDs: []string{}, Read: false, Count: int(total), All: true})
+	}
+
 	BroadcastMailboxStats()
 
 	dbLastAction = time.Now()
@@ -515,6 +1076,8 @@ func MarkUnread(id string) error {
 
 	if err == nil {
 		logger.Log().Debugf("[db] marked message %s as unread", id)
+		AddMessageEvent(id, EventUnread, nil)
+		webhook.Dispatch(webhook.MessageRead, webhook.ReadData{IDs: []string{id}, Read: false, Count: 1})
 	}
 
 	dbLastAction = time.Now()
@@ -524,10 +1087,23 @@ func MarkUnread(id string) error {
 	return err
 }
 
-// DeleteMessages deletes one or more messages in bulk
-func DeleteMessages(ids []string) error {
+// DeleteMessages deletes one or more messages in bulk, returning the number of deleted messages
+// and the IDs which did not match any message. If config.Trash is enabled then the messages are
+// moved to the trash instead, see PurgeTrash.
+func DeleteMessages(ids []string) (int, []string, error) {
+	if config.Trash {
+		return trashMessages(ids)
+	}
+
+	return deleteMessages(ids)
+}
+
+// DeleteMessages permanently deletes one or more messages in bulk, including trashed messages
+func deleteMessages(ids []string) (int, []string, error) {
+	notFound := []string{}
+
 	if len(ids) == 0 {
-		return nil
+		return 0, notFound, nil
 	}
 
 	start := time.Now()
@@ -540,34 +1116,42 @@ func DeleteMessages(ids []string) error {
 	sql := fmt.Sprintf(`SELECT ID, Size FROM %s WHERE  ID IN (?%s)`, tenant("mailbox"), strings.Repeat(",?", len(args)-1)) // #nosec
 	rows, err := db.Query(sql, args...)
 	if err != nil {
-		return err
+		return 0, notFound, err
 	}
 	defer rows.Close()
 
 	toDelete := []string{}
+	found := map[string]bool{}
 	var totalSize float64
 
 	for rows.Next() {
 		var id string
 		var size float64
 		if err := rows.Scan(&id, &size); err != nil {
-			return err
+			return 0, notFound, err
 		}
 		toDelete = append(toDelete, id)
+		found[id] = true
 		totalSize = totalSize + size
 	}
 
 	if err = rows.Err(); err != nil {
-		return err
+		return 0, notFound, err
+	}
+
+	for _, id := range ids {
+		if !found[id] && !inArray(id, notFound) {
+			notFound = append(notFound, id)
+		}
 	}
 
 	if len(toDelete) == 0 {
-		return nil // nothing to delete
+		return 0, notFound, nil // nothing to delete
 	}
 
 	tx, err := db.BeginTx(context.Background(), nil)
 	if err != nil {
-		return err
+		return 0, notFound, err
 	}
 
 	args = make([]interface{}, len(toDelete))
@@ -575,18 +1159,21 @@ func DeleteMessages(ids []string) error {
 		args[i] = id
 	}
 
-	tables := []string{"mailbox", "mailbox_data", "message_tags"}
+	tables := withReleaseHistory([]string{"mailbox", "mailbox_data", "message_tags", "message_events", "message_references"})
 
 	for _, t := range tables {
-		sql = fmt.Sprintf(`DELETE FROM %s WHERE ID IN (?%s)`, tenant(t), strings.Repeat(",?", len(ids)-1))
+		sql = fmt.Sprintf(`DELETE FROM %s WHERE ID IN (?%s)`, tenant(t), strings.Repeat(",?", len(toDelete)-1))
 
 		_, err = tx.Exec(sql, args...) // #nosec
 		if err != nil {
-			return err
+			_ = tx.Rollback()
+			return 0, notFound, err
 		}
 	}
 
-	err = tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return 0, notFound, err
+	}
 
 	dbLastAction = time.Now()
 	addDeletedSize(int64(totalSize))
@@ -604,13 +1191,20 @@ func DeleteMessages(ids []string) error {
 
 	logger.Log().Debugf("[db] deleted %d %s in %s", len(toDelete), messages, elapsed)
 
+	webhook.Dispatch(webhook.MessageDeleted, webhook.DeletedData{IDs: toDelete, Count: len(toDelete)})
+
 	BroadcastMailboxStats()
 
-	return nil
+	return len(toDelete), notFound, nil
 }
 
-// DeleteAllMessages will delete all messages from a mailbox
-func DeleteAllMessages() error {
+// DeleteAllMessages will delete all messages from a mailbox, returning the number of deleted messages.
+// Pinned messages are kept unless force is set.
+func DeleteAllMessages(force bool) (int, error) {
+	if !force && CountPinned() > 0 {
+		return deleteUnpinnedMessages()
+	}
+
 	var (
 		start = time.Now()
 		total int
@@ -624,24 +1218,24 @@ func DeleteAllMessages() error {
 	// summaries and data are deleted successfully
 	tx, err := db.BeginTx(context.Background(), nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// roll back if it fails
 	defer tx.Rollback()
 
-	tables := []string{"mailbox", "mailbox_data", "tags", "message_tags"}
+	tables := withReleaseHistory([]string{"mailbox", "mailbox_data", "tags", "message_tags", "message_events", "message_references"})
 
 	for _, t := range tables {
 		sql := fmt.Sprintf(`DELETE FROM %s`, tenant(t)) // #nosec
 		_, err := tx.Exec(sql)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return err
+		return 0, err
 	}
 
 	elapsed := time.Since(start)
@@ -656,8 +1250,95 @@ func DeleteAllMessages() error {
 
 	logMessagesDeleted(total)
 
+	if total > 0 {
+		webhook.Dispatch(webhook.MessageDeleted, webhook.DeletedData{IDs: []string{}, Count: total, All: true})
+	}
+
 	websockets.Broadcast("prune", nil)
 	BroadcastMailboxStats()
 
-	return err
+	return total, nil
+}
+
+// DeleteOlderThan will delete all messages older than a duration, optionally keeping unread messages,
+// returning the number of deleted messages & their total size in bytes.
+// The cutoff is computed when called.
+func DeleteOlderThan(age time.Duration, keepUnread bool) (int, int64, error) {
+	start := time.Now()
+
+	where := "Created < ?"
+	if keepUnread {
+		where = where + " AND Read = 1"
+	}
+	cutoff := start.Add(-age).UnixMilli()
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	ids := []string{}
+	var totalSize float64
+
+	rows, err := tx.Query(`SELECT ID, Size FROM `+tenant("mailbox")+` WHERE `+where, cutoff) // #nosec
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for rows.Next() {
+		var id string
+		var size float64
+		if err := rows.Scan(&id, &size); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+		totalSize = totalSize + size
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, 0, nil // nothing to delete
+	}
+
+	// mailbox must be last as the other tables are matched against it
+	tables := withReleaseHistory([]string{"mailbox_data", "message_tags", "message_events", "message_references"})
+
+	for _, t := range tables {
+		sql := fmt.Sprintf(`DELETE FROM %s WHERE ID IN (SELECT ID FROM %s WHERE %s)`, tenant(t), tenant("mailbox"), where) // #nosec
+		if _, err := tx.Exec(sql, cutoff); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM `+tenant("mailbox")+` WHERE `+where, cutoff); err != nil { // #nosec
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	dbLastAction = time.Now()
+	addDeletedSize(int64(totalSize))
+
+	logMessagesDeleted(len(ids))
+
+	_ = pruneUnusedTags()
+
+	logger.Log().Debugf("[db] deleted %d messages older than %s in %s", len(ids), age, time.Since(start))
+
+	webhook.Dispatch(webhook.MessageDeleted, webhook.DeletedData{IDs: ids, Count: len(ids)})
+
+	websockets.Broadcast("prune", nil)
+	BroadcastMailboxStats()
+
+	return len(ids), int64(totalSize), nil
 }
@@ -1,8 +1,15 @@
 package storage
 
 import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/axllent/mailpit/config"
 )
 
 func TestTextEmailInserts(t *testing.T) {
@@ -25,11 +32,13 @@ func TestTextEmailInserts(t *testing.T) {
 	t.Logf("Inserted %d text emails in %s", testRuns, time.Since(start))
 
 	delStart := time.Now()
-	if err := DeleteAllMessages(); err != nil {
+	deleted, err := DeleteAllMessages(false)
+	if err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
 
+	assertEqual(t, deleted, testRuns, "incorrect number of deleted text emails returned")
 	assertEqual(t, CountTotal(), float64(0), "incorrect number of text emails deleted")
 
 	t.Logf("deleted %d text emails in %s", testRuns, time.Since(delStart))
@@ -57,7 +66,7 @@ func TestMimeEmailInserts(t *testing.T) {
 	t.Logf("Inserted %d text emails in %s", testRuns, time.Since(start))
 
 	delStart := time.Now()
-	if err := DeleteAllMessages(); err != nil {
+	if _, err := DeleteAllMessages(false); err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
@@ -122,7 +131,7 @@ func TestMessageSummary(t *testing.T) {
 		t.Fail()
 	}
 
-	summaries, err := List(0, 1)
+	summaries, err := List(0, 1, "")
 	if err != nil {
 		t.Log("error ", err)
 		t.Fail()
@@ -141,29 +150,1901 @@ func TestMessageSummary(t *testing.T) {
 	assertEqual(t, msg.Snippet, "Message with inline image and attachment:", "\"Snippet\" does does not match")
 	assertEqual(t, msg.Attachments, 1, "Expected 1 attachment")
 	assertEqual(t, msg.MessageID, "33af2ac1-c33d-9738-35e3-a6daf90bbd89@gmail.com", "\"MessageID\" does not match")
+	assertEqual(t, msg.BareLineEndings, false, "Expected no bare line endings")
 }
 
-func BenchmarkImportText(b *testing.B) {
+func TestBareLineEndingsSummary(t *testing.T) {
 	setup()
 	defer Close()
 
-	for i := 0; i < b.N; i++ {
-		if _, err := Store(&testTextEmail); err != nil {
-			b.Log("error ", err)
-			b.Fail()
+	t.Log("Testing bare line endings, TLS & authentication flags")
+
+	if _, err := StoreWithOptions(&testTextEmail, StoreOptions{BareLineEndings: true, TLS: true, Authenticated: true}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	summaries, err := List(0, 1, "")
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 1, "Expected 1 result")
+	assertEqual(t, summaries[0].BareLineEndings, true, "Expected bare line endings flag")
+	assertEqual(t, summaries[0].TLS, true, "Expected TLS flag")
+	assertEqual(t, summaries[0].Authenticated, true, "Expected authenticated flag")
+
+	// the flag is not derived from the message, so must survive a reindex
+	ReindexAll()
+
+	summaries, err = List(0, 1, "")
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, len(summaries), 1, "Expected 1 result")
+	assertEqual(t, summaries[0].BareLineEndings, true, "Expected bare line endings flag after reindex")
+	assertEqual(t, summaries[0].TLS, true, "Expected TLS flag after reindex")
+}
+
+func TestPruneAttachments(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing attachment pruning")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	summary, err := GetMessageSummary(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalSize := summary.AttachmentsSize
+	assertEqual(t, originalSize > 0, true, "attachments size not set")
+
+	time.Sleep(5 * time.Millisecond)
+
+	// keep inline attachments
+	res, err := PruneAttachments(0, true, 0)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, res.Messages, 1, "incorrect number of messages processed")
+	assertEqual(t, res.Attachments, 1, "incorrect number of attachments pruned")
+	assertEqual(t, res.BytesReclaimed > 0, true, "no bytes reclaimed")
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	assertEqual(t, msg.Subject, "inline + attachment", "subject does not match")
+	assertEqual(t, msg.Text != "" && msg.HTML != "", true, "message body was not retained")
+	assertEqual(t, len(msg.Attachments), 1, "incorrect number of attachments")
+	assertEqual(t, msg.Attachments[0].FileName, "Sample PDF.pdf", "attachment placeholder filename does not match")
+	assertEqual(t, msg.Attachments[0].ContentType, "text/plain", "attachment placeholder content type does not match")
+	assertEqual(t, len(msg.Inline), 1, "incorrect number of inline attachments")
+	assertEqual(t, msg.Inline[0].ContentType, "image/jpeg", "inline attachment should not be pruned")
+
+	summary, err = GetMessageSummary(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summary.AttachmentsSize < originalSize, true, "attachments size not updated")
+
+	// already processed
+	res, err = PruneAttachments(0, true, 0)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, res.Messages, 0, "message should not be processed twice")
+
+	// prune inline attachments
+	res, err = PruneAttachments(0, false, 0)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, res.Messages, 1, "incorrect number of messages processed")
+	assertEqual(t, res.Attachments, 1, "incorrect number of inline attachments pruned")
+
+	msg, err = GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, len(msg.Inline), 1, "incorrect number of inline attachments")
+	assertEqual(t, msg.Inline[0].ContentType, "text/plain", "inline attachment placeholder content type does not match")
+
+	t.Log("Pinned messages are not pruned")
+	pinnedID, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPinned(pinnedID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	res, err = PruneAttachments(0, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Messages, 0, "pinned message should not be processed")
+
+	msg, err = GetMessage(pinnedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Attachments[0].ContentType, "application/pdf", "pinned attachment should not be pruned")
+	assertEqual(t, msg.Inline[0].ContentType, "image/jpeg", "pinned inline attachment should not be pruned")
+}
+
+func TestDeleteOlderThan(t *testing.T) {
+	setup()
+	defer Close()
+
+	ages := []time.Duration{96 * time.Hour, 96 * time.Hour, 48 * time.Hour, time.Minute}
+
+	ids := []string{}
+	for _, age := range ages {
+		id, err := Store(&testMimeEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET Created = ? WHERE ID = ?`, time.Now().Add(-age).UnixMilli(), id); err != nil {
+			t.Fatal(err)
 		}
+
+		ids = append(ids, id)
+	}
+
+	if err := SetMessageTags(ids[0], []string{"Old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MarkReadIDs(ids[0:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := GetMessageSummary(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the read message older than 72h
+	deleted, size, err := DeleteOlderThan(72*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "incorrect number of deleted messages")
+	assertEqual(t, size, int64(summary.Size), "incorrect deleted size")
+	assertEqual(t, CountTotal(), float64(3), "incorrect number of remaining messages")
+	assertEqual(t, len(GetAllTags()), 0, "unused tags not pruned")
+
+	deleted, _, err = DeleteOlderThan(72*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "incorrect number of deleted messages")
+
+	deleted, _, err = DeleteOlderThan(72*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 0, "incorrect number of deleted messages")
+
+	deleted, _, err = DeleteOlderThan(time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "incorrect number of deleted messages")
+
+	if _, err := GetMessageSummary(ids[3]); err != nil {
+		t.Error("recent message was deleted")
 	}
 }
 
-func BenchmarkImportMime(b *testing.B) {
+func TestTrash(t *testing.T) {
 	setup()
 	defer Close()
 
-	for i := 0; i < b.N; i++ {
-		if _, err := Store(&testMimeEmail); err != nil {
-			b.Log("error ", err)
-			b.Fail()
+	config.Trash = true
+	defer func() { config.Trash = false }()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		raw := []byte(fmt.Sprintf("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Trash %d\r\n\r\nBody\r\n", i))
+		id, err := Store(&raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	deleted, notFound, err := DeleteMessages([]string{ids[0], "does-not-exist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "incorrect number of trashed messages")
+	assertEqual(t, strings.Join(notFound, ","), "does-not-exist", "incorrect not found IDs")
+	assertEqual(t, IsTrashed(ids[0]), true, "message not trashed")
+	assertEqual(t, CountTotal(), float64(2), "trashed message included in stats")
+
+	// already trashed
+	deleted, notFound, err = DeleteMessages(ids[0:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 0, "trashed message was trashed again")
+	assertEqual(t, len(notFound), 1, "incorrect not found IDs")
+
+	messages, total, err := ListFiltered(0, 50, "", "", TagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(messages), 2, "trashed message included in list")
+	assertEqual(t, total, float64(2), "trashed message included in list total")
+
+	if _, err := DeleteSearch(`subject:"Trash 1"`, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	results, _, err := Search("trash", "", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 1, "trashed messages included in search")
+
+	trash, total, err := ListTrash(0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(2), "incorrect number of trashed messages")
+	assertEqual(t, trash[0].ID, ids[1], "trash not ordered by most recently trashed")
+	assertEqual(t, trash[0].Trashed != nil, true, "trashed time not set")
+
+	restored, err := RestoreMessages([]string{ids[1], ids[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, restored, 1, "incorrect number of restored messages")
+	assertEqual(t, CountTotal(), float64(2), "message not restored")
+
+	purged, err := PurgeTrash([]string{ids[0], ids[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, purged, 1, "incorrect number of purged messages")
+	if _, err := GetMessageSummary(ids[0]); err == nil {
+		t.Error("purged message still exists")
+	}
+
+	if _, _, err := DeleteMessages(ids[1:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET Deleted = ? WHERE ID = ?`, time.Now().Add(-2*time.Hour).UnixMilli(), ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err = purgeExpiredTrash(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, purged, 1, "incorrect number of expired messages purged")
+	assertEqual(t, CountTotal(), float64(1), "untrashed message purged")
+
+	purged, err = PurgeTrash(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, purged, 0, "incorrect number of purged messages")
+}
+
+func TestTrashExcluded(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.Trash = true
+	defer func() { config.Trash = false }()
+
+	original := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nMessage-ID: <original@example.com>\r\nSubject: Original\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nBody\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=file.pdf\r\n\r\nPDF\r\n--b--\r\n")
+	originalID, err := Store(&original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := []byte("From: recipient@example.com\r\nTo: sender@example.com\r\nMessage-ID: <reply@example.com>\r\n" +
+		"In-Reply-To: <original@example.com>\r\nReferences: <original@example.com>\r\nSubject: Re: Original\r\n\r\nReply\r\n")
+	replyID, err := Store(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread, err := GetThread(replyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(thread), 2, "incorrect number of thread messages")
+
+	if _, err := AddMessageTags([]string{originalID, replyID}, []string{"Shared"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddMessageTags([]string{originalID}, []string{"Trashed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := DeleteMessages([]string{originalID}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, strings.Join(GetAllTags(), ","), "Shared", "trashed message tags listed")
+	counts := GetAllTagsCount()
+	assertEqual(t, len(counts), 1, "trashed message tags counted")
+	assertEqual(t, counts["Shared"], int64(1), "trashed message included in tag count")
+
+	summaries, err := GetMessageSummariesByMessageID("original@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(summaries), 0, "trashed message returned by Message-ID")
+
+	thread, err = GetThread(replyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(thread), 1, "trashed message included in thread")
+	assertEqual(t, thread[0].ID, replyID, "incorrect thread message")
+
+	attachments, total, err := ListAttachments("", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(attachments), 0, "trashed message attachments listed")
+	assertEqual(t, total, float64(0), "trashed message attachments counted")
+}
+
+func TestPinned(t *testing.T) {
+	setup()
+	defer Close()
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		raw := []byte(fmt.Sprintf("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Pinned %d\r\n\r\nBody\r\n", i))
+		id, err := Store(&raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetPinned("does-not-exist", true); err != ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+
+	for _, id := range ids[0:2] {
+		if err := SetPinned(id, true); err != nil {
+			t.Fatal(err)
 		}
 	}
+	assertEqual(t, CountPinned(), float64(2), "incorrect number of pinned messages")
+	assertEqual(t, StatsGet().Pinned, float64(2), "incorrect pinned stats")
+
+	summary, err := GetMessageSummary(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summary.Pinned, true, "summary not pinned")
+
+	msg, err := GetMessage(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Pinned, true, "message not pinned")
+
+	results, _, err := Search("is:pinned", "", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 2, "incorrect is:pinned results")
+	assertEqual(t, results[0].Pinned, true, "search result not pinned")
+
+	results, _, err = Search("!is:pinned", "", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 3, "incorrect !is:pinned results")
+
+	// pinned messages are never pruned
+	config.MaxMessages = 1
+	pruneMessages()
+	config.MaxMessages = 0
+	assertEqual(t, CountTotal(), float64(3), "pinned messages were pruned")
+
+	deleted, err := DeleteSearch("pinned", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "pinned messages were deleted by search")
+
+	if err := SetPinned(ids[1], false); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err = DeleteAllMessages(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "pinned messages were deleted")
+	assertEqual(t, CountTotal(), float64(1), "pinned message was not kept")
+
+	if _, err := GetMessageSummary(ids[0]); err != nil {
+		t.Error("pinned message was deleted")
+	}
+
+	deleted, err = DeleteAllMessages(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "pinned message was not force deleted")
+	assertEqual(t, CountTotal(), float64(0), "messages not deleted")
+}
+
+func TestMessageExpiry(t *testing.T) {
+	setup()
+	defer Close()
+
+	expired, err := StoreWithOptions(&testTextEmail, StoreOptions{Expires: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiring, err := StoreWithOptions(&testTextEmail, StoreOptions{Expires: time.Now().Add(15 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned, err := StoreWithOptions(&testTextEmail, StoreOptions{Expires: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPinned(pinned, true); err != nil {
+		t.Fatal(err)
+	}
+
+	permanent, err := Store(&testTextEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := GetMessage(expiring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Expires == nil || time.Until(*msg.Expires) < 14*time.Minute {
+		t.Errorf("unexpected expiry: %v", msg.Expires)
+	}
+
+	msg, err = GetMessage(permanent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Expires == nil, true, "message without a TTL has an expiry")
 
+	deleted, err := deleteExpiredMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, deleted, 1, "incorrect number of expired messages deleted")
+
+	if _, err := GetMessageSummary(expired); err == nil {
+		t.Error("expired message was not deleted")
+	}
+	assertEqual(t, CountTotal(), float64(3), "unexpired or pinned messages were deleted")
+}
+
+func TestStarred(t *testing.T) {
+	setup()
+	defer Close()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	n, err := SetStarred(ids[0:2], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 2, "incorrect number of starred messages")
+
+	// already starred
+	n, err = SetStarred(ids[0:1], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 0, "starred message was starred again")
+
+	summary, err := GetMessageSummary(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summary.Starred, true, "summary not starred")
+	assertEqual(t, summary.Read, false, "starring changed the read status")
+
+	msg, err := GetMessage(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Starred, true, "message not starred")
+
+	results, _, err := Search("is:starred", "", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 2, "incorrect is:starred results")
+	assertEqual(t, results[0].Starred, true, "search result not starred")
+
+	results, _, err = Search("-is:starred", "", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 1, "incorrect -is:starred results")
+
+	n, err = SetStarred(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 2, "incorrect number of unstarred messages")
+
+	n, err = SetStarred(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 3, "incorrect number of starred messages")
+
+	// trashing a message removes the star
+	config.Trash = true
+	defer func() { config.Trash = false }()
+
+	if _, _, err := DeleteMessages(ids[2:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RestoreMessages(ids[2:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err = GetMessageSummary(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summary.Starred, false, "trashed message is still starred")
+}
+
+func BenchmarkImportText(b *testing.B) {
+	setup()
+	defer Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			b.Log("error ", err)
+			b.Fail()
+		}
+	}
+}
+
+func BenchmarkImportMime(b *testing.B) {
+	setup()
+	defer Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Store(&testMimeEmail); err != nil {
+			b.Log("error ", err)
+			b.Fail()
+		}
+	}
+
+}
+
+func TestEmbedCIDs(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing cid: rewriting")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, len(msg.CIDMap), 1, "Expected 1 Content-ID")
+	partID := msg.CIDMap["part1.845LaYlX.wtWMpWwa@gmail.com"]
+	assertEqual(t, partID != "", true, "Expected Content-ID to map to a part ID")
+
+	// the same cid referenced multiple times, with different casing, plus an unknown cid
+	msg.HTML = `<img src="cid:part1.845LaYlX.wtWMpWwa@gmail.com"><img src='CID:PART1.845laylx.wtwmpwwa@gmail.com'>` +
+		`<div style="background: url(cid:part1.845LaYlX.wtWMpWwa%40gmail.com)"></div><img src="cid:unknown@example.com">`
+
+	html := ReplaceCIDs(msg, func(a Attachment) (string, bool) {
+		return "/part/" + a.PartID, true
+	})
+	assertEqual(t, html, `<img src="/part/`+partID+`"><img src='/part/`+partID+`'>`+
+		`<div style="background: url(/part/`+partID+`)"></div><img src="cid:unknown@example.com">`, "cid: references not replaced")
+
+	html, err = EmbedCIDs(msg)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	assertEqual(t, strings.Count(html, "data:image/jpeg;base64,"), 3, "Expected base64 data URIs")
+	assertEqual(t, strings.Count(html, "cid:"), 1, "Expected only the unknown cid: to remain")
+}
+
+func TestCIDParts(t *testing.T) {
+	setup()
+	defer Close()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: CID map\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=mixed\r\n\r\n" +
+		"--mixed\r\nContent-Type: multipart/related; boundary=related\r\n\r\n" +
+		"--related\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo@example.com\"><img src=\"cid:missing\">\r\n" +
+		"--related\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw0KGgo=\r\n" +
+		"--related\r\nContent-Type: image/gif\r\nContent-Disposition: inline; filename=spacer.gif\r\nContent-Transfer-Encoding: base64\r\n\r\nR0lGODlh\r\n" +
+		"--related--\r\n" +
+		"--mixed\r\nContent-Type: application/pdf\r\nContent-ID: <doc@example.com>\r\nContent-Disposition: attachment; filename=doc.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQK\r\n" +
+		"--mixed\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=notes.txt\r\n\r\nnotes\r\n" +
+		"--mixed--\r\n")
+
+	id, err := Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts, err := GetCIDParts(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(parts), 3, "incorrect number of parts")
+
+	assertEqual(t, *parts[0].ContentID, "logo@example.com", "incorrect first Content-ID")
+	assertEqual(t, parts[0].ContentType, "image/png", "incorrect first content type")
+	assertEqual(t, parts[0].Size, float64(8), "incorrect first size")
+	assertEqual(t, parts[0].Inline, true, "first part should be inline")
+
+	assertEqual(t, parts[1].ContentID == nil, true, "second part should not have a Content-ID")
+	assertEqual(t, parts[1].ContentType, "image/gif", "incorrect second content type")
+	assertEqual(t, parts[1].Inline, true, "second part should be inline")
+
+	assertEqual(t, *parts[2].ContentID, "doc@example.com", "incorrect third Content-ID")
+	assertEqual(t, parts[2].Inline, false, "third part should be an attachment")
+
+	part, err := GetAttachmentPart(id, parts[0].PartID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, part.ContentID, "logo@example.com", "part ID does not match the Content-ID")
+
+	if _, err := GetCIDParts("missing"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestMessageEncryption(t *testing.T) {
+	setup()
+	defer Close()
+	defer func() { config.EncryptionKey = "" }()
+
+	t.Log("Testing message encryption at rest")
+
+	legacyID, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	config.EncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	if err := initEncryption(); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	var stored string
+	if err := db.QueryRow(`SELECT Email FROM `+tenant("mailbox_data")+` WHERE ID = ?`, id).Scan(&stored); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, strings.HasPrefix(stored, string(encryptedMarker)), true, "Expected message to be encrypted")
+
+	for _, i := range []string{legacyID, id} {
+		if _, err := GetMessage(i); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, string(raw), string(testMimeEmail), "Decrypted message does not match")
+
+	t.Log("Testing missing & invalid encryption keys")
+	config.EncryptionKey = ""
+	assertEqual(t, initEncryption() != nil, true, "Expected an error without an encryption key")
+
+	_, err = GetMessageRaw(id)
+	assertEqual(t, err, ErrMessageEncrypted, "Expected encrypted message error")
+
+	config.EncryptionKey = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+	assertEqual(t, initEncryption() != nil, true, "Expected an error with the wrong encryption key")
+
+	config.EncryptionKey = "invalid"
+	assertEqual(t, initEncryption() != nil, true, "Expected an error with an invalid encryption key")
+
+	t.Log("Testing the encryption key check without encrypted messages")
+	if _, err := db.Exec(`DELETE FROM `+tenant("mailbox_data")+` WHERE ID = ?`, id); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	config.EncryptionKey = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+	assertEqual(t, initEncryption() != nil, true, "Expected an error with the wrong encryption key")
+
+	config.EncryptionKey = ""
+	if err := initEncryption(); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+	assertEqual(t, SettingGet(encryptionKeyCheckSetting), "", "Expected the encryption key check to be removed")
+
+	config.EncryptionKey = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+	if err := initEncryption(); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+}
+
+func TestDisableBodyIndex(t *testing.T) {
+	setup()
+	defer Close()
+	defer func() { config.DisableBodyIndex = false }()
+
+	config.DisableBodyIndex = true
+
+	if _, err := Store(&testTextEmail); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	var searchText, snippet string
+	if err := db.QueryRow(`SELECT SearchText, Snippet FROM `+tenant("mailbox")).Scan(&searchText, &snippet); err != nil {
+		t.Log("error ", err)
+		t.FailNow()
+	}
+
+	assertEqual(t, snippet, "", "Expected no snippet")
+	assertEqual(t, strings.Contains(searchText, "plain text message"), true, "Expected subject to be indexed")
+	assertEqual(t, strings.Contains(searchText, "vulputate"), false, "Expected message body not to be indexed")
+}
+
+func TestBulkReadStatus(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing bulk read status")
+
+	ids := []string{}
+	for i := 0; i < 50; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	n, err := MarkReadIDs(append(ids[0:20:20], "does-not-exist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 20, "incorrect number of messages marked read")
+	assertEqualStats(t, 50, 30)
+
+	// already read
+	n, err = MarkReadIDs(ids[0:20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 0, "read messages were changed")
+
+	n, err = MarkUnreadIDs(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 20, "incorrect number of messages marked unread")
+	assertEqualStats(t, 50, 50)
+
+	if err := MarkAllRead(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualStats(t, 50, 0)
+
+	if err := MarkAllUnread(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualStats(t, 50, 50)
+}
+
+func BenchmarkMarkReadIDs(b *testing.B) {
+	setup()
+	defer Close()
+
+	ids := []string{}
+	for i := 0; i < 2000; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// the underlying SQL
+	sqlStart := time.Now()
+	for i := 0; i < b.N; i++ {
+		for _, read := range []int{1, 0} {
+			for _, chunk := range chunkIDs(ids, 1000) {
+				in, args := sqlPlaceholders(chunk)
+				if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET Read = ? WHERE ID IN `+in, append([]interface{}{read}, args...)...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	sqlElapsed := time.Since(sqlStart)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MarkReadIDs(ids); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := MarkUnreadIDs(ids); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	ratio := float64(b.Elapsed()) / float64(sqlElapsed)
+	b.ReportMetric(ratio, "x-sql")
+
+	// the selects before each update are expected, per-message queries are not
+	if ratio > 5 {
+		b.Fatalf("bulk read status took %.1fx the time of the SQL updates", ratio)
+	}
+}
+
+func TestListSortOrder(t *testing.T) {
+	setup()
+	defer Close()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for sort, expected := range map[string][]string{
+		"":             {ids[2], ids[1], ids[0]},
+		"created:desc": {ids[2], ids[1], ids[0]},
+		"created:asc":  {ids[0], ids[1], ids[2]},
+	} {
+		summaries, err := List(0, 3, sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, len(summaries), 3, "incorrect number of messages")
+		for i, m := range summaries {
+			assertEqual(t, m.ID, expected[i], "incorrect sort order for "+sort)
+		}
+	}
+
+	if _, err := List(0, 3, "subject:asc"); err == nil {
+		t.Error("expected an error for an invalid sort order")
+	}
+}
+
+func TestListAfter(t *testing.T) {
+	setup()
+	defer Close()
+
+	// messages are stored quickly, so several share the same received time
+	for i := 0; i < 10; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sort := range []string{"created:desc", "created:asc"} {
+		all, err := List(0, 10, sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paged := []string{}
+		afterID := ""
+		for {
+			var summaries []MessageSummary
+			if afterID == "" {
+				summaries, _, err = ListFiltered(0, 3, "all", sort, TagFilter{})
+			} else {
+				summaries, _, err = ListAfter(afterID, 3, "all", sort, TagFilter{})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(summaries) == 0 {
+				break
+			}
+			for _, m := range summaries {
+				paged = append(paged, m.ID)
+			}
+			afterID = summaries[len(summaries)-1].ID
+		}
+
+		assertEqual(t, len(paged), len(all), "incorrect number of paged messages for "+sort)
+		for i, m := range all {
+			assertEqual(t, paged[i], m.ID, "incorrect paged order for "+sort)
+		}
+	}
+
+	if _, _, err := ListAfter("missing", 3, "all", "", TagFilter{}); err != ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+}
+
+func TestListFiltered(t *testing.T) {
+	setup()
+	defer Close()
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// mark every second message as read
+	for i := 0; i < len(ids); i += 2 {
+		if err := MarkRead(ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for start := 0; start < 5; start += 2 {
+		summaries, total, err := ListFiltered(start, 2, "unread", "", TagFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, total, float64(5), "incorrect unread total")
+		for _, m := range summaries {
+			assertEqual(t, m.Read, false, "read message in unread filter")
+			assertEqual(t, seen[m.ID], false, "duplicate message across pages")
+			seen[m.ID] = true
+		}
+	}
+	assertEqual(t, len(seen), 5, "incorrect number of paginated unread messages")
+
+	summaries, total, err := ListFiltered(0, 50, "read", "", TagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(5), "incorrect read total")
+	assertEqual(t, len(summaries), 5, "incorrect number of read messages")
+
+	_, total, err = ListFiltered(0, 50, "all", "", TagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(10), "incorrect total")
+
+	if err := MarkAllRead(); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, total, err = ListFiltered(0, 50, "unread", "", TagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(0), "incorrect unread total after marking all read")
+	assertEqual(t, len(summaries), 0, "incorrect number of unread messages after marking all read")
+
+	_, total, err = ListFiltered(0, 50, "read", "", TagFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(10), "incorrect read total after marking all read")
+
+	if _, _, err := ListFiltered(0, 50, "flagged", "", TagFilter{}); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+}
+
+func TestListTagFilter(t *testing.T) {
+	setup()
+	defer Close()
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetTagsForIDs(ids[0:6], []string{"Billing"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddMessageTags(ids[4:8], []string{"Build 1.2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a legacy tag containing a colon directly, bypassing validation
+	if _, err := db.Exec(`INSERT INTO ` + tenant("tags") + ` (Name) VALUES ('env:prod')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO `+tenant("message_tags")+` (ID, TagID) SELECT ?, ID FROM `+tenant("tags")+` WHERE Name = 'env:prod'`, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		tags  TagFilter
+		total float64
+	}{
+		{TagFilter{Tags: []string{"billing"}}, 6},
+		{TagFilter{Tags: []string{"Billing", "build  1.2"}}, 2},
+		{TagFilter{Tags: []string{"Billing", "build 1.2"}, Any: true}, 8},
+		{TagFilter{Tags: []string{"Billing", "Missing"}}, 0},
+		{TagFilter{Tags: []string{"env:prod", "billing"}}, 1},
+		{TagFilter{Tags: []string{""}}, 10},
+	} {
+		summaries, total, err := ListFiltered(0, 3, "all", "", test.tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, total, test.total, fmt.Sprintf("incorrect total for %+v", test.tags))
+		if len(summaries) > 3 || (test.total > 0 && len(summaries) == 0) {
+			t.Errorf("incorrect number of messages for %+v: %d", test.tags, len(summaries))
+		}
+	}
+
+	_, total, err := ListAfter(ids[5], 10, "unread", "", TagFilter{Tags: []string{"Billing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(6), "incorrect total")
+}
+
+func TestMessageEvents(t *testing.T) {
+	setup()
+	defer Close()
+
+	id, err := StoreWithOptions(&testTextEmail, StoreOptions{Via: "smtp", From: "sender@example.com", To: []string{"a@example.com", "b@example.com"}, ClientIP: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MarkRead(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetMessageTags(id, []string{"Events"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MarkAllUnread(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := GetMessageEvents(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := []string{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+
+	assertEqual(t, strings.Join(types, ","), "received,read,tags-changed,unread", "incorrect events")
+	assertEqual(t, events[0].Details["from"], "sender@example.com", "incorrect received from")
+	assertEqual(t, events[0].Details["to"], "a@example.com, b@example.com", "incorrect received to")
+	assertEqual(t, events[0].Details["client"], "127.0.0.1", "incorrect received client")
+	assertEqual(t, events[2].Details["tags"], "Events", "incorrect tags")
+
+	t.Log("Event limit")
+	for i := 0; i < MaxMessageEvents+10; i++ {
+		AddMessageEvent(id, EventSpamScored, map[string]string{"score": strconv.Itoa(i)})
+	}
+
+	events, err = GetMessageEvents(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(events), MaxMessageEvents, "incorrect number of events")
+	assertEqual(t, events[0].Details["score"], "10", "oldest events not removed")
+	assertEqual(t, events[len(events)-1].Details["score"], strconv.Itoa(MaxMessageEvents+9), "incorrect latest event")
+
+	t.Log("Delete message")
+	if _, _, err := DeleteMessages([]string{id}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetMessageEvents(id); err != ErrMessageNotFound {
+		t.Fatalf("expected ErrMessageNotFound, got %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + tenant("message_events")).Scan(&count); err != nil { // #nosec
+		t.Fatal(err)
+	}
+	assertEqual(t, count, 0, "events not deleted with the message")
+
+	t.Log("Events of deleted messages are ignored")
+	AddMessageEvent(id, EventRead, nil)
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + tenant("message_events")).Scan(&count); err != nil { // #nosec
+		t.Fatal(err)
+	}
+	assertEqual(t, count, 0, "event added to a deleted message")
+}
+
+func TestMessageEnvelope(t *testing.T) {
+	setup()
+	defer Close()
+
+	id, err := StoreWithOptions(&testTextEmail, StoreOptions{
+		Via:      ViaSMTPS,
+		TLS:      true,
+		From:     "sender@example.com",
+		To:       []string{"a@example.com", "hidden@example.com"},
+		ClientIP: "127.0.0.1",
+		Helo:     "client.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := GetMessageEnvelope(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, e.ID, id, "incorrect ID")
+	assertEqual(t, e.From, "sender@example.com", "incorrect envelope sender")
+	assertEqual(t, strings.Join(e.To, ","), "a@example.com,hidden@example.com", "incorrect envelope recipients")
+	assertEqual(t, e.ClientIP, "127.0.0.1", "incorrect client IP")
+	assertEqual(t, e.Helo, "client.example.com", "incorrect HELO")
+	assertEqual(t, e.TLS, true, "incorrect TLS")
+	assertEqual(t, e.Authenticated, false, "incorrect authenticated")
+	assertEqual(t, e.Via, ViaSMTPS, "incorrect via")
+
+	t.Log("Message without an envelope")
+	noEnvelopeID, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = GetMessageEnvelope(noEnvelopeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, e.From, "", "incorrect envelope sender")
+	assertEqual(t, len(e.To), 0, "incorrect envelope recipients")
+	assertEqual(t, e.Helo, "", "incorrect HELO")
+	assertEqual(t, e.Via, ViaUnknown, "incorrect via")
+
+	t.Log("Summaries")
+	messages, err := List(0, 50, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetEnvelopeRecipients(messages); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range messages {
+		if m.ID == id {
+			assertEqual(t, strings.Join(m.EnvelopeTo, ","), "a@example.com,hidden@example.com", "incorrect summary envelope recipients")
+		} else if m.EnvelopeTo != nil {
+			t.Errorf("unexpected envelope recipients: %v", m.EnvelopeTo)
+		}
+	}
+
+	if _, err := GetMessageEnvelope("missing"); err != ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+}
+
+func TestRuntimeSettings(t *testing.T) {
+	setup()
+	defer Close()
+
+	maxMessages := config.MaxMessages
+	defer func() { config.MaxMessages, config.SMTPRelayPaused = maxMessages, false }()
+
+	if err := UpdateRuntimeSettings(map[string]interface{}{"max-messages": float64(42)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateRuntimeSettings(map[string]interface{}{"smtp-relay-paused": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a restart
+	config.MaxMessages, config.SMTPRelayPaused = maxMessages, false
+	loadRuntimeSettings()
+
+	assertEqual(t, config.MaxMessages, 42, "max-messages not restored")
+	assertEqual(t, config.SMTPRelayPaused, true, "smtp-relay-paused not restored")
+
+	if err := UpdateRuntimeSettings(map[string]interface{}{"unknown": 1}); err == nil {
+		t.Error("expected an error for an unknown setting")
+	}
+}
+
+func TestMessageSnippets(t *testing.T) {
+	setup()
+	defer Close()
+
+	tests := map[string]string{
+		"html-only": "Content-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<p>Caf=C3=A9   <b>menu</b></p>\r\n",
+		"attachment-only": "Content-Type: multipart/mixed; boundary=b1\r\n\r\n--b1\r\nContent-Type: application/pdf\r\n" +
+			"Content-Disposition: attachment; filename=test.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQK\r\n--b1--\r\n",
+		"base64-text": "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\nSGVsbG8KCldvcmxk\r\n",
+	}
+
+	expected := map[string]string{
+		"html-only":       "Café menu",
+		"attachment-only": "",
+		"base64-text":     "Hello World",
+	}
+
+	for name, body := range tests {
+		raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: " + name + "\r\nMIME-Version: 1.0\r\n" + body)
+		id, err := Store(&raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		summary, err := GetMessageSummary(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, summary.Snippet, expected[name], "incorrect snippet for "+name)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	setup()
+	defer Close()
+
+	for i := 0; i < 25; i++ {
+		if _, err := Store(&testTextEmail); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, batchSize := backfillJobs, backfillBatchSize
+	defer func() { backfillJobs, backfillBatchSize = jobs, batchSize }()
+
+	processed := map[string]int{}
+	backfillJobs = []backfillJob{{
+		Name:           "test",
+		SearchPrefixes: []string{"subject"},
+		Process: func(id string) error {
+			processed[id]++
+			return nil
+		},
+	}}
+	backfillBatchSize = 10
+
+	assertEqual(t, prepareBackfills(), true, "expected an incomplete job")
+
+	// messages stored after the job was added are not processed
+	newID, err := Store(&testTextEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := backfillStep(backfillJobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, done, false, "job should not be complete")
+	assertEqual(t, len(processed), 10, "incorrect number of processed messages")
+
+	status := BackfillStatuses()[0]
+	assertEqual(t, status.Processed, float64(10), "incorrect processed count")
+	assertEqual(t, status.Total, float64(25), "incorrect total")
+	assertEqual(t, status.Complete, false, "job should not be complete")
+	assertEqual(t, strings.Join(SearchPendingBackfills("subject:test"), ","), "test", "search should depend on the job")
+	assertEqual(t, len(SearchPendingBackfills("test")), 0, "search should not depend on the job")
+
+	t.Log("Resume after a restart")
+	backfillRuns = map[string]*backfillRun{}
+	assertEqual(t, prepareBackfills(), true, "expected an incomplete job")
+
+	for !done {
+		if done, err = backfillStep(backfillJobs[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEqual(t, len(processed), 25, "incorrect number of processed messages")
+	for id, n := range processed {
+		assertEqual(t, n, 1, "message processed more than once: "+id)
+	}
+	assertEqual(t, processed[newID], 0, "new message should not be processed")
+
+	status = BackfillStatuses()[0]
+	assertEqual(t, status.Processed, float64(25), "incorrect processed count")
+	assertEqual(t, status.Complete, true, "job should be complete")
+	assertEqual(t, len(SearchPendingBackfills("subject:test")), 0, "search should not depend on a completed job")
+
+	t.Log("Attachments size")
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET Metadata = json_remove(Metadata, '$.AttachmentsSize') WHERE ID = ?`, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backfillAttachmentsSize(id); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := GetMessageSummary(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summary.AttachmentsSize > 0, true, "attachments size not backfilled")
+}
+
+func TestThread(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.UseMessageDates = true
+	defer func() { config.UseMessageDates = false }()
+
+	t.Log("Testing message threads")
+
+	start := time.Now().Add(-time.Hour)
+
+	messages := []struct {
+		name       string
+		messageID  string
+		inReplyTo  string
+		references string
+	}{
+		{"a", "<a@example.com>", "", ""},
+		{"b", "<b@example.com>", "<a@example.com>", "<a@example.com>"},
+		{"c", "<c@example.com>", "<b@example.com>", "<a@example.com>\r\n <b@example.com>"},
+		{"unrelated", "<x@example.com>", "", ""},
+		{"e", "<e@example.com>", "a@example.com", ""},
+		{"no-id-1", "", "", ""},
+		{"no-id-2", "", "", ""},
+	}
+
+	ids := map[string]string{}
+
+	for i, m := range messages {
+		header := fmt.Sprintf("From: from@example.com\r\nTo: to@example.com\r\nSubject: %s\r\nDate: %s\r\n", m.name, start.Add(time.Duration(i)*time.Minute).Format(time.RFC1123Z))
+		if m.messageID != "" {
+			header += "Message-ID: " + m.messageID + "\r\n"
+		}
+		if m.inReplyTo != "" {
+			header += "In-Reply-To: " + m.inReplyTo + "\r\n"
+		}
+		if m.references != "" {
+			header += "References: " + m.references + "\r\n"
+		}
+
+		bufBytes := []byte(header + "\r\nbody\r\n")
+		id, err := Store(&bufBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[m.name] = id
+	}
+
+	assertThread := func(name, expected string) {
+		thread, err := GetThread(ids[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subjects := []string{}
+		for _, m := range thread {
+			subjects = append(subjects, m.Subject)
+		}
+
+		assertEqual(t, strings.Join(subjects, ","), expected, "wrong thread for "+name)
+	}
+
+	for _, name := range []string{"a", "b", "c", "e"} {
+		assertThread(name, "a,b,c,e")
+	}
+	assertThread("unrelated", "unrelated")
+	assertThread("no-id-1", "no-id-1")
+
+	if _, err := GetThread("missing"); err != ErrMessageNotFound {
+		t.Fatal("expected ErrMessageNotFound")
+	}
+
+	t.Log("Broken chains")
+	if _, _, err := DeleteMessages([]string{ids["b"]}); err != nil {
+		t.Fatal(err)
+	}
+	assertThread("c", "a,c,e")
+
+	if _, _, err := DeleteMessages([]string{ids["a"]}); err != nil {
+		t.Fatal(err)
+	}
+	assertThread("c", "c,e")
+	assertThread("e", "c,e")
+
+	t.Log("Backfill references")
+	if _, err := db.Exec(`DELETE FROM ` + tenant("message_references")); err != nil {
+		t.Fatal(err)
+	}
+	assertThread("c", "c")
+
+	for _, name := range []string{"c", "e", "unrelated"} {
+		if err := backfillMessageReferences(ids[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertThread("c", "c,e")
+}
+
+func TestWaitForMessageCancelled(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing waiting for a message is cancelled when the database closes")
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := WaitForMessage(context.Background(), "from:nobody@example.com", "")
+		errs <- err
+	}()
+
+	// wait for the subscription
+	for i := 0; i < 50; i++ {
+		newMessageSubscribersMu.Lock()
+		n := len(newMessageSubscribers)
+		newMessageSubscribersMu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closeNewMessageSubscribers()
+
+	select {
+	case err := <-errs:
+		assertEqual(t, err, ErrWaitCancelled, "expected the wait to be cancelled")
+	case <-time.After(time.Second):
+		t.Error("waiting was not cancelled")
+	}
+}
+
+func TestMessageChecks(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing stored spam & HTML check scores")
+
+	htmlID, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	textID, err := Store(&testTextEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := GetMessagePeek(htmlID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := HTMLCheck(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := GetMessageSummary(htmlID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.HTMLScore == nil {
+		t.Fatal("expected an HTML score")
+	}
+	assertEqual(t, *summary.HTMLScore, float64(res.Total.Supported), "wrong HTML score")
+	assertEqual(t, summary.SpamScore == nil, true, "expected a null spam score")
+
+	// the stored result is returned without running the check again
+	if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET HTMLCheck = json_set(HTMLCheck, '$.Total.Tests', 12345) WHERE ID = ?`, htmlID); err != nil {
+		t.Fatal(err)
+	}
+	res, err = HTMLCheck(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Total.Tests, 12345, "expected the stored HTML check result")
+
+	// messages which have not been checked have null scores
+	summary, err = GetMessageSummary(textID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summary.HTMLScore == nil, true, "expected a null HTML score")
+
+	if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET SpamScore = 6.5 WHERE ID = ?`, htmlID); err != nil {
+		t.Fatal(err)
+	}
+
+	results, _, err := Search("spam-score:>5", "", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 1, "wrong number of spam-score:>5 results")
+	assertEqual(t, results[0].ID, htmlID, "wrong spam-score:>5 result")
+	assertEqual(t, *results[0].SpamScore, 6.5, "wrong spam score")
+
+	assertSearchCount(t, "spam-score:<=6.5", 1)
+	assertSearchCount(t, "spam-score:6.5", 1)
+	assertSearchCount(t, "spam-score:>7", 0)
+	assertSearchCount(t, "-spam-score:>5", 1)
+	assertSearchCount(t, "html-score:>=0", 1)
+
+	if _, _, err := Search("spam-score:high", "", 0, 10); err == nil {
+		t.Error("expected an error for an invalid score")
+	}
+}
+
+func TestListAttachments(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing listing attachments")
+
+	mimeID, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Store(&testTextEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	// an inline part without a file name
+	cid := []byte("From: sender@example.com\r\n" +
+		"Subject: Content-ID only\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo@example.com\">\r\n" +
+		"--b\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Disposition: inline\r\n\r\nPNG\r\n" +
+		"--b--\r\n")
+	cidID, err := Store(&cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attachments, total, err := ListAttachments("", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(3), "wrong total")
+	assertEqual(t, len(attachments), 3, "wrong number of attachments")
+
+	assertEqual(t, attachments[0].MessageID, cidID, "wrong message ID")
+	assertEqual(t, attachments[0].FileName, "logo@example.com", "expected the Content-ID as the file name")
+	assertEqual(t, attachments[0].From.Address, "sender@example.com", "wrong from address")
+
+	assertEqual(t, attachments[1].MessageID, mimeID, "wrong message ID")
+	assertEqual(t, attachments[1].FileName, "inline-image.jpg", "wrong file name")
+	assertEqual(t, attachments[2].FileName, "Sample PDF.pdf", "wrong file name")
+	assertEqual(t, attachments[2].Subject, "inline + attachment", "wrong subject")
+
+	// the listed part can be fetched
+	part, err := GetAttachmentPart(mimeID, attachments[2].PartID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, attachments[2].Size, float64(len(part.Content)), "wrong size")
+
+	attachments, total, err = ListAttachments("PDF", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(1), "wrong total")
+	assertEqual(t, attachments[0].ContentType, "application/pdf", "wrong content type")
+
+	attachments, total, err = ListAttachments("", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(3), "wrong total")
+	assertEqual(t, len(attachments), 1, "wrong number of attachments")
+	assertEqual(t, attachments[0].FileName, "inline-image.jpg", "wrong paginated attachment")
+
+	t.Log("Attachment part IDs migration")
+	if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET Metadata = json_set(Metadata, '$.Parts', json('[{"FileName":"Sample PDF.pdf","ContentType":"application/pdf"}]')) WHERE ID = ?`, mimeID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, total, err = ListAttachments("", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(1), "parts without part IDs should not be listed")
+
+	if err := backfillAttachmentPartIDs(mimeID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, total, err = ListAttachments("", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, float64(3), "part IDs not backfilled")
+}
+
+func TestAttachmentChecksum(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing attachment checksums")
+
+	id, err := Store(&testMimeEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partID := msg.Attachments[0].PartID
+
+	part, err := GetAttachmentPart(id, partID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := partChecksum(part.Content)
+	assertEqual(t, expected.SHA256, fmt.Sprintf("%x", sha256.Sum256(part.Content)), "wrong sha256")
+
+	checksum, err := GetAttachmentChecksum(id, partID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, checksum, expected, "wrong stored checksum")
+
+	// messages stored by older versions have no stored digests
+	if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET Metadata = json_remove(Metadata, '$.Parts') WHERE ID = ?`, id); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err = GetAttachmentChecksum(id, partID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, checksum, expected, "wrong calculated checksum")
+
+	if _, err := GetAttachmentChecksum(id, "99"); err == nil {
+		t.Error("expected error for missing part")
+	}
+
+	if _, err := GetAttachmentChecksum("missing", partID); err != ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+}
+
+func TestReleaseJobs(t *testing.T) {
+	setup()
+	defer Close()
+
+	id, err := Store(&testTextEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AddReleaseJob(ReleaseJob{MessageID: "missing", Due: time.Now(), To: []string{"user@example.com"}}); err != ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+
+	next, err := NextReleaseJobDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, next.IsZero(), true, "unexpected next due release")
+
+	later, err := AddReleaseJob(ReleaseJob{MessageID: id, Due: time.Now().Add(time.Hour), To: []string{"later@example.com"}, DeleteAfterRelease: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := AddReleaseJob(ReleaseJob{MessageID: id, Due: time.Now().Add(-time.Second), To: []string{"one@example.com", "two@example.com"}, From: "qa@example.com", Subject: "[TEST] Release"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := GetReleaseJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(jobs), 2, "incorrect number of release jobs")
+	assertEqual(t, jobs[0].ID, due.ID, "release jobs not ordered by due time")
+	assertEqual(t, strings.Join(jobs[0].To, ","), "one@example.com,two@example.com", "incorrect recipients")
+	assertEqual(t, jobs[0].From, "qa@example.com", "incorrect from")
+	assertEqual(t, jobs[0].Subject, "[TEST] Release", "incorrect subject")
+	assertEqual(t, jobs[1].DeleteAfterRelease, true, "incorrect delete after release")
+
+	jobs, err = DueReleaseJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(jobs), 1, "incorrect number of due release jobs")
+	assertEqual(t, jobs[0].ID, due.ID, "incorrect due release job")
+
+	// failed releases are kept, but are no longer due
+	if err := SetReleaseJobError(due.ID, "550 rejected"); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err = DueReleaseJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(jobs), 0, "failed release job is still due")
+
+	next, err = NextReleaseJobDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, next.UnixMilli(), later.Due.UnixMilli(), "incorrect next due release")
+
+	jobs, err = GetReleaseJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, jobs[0].Error, "550 rejected", "release job error not recorded")
+
+	if err := DeleteReleaseJob(due.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteReleaseJob(due.ID); err != ErrReleaseJobNotFound {
+		t.Errorf("expected ErrReleaseJobNotFound, got %v", err)
+	}
+}
+
+func TestReleaseHistory(t *testing.T) {
+	setup()
+	defer Close()
+
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	AddReleaseHistory(ids[0], []string{"one@example.com"}, "sender@example.com", "", "127.0.0.1")
+	AddReleaseHistory(ids[0], []string{"two@example.com"}, "sender@example.com", "550 rejected", "127.0.0.1")
+	AddReleaseHistory(ids[1], []string{"three@example.com"}, "sender@example.com", "", "")
+
+	if _, _, err := GetReleaseHistory("missing", 0, 50); err != ErrMessageNotFound {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+
+	history, total, err := GetReleaseHistory(ids[0], 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, 2, "incorrect release history total")
+	assertEqual(t, history[0].Success, false, "failed release not recorded")
+	assertEqual(t, history[0].Error, "550 rejected", "incorrect release error")
+	assertEqual(t, history[1].Success, true, "successful release not recorded")
+	assertEqual(t, strings.Join(history[1].To, ","), "one@example.com", "incorrect release recipients")
+	assertEqual(t, history[1].ClientIP, "127.0.0.1", "incorrect release client IP")
+
+	summary, err := GetMessageSummary(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summary.ReleaseCount, 1, "failed releases should not be counted")
+
+	history, total, err = GetReleaseHistory("", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, 3, "incorrect release history total")
+	assertEqual(t, len(history), 1, "release history not paginated")
+	assertEqual(t, history[0].MessageID, ids[0], "release history not ordered newest first")
+
+	// history is deleted with the message by default
+	if _, _, err := DeleteMessages(ids[1:]); err != nil {
+		t.Fatal(err)
+	}
+	_, total, err = GetReleaseHistory("", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, 2, "release history not deleted with the message")
+
+	config.SMTPRelayConfig.KeepReleaseHistory = true
+	defer func() { config.SMTPRelayConfig.KeepReleaseHistory = false }()
+
+	if _, _, err := DeleteMessages(ids[0:1]); err != nil {
+		t.Fatal(err)
+	}
+	history, total, err = GetReleaseHistory("", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, total, 2, "release history not kept")
+	assertEqual(t, history[0].Orphaned, true, "release history of a deleted message not orphaned")
 }
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/tools"
+	"github.com/leporo/sqlf"
+)
+
+const (
+	// MaxMetadataKeys is the maximum number of metadata keys per message
+	MaxMetadataKeys = 50
+	// MaxMetadataKeyLength is the maximum length of a metadata key
+	MaxMetadataKeyLength = 64
+	// MaxMetadataValueLength is the maximum length of a metadata value in bytes
+	MaxMetadataValueLength = 1024
+)
+
+var (
+	// ErrMessageNotFound is returned when a message does not exist
+	ErrMessageNotFound = errors.New("message not found")
+
+	metadataKeyRe = regexp.MustCompile(`^[a-zA-Z0-9_\.\-]+$`)
+)
+
+// ValidMetadataKey returns whether a metadata key is valid
+func ValidMetadataKey(k string) bool {
+	return len(k) <= MaxMetadataKeyLength && metadataKeyRe.MatchString(k)
+}
+
+// ValidateMetadata returns an error if the metadata exceeds the key or value limits
+func validateMetadata(meta map[string]string) error {
+	if len(meta) > MaxMetadataKeys {
+		return fmt.Errorf("too many metadata keys (%d), the maximum is %d", len(meta), MaxMetadataKeys)
+	}
+
+	for k, v := range meta {
+		if !ValidMetadataKey(k) {
+			return fmt.Errorf("invalid metadata key \"%s\", keys may contain up to %d letters, numbers, dots, dashes & underscores", k, MaxMetadataKeyLength)
+		}
+		if len(v) > MaxMetadataValueLength {
+			return fmt.Errorf("metadata value for \"%s\" exceeds %d bytes", k, MaxMetadataValueLength)
+		}
+	}
+
+	return nil
+}
+
+// SetMessageMetadata sets the metadata of a message and returns the resulting metadata.
+// If replace is false then the metadata is merged with the existing metadata, and keys with empty values are removed.
+// ErrMessageNotFound is returned if the message does not exist.
+func SetMessageMetadata(id string, meta map[string]string, replace bool) (map[string]string, error) {
+	var metadata string
+
+	if err := sqlf.From(tenant("mailbox")).
+		Select(`Metadata`).To(&metadata).
+		Where(`ID = ?`, id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	summary := DBMailSummary{}
+	if err := json.Unmarshal([]byte(metadata), &summary); err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+	if !replace {
+		for k, v := range summary.Metadata {
+			result[k] = v
+		}
+	}
+
+	for k, v := range meta {
+		if v == "" && !replace {
+			delete(result, k)
+			continue
+		}
+		result[k] = v
+	}
+
+	if err := validateMetadata(result); err != nil {
+		return nil, err
+	}
+
+	summary.Metadata = result
+
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := sqlf.Update(tenant("mailbox")).
+		Set(`Metadata`, string(b)).
+		Where(`ID = ?`, id).
+		ExecAndClose(context.TODO(), db); err != nil {
+		return nil, err
+	}
+
+	dbLastAction = time.Now()
+
+	return result, nil
+}
+
+// HarvestMetadataHeaders returns the message without any metadata headers matching config.MetadataHeaderPrefix,
+// and the metadata from those headers. Keys are the lowercase header name without the prefix,
+// eg: `X-Mailpit-Meta-Build: 123` is stored as `build: 123`. Invalid keys & values are ignored.
+func harvestMetadataHeaders(body []byte) ([]byte, map[string]string) {
+	meta := map[string]string{}
+
+	if config.MetadataHeaderPrefix == "" {
+		return body, meta
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return body, meta
+	}
+
+	prefix := strings.ToLower(config.MetadataHeaderPrefix)
+	headers := []string{}
+
+	for h, values := range msg.Header {
+		if !strings.HasPrefix(strings.ToLower(h), prefix) || len(h) == len(prefix) {
+			continue
+		}
+
+		headers = append(headers, h)
+		k := strings.ToLower(h[len(prefix):])
+		v := strings.TrimSpace(values[0])
+
+		if !ValidMetadataKey(k) || len(v) > MaxMetadataValueLength {
+			logger.Log().Warnf("[db] ignoring invalid metadata header %s", h)
+			continue
+		}
+
+		meta[k] = v
+	}
+
+	if len(meta) > MaxMetadataKeys {
+		logger.Log().Warnf("[db] ignoring metadata headers, too many keys (%d)", len(meta))
+		meta = map[string]string{}
+	}
+
+	if len(headers) > 0 {
+		sort.Strings(headers)
+		if stripped, err := tools.RemoveMessageHeaders(body, headers); err == nil {
+			body = stripped
+		} else {
+			logger.Log().Warnf("[db] error removing metadata headers: %s", err.Error())
+		}
+	}
+
+	return body, meta
+}
@@ -1,16 +1,28 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/server/websockets"
 )
 
-var bcStatsDelay = false
+var (
+	bcStatsDelay = false
+
+	// NewMessageSubscribers are notified when a message is stored, see WaitForMessage()
+	newMessageSubscribers   = map[chan struct{}]bool{}
+	newMessageSubscribersMu sync.Mutex
+
+	// ErrWaitCancelled is returned when waiting for a message is cancelled by the database closing
+	ErrWaitCancelled = errors.New("database is closing")
+)
 
 // BroadcastMailboxStats broadcasts the total number of messages
-// displayed to the web UI, as well as the total unread messages.
+// displayed to the web UI, as well as the total unread messages & all tags.
 // The lookup is very fast (< 10ms / 100k messages under load).
 // Rate limited to 4x per second.
 func BroadcastMailboxStats() {
@@ -26,13 +38,94 @@ func BroadcastMailboxStats() {
 		b := struct {
 			Total   float64
 			Unread  float64
+			Pinned  float64
+			Tags    []string
 			Version string
 		}{
 			Total:   CountTotal(),
 			Unread:  CountUnread(),
+			Pinned:  CountPinned(),
+			Tags:    GetAllTags(),
 			Version: config.Version,
 		}
 
 		websockets.Broadcast("stats", b)
 	}()
 }
+
+// WaitForMessage returns the latest message matching a search (all messages if the search is empty),
+// waiting for a matching message to be stored if none exist. The search is only repeated when a new
+// message is stored. Returns nil if the context is done before a matching message is stored.
+func WaitForMessage(ctx context.Context, search, timezone string) (*MessageSummary, error) {
+	// subscribe before searching so a message stored in between is not missed
+	ch := subscribeNewMessages()
+	defer unsubscribeNewMessages(ch)
+
+	for {
+		id, _, err := LatestMessage(search, timezone)
+		if err == nil {
+			m, err := GetMessageSummary(id)
+			if err == nil {
+				return &m, nil
+			}
+			// the message may have been deleted since the search
+			if err != ErrMessageNotFound {
+				return nil, err
+			}
+		} else if err != ErrMessageNotFound {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case _, ok := <-ch:
+			if !ok {
+				return nil, ErrWaitCancelled
+			}
+		}
+	}
+}
+
+// Subscribe to new message notifications
+func subscribeNewMessages() chan struct{} {
+	// buffered so notifications are never blocked, multiple notifications while busy are merged
+	ch := make(chan struct{}, 1)
+
+	newMessageSubscribersMu.Lock()
+	newMessageSubscribers[ch] = true
+	newMessageSubscribersMu.Unlock()
+
+	return ch
+}
+
+// Unsubscribe from new message notifications
+func unsubscribeNewMessages(ch chan struct{}) {
+	newMessageSubscribersMu.Lock()
+	delete(newMessageSubscribers, ch)
+	newMessageSubscribersMu.Unlock()
+}
+
+// Notify all subscribers that a new message was stored
+func notifyNewMessage() {
+	newMessageSubscribersMu.Lock()
+	defer newMessageSubscribersMu.Unlock()
+
+	for ch := range newMessageSubscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Cancel all subscribers, used when the database is closed
+func closeNewMessageSubscribers() {
+	newMessageSubscribersMu.Lock()
+	defer newMessageSubscribersMu.Unlock()
+
+	for ch := range newMessageSubscribers {
+		close(ch)
+		delete(newMessageSubscribers, ch)
+	}
+}
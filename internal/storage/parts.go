@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// GetMessagePartTree returns the MIME part tree of a message, along with any warnings encountered
+// while parsing it (eg: malformed headers or boundaries). Parts are returned as far as they can be
+// recovered, rather than failing on the first error.
+func GetMessagePartTree(id string) (MessagePart, []string, error) {
+	warnings := []string{}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return MessagePart{}, warnings, err
+	}
+
+	root, err := enmime.ReadParts(bytes.NewReader(raw))
+	if err != nil {
+		// the message headers could not be parsed, so there is no tree to return
+		warnings = append(warnings, err.Error())
+		return MessagePart{PartID: "0", Children: []MessagePart{}}, warnings, nil
+	}
+
+	var build func(p *enmime.Part) MessagePart
+	build = func(p *enmime.Part) MessagePart {
+		for _, e := range p.Errors {
+			warnings = append(warnings, fmt.Sprintf("part %s: %s", p.PartID, e.Error()))
+		}
+
+		part := MessagePart{
+			PartID:           p.PartID,
+			ContentType:      p.ContentType,
+			Charset:          p.Charset,
+			TransferEncoding: strings.ToLower(p.Header.Get("Content-Transfer-Encoding")),
+			Disposition:      p.Disposition,
+			FileName:         p.FileName,
+			ContentID:        p.ContentID,
+			Size:             float64(len(p.Content)),
+			Children:         []MessagePart{},
+		}
+
+		for c := p.FirstChild; c != nil; c = c.NextSibling {
+			part.Children = append(part.Children, build(c))
+		}
+
+		return part
+	}
+
+	return build(root), warnings, nil
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/webhook"
+	"github.com/axllent/mailpit/server/websockets"
+	"github.com/leporo/sqlf"
+)
+
+// SetPinned pins or unpins a message. Pinned messages are skipped when deleting all messages,
+// deleting by search & pruning, unless forced.
+func SetPinned(id string, pinned bool) error {
+	var n int
+	if err := sqlf.From(tenant("mailbox")).
+		Select("COUNT(*)").To(&n).
+		Where("ID = ?", id).
+		Where("Deleted = 0").
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrMessageNotFound
+	}
+
+	v := 0
+	if pinned {
+		v = 1
+	}
+
+	if _, err := sqlf.Update(tenant("mailbox")).
+		Set("Pinned", v).
+		Where("ID = ?", id).
+		ExecAndClose(context.TODO(), db); err != nil {
+		return err
+	}
+
+	dbLastAction = time.Now()
+
+	BroadcastMailboxStats()
+
+	return nil
+}
+
+// CountPinned returns the number of pinned messages in the database, excluding trashed messages
+func CountPinned() float64 {
+	var total float64
+
+	_ = sqlf.From(tenant("mailbox")).
+		Select("COUNT(*)").To(&total).
+		Where("Pinned = 1").
+		Where("Deleted = 0").
+		QueryRowAndClose(context.TODO(), db)
+
+	return total
+}
+
+// DeleteUnpinnedMessages permanently deletes all messages which are not pinned, returning the number of deleted messages
+func deleteUnpinnedMessages() (int, error) {
+	start := time.Now()
+
+	ids := []string{}
+	var totalSize float64
+
+	if err := sqlf.From(tenant("mailbox")).
+		Select("ID, Size").
+		Where("Pinned = 0").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var id string
+			var size float64
+			if err := row.Scan(&id, &size); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+			ids = append(ids, id)
+			totalSize = totalSize + size
+		}); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	unpinned := `SELECT ID FROM ` + tenant("mailbox") + ` WHERE Pinned = 0` // #nosec
+
+	for _, t := range withReleaseHistory([]string{"mailbox_data", "message_tags", "message_events", "message_references"}) {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE ID IN (%s)`, tenant(t), unpinned)); err != nil { // #nosec
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM ` + tenant("mailbox") + ` WHERE Pinned = 0`); err != nil { // #nosec
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if err := pruneUnusedTags(); err != nil {
+		return 0, err
+	}
+
+	addDeletedSize(int64(totalSize))
+
+	logMessagesDeleted(len(ids))
+
+	logger.Log().Debugf("[db] deleted %d unpinned messages in %s", len(ids), time.Since(start))
+
+	dbLastAction = time.Now()
+
+	webhook.Dispatch(webhook.MessageDeleted, webhook.DeletedData{IDs: ids, Count: len(ids)})
+
+	websockets.Broadcast("prune", nil)
+	BroadcastMailboxStats()
+
+	return len(ids), nil
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+)
+
+// ProfileVersion is the format version of exported profiles
+const ProfileVersion = 1
+
+// Profile is a portable export of the non-message configuration stored in the database,
+// which can be imported into another Mailpit instance
+//
+// swagger:model Profile
+type Profile struct {
+	// Profile format version
+	Version int
+	// Runtime setting overrides, see `GET /api/v1/settings`
+	Settings map[string]interface{}
+	// Tag colors & descriptions
+	TagMeta []TagMeta
+	// Tag rules, in the order they are applied
+	TagRules []ProfileTagRule
+	// Forwarding rules
+	ForwardRules []ProfileForwardRule
+}
+
+// ProfileTagRule is a tag rule within a profile
+//
+// swagger:model ProfileTagRule
+type ProfileTagRule struct {
+	// Search query, see https://mailpit.axllent.org/docs/usage/search-filters/
+	Query string
+	// Tags added to matching messages
+	Tags []string
+}
+
+// ProfileForwardRule is a forwarding rule within a profile, the forwarded count is not included
+//
+// swagger:model ProfileForwardRule
+type ProfileForwardRule struct {
+	// Search query, see https://mailpit.axllent.org/docs/usage/search-filters/
+	Query string
+	// Recipients matching messages are forwarded to
+	To []string
+	// Relay profile matching messages are forwarded via, empty for the main relay config
+	Profile string
+}
+
+// ProfileSectionResult is the result of importing a single profile section
+//
+// swagger:model ProfileSectionResult
+type ProfileSectionResult struct {
+	// Section name
+	Section string
+	// Number of items applied
+	Applied int
+	// Error if the section was not applied
+	Error string `json:",omitempty"`
+}
+
+// runtimeSettingDefaults are the runtime setting values set at startup, before any
+// overrides were restored, used to reset settings which are no longer overridden
+var runtimeSettingDefaults = map[string]interface{}{}
+
+// ExportProfile returns the non-message configuration stored in the database
+func ExportProfile() (Profile, error) {
+	p := Profile{
+		Version:      ProfileVersion,
+		Settings:     runtimeSettingOverrides(),
+		TagRules:     []ProfileTagRule{},
+		ForwardRules: []ProfileForwardRule{},
+	}
+
+	var err error
+	if p.TagMeta, err = GetTagMeta(); err != nil {
+		return p, err
+	}
+
+	tagRules, err := GetTagRules()
+	if err != nil {
+		return p, err
+	}
+	for _, r := range tagRules {
+		p.TagRules = append(p.TagRules, ProfileTagRule{Query: r.Query, Tags: r.Tags})
+	}
+
+	forwardRules, err := GetForwardRules()
+	if err != nil {
+		return p, err
+	}
+	for _, r := range forwardRules {
+		p.ForwardRules = append(p.ForwardRules, ProfileForwardRule{Query: r.Query, To: r.To, Profile: r.Profile})
+	}
+
+	return p, nil
+}
+
+// ImportProfile applies an exported profile. Each section is validated and applied individually,
+// either completely or not at all. In replace mode any existing configuration not contained in
+// the section is removed, otherwise the section is merged with the existing configuration.
+// Importing the same profile more than once has no further effect.
+func ImportProfile(sections map[string]json.RawMessage, replace bool) ([]ProfileSectionResult, error) {
+	var version int
+	if v, ok := sections["Version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, fmt.Errorf("invalid profile version: %s", err.Error())
+		}
+	}
+
+	if version < 1 || version > ProfileVersion {
+		return nil, fmt.Errorf("unsupported profile version: %d", version)
+	}
+
+	names := []string{}
+	for k := range sections {
+		if k != "Version" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	results := []ProfileSectionResult{}
+
+	for _, name := range names {
+		r := ProfileSectionResult{Section: name}
+		var err error
+
+		switch name {
+		case "Settings":
+			r.Applied, err = importProfileSettings(sections[name], replace)
+		case "TagMeta":
+			r.Applied, err = importProfileTagMeta(sections[name], replace)
+		case "TagRules":
+			r.Applied, err = importProfileTagRules(sections[name], replace)
+		case "ForwardRules":
+			r.Applied, err = importProfileForwardRules(sections[name], replace)
+		default:
+			err = errors.New("unknown section")
+		}
+
+		if err != nil {
+			r.Error = err.Error()
+		}
+
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// Import the runtime setting overrides of a profile
+func importProfileSettings(data json.RawMessage, replace bool) (int, error) {
+	settings := map[string]interface{}{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return 0, err
+	}
+
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+
+	overrides := runtimeSettingOverrides()
+	changes := map[string]interface{}{}
+
+	if replace {
+		// reset the settings which are currently overridden to their startup values
+		for k := range overrides {
+			if _, ok := settings[k]; !ok {
+				if v, ok := runtimeSettingDefaults[k]; ok {
+					changes[k] = v
+				}
+			}
+		}
+		overrides = map[string]interface{}{}
+	}
+
+	for k, v := range settings {
+		changes[k] = v
+		overrides[k] = v
+	}
+
+	if len(changes) > 0 {
+		if err := config.ApplyRuntimeSettings(changes); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(settings), putRuntimeSettingOverrides(overrides)
+}
+
+// Import the tag metadata of a profile, replacing the metadata of existing tags
+func importProfileTagMeta(data json.RawMessage, replace bool) (int, error) {
+	items := []TagMeta{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return 0, err
+	}
+
+	meta := []TagMeta{}
+	for _, item := range items {
+		m, err := validateTagMeta(item.Tag, item.Color, item.Description)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", item.Tag, err.Error())
+		}
+		meta = append(meta, m)
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM ` + tenant("tag_meta")); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, m := range meta {
+		if m.Color == "" && m.Description == "" {
+			if _, err := tx.Exec(`DELETE FROM `+tenant("tag_meta")+` WHERE Tag = ?`, m.Tag); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if _, err := tx.Exec(`INSERT INTO `+tenant("tag_meta")+` (Tag, Color, Description) VALUES (?, ?, ?)
+			ON CONFLICT(Tag) DO UPDATE SET Tag = ?, Color = ?, Description = ?`,
+			m.Tag, m.Color, m.Description, m.Tag, m.Color, m.Description); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(meta), tx.Commit()
+}
+
+// Import the tag rules of a profile. Rules identical to an existing rule are not added again.
+func importProfileTagRules(data json.RawMessage, replace bool) (int, error) {
+	items := []ProfileTagRule{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return 0, err
+	}
+
+	rules := []TagRule{}
+	for i, item := range items {
+		r, err := validateTagRule(item.Query, item.Tags)
+		if err != nil {
+			return 0, fmt.Errorf("rule %d: %s", i, err.Error())
+		}
+		rules = append(rules, r)
+	}
+
+	existing := map[string]bool{}
+	if !replace {
+		current, err := GetTagRules()
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range current {
+			existing[r.Query+"\x00"+strings.Join(r.Tags, ",")] = true
+		}
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM ` + tenant("tag_rules")); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, r := range rules {
+		key := r.Query + "\x00" + strings.Join(r.Tags, ",")
+		if existing[key] {
+			continue
+		}
+		existing[key] = true
+
+		b, err := json.Marshal(r.Tags)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := tx.Exec(`INSERT INTO `+tenant("tag_rules")+` (Query, Tags) VALUES (?, ?)`, r.Query, string(b)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rules), tx.Commit()
+}
+
+// Import the forwarding rules of a profile. Rules identical to an existing rule are not added again.
+func importProfileForwardRules(data json.RawMessage, replace bool) (int, error) {
+	items := []ProfileForwardRule{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return 0, err
+	}
+
+	rules := []ForwardRule{}
+	for i, item := range items {
+		r, err := validateForwardRule(ForwardRule{Query: item.Query, To: item.To, Profile: item.Profile})
+		if err != nil {
+			return 0, fmt.Errorf("rule %d: %s", i, err.Error())
+		}
+		rules = append(rules, r)
+	}
+
+	existing := map[string]bool{}
+	if !replace {
+		current, err := GetForwardRules()
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range current {
+			existing[r.Query+"\x00"+strings.Join(r.To, ",")+"\x00"+r.Profile] = true
+		}
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM ` + tenant("forward_rules")); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, r := range rules {
+		key := r.Query + "\x00" + strings.Join(r.To, ",") + "\x00" + r.Profile
+		if existing[key] {
+			continue
+		}
+		existing[key] = true
+
+		b, err := json.Marshal(r.To)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := tx.Exec(`INSERT INTO `+tenant("forward_rules")+` (Query, Recipients, Profile) VALUES (?, ?, ?)`, r.Query, string(b), r.Profile); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rules), tx.Commit()
+}
@@ -9,8 +9,8 @@ import (
 	"net/mail"
 	"os"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
-	"github.com/axllent/mailpit/internal/tools"
 	"github.com/jhillyerd/enmime"
 	"github.com/leporo/sqlf"
 )
@@ -75,14 +75,22 @@ func ReindexAll() {
 				from = &mail.Address{Name: env.GetHeader("From")}
 			}
 
-			obj := DBMailSummary{
-				From:    from,
-				To:      addressToSlice(env, "To"),
-				Cc:      addressToSlice(env, "Cc"),
-				Bcc:     addressToSlice(env, "Bcc"),
-				ReplyTo: addressToSlice(env, "Reply-To"),
+			// retain values which are not derived from the message itself
+			obj := DBMailSummary{}
+			var metadata string
+			if err := sqlf.From(tenant("mailbox")).Select("Metadata").To(&metadata).Where("ID = ?", id).
+				QueryRowAndClose(context.TODO(), db); err == nil {
+				_ = json.Unmarshal([]byte(metadata), &obj)
 			}
 
+			obj.From = from
+			obj.To = addressToSlice(env, "To")
+			obj.Cc = addressToSlice(env, "Cc")
+			obj.Bcc = addressToSlice(env, "Bcc")
+			obj.ReplyTo = addressToSlice(env, "Reply-To")
+			obj.AttachmentsSize = attachmentsSize(env)
+			obj.Parts = messageParts(env)
+
 			MetadataJSON, err := json.Marshal(obj)
 			if err != nil {
 				logger.Log().Errorf("[message] %s", err.Error())
@@ -90,7 +98,10 @@ func ReindexAll() {
 			}
 
 			searchText := createSearchText(env)
-			snippet := tools.CreateSnippet(env.Text, env.HTML)
+			snippet := ""
+			if !config.DisableBodyIndex {
+				snippet = createSnippet(env)
+			}
 
 			u := updateStruct{}
 			u.ID = id
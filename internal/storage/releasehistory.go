@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// AddReleaseHistory records a release attempt of a message, incrementing the release count of the
+// message if it was successful (errMsg is empty). Errors are logged only as the history is informational.
+func AddReleaseHistory(id string, to []string, mailFrom, errMsg, clientIP string) {
+	if db == nil {
+		return
+	}
+
+	b, err := json.Marshal(to)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO `+tenant("release_history")+` (ID, Created, Recipients, MailFrom, Error, ClientIP) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, time.Now().UnixMilli(), string(b), mailFrom, errMsg, clientIP); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	if errMsg == "" {
+		if _, err := tx.Exec(`UPDATE `+tenant("mailbox")+` SET ReleaseCount = ReleaseCount + 1 WHERE ID = ?`, id); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+		return
+	}
+
+	dbLastAction = time.Now()
+}
+
+// GetReleaseHistory returns the release attempts of a message, newest first, along with the total number
+// of attempts. If id is empty then the release attempts of all messages are returned, including those of
+// deleted messages if the release history is kept (see `keep-release-history` in the relay config).
+// ErrMessageNotFound is returned if the message does not exist.
+func GetReleaseHistory(id string, start, limit int) ([]ReleaseHistory, int, error) {
+	history := []ReleaseHistory{}
+	var total int
+
+	q := sqlf.From(tenant("release_history") + " h").
+		Select(`h.Key, h.ID, h.Created, h.Recipients, h.MailFrom, h.Error, h.ClientIP,
+			EXISTS (SELECT 1 FROM ` + tenant("mailbox") + ` m WHERE m.ID = h.ID) AS MessageExists`).
+		OrderBy("h.Key DESC")
+
+	countQ := sqlf.From(tenant("release_history")).Select("COUNT(*)").To(&total)
+
+	if id != "" {
+		var exists int
+		if err := sqlf.From(tenant("mailbox")).
+			Select("COUNT(*)").To(&exists).
+			Where("ID = ?", id).
+			QueryRowAndClose(context.TODO(), db); err != nil {
+			return history, 0, err
+		}
+
+		if exists == 0 {
+			return history, 0, ErrMessageNotFound
+		}
+
+		q.Where("h.ID = ?", id)
+		countQ.Where("ID = ?", id)
+	}
+
+	if err := countQ.QueryRowAndClose(context.TODO(), db); err != nil {
+		return history, 0, err
+	}
+
+	if limit > 0 {
+		q.Limit(limit).Offset(start)
+	}
+
+	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		var h ReleaseHistory
+		var created int64
+		var to string
+		var exists int
+
+		if err := row.Scan(&h.ID, &h.MessageID, &created, &to, &h.MailFrom, &h.Error, &h.ClientIP, &exists); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		if err := json.Unmarshal([]byte(to), &h.To); err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+		}
+
+		h.Created = time.UnixMilli(created)
+		h.Success = h.Error == ""
+		h.Orphaned = exists == 0
+
+		history = append(history, h)
+	}); err != nil {
+		return history, total, err
+	}
+
+	return history, total, nil
+}
+
+// WithReleaseHistory appends the release history to the tables deleted along with messages,
+// unless the release history is kept after messages are deleted
+func withReleaseHistory(tables []string) []string {
+	if config.SMTPRelayConfig.KeepReleaseHistory {
+		return tables
+	}
+
+	return append(tables, "release_history")
+}
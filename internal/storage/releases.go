@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// ErrReleaseJobNotFound is returned when a scheduled release does not exist
+var ErrReleaseJobNotFound = errors.New("release job not found")
+
+// AddReleaseJob schedules the release of a message, returning the stored job with its ID & created time set.
+// ErrMessageNotFound is returned if the message does not exist.
+func AddReleaseJob(job ReleaseJob) (ReleaseJob, error) {
+	job.ID = shortuuid.New()
+	job.Created = time.Now()
+
+	var n int
+	if err := sqlf.From(tenant("mailbox")).
+		Select("COUNT(*)").To(&n).
+		Where("ID = ?", job.MessageID).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return job, err
+	}
+
+	if n == 0 {
+		return job, ErrMessageNotFound
+	}
+
+	b, err := json.Marshal(job.To)
+	if err != nil {
+		return job, err
+	}
+
+	deleteAfter := 0
+	if job.DeleteAfterRelease {
+		deleteAfter = 1
+	}
+
+	if _, err := db.Exec(`INSERT INTO `+tenant("release_jobs")+` (ID, MessageID, Created, Due, Recipients, FromAddress, Subject, Profile, DeleteAfterRelease) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.ID, job.MessageID, job.Created.UnixMilli(), job.Due.UnixMilli(), string(b), job.From, job.Subject, job.Profile, deleteAfter); err != nil {
+		return job, err
+	}
+
+	return job, nil
+}
+
+// GetReleaseJobs returns all scheduled releases which have not been sent, including failed releases, ordered by due time
+func GetReleaseJobs() ([]ReleaseJob, error) {
+	return releaseJobs(sqlf.From(tenant("release_jobs")))
+}
+
+// DueReleaseJobs returns the scheduled releases which are due, excluding failed releases
+func DueReleaseJobs() ([]ReleaseJob, error) {
+	return releaseJobs(sqlf.From(tenant("release_jobs")).
+		Where("Due <= ?", time.Now().UnixMilli()).
+		Where("Error = ''"))
+}
+
+// NextReleaseJobDue returns the due time of the next scheduled release, or a zero time if none are scheduled
+func NextReleaseJobDue() (time.Time, error) {
+	var due sql.NullInt64
+
+	if err := sqlf.From(tenant("release_jobs")).
+		Select("MIN(Due)").To(&due).
+		Where("Error = ''").
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return time.Time{}, err
+	}
+
+	if !due.Valid {
+		return time.Time{}, nil
+	}
+
+	return time.UnixMilli(due.Int64), nil
+}
+
+// DeleteReleaseJob deletes a scheduled release, ErrReleaseJobNotFound is returned if the release does not exist
+func DeleteReleaseJob(id string) error {
+	res, err := db.Exec(`DELETE FROM `+tenant("release_jobs")+` WHERE ID = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrReleaseJobNotFound
+	}
+
+	return nil
+}
+
+// SetReleaseJobError records the error of a failed scheduled release, which is not retried
+func SetReleaseJobError(id, msg string) error {
+	if msg == "" {
+		msg = "unknown error"
+	}
+
+	_, err := db.Exec(`UPDATE `+tenant("release_jobs")+` SET Error = ? WHERE ID = ?`, msg, id)
+
+	return err
+}
+
+// ReleaseJobs returns the scheduled releases of a query, ordered by due time
+func releaseJobs(q *sqlf.Stmt) ([]ReleaseJob, error) {
+	jobs := []ReleaseJob{}
+
+	if err := q.Select("ID, MessageID, Created, Due, Recipients, FromAddress, Subject, Profile, DeleteAfterRelease, Error").
+		OrderBy("Due, Created").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var j ReleaseJob
+			var created, due int64
+			var to string
+			var deleteAfter int
+
+			if err := row.Scan(&j.ID, &j.MessageID, &created, &due, &to, &j.From, &j.Subject, &j.Profile, &deleteAfter, &j.Error); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			if err := json.Unmarshal([]byte(to), &j.To); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			j.Created = time.UnixMilli(created)
+			j.Due = time.UnixMilli(due)
+			j.DeleteAfterRelease = deleteAfter == 1
+
+			jobs = append(jobs, j)
+		}); err != nil {
+		return jobs, err
+	}
+
+	return jobs, nil
+}
@@ -161,6 +161,101 @@ func dataMigrations() {
 	}
 
 	migrateTagsToManyMany()
+
+	if SettingGet("TagsNormalised") == "" {
+		if err := migrateNormaliseTags(); err != nil {
+			logger.Log().Errorf("[migration] %s", err.Error())
+		} else {
+			_ = SettingPut("TagsNormalised", "1")
+		}
+	}
+
+	initBackfills()
+}
+
+// Merge existing tags which normalise to the same value, retaining the first-seen tag.
+// Migration task implemented 10/2026
+func migrateNormaliseTags() error {
+	type tag struct {
+		ID   int
+		Name string
+	}
+
+	// tags grouped by their case-insensitive normalised name, in order of creation
+	groups := make(map[string][]tag)
+	keys := []string{}
+
+	if err := sqlf.From(tenant("tags")).
+		Select("ID, Name").
+		OrderBy("ID").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var t tag
+			if err := row.Scan(&t.ID, &t.Name); err != nil {
+				logger.Log().Errorf("[migration] %s", err.Error())
+				return
+			}
+
+			k := strings.ToLower(NormaliseTag(t.Name))
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], t)
+		}); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	for _, k := range keys {
+		tags := groups[k]
+		keep := tags[0]
+		name := NormaliseTag(keep.Name)
+
+		if len(tags) == 1 && name == keep.Name {
+			continue
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range tags[1:] {
+			logger.Log().Debugf("[migration] merging tag \"%s\" into \"%s\"", t.Name, name)
+
+			if _, err := tx.Exec(`UPDATE `+tenant("message_tags")+` SET TagID = ? WHERE TagID = ?`, keep.ID, t.ID); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+
+			if _, err := tx.Exec(`DELETE FROM `+tenant("tags")+` WHERE ID = ?`, t.ID); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+
+		// remove messages tagged more than once with the merged tag
+		if _, err := tx.Exec(`DELETE FROM `+tenant("message_tags")+` WHERE TagID = ? AND Key NOT IN
+			(SELECT MIN(Key) FROM `+tenant("message_tags")+` WHERE TagID = ? GROUP BY ID)`, keep.ID, keep.ID); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if name != keep.Name {
+			if _, err := tx.Exec(`UPDATE `+tenant("tags")+` SET Name = ? WHERE ID = ?`, name, keep.ID); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		logger.Log().Infof("[migration] normalised tag \"%s\"", name)
+	}
+
+	return nil
 }
 
 // Migrate tags to ManyMany structure
@@ -197,7 +292,7 @@ func migrateTagsToManyMany() {
 	if len(toConvert) > 0 {
 		logger.Log().Infof("[migration] converting %d message tags", len(toConvert))
 		for id, tags := range toConvert {
-			if err := SetMessageTags(id, tags); err != nil {
+			if _, err := setMessageTags(id, tags); err != nil {
 				logger.Log().Errorf("[migration] %s", err.Error())
 			} else {
 				if _, err := sqlf.Update(tenant("mailbox")).
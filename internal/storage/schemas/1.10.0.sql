@@ -0,0 +1,7 @@
+-- CREATE SPAM & HTML CHECK COLUMNS
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN SpamScore REAL NULL;
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN SpamCheck TEXT NULL;
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN HTMLScore REAL NULL;
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN HTMLCheck TEXT NULL;
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_spam_score" }} ON {{ tenant "mailbox" }} (SpamScore);
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_html_score" }} ON {{ tenant "mailbox" }} (HTMLScore);
@@ -0,0 +1,5 @@
+-- CREATE SMTP ENVELOPE COLUMNS
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN EnvelopeFrom TEXT NULL;
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN EnvelopeTo TEXT NULL;
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN ClientIP TEXT NULL;
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN Helo TEXT NULL;
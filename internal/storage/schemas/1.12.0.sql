@@ -0,0 +1,6 @@
+-- CREATE TAG RULES TABLE
+CREATE TABLE IF NOT EXISTS {{ tenant "tag_rules" }} (
+	ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	Query TEXT NOT NULL,
+	Tags TEXT NOT NULL DEFAULT '[]'
+);
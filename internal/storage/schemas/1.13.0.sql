@@ -0,0 +1,6 @@
+-- CREATE TAG METADATA TABLE
+CREATE TABLE IF NOT EXISTS {{ tenant "tag_meta" }} (
+	Tag TEXT COLLATE NOCASE NOT NULL PRIMARY KEY,
+	Color TEXT NOT NULL DEFAULT '',
+	Description TEXT NOT NULL DEFAULT ''
+);
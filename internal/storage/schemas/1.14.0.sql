@@ -0,0 +1,3 @@
+-- CREATE TRASH COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN Deleted INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_deleted" }} ON {{ tenant "mailbox" }} (Deleted);
@@ -0,0 +1,3 @@
+-- CREATE PINNED COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN Pinned INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_pinned" }} ON {{ tenant "mailbox" }} (Pinned);
@@ -0,0 +1,3 @@
+-- CREATE EXPIRES COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN Expires INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_expires" }} ON {{ tenant "mailbox" }} (Expires);
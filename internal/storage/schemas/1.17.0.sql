@@ -0,0 +1,3 @@
+-- CREATE STARRED COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN Starred INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_starred" }} ON {{ tenant "mailbox" }} (Starred);
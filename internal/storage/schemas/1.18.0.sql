@@ -0,0 +1,12 @@
+-- CREATE SCHEDULED RELEASES TABLE
+CREATE TABLE IF NOT EXISTS {{ tenant "release_jobs" }} (
+	ID TEXT NOT NULL PRIMARY KEY,
+	MessageID TEXT NOT NULL,
+	Created INTEGER NOT NULL,
+	Due INTEGER NOT NULL,
+	Recipients TEXT NOT NULL DEFAULT '[]',
+	FromAddress TEXT NOT NULL DEFAULT '',
+	DeleteAfterRelease INTEGER NOT NULL DEFAULT 0,
+	Error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_release_jobs_due" }} ON {{ tenant "release_jobs" }} (Due);
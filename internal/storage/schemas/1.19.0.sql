@@ -0,0 +1,14 @@
+-- CREATE RELEASE HISTORY TABLE
+CREATE TABLE IF NOT EXISTS {{ tenant "release_history" }} (
+	Key INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	ID TEXT NOT NULL,
+	Created INTEGER NOT NULL,
+	Recipients TEXT NOT NULL DEFAULT '[]',
+	MailFrom TEXT NOT NULL DEFAULT '',
+	Error TEXT NOT NULL DEFAULT '',
+	ClientIP TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_release_history_id" }} ON {{ tenant "release_history" }} (ID);
+
+-- CREATE RELEASE COUNT COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN ReleaseCount INTEGER NOT NULL DEFAULT 0;
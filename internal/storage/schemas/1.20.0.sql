@@ -0,0 +1,2 @@
+-- CREATE SCHEDULED RELEASE SUBJECT COLUMN
+ALTER TABLE {{ tenant "release_jobs" }} ADD COLUMN Subject TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- CREATE SCHEDULED RELEASE PROFILE COLUMN
+ALTER TABLE {{ tenant "release_jobs" }} ADD COLUMN Profile TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+-- CREATE FORWARDING RULES TABLE
+CREATE TABLE IF NOT EXISTS {{ tenant "forward_rules" }} (
+	ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	Query TEXT NOT NULL,
+	Recipients TEXT NOT NULL DEFAULT '[]',
+	Profile TEXT NOT NULL DEFAULT '',
+	Forwarded INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,2 @@
+-- CREATE SMTP AUTH USERNAME COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN AuthUser TEXT NULL;
@@ -0,0 +1,3 @@
+-- CREATE ATTACHMENTS PRUNED COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN AttachmentsPruned INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_attachments_pruned" }} ON {{ tenant "mailbox" }} (AttachmentsPruned);
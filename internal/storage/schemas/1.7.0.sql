@@ -0,0 +1,3 @@
+-- CREATE FIRST OPENED COLUMN
+ALTER TABLE {{ tenant "mailbox" }} ADD COLUMN FirstOpened INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_first_opened" }} ON {{ tenant "mailbox" }} (FirstOpened);
@@ -0,0 +1,10 @@
+-- CREATE MESSAGE EVENTS TABLE
+CREATE TABLE IF NOT EXISTS {{ tenant "message_events" }} (
+	Key INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	ID TEXT REFERENCES {{ tenant "mailbox" }} (ID),
+	Created INTEGER NOT NULL,
+	Type TEXT NOT NULL,
+	Details TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_message_events_id" }} ON {{ tenant "message_events" }} (ID);
@@ -0,0 +1,9 @@
+-- CREATE MESSAGE REFERENCES TABLE
+CREATE TABLE IF NOT EXISTS {{ tenant "message_references" }} (
+	Key INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	ID TEXT REFERENCES {{ tenant "mailbox" }} (ID),
+	Reference TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_message_references_id" }} ON {{ tenant "message_references" }} (ID);
+CREATE INDEX IF NOT EXISTS {{ tenant "idx_message_references_reference" }} ON {{ tenant "message_references" }} (Reference);
@@ -4,19 +4,23 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"regexp"
 	"strings"
 	"time"
+	"unicode"
 
-	"github.com/araddon/dateparse"
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
-	"github.com/axllent/mailpit/internal/tools"
+	"github.com/axllent/mailpit/server/webhook"
 	"github.com/leporo/sqlf"
+	"golang.org/x/net/idna"
 )
 
 // Search will search a mailbox for search terms.
 // The search is broken up by segments (exact phrases can be quoted), and interprets specific terms such as:
-// is:read, is:unread, has:attachment, to:<term>, from:<term> & subject:<term>
+// is:read, is:unread, is:pinned, is:starred, opened:yes, opened:no, has:attachment, meta:<key>=<value>, to:<term>, from:<term> & subject:<term>
 // Negative searches also also included by prefixing the search term with a `-` or `!`
 func Search(search, timezone string, start, limit int) ([]MessageSummary, int, error) {
 	results := []MessageSummary{}
@@ -27,8 +31,10 @@ func Search(search, timezone string, start, limit int) ([]MessageSummary, int, e
 		limit = 50
 	}
 
-	q := searchQueryBuilder(search, timezone)
-	var err error
+	q, err := searchQueryBuilder(search, timezone)
+	if err != nil {
+		return results, nrResults, err
+	}
 
 	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
 		var created float64
@@ -40,10 +46,13 @@ func Search(search, timezone string, start, limit int) ([]MessageSummary, int, e
 		var attachments int
 		var snippet string
 		var read int
+		var firstOpened float64
+		var spamScore, htmlScore sql.NullFloat64
+		var pinned, starred, releaseCount int
 		var ignore string
 		em := MessageSummary{}
 
-		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
+		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet, &firstOpened, &spamScore, &htmlScore, &pinned, &starred, &releaseCount, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
 			logger.Log().Errorf("[db] %s", err.Error())
 			return
 		}
@@ -61,6 +70,15 @@ func Search(search, timezone string, start, limit int) ([]MessageSummary, int, e
 		em.Attachments = attachments
 		em.Read = read == 1
 		em.Snippet = snippet
+		em.FirstOpened = firstOpenedTime(firstOpened)
+		em.SpamScore = nullFloat(spamScore)
+		em.HTMLScore = nullFloat(htmlScore)
+		em.Pinned = pinned == 1
+		em.Starred = starred == 1
+		em.ReleaseCount = releaseCount
+		if em.Metadata == nil {
+			em.Metadata = map[string]string{}
+		}
 
 		allResults = append(allResults, em)
 	}); err != nil {
@@ -92,12 +110,66 @@ func Search(search, timezone string, start, limit int) ([]MessageSummary, int, e
 	return results, nrResults, err
 }
 
-// DeleteSearch will delete all messages for search terms.
+// SearchDigest returns a digest of the messages matching a search, their mutable summary fields
+// (read status, tags, metadata, first opened, scores, pinned, starred & release count), the pagination
+// and the mailbox stats. It changes whenever the result of the same search would
+// change, and is significantly cheaper than the search itself as no message summaries are built.
+func SearchDigest(search, timezone string, start, limit int) (string, error) {
+	q, err := searchQueryBuilder(search, timezone)
+	if err != nil {
+		return "", err
+	}
+	defer q.Close()
+
+	query := `SELECT s.ID, s.Read, s.Metadata, s.FirstOpened, s.SpamScore, s.HTMLScore, s.Pinned, s.Starred, s.ReleaseCount,
+		IFNULL((SELECT GROUP_CONCAT(t.TagID) FROM ` + tenant("message_tags") + ` t WHERE t.ID = s.ID), '')
+		FROM (` + q.String() + `) s` // #nosec
+
+	rows, err := db.Query(query, q.Args()...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	h := fnv.New64a()
+	results := 0
+
+	for rows.Next() {
+		var id, metadata, tags string
+		var read, pinned, starred, releaseCount int
+		var firstOpened float64
+		var spamScore, htmlScore sql.NullFloat64
+		if err := rows.Scan(&id, &read, &metadata, &firstOpened, &spamScore, &htmlScore, &pinned, &starred, &releaseCount, &tags); err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s:%d:%s:%v:%v:%v:%d:%d:%d:%s\n", id, read, metadata, firstOpened, spamScore, htmlScore, pinned, starred, releaseCount, tags)
+		results++
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	stats := StatsGet()
+
+	fmt.Fprintf(h, "%d:%d:%d:%v:%v:%s", results, start, limit, stats.Total, stats.Unread, strings.Join(stats.Tags, ","))
+	fmt.Fprintf(h, ":%s", strings.Join(SearchPendingBackfills(search), ","))
+
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
+
+// DeleteSearch will delete all messages for search terms, returning the number of deleted messages.
 // The search is broken up by segments (exact phrases can be quoted), and interprets specific terms such as:
-// is:read, is:unread, has:attachment, to:<term>, from:<term> & subject:<term>
+// is:read, is:unread, is:pinned, is:starred, opened:yes, opened:no, has:attachment, meta:<key>=<value>, to:<term>, from:<term> & subject:<term>
 // Negative searches also also included by prefixing the search term with a `-` or `!`
-func DeleteSearch(search, timezone string) error {
-	q := searchQueryBuilder(search, timezone)
+// Pinned messages are skipped unless force is set.
+// If config.Trash is enabled then the messages are moved to the trash instead.
+func DeleteSearch(search, timezone string, force bool) (int, error) {
+	q, err := searchQueryBuilder(search, timezone)
+	if err != nil {
+		return 0, err
+	}
 
 	ids := []string{}
 	deleteSize := float64(0)
@@ -112,43 +184,43 @@ func DeleteSearch(search, timezone string) error {
 		var attachments int
 		var read int
 		var snippet string
+		var firstOpened float64
 		var ignore string
+		var ignoreScore sql.NullFloat64
+		var pinned, ignoreInt int
 
-		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
+		if err := row.Scan(&created, &id, &messageID, &subject, &metadata, &size, &attachments, &read, &snippet, &firstOpened, &ignoreScore, &ignoreScore, &pinned, &ignoreInt, &ignoreInt, &ignore, &ignore, &ignore, &ignore, &ignore); err != nil {
 			logger.Log().Errorf("[db] %s", err.Error())
 			return
 		}
 
+		if pinned == 1 && !force {
+			return
+		}
+
 		ids = append(ids, id)
 		deleteSize = deleteSize + size
 	}); err != nil {
-		return err
+		return 0, err
+	}
+
+	if len(ids) > 0 && config.Trash {
+		n, _, err := trashMessages(ids)
+		return n, err
 	}
 
 	if len(ids) > 0 {
 		total := len(ids)
+		deletedIDs := ids
 
 		// split ids into chunks of 1000 ids
-		var chunks [][]string
-		if total > 1000 {
-			chunkSize := 1000
-			chunks = make([][]string, 0, (len(ids)+chunkSize-1)/chunkSize)
-			for chunkSize < len(ids) {
-				ids, chunks = ids[chunkSize:], append(chunks, ids[0:chunkSize:chunkSize])
-			}
-			if len(ids) > 0 {
-				// add remaining ids <= 1000
-				chunks = append(chunks, ids)
-			}
-		} else {
-			chunks = append(chunks, ids)
-		}
+		chunks := chunkIDs(ids, 1000)
 
 		// begin a transaction to ensure both the message
 		// and data are deleted successfully
 		tx, err := db.BeginTx(context.Background(), nil)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		// roll back if it fails
@@ -164,33 +236,57 @@ func DeleteSearch(search, timezone string) error {
 
 			_, err = tx.Exec(sqlDelete1, delIDs...)
 			if err != nil {
-				return err
+				return 0, err
 			}
 
 			sqlDelete2 := `DELETE FROM ` + tenant("mailbox_data") + ` WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
 
 			_, err = tx.Exec(sqlDelete2, delIDs...)
 			if err != nil {
-				return err
+				return 0, err
 			}
 
 			sqlDelete3 := `DELETE FROM ` + tenant("message_tags") + ` WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
 
 			_, err = tx.Exec(sqlDelete3, delIDs...)
 			if err != nil {
-				return err
+				return 0, err
+			}
+
+			sqlDelete4 := `DELETE FROM ` + tenant("message_events") + ` WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete4, delIDs...)
+			if err != nil {
+				return 0, err
+			}
+
+			sqlDelete5 := `DELETE FROM ` + tenant("message_references") + ` WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+			_, err = tx.Exec(sqlDelete5, delIDs...)
+			if err != nil {
+				return 0, err
+			}
+
+			if !config.SMTPRelayConfig.KeepReleaseHistory {
+				sqlDelete6 := `DELETE FROM ` + tenant("release_history") + ` WHERE ID IN (?` + strings.Repeat(",?", len(ids)-1) + `)` // #nosec
+
+				_, err = tx.Exec(sqlDelete6, delIDs...)
+				if err != nil {
+					return 0, err
+				}
 			}
 		}
 
-		err = tx.Commit()
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
 
 		if err := pruneUnusedTags(); err != nil {
-			return err
+			return 0, err
 		}
 
-		if err == nil {
-			logger.Log().Debugf("[db] deleted %d messages matching %s", total, search)
-		}
+		logger.Log().Debugf("[db] deleted %d messages matching %s", total, search)
+		webhook.Dispatch(webhook.MessageDeleted, webhook.DeletedData{IDs: deletedIDs, Count: total})
 
 		dbLastAction = time.Now()
 		addDeletedSize(int64(deleteSize))
@@ -200,13 +296,117 @@ func DeleteSearch(search, timezone string) error {
 		BroadcastMailboxStats()
 	}
 
-	return nil
+	return len(ids), nil
+}
+
+// AdjacentMessages returns the database IDs of the previous (newer) & next (older) messages relative to
+// a message, in the same order as Search (or List if the search is empty), blank at the boundaries.
+// Messages received at the same time are ordered by insertion, so navigation never skips or repeats a message.
+func AdjacentMessages(id, search, timezone string) (string, string, error) {
+	var created, rowID int64
+	if err := sqlf.From(tenant("mailbox")).
+		Select("Created").To(&created).
+		Select("rowid").To(&rowID).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", ErrMessageNotFound
+		}
+		return "", "", err
+	}
+
+	adjacent := func(op, order string) (string, error) {
+		var result string
+
+		q := sqlf.From(tenant("mailbox")+" m").
+			Select("m.ID").To(&result).
+			Where("m.Deleted = 0").
+			Where("(m.Created, m.rowid) "+op+" (?, ?)", created, rowID).
+			OrderBy("m.Created " + order + ", m.rowid " + order).
+			Limit(1)
+
+		if search != "" {
+			s, err := searchQueryBuilder(search, timezone)
+			if err != nil {
+				q.Close()
+				return "", err
+			}
+			// seek within the search results
+			s.Where("(m.Created, m.rowid) "+op+" (?, ?)", created, rowID)
+			q.Where("m.ID IN (SELECT r.ID FROM ("+s.String()+") r)", s.Args()...)
+			s.Close()
+		}
+
+		if err := q.QueryRowAndClose(context.TODO(), db); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+
+		return result, nil
+	}
+
+	previous, err := adjacent(">", "ASC")
+	if err != nil {
+		return "", "", err
+	}
+
+	next, err := adjacent("<", "DESC")
+	if err != nil {
+		return "", "", err
+	}
+
+	return previous, next, nil
+}
+
+// SearchIDs returns the database IDs of all messages matching a search, newest first
+func SearchIDs(search, timezone string) ([]string, error) {
+	ids := []string{}
+
+	q, err := searchQueryBuilder(search, timezone)
+	if err != nil {
+		return ids, err
+	}
+	defer q.Close()
+
+	rows, err := db.Query(`SELECT s.ID FROM (`+q.String()+`) s`, q.Args()...) // #nosec
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// CountSearch returns the number of messages matching a search, see Search
+func CountSearch(search, timezone string) (int, error) {
+	q, err := searchQueryBuilder(search, timezone)
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM (`+q.String()+`) s`, q.Args()...).Scan(&total); err != nil { // #nosec
+		return 0, err
+	}
+
+	return total, nil
 }
 
 // SearchParser returns the SQL syntax for the database search based on the search arguments
-func searchQueryBuilder(searchString, timezone string) *sqlf.Stmt {
-	// group strings with quotes as a single argument and remove quotes
-	args := tools.ArgsParser(searchString)
+func searchQueryBuilder(searchString, timezone string) (*sqlf.Stmt, error) {
+	// group quoted phrases as a single argument, and detect search prefixes & exclusions
+	terms, err := parseSearchQuery(searchString)
+	if err != nil {
+		return nil, err
+	}
 
 	if timezone != "" {
 		loc, err := time.LoadLocation(timezone)
@@ -219,83 +419,58 @@ func searchQueryBuilder(searchString, timezone string) *sqlf.Stmt {
 
 	q := sqlf.From(tenant("mailbox") + " m").
 		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read,
-			m.Snippet,
+			m.Snippet, m.FirstOpened, m.SpamScore, m.HTMLScore, m.Pinned, m.Starred, m.ReleaseCount,
 			IFNULL(json_extract(Metadata, '$.To'), '{}') as ToJSON,
 			IFNULL(json_extract(Metadata, '$.From'), '{}') as FromJSON,
 			IFNULL(json_extract(Metadata, '$.Cc'), '{}') as CcJSON,
 			IFNULL(json_extract(Metadata, '$.Bcc'), '{}') as BccJSON,
 			IFNULL(json_extract(Metadata, '$.ReplyTo'), '{}') as ReplyToJSON
 		`).
-		OrderBy("m.Created DESC")
+		Where("m.Deleted = 0").
+		OrderBy("m.Created DESC, m.rowid DESC")
 
-	for _, w := range args {
-		if cleanString(w) == "" {
-			continue
-		}
+	re := regexp.MustCompile(`[\p{L}\p{N}]+`)
 
-		// lowercase search to try match search prefixes
-		lw := strings.ToLower(w)
+	// relative before: & after: dates are relative to the time of the search
+	now := time.Now()
 
-		exclude := false
-		// search terms starting with a `-` or `!` imply an exclude
-		if len(w) > 1 && (strings.HasPrefix(w, "-") || strings.HasPrefix(w, "!")) {
-			exclude = true
-			w = w[1:]
-			lw = lw[1:]
-		}
+	for _, term := range terms {
+		w := term.value
+		exclude := term.exclude
 
-		re := regexp.MustCompile(`[a-zA-Z0-9]+`)
-		if !re.MatchString(w) {
+		if cleanString(w) == "" || !re.MatchString(w) {
 			continue
 		}
 
-		if strings.HasPrefix(lw, "to:") {
-			w = cleanString(w[3:])
+		// lowercase value to match flags such as is:read
+		lw := strings.ToLower(w)
+
+		if term.prefix == "to" {
+			w = cleanString(w)
 			if w != "" {
-				if exclude {
-					q.Where("ToJSON NOT LIKE ?", "%"+escPercentChar(w)+"%")
-				} else {
-					q.Where("ToJSON LIKE ?", "%"+escPercentChar(w)+"%")
-				}
+				whereLike(q, "ToJSON", searchAddressForms(w), exclude)
 			}
-		} else if strings.HasPrefix(lw, "from:") {
-			w = cleanString(w[5:])
+		} else if term.prefix == "from" {
+			w = cleanString(w)
 			if w != "" {
-				if exclude {
-					q.Where("FromJSON NOT LIKE ?", "%"+escPercentChar(w)+"%")
-				} else {
-					q.Where("FromJSON LIKE ?", "%"+escPercentChar(w)+"%")
-				}
+				whereLike(q, "FromJSON", searchAddressForms(w), exclude)
 			}
-		} else if strings.HasPrefix(lw, "cc:") {
-			w = cleanString(w[3:])
+		} else if term.prefix == "cc" {
+			w = cleanString(w)
 			if w != "" {
-				if exclude {
-					q.Where("CcJSON NOT LIKE ?", "%"+escPercentChar(w)+"%")
-				} else {
-					q.Where("CcJSON LIKE ?", "%"+escPercentChar(w)+"%")
-				}
+				whereLike(q, "CcJSON", searchAddressForms(w), exclude)
 			}
-		} else if strings.HasPrefix(lw, "bcc:") {
-			w = cleanString(w[4:])
+		} else if term.prefix == "bcc" {
+			w = cleanString(w)
 			if w != "" {
-				if exclude {
-					q.Where("BccJSON NOT LIKE ?", "%"+escPercentChar(w)+"%")
-				} else {
-					q.Where("BccJSON LIKE ?", "%"+escPercentChar(w)+"%")
-				}
+				whereLike(q, "BccJSON", searchAddressForms(w), exclude)
 			}
-		} else if strings.HasPrefix(lw, "reply-to:") {
-			w = cleanString(w[9:])
+		} else if term.prefix == "reply-to" {
+			w = cleanString(w)
 			if w != "" {
-				if exclude {
-					q.Where("ReplyToJSON NOT LIKE ?", "%"+escPercentChar(w)+"%")
-				} else {
-					q.Where("ReplyToJSON LIKE ?", "%"+escPercentChar(w)+"%")
-				}
+				whereLike(q, "ReplyToJSON", searchAddressForms(w), exclude)
 			}
-		} else if strings.HasPrefix(lw, "subject:") {
-			w = w[8:]
+		} else if term.prefix == "subject" {
 			if w != "" {
 				if exclude {
 					q.Where("Subject NOT LIKE ?", "%"+escPercentChar(w)+"%")
@@ -303,17 +478,18 @@ func searchQueryBuilder(searchString, timezone string) *sqlf.Stmt {
 					q.Where("Subject LIKE ?", "%"+escPercentChar(w)+"%")
 				}
 			}
-		} else if strings.HasPrefix(lw, "message-id:") {
-			w = cleanString(w[11:])
+		} else if term.prefix == "message-id" {
+			// exact (indexed) match, Message-IDs are stored without angle brackets
+			w = strings.Trim(strings.TrimSpace(term.value), "<>")
 			if w != "" {
 				if exclude {
-					q.Where("MessageID NOT LIKE ?", "%"+escPercentChar(w)+"%")
+					q.Where("MessageID != ?", w)
 				} else {
-					q.Where("MessageID LIKE ?", "%"+escPercentChar(w)+"%")
+					q.Where("MessageID = ?", w)
 				}
 			}
-		} else if strings.HasPrefix(lw, "tag:") {
-			w = cleanString(w[4:])
+		} else if term.prefix == "tag" {
+			w = cleanString(w)
 			if w != "" {
 				if exclude {
 					q.Where(`m.ID NOT IN (SELECT mt.ID FROM `+tenant("message_tags")+` mt JOIN `+tenant("tags")+` t ON mt.TagID = t.ID WHERE t.Name = ?)`, w)
@@ -321,35 +497,111 @@ func searchQueryBuilder(searchString, timezone string) *sqlf.Stmt {
 					q.Where(`m.ID IN (SELECT mt.ID FROM `+tenant("message_tags")+` mt JOIN `+tenant("tags")+` t ON mt.TagID = t.ID WHERE t.Name = ?)`, w)
 				}
 			}
-		} else if lw == "is:read" {
+		} else if term.prefix == "is" && lw == "read" {
 			if exclude {
 				q.Where("Read = 0")
 			} else {
 				q.Where("Read = 1")
 			}
-		} else if lw == "is:unread" {
+		} else if term.prefix == "is" && lw == "unread" {
 			if exclude {
 				q.Where("Read = 1")
 			} else {
 				q.Where("Read = 0")
 			}
-		} else if lw == "is:tagged" {
+		} else if term.prefix == "is" && lw == "pinned" {
+			if exclude {
+				q.Where("m.Pinned = 0")
+			} else {
+				q.Where("m.Pinned = 1")
+			}
+		} else if term.prefix == "is" && lw == "starred" {
+			if exclude {
+				q.Where("m.Starred = 0")
+			} else {
+				q.Where("m.Starred = 1")
+			}
+		} else if term.prefix == "is" && lw == "tagged" {
 			if exclude {
 				q.Where(`m.ID NOT IN (SELECT DISTINCT mt.ID FROM ` + tenant("message_tags") + ` mt JOIN tags t ON mt.TagID = t.ID)`)
 			} else {
 				q.Where(`m.ID IN (SELECT DISTINCT mt.ID FROM ` + tenant("message_tags") + ` mt JOIN tags t ON mt.TagID = t.ID)`)
 			}
-		} else if lw == "has:attachment" || lw == "has:attachments" {
+		} else if term.prefix == "opened" && (lw == "yes" || lw == "no") {
+			if exclude == (lw == "yes") {
+				q.Where("FirstOpened = 0")
+			} else {
+				q.Where("FirstOpened > 0")
+			}
+		} else if term.prefix == "has" && (lw == "attachment" || lw == "attachments") {
 			if exclude {
 				q.Where("Attachments = 0")
 			} else {
 				q.Where("Attachments > 0")
 			}
-		} else if strings.HasPrefix(lw, "after:") {
-			w = cleanString(w[6:])
+		} else if term.prefix == "attachment" || term.prefix == "attachment-type" {
+			// substring match of the file names or content types of inline parts & attachments
+			field := map[string]string{"attachment": "$.FileName", "attachment-type": "$.ContentType"}[term.prefix]
+			w = strings.TrimSpace(w)
+			if w != "" {
+				sub := `EXISTS (SELECT 1 FROM json_each(m.Metadata, '$.Parts') p WHERE json_extract(p.value, '` + field + `') LIKE ?)`
+				if exclude {
+					q.Where("NOT "+sub, "%"+escPercentChar(w)+"%")
+				} else {
+					q.Where(sub, "%"+escPercentChar(w)+"%")
+				}
+			}
+		} else if term.prefix == "meta" {
+			// meta:key=value for an exact match, or meta:key if the key is set
+			k, v, hasValue := strings.Cut(w, "=")
+			if !ValidMetadataKey(k) {
+				logger.Log().Warnf("ignoring invalid meta: key \"%s\"", k)
+				continue
+			}
+			path := `$.Metadata."` + k + `"`
+			if hasValue {
+				if exclude {
+					q.Where("IFNULL(json_extract(Metadata, ?), '') != ?", path, v)
+				} else {
+					q.Where("json_extract(Metadata, ?) = ?", path, v)
+				}
+			} else {
+				if exclude {
+					q.Where("json_extract(Metadata, ?) IS NULL", path)
+				} else {
+					q.Where("json_extract(Metadata, ?) IS NOT NULL", path)
+				}
+			}
+		} else if term.prefix == "via" {
+			// via:<source> (eg: via:smtp or via:import), or the listener address
+			w = cleanString(w)
+			if w != "" {
+				if exclude {
+					q.Where(`IFNULL(json_extract(Metadata, '$.Via'), ?) != ? AND IFNULL(json_extract(Metadata, '$.Listener'), '') != ?`, ViaUnknown, w, w)
+				} else {
+					q.Where(`(IFNULL(json_extract(Metadata, '$.Via'), ?) = ? OR json_extract(Metadata, '$.Listener') = ?)`, ViaUnknown, w, w)
+				}
+			}
+		} else if term.prefix == "auth" || term.prefix == "helo" {
+			// SMTP AUTH username or HELO/EHLO hostname
+			col := map[string]string{"auth": "m.AuthUser", "helo": "m.Helo"}[term.prefix]
+			w = cleanString(w)
+			if w != "" {
+				if exclude {
+					q.Where(`IFNULL(`+col+`, '') NOT LIKE ?`, "%"+escPercentChar(w)+"%")
+				} else {
+					q.Where(col+` LIKE ?`, "%"+escPercentChar(w)+"%")
+				}
+			}
+		} else if term.prefix == "after" {
+			w = cleanString(w)
 			if w != "" {
-				t, err := dateparse.ParseLocal(w)
+				t, err := parseSearchDate(w, now)
 				if err != nil {
+					if err != errSearchDate {
+						q.Close()
+						return nil, err
+					}
 					logger.Log().Warnf("ignoring invalid after: date \"%s\"", w)
 				} else {
 					timestamp := t.UnixMilli()
@@ -360,11 +612,15 @@ func searchQueryBuilder(searchString, timezone string) *sqlf.Stmt {
 					}
 				}
 			}
-		} else if strings.HasPrefix(lw, "before:") {
-			w = cleanString(w[7:])
+		} else if term.prefix == "before" {
+			w = cleanString(w)
 			if w != "" {
-				t, err := dateparse.ParseLocal(w)
+				t, err := parseSearchDate(w, now)
 				if err != nil {
+					if err != errSearchDate {
+						q.Close()
+						return nil, err
+					}
 					logger.Log().Warnf("ignoring invalid before: date \"%s\"", w)
 				} else {
 					timestamp := t.UnixMilli()
@@ -375,15 +631,114 @@ func searchQueryBuilder(searchString, timezone string) *sqlf.Stmt {
 					}
 				}
 			}
-		} else {
-			// search text
+		} else if term.prefix == "larger" || term.prefix == "smaller" {
+			size, err := parseSearchSize(w)
+			if err != nil {
+				q.Close()
+				return nil, err
+			}
+			op := map[string]string{"larger": ">", "smaller": "<"}[term.prefix]
+			if exclude {
+				op = map[string]string{"larger": "<=", "smaller": ">="}[term.prefix]
+			}
+			q.Where(`m.Size `+op+` ?`, size)
+		} else if term.prefix == "spam-score" || term.prefix == "html-score" {
+			op, score, err := parseSearchScore(w)
+			if err != nil {
+				q.Close()
+				return nil, err
+			}
+			col := map[string]string{"spam-score": "m.SpamScore", "html-score": "m.HTMLScore"}[term.prefix]
 			if exclude {
-				q.Where("SearchText NOT LIKE ?", "%"+cleanString(escPercentChar(strings.ToLower(w)))+"%")
+				// messages which have not been checked do not match the score, so are not excluded
+				q.Where(`NOT IFNULL(`+col+` `+op+` ?, 0)`, score)
 			} else {
-				q.Where("SearchText LIKE ?", "%"+cleanString(escPercentChar(strings.ToLower(w)))+"%")
+				q.Where(col+` `+op+` ?`, score)
 			}
+		} else {
+			// search text, including unrecognised values of is:, has: & opened:
+			if term.prefix != "" {
+				w = term.prefix + ":" + w
+			}
+			w = cleanString(strings.ToLower(w))
+			if isAddressTerm(w) {
+				whereLike(q, "SearchText", searchAddressForms(w), exclude)
+			} else {
+				whereLike(q, "SearchText", []string{w}, exclude)
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// whereLike adds a substring match of any of the values to a search query, or if exclude is set, excludes
+// all of the values
+func whereLike(q *sqlf.Stmt, col string, values []string, exclude bool) {
+	clauses := []string{}
+	args := []interface{}{}
+
+	for _, v := range values {
+		if exclude {
+			clauses = append(clauses, col+" NOT LIKE ?")
+		} else {
+			clauses = append(clauses, col+" LIKE ?")
+		}
+		args = append(args, "%"+escPercentChar(v)+"%")
+	}
+
+	if exclude {
+		q.Where(strings.Join(clauses, " AND "), args...)
+	} else {
+		q.Where("("+strings.Join(clauses, " OR ")+")", args...)
+	}
+}
+
+// searchAddressForms returns a search term, and if the term is an internationalised email address or domain,
+// the alternate (Unicode or punycode) form of the domain so either form matches, eg: 例え.jp & xn--r8jz45g.jp
+func searchAddressForms(w string) []string {
+	forms := []string{w}
+
+	if strings.ContainsAny(w, " ") {
+		return forms
+	}
+
+	local, domain := "", w
+	if i := strings.LastIndex(w, "@"); i > -1 {
+		local, domain = w[:i+1], w[i+1:]
+	}
+
+	if !strings.Contains(domain, ".") {
+		return forms
+	}
+
+	var alt string
+	var err error
+	if strings.Contains(domain, "xn--") {
+		alt, err = idna.ToUnicode(domain)
+	} else {
+		alt, err = idna.ToASCII(domain)
+	}
+
+	if err == nil && alt != domain && alt != "" {
+		forms = append(forms, local+strings.ToLower(alt))
+	}
+
+	return forms
+}
+
+// isAddressTerm returns whether a plain search term may be an internationalised email address or domain,
+// ie: it contains an @, a punycode label or non-ASCII characters
+func isAddressTerm(w string) bool {
+	if strings.Contains(w, "@") || strings.Contains(w, "xn--") {
+		return true
+	}
+
+	for _, r := range w {
+		if r > unicode.MaxASCII {
+			return true
 		}
 	}
 
-	return q
+	return false
 }
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/jhillyerd/enmime"
 )
 
@@ -117,7 +121,7 @@ func TestSearchDelete100(t *testing.T) {
 
 	assertEqual(t, total, 100, "100 search results expected")
 
-	if err := DeleteSearch("from:sender@example.com", ""); err != nil {
+	if _, err := DeleteSearch("from:sender@example.com", "", false); err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
@@ -151,7 +155,7 @@ func TestSearchDelete1100(t *testing.T) {
 
 	assertEqual(t, total, 1100, "100 search results expected")
 
-	if err := DeleteSearch("from:sender@example.com", ""); err != nil {
+	if _, err := DeleteSearch("from:sender@example.com", "", false); err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
@@ -180,3 +184,600 @@ func TestEscPercentChar(t *testing.T) {
 		assertEqual(t, res, expected, "no match")
 	}
 }
+
+func TestSearchParser(t *testing.T) {
+	tests := map[string][]searchTerm{}
+	// plain terms
+	tests[""] = []searchTerm{}
+	tests["   "] = []searchTerm{}
+	tests["test"] = []searchTerm{{value: "test"}}
+	tests["this is a test"] = []searchTerm{{value: "this"}, {value: "is"}, {value: "a"}, {value: "test"}}
+	tests["  spaced \t  out  "] = []searchTerm{{value: "spaced"}, {value: "out"}}
+	// quoted phrases
+	tests[`"this is" a test`] = []searchTerm{{value: "this is"}, {value: "a"}, {value: "test"}}
+	tests[`"this is a test"`] = []searchTerm{{value: "this is a test"}}
+	tests[`""`] = []searchTerm{{value: ""}}
+	tests[`pre"fix suf"fix`] = []searchTerm{{value: "prefix suffix"}}
+	tests[`"a""b"`] = []searchTerm{{value: "ab"}}
+	tests[`"it's here"`] = []searchTerm{{value: "it's here"}}
+	// prefixes
+	tests["subject:test"] = []searchTerm{{prefix: "subject", value: "test"}}
+	tests["SUBJECT:Test"] = []searchTerm{{prefix: "subject", value: "Test"}}
+	tests[`subject:"Reset your password"`] = []searchTerm{{prefix: "subject", value: "Reset your password"}}
+	tests[`subject:"Re: order #123"`] = []searchTerm{{prefix: "subject", value: "Re: order #123"}}
+	tests["subject:Re:"] = []searchTerm{{prefix: "subject", value: "Re:"}}
+	tests["subject:"] = []searchTerm{{prefix: "subject", value: ""}}
+	tests["from:user@example.com to:other@example.com"] = []searchTerm{{prefix: "from", value: "user@example.com"}, {prefix: "to", value: "other@example.com"}}
+	tests[`reply-to:"reply@example.com"`] = []searchTerm{{prefix: "reply-to", value: "reply@example.com"}}
+	tests["message-id:abc@example.com"] = []searchTerm{{prefix: "message-id", value: "abc@example.com"}}
+	tests["is:read has:attachment"] = []searchTerm{{prefix: "is", value: "read"}, {prefix: "has", value: "attachment"}}
+	tests[`after:"2024-01-01 10:00"`] = []searchTerm{{prefix: "after", value: "2024-01-01 10:00"}}
+	tests[`tag:"My Tag"`] = []searchTerm{{prefix: "tag", value: "My Tag"}}
+	// colons which are not prefixes
+	tests["Re: order"] = []searchTerm{{value: "Re:"}, {value: "order"}}
+	tests["unknown:value"] = []searchTerm{{value: "unknown:value"}}
+	tests["http://example.com"] = []searchTerm{{value: "http://example.com"}}
+	tests[`"subject:test"`] = []searchTerm{{value: "subject:test"}}
+	tests[`sub"ject":test`] = []searchTerm{{value: "subject:test"}}
+	tests["10:30"] = []searchTerm{{value: "10:30"}}
+	// exclusions
+	tests["-test"] = []searchTerm{{exclude: true, value: "test"}}
+	tests["!test"] = []searchTerm{{exclude: true, value: "test"}}
+	tests[`!"this is" a test`] = []searchTerm{{exclude: true, value: "this is"}, {value: "a"}, {value: "test"}}
+	tests["-subject:test"] = []searchTerm{{exclude: true, prefix: "subject", value: "test"}}
+	tests[`-subject:"Re: order #123"`] = []searchTerm{{exclude: true, prefix: "subject", value: "Re: order #123"}}
+	tests["--test"] = []searchTerm{{exclude: true, value: "-test"}}
+	tests["-"] = []searchTerm{{value: "-"}}
+	tests["- test"] = []searchTerm{{value: "-"}, {value: "test"}}
+	tests["co-worker"] = []searchTerm{{value: "co-worker"}}
+	// escapes
+	tests[`\-test`] = []searchTerm{{value: "-test"}}
+	tests[`\!test`] = []searchTerm{{value: "!test"}}
+	tests[`subject:\-test`] = []searchTerm{{prefix: "subject", value: "-test"}}
+	tests[`"say \"hello\""`] = []searchTerm{{value: `say "hello"`}}
+	tests[`subject:"say \"hello\" now"`] = []searchTerm{{prefix: "subject", value: `say "hello" now`}}
+	tests[`say\"hello`] = []searchTerm{{value: `say"hello`}}
+	tests[`back\\slash`] = []searchTerm{{value: `back\slash`}}
+	tests[`"back\\slash"`] = []searchTerm{{value: `back\slash`}}
+	tests[`C:\path\to`] = []searchTerm{{value: `C:\path\to`}}
+	tests[`trailing\`] = []searchTerm{{value: `trailing\`}}
+	tests[`"\d+"`] = []searchTerm{{value: `\d+`}}
+	tests[`subject\:test`] = []searchTerm{{value: `subject\:test`}}
+
+	for search, expected := range tests {
+		res, err := parseSearchQuery(search)
+		if err != nil {
+			t.Logf("Search parser error for %q: %s", search, err.Error())
+			t.Fail()
+			continue
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Logf("Search parser error for %q: %+v != %+v", search, res, expected)
+			t.Fail()
+		}
+	}
+
+	// unterminated quotes
+	for _, search := range []string{`"test`, `subject:"test`, `"test\"`, `a "b" "c`, `-"`} {
+		if _, err := parseSearchQuery(search); err != errUnterminatedQuote {
+			t.Logf("Expected unterminated quote error for %q, got %v", search, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestSearchEscaping(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing search escaping")
+
+	for _, subject := range []string{"Re: order #123", `Say "hello"`, "-5% discount", `C:\temp`} {
+		msg := enmime.Builder().
+			From("From", "from@example.com").
+			To("To", "to@example.com").
+			Subject(subject).
+			Text([]byte("body"))
+
+		env, err := msg.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := env.Encode(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		bufBytes := buf.Bytes()
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	searches := map[string]int{
+		`subject:"Re: order #123"`: 1,
+		`subject:"say \"hello\""`:  1,
+		`subject:\-5`:              1,
+		`-subject:\-5`:             3,
+		`subject:"C:\\temp"`:       1,
+		`subject:C:\temp`:          1,
+	}
+
+	for search, expected := range searches {
+		summaries, _, err := Search(search, "", 0, 100)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, len(summaries), expected, fmt.Sprintf("unexpected number of results for %s", search))
+	}
+
+	if _, _, err := Search(`subject:"unterminated`, "", 0, 100); err == nil {
+		t.Log("expected error for unterminated quote")
+		t.Fail()
+	}
+}
+
+func TestSearchVia(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing via: search")
+
+	sources := []StoreOptions{
+		{},
+		{Via: ViaSMTP, Listener: "0.0.0.0:1025"},
+		{Via: ViaSMTPS, Listener: "0.0.0.0:1465"},
+		{Via: ViaImport, Listener: "0.0.0.0:1025"},
+	}
+
+	for _, opts := range sources {
+		bufBytes := []byte("From: from@example.com\r\nTo: to@example.com\r\nSubject: via\r\n\r\nbody\r\n")
+		if _, err := StoreWithOptions(&bufBytes, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	searches := map[string]int{
+		`via:smtp`:         1,
+		`via:SMTPS`:        1,
+		`via:import`:       1,
+		`via:lmtp`:         0,
+		`via:unknown`:      1,
+		`-via:unknown`:     3,
+		`via:0.0.0.0:1025`: 2,
+		`-via:smtp`:        3,
+	}
+
+	for search, expected := range searches {
+		summaries, _, err := Search(search, "", 0, 100)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		assertEqual(t, len(summaries), expected, fmt.Sprintf("unexpected number of results for %s", search))
+	}
+
+	summaries, _, err := Search("via:unknown", "", 0, 1)
+	if err != nil || len(summaries) != 1 {
+		t.Fatalf("expected a message received via unknown: %v", err)
+	}
+
+	msg, err := GetMessage(summaries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Via, ViaUnknown, "wrong via for message without an ingress source")
+}
+
+func TestSearchSize(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing larger: & smaller: search")
+
+	// messages of exactly these sizes in bytes
+	for _, size := range []int{1000, 1024, 2048, 1024 * 1024} {
+		header := fmt.Sprintf("From: from@example.com\r\nTo: to@example.com\r\nSubject: size %d\r\n\r\n", size)
+		bufBytes := []byte(header + strings.Repeat("a", size-len(header)))
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+
+	searches := map[string]int{
+		`larger:1000`:                   3,
+		`larger:999`:                    4,
+		`larger:1K`:                     2,
+		`larger:1k smaller:1M`:          1,
+		`smaller:1K`:                    1,
+		`smaller:1025`:                  2,
+		`larger:1.5KB`:                  2,
+		`-larger:1K`:                    2,
+		`-smaller:1K`:                   3,
+		`larger:1M`:                     0,
+		`smaller:2M`:                    4,
+		`larger:1K subject:"size 2048"`: 1,
+		`larger:1K after:` + yesterday:  2,
+		`larger:1K before:` + yesterday: 0,
+		`smaller:2K before:` + tomorrow + ` size`: 2,
+	}
+
+	for search, expected := range searches {
+		summaries, _, err := Search(search, "", 0, 100)
+		if err != nil {
+			t.Fatalf("error searching %s: %s", search, err.Error())
+		}
+
+		assertEqual(t, len(summaries), expected, fmt.Sprintf("unexpected number of results for %s", search))
+
+		count, err := CountSearch(search, "")
+		if err != nil {
+			t.Fatalf("error counting %s: %s", search, err.Error())
+		}
+		assertEqual(t, count, expected, fmt.Sprintf("unexpected count for %s", search))
+	}
+
+	for _, search := range []string{`larger:big`, `smaller:10G`, `larger:-5`, `smaller:1..5K`} {
+		if _, _, err := Search(search, "", 0, 100); err == nil {
+			t.Errorf("expected an error for %s", search)
+		}
+	}
+}
+
+func TestSearchMessageID(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing message-id: search")
+
+	for i, messageID := range []string{"<dup@example.com>", "<Unique.ID@Example.com>", "<dup@example.com>", "<dup@example.com.au>"} {
+		bufBytes := []byte(fmt.Sprintf("From: from@example.com\r\nTo: to@example.com\r\nSubject: message %d\r\nMessage-ID: %s\r\n\r\nbody\r\n", i, messageID))
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	searches := map[string]int{
+		`message-id:dup@example.com`:         2,
+		`message-id:<dup@example.com>`:       2,
+		`message-id:"<dup@example.com>"`:     2,
+		`message-id:Unique.ID@Example.com`:   1,
+		`message-id:unique.id@example.com`:   0,
+		`message-id:example.com`:             0,
+		`-message-id:dup@example.com`:        2,
+		`message-id:dup@example.com message`: 2,
+	}
+
+	for search, expected := range searches {
+		summaries, _, err := Search(search, "", 0, 100)
+		if err != nil {
+			t.Fatalf("error searching %s: %s", search, err.Error())
+		}
+
+		assertEqual(t, len(summaries), expected, fmt.Sprintf("unexpected number of results for %s", search))
+	}
+
+	summaries, _, err := Search("message-id:dup@example.com", "", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, summaries[0].Subject, "message 2", "duplicates not sorted by received date")
+	assertEqual(t, summaries[1].Subject, "message 0", "duplicates not sorted by received date")
+}
+
+func TestSearchInternationalised(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing internationalised address search")
+
+	messages := []string{
+		"From: 发送 <发送@例え.jp>\r\nTo: 用户@例え.jp\r\nSubject: 测试 message\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n你好\r\n",
+		"From: sender@example.com\r\nTo: user@xn--r8jz45g.jp\r\nSubject: punycode\r\n\r\nbody\r\n",
+		"From: sender@example.com\r\nTo: user@example.com\r\nSubject: ascii\r\n\r\nbody\r\n",
+	}
+
+	for _, m := range messages {
+		bufBytes := []byte(m)
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	searches := map[string]int{
+		`用户`:                        1,
+		`你好`:                        1,
+		`subject:测试`:                1,
+		`from:发送@例え.jp`:             1,
+		`to:用户@例え.jp`:               1,
+		`to:用户@xn--r8jz45g.jp`:      1,
+		`to:例え.jp`:                  2,
+		`to:xn--r8jz45g.jp`:         2,
+		`xn--r8jz45g.jp`:            2,
+		`例え.jp`:                     2,
+		`example.com`:               2,
+		`-to:例え.jp`:                 1,
+		`to:user@例え.jp`:             1,
+		`to:USER@XN--R8JZ45G.JP`:    1,
+		`to:user@example.com 例え.jp`: 0,
+	}
+
+	for search, expected := range searches {
+		assertSearchCount(t, search, expected)
+	}
+}
+
+func TestSearchRelativeDates(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing relative before: & after: search")
+
+	config.UseMessageDates = true
+	defer func() { config.UseMessageDates = false }()
+
+	now := time.Now()
+
+	for _, age := range []time.Duration{5 * time.Minute, 3 * time.Hour, 48 * time.Hour, 10 * 24 * time.Hour} {
+		bufBytes := []byte(fmt.Sprintf("From: from@example.com\r\nTo: to@example.com\r\nSubject: age %s\r\nDate: %s\r\n\r\nbody\r\n",
+			age, now.Add(-age).Format(time.RFC1123Z)))
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+
+	searches := map[string]int{
+		`after:30m`:                          1,
+		`after:4h`:                           2,
+		`after:4H`:                           2,
+		`before:1d`:                          2,
+		`before:7d`:                          1,
+		`after:1w before:1d`:                 1,
+		`-after:1h`:                          3,
+		`after:` + yesterday + ` before:1h`:  1,
+		`after:` + yesterday + ` -before:1h`: 1,
+		`after:notadate`:                     4,
+	}
+
+	for search, expected := range searches {
+		summaries, _, err := Search(search, "", 0, 100)
+		if err != nil {
+			t.Fatalf("error searching %s: %s", search, err.Error())
+		}
+
+		assertEqual(t, len(summaries), expected, fmt.Sprintf("unexpected number of results for %s", search))
+	}
+
+	for _, search := range []string{`after:5y`, `before:10x`, `after:1st`} {
+		_, _, err := Search(search, "", 0, 100)
+		if err == nil {
+			t.Errorf("expected an error for %s", search)
+			continue
+		}
+		assertEqual(t, strings.Contains(err.Error(), "invalid relative date"), true, "wrong error for "+search)
+	}
+
+	t.Log("Delete messages older than 7 days")
+	if _, err := DeleteSearch("before:7d", "", false); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, CountTotal(), float64(3), "wrong number of messages after delete")
+
+	if _, err := DeleteSearch("before:7y", "", false); err == nil {
+		t.Error("expected an error for an invalid unit")
+	}
+	assertEqual(t, CountTotal(), float64(3), "messages deleted despite an error")
+}
+
+func TestParseSearchDate(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]time.Time{
+		"30m": now.Add(-30 * time.Minute),
+		"2h":  now.Add(-2 * time.Hour),
+		"1d":  now.AddDate(0, 0, -1),
+		"2w":  now.AddDate(0, 0, -14),
+		"90s": now.Add(-90 * time.Second),
+	}
+
+	for s, expected := range tests {
+		res, err := parseSearchDate(s, now)
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", s, err.Error())
+		}
+		assertEqual(t, res, expected, "wrong date for "+s)
+	}
+
+	res, err := parseSearchDate("2024-01-02", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Format("2006-01-02"), "2024-01-02", "wrong absolute date")
+
+	_, err = parseSearchDate("tomorrow", now)
+	assertEqual(t, err, errSearchDate, "expected an unrecognised date")
+
+	for _, s := range []string{"5y", "3mo", "10x"} {
+		if _, err := parseSearchDate(s, now); err == nil || err == errSearchDate {
+			t.Errorf("expected an invalid unit error for %s", s)
+		}
+	}
+}
+
+func TestSearchAttachments(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing attachment: & attachment-type: search")
+
+	// an invoice attachment, and an inline image with a Content-ID but no filename
+	invoice := []byte("From: from@example.com\r\nTo: to@example.com\r\nSubject: invoice\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n" +
+		"--b1\r\nContent-Type: multipart/related; boundary=\"b2\"\r\n\r\n" +
+		"--b2\r\nContent-Type: text/html\r\n\r\n<p>Invoice <img src=\"cid:logo@example.com\"></p>\r\n" +
+		"--b2\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw0KGgo=\r\n" +
+		"--b2--\r\n" +
+		"--b1\r\nContent-Type: application/pdf; name=\"Invoice_2024_03.pdf\"\r\nContent-Disposition: attachment; filename=\"Invoice_2024_03.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQ=\r\n" +
+		"--b1--\r\n")
+
+	for _, msg := range [][]byte{invoice, testMimeEmail, testTextEmail} {
+		bufBytes := append([]byte{}, msg...)
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	searches := map[string]int{
+		`attachment:invoice`:              1,
+		`attachment:INVOICE_2024`:         1,
+		`attachment:"sample pdf"`:         1,
+		`attachment:.pdf`:                 2,
+		`attachment:inline-image.jpg`:     1,
+		`attachment:notfound`:             0,
+		`-attachment:invoice`:             2,
+		`attachment-type:image/png`:       1,
+		`attachment-type:IMAGE/`:          2,
+		`attachment-type:application/pdf`: 2,
+		`-attachment-type:pdf`:            1,
+		`attachment:.pdf subject:invoice`: 1,
+	}
+
+	for search, expected := range searches {
+		summaries, _, err := Search(search, "", 0, 100)
+		if err != nil {
+			t.Fatalf("error searching %s: %s", search, err.Error())
+		}
+
+		assertEqual(t, len(summaries), expected, fmt.Sprintf("unexpected number of results for %s", search))
+	}
+
+	t.Log("Backfill attachment parts")
+	summaries, _, err := Search("attachment:invoice", "", 0, 1)
+	if err != nil || len(summaries) != 1 {
+		t.Fatalf("expected an invoice message: %v", err)
+	}
+	id := summaries[0].ID
+
+	if _, err := db.Exec(`UPDATE ` + tenant("mailbox") + ` SET Metadata = json_remove(Metadata, '$.Parts')`); err != nil {
+		t.Fatal(err)
+	}
+
+	assertSearchCount(t, "attachment:invoice", 0)
+
+	if err := backfillAttachmentParts(id); err != nil {
+		t.Fatal(err)
+	}
+
+	assertSearchCount(t, "attachment:invoice", 1)
+	assertSearchCount(t, "attachment-type:image/png", 1)
+}
+
+func assertSearchCount(t *testing.T, search string, expected int) {
+	summaries, _, err := Search(search, "", 0, 100)
+	if err != nil {
+		t.Fatalf("error searching %s: %s", search, err.Error())
+	}
+
+	assertEqual(t, len(summaries), expected, fmt.Sprintf("unexpected number of results for %s", search))
+}
+
+func TestAdjacentMessages(t *testing.T) {
+	setup()
+	defer Close()
+
+	config.UseMessageDates = true
+	defer func() { config.UseMessageDates = false }()
+
+	t.Log("Testing adjacent messages")
+
+	// most messages are received at exactly the same time
+	date := time.Now().Add(-time.Hour)
+	for i := 0; i < 15; i++ {
+		d := date
+		if i%5 == 0 {
+			d = date.Add(time.Duration(i) * time.Minute)
+		}
+		bufBytes := []byte(fmt.Sprintf("From: from@example.com\r\nTo: to@example.com\r\nSubject: message %d %s\r\nDate: %s\r\n\r\nbody\r\n",
+			i, map[bool]string{true: "even", false: "odd"}[i%2 == 0], d.Format(time.RFC1123Z)))
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertNavigation := func(search string, expected []MessageSummary) {
+		ids := []string{}
+		for _, m := range expected {
+			ids = append(ids, m.ID)
+		}
+
+		// walk forwards & backwards through all messages
+		forwards := []string{ids[0]}
+		for {
+			previous, next, err := AdjacentMessages(forwards[len(forwards)-1], search, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(forwards) == 1 {
+				assertEqual(t, previous, "", "expected no previous message for the first message")
+			}
+			if next == "" {
+				break
+			}
+			forwards = append(forwards, next)
+		}
+		assertEqual(t, strings.Join(forwards, ","), strings.Join(ids, ","), "wrong forwards navigation for "+search)
+
+		backwards := []string{ids[len(ids)-1]}
+		for {
+			previous, _, err := AdjacentMessages(backwards[0], search, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if previous == "" {
+				break
+			}
+			backwards = append([]string{previous}, backwards...)
+		}
+		assertEqual(t, strings.Join(backwards, ","), strings.Join(ids, ","), "wrong backwards navigation for "+search)
+	}
+
+	all, err := List(0, 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(all), 15, "wrong number of messages")
+	assertNavigation("", all)
+
+	even, _, err := Search("subject:even", "", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(even), 8, "wrong number of search results")
+	assertNavigation("subject:even", even)
+
+	t.Log("Messages outside of the search are navigated relative to their position")
+	previous, next, err := AdjacentMessages(all[1].ID, "subject:even", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, previous, all[0].ID, "wrong previous message")
+	assertEqual(t, next, all[2].ID, "wrong next message")
+
+	if _, _, err := AdjacentMessages("missing", "", ""); err != ErrMessageNotFound {
+		t.Fatal("expected ErrMessageNotFound")
+	}
+
+	if _, _, err := AdjacentMessages(all[0].ID, "larger:big", ""); err == nil {
+		t.Fatal("expected an error for an invalid search")
+	}
+}
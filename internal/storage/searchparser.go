@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/araddon/dateparse"
+	"github.com/axllent/mailpit/internal/tools"
+)
+
+// searchPrefixes are the recognised search filters, eg: `subject:<term>`
+var searchPrefixes = []string{
+	"to", "from", "cc", "bcc", "reply-to", "subject", "message-id", "tag", "is", "has", "opened", "meta", "after", "before", "via",
+	"auth", "helo", "larger", "smaller", "attachment", "attachment-type", "spam-score", "html-score",
+}
+
+// errUnterminatedQuote is returned when a search query contains an unterminated quoted phrase
+var errUnterminatedQuote = errors.New("invalid search query: unterminated quoted phrase")
+
+// searchRelativeDateRe matches a relative search date, eg: 30m, 2h or 7d
+var searchRelativeDateRe = regexp.MustCompile(`^\d+[a-z]+$`)
+
+// errSearchDate is returned when a before: or after: value is not a recognised date
+var errSearchDate = errors.New("invalid search date")
+
+// searchSizeRe matches a search size, eg: 2048, 500K or 1.5MB
+var searchSizeRe = regexp.MustCompile(`^(?i)(\d+(?:\.\d+)?)\s*([km]?)b?$`)
+
+// searchScoreRe matches a search score with an optional comparison operator, eg: >5, <=2.5 or 3
+var searchScoreRe = regexp.MustCompile(`^(>=|<=|>|<|=)?\s*(-?\d+(?:\.\d+)?)$`)
+
+// SearchTerm is a single parsed term of a search query
+type searchTerm struct {
+	// exclude messages matching this term (prefixed with an unescaped `-` or `!`)
+	exclude bool
+	// lowercase search prefix without the colon, eg: "subject", empty for text searches
+	prefix string
+	// the unquoted & unescaped search value
+	value string
+}
+
+// ParseSearchQuery splits a search query into terms.
+//
+// The grammar is:
+//   - terms are separated by whitespace, unless the whitespace is inside a quoted phrase
+//   - a term starting with `-` or `!` excludes matching messages, `\-` & `\!` are a literal `-` & `!`
+//   - a term starting with a recognised prefix & colon (eg: `subject:`) is a filter, the colon must not be quoted or escaped
+//   - quoted phrases (`"..."`) may appear anywhere in a term, and may contain colons & whitespace
+//   - `\"` is a literal quote & `\\` is a literal backslash, both inside & outside quoted phrases
+//   - any other backslash is literal, eg: `C:\path`
+//
+// An error is returned for unterminated quoted phrases.
+func parseSearchQuery(s string) ([]searchTerm, error) {
+	terms := []searchTerm{}
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		t := searchTerm{}
+
+		if (runes[i] == '-' || runes[i] == '!') && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			t.exclude = true
+			i++
+		}
+
+		var sb strings.Builder
+		quoted := false
+		// a prefix can only be detected before any quotes or escapes
+		prefixAllowed := true
+
+		for ; i < len(runes); i++ {
+			r := runes[i]
+
+			if quoted {
+				if r == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\') {
+					sb.WriteRune(runes[i+1])
+					i++
+				} else if r == '"' {
+					quoted = false
+				} else {
+					sb.WriteRune(r)
+				}
+				continue
+			}
+
+			if unicode.IsSpace(r) {
+				break
+			}
+
+			switch {
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\-!`, runes[i+1]):
+				sb.WriteRune(runes[i+1])
+				i++
+				prefixAllowed = false
+			case r == '"':
+				quoted = true
+				prefixAllowed = false
+			case r == ':' && prefixAllowed:
+				prefixAllowed = false
+				if p := strings.ToLower(sb.String()); inArray(p, searchPrefixes) {
+					t.prefix = p
+					sb.Reset()
+				} else {
+					sb.WriteRune(r)
+				}
+			default:
+				sb.WriteRune(r)
+			}
+		}
+
+		if quoted {
+			return nil, errUnterminatedQuote
+		}
+
+		t.value = sb.String()
+
+		terms = append(terms, t)
+	}
+
+	return terms, nil
+}
+
+// ParseSearchSize returns the number of bytes of a larger: or smaller: search value,
+// which is a number of bytes with an optional K or M (1024 based) suffix
+func parseSearchSize(s string) (float64, error) {
+	m := searchSizeRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid search query: invalid size \"%s\", eg: 500K or 2M", s)
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid search query: invalid size \"%s\", eg: 500K or 2M", s)
+	}
+
+	switch strings.ToLower(m[2]) {
+	case "k":
+		n = n * 1024
+	case "m":
+		n = n * 1024 * 1024
+	}
+
+	return n, nil
+}
+
+// ParseSearchScore returns the comparison operator & score of a spam-score: or html-score: search value,
+// which is a number with an optional >, >=, <, <= or = operator (defaults to =)
+func parseSearchScore(s string) (string, float64, error) {
+	m := searchScoreRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return "", 0, fmt.Errorf("invalid search query: invalid score \"%s\", eg: >5 or <=2.5", s)
+	}
+
+	n, err := strconv.ParseFloat(m[2], 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid search query: invalid score \"%s\", eg: >5 or <=2.5", s)
+	}
+
+	op := m[1]
+	if op == "" {
+		op = "="
+	}
+
+	return op, n, nil
+}
+
+// ParseSearchDate returns the time of a before: or after: search value, which is either a date
+// (parsed in the local timezone), or a duration relative to now with a s, m, h, d or w unit, eg: 30m.
+// An error is returned for relative dates with an invalid unit, or errSearchDate if the value
+// is not a recognised date.
+func parseSearchDate(s string, now time.Time) (time.Time, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if searchRelativeDateRe.MatchString(s) {
+		d, err := tools.ParseDuration(s)
+		if err != nil || !strings.ContainsAny(s[len(s)-1:], "smhdw") {
+			return time.Time{}, fmt.Errorf("invalid search query: invalid relative date \"%s\", eg: 30m, 2h, 7d or 2w", s)
+		}
+
+		return now.Add(-d), nil
+	}
+
+	t, err := dateparse.ParseLocal(s)
+	if err != nil {
+		return time.Time{}, errSearchDate
+	}
+
+	return t, nil
+}
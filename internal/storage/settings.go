@@ -3,7 +3,9 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/leporo/sqlf"
 )
@@ -34,6 +36,59 @@ func SettingPut(k, v string) error {
 	return err
 }
 
+// runtimeSettingsKey is the settings key of the persisted runtime setting overrides
+const runtimeSettingsKey = "RuntimeSettings"
+
+// UpdateRuntimeSettings validates & applies runtime setting changes (see config.ApplyRuntimeSettings),
+// persisting them so they are restored on restart
+func UpdateRuntimeSettings(changes map[string]interface{}) error {
+	if err := config.ApplyRuntimeSettings(changes); err != nil {
+		return err
+	}
+
+	overrides := runtimeSettingOverrides()
+	for k, v := range changes {
+		overrides[k] = v
+	}
+
+	return putRuntimeSettingOverrides(overrides)
+}
+
+// Persist the runtime setting overrides
+func putRuntimeSettingOverrides(overrides map[string]interface{}) error {
+	b, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+
+	return SettingPut(runtimeSettingsKey, string(b))
+}
+
+// The persisted runtime setting overrides
+func runtimeSettingOverrides() map[string]interface{} {
+	overrides := map[string]interface{}{}
+
+	if v := SettingGet(runtimeSettingsKey); v != "" {
+		if err := json.Unmarshal([]byte(v), &overrides); err != nil {
+			logger.Log().Errorf("[settings] %s", err.Error())
+		}
+	}
+
+	return overrides
+}
+
+// Restore the persisted runtime setting overrides. Each setting is applied individually
+// so an override which is no longer valid (eg: the relay configuration was removed) is skipped.
+func loadRuntimeSettings() {
+	runtimeSettingDefaults = config.RuntimeSettings()
+
+	for k, v := range runtimeSettingOverrides() {
+		if err := config.ApplyRuntimeSettings(map[string]interface{}{k: v}); err != nil {
+			logger.Log().Warnf("[settings] ignoring stored runtime setting: %s", err.Error())
+		}
+	}
+}
+
 // The total deleted message size as an int64 value
 func getDeletedSize() float64 {
 	var result sql.NullFloat64
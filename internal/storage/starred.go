@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/websockets"
+	"github.com/leporo/sqlf"
+)
+
+// StarredEvent is broadcast to the web UI when messages are starred or unstarred
+type starredEvent struct {
+	// Database IDs of the changed messages, empty if all messages were changed
+	IDs []string
+	// Whether the messages are starred
+	Starred bool
+	// Whether all messages were changed
+	All bool
+}
+
+// SetStarred stars or unstars messages, returning the number of changed messages.
+// If no IDs are provided then all messages are updated.
+func SetStarred(ids []string, starred bool) (int, error) {
+	start := time.Now()
+
+	newStatus, oldStatus := 0, 1
+	if starred {
+		newStatus, oldStatus = 1, 0
+	}
+
+	if len(ids) == 0 {
+		res, err := sqlf.Update(tenant("mailbox")).
+			Set("Starred", newStatus).
+			Where("Starred = ?", oldStatus).
+			Where("Deleted = 0").
+			ExecAndClose(context.Background(), db)
+		if err != nil {
+			return 0, err
+		}
+
+		total, _ := res.RowsAffected()
+
+		logger.Log().Debugf("[db] updated the starred status of %d messages in %s", total, time.Since(start))
+
+		if total > 0 {
+			websockets.Broadcast("starred", starredEvent{IDs: []string{}, Starred: starred, All: true})
+		}
+
+		dbLastAction = time.Now()
+
+		return int(total), nil
+	}
+
+	// find the messages which will change, the query is closed before the transaction begins
+	changed := []string{}
+	for _, chunk := range chunkIDs(ids, 1000) {
+		in, args := sqlPlaceholders(chunk)
+		if err := sqlf.From(tenant("mailbox")).
+			Select("ID").
+			Where("Starred = ?", oldStatus).
+			Where("Deleted = 0").
+			Where("ID IN "+in, args...).
+			QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+				var id string
+				if err := row.Scan(&id); err != nil {
+					logger.Log().Errorf("[db] %s", err.Error())
+					return
+				}
+				changed = append(changed, id)
+			}); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(changed) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	for _, chunk := range chunkIDs(changed, 1000) {
+		in, args := sqlPlaceholders(chunk)
+		if _, err := tx.Exec(`UPDATE `+tenant("mailbox")+` SET Starred = ? WHERE ID IN `+in, append([]interface{}{newStatus}, args...)...); err != nil { // #nosec
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	logger.Log().Debugf("[db] updated the starred status of %d messages in %s", len(changed), time.Since(start))
+
+	websockets.Broadcast("starred", starredEvent{IDs: changed, Starred: starred})
+
+	dbLastAction = time.Now()
+
+	return len(changed), nil
+}
@@ -4,6 +4,7 @@ import (
 	"net/mail"
 	"time"
 
+	"github.com/axllent/mailpit/internal/tools"
 	"github.com/jhillyerd/enmime"
 )
 
@@ -46,6 +47,51 @@ type Message struct {
 	Inline []Attachment
 	// Message attachments
 	Attachments []Attachment
+	// Content-ID to part ID mapping of inline parts & attachments, for rewriting cid: references
+	CIDMap map[string]string
+	// Spam & authentication results reported by upstream mail servers
+	Upstream Upstream
+	// Time the message was first opened, null if it has not been opened
+	FirstOpened *time.Time
+	// Key/value metadata
+	Metadata map[string]string
+	// How the message was received: smtp, smtps, lmtp, http-api, import, or unknown for messages stored before this was recorded
+	Via string
+	// Address of the listener the message was received on, if received via a listener
+	Listener string
+	// Whether the message is pinned, pinned messages are not deleted or pruned unless forced
+	Pinned bool
+	// Time the message expires & is automatically deleted (set via the X-Mailpit-TTL header), null if it does not expire
+	Expires *time.Time
+	// Whether the message is starred
+	Starred bool
+	// Number of times the message has been successfully released
+	ReleaseCount int
+	// SMTP session details, empty values if not received via SMTP
+	ServerInfo ServerInfo
+}
+
+// ServerInfo contains details about the SMTP session a message was received with
+//
+// swagger:model ServerInfo
+type ServerInfo struct {
+	// IP address of the client
+	ClientIP string
+	// Hostname supplied by the client with HELO or EHLO
+	Helo string
+	// Username the client authenticated with, empty if the session was not authenticated
+	AuthUser string
+}
+
+// Upstream contains the results of existing X-Spam-* & Authentication-Results
+// headers, as added by an upstream mail gateway
+//
+// swagger:model Upstream
+type Upstream struct {
+	// Upstream spam results, null if no X-Spam-* headers are set
+	Spam *tools.UpstreamSpam
+	// Parsed Authentication-Results headers
+	AuthenticationResults []tools.AuthenticationResults
 }
 
 // Attachment struct for inline and attachments
@@ -64,6 +110,46 @@ type Attachment struct {
 	Size float64
 }
 
+// CIDPart is a message part which has a Content-ID or is displayed inline
+//
+// swagger:model CIDPart
+type CIDPart struct {
+	// Content ID, null if the part is inline but has no Content-ID
+	ContentID *string
+	// Part ID
+	PartID string
+	// Content type
+	ContentType string
+	// Size in bytes
+	Size float64
+	// Whether the part is displayed inline (not an attachment)
+	Inline bool
+}
+
+// MessagePart is a node of the MIME part tree of a message
+//
+// swagger:model MessagePart
+type MessagePart struct {
+	// Part ID, as used to download the part
+	PartID string
+	// Content type
+	ContentType string
+	// Charset of the content
+	Charset string
+	// Content-Transfer-Encoding
+	TransferEncoding string
+	// Content-Disposition
+	Disposition string
+	// File name
+	FileName string
+	// Content ID
+	ContentID string
+	// Size of the decoded content in bytes (0 for multipart parts)
+	Size float64
+	// Nested parts of a multipart part
+	Children []MessagePart
+}
+
 // MessageSummary struct for frontend messages
 //
 // swagger:model MessageSummary
@@ -92,16 +178,43 @@ type MessageSummary struct {
 	Tags []string
 	// Message size in bytes (total)
 	Size float64
-	// Whether the message has any attachments
+	// Number of attachments
 	Attachments int
-	// Message snippet includes up to 250 characters
+	// Total size of all attachments in bytes
+	AttachmentsSize float64
+	// Message snippet of up to 160 characters of the message text (or HTML if there is no text part)
 	Snippet string
+	// Whether the message contained bare <CR> or <LF> line endings (normalised when received)
+	BareLineEndings bool
+	// Whether the message was received via SMTP over a TLS connection (STARTTLS or TLS listener)
+	TLS bool
+	// Whether the message was received via an authenticated SMTP session
+	Authenticated bool
+	// Key/value metadata
+	Metadata map[string]string
+	// Time the message was first opened, null if it has not been opened
+	FirstOpened *time.Time
+	// SpamAssassin score, null if the message has not been checked
+	SpamScore *float64
+	// HTML check score (overall percentage supported), null if the message has not been checked or does not contain HTML
+	HTMLScore *float64
+	// SMTP envelope recipients, only set when requested with `envelope=true`
+	EnvelopeTo []string `json:",omitempty"`
+	// Time the message was moved to the trash, only set when listing the trash
+	Trashed *time.Time `json:",omitempty"`
+	// Whether the message is pinned, pinned messages are not deleted or pruned unless forced
+	Pinned bool
+	// Whether the message is starred
+	Starred bool
+	// Number of times the message has been successfully released
+	ReleaseCount int
 }
 
 // MailboxStats struct for quick mailbox total/read lookups
 type MailboxStats struct {
 	Total  float64
 	Unread float64
+	Pinned float64
 	Tags   []string
 }
 
@@ -112,8 +225,271 @@ type DBMailSummary struct {
 	Cc      []*mail.Address
 	Bcc     []*mail.Address
 	ReplyTo []*mail.Address
+
+	// Total size of all attachments in bytes, set for messages stored by older
+	// versions by a background migration
+	AttachmentsSize float64 `json:",omitempty"`
+
+	// Inline parts & attachments, for attachment: & attachment-type: searches. Set for messages
+	// stored by older versions by a background migration.
+	Parts []DBPart `json:",omitempty"`
+
+	// The following are set when the message is received, and are not derived from the message itself
+	BareLineEndings bool   `json:",omitempty"`
+	TLS             bool   `json:",omitempty"`
+	Authenticated   bool   `json:",omitempty"`
+	Via             string `json:",omitempty"`
+	Listener        string `json:",omitempty"`
+
+	// Key/value metadata, set via the API or X-Mailpit-Meta-* headers
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// DBPart is a summary of an inline part or attachment stored in the message summary.
+// PartID, ContentID & Size are set for messages stored by older versions by a background migration.
+type DBPart struct {
+	PartID      string `json:",omitempty"`
+	FileName    string `json:",omitempty"`
+	ContentID   string `json:",omitempty"`
+	ContentType string
+	Size        float64 `json:",omitempty"`
+	// hex digests of the decoded content, not set for messages stored by older versions
+	MD5    string `json:",omitempty"`
+	SHA1   string `json:",omitempty"`
+	SHA256 string `json:",omitempty"`
+}
+
+// TagStats is a tag with the number of messages with the tag
+//
+// swagger:model TagStats
+type TagStats struct {
+	// Tag name
+	Name string
+	// Total number of messages with the tag
+	Total int
+	// Number of unread messages with the tag
+	Unread int
+	// Received time of the latest message with the tag
+	LatestCreated time.Time
+}
+
+// TagRule is a search which automatically tags matching messages when they are received
+//
+// swagger:model TagRule
+type TagRule struct {
+	// Rule ID
+	ID int
+	// Search query, see https://mailpit.axllent.org/docs/usage/search-filters/
+	Query string
+	// Tags added to matching messages
+	Tags []string
+}
+
+// ForwardRule is a search which automatically forwards matching messages received via SMTP to the recipients
+//
+// swagger:model ForwardRule
+type ForwardRule struct {
+	// Rule ID
+	ID int
+	// Search query, see https://mailpit.axllent.org/docs/usage/search-filters/
+	Query string
+	// Recipients matching messages are forwarded to
+	To []string
+	// Relay profile matching messages are forwarded via, empty for the main relay config
+	Profile string
+	// Number of messages forwarded by the rule
+	Forwarded int
 }
 
+// ReleaseJob is a scheduled release of a message via the pre-configured SMTP server
+//
+// swagger:model ReleaseJob
+type ReleaseJob struct {
+	// Release job ID
+	ID string
+	// Message database ID
+	MessageID string
+	// Time the release was scheduled
+	Created time.Time
+	// Time the message is due to be released
+	Due time.Time
+	// Email addresses to release the message to
+	To []string
+	// Optional From address to release the message as
+	From string
+	// Optional Subject to release the message with
+	Subject string
+	// Relay profile to release the message via
+	Profile string
+	// Whether to delete the message after it has been released
+	DeleteAfterRelease bool
+	// The error if the release failed, failed releases are not retried
+	Error string
+}
+
+// ReleaseHistory is a single release attempt of a message
+//
+// swagger:model ReleaseHistory
+type ReleaseHistory struct {
+	// Release attempt ID
+	ID int
+	// Message database ID
+	MessageID string
+	// Time of the release attempt
+	Created time.Time
+	// Email addresses the message was released to
+	To []string
+	// SMTP envelope sender (MAIL FROM) used for the release
+	MailFrom string
+	// Whether the relay server accepted the message
+	Success bool
+	// The SMTP error if the release failed
+	Error string
+	// IP address of the client which requested the release, empty for scheduled releases
+	ClientIP string
+	// Whether the message has since been deleted, only possible if `keep-release-history` is set in the relay config
+	Orphaned bool
+}
+
+// TagMeta is the metadata of a tag, shared by all users
+//
+// swagger:model TagMeta
+type TagMeta struct {
+	// Tag name
+	Tag string
+	// Color as #RRGGBB, empty if not set
+	Color string
+	// Description, empty if not set
+	Description string
+}
+
+// MessageTagsResult is the result of adding or removing the tags of a message
+//
+// swagger:model MessageTagsResult
+type MessageTagsResult struct {
+	// Database ID
+	ID string
+	// Tags which were added to the message
+	Added []string
+	// Tags which were removed from the message
+	Removed []string
+	// The resulting message tags
+	Tags []string
+	// Error, eg: if the message does not exist
+	Error string `json:",omitempty"`
+}
+
+// MessageEnvelope is the SMTP envelope & connection details of a message, as recorded when it was received.
+// The envelope recipients include any Bcc recipients, which are not necessarily in the message headers.
+//
+// swagger:model MessageEnvelope
+type MessageEnvelope struct {
+	// Database ID
+	ID string
+	// SMTP envelope sender (MAIL FROM), empty for a null sender
+	From string
+	// SMTP envelope recipients (RCPT TO)
+	To []string
+	// IP address of the client
+	ClientIP string
+	// Hostname supplied by the client with HELO or EHLO
+	Helo string
+	// Username the client authenticated with, empty if the session was not authenticated
+	AuthUser string
+	// Whether the message was received over a TLS connection (STARTTLS or TLS listener)
+	TLS bool
+	// Whether the message was received via an authenticated SMTP session
+	Authenticated bool
+	// How the message was received, eg: smtp, smtps, lmtp, http-api, import or unknown
+	Via string
+}
+
+// AttachmentChecksum is the size & digests of the decoded content of an inline part or attachment
+//
+// swagger:model AttachmentChecksum
+type AttachmentChecksum struct {
+	// Size in bytes
+	Size float64
+	// MD5 hex digest
+	MD5 string
+	// SHA1 hex digest
+	SHA1 string
+	// SHA256 hex digest
+	SHA256 string
+}
+
+// MessageAttachment is an inline part or attachment with the details of its message
+//
+// swagger:model MessageAttachment
+type MessageAttachment struct {
+	// Message database ID
+	MessageID string
+	// Attachment part ID
+	PartID string
+	// File name, or the Content ID if the part has no file name
+	FileName string
+	// Content type
+	ContentType string
+	// Size in bytes
+	Size float64
+	// Time the message was received
+	Created time.Time
+	// Message subject
+	Subject string
+	// Message From address
+	From *mail.Address
+}
+
+// StoreOptions are optional details about how a message was received
+type StoreOptions struct {
+	// The message contained bare <CR> or <LF> line endings (normalised)
+	BareLineEndings bool
+	// The message was received over a TLS connection
+	TLS bool
+	// The SMTP session was authenticated
+	Authenticated bool
+	// How the message was received, eg: ViaSMTP
+	Via string
+	// Address of the listener the message was received on
+	Listener string
+	// SMTP envelope sender
+	From string
+	// SMTP envelope recipients
+	To []string
+	// IP address of the client
+	ClientIP string
+	// Hostname supplied by the client with HELO or EHLO
+	Helo string
+	// Username the SMTP session was authenticated with (never the password)
+	AuthUser string
+	// Time the message expires & is automatically deleted, zero if it does not expire
+	Expires time.Time
+}
+
+// TagFilter restricts a list of messages to messages with the tags, either all of the tags (default) or any of the tags
+type TagFilter struct {
+	// Tag names, compared case-insensitively
+	Tags []string
+	// Match messages with any of the tags instead of all of the tags
+	Any bool
+}
+
+// Message ingress sources, see StoreOptions.Via
+const (
+	// ViaSMTP is a message received via SMTP (including STARTTLS)
+	ViaSMTP = "smtp"
+	// ViaSMTPS is a message received via an SMTP TLS listener
+	ViaSMTPS = "smtps"
+	// ViaLMTP is a message received via LMTP
+	ViaLMTP = "lmtp"
+	// ViaHTTPAPI is a message submitted via the HTTP API
+	ViaHTTPAPI = "http-api"
+	// ViaImport is a message stored directly in the database with the ingest command
+	ViaImport = "import"
+	// ViaUnknown is a message stored before the ingress source was recorded
+	ViaUnknown = "unknown"
+)
+
 // AttachmentSummary returns a summary of the attachment without any binary data
 func AttachmentSummary(a *enmime.Part) Attachment {
 	o := Attachment{}
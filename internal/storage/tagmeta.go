@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// MaxTagDescriptionLength is the maximum number of characters in a tag description
+const MaxTagDescriptionLength = 200
+
+var tagColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// GetTagMeta returns the metadata of all tags, ordered by tag name. Metadata is kept
+// when a tag is no longer used by any messages.
+func GetTagMeta() ([]TagMeta, error) {
+	meta := []TagMeta{}
+
+	if err := sqlf.From(tenant("tag_meta")).
+		Select("Tag, Color, Description").
+		OrderBy("Tag").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var m TagMeta
+
+			if err := row.Scan(&m.Tag, &m.Color, &m.Description); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			meta = append(meta, m)
+		}); err != nil {
+		return meta, err
+	}
+
+	return meta, nil
+}
+
+// SetTagMeta sets the color (#RRGGBB) & description of a tag, replacing any existing metadata.
+// The metadata is removed if both the color & description are empty. The tag does not need to
+// be in use, and an error is returned if the tag name, color or description is invalid.
+func SetTagMeta(tag, color, description string) (TagMeta, error) {
+	m, err := validateTagMeta(tag, color, description)
+	if err != nil {
+		return m, err
+	}
+
+	if m.Color == "" && m.Description == "" {
+		_, err := db.Exec(`DELETE FROM `+tenant("tag_meta")+` WHERE Tag = ?`, m.Tag)
+		return m, err
+	}
+
+	_, err = db.Exec(`INSERT INTO `+tenant("tag_meta")+` (Tag, Color, Description) VALUES (?, ?, ?)
+		ON CONFLICT(Tag) DO UPDATE SET Tag = ?, Color = ?, Description = ?`,
+		m.Tag, m.Color, m.Description, m.Tag, m.Color, m.Description)
+
+	return m, err
+}
+
+// ValidateTagMeta returns the tag metadata with the cleaned tag name, lowercase color & trimmed description,
+// or an error if the tag name, color or description is invalid
+func validateTagMeta(tag, color, description string) (TagMeta, error) {
+	m := TagMeta{Color: strings.ToLower(strings.TrimSpace(color)), Description: strings.TrimSpace(description)}
+
+	tags, err := cleanTags([]string{tag})
+	if err != nil {
+		return m, err
+	}
+	if len(tags) == 0 {
+		return m, InvalidTagsError{Tags: []string{tag}}
+	}
+	m.Tag = tags[0]
+
+	if m.Color != "" && !tagColorRe.MatchString(m.Color) {
+		return m, fmt.Errorf("invalid color (%s), eg: #1e90ff", color)
+	}
+
+	if utf8.RuneCountInString(m.Description) > MaxTagDescriptionLength {
+		return m, fmt.Errorf("description can be up to %d characters", MaxTagDescriptionLength)
+	}
+
+	return m, nil
+}
+
+// RenameTagMeta moves the metadata of a tag to its new name within a tag rename, replacing
+// the metadata of the target tag. The target metadata is kept if the tag has no metadata.
+func renameTagMeta(tx *sql.Tx, from, to string) error {
+	var tag string
+	err := tx.QueryRow(`SELECT Tag FROM `+tenant("tag_meta")+` WHERE Tag = ?`, from).Scan(&tag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// tag names are case-insensitive, so a change of case is the same row
+	if !strings.EqualFold(tag, to) {
+		if _, err := tx.Exec(`DELETE FROM `+tenant("tag_meta")+` WHERE Tag = ?`, to); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE `+tenant("tag_meta")+` SET Tag = ? WHERE Tag = ?`, to, tag)
+
+	return err
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/leporo/sqlf"
+)
+
+// ErrTagRuleNotFound is returned when a tag rule does not exist
+var ErrTagRuleNotFound = errors.New("tag rule not found")
+
+// GetTagRules returns all tag rules in the order they are applied
+func GetTagRules() ([]TagRule, error) {
+	rules := []TagRule{}
+
+	if err := sqlf.From(tenant("tag_rules")).
+		Select("ID, Query, Tags").
+		OrderBy("ID").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var r TagRule
+			var tags string
+
+			if err := row.Scan(&r.ID, &r.Query, &tags); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			if err := json.Unmarshal([]byte(tags), &r.Tags); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			rules = append(rules, r)
+		}); err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+// AddTagRule adds a tag rule, which is applied after all existing rules.
+// An error is returned if the search query or any of the tags are invalid.
+func AddTagRule(query string, tags []string) (TagRule, error) {
+	r, err := validateTagRule(query, tags)
+	if err != nil {
+		return r, err
+	}
+
+	b, err := json.Marshal(r.Tags)
+	if err != nil {
+		return r, err
+	}
+
+	res, err := db.Exec(`INSERT INTO `+tenant("tag_rules")+` (Query, Tags) VALUES (?, ?)`, r.Query, string(b))
+	if err != nil {
+		return r, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return r, err
+	}
+
+	r.ID = int(id)
+
+	return r, nil
+}
+
+// UpdateTagRule updates the search query & tags of a tag rule.
+// ErrTagRuleNotFound is returned if the rule does not exist, or an error if the search query or any of the tags are invalid.
+func UpdateTagRule(id int, query string, tags []string) (TagRule, error) {
+	r, err := validateTagRule(query, tags)
+	if err != nil {
+		return r, err
+	}
+
+	r.ID = id
+
+	b, err := json.Marshal(r.Tags)
+	if err != nil {
+		return r, err
+	}
+
+	res, err := db.Exec(`UPDATE `+tenant("tag_rules")+` SET Query = ?, Tags = ? WHERE ID = ?`, r.Query, string(b), id)
+	if err != nil {
+		return r, err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return r, ErrTagRuleNotFound
+	}
+
+	return r, nil
+}
+
+// DeleteTagRule deletes a tag rule, ErrTagRuleNotFound is returned if the rule does not exist.
+// Tags which have already been applied are not removed.
+func DeleteTagRule(id int) error {
+	res, err := db.Exec(`DELETE FROM `+tenant("tag_rules")+` WHERE ID = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTagRuleNotFound
+	}
+
+	return nil
+}
+
+// ApplyTagRules applies all tag rules to the existing messages, adding the tags of each rule to the messages
+// matching its search. Existing tags are preserved. Returns the number of messages with added tags.
+func ApplyTagRules() (int, error) {
+	rules, err := GetTagRules()
+	if err != nil {
+		return 0, err
+	}
+
+	updated := map[string]bool{}
+
+	for _, r := range rules {
+		ids, err := SearchIDs(r.Query, "")
+		if err != nil {
+			return len(updated), err
+		}
+
+		results, err := AddMessageTags(ids, r.Tags)
+		if err != nil {
+			return len(updated), err
+		}
+
+		for _, res := range results {
+			if len(res.Added) > 0 {
+				updated[res.ID] = true
+			}
+		}
+	}
+
+	if len(updated) > 0 {
+		dbLastAction = time.Now()
+		BroadcastMailboxStats()
+	}
+
+	return len(updated), nil
+}
+
+// ValidateTagRule returns a tag rule with the trimmed search query & cleaned tags, or an error if either are invalid
+func validateTagRule(query string, tags []string) (TagRule, error) {
+	r := TagRule{Query: strings.TrimSpace(query)}
+
+	if r.Query == "" {
+		return r, errors.New("no search query")
+	}
+
+	q, err := searchQueryBuilder(r.Query, "")
+	if err != nil {
+		return r, err
+	}
+	q.Close()
+
+	r.Tags, err = cleanTags(tags)
+	if err != nil {
+		return r, err
+	}
+
+	if len(r.Tags) == 0 {
+		return r, errors.New("no tags")
+	}
+
+	return r, nil
+}
+
+// MatchingTagRules returns the tag rules matching a message, in the order they are applied
+func matchingTagRules(id string) ([]TagRule, error) {
+	matches := []TagRule{}
+
+	rules, err := GetTagRules()
+	if err != nil || len(rules) == 0 {
+		return matches, err
+	}
+
+	for _, r := range rules {
+		match, err := messageMatchesQuery(id, r.Query)
+		if err != nil {
+			logger.Log().Warnf("[tags] invalid tag rule %d: %s", r.ID, err.Error())
+			continue
+		}
+
+		if match {
+			matches = append(matches, r)
+		}
+	}
+
+	return matches, nil
+}
+
+// MessageMatchesQuery returns whether a message matches a search query
+func messageMatchesQuery(id, query string) (bool, error) {
+	q, err := searchQueryBuilder(query, "")
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+
+	var match int
+	err = db.QueryRow(`SELECT COUNT(*) FROM (`+q.String()+`) s WHERE s.ID = ?`, append(q.Args(), id)...).Scan(&match) // #nosec
+
+	return match > 0, err
+}
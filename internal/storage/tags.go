@@ -3,57 +3,582 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/tools"
+	"github.com/axllent/mailpit/server/webhook"
 	"github.com/leporo/sqlf"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
 )
 
 var (
 	addressPlusRe = regexp.MustCompile(`(?U)^(.*){1,}\+(.*)@`)
+
+	multiSpaceRe = regexp.MustCompile(`\s+`)
 )
 
-// SetMessageTags will set the tags for a given database ID
+// MaxTagLength is the maximum number of characters in a tag name
+const MaxTagLength = 64
+
+// ErrTagNotFound is returned when a tag does not exist
+var ErrTagNotFound = errors.New("tag not found")
+
+// InvalidTagsError is returned when one or more tag names are invalid
+type InvalidTagsError struct {
+	Tags []string
+}
+
+func (e InvalidTagsError) Error() string {
+	return fmt.Sprintf("invalid tag names: %q - tags can be up to %d characters, and can only contain spaces, letters, numbers, -, _ & .",
+		e.Tags, MaxTagLength)
+}
+
+// NormaliseTag returns the normalised form of a tag name by trimming & collapsing whitespace,
+// and applying title case if enabled. Tag names are compared case-insensitively, and the
+// casing of the first-seen tag is used for display.
+func NormaliseTag(s string) string {
+	s = strings.TrimSpace(multiSpaceRe.ReplaceAllString(s, " "))
+
+	if tools.TagsTitleCase {
+		return cases.Title(language.Und, cases.NoLower).String(s)
+	}
+
+	return s
+}
+
+// ValidTag returns whether a normalised tag name is valid
+func ValidTag(s string) bool {
+	return s != "" && len(s) <= MaxTagLength && config.ValidTagRegexp.MatchString(s)
+}
+
+// SetMessageTags will set the tags for a given database ID.
+// An InvalidTagsError is returned (without changes) if any of the tags are invalid.
 func SetMessageTags(id string, tags []string) error {
+	return SetTagsForIDs([]string{id}, tags)
+}
+
+// SetTagsForIDs will set the tags for multiple database IDs. Unused tags are pruned & the
+// webhook is sent once for all changed messages.
+// An InvalidTagsError is returned (without changes) if any of the tags are invalid.
+func SetTagsForIDs(ids []string, tags []string) error {
+	applyTags, err := cleanTags(tags)
+	if err != nil {
+		return err
+	}
+
+	changedMessages := []webhook.MessageTags{}
+	prune := false
+
+	for _, id := range ids {
+		changed, removed, err := applyMessageTags(id, applyTags)
+		if removed {
+			prune = true
+		}
+		if err != nil {
+			return err
+		}
+		if changed {
+			newTags := getMessageTags(id)
+			changedMessages = append(changedMessages, webhook.MessageTags{ID: id, Tags: newTags})
+			AddMessageEvent(id, EventTagsChanged, map[string]string{"tags": strings.Join(newTags, ", ")})
+		}
+	}
+
+	if prune {
+		if err := pruneUnusedTags(); err != nil {
+			return err
+		}
+	}
+
+	if len(changedMessages) > 0 {
+		webhook.Dispatch(webhook.MessageTagsChanged, webhook.TagsData{Messages: changedMessages})
+		dbLastAction = time.Now()
+	}
+
+	return nil
+}
+
+// AddMessageTags adds tags to multiple database IDs, preserving their existing tags, returning the result
+// for each message. Tags are added in a transaction per message, and adding an existing tag has no effect.
+// An InvalidTagsError is returned (without changes) if any of the tags are invalid.
+func AddMessageTags(ids []string, tags []string) ([]MessageTagsResult, error) {
+	return patchMessagesTags(ids, tags, true)
+}
+
+// RemoveMessageTags removes tags from multiple database IDs, preserving their other tags, returning the result
+// for each message. Tags are removed in a transaction per message, and removing a missing tag has no effect.
+// An InvalidTagsError is returned (without changes) if any of the tags are invalid.
+func RemoveMessageTags(ids []string, tags []string) ([]MessageTagsResult, error) {
+	return patchMessagesTags(ids, tags, false)
+}
+
+// PatchMessagesTags adds or removes tags of multiple database IDs. Unused tags are pruned & the
+// webhook is sent once for all changed messages.
+func patchMessagesTags(ids []string, tags []string, add bool) ([]MessageTagsResult, error) {
+	results := []MessageTagsResult{}
+
+	applyTags, err := cleanTags(tags)
+	if err != nil {
+		return results, err
+	}
+
+	changedMessages := []webhook.MessageTags{}
+
+	for _, id := range ids {
+		res, err := patchMessageTags(id, applyTags, add)
+		if err != nil {
+			return results, err
+		}
+
+		results = append(results, res)
+
+		if len(res.Added) > 0 || len(res.Removed) > 0 {
+			changedMessages = append(changedMessages, webhook.MessageTags{ID: id, Tags: res.Tags})
+			AddMessageEvent(id, EventTagsChanged, map[string]string{"tags": strings.Join(res.Tags, ", ")})
+		}
+	}
+
+	if !add && len(changedMessages) > 0 {
+		if err := pruneUnusedTags(); err != nil {
+			return results, err
+		}
+	}
+
+	if len(changedMessages) > 0 {
+		webhook.Dispatch(webhook.MessageTagsChanged, webhook.TagsData{Messages: changedMessages})
+		dbLastAction = time.Now()
+	}
+
+	return results, nil
+}
+
+// PatchMessageTags adds or removes the (cleaned) tags of a message in a single transaction
+func patchMessageTags(id string, tags []string, add bool) (MessageTagsResult, error) {
+	res := MessageTagsResult{ID: id, Added: []string{}, Removed: []string{}, Tags: []string{}}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return res, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM `+tenant("mailbox")+` WHERE ID = ?`, id).Scan(&exists); err != nil {
+		return res, err
+	}
+
+	if exists == 0 {
+		res.Error = ErrMessageNotFound.Error()
+		return res, nil
+	}
+
+	current := []string{}
+	rows, err := tx.Query(`SELECT t.Name FROM `+tenant("message_tags")+` mt JOIN `+tenant("tags")+` t ON mt.TagID = t.ID WHERE mt.ID = ?`, id)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return res, err
+		}
+		current = append(current, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+
+	for _, t := range tags {
+		has := inArray(t, current)
+
+		if add && !has {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO `+tenant("tags")+` (Name) VALUES (?)`, t); err != nil {
+				return res, err
+			}
+
+			// the casing of an existing tag is retained
+			var name string
+			if err := tx.QueryRow(`SELECT Name FROM `+tenant("tags")+` WHERE Name = ?`, t).Scan(&name); err != nil {
+				return res, err
+			}
+
+			if _, err := tx.Exec(`INSERT INTO `+tenant("message_tags")+` (ID, TagID) SELECT ?, ID FROM `+tenant("tags")+` WHERE Name = ?`, id, t); err != nil {
+				return res, err
+			}
+
+			res.Added = append(res.Added, name)
+			current = append(current, name)
+		} else if !add && has {
+			if _, err := tx.Exec(`DELETE FROM `+tenant("message_tags")+` WHERE ID = ? AND TagID IN (SELECT ID FROM `+tenant("tags")+` WHERE Name = ?)`, id, t); err != nil {
+				return res, err
+			}
+
+			for _, c := range current {
+				if strings.EqualFold(c, t) {
+					res.Removed = append(res.Removed, c)
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+
+	res.Tags = getMessageTags(id)
+
+	return res, nil
+}
+
+// SetSearchTags sets the tags of all messages matching a search in a single transaction, returning the
+// number of matching & updated messages. If appendTags is true, the tags are added to the existing tags.
+// Unused tags are pruned & the webhook is sent once for all changed messages.
+// An InvalidTagsError is returned (without changes) if any of the tags are invalid.
+func SetSearchTags(search, timezone string, tags []string, appendTags bool) (int, int, error) {
+	applyTags, err := cleanTags(tags)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ids, err := SearchIDs(search, timezone)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+
+	currentTags, err := getMessagesTags(ids)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	for _, t := range applyTags {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO `+tenant("tags")+` (Name) VALUES (?)`, t); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	changedIDs := []string{}
+	removed := false
+
+	for _, id := range ids {
+		changed := false
+
+		for _, t := range applyTags {
+			if inArray(t, currentTags[id]) {
+				continue
+			}
+
+			if _, err := tx.Exec(`INSERT INTO `+tenant("message_tags")+` (ID, TagID) SELECT ?, ID FROM `+tenant("tags")+` WHERE Name = ?`, id, t); err != nil {
+				return 0, 0, err
+			}
+			changed = true
+		}
+
+		if !appendTags {
+			for _, t := range currentTags[id] {
+				if inArray(t, applyTags) {
+					continue
+				}
+
+				if _, err := tx.Exec(`DELETE FROM `+tenant("message_tags")+` WHERE ID = ? AND TagID IN (SELECT ID FROM `+tenant("tags")+` WHERE Name = ?)`, id, t); err != nil {
+					return 0, 0, err
+				}
+				changed = true
+				removed = true
+			}
+		}
+
+		if changed {
+			changedIDs = append(changedIDs, id)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	if removed {
+		if err := pruneUnusedTags(); err != nil {
+			return len(ids), len(changedIDs), err
+		}
+	}
+
+	if len(changedIDs) > 0 {
+		changedMessages := []webhook.MessageTags{}
+		for _, id := range changedIDs {
+			newTags := getMessageTags(id)
+			changedMessages = append(changedMessages, webhook.MessageTags{ID: id, Tags: newTags})
+			AddMessageEvent(id, EventTagsChanged, map[string]string{"tags": strings.Join(newTags, ", ")})
+		}
+
+		webhook.Dispatch(webhook.MessageTagsChanged, webhook.TagsData{Messages: changedMessages})
+		dbLastAction = time.Now()
+	}
+
+	return len(ids), len(changedIDs), nil
+}
+
+// RenameTag renames a tag across all messages in a single transaction, returning the number of messages affected.
+// If a tag with the new name already exists then the tags are merged. Tag metadata (see SetTagMeta) is moved to the
+// new name. The tag name is validated in the same way as
+// SetMessageTags, and an InvalidTagsError is returned (without changes) if it is invalid.
+// ErrTagNotFound is returned if the tag does not exist.
+func RenameTag(from, to string) (int, error) {
+	applyTags, err := cleanTags([]string{to})
+	if err != nil {
+		return 0, err
+	}
+	if len(applyTags) == 0 {
+		return 0, InvalidTagsError{Tags: []string{to}}
+	}
+	name := applyTags[0]
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	var fromID int
+	if err := tx.QueryRow(`SELECT ID FROM `+tenant("tags")+` WHERE Name = ?`, NormaliseTag(from)).Scan(&fromID); err == sql.ErrNoRows {
+		return 0, ErrTagNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	ids, err := taggedMessageIDs(tx, fromID)
+	if err != nil {
+		return 0, err
+	}
+
+	var toID int
+	err = tx.QueryRow(`SELECT ID FROM `+tenant("tags")+` WHERE Name = ?`, name).Scan(&toID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if err == nil && toID != fromID {
+		logger.Log().Debugf("[tags] merging tag \"%s\" into \"%s\"", from, name)
+
+		if _, err := tx.Exec(`UPDATE `+tenant("message_tags")+` SET TagID = ? WHERE TagID = ?`, toID, fromID); err != nil {
+			return 0, err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM `+tenant("tags")+` WHERE ID = ?`, fromID); err != nil {
+			return 0, err
+		}
+
+		// remove messages tagged more than once with the merged tag
+		if _, err := tx.Exec(`DELETE FROM `+tenant("message_tags")+` WHERE TagID = ? AND Key NOT IN
+			(SELECT MIN(Key) FROM `+tenant("message_tags")+` WHERE TagID = ? GROUP BY ID)`, toID, toID); err != nil {
+			return 0, err
+		}
+	} else {
+		logger.Log().Debugf("[tags] renaming tag \"%s\" to \"%s\"", from, name)
+
+		// tag names are case-insensitive, so this also applies a change of case
+		if _, err := tx.Exec(`UPDATE `+tenant("tags")+` SET Name = ? WHERE ID = ?`, name, fromID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := renameTagMeta(tx, NormaliseTag(from), name); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	tagsChanged(ids)
+
+	return len(ids), nil
+}
+
+// DeleteTag removes a tag from all messages in a single transaction, returning the number of messages affected.
+// Tag names are compared case-insensitively, and 0 is returned if the tag does not exist. The tag metadata is also removed.
+func DeleteTag(name string) (int, error) {
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	var tagID int
+	if err := tx.QueryRow(`SELECT ID FROM `+tenant("tags")+` WHERE Name = ?`, NormaliseTag(name)).Scan(&tagID); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	ids, err := taggedMessageIDs(tx, tagID)
+	if err != nil {
+		return 0, err
+	}
+
+	logger.Log().Debugf("[tags] deleting tag \"%s\" from %d messages", name, len(ids))
+
+	if _, err := tx.Exec(`DELETE FROM `+tenant("message_tags")+` WHERE TagID = ?`, tagID); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM `+tenant("tags")+` WHERE ID = ?`, tagID); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM `+tenant("tag_meta")+` WHERE Tag = ?`, NormaliseTag(name)); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	tagsChanged(ids)
+
+	return len(ids), nil
+}
+
+// TaggedMessageIDs returns the IDs of all messages with a tag
+func taggedMessageIDs(tx *sql.Tx, tagID int) ([]string, error) {
+	ids := []string{}
+
+	rows, err := tx.Query(`SELECT DISTINCT ID FROM `+tenant("message_tags")+` WHERE TagID = ?`, tagID)
+	if err != nil {
+		return ids, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// TagsChanged records the tag change events of messages after a tag is renamed or deleted, sends the
+// webhook once for all changed messages, and broadcasts the mailbox stats (including tags) to the web UI
+func tagsChanged(ids []string) {
+	if len(ids) > 0 {
+		changedMessages := []webhook.MessageTags{}
+		for _, id := range ids {
+			newTags := getMessageTags(id)
+			changedMessages = append(changedMessages, webhook.MessageTags{ID: id, Tags: newTags})
+			AddMessageEvent(id, EventTagsChanged, map[string]string{"tags": strings.Join(newTags, ", ")})
+		}
+
+		webhook.Dispatch(webhook.MessageTagsChanged, webhook.TagsData{Messages: changedMessages})
+	}
+
+	dbLastAction = time.Now()
+
+	BroadcastMailboxStats()
+}
+
+// SetMessageTags sets the tags for a given database ID without any notifications,
+// returning whether the tags were changed
+func setMessageTags(id string, tags []string) (bool, error) {
+	applyTags, err := cleanTags(tags)
+	if err != nil {
+		return false, err
+	}
+
+	changed, removed, err := applyMessageTags(id, applyTags)
+	if removed {
+		if err := pruneUnusedTags(); err != nil {
+			return changed, err
+		}
+	}
+
+	return changed, err
+}
+
+// CleanTags returns the normalised unique tags, or an InvalidTagsError if any of the tags are invalid
+func cleanTags(tags []string) ([]string, error) {
 	applyTags := []string{}
+	invalid := []string{}
 	for _, t := range tags {
-		t = tools.CleanTag(t)
-		if t != "" && config.ValidTagRegexp.MatchString(t) && !inArray(t, applyTags) {
-			applyTags = append(applyTags, t)
+		n := NormaliseTag(t)
+		if n == "" {
+			continue
+		}
+		if !ValidTag(n) {
+			invalid = append(invalid, t)
+			continue
+		}
+		if !inArray(n, applyTags) {
+			applyTags = append(applyTags, n)
 		}
 	}
 
+	if len(invalid) > 0 {
+		return nil, InvalidTagsError{Tags: invalid}
+	}
+
+	return applyTags, nil
+}
+
+// ApplyMessageTags sets the (cleaned) tags of a message, returning whether the tags were changed
+// & whether any tags were removed. Unused tags are not pruned.
+func applyMessageTags(id string, applyTags []string) (bool, bool, error) {
 	currentTags := getMessageTags(id)
-	origTagCount := len(currentTags)
+	changed := false
+	removed := false
 
 	for _, t := range applyTags {
-		t = tools.CleanTag(t)
-		if t == "" || !config.ValidTagRegexp.MatchString(t) || inArray(t, currentTags) {
+		if inArray(t, currentTags) {
 			continue
 		}
 
 		if err := AddMessageTag(id, t); err != nil {
-			return err
+			return changed, removed, err
 		}
+		changed = true
 	}
 
-	if origTagCount > 0 {
-		currentTags = getMessageTags(id)
-
-		for _, t := range currentTags {
-			if !inArray(t, applyTags) {
-				if err := DeleteMessageTag(id, t); err != nil {
-					return err
-				}
+	for _, t := range currentTags {
+		if !inArray(t, applyTags) {
+			if err := deleteMessageTag(id, t); err != nil {
+				return changed, removed, err
 			}
+			changed = true
+			removed = true
 		}
 	}
 
-	return nil
+	return changed, removed, nil
 }
 
 // AddMessageTag adds a tag to a message
@@ -103,16 +628,23 @@ func AddMessageTag(id, name string) error {
 
 // DeleteMessageTag deleted a tag from a message
 func DeleteMessageTag(id, name string) error {
-	if _, err := sqlf.DeleteFrom(tenant("message_tags")).
-		Where(tenant("message_tags.ID")+" = ?", id).
-		Where(tenant("message_tags.Key")+` IN (SELECT Key FROM `+tenant("message_tags")+` LEFT JOIN tags ON `+tenant("TagID")+"="+tenant("tags.ID")+` WHERE Name = ?)`, name).
-		ExecAndClose(context.TODO(), db); err != nil {
+	if err := deleteMessageTag(id, name); err != nil {
 		return err
 	}
 
 	return pruneUnusedTags()
 }
 
+// DeleteMessageTag deletes a tag from a message without pruning unused tags
+func deleteMessageTag(id, name string) error {
+	_, err := sqlf.DeleteFrom(tenant("message_tags")).
+		Where(tenant("message_tags.ID")+" = ?", id).
+		Where(tenant("message_tags.Key")+` IN (SELECT Key FROM `+tenant("message_tags")+` LEFT JOIN tags ON `+tenant("TagID")+"="+tenant("tags.ID")+` WHERE Name = ?)`, name).
+		ExecAndClose(context.TODO(), db)
+
+	return err
+}
+
 // DeleteAllMessageTags deleted all tags from a message
 func DeleteAllMessageTags(id string) error {
 	if _, err := sqlf.DeleteFrom(tenant("message_tags")).
@@ -124,15 +656,18 @@ func DeleteAllMessageTags(id string) error {
 	return pruneUnusedTags()
 }
 
-// GetAllTags returns all used tags
+// GetAllTags returns all tags used by messages which are not in the trash
 func GetAllTags() []string {
 	var tags = []string{}
 	var name string
 
 	if err := sqlf.
-		Select(`DISTINCT Name`).
-		From(tenant("tags")).To(&name).
-		OrderBy("Name").
+		Select(`DISTINCT t.Name`).To(&name).
+		From(tenant("tags")+" t").
+		Join(tenant("message_tags")+" mt", "mt.TagID = t.ID").
+		Join(tenant("mailbox")+" m", "m.ID = mt.ID").
+		Where("m.Deleted = 0").
+		OrderBy("t.Name").
 		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
 			tags = append(tags, name)
 		}); err != nil {
@@ -142,22 +677,23 @@ func GetAllTags() []string {
 	return tags
 }
 
-// GetAllTagsCount returns all used tags with their total messages
+// GetAllTagsCount returns all tags used by messages which are not in the trash, with their total messages
 func GetAllTagsCount() map[string]int64 {
 	var tags = make(map[string]int64)
 	var name string
 	var total int64
 
 	if err := sqlf.
-		Select(`Name`).To(&name).
-		Select(`COUNT(`+tenant("message_tags.TagID")+`) as total`).To(&total).
-		From(tenant("tags")).
-		LeftJoin(tenant("message_tags"), tenant("tags.ID")+" = "+tenant("message_tags.TagID")).
-		GroupBy(tenant("message_tags.TagID")).
-		OrderBy("Name").
+		Select(`t.Name`).To(&name).
+		Select(`COUNT(m.ID) as total`).To(&total).
+		From(tenant("tags")+" t").
+		Join(tenant("message_tags")+" mt", "mt.TagID = t.ID").
+		Join(tenant("mailbox")+" m", "m.ID = mt.ID").
+		Where("m.Deleted = 0").
+		GroupBy("t.ID").
+		OrderBy("t.Name").
 		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
 			tags[name] = total
-			// tags = append(tags, name)
 		}); err != nil {
 		logger.Log().Errorf("[db] %s", err.Error())
 	}
@@ -165,6 +701,64 @@ func GetAllTagsCount() map[string]int64 {
 	return tags
 }
 
+// GetTagStats returns all used tags ordered by name, with the total & unread number of messages with
+// each tag, and the received time of the latest message with each tag
+func GetTagStats() ([]TagStats, error) {
+	stats := []TagStats{}
+
+	if err := sqlf.
+		Select(`t.Name, COUNT(m.ID), SUM(CASE WHEN m.Read = 0 THEN 1 ELSE 0 END), MAX(m.Created)`).
+		From(tenant("tags")+" t").
+		Join(tenant("message_tags")+" mt", "mt.TagID = t.ID").
+		Join(tenant("mailbox")+" m", "m.ID = mt.ID").
+		Where("m.Deleted = 0").
+		GroupBy("t.ID").
+		OrderBy("t.Name").
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var s TagStats
+			var latest float64
+
+			if err := row.Scan(&s.Name, &s.Total, &s.Unread, &latest); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+
+			s.LatestCreated = time.UnixMilli(int64(latest))
+			stats = append(stats, s)
+		}); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// Where returns the SQL condition & arguments of a tag filter, or an empty condition if no tags are set
+func (f TagFilter) where() (string, []interface{}) {
+	args := []interface{}{}
+	for _, t := range f.Tags {
+		if t = NormaliseTag(t); t != "" {
+			args = append(args, t)
+		}
+	}
+
+	if len(args) == 0 {
+		return "", args
+	}
+
+	sub := `m.ID IN (SELECT mt.ID FROM ` + tenant("message_tags") + ` mt JOIN ` + tenant("tags") + ` t ON mt.TagID = t.ID WHERE t.Name`
+
+	if f.Any {
+		return sub + ` IN (?` + strings.Repeat(",?", len(args)-1) + `))`, args
+	}
+
+	where := []string{}
+	for range args {
+		where = append(where, sub+` = ?)`)
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
 // PruneUnusedTags will delete all unused tags from the database
 func pruneUnusedTags() error {
 	q := sqlf.From(tenant("tags")).
@@ -193,34 +787,36 @@ func pruneUnusedTags() error {
 	}
 
 	if len(toDel) > 0 {
-		for _, id := range toDel {
-			if _, err := sqlf.DeleteFrom(tenant("tags")).
-				Where("ID = ?", id).
-				ExecAndClose(context.TODO(), db); err != nil {
-				return err
-			}
+		args := make([]interface{}, len(toDel))
+		for i, id := range toDel {
+			args[i] = id
+		}
+
+		if _, err := sqlf.DeleteFrom(tenant("tags")).
+			Where("ID IN (?"+strings.Repeat(",?", len(toDel)-1)+")", args...).
+			ExecAndClose(context.TODO(), db); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// Find tags set via --tags in raw message.
-// Returns a comma-separated string.
-func findTagsInRawMessage(message *[]byte) string {
-	tagStr := ""
+// Find tag rules set via --tags matching the raw message
+func findTagRulesInRawMessage(message *[]byte) []config.AutoTag {
+	matches := []config.AutoTag{}
 	if len(config.SMTPTags) == 0 {
-		return tagStr
+		return matches
 	}
 
 	str := strings.ToLower(string(*message))
 	for _, t := range config.SMTPTags {
 		if strings.Contains(str, t.Match) {
-			tagStr += "," + t.Tag
+			matches = append(matches, t)
 		}
 	}
 
-	return tagStr
+	return matches
 }
 
 // Returns tags found in email plus addresses (eg: test+tagname@example.com)
@@ -252,6 +848,20 @@ func (d DBMailSummary) tagsFromPlusAddresses() string {
 	return strings.Join(tags, ",")
 }
 
+// Returns tags found in SMTP envelope recipient plus addresses (eg: test+tagname@example.com),
+// used if config.TagsFromPlusAddress is enabled
+func tagsFromEnvelopeRecipients(to []string) string {
+	tags := []string{}
+	for _, a := range to {
+		matches := addressPlusRe.FindAllStringSubmatch(a, 1)
+		if len(matches) == 1 {
+			tags = append(tags, strings.Split(matches[0][2], "+")...)
+		}
+	}
+
+	return strings.Join(tags, ",")
+}
+
 // Get message tags from the database for a given database ID
 // Used when parsing a raw email.
 func getMessageTags(id string) []string {
@@ -274,6 +884,33 @@ func getMessageTags(id string) []string {
 	return tags
 }
 
+// Get the tags of multiple messages, keyed by database ID
+func getMessagesTags(ids []string) (map[string][]string, error) {
+	results := map[string][]string{}
+
+	for _, chunk := range chunkIDs(ids, 1000) {
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		var id, name string
+		if err := sqlf.
+			Select(tenant("message_tags.ID")).To(&id).
+			Select("Name").To(&name).
+			From(tenant("message_tags")).
+			Join(tenant("tags"), tenant("tags.ID")+"="+tenant("message_tags.TagID")).
+			Where(tenant("message_tags.ID")+` IN (?`+strings.Repeat(",?", len(chunk)-1)+`)`, args...).
+			QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+				results[id] = append(results[id], name)
+			}); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
 // UniqueTagsFromString will split a string with commas, and extract a unique slice of formatted tags
 func uniqueTagsFromString(s string) []string {
 	tags := []string{}
@@ -284,11 +921,12 @@ func uniqueTagsFromString(s string) []string {
 
 	parts := strings.Split(s, ",")
 	for _, p := range parts {
-		w := tools.CleanTag(p)
+		// invalid characters are replaced as tags detected in messages cannot be rejected
+		w := NormaliseTag(tools.CleanTag(p))
 		if w == "" {
 			continue
 		}
-		if config.ValidTagRegexp.MatchString(w) {
+		if ValidTag(w) {
 			if !inArray(w, tags) {
 				tags = append(tags, w)
 			}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
 )
 
 func TestTags(t *testing.T) {
@@ -42,7 +45,7 @@ func TestTags(t *testing.T) {
 		}
 	}
 
-	if err := DeleteAllMessages(); err != nil {
+	if _, err := DeleteAllMessages(false); err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
@@ -94,12 +97,29 @@ func TestTags(t *testing.T) {
 	}
 
 	// apply tag with invalid characters
-	if err := SetMessageTags(id, []string{"Dirty! \"Tag\""}); err != nil {
+	if err := SetMessageTags(id, []string{"Valid Tag", "Dirty! \"Tag\"", strings.Repeat("a", MaxTagLength+1)}); err == nil {
+		t.Log("expected error setting invalid tags")
+		t.Fail()
+	} else if e, ok := err.(InvalidTagsError); !ok || len(e.Tags) != 2 || e.Tags[0] != "Dirty! \"Tag\"" {
+		t.Logf("unexpected error %v", err)
+		t.Fail()
+	}
+	returnedTags = getMessageTags(id)
+	assertEqual(t, "", strings.Join(returnedTags, "|"), "Invalid message tags should not be applied")
+
+	// tags are normalised & compared case-insensitively, retaining the first-seen casing
+	if err := SetMessageTags(id, []string{" QA ", "qa", "Qa", "Multi   \t Space"}); err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	returnedTags = getMessageTags(id)
+	assertEqual(t, "Multi Space|QA", strings.Join(returnedTags, "|"), "Message tags were not normalised")
+	if err := SetMessageTags(id, []string{"qa", "multi space"}); err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
 	returnedTags = getMessageTags(id)
-	assertEqual(t, "Dirty Tag", strings.Join(returnedTags, "|"), "Dirty message tag did not clean as expected")
+	assertEqual(t, "Multi Space|QA", strings.Join(returnedTags, "|"), "Message tags did not retain the first-seen casing")
 	if err := DeleteAllMessageTags(id); err != nil {
 		t.Log("error ", err)
 		t.Fail()
@@ -109,7 +129,7 @@ func TestTags(t *testing.T) {
 	allTags := GetAllTags()
 	assertEqual(t, "", strings.Join(allTags, "|"), "Tags did not delete as expected")
 
-	if err := DeleteAllMessages(); err != nil {
+	if _, err := DeleteAllMessages(false); err != nil {
 		t.Log("error ", err)
 		t.Fail()
 	}
@@ -128,3 +148,648 @@ func TestTags(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNormaliseTagsMigration(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag normalisation migration")
+
+	id1, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+	id2, err := Store(&testTextEmail)
+	if err != nil {
+		t.Log("error ", err)
+		t.Fail()
+	}
+
+	// insert legacy tags directly, bypassing normalisation
+	for _, name := range []string{"QA", "qa ", " Qa", "Other  Tag"} {
+		if _, err := db.Exec(`INSERT INTO `+tenant("tags")+` (Name) VALUES (?)`, name); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{id1, id2} {
+			if _, err := db.Exec(`INSERT INTO `+tenant("message_tags")+` (ID, TagID) VALUES (?, (SELECT ID FROM `+
+				tenant("tags")+` WHERE Name = ?))`, id, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := migrateNormaliseTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, "Other Tag|QA", strings.Join(GetAllTags(), "|"), "Tags were not merged")
+	assertEqual(t, "Other Tag|QA", strings.Join(getMessageTags(id1), "|"), "Message tags were not merged")
+	assertEqual(t, "Other Tag|QA", strings.Join(getMessageTags(id2), "|"), "Message tags were not merged")
+}
+
+func TestSetTagsForIDs(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing bulk tags")
+
+	ids := []string{}
+	for i := 0; i < 20; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetTagsForIDs(ids[0:10], []string{"Bulk", "Other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := GetAllTagsCount()
+	assertEqual(t, counts["Bulk"], int64(10), "incorrect number of tagged messages")
+	assertEqual(t, counts["Other"], int64(10), "incorrect number of tagged messages")
+
+	if err := SetTagsForIDs(ids, []string{"Bulk"}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts = GetAllTagsCount()
+	assertEqual(t, counts["Bulk"], int64(20), "incorrect number of tagged messages")
+	assertEqual(t, len(GetAllTags()), 1, "unused tag was not pruned")
+
+	if err := SetTagsForIDs(ids, []string{"Valid", "Invalid!"}); err == nil {
+		t.Fatal("expected an error for invalid tags")
+	}
+	assertEqual(t, GetAllTagsCount()["Bulk"], int64(20), "tags changed with invalid tags")
+}
+
+func TestSetSearchTags(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tags by search")
+
+	for i := 0; i < 20; i++ {
+		bufBytes := []byte(fmt.Sprintf("From: sender-%d@example.com\r\nTo: to@example.com\r\nSubject: run %d\r\n\r\nbody\r\n", i%2, i))
+		if _, err := Store(&bufBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matched, updated, err := SetSearchTags("from:sender-0@example.com", "", []string{"Staging", "run  1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, matched, 10, "incorrect number of matched messages")
+	assertEqual(t, updated, 10, "incorrect number of updated messages")
+
+	counts := GetAllTagsCount()
+	assertEqual(t, counts["Staging"], int64(10), "incorrect number of tagged messages")
+	assertEqual(t, counts["run 1"], int64(10), "incorrect number of tagged messages")
+
+	t.Log("Unchanged messages are not updated")
+	matched, updated, err = SetSearchTags("run", "", []string{"staging"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, matched, 20, "incorrect number of matched messages")
+	assertEqual(t, updated, 10, "incorrect number of updated messages")
+
+	counts = GetAllTagsCount()
+	assertEqual(t, counts["Staging"], int64(20), "incorrect number of tagged messages")
+	assertEqual(t, counts["run 1"], int64(10), "existing tags not preserved when appending")
+
+	t.Log("Replace tags")
+	_, updated, err = SetSearchTags("from:sender-0@example.com", "", []string{"Staging"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, updated, 10, "incorrect number of updated messages")
+	assertEqual(t, strings.Join(GetAllTags(), ","), "Staging", "unused tag was not pruned")
+
+	t.Log("Invalid tags")
+	if _, _, err := SetSearchTags("run", "", []string{"Valid", "Invalid!"}, true); err == nil {
+		t.Fatal("expected an error for invalid tags")
+	}
+	assertEqual(t, strings.Join(GetAllTags(), ","), "Staging", "tags changed with invalid tags")
+
+	matched, updated, err = SetSearchTags("thisdoesnotexist", "", []string{"Other"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, matched, 0, "incorrect number of matched messages")
+	assertEqual(t, updated, 0, "incorrect number of updated messages")
+}
+
+func TestRenameTag(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag rename")
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetTagsForIDs(ids[0:6], []string{"Old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTagsForIDs(ids[4:10], []string{"New"}); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := RenameTag("old", "Renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, updated, 4, "incorrect number of updated messages")
+	assertEqual(t, strings.Join(GetAllTags(), ","), "New,Renamed", "tag was not renamed")
+
+	t.Log("Change case")
+	if _, err := RenameTag("Renamed", "RENAMED"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Join(GetAllTags(), ","), "New,RENAMED", "tag case was not changed")
+
+	t.Log("Merge tags")
+	if err := SetTagsForIDs(ids[0:1], []string{"RENAMED", "New"}); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err = RenameTag("renamed", " new ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, updated, 4, "incorrect number of updated messages")
+	assertEqual(t, strings.Join(GetAllTags(), ","), "New", "tags were not merged")
+	assertEqual(t, GetAllTagsCount()["New"], int64(10), "incorrect number of tagged messages")
+	assertEqual(t, strings.Join(getMessageTags(ids[0]), ","), "New", "duplicate message tag")
+
+	t.Log("Errors")
+	if _, err := RenameTag("New", "Invalid!"); err == nil {
+		t.Error("expected an error for an invalid tag")
+	}
+	if _, err := RenameTag("New", ""); err == nil {
+		t.Error("expected an error for an empty tag")
+	}
+	if _, err := RenameTag("Missing", "Other"); err != ErrTagNotFound {
+		t.Errorf("expected ErrTagNotFound, got %v", err)
+	}
+	assertEqual(t, strings.Join(GetAllTags(), ","), "New", "tags changed with errors")
+}
+
+func TestDeleteTag(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag deletion")
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetTagsForIDs(ids[0:6], []string{"Retired", "Kept"}); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := DeleteTag("RETIRED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, updated, 6, "incorrect number of updated messages")
+	assertEqual(t, strings.Join(GetAllTags(), ","), "Kept", "tag was not deleted")
+	assertEqual(t, strings.Join(getMessageTags(ids[0]), ","), "Kept", "other tags were changed")
+
+	updated, err = DeleteTag("Retired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, updated, 0, "incorrect number of updated messages for a missing tag")
+}
+
+func TestAddRemoveMessageTags(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing adding & removing tags")
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetTagsForIDs(ids[0:1], []string{"Existing", "Job A"}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := AddMessageTags(ids[0:2], []string{"job  b", "existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 2, "incorrect number of results")
+	assertEqual(t, strings.Join(results[0].Added, ","), "job b", "incorrect added tags")
+	assertEqual(t, strings.Join(results[0].Tags, ","), "Existing,Job A,job b", "existing tags not preserved")
+	assertEqual(t, strings.Join(results[1].Added, ","), "job b,Existing", "incorrect added tags")
+	assertEqual(t, strings.Join(results[1].Tags, ","), "Existing,job b", "incorrect tags")
+
+	t.Log("Duplicate adds are idempotent")
+	results, err = AddMessageTags(ids[0:1], []string{"Job B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results[0].Added), 0, "tag added twice")
+	assertEqual(t, GetAllTagsCount()["job b"], int64(2), "incorrect number of tagged messages")
+
+	t.Log("Remove tags")
+	results, err = RemoveMessageTags(ids, []string{"JOB A", "Existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Join(results[0].Removed, ","), "Job A,Existing", "incorrect removed tags")
+	assertEqual(t, strings.Join(results[0].Tags, ","), "job b", "other tags not preserved")
+	assertEqual(t, strings.Join(results[1].Removed, ","), "Existing", "incorrect removed tags")
+	assertEqual(t, len(results[2].Removed), 0, "removed a missing tag")
+	assertEqual(t, strings.Join(GetAllTags(), ","), "job b", "unused tags were not pruned")
+
+	t.Log("Errors")
+	results, err = AddMessageTags([]string{"missing"}, []string{"Other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, results[0].Error, ErrMessageNotFound.Error(), "expected an error for a missing message")
+
+	if _, err := AddMessageTags(ids, []string{"Valid", "Invalid!"}); err == nil {
+		t.Error("expected an error for invalid tags")
+	}
+	assertEqual(t, strings.Join(GetAllTags(), ","), "job b", "tags changed with invalid tags")
+}
+
+func TestTagRules(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag rules")
+
+	existing := []byte("From: noreply@example.com\r\nTo: user@example.com\r\nSubject: Reset your password\r\n\r\nbody\r\n")
+	existingID, err := Store(&existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset, err := AddTagRule(`subject:"Reset your password"`, []string{"Password  Reset"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Join(reset.Tags, ","), "Password Reset", "tags were not normalised")
+
+	// overlapping rules, the casing of the first matching rule is used
+	if _, err := AddTagRule(`to:@example.com`, []string{"password reset", "Example"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddTagRule(`tag:Example`, []string{"Tagged by rule"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := GetTagRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(rules), 3, "incorrect number of rules")
+	assertEqual(t, rules[0].ID, reset.ID, "rules are not ordered")
+
+	bufBytes := []byte("From: noreply@example.com\r\nTo: user@example.com\r\nX-Tags: Header\r\nSubject: Reset your password\r\n\r\nbody\r\n")
+	id, err := Store(&bufBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tag:Example rule does not match as the rule tags are applied after matching
+	assertEqual(t, strings.Join(getMessageTags(id), ","), "Example,Header,Password Reset", "incorrect rule tags")
+
+	bufBytes = []byte("From: noreply@example.com\r\nTo: user@example.net\r\nSubject: Hello\r\n\r\nbody\r\n")
+	id2, err := Store(&bufBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(getMessageTags(id2)), 0, "unexpected rule tags")
+
+	t.Log("Apply rules to existing messages")
+	assertEqual(t, len(getMessageTags(existingID)), 0, "rules applied to existing message")
+
+	updated, err := ApplyTagRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, updated, 2, "incorrect number of updated messages")
+	assertEqual(t, strings.Join(getMessageTags(existingID), ","), "Example,Password Reset,Tagged by rule", "incorrect rule tags")
+	assertEqual(t, strings.Join(getMessageTags(id), ","), "Example,Header,Password Reset,Tagged by rule", "incorrect rule tags")
+
+	t.Log("Update & delete rules")
+	if _, err := UpdateTagRule(reset.ID, "subject:Hello", []string{"Greeting"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateTagRule(999, "subject:Hello", []string{"Greeting"}); err != ErrTagRuleNotFound {
+		t.Errorf("expected ErrTagRuleNotFound, got %v", err)
+	}
+	if err := DeleteTagRule(rules[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteTagRule(rules[1].ID); err != ErrTagRuleNotFound {
+		t.Errorf("expected ErrTagRuleNotFound, got %v", err)
+	}
+
+	id3, err := Store(&bufBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Join(getMessageTags(id3), ","), "Greeting", "incorrect rule tags")
+
+	t.Log("Invalid rules")
+	for _, r := range []TagRule{{Query: "", Tags: []string{"Valid"}}, {Query: "subject:test", Tags: []string{"Invalid!"}}, {Query: "subject:test"}, {Query: `larger:abc`, Tags: []string{"Valid"}}} {
+		if _, err := AddTagRule(r.Query, r.Tags); err == nil {
+			t.Errorf("expected an error for %+v", r)
+		}
+	}
+}
+
+func TestTagStats(t *testing.T) {
+	setup()
+	defer Close()
+
+	t.Log("Testing tag statistics")
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		bufBytes := []byte(fmt.Sprintf("From: sender@example.com\r\nTo: to@example.com\r\nSubject: message %d\r\n\r\nbody\r\n", i))
+		id, err := Store(&bufBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := SetTagsForIDs(ids[0:6], []string{"Billing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTagsForIDs(ids[6:10], []string{"Support"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddMessageTags(ids[4:8], []string{"Urgent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStats := func(expected string) {
+		t.Helper()
+		stats, err := GetTagStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := []string{}
+		for _, ts := range stats {
+			s = append(s, fmt.Sprintf("%s:%d/%d", ts.Name, ts.Unread, ts.Total))
+		}
+		assertEqual(t, strings.Join(s, ","), expected, "incorrect tag stats")
+	}
+
+	assertStats("Billing:6/6,Support:4/4,Urgent:4/4")
+
+	latest, err := GetMessageSummary(ids[9])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := GetTagStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, stats[1].LatestCreated.UnixMilli(), latest.Created.UnixMilli(), "incorrect latest created")
+
+	if _, err := MarkReadIDs(ids[0:5]); err != nil {
+		t.Fatal(err)
+	}
+	assertStats("Billing:1/6,Support:4/4,Urgent:3/4")
+
+	if _, err := MarkUnreadIDs(ids[4:5]); err != nil {
+		t.Fatal(err)
+	}
+	assertStats("Billing:2/6,Support:4/4,Urgent:4/4")
+
+	if _, _, err := DeleteMessages(ids[0:2]); err != nil {
+		t.Fatal(err)
+	}
+	assertStats("Billing:2/4,Support:4/4,Urgent:4/4")
+
+	if _, err := DeleteSearch(`subject:"message 7"`, "", false); err != nil {
+		t.Fatal(err)
+	}
+	assertStats("Billing:2/4,Support:3/3,Urgent:3/3")
+}
+
+func TestTagsFromPlusAddress(t *testing.T) {
+	setup()
+	defer Close()
+
+	defer func() { config.TagsFromPlusAddress = false }()
+
+	opts := StoreOptions{
+		Via: ViaSMTP,
+		To:  []string{"User+Billing@example.com", "user+billing@example.com", "a+Staging+QA@example.com", "b+my!tag@example.com", "plain@example.com"},
+	}
+
+	id, err := StoreWithOptions(&testTextEmail, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Join(msg.Tags, ","), "", "envelope tags should not be set by default")
+
+	config.TagsFromPlusAddress = true
+
+	id, err = StoreWithOptions(&testTextEmail, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Join(msg.Tags, ","), "Billing,my tag,QA,Staging", "incorrect envelope tags")
+}
+
+func TestTagRetention(t *testing.T) {
+	setup()
+	defer Close()
+
+	rules, err := config.ParseTagRetention("loadtest=1h, ci=1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TagRetentionRules = rules
+	defer func() { config.TagRetentionRules = nil }()
+
+	for _, s := range []string{"loadtest", "loadtest=", "loadtest=0", "loadtest=1x", "=1h", "ci=1h,CI=2h"} {
+		if _, err := config.ParseTagRetention(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+
+	messages := []struct {
+		tags []string
+		age  time.Duration
+	}{
+		{[]string{"loadtest"}, 2 * time.Hour},
+		{[]string{"loadtest"}, 30 * time.Minute},
+		{[]string{"loadtest", "ci"}, 2 * time.Hour},
+		{[]string{"loadtest", "CI"}, 48 * time.Hour},
+		{[]string{}, 72 * time.Hour},
+		{[]string{"Other"}, 72 * time.Hour},
+	}
+
+	ids := []string{}
+	for _, m := range messages {
+		id, err := Store(&testTextEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := SetMessageTags(id, m.tags); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Exec(`UPDATE `+tenant("mailbox")+` SET Created = ? WHERE ID = ?`, time.Now().Add(-m.age).UnixMilli(), id); err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	deleted, err := pruneTaggedMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(deleted), 2, "incorrect number of rules deleting messages")
+	assertEqual(t, deleted["loadtest"], 1, "incorrect number of loadtest messages deleted")
+	assertEqual(t, deleted["ci"], 1, "incorrect number of ci messages deleted")
+	assertEqual(t, CountTotal(), float64(4), "incorrect number of remaining messages")
+
+	for i, id := range ids {
+		_, err := GetMessageSummary(id)
+		assertEqual(t, err != nil, i == 0 || i == 3, fmt.Sprintf("message %d incorrectly pruned", i))
+	}
+}
+
+func TestTagMeta(t *testing.T) {
+	setup()
+	defer Close()
+
+	id, err := Store(&testTextEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetMessageTags(id, []string{"Billing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := SetTagMeta("billing", "#1E90FF", " Invoices & receipts ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, fmt.Sprintf("%s|%s|%s", m.Tag, m.Color, m.Description), "billing|#1e90ff|Invoices & receipts", "incorrect tag meta")
+
+	// unused tags can have metadata
+	if _, err := SetTagMeta("Support", "#00ff00", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []string{"red", "#fff", "#12345g", "1e90ff"} {
+		if _, err := SetTagMeta("Billing", c, ""); err == nil {
+			t.Errorf("expected an error for color %q", c)
+		}
+	}
+
+	if _, err := SetTagMeta("Billing", "", strings.Repeat("x", MaxTagDescriptionLength+1)); err == nil {
+		t.Error("expected an error for a long description")
+	}
+
+	if _, err := SetTagMeta("", "#00ff00", ""); err == nil {
+		t.Error("expected an error for an empty tag")
+	}
+
+	assertMeta := func(expected string) {
+		meta, err := GetTagMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := []string{}
+		for _, m := range meta {
+			s = append(s, m.Tag+":"+m.Color)
+		}
+		assertEqual(t, strings.Join(s, ","), expected, "incorrect tag meta")
+	}
+
+	assertMeta("billing:#1e90ff,Support:#00ff00")
+
+	// deleting the last message with a tag keeps the metadata
+	if _, _, err := DeleteMessages([]string{id}); err != nil {
+		t.Fatal(err)
+	}
+	assertMeta("billing:#1e90ff,Support:#00ff00")
+
+	id, err = Store(&testTextEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMessageTags(id, []string{"Billing", "Support"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// renaming moves the metadata, replacing the metadata of a merged tag
+	if _, err := RenameTag("Billing", "Invoices"); err != nil {
+		t.Fatal(err)
+	}
+	assertMeta("Invoices:#1e90ff,Support:#00ff00")
+
+	if _, err := RenameTag("invoices", "INVOICES"); err != nil {
+		t.Fatal(err)
+	}
+	assertMeta("INVOICES:#1e90ff,Support:#00ff00")
+
+	if _, err := RenameTag("Invoices", "Support"); err != nil {
+		t.Fatal(err)
+	}
+	assertMeta("Support:#1e90ff")
+
+	if _, err := SetTagMeta("Support", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	assertMeta("")
+
+	if _, err := SetTagMeta("Support", "#00ff00", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteTag("support"); err != nil {
+		t.Fatal(err)
+	}
+	assertMeta("")
+}
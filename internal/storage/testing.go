@@ -28,7 +28,7 @@ func setup() {
 	var err error
 
 	// ensure DB is empty
-	if err := DeleteAllMessages(); err != nil {
+	if _, err := DeleteAllMessages(true); err != nil {
 		panic(err)
 	}
 
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/jhillyerd/enmime"
+	"github.com/leporo/sqlf"
+)
+
+// MaxThreadMessages is the maximum number of messages returned in a thread
+const MaxThreadMessages = 500
+
+// messageIDRe matches a single <message-id> in In-Reply-To & References headers
+var messageIDRe = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// MessageReferences returns the unique Message-IDs (without angle brackets) of the
+// In-Reply-To & References headers, excluding the message's own Message-ID
+func messageReferences(env *enmime.Envelope, messageID string) []string {
+	refs := []string{}
+
+	for _, h := range []string{"In-Reply-To", "References"} {
+		v := env.Root.Header.Get(h)
+		matches := messageIDRe.FindAllStringSubmatch(v, -1)
+		if len(matches) == 0 {
+			// tolerate Message-IDs without angle brackets
+			for _, f := range strings.Fields(v) {
+				matches = append(matches, []string{f, strings.Trim(f, "<>")})
+			}
+		}
+
+		for _, m := range matches {
+			if m[1] != "" && m[1] != messageID && !inArray(m[1], refs) {
+				refs = append(refs, m[1])
+			}
+		}
+	}
+
+	return refs
+}
+
+// Store the In-Reply-To & References Message-IDs of a message
+func storeMessageReferences(tx *sql.Tx, id string, refs []string) error {
+	for _, r := range refs {
+		if _, err := tx.Exec(`INSERT INTO `+tenant("message_references")+` (ID, Reference) VALUES(?, ?)`, id, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetThread returns the summaries of all messages in the same conversation as a message, oldest first.
+// Messages are linked by their Message-ID, In-Reply-To & References headers, so messages still
+// thread together via their common references if a message in the chain was deleted.
+func GetThread(id string) ([]MessageSummary, error) {
+	results := []MessageSummary{}
+
+	var messageID string
+	if err := sqlf.From(tenant("mailbox")).
+		Select("MessageID").To(&messageID).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		if err == sql.ErrNoRows {
+			return results, ErrMessageNotFound
+		}
+		return results, err
+	}
+
+	ids := map[string]bool{id: true}
+	known := map[string]bool{}
+	pending := []string{}
+
+	addMessageIDs := func(messageIDs ...string) {
+		for _, m := range messageIDs {
+			if m != "" && !known[m] {
+				known[m] = true
+				pending = append(pending, m)
+			}
+		}
+	}
+
+	addMessageIDs(messageID)
+
+	refs, err := getReferences([]string{id})
+	if err != nil {
+		return results, err
+	}
+	addMessageIDs(refs...)
+
+	// expand the conversation until no new messages are found
+	for len(pending) > 0 && len(ids) < MaxThreadMessages {
+		batch := pending
+		pending = []string{}
+
+		newIDs := []string{}
+
+		for _, chunk := range chunkIDs(batch, 500) {
+			args := make([]interface{}, len(chunk))
+			for i, m := range chunk {
+				args[i] = m
+			}
+			in := `(?` + strings.Repeat(",?", len(chunk)-1) + `)`
+
+			rows, err := db.Query(`SELECT ID, MessageID FROM `+tenant("mailbox")+` WHERE Deleted = 0 AND MessageID IN `+in+`
+				UNION SELECT m.ID, m.MessageID FROM `+tenant("message_references")+` r
+				JOIN `+tenant("mailbox")+` m ON m.ID = r.ID WHERE m.Deleted = 0 AND r.Reference IN `+in, append(args, args...)...) // #nosec
+			if err != nil {
+				return results, err
+			}
+
+			for rows.Next() {
+				var mID, mMessageID string
+				if err := rows.Scan(&mID, &mMessageID); err != nil {
+					rows.Close()
+					return results, err
+				}
+
+				if !ids[mID] {
+					ids[mID] = true
+					newIDs = append(newIDs, mID)
+				}
+				addMessageIDs(mMessageID)
+			}
+			rows.Close()
+		}
+
+		if len(newIDs) > 0 {
+			refs, err := getReferences(newIDs)
+			if err != nil {
+				return results, err
+			}
+			addMessageIDs(refs...)
+		}
+	}
+
+	threadIDs := []string{}
+	for i := range ids {
+		threadIDs = append(threadIDs, i)
+	}
+
+	for _, chunk := range chunkIDs(threadIDs, 500) {
+		args := make([]interface{}, len(chunk))
+		for i, m := range chunk {
+			args[i] = m
+		}
+
+		if err := sqlf.From(tenant("mailbox")+" m").
+			Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Snippet, m.FirstOpened, m.SpamScore, m.HTMLScore, m.Pinned, m.Starred, m.ReleaseCount`).
+			Where(`m.ID IN (?`+strings.Repeat(",?", len(chunk)-1)+`)`, args...).
+			Where("m.Deleted = 0").
+			QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+				em, err := scanMessageSummary(row)
+				if err != nil {
+					logger.Log().Errorf("[db] %s", err.Error())
+					return
+				}
+
+				results = append(results, em)
+			}); err != nil {
+			return results, err
+		}
+	}
+
+	// oldest first, by database ID if received at the same time
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].Created.Equal(results[j].Created) {
+			return results[i].Created.Before(results[j].Created)
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	if len(results) > MaxThreadMessages {
+		results = results[:MaxThreadMessages]
+	}
+
+	for i, m := range results {
+		results[i].Tags = getMessageTags(m.ID)
+	}
+
+	dbLastAction = time.Now()
+
+	return results, nil
+}
+
+// Get the In-Reply-To & References Message-IDs of messages
+func getReferences(ids []string) ([]string, error) {
+	refs := []string{}
+
+	for _, chunk := range chunkIDs(ids, 500) {
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		var ref string
+		if err := sqlf.From(tenant("message_references")).
+			Select("Reference").To(&ref).
+			Where(`ID IN (?`+strings.Repeat(",?", len(chunk)-1)+`)`, args...).
+			QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+				refs = append(refs, ref)
+			}); err != nil {
+			return refs, err
+		}
+	}
+
+	return refs, nil
+}
+
+// Store the In-Reply-To & References Message-IDs of messages stored by older versions.
+// Migration task implemented 10/2026
+func backfillMessageReferences(id string) error {
+	var count int
+	if err := sqlf.From(tenant("message_references")).
+		Select("COUNT(*)").To(&count).
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	raw, err := GetMessageRaw(id)
+	if err != nil {
+		return err
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	refs := messageReferences(env, strings.Trim(env.Root.Header.Get("Message-ID"), "<>"))
+	if len(refs) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	if err := storeMessageReferences(tx, id, refs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/server/websockets"
+	"github.com/leporo/sqlf"
+)
+
+// TrashMessages moves messages to the trash, hiding them from the mailbox, searches & stats.
+// Returns the number of trashed messages and the IDs which did not match a message outside the trash.
+func trashMessages(ids []string) (int, []string, error) {
+	notFound := []string{}
+
+	if len(ids) == 0 {
+		return 0, notFound, nil
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, notFound, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	trashed, err := trashedIDs(tx, ids, false)
+	if err != nil {
+		return 0, notFound, err
+	}
+
+	found := map[string]bool{}
+	for _, id := range trashed {
+		found[id] = true
+	}
+
+	for _, id := range ids {
+		if !found[id] && !inArray(id, notFound) {
+			notFound = append(notFound, id)
+		}
+	}
+
+	if len(trashed) == 0 {
+		return 0, notFound, nil
+	}
+
+	now := time.Now().UnixMilli()
+	for _, chunk := range chunkIDs(trashed, 1000) {
+		in, args := sqlPlaceholders(chunk)
+		if _, err := tx.Exec(`UPDATE `+tenant("mailbox")+` SET Deleted = ?, Starred = 0 WHERE ID IN `+in, append([]interface{}{now}, args...)...); err != nil { // #nosec
+			return 0, notFound, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, notFound, err
+	}
+
+	addMessageEvents(trashed, EventTrashed, nil)
+
+	dbLastAction = time.Now()
+
+	logger.Log().Debugf("[db] moved %d messages to the trash", len(trashed))
+
+	BroadcastMailboxStats()
+
+	return len(trashed), notFound, nil
+}
+
+// ListTrash returns a subset of the trashed messages, most recently trashed first, and the total number of trashed messages
+func ListTrash(start, limit int) ([]MessageSummary, float64, error) {
+	results := []MessageSummary{}
+
+	q := sqlf.From(tenant("mailbox") + " m").
+		Select(`m.Created, m.ID, m.MessageID, m.Subject, m.Metadata, m.Size, m.Attachments, m.Read, m.Snippet, m.FirstOpened, m.SpamScore, m.HTMLScore, m.Pinned, m.Starred, m.ReleaseCount, m.Deleted`).
+		Where("m.Deleted > 0").
+		OrderBy("m.Deleted DESC, m.rowid DESC").
+		Limit(limit).
+		Offset(start)
+
+	if err := q.QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+		var deleted float64
+		em, err := scanMessageSummary(row, &deleted)
+		if err != nil {
+			logger.Log().Errorf("[db] %s", err.Error())
+			return
+		}
+
+		trashed := time.UnixMilli(int64(deleted))
+		em.Trashed = &trashed
+
+		results = append(results, em)
+	}); err != nil {
+		return results, 0, err
+	}
+
+	var total float64
+	if err := sqlf.From(tenant("mailbox")).
+		Select("COUNT(*)").To(&total).
+		Where("Deleted > 0").
+		QueryRowAndClose(context.TODO(), db); err != nil {
+		return results, 0, err
+	}
+
+	// set the tags for listed messages only
+	for i, m := range results {
+		results[i].Tags = getMessageTags(m.ID)
+	}
+
+	dbLastAction = time.Now()
+
+	return results, total, nil
+}
+
+// IsTrashed returns whether a message is in the trash
+func IsTrashed(id string) bool {
+	var trashed int
+
+	_ = sqlf.From(tenant("mailbox")).
+		Select("COUNT(*)").To(&trashed).
+		Where("Deleted > 0").
+		Where("ID = ?", id).
+		QueryRowAndClose(context.TODO(), db)
+
+	return trashed == 1
+}
+
+// RestoreMessages restores messages from the trash, returning the number of restored messages.
+// IDs which do not match a trashed message are ignored.
+func RestoreMessages(ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// roll back if it fails
+	defer tx.Rollback()
+
+	restored, err := trashedIDs(tx, ids, true)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(restored) == 0 {
+		return 0, nil
+	}
+
+	for _, chunk := range chunkIDs(restored, 1000) {
+		in, args := sqlPlaceholders(chunk)
+		if _, err := tx.Exec(`UPDATE `+tenant("mailbox")+` SET Deleted = 0 WHERE ID IN `+in, args...); err != nil { // #nosec
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	addMessageEvents(restored, EventRestored, nil)
+
+	dbLastAction = time.Now()
+
+	logger.Log().Debugf("[db] restored %d messages from the trash", len(restored))
+
+	// the UI reloads the messages
+	websockets.Broadcast("prune", nil)
+	BroadcastMailboxStats()
+
+	return len(restored), nil
+}
+
+// PurgeTrash permanently deletes messages from the trash, or all trashed messages if no IDs are provided.
+// Returns the number of deleted messages, IDs which do not match a trashed message are ignored.
+func PurgeTrash(ids []string) (int, error) {
+	var purge []string
+
+	if len(ids) == 0 {
+		purge = []string{}
+		if err := sqlf.From(tenant("mailbox")).
+			Select("ID").
+			Where("Deleted > 0").
+			QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+				var id string
+				if err := row.Scan(&id); err != nil {
+					logger.Log().Errorf("[db] %s", err.Error())
+					return
+				}
+				purge = append(purge, id)
+			}); err != nil {
+			return 0, err
+		}
+	} else {
+		var err error
+		purge, err = trashedIDs(db, ids, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, _, err := deleteMessages(purge)
+
+	return n, err
+}
+
+// PurgeExpiredTrash permanently deletes messages which have been in the trash for longer than a duration
+func purgeExpiredTrash(olderThan time.Duration) (int, error) {
+	ids := []string{}
+
+	if err := sqlf.From(tenant("mailbox")).
+		Select("ID").
+		Where("Deleted > 0").
+		Where("Deleted < ?", time.Now().Add(-olderThan).UnixMilli()).
+		QueryAndClose(context.TODO(), db, func(row *sql.Rows) {
+			var id string
+			if err := row.Scan(&id); err != nil {
+				logger.Log().Errorf("[db] %s", err.Error())
+				return
+			}
+			ids = append(ids, id)
+		}); err != nil {
+		return 0, err
+	}
+
+	n, _, err := deleteMessages(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	if n > 0 {
+		logger.Log().Infof("[db] purged %d messages from the trash", n)
+	}
+
+	return n, nil
+}
+
+// TrashedIDs returns the IDs which match a message in (trashed) or outside (!trashed) the trash,
+// using either the database or a transaction
+func trashedIDs(tx interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, ids []string, trashed bool) ([]string, error) {
+	results := []string{}
+
+	where := "Deleted = 0"
+	if trashed {
+		where = "Deleted > 0"
+	}
+
+	for _, chunk := range chunkIDs(ids, 1000) {
+		in, args := sqlPlaceholders(chunk)
+		rows, err := tx.Query(`SELECT ID FROM `+tenant("mailbox")+` WHERE `+where+` AND ID IN `+in, args...) // #nosec
+		if err != nil {
+			return results, err
+		}
+
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return results, err
+			}
+			results = append(results, id)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
@@ -1,13 +1,16 @@
 package storage
 
 import (
+	"database/sql"
 	"net/mail"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/html2text"
+	"github.com/axllent/mailpit/internal/tools"
 	"github.com/jhillyerd/enmime"
 )
 
@@ -29,7 +32,7 @@ func addressToSlice(env *enmime.Envelope, key string) []*mail.Address {
 }
 
 // Generate the search text based on some header fields (to, from, subject etc)
-// and either the stripped HTML body (if exists) or text body
+// and either the stripped HTML body (if exists) or text body, unless body indexing is disabled
 func createSearchText(env *enmime.Envelope) string {
 	var b strings.Builder
 
@@ -41,11 +44,13 @@ func createSearchText(env *enmime.Envelope) string {
 	b.WriteString(env.GetHeader("Reply-To") + " ")
 	b.WriteString(env.GetHeader("Return-Path") + " ")
 
-	h := html2text.Strip(env.HTML, true)
-	if h != "" {
-		b.WriteString(h + " ")
-	} else {
-		b.WriteString(env.Text + " ")
+	if !config.DisableBodyIndex {
+		h := html2text.Strip(env.HTML, true)
+		if h != "" {
+			b.WriteString(h + " ")
+		} else {
+			b.WriteString(env.Text + " ")
+		}
 	}
 	// add attachment filenames
 	for _, a := range env.Attachments {
@@ -57,6 +62,50 @@ func createSearchText(env *enmime.Envelope) string {
 	return d
 }
 
+// AttachmentsSize returns the total size of all attachments in bytes
+func attachmentsSize(env *enmime.Envelope) float64 {
+	var size float64
+	for _, a := range env.Attachments {
+		size = size + float64(len(a.Content))
+	}
+
+	return size
+}
+
+// MessageParts returns a summary of the inline parts & attachments
+func messageParts(env *enmime.Envelope) []DBPart {
+	parts := []DBPart{}
+	for _, p := range append(append(append([]*enmime.Part{}, env.Inlines...), env.OtherParts...), env.Attachments...) {
+		c := partChecksum(p.Content)
+		parts = append(parts, DBPart{
+			PartID:      p.PartID,
+			FileName:    p.FileName,
+			ContentID:   p.ContentID,
+			ContentType: p.ContentType,
+			Size:        c.Size,
+			MD5:         c.MD5,
+			SHA1:        c.SHA1,
+			SHA256:      c.SHA256,
+		})
+	}
+
+	return parts
+}
+
+// CreateSnippet returns the message snippet. The text enmime converts from the HTML (if the
+// message has no text part) is ignored in favour of stripping the HTML.
+func createSnippet(env *enmime.Envelope) string {
+	text := env.Text
+	for _, e := range env.Errors {
+		if e.Name == enmime.ErrorPlainTextFromHTML {
+			text = ""
+			break
+		}
+	}
+
+	return tools.CreateSnippet(text, env.HTML)
+}
+
 // CleanString removes unwanted characters from stored search text and search queries
 func cleanString(str string) string {
 	// replace \uFEFF with space, see https://github.com/golang/go/issues/42274#issuecomment-1017258184
@@ -103,3 +152,35 @@ func inArray(k string, arr []string) bool {
 func escPercentChar(s string) string {
 	return strings.ReplaceAll(s, "%", "%%")
 }
+
+// ChunkIDs splits IDs into chunks of at most size IDs, to keep SQL queries within the variable limit
+func chunkIDs(ids []string, size int) [][]string {
+	chunks := make([][]string, 0, (len(ids)+size-1)/size)
+	for size < len(ids) {
+		ids, chunks = ids[size:], append(chunks, ids[0:size:size])
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+
+	return chunks
+}
+
+// SQLPlaceholders returns the IN placeholders & arguments for a list of IDs, eg: `(?,?,?)`
+func sqlPlaceholders(ids []string) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	return `(?` + strings.Repeat(",?", len(ids)-1) + `)`, args
+}
+
+// NullFloat returns a pointer to the value of a nullable float, nil if null
+func nullFloat(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+
+	return &f.Float64
+}
@@ -0,0 +1,38 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationDaysRe = regexp.MustCompile(`^(\d+)(d|w)$`)
+
+// ParseDuration parses a duration string, extending time.ParseDuration with
+// support for days (d) and weeks (w), eg: 30d, 2w, 12h, 90m
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if m := durationDaysRe.FindStringSubmatch(s); len(m) == 3 {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, err
+		}
+
+		d := time.Duration(n) * 24 * time.Hour
+		if m[2] == "w" {
+			d = d * 7
+		}
+
+		return d, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+
+	return d, nil
+}
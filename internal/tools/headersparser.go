@@ -0,0 +1,90 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// decodes RFC 2047 encoded-words, converting legacy charsets (eg: ISO-8859-*, windows-1252, GB2312 & Shift_JIS) to UTF-8
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		return charset.NewReaderLabel(label, input)
+	},
+}
+
+// MessageHeader is a message header in its original order & form
+//
+// swagger:model MessageHeader
+type MessageHeader struct {
+	// Header name, in its original case
+	Name string
+	// Unfolded header value
+	Value string
+	// The header exactly as it appears in the message, including folding
+	Raw string
+}
+
+// ParseOrderedHeaders returns the headers of a raw message in their original order, unlike a
+// mail.Header which groups repeated headers (eg: Received) & canonicalizes the header names.
+func ParseOrderedHeaders(raw []byte) ([]MessageHeader, error) {
+	headers := []MessageHeader{}
+	r := bufio.NewReader(bytes.NewReader(raw))
+
+	var current *MessageHeader
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return headers, err
+		}
+
+		content := strings.TrimRight(line, "\r\n")
+		if content == "" {
+			// end of the headers
+			break
+		}
+
+		if content[0] == ' ' || content[0] == '\t' {
+			if current == nil {
+				return headers, fmt.Errorf("malformed header line %d: continuation without a header", n)
+			}
+			current.Value = current.Value + content
+			current.Raw = current.Raw + line
+		} else {
+			name, value, ok := strings.Cut(content, ":")
+			if !ok || strings.TrimSpace(name) == "" || strings.ContainsAny(name, " \t") {
+				return headers, fmt.Errorf("malformed header line %d: %q", n, content)
+			}
+
+			headers = append(headers, MessageHeader{Name: name, Value: value, Raw: line})
+			current = &headers[len(headers)-1]
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	for i := range headers {
+		headers[i].Value = strings.TrimSpace(headers[i].Value)
+		headers[i].Raw = strings.TrimRight(headers[i].Raw, "\r\n")
+	}
+
+	return headers, nil
+}
+
+// DecodeHeader returns a header value with all RFC 2047 encoded-words (eg: `=?UTF-8?B?...?=`) decoded.
+// The raw value is returned if it cannot be decoded, eg: an unknown charset.
+func DecodeHeader(v string) string {
+	d, err := headerDecoder.DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+
+	return d
+}
@@ -0,0 +1,34 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var sizeRe = regexp.MustCompile(`^(\d+)\s*(k|kb|m|mb|g|gb)?$`)
+
+// ParseSize parses a size in bytes, with optional K, M or G suffixes (multiples of 1024), eg: 512K, 25M
+func ParseSize(s string) (int, error) {
+	m := sizeRe.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	switch strings.TrimSuffix(m[2], "b") {
+	case "k":
+		n = n * 1024
+	case "m":
+		n = n * 1024 * 1024
+	case "g":
+		n = n * 1024 * 1024 * 1024
+	}
+
+	return n, nil
+}
@@ -7,38 +7,33 @@ import (
 	"github.com/axllent/mailpit/internal/html2text"
 )
 
-// CreateSnippet returns a message snippet. It will use the HTML version (if it exists)
-// otherwise the text version.
+// SnippetLength is the maximum number of characters of a message snippet (excluding the trailing ...)
+const SnippetLength = 160
+
+var snippetSpaceRe = regexp.MustCompile(`\s+`)
+
+// CreateSnippet returns a message snippet. It will use the text version (if it exists)
+// otherwise the HTML version with the HTML stripped. Whitespace is collapsed, and snippets
+// longer than SnippetLength characters are truncated.
 func CreateSnippet(text, html string) string {
 	text = strings.TrimSpace(text)
 	html = strings.TrimSpace(html)
-	limit := 200
-	spaceRe := regexp.MustCompile(`\s+`)
-
-	if text == "" && html == "" {
-		return ""
-	}
-
-	if html != "" {
-		data := html2text.Strip(html, false)
-
-		if len(data) <= limit {
-			return data
-		}
-
-		return data[0:limit] + "..."
-	}
 
+	var data string
 	if text != "" {
 		// replace \uFEFF with space, see https://github.com/golang/go/issues/42274#issuecomment-1017258184
-		text = strings.ReplaceAll(text, string('\uFEFF'), " ")
-		text = strings.TrimSpace(spaceRe.ReplaceAllString(text, " "))
-		if len(text) <= limit {
-			return text
-		}
+		data = strings.ReplaceAll(text, string('\uFEFF'), " ")
+	} else if html != "" {
+		data = html2text.Strip(html, false)
+	}
+
+	data = strings.TrimSpace(snippetSpaceRe.ReplaceAllString(data, " "))
 
-		return text[0:limit] + "..."
+	// truncate by characters rather than bytes to not split multi-byte characters
+	runes := []rune(data)
+	if len(runes) <= SnippetLength {
+		return data
 	}
 
-	return ""
+	return strings.TrimSpace(string(runes[0:SnippetLength])) + "..."
 }
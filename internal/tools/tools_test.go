@@ -2,7 +2,10 @@ package tools
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestArgsParser(t *testing.T) {
@@ -58,16 +61,35 @@ func TestSnippets(t *testing.T) {
 	tests[`<h1>Heading</h1><p>   <a href="https://github.com">linked text</a></p>`] = "Heading linked text"
 	// broken html
 	tests[`<h1>Heading</h3><p>   <a href="https://github.com">linked text.`] = "Heading linked text."
-	// truncation to 200 chars + ...
-	tests["abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789"] = "abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmno..."
+	// truncation to 160 chars + ...
+	tests["abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789"] = "abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijklmnopqrstuvwxyx0123456789 abcdefghijkl..."
 
 	for str, expected := range tests {
-		res := CreateSnippet(str, str)
+		res := CreateSnippet("", str)
 		if res != expected {
 			t.Log("CreateSnippet error:", res, "!=", expected)
 			t.Fail()
 		}
 	}
+
+	// the text version is preferred
+	if res := CreateSnippet("Plain   text\r\nversion", "<p>HTML version</p>"); res != "Plain text version" {
+		t.Log("CreateSnippet error:", res, "!= Plain text version")
+		t.Fail()
+	}
+
+	// no text or HTML (eg: attachments only)
+	if res := CreateSnippet("", ""); res != "" {
+		t.Log("CreateSnippet error:", res, "!= \"\"")
+		t.Fail()
+	}
+
+	// multi-byte characters are not split
+	res := CreateSnippet(strings.Repeat("é", 200), "")
+	if res != strings.Repeat("é", SnippetLength)+"..." || !utf8.ValidString(res) {
+		t.Log("CreateSnippet error:", res)
+		t.Fail()
+	}
 }
 
 func TestListUnsubscribeParser(t *testing.T) {
@@ -117,3 +139,177 @@ func TestListUnsubscribeParser(t *testing.T) {
 		}
 	}
 }
+
+func TestUpstreamSpamParser(t *testing.T) {
+	if res := UpstreamSpamParser("", "", ""); res != nil {
+		t.Log("UpstreamSpamParser: expected nil without headers")
+		t.Fail()
+	}
+
+	// [status, score, flag] => expected
+	tests := map[[3]string]UpstreamSpam{}
+	tests[[3]string{"Yes, score=7.3 required=5.0 tests=BAYES_99,HTML_MESSAGE autolearn=no version=3.4.6", "", ""}] = UpstreamSpam{Score: 7.3, Required: 5, Verdict: "spam", Tests: []string{"BAYES_99", "HTML_MESSAGE"}}
+	tests[[3]string{"No, hits=-0.1 required=5.0 tests=none", "", ""}] = UpstreamSpam{Score: -0.1, Required: 5, Verdict: "ham", Tests: []string{}}
+	tests[[3]string{"", "2.5", "YES"}] = UpstreamSpam{Score: 2.5, Verdict: "spam", Tests: []string{}}
+	tests[[3]string{"", "high", ""}] = UpstreamSpam{Tests: []string{}, ParseError: true}
+	tests[[3]string{"garbage", "", ""}] = UpstreamSpam{Tests: []string{}, ParseError: true}
+
+	for headers, expected := range tests {
+		expected.Status = headers[0]
+		res := UpstreamSpamParser(headers[0], headers[1], headers[2])
+		if res == nil || !reflect.DeepEqual(*res, expected) {
+			t.Logf("UpstreamSpamParser: %v != %v", res, expected)
+			t.Fail()
+		}
+	}
+}
+
+func TestAuthenticationResultsParser(t *testing.T) {
+	type expected struct {
+		authServID string
+		results    map[string][2]string // method => [result, domain]
+		parseError bool
+	}
+
+	tests := map[string]expected{}
+	tests["mx.example.com; dkim=pass header.d=example.com header.s=sel; spf=pass smtp.mailfrom=bounce@mail.example.org; dmarc=pass (p=none dis=none) header.from=example.com"] = expected{
+		authServID: "mx.example.com",
+		results: map[string][2]string{
+			"dkim":  {"pass", "example.com"},
+			"spf":   {"pass", "mail.example.org"},
+			"dmarc": {"pass", "example.com"},
+		},
+	}
+	tests["mx.google.com (comment; with semicolon) 1;\r\n\tdkim=fail (bad signature) reason=\"signature verification failed\" header.i=@Example.COM"] = expected{
+		authServID: "mx.google.com",
+		results:    map[string][2]string{"dkim": {"fail", "example.com"}},
+	}
+	tests["example.org; none"] = expected{authServID: "example.org", results: map[string][2]string{}}
+	tests["example.org; spf"] = expected{authServID: "example.org", results: map[string][2]string{}, parseError: true}
+	tests[""] = expected{results: map[string][2]string{}, parseError: true}
+
+	for header, e := range tests {
+		res := AuthenticationResultsParser(header)
+
+		if res.AuthServID != e.authServID || res.ParseError != e.parseError || len(res.Results) != len(e.results) {
+			t.Logf("AuthenticationResultsParser: unexpected result for %q: %+v", header, res)
+			t.Fail()
+			continue
+		}
+
+		for _, r := range res.Results {
+			if v, ok := e.results[r.Method]; !ok || v[0] != r.Result || v[1] != r.Domain {
+				t.Logf("AuthenticationResultsParser: unexpected %s result for %q: %+v", r.Method, header, r)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{}
+	tests["30d"] = 30 * 24 * time.Hour
+	tests["2w"] = 14 * 24 * time.Hour
+	tests["12h"] = 12 * time.Hour
+	tests["1h30m"] = 90 * time.Minute
+	tests[" 7D "] = 7 * 24 * time.Hour
+
+	for str, expected := range tests {
+		res, err := ParseDuration(str)
+		if err != nil || res != expected {
+			t.Logf("ParseDuration: %q returned %v (%v), expected %v", str, res, err, expected)
+			t.Fail()
+		}
+	}
+
+	for _, str := range []string{"", "30 days", "d", "-h"} {
+		if _, err := ParseDuration(str); err == nil {
+			t.Logf("ParseDuration: expected error for %q", str)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int{}
+	tests["0"] = 0
+	tests["1000"] = 1000
+	tests["512K"] = 512 * 1024
+	tests["25M"] = 25 * 1024 * 1024
+	tests[" 2 mb "] = 2 * 1024 * 1024
+	tests["1G"] = 1024 * 1024 * 1024
+
+	for str, expected := range tests {
+		res, err := ParseSize(str)
+		if err != nil || res != expected {
+			t.Logf("ParseSize: %q returned %v (%v), expected %v", str, res, err, expected)
+			t.Fail()
+		}
+	}
+
+	for _, str := range []string{"", "M", "-1", "1.5M", "10T"} {
+		if _, err := ParseSize(str); err == nil {
+			t.Logf("ParseSize: expected error for %q", str)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseOrderedHeaders(t *testing.T) {
+	raw := []byte("Received: from relay2.example.com\r\n\tby mx.example.net; Mon, 1 Jan 2024 10:00:01 +0000\r\n" +
+		"Received: from relay1.example.com by relay2.example.com;\r\n Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"x-custom-HEADER: value\r\n" +
+		"Subject:  Hello\r\n" +
+		"\r\n" +
+		"Body: not a header\r\n")
+
+	expected := []MessageHeader{
+		{"Received", "from relay2.example.com\tby mx.example.net; Mon, 1 Jan 2024 10:00:01 +0000", "Received: from relay2.example.com\r\n\tby mx.example.net; Mon, 1 Jan 2024 10:00:01 +0000"},
+		{"Received", "from relay1.example.com by relay2.example.com; Mon, 1 Jan 2024 10:00:00 +0000", "Received: from relay1.example.com by relay2.example.com;\r\n Mon, 1 Jan 2024 10:00:00 +0000"},
+		{"x-custom-HEADER", "value", "x-custom-HEADER: value"},
+		{"Subject", "Hello", "Subject:  Hello"},
+	}
+
+	res, err := ParseOrderedHeaders(raw)
+	if err != nil || !reflect.DeepEqual(res, expected) {
+		t.Logf("ParseOrderedHeaders: %q (%v) != %q", res, err, expected)
+		t.Fail()
+	}
+
+	// LF line endings & headers without a body
+	res, err = ParseOrderedHeaders([]byte("From: a@example.com\nTo: b@example.com,\n c@example.com"))
+	if err != nil || len(res) != 2 || res[1].Value != "b@example.com, c@example.com" || res[1].Raw != "To: b@example.com,\n c@example.com" {
+		t.Logf("ParseOrderedHeaders: unexpected result %q (%v)", res, err)
+		t.Fail()
+	}
+
+	for _, str := range []string{" folded\r\nSubject: test\r\n", "Not a header\r\n"} {
+		if _, err := ParseOrderedHeaders([]byte(str)); err == nil {
+			t.Logf("ParseOrderedHeaders: expected error for %q", str)
+			t.Fail()
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	tests := map[string]string{}
+	tests["plain text"] = "plain text"
+	tests["=?UTF-8?B?SGVsbG8gV8O2cmxk?="] = "Hello Wörld"
+	tests["=?ISO-8859-1?Q?Caf=E9?="] = "Café"
+	tests["=?windows-1252?Q?=80100?="] = "€100"
+	tests["=?ISO-8859-2?Q?=A3=F3d=BC?="] = "Łódź"
+	tests["=?GB2312?B?xOO6ww==?="] = "你好"
+	tests["=?Shift_JIS?B?g2WDWINn?="] = "テスト"
+	// mixed encoded-words, whitespace between adjacent encoded-words is removed
+	tests["Re: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?= =?ISO-8859-1?Q?aus_K=F6ln?= & more"] = "Re: Grüßeaus Köln & more"
+	tests["\"=?UTF-8?Q?J=C3=B6rg?=\" <jorg@example.com>"] = "\"Jörg\" <jorg@example.com>"
+	// unknown charset
+	tests["=?x-unknown?Q?abc?= test"] = "=?x-unknown?Q?abc?= test"
+
+	for str, expected := range tests {
+		if res := DecodeHeader(str); res != expected {
+			t.Logf("DecodeHeader: %q returned %q, expected %q", str, res, expected)
+			t.Fail()
+		}
+	}
+}
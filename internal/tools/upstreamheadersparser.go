@@ -0,0 +1,280 @@
+package tools
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	spamScoreRe    = regexp.MustCompile(`(?i)\b(?:score|hits)=(-?[0-9]+(?:\.[0-9]+)?)`)
+	spamRequiredRe = regexp.MustCompile(`(?i)\brequired=(-?[0-9]+(?:\.[0-9]+)?)`)
+	spamTestsRe    = regexp.MustCompile(`(?is)\btests=(.*?)(?:\s+[a-z_]+=|$)`)
+	spamVerdictRe  = regexp.MustCompile(`(?i)^\s*(yes|no)\b`)
+	authPropRe     = regexp.MustCompile(`^([a-zA-Z0-9_\-]+)\.([a-zA-Z0-9_\-\.]+)=(.*)$`)
+	authEqualsRe   = regexp.MustCompile(`\s*=\s*`)
+)
+
+// UpstreamSpam contains the spam results reported by an upstream scanner in the
+// X-Spam-Status, X-Spam-Score & X-Spam-Flag headers
+//
+// swagger:model UpstreamSpam
+type UpstreamSpam struct {
+	// Raw X-Spam-Status header value
+	Status string
+	// Spam score
+	Score float64
+	// Spam score required to be flagged as spam, if reported
+	Required float64
+	// Verdict [spam, ham]
+	Verdict string
+	// Matched tests, if reported
+	Tests []string
+	// Whether the headers could not be parsed
+	ParseError bool
+}
+
+// AuthenticationResults contains a parsed Authentication-Results header (RFC 8601)
+//
+// swagger:model AuthenticationResults
+type AuthenticationResults struct {
+	// Raw header value
+	Header string
+	// Authentication service identifier (usually the hostname of the upstream MTA)
+	AuthServID string
+	// Method results
+	Results []AuthenticationResult
+	// Whether the header could not be parsed
+	ParseError bool
+}
+
+// AuthenticationResult is a single method result from an Authentication-Results header
+//
+// swagger:model AuthenticationResult
+type AuthenticationResult struct {
+	// Authentication method, eg: dkim, spf, dmarc
+	Method string
+	// Result, eg: pass, fail, none, neutral
+	Result string
+	// Domain the result applies to, if detected
+	Domain string
+	// Reason, if provided
+	Reason string
+	// Properties, eg: header.d, smtp.mailfrom
+	Properties map[string]string
+}
+
+// UpstreamSpamParser will parse the X-Spam-Status, X-Spam-Score & X-Spam-Flag header values.
+// It returns nil if none of the headers are set.
+func UpstreamSpamParser(status, score, flag string) *UpstreamSpam {
+	status = strings.TrimSpace(status)
+	score = strings.TrimSpace(score)
+	flag = strings.TrimSpace(flag)
+
+	if status == "" && score == "" && flag == "" {
+		return nil
+	}
+
+	s := UpstreamSpam{Status: status, Tests: []string{}}
+	hasScore := false
+
+	if status != "" {
+		if m := spamVerdictRe.FindStringSubmatch(status); len(m) == 2 {
+			s.Verdict = spamVerdict(m[1])
+		} else {
+			s.ParseError = true
+		}
+
+		if m := spamScoreRe.FindStringSubmatch(status); len(m) == 2 {
+			s.Score, _ = strconv.ParseFloat(m[1], 64)
+			hasScore = true
+		}
+
+		if m := spamRequiredRe.FindStringSubmatch(status); len(m) == 2 {
+			s.Required, _ = strconv.ParseFloat(m[1], 64)
+		}
+
+		if m := spamTestsRe.FindStringSubmatch(status); len(m) == 2 {
+			for _, t := range strings.Split(m[1], ",") {
+				if t = strings.TrimSpace(t); t != "" && t != "none" {
+					s.Tests = append(s.Tests, t)
+				}
+			}
+		}
+	}
+
+	if score != "" && !hasScore {
+		f, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			s.ParseError = true
+		} else {
+			s.Score = f
+		}
+	}
+
+	if s.Verdict == "" && flag != "" {
+		s.Verdict = spamVerdict(flag)
+	}
+
+	return &s
+}
+
+func spamVerdict(v string) string {
+	if strings.EqualFold(v, "yes") || strings.EqualFold(v, "true") {
+		return "spam"
+	}
+
+	return "ham"
+}
+
+// AuthenticationResultsParser will parse an Authentication-Results header value (RFC 8601).
+// If the header cannot be parsed, ParseError is set and any results parsed so far are returned.
+func AuthenticationResultsParser(v string) AuthenticationResults {
+	a := AuthenticationResults{Header: v, Results: []AuthenticationResult{}}
+
+	parts := splitUnquoted(stripHeaderComments(v), ';')
+	if len(parts) == 0 || strings.TrimSpace(parts[0]) == "" {
+		a.ParseError = true
+		return a
+	}
+
+	// the authserv-id can be followed by an optional version
+	id := strings.Fields(parts[0])
+	a.AuthServID = id[0]
+
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(authEqualsRe.ReplaceAllString(p, "="))
+		if p == "" {
+			continue
+		}
+
+		if strings.EqualFold(p, "none") {
+			continue
+		}
+
+		tokens := strings.Fields(p)
+		methodResult := strings.SplitN(tokens[0], "=", 2)
+		if len(methodResult) != 2 || methodResult[0] == "" || methodResult[1] == "" {
+			a.ParseError = true
+			continue
+		}
+
+		r := AuthenticationResult{
+			// strip the optional method version, eg: dkim/1
+			Method:     strings.ToLower(strings.SplitN(methodResult[0], "/", 2)[0]),
+			Result:     strings.ToLower(methodResult[1]),
+			Properties: map[string]string{},
+		}
+
+		for _, t := range tokens[1:] {
+			if strings.HasPrefix(strings.ToLower(t), "reason=") {
+				r.Reason = strings.Trim(t[7:], `"`)
+				continue
+			}
+
+			m := authPropRe.FindStringSubmatch(t)
+			if len(m) != 4 {
+				// the reason value may contain quoted spaces
+				if r.Reason != "" {
+					r.Reason = r.Reason + " " + strings.Trim(t, `"`)
+					continue
+				}
+				a.ParseError = true
+				continue
+			}
+
+			r.Properties[strings.ToLower(m[1]+"."+m[2])] = strings.Trim(m[3], `"`)
+		}
+
+		r.Domain = authResultDomain(r)
+		a.Results = append(a.Results, r)
+	}
+
+	return a
+}
+
+// Return the domain relevant to the authentication method
+func authResultDomain(r AuthenticationResult) string {
+	var keys []string
+	switch r.Method {
+	case "dkim", "domainkeys":
+		keys = []string{"header.d", "header.i"}
+	case "spf":
+		keys = []string{"smtp.mailfrom", "smtp.helo"}
+	case "dmarc":
+		keys = []string{"header.from"}
+	default:
+		keys = []string{"header.d", "header.from", "smtp.mailfrom"}
+	}
+
+	for _, k := range keys {
+		if v, ok := r.Properties[k]; ok && v != "" {
+			if i := strings.LastIndex(v, "@"); i > -1 {
+				v = v[i+1:]
+			}
+			return strings.ToLower(v)
+		}
+	}
+
+	return ""
+}
+
+// Remove all (nested) comments from a header value, ignoring quoted strings
+func stripHeaderComments(v string) string {
+	var b strings.Builder
+	depth := 0
+	quoted := false
+	escaped := false
+
+	for _, c := range v {
+		switch {
+		case escaped:
+			escaped = false
+			if depth > 0 {
+				continue
+			}
+		case c == '\\':
+			escaped = true
+			if depth > 0 {
+				continue
+			}
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			// comments act as whitespace
+			b.WriteRune(' ')
+			continue
+		}
+
+		if depth == 0 {
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Split a string by a separator, ignoring separators in quoted strings
+func splitUnquoted(v string, sep rune) []string {
+	parts := []string{}
+	var b strings.Builder
+	quoted := false
+
+	for _, c := range v {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c == sep && !quoted {
+			parts = append(parts, b.String())
+			b.Reset()
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return append(parts, b.String())
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/httpclient"
 	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/semver"
 )
@@ -53,9 +54,7 @@ func GithubLatest(repo, name string) (string, string, string, error) {
 
 	timeout := time.Duration(5 * time.Second)
 
-	client := http.Client{
-		Timeout: timeout,
-	}
+	client := httpclient.Client(timeout, false)
 
 	req, err := http.NewRequest("GET", releaseURL, nil)
 	if err != nil {
@@ -207,7 +206,7 @@ func GithubUpdate(repo, appName, currentVersion string) (string, error) {
 // DownloadToFile downloads a URL to a file
 func downloadToFile(url, fileName string) error {
 	// Get the data
-	resp, err := http.Get(url) // #nosec
+	resp, err := httpclient.Client(0, false).Get(url) // #nosec
 	if err != nil {
 		return err
 	}
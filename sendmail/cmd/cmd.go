@@ -4,9 +4,9 @@ package cmd
 /**
  * Bare bones sendmail drop-in replacement borrowed from MailHog
  *
- * It uses a bit of a hack for flag parsing in order to be compatible
- * with the cobra sendmail subcommand, as sendmail uses `-bc` which
- * is not POSIX compatible.
+ * Flags are parsed here rather than by the cobra sendmail subcommand, as
+ * sendmail uses `-bs` which is not POSIX compatible, and any unsupported
+ * sendmail flags are ignored.
  *
  * The -bs command-line switch causes sendmail to run a single SMTP session in the
  * foreground over its standard input and output, and then exit. The SMTP session
@@ -14,17 +14,19 @@ package cmd
  * submitted to sendmail for delivery.
  */
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
 	"os/user"
 	"strings"
 
 	"github.com/axllent/mailpit/config"
-	"github.com/axllent/mailpit/internal/logger"
 	"github.com/reiver/go-telnet"
 	flag "github.com/spf13/pflag"
 )
@@ -35,12 +37,36 @@ var (
 	// FromAddr email address
 	FromAddr string
 
-	// UseB - used to set from `-bs`
+	// UseB - used to set from `-bs` or `-bm`
 	UseB bool
 	// UseS - used to set from `-bs`
 	UseS bool
+	// UseM - used to set from `-bm` (the default delivery mode)
+	UseM bool
+	// UseT - read recipients from the To, Cc & Bcc message headers (`-t`)
+	UseT bool
+	// UseI - do not treat a line with a single dot as the end of the message (`-i` or `-oi`)
+	UseI bool
 )
 
+// Exit codes, as defined in sysexits.h
+const (
+	exitUsage       = 64
+	exitDataErr     = 65
+	exitUnavailable = 69
+	exitTempFail    = 75
+)
+
+// SendError is an error with the exit code to return
+type sendError struct {
+	code int
+	msg  string
+}
+
+func (e sendError) Error() string {
+	return e.msg
+}
+
 func init() {
 	host, err := os.Hostname()
 	if err != nil {
@@ -60,8 +86,6 @@ func init() {
 
 // Run the Mailpit sendmail replacement.
 func Run() {
-	var recipients []string
-
 	// defaults from envars if provided
 	if len(os.Getenv("MP_SENDMAIL_SMTP_ADDR")) > 0 {
 		SMTPAddr = os.Getenv("MP_SENDMAIL_SMTP_ADDR")
@@ -70,43 +94,32 @@ func Run() {
 		FromAddr = os.Getenv("MP_SENDMAIL_FROM")
 	}
 
-	flag.StringVarP(&FromAddr, "from", "f", FromAddr, "SMTP sender")
-	flag.StringVarP(&SMTPAddr, "smtp-addr", "S", SMTPAddr, "SMTP server address")
-	flag.BoolVarP(&UseB, "long-b", "b", false, "Handle SMTP commands on standard input (use as -bs)")
-	flag.BoolVarP(&UseS, "long-s", "s", false, "Handle SMTP commands on standard input (use as -bs)")
-	flag.BoolP("verbose", "v", false, "Ignored")
-	flag.BoolP("long-i", "i", false, "Ignored")
-	flag.BoolP("long-o", "o", false, "Ignored")
-	flag.BoolP("long-t", "t", false, "Ignored")
-
 	// set the default help
-	flag.Usage = func() {
-		fmt.Println(HelpTemplate(os.Args[0:1]))
+	usage := func() {
+		args := os.Args[0:1]
+		// if run via `mailpit sendmail ...`
+		if len(os.Args) > 1 && os.Args[1] == "sendmail" {
+			args = os.Args[0:2]
+		}
+		fmt.Println(HelpTemplate(args))
 	}
 
-	var showHelp bool
-	// avoid 'pflag: help requested' error
-	flag.BoolVarP(&showHelp, "help", "h", false, "")
-
-	flag.Parse()
-
-	// allow recipients to be passed as an argument
-	recipients = flag.Args()
-
-	// if run via `mailpit sendmail ...` then remove `sendmail` from "recipients"
-	if len(recipients) > 0 && recipients[0] == "sendmail" {
-		recipients = recipients[1:]
+	recipients, showHelp, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err.Error())
+		usage()
+		os.Exit(exitUsage)
 	}
 
 	if showHelp {
-		flag.Usage()
+		usage()
 		os.Exit(0)
 	}
 
-	// ensure -bs is set
-	if UseB && !UseS || !UseB && UseS {
-		fmt.Printf("error: use -bs")
-		os.Exit(1)
+	// ensure -bs or -bm is set
+	if UseB && UseS == UseM || !UseB && (UseS || UseM) {
+		fmt.Fprintln(os.Stderr, "error: use -bs or -bm")
+		os.Exit(exitUsage)
 	}
 
 	// handles `sendmail -bs`
@@ -122,52 +135,230 @@ func Run() {
 		return
 	}
 
-	body, err := io.ReadAll(os.Stdin)
+	if err := Send(os.Stdin, recipients); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+
+		code := 1
+		var sErr sendError
+		if errors.As(err, &sErr) {
+			code = sErr.code
+		}
+		os.Exit(code)
+	}
+}
+
+// ParseFlags parses the sendmail command line arguments, returning the recipients.
+//
+// Sendmail options which are not supported, such as cron's `-FCronDaemon -B8BITMIME -oem`,
+// are accepted & ignored, as are any unknown flags.
+func parseFlags(args []string) ([]string, bool, error) {
+	fs := flag.NewFlagSet("sendmail", flag.ContinueOnError)
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+	fs.SetOutput(io.Discard)
+
+	var showHelp bool
+	var options []string
+
+	fs.StringVarP(&FromAddr, "from", "f", FromAddr, "SMTP sender")
+	fs.StringVarP(&SMTPAddr, "smtp-addr", "S", SMTPAddr, "SMTP server address")
+	fs.BoolVarP(&UseB, "long-b", "b", false, "Handle SMTP commands on standard input (use as -bs)")
+	fs.BoolVarP(&UseS, "long-s", "s", false, "Handle SMTP commands on standard input (use as -bs)")
+	fs.BoolVarP(&UseM, "long-m", "m", false, "Deliver mail in the usual way (use as -bm)")
+	fs.BoolVarP(&UseT, "long-t", "t", false, "Read recipients from the message headers")
+	fs.BoolVarP(&UseI, "long-i", "i", false, "Do not treat a line with a single dot as the end of the message")
+	fs.StringArrayVarP(&options, "long-o", "o", nil, "Set an option, only -oi is supported")
+	fs.BoolP("verbose", "v", false, "Ignored")
+	// avoid 'pflag: help requested' error
+	fs.BoolVarP(&showHelp, "help", "h", false, "")
+
+	// ignored sendmail flags which take a value, registered so the value is not
+	// mistaken for further flags, eg: -FCronDaemon
+	for _, f := range []string{"B", "C", "F", "L", "N", "O", "R", "V", "X", "p"} {
+		fs.StringP("long-"+f, f, "", "Ignored")
+	}
+
+	// ignored sendmail flags without a value
+	for _, f := range []string{"G", "U", "n"} {
+		fs.BoolP("long-"+f, f, false, "Ignored")
+	}
+
+	if err := fs.Parse(ignoreUnknownFlags(fs, args)); err != nil {
+		return nil, false, err
+	}
+
+	for _, o := range options {
+		if o == "i" {
+			UseI = true
+		}
+	}
+
+	// allow recipients to be passed as an argument
+	recipients := fs.Args()
+
+	// if run via `mailpit sendmail ...` then remove `sendmail` from "recipients"
+	if len(recipients) > 0 && recipients[0] == "sendmail" {
+		recipients = recipients[1:]
+	}
+
+	return recipients, showHelp, nil
+}
+
+// IgnoreUnknownFlags removes any unknown flags from the arguments. These are not left to
+// pflag's UnknownFlags whitelist as that would also remove the following argument, which
+// is likely to be a recipient.
+func ignoreUnknownFlags(fs *flag.FlagSet, args []string) []string {
+	result := []string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return append(result, args[i:]...)
+		}
+
+		var f *flag.Flag
+		if strings.HasPrefix(a, "--") {
+			f = fs.Lookup(strings.SplitN(a[2:], "=", 2)[0])
+		} else if len(a) > 1 && a[0] == '-' {
+			f = fs.ShorthandLookup(a[1:2])
+		} else {
+			result = append(result, a)
+			continue
+		}
+
+		if f == nil {
+			continue
+		}
+
+		result = append(result, a)
+
+		// a flag requiring a value, passed as a separate argument, eg: `-f sender@example.com`
+		if f.NoOptDefVal == "" && i+1 < len(args) && (a == "-"+f.Shorthand || a == "--"+f.Name) {
+			i++
+			result = append(result, args[i])
+		}
+	}
+
+	return result
+}
+
+// Send reads a message from r and sends it via SMTPAddr with the FromAddr envelope sender.
+//
+// With UseT the recipients are read from the To, Cc & Bcc headers, and the Bcc header is removed.
+// As with sendmail, any recipients passed as arguments are then excluded. Without UseT the message
+// is sent to the recipients, falling back to the message headers if no recipients are passed.
+//
+// Unless UseI is set, a line containing a single dot is treated as the end of the message.
+func Send(r io.Reader, recipients []string) error {
+	body, err := readMessage(r, !UseI)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error reading stdin")
-		os.Exit(11)
+		return sendError{exitDataErr, "error reading stdin"}
 	}
 
 	msg, err := mail.ReadMessage(bytes.NewReader(body))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error parsing message body: %si\n", err)
-		os.Exit(11)
+		return sendError{exitDataErr, fmt.Sprintf("error parsing message body: %s", err)}
 	}
 
 	addresses := []string{}
 
-	if len(recipients) > 0 {
-		addresses = recipients
-	} else {
-		// get all recipients in To, Cc and Bcc
-		if to, err := msg.Header.AddressList("To"); err == nil {
-			for _, a := range to {
-				addresses = append(addresses, a.Address)
+	if UseT || len(recipients) == 0 {
+		excluded := map[string]bool{}
+		if UseT {
+			for _, a := range recipients {
+				excluded[strings.ToLower(a)] = true
 			}
 		}
-		if cc, err := msg.Header.AddressList("Cc"); err == nil {
-			for _, a := range cc {
-				addresses = append(addresses, a.Address)
+
+		// get all recipients in To, Cc and Bcc
+		for _, h := range []string{"To", "Cc", "Bcc"} {
+			list, err := msg.Header.AddressList(h)
+			if err != nil {
+				continue
 			}
-		}
-		if bcc, err := msg.Header.AddressList("Bcc"); err == nil {
-			for _, a := range bcc {
-				addresses = append(addresses, a.Address)
+			for _, a := range list {
+				if !excluded[strings.ToLower(a.Address)] {
+					addresses = append(addresses, a.Address)
+				}
 			}
 		}
+
+		if UseT {
+			body = removeBcc(body)
+		}
+	} else {
+		addresses = recipients
+	}
+
+	if len(addresses) == 0 {
+		return sendError{exitUsage, "no recipients found"}
 	}
 
 	from, err := mail.ParseAddress(FromAddr)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "invalid from address")
-		os.Exit(11)
+		return sendError{exitUsage, "invalid from address"}
 	}
 
-	err = smtp.SendMail(SMTPAddr, nil, from.Address, addresses, body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "error sending mail")
-		logger.Log().Fatal(err)
+	if err := smtp.SendMail(SMTPAddr, nil, from.Address, addresses, body); err != nil {
+		code := exitTempFail
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) && tpErr.Code >= 500 {
+			code = exitUnavailable
+		}
+
+		return sendError{code, fmt.Sprintf("error sending mail: %s", err)}
+	}
+
+	return nil
+}
+
+// ReadMessage reads the message, optionally stopping at a line containing a single dot
+func readMessage(r io.Reader, dotTerminated bool) ([]byte, error) {
+	if !dotTerminated {
+		return io.ReadAll(r)
+	}
+
+	var b bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if string(bytes.TrimRight(line, "\r\n")) == "." {
+			break
+		}
+		b.Write(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	return b.Bytes(), nil
+}
+
+// RemoveBcc removes the Bcc header (including any folded lines) from the message headers
+func removeBcc(body []byte) []byte {
+	var out bytes.Buffer
+	inHeaders := true
+	skipping := false
+
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if inHeaders {
+			trimmed := bytes.TrimRight(line, "\r\n")
+			if len(trimmed) == 0 {
+				inHeaders = false
+			} else if skipping && (trimmed[0] == ' ' || trimmed[0] == '\t') {
+				continue
+			} else {
+				skipping = len(trimmed) > 4 && strings.EqualFold(string(trimmed[:4]), "bcc:")
+				if skipping {
+					continue
+				}
+			}
+		}
+		out.Write(line)
+	}
+
+	return out.Bytes()
 }
 
 // HelpTemplate returns a string of the help
@@ -182,9 +373,14 @@ Flags:
   -S  string  SMTP server address (default "localhost:1025")
   -f  string  Set the envelope sender address (default "%s")
   -bs         Handle SMTP commands on standard input
-  -t          Ignored
-  -i          Ignored
-  -o          Ignored
+  -bm         Deliver mail in the usual way (default)
+  -t          Read recipients from the To, Cc & Bcc headers, removing the Bcc header.
+              Any recipients passed as arguments are excluded.
+  -i, -oi     Do not treat a line with a single dot as the end of the message
+  -o  string  Set an option, all other than -oi are ignored
   -v          Ignored
+  -B, -C, -F, -L, -N, -O, -R, -V, -X, -p  string
+              Ignored
+  -G, -U, -n  Ignored
 `, config.Version, strings.Join(args, " "), FromAddr)
 }
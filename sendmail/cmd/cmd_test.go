@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/server/smtpd"
+)
+
+var (
+	envelopeFrom string
+	envelopeTo   []string
+)
+
+var (
+	cronMessage = "From: root (Cron Daemon)\n" +
+		"To: root\n" +
+		"Subject: Cron <root@server> /usr/local/bin/backup\n" +
+		"\n" +
+		"backup complete\n" +
+		".\n" +
+		"this line is after the dot\n"
+
+	phpMessage = "To: jane@example.com\r\n" +
+		"Subject: PHP mail()\r\n" +
+		"From: webmaster@example.com\r\n" +
+		"Cc: John <john@example.com>\r\n" +
+		"Bcc: secret@example.com,\r\n" +
+		" hidden@example.com\r\n" +
+		"X-Mailer: PHP/8.2\r\n" +
+		"\r\n" +
+		"Hello,\r\n" +
+		".\r\n" +
+		"Regards\r\n"
+
+	gitMessage = "From: Dev <dev@example.com>\n" +
+		"To: list@example.com\n" +
+		"Cc: maintainer@example.com\n" +
+		"Subject: [PATCH] fix typo\n" +
+		"Message-Id: <20240101.1234-1-dev@example.com>\n" +
+		"\n" +
+		"---\n" +
+		" README | 2 +-\n"
+)
+
+func TestSendmailCron(t *testing.T) {
+	addr := setup(t)
+
+	// cron: `sendmail -i -FCronDaemon -B8BITMIME -oem -f root@server root@server`
+	resetFlags(addr)
+	recipients := parseArgs(t, "-i", "-FCronDaemon", "-B8BITMIME", "-oem", "-f", "root@server", "root@server")
+	if err := Send(strings.NewReader(cronMessage), recipients); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEnvelope(t, "root@server", []string{"root@server"})
+
+	msg := latestMessage(t)
+	if !strings.Contains(msg.Text, "this line is after the dot") {
+		t.Errorf("message was truncated at a single dot with -i: %q", msg.Text)
+	}
+
+	// without -i the message ends at a single dot
+	resetFlags(addr)
+	recipients = parseArgs(t, "-FCronDaemon", "-B8BITMIME", "-oem", "root@server")
+	if err := Send(strings.NewReader(cronMessage), recipients); err != nil {
+		t.Fatal(err)
+	}
+
+	msg = latestMessage(t)
+	if strings.Contains(msg.Text, "this line is after the dot") {
+		t.Errorf("message was not terminated at a single dot: %q", msg.Text)
+	}
+}
+
+func TestSendmailPHP(t *testing.T) {
+	addr := setup(t)
+
+	// PHP mail(): `sendmail -t -i -f bounces@example.com`
+	resetFlags(addr)
+	recipients := parseArgs(t, "-t", "-i", "-f", "bounces@example.com")
+	if err := Send(strings.NewReader(phpMessage), recipients); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEnvelope(t, "bounces@example.com", []string{"jane@example.com", "john@example.com", "secret@example.com", "hidden@example.com"})
+
+	raw := latestRaw(t)
+	if strings.Contains(strings.ToLower(raw), "bcc:") || strings.Contains(raw, "hidden@example.com") {
+		t.Errorf("Bcc header was not removed: %q", raw)
+	}
+	if !strings.Contains(raw, "X-Mailer: PHP/8.2\r\n") || !strings.Contains(raw, "Regards") {
+		t.Errorf("message was modified: %q", raw)
+	}
+
+	// recipients passed as arguments are excluded with -t
+	resetFlags(addr)
+	recipients = parseArgs(t, "-t", "John@example.com")
+	if err := Send(strings.NewReader(phpMessage), recipients); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEnvelope(t, FromAddr, []string{"jane@example.com", "secret@example.com", "hidden@example.com"})
+}
+
+func TestSendmailGitSendEmail(t *testing.T) {
+	addr := setup(t)
+
+	// git send-email: `sendmail -i -f dev@example.com list@example.com maintainer@example.com extra@example.com`
+	resetFlags(addr)
+	recipients := parseArgs(t, "-i", "-f", "dev@example.com", "list@example.com", "maintainer@example.com", "extra@example.com")
+	if err := Send(strings.NewReader(gitMessage), recipients); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEnvelope(t, "dev@example.com", []string{"list@example.com", "maintainer@example.com", "extra@example.com"})
+
+	msg := latestMessage(t)
+	if msg.MessageID != "20240101.1234-1-dev@example.com" || msg.Subject != "[PATCH] fix typo" {
+		t.Errorf("unexpected message %q %q", msg.MessageID, msg.Subject)
+	}
+}
+
+func TestSendmailErrors(t *testing.T) {
+	addr := setup(t)
+
+	resetFlags(addr)
+	if err := Send(strings.NewReader("Subject: no recipients\n\ntest\n"), nil); err == nil {
+		t.Error("expected an error with no recipients")
+	} else if sErr, ok := err.(sendError); !ok || sErr.code != exitUsage {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// SMTP server unavailable
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetFlags(l.Addr().String())
+	l.Close()
+
+	if err := Send(strings.NewReader(gitMessage), nil); err == nil {
+		t.Error("expected an error sending to an unavailable server")
+	} else if sErr, ok := err.(sendError); !ok || sErr.code != exitTempFail {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func setup(t *testing.T) string {
+	logger.NoLogging = true
+	config.MaxMessages = 0
+	config.Database = os.Getenv("MP_DATABASE")
+
+	if err := storage.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(storage.Close)
+
+	if _, err := storage.DeleteAllMessages(true); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &smtpd.Server{
+		Appname:  "Mailpit",
+		Hostname: "mailpit",
+		Timeout:  5 * time.Second,
+		Handler: func(_ net.Addr, from string, to []string, data []byte) error {
+			envelopeFrom = from
+			envelopeTo = to
+			_, err := storage.Store(&data)
+			return err
+		},
+	}
+
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		args       []string
+		recipients []string
+		useI       bool
+	}{
+		{[]string{"-i", "-FCronDaemon", "-B8BITMIME", "-oem", "root"}, []string{"root"}, true},
+		{[]string{"-oi", "-odb", "user@example.com"}, []string{"user@example.com"}, true},
+		{[]string{"-F", "Cron Daemon", "-U", "-n", "a@example.com", "b@example.com"}, []string{"a@example.com", "b@example.com"}, false},
+		// when run via `mailpit sendmail ...`
+		{[]string{"sendmail", "-t", "-i"}, []string{}, true},
+		// unknown flags are ignored
+		{[]string{"-W", "--unknown", "root"}, []string{"root"}, false},
+	}
+
+	for _, test := range tests {
+		resetFlags("")
+		recipients := parseArgs(t, test.args...)
+		if strings.Join(recipients, ",") != strings.Join(test.recipients, ",") {
+			t.Errorf("%v: expected recipients %v, got %v", test.args, test.recipients, recipients)
+		}
+		if UseI != test.useI {
+			t.Errorf("%v: expected UseI %v, got %v", test.args, test.useI, UseI)
+		}
+		if UseB || UseS || UseM {
+			t.Errorf("%v: unexpected -b, -s or -m", test.args)
+		}
+	}
+
+	resetFlags("")
+	if _, showHelp, err := parseFlags([]string{"-h"}); err != nil || !showHelp {
+		t.Errorf("-h: expected help, got %v %v", showHelp, err)
+	}
+}
+
+func parseArgs(t *testing.T, args ...string) []string {
+	recipients, _, err := parseFlags(args)
+	if err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+
+	return recipients
+}
+
+func resetFlags(addr string) {
+	SMTPAddr = addr
+	FromAddr = "sender@example.com"
+	UseB = false
+	UseS = false
+	UseM = false
+	UseT = false
+	UseI = false
+	envelopeFrom = ""
+	envelopeTo = nil
+}
+
+func assertEnvelope(t *testing.T, from string, to []string) {
+	if envelopeFrom != from {
+		t.Errorf("envelope sender %q != %q", envelopeFrom, from)
+	}
+
+	if strings.Join(envelopeTo, ",") != strings.Join(to, ",") {
+		t.Errorf("envelope recipients %v != %v", envelopeTo, to)
+	}
+}
+
+func latestMessage(t *testing.T) *storage.Message {
+	messages, err := storage.List(0, 1, "")
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("no stored message: %v", err)
+	}
+
+	msg, err := storage.GetMessage(messages[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func latestRaw(t *testing.T) string {
+	msg := latestMessage(t)
+	raw, err := storage.GetMessageRaw(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(raw)
+}
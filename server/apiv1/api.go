@@ -2,27 +2,39 @@
 package apiv1
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/mail"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/antivirus"
 	"github.com/axllent/mailpit/internal/htmlcheck"
+	"github.com/axllent/mailpit/internal/httpclient"
 	"github.com/axllent/mailpit/internal/linkcheck"
 	"github.com/axllent/mailpit/internal/logger"
-	"github.com/axllent/mailpit/internal/spamassassin"
+	"github.com/axllent/mailpit/internal/paritycheck"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/axllent/mailpit/internal/tools"
-	"github.com/axllent/mailpit/server/smtpd"
+	"github.com/axllent/mailpit/server/handlers"
 	"github.com/gorilla/mux"
-	"github.com/lithammer/shortuuid/v4"
+)
+
+const (
+	// default & maximum time to wait for a message, see WaitForMessage()
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
 )
 
 // GetMessages returns a paginated list of messages as JSON
@@ -31,7 +43,7 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	//
 	// # List messages
 	//
-	// Returns messages from the mailbox ordered from newest to oldest.
+	// Returns messages from the mailbox ordered from newest to oldest, unless a sort order is specified.
 	//
 	//	Produces:
 	//	- application/json
@@ -51,18 +63,103 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	//	    required: false
 	//	    type: integer
 	//	    default: 50
+	//	  + name: sort
+	//	    in: query
+	//	    description: Sort order, either `created:desc` (newest first) or `created:asc` (oldest first)
+	//	    required: false
+	//	    type: string
+	//	    default: created:desc
+	//	  + name: filter
+	//	    in: query
+	//	    description: Filter messages by read status, either `all`, `read` or `unread`. The messages count reflects the filtered total.
+	//	    required: false
+	//	    type: string
+	//	    default: all
+	//	  + name: tag
+	//	    in: query
+	//	    description: Filter messages by tag (case-insensitive), can be repeated for multiple tags, eg: `tag=billing&tag=staging`. Tag names do not need to be quoted. The messages count reflects the filtered total.
+	//	    required: false
+	//	    type: string
+	//	  + name: tag_mode
+	//	    in: query
+	//	    description: Whether messages must have `all` of the tags, or `any` of the tags
+	//	    required: false
+	//	    type: string
+	//	    enum: all, any
+	//	    default: all
+	//	  + name: after_id
+	//	    in: query
+	//	    description: Return the messages following this message ID (the `next_cursor` of the previous page) instead of using the `start` offset. Recommended for paging through large mailboxes.
+	//	    required: false
+	//	    type: string
+	//	  + name: fields
+	//	    in: query
+	//	    description: Comma-separated message summary fields to return for each message (case-insensitive), eg: `ID,Subject,From,Created,Read`. All fields are returned if not set. Valid fields are ID, MessageID, Read, From, To, Cc, Bcc, ReplyTo, Subject, Created, Tags, Size, Attachments, AttachmentsSize, Snippet, BareLineEndings, TLS, Authenticated, Metadata, FirstOpened, SpamScore, HTMLScore, EnvelopeTo, Trashed, Pinned, Starred & ReleaseCount.
+	//	    required: false
+	//	    type: string
+	//	  + name: envelope
+	//	    in: query
+	//	    description: Include the SMTP envelope recipients (EnvelopeTo) of each message, including Bcc recipients
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: MessagesSummaryResponse
 	//		default: ErrorResponse
 	start, limit := getStartLimit(r)
+	filter := r.URL.Query().Get("filter")
+	sort := r.URL.Query().Get("sort")
+	afterID := strings.TrimSpace(r.URL.Query().Get("after_id"))
+
+	fields, err := summaryFields(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	tags := storage.TagFilter{Tags: r.URL.Query()["tag"]}
+	switch strings.ToLower(r.URL.Query().Get("tag_mode")) {
+	case "", "all":
+	case "any":
+		tags.Any = true
+	default:
+		httpError(w, fmt.Sprintf("Error: invalid tag_mode \"%s\", must be either all or any", r.URL.Query().Get("tag_mode")))
+		return
+	}
 
-	messages, err := storage.List(start, limit)
+	var messages []storage.MessageSummary
+	var filtered float64
+
+	// an additional message is requested to determine whether there are more results
+	if afterID != "" {
+		start = 0
+		messages, filtered, err = storage.ListAfter(afterID, limit+1, filter, sort, tags)
+		if err == storage.ErrMessageNotFound {
+			httpError(w, "invalid after_id: message not found")
+			return
+		}
+	} else {
+		messages, filtered, err = storage.ListFiltered(start, limit+1, filter, sort, tags)
+	}
 	if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
+	var nextCursor string
+	if len(messages) > limit {
+		messages = messages[:limit]
+		nextCursor = messages[limit-1].ID
+	}
+
+	if envelopeRecipients(r, fields) {
+		if err := storage.SetEnvelopeRecipients(messages); err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	}
+
 	stats := storage.StatsGet()
 
 	var res MessagesSummary
@@ -72,10 +169,141 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	res.Count = float64(len(messages)) // legacy - now undocumented in API specs
 	res.Total = stats.Total
 	res.Unread = stats.Unread
+	res.Pinned = stats.Pinned
 	res.Tags = stats.Tags
-	res.MessagesCount = stats.Total
+	res.MessagesCount = filtered
+	res.NextCursor = nextCursor
 
-	bytes, _ := json.Marshal(res)
+	bytes, _ := marshalMessagesSummary(res, fields)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// LatestMessageID (method: GET) returns the ID & received time of the latest message
+func LatestMessageID(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/latest-id messages LatestMessageID
+	//
+	// # Get latest message ID
+	//
+	// Returns the database ID and received time of the latest message, or of the latest message matching
+	// [a search](https://mailpit.axllent.org/docs/usage/search-filters/) if a query is provided. This is a lightweight
+	// alternative to fetching the latest message for clients polling for new messages.
+	// A 404 is returned if the mailbox is empty, or if no messages match the search.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: query
+	//	    in: query
+	//	    description: Search query, if not set then the latest message in the mailbox is returned
+	//	    required: false
+	//	    type: string
+	//	  + name: tz
+	//	    in: query
+	//	    description: [Timezone identifier](https://en.wikipedia.org/wiki/List_of_tz_database_time_zones) used specifically for `before:` & `after:` searches (eg: "Pacific/Auckland").
+	//	    required: false
+	//	    type: string
+	//
+	//	Responses:
+	//	  200: LatestMessageIDResponse
+	//	  default: ErrorResponse
+	search := strings.TrimSpace(r.URL.Query().Get("query"))
+
+	id, created, err := storage.LatestMessage(search, r.URL.Query().Get("tz"))
+	if err == storage.ErrMessageNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(LatestMessageIDResult{ID: id, Created: created})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// WaitForMessage (method: GET) waits for a message matching a search to arrive
+func WaitForMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/messages/wait messages WaitForMessage
+	//
+	// # Wait for a message
+	//
+	// Returns the summary of the latest message matching [a search](https://mailpit.axllent.org/docs/usage/search-filters/),
+	// or the latest message if no query is provided. If no messages match, the request is held open until a matching
+	// message is received, or the timeout is reached in which case a 204 (no content) is returned.
+	// This can be used by integration tests instead of repeatedly polling the search.
+	//
+	// The timeout is capped at 5 minutes.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: query
+	//	    in: query
+	//	    description: Search query, if not set then any message is matched
+	//	    required: false
+	//	    type: string
+	//	  + name: tz
+	//	    in: query
+	//	    description: [Timezone identifier](https://en.wikipedia.org/wiki/List_of_tz_database_time_zones) used specifically for `before:` & `after:` searches (eg: "Pacific/Auckland").
+	//	    required: false
+	//	    type: string
+	//	  + name: timeout
+	//	    in: query
+	//	    description: How long to wait for a matching message, eg: 10s or 2m
+	//	    required: false
+	//	    type: string
+	//	    default: 30s
+	//
+	//	Responses:
+	//	  200: MessageSummaryResponse
+	//	  204: NoContentResponse
+	//	  default: ErrorResponse
+	search := strings.TrimSpace(r.URL.Query().Get("query"))
+
+	timeout := defaultWaitTimeout
+	if v := strings.TrimSpace(r.URL.Query().Get("timeout")); v != "" {
+		d, err := tools.ParseDuration(v)
+		if err != nil || d <= 0 {
+			httpError(w, fmt.Sprintf("invalid timeout (%s), eg: 10s or 2m", v))
+			return
+		}
+		timeout = d
+	}
+
+	if timeout > maxWaitTimeout {
+		timeout = maxWaitTimeout
+	}
+
+	// extend the server write timeout for this request, ignored if the connection does not support it
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	m, err := storage.WaitForMessage(ctx, search, r.URL.Query().Get("tz"))
+	if err == storage.ErrWaitCancelled {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "server is shutting down")
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if m == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	bytes, _ := json.Marshal(m)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
@@ -87,6 +315,20 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	// # Search messages
 	//
 	// Returns messages matching [a search](https://mailpit.axllent.org/docs/usage/search-filters/), sorted by received date (descending).
+	// Messages can be filtered by size using `larger:<size>` and `smaller:<size>`, where the size is in bytes with an optional
+	// `K` or `M` suffix, eg: `larger:500K`. `message-id:<id>` returns the messages with exactly that Message-ID header,
+	// with or without angle brackets. `before:` and `after:` accept a date, or a duration relative to now with an `s`, `m`,
+	// `h`, `d` or `w` unit, eg: `after:30m`. `attachment:<name>` and `attachment-type:<type>` match the file names and
+	// content types of inline parts & attachments. `spam-score:<score>` and `html-score:<score>` match the stored SpamAssassin
+	// and HTML check scores with an optional `>`, `>=`, `<` or `<=` operator, eg: `spam-score:>5`. Messages which have not been
+	// checked have no score, so never match a score filter and are never excluded by a negated one. `auth:<username>` and
+	// `helo:<hostname>` match the SMTP AUTH username and HELO/EHLO hostname of messages received via SMTP. Searches for
+	// internationalised domains also match their punycode form & vice versa, eg: `例え.jp` matches `xn--r8jz45g.jp`. An
+	// invalid search query returns a 400 error.
+	//
+	// The response includes an `ETag` header, and a `304 Not Modified` response without a body is returned if the request
+	// includes a matching `If-None-Match` header. The ETag is advisory only, and changes whenever the matching messages or
+	// their read status or tags change. This allows frequent polling of the same search with minimal overhead.
 	//
 	//	Produces:
 	//	- application/json
@@ -116,9 +358,21 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	//	    description: [Timezone identifier](https://en.wikipedia.org/wiki/List_of_tz_database_time_zones) used specifically for `before:` & `after:` searches (eg: "Pacific/Auckland").
 	//	    required: false
 	//	    type: string
+	//	  + name: fields
+	//	    in: query
+	//	    description: Comma-separated message summary fields to return for each message (case-insensitive), eg: `ID,Subject,From,Created,Read`. All fields are returned if not set. Valid fields are ID, MessageID, Read, From, To, Cc, Bcc, ReplyTo, Subject, Created, Tags, Size, Attachments, AttachmentsSize, Snippet, BareLineEndings, TLS, Authenticated, Metadata, FirstOpened, SpamScore, HTMLScore, EnvelopeTo, Trashed, Pinned, Starred & ReleaseCount.
+	//	    required: false
+	//	    type: string
+	//	  + name: envelope
+	//	    in: query
+	//	    description: Include the SMTP envelope recipients (EnvelopeTo) of each message, including Bcc recipients
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: MessagesSummaryResponse
+	//		304: NotModifiedResponse
 	//		default: ErrorResponse
 	search := strings.TrimSpace(r.URL.Query().Get("query"))
 	if search == "" {
@@ -128,12 +382,49 @@ func Search(w http.ResponseWriter, r *http.Request) {
 
 	start, limit := getStartLimit(r)
 
+	fields, err := summaryFields(r)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	digest, err := storage.SearchDigest(search, r.URL.Query().Get("tz"), start, limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	envelope := envelopeRecipients(r, fields)
+
+	// the response differs for each set of fields
+	if fields != nil {
+		digest = digest + "-" + strings.Join(fields, ",")
+	}
+	if envelope {
+		digest = digest + "-envelope"
+	}
+
+	etag := `"` + digest + `"`
+	w.Header().Set("ETag", etag)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && (match == etag || match == "W/"+etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	messages, results, err := storage.Search(search, r.URL.Query().Get("tz"), start, limit)
 	if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
+	if envelope {
+		if err := storage.SetEnvelopeRecipients(messages); err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	}
+
 	stats := storage.StatsGet()
 
 	var res MessagesSummary
@@ -144,9 +435,13 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	res.Total = stats.Total            // total messages in mailbox
 	res.MessagesCount = float64(results)
 	res.Unread = stats.Unread
+	res.Pinned = stats.Pinned
 	res.Tags = stats.Tags
+	if pending := storage.SearchPendingBackfills(search); len(pending) > 0 {
+		res.IncompleteMigrations = pending
+	}
 
-	bytes, _ := json.Marshal(res)
+	bytes, _ := marshalMessagesSummary(res, fields)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
@@ -157,10 +452,19 @@ func DeleteSearch(w http.ResponseWriter, r *http.Request) {
 	//
 	// # Delete messages by search
 	//
-	// Delete all messages matching [a search](https://mailpit.axllent.org/docs/usage/search-filters/).
+	// Delete all messages matching [a search](https://mailpit.axllent.org/docs/usage/search-filters/), including the
+	// `larger:<size>` and `smaller:<size>` filters, and relative `before:` & `after:` dates, eg: `before:7d` deletes
+	// messages received more than 7 days ago. An invalid search query returns a 400 error.
+	//
+	// Pinned messages are not deleted unless `force=true` is set.
+	//
+	// The number of matched and deleted messages is returned. With `dry_run=true` no messages are deleted,
+	// and only the number of matching messages is returned. Requests with an `Accept: text/plain` header
+	// receive a plain `ok` response (except for dry runs).
 	//
 	//	Produces:
 	//	- application/json
+	//	- text/plain
 	//
 	//	Schemes: http, https
 	//
@@ -175,9 +479,21 @@ func DeleteSearch(w http.ResponseWriter, r *http.Request) {
 	//	    description: [Timezone identifier](https://en.wikipedia.org/wiki/List_of_tz_database_time_zones) used specifically for `before:` & `after:` searches (eg: "Pacific/Auckland").
 	//	    required: false
 	//	    type: string
+	//	  + name: dry_run
+	//	    in: query
+	//	    description: Return the number of matching messages without deleting them
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//	  + name: force
+	//	    in: query
+	//	    description: Also delete pinned messages
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
-	//		200: OKResponse
+	//		200: DeleteSearchResponse
 	//		default: ErrorResponse
 	search := strings.TrimSpace(r.URL.Query().Get("query"))
 	if search == "" {
@@ -185,13 +501,41 @@ func DeleteSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := storage.DeleteSearch(search, r.URL.Query().Get("tz")); err != nil {
-		httpError(w, err.Error())
-		return
+	d := r.URL.Query().Get("dry_run")
+	dryRun := d == "true" || d == "1"
+
+	f := r.URL.Query().Get("force")
+	force := f == "true" || f == "1"
+
+	res := DeleteSearchResult{}
+
+	if dryRun {
+		matched, err := storage.CountSearch(search, r.URL.Query().Get("tz"))
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+
+		res.Matched = matched
+	} else {
+		deleted, err := storage.DeleteSearch(search, r.URL.Query().Get("tz"), force)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+
+		res.Matched, res.Deleted = deleted, deleted
+
+		if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+			w.Header().Add("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
 	}
 
-	w.Header().Add("Content-Type", "text/plain")
-	_, _ = w.Write([]byte("ok"))
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
 }
 
 // GetMessage (method: GET) returns the Message as JSON
@@ -200,10 +544,16 @@ func GetMessage(w http.ResponseWriter, r *http.Request) {
 	//
 	// # Get message summary
 	//
-	// Returns the summary of a message, marking the message as read.
+	// Returns the summary of a message, marking the message as read. The first time a message is fetched
+	// its `FirstOpened` timestamp is set. Set `mark_read` to `false` to fetch the message without marking
+	// it as read or setting its `FirstOpened` timestamp, eg: for monitoring scripts.
 	//
 	// The ID can be set to `latest` to return the latest message.
 	//
+	// The HTML `cid:` references to inline images can be rewritten by setting `embedCID` to either `link` (absolute
+	// part download URLs) or `base64` (data URIs). References which cannot be resolved are left untouched. The
+	// `CIDMap` field maps Content-IDs to part IDs for clients which prefer to rewrite references themselves.
+	//
 	//	Produces:
 	//	- application/json
 	//
@@ -215,6 +565,24 @@ func GetMessage(w http.ResponseWriter, r *http.Request) {
 	//	    description: Message database ID or "latest"
 	//	    required: true
 	//	    type: string
+	//	  + name: embedCID
+	//	    in: query
+	//	    description: Rewrite HTML cid: references to absolute part URLs (link) or base64 data URIs (base64)
+	//	    required: false
+	//	    type: string
+	//	    enum: link, base64
+	//	  + name: mark_read
+	//	    in: query
+	//	    description: Mark the message as read (set to false to fetch the message without changing its read status)
+	//	    required: false
+	//	    type: boolean
+	//	    default: true
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: Message
@@ -234,77 +602,711 @@ func GetMessage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	msg, err := storage.GetMessage(id)
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	m := r.URL.Query().Get("mark_read")
+	peek := m == "false" || m == "0"
+
+	var msg *storage.Message
+	var err error
+
+	if peek {
+		msg, err = storage.GetMessagePeek(id)
+	} else {
+		if err := storage.MarkOpened(id); err != nil {
+			logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "db", logger.FieldMessageID: id, logger.FieldError: err.Error()})).
+				Errorf("[db] %s", err.Error())
+		}
+
+		msg, err = storage.GetMessage(id)
+	}
 	if err != nil {
 		fourOFour(w)
 		return
 	}
 
+	if mode := r.URL.Query().Get("embedCID"); mode != "" {
+		msg.HTML, err = handlers.EmbedCIDs(r, msg, mode)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	}
+
 	bytes, _ := json.Marshal(msg)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
 
-// DownloadAttachment (method: GET) returns the attachment data
-func DownloadAttachment(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID}/part/{PartID} message Attachment
+// GetMessageHTML (method: GET) returns the message HTML with cid: references rewritten
+func GetMessageHTML(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/html message GetMessageHTML
 	//
-	// # Get message attachment
+	// # Get message HTML
+	//
+	// Returns the HTML part of the message with all `cid:` references (eg: inline images) rewritten so the HTML
+	// renders standalone, for instance when embedded in an external report. By default (`embed=cid`) references are
+	// rewritten to absolute part download URLs, or with `embed=datauri` to base64 data URIs.
+	// Content-IDs are matched case-insensitively, and references to missing Content-IDs are left untouched.
 	//
-	// This will return the attachment part using the appropriate Content-Type.
+	// A 404 is returned if the message does not contain a HTML part. The message is not marked as read.
+	//
+	// The ID can be set to `latest` to return the HTML of the latest message.
 	//
 	//	Produces:
-	//	- application/*
-	//	- image/*
-	//	- text/*
+	//	- text/html
 	//
 	//	Schemes: http, https
 	//
 	//	Parameters:
 	//	  + name: ID
 	//	    in: path
-	//	    description: Message database ID
+	//	    description: Message database ID or "latest"
 	//	    required: true
 	//	    type: string
-	//	  + name: PartID
-	//	    in: path
-	//	    description: Attachment part ID
-	//	    required: true
+	//	  + name: embed
+	//	    in: query
+	//	    description: Rewrite cid: references to part URLs (cid) or base64 data URIs (datauri)
+	//	    required: false
 	//	    type: string
+	//	    enum: cid, datauri
+	//	    default: cid
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
-	//		200: BinaryResponse
+	//		200: HTMLResponse
 	//		default: ErrorResponse
 
 	vars := mux.Vars(r)
 
 	id := vars["id"]
-	partID := vars["partID"]
 
-	a, err := storage.GetAttachmentPart(id, partID)
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	var mode string
+	switch e := strings.ToLower(r.URL.Query().Get("embed")); e {
+	case "", "cid":
+		mode = "link"
+	case "datauri":
+		mode = "base64"
+	default:
+		httpError(w, fmt.Sprintf("Error: invalid embed value \"%s\", must be either cid or datauri", e))
+		return
+	}
+
+	msg, err := storage.GetMessagePeek(id)
 	if err != nil {
 		fourOFour(w)
 		return
 	}
-	fileName := a.FileName
-	if fileName == "" {
-		fileName = a.ContentID
+
+	if msg.HTML == "" {
+		w.WriteHeader(404)
+		fmt.Fprint(w, "This message does not contain a HTML part")
+		return
 	}
 
-	w.Header().Add("Content-Type", a.ContentType)
-	w.Header().Set("Content-Disposition", "filename=\""+fileName+"\"")
-	_, _ = w.Write(a.Content)
-}
+	html, err := handlers.EmbedCIDs(r, msg, mode)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", config.ContentSecurityPolicy)
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(html))
+}
+
+// GetMessageByMessageID (method: GET) returns the message summary matching a Message-ID header
+func GetMessageByMessageID(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message-id/{MessageID} message MessageByMessageID
+	//
+	// # Get message summary by Message-ID
+	//
+	// Returns the summary of the message matching the RFC 5322 Message-ID header. The Message-ID must be
+	// URL-encoded (eg: `abc%40example.com`), and the surrounding angle brackets are optional.
+	//
+	// If more than one message shares the same Message-ID, an array of message summaries is returned
+	// (latest to oldest). A 404 is returned if no messages match.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: MessageID
+	//	    in: path
+	//	    description: URL-encoded Message-ID header, with or without angle brackets
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: MessageSummaryResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	messageID := strings.Trim(strings.TrimSpace(vars["messageID"]), "<>")
+	if messageID == "" {
+		httpError(w, "Error: no Message-ID")
+		return
+	}
+
+	messages, err := storage.GetMessageSummariesByMessageID(messageID)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if len(messages) == 0 {
+		fourOFour(w)
+		return
+	}
+
+	var bytes []byte
+	if len(messages) == 1 {
+		bytes, _ = json.Marshal(messages[0])
+	} else {
+		bytes, _ = json.Marshal(messages)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DownloadAttachment (method: GET) returns the attachment data
+func DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/part/{PartID} message Attachment
+	//
+	// # Get message attachment
+	//
+	// This will return the attachment part using the appropriate Content-Type. Any other non-multipart part
+	// of the message part tree (see `/api/v1/message/{ID}/parts`) can also be returned, eg: the HTML body.
+	// Range requests are supported, as are conditional requests using the `ETag` & `Last-Modified` headers.
+	//
+	//	Produces:
+	//	- application/*
+	//	- image/*
+	//	- text/*
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID
+	//	    required: true
+	//	    type: string
+	//	  + name: PartID
+	//	    in: path
+	//	    description: Attachment part ID
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+	partID := vars["partID"]
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	a, err := storage.GetAttachmentPart(id, partID)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+	fileName := a.FileName
+	if fileName == "" {
+		fileName = a.ContentID
+	}
+
+	w.Header().Add("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", "filename=\""+fileName+"\"")
+	serveContent(w, r, id, id+"-"+partID, a.Content)
+}
+
+// AttachmentChecksum (method: GET) returns the size & digests of an attachment
+func AttachmentChecksum(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/part/{PartID}/checksum message AttachmentChecksum
+	//
+	// # Get attachment checksum
+	//
+	// Returns the size and the MD5, SHA1 & SHA256 hex digests of the decoded attachment content, for
+	// verifying or deduplicating attachments without downloading them.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID
+	//	    required: true
+	//	    type: string
+	//	  + name: PartID
+	//	    in: path
+	//	    description: Attachment part ID
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: AttachmentChecksumResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+	partID := vars["partID"]
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	checksum, err := storage.GetAttachmentChecksum(id, partID)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(checksum)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// ServeContent writes the content of a message or part, supporting Range & conditional requests.
+// The ETag is set from the tag & content size, as pruning attachments changes the stored message,
+// and Last-Modified is the time the message was received.
+func serveContent(w http.ResponseWriter, r *http.Request, id, tag string, content []byte) {
+	modified, err := storage.GetMessageCreated(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, tag, len(content)))
+	http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+}
+
+// DownloadAttachmentsZip (method: GET) returns a zip archive of the message attachments
+func DownloadAttachmentsZip(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/attachments.zip message AttachmentsZip
+	//
+	// # Get message attachments as a zip archive
+	//
+	// Returns a zip archive containing all attachments of the message, named using their file name (or Content-ID if
+	// the part has no file name). Duplicate names are numbered, eg: `report-2.pdf`. Inline parts (eg: embedded images)
+	// are only included if `inline` is set. A 404 is returned if the message has no (matching) attachments.
+	//
+	// The ID can be set to `latest` to return the attachments of the latest message.
+	//
+	//	Produces:
+	//	- application/zip
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: inline
+	//	    in: query
+	//	    description: Include inline parts
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: BinaryResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	i := r.URL.Query().Get("inline")
+	inline := i == "true" || i == "1"
+
+	parts, err := storage.GetAttachmentParts(id, inline)
+	if err != nil || len(parts) == 0 {
+		fourOFour(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+id+".zip\"")
+
+	// entries are written as they are compressed, so the archive is never held in memory
+	zw := zip.NewWriter(w)
+
+	names := map[string]bool{}
+	for _, p := range parts {
+		name := zipEntryName(p.FileName, p.ContentID, names)
+
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			logger.Log().Errorf("[api] %s", err.Error())
+			return
+		}
+
+		if _, err := f.Write(p.Content); err != nil {
+			logger.Log().Errorf("[api] %s", err.Error())
+			return
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		logger.Log().Errorf("[api] %s", err.Error())
+	}
+}
+
+// ZipEntryName returns a unique name for a zip archive entry from the part file name (or Content-ID),
+// removing any directories & numbering duplicates, eg: report-2.pdf
+func zipEntryName(fileName, contentID string, used map[string]bool) string {
+	name := fileName
+	if name == "" {
+		name = contentID
+	}
+
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "attachment"
+	}
+
+	unique := name
+	ext := filepath.Ext(name)
+	for n := 2; used[strings.ToLower(unique)]; n++ {
+		unique = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	used[strings.ToLower(unique)] = true
+
+	return unique
+}
+
+// ListAttachments (method: GET) returns a paginated list of the attachments of all messages
+func ListAttachments(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/attachments messages ListAttachments
+	//
+	// # List attachments
+	//
+	// Returns the inline parts & attachments of all messages, ordered by the messages from newest to oldest, with
+	// the details of each message. Parts without a file name use their Content-ID as the file name. The part can be
+	// downloaded using the message database ID & part ID.
+	//
+	// Parts of messages stored by older versions of Mailpit are listed once a background migration has completed.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: type
+	//	    in: query
+	//	    description: Only return parts with a content type containing this value (case-insensitive), eg: `pdf`
+	//	    required: false
+	//	    type: string
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
+	//
+	//	Responses:
+	//		200: AttachmentsListResponse
+	//		default: ErrorResponse
+	start, limit := getStartLimit(r)
+
+	attachments, total, err := storage.ListAttachments(r.URL.Query().Get("type"), start, limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	res := AttachmentsList{
+		Total:       total,
+		Start:       start,
+		Attachments: attachments,
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetHeaders (method: GET) returns the message headers as JSON
+func GetHeaders(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/headers message Headers
+	//
+	// # Get message headers
+	//
+	// Returns the message headers as an array.
+	//
+	// By default the headers are returned as an object of canonical header names to an array of values. Set
+	// `format` to `ordered` to return an array of headers in their original order & case instead, with each
+	// repeated header (eg: Received) returned separately, the unfolded Value and the Raw header including folding.
+	//
+	// Set `decode` to decode RFC 2047 encoded-words (eg: `=?UTF-8?B?...?=`) in the header values, including legacy
+	// charsets such as ISO-8859-1, windows-1252, GB2312 & Shift_JIS. Values which cannot be decoded are returned as-is.
+	//
+	// The ID can be set to `latest` to return the latest message headers.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: format
+	//	    in: query
+	//	    description: Header format, either map or ordered
+	//	    required: false
+	//	    type: string
+	//	    enum: map, ordered
+	//	    default: map
+	//	  + name: decode
+	//	    in: query
+	//	    description: Decode RFC 2047 encoded-words in header values
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//	  200: MessageHeaders
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format != "" && format != "map" && format != "ordered" {
+		httpError(w, fmt.Sprintf("Error: invalid format \"%s\", must be either map or ordered", format))
+		return
+	}
+
+	d := r.URL.Query().Get("decode")
+	decode := d == "true" || d == "1"
+
+	data, err := storage.GetMessageRaw(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	if format == "ordered" {
+		headers, err := tools.ParseOrderedHeaders(data)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+
+		if decode {
+			for i, h := range headers {
+				headers[i].Value = tools.DecodeHeader(h.Value)
+			}
+		}
+
+		bytes, _ := json.Marshal(headers)
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+		return
+	}
+
+	reader := bytes.NewReader(data)
+	m, err := mail.ReadMessage(reader)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if decode {
+		for k, values := range m.Header {
+			for i, v := range values {
+				m.Header[k][i] = tools.DecodeHeader(v)
+			}
+		}
+	}
+
+	bytes, err := json.Marshal(m.Header)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMessageEnvelope (method: GET) returns the SMTP envelope & connection details of a message
+func GetMessageEnvelope(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/envelope message MessageEnvelope
+	//
+	// # Get message envelope
+	//
+	// Returns the SMTP envelope sender & recipients of a message, and details of the connection it was received on
+	// (client IP, HELO/EHLO hostname, TLS, authentication & AUTH username). The envelope recipients include any Bcc recipients.
+	// Messages which were not received via SMTP, or were received by an older version, have no envelope details.
+	//
+	// The ID can be set to `latest` to return the envelope of the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//	  200: MessageEnvelopeResponse
+	//	  default: ErrorResponse
 
-// GetHeaders (method: GET) returns the message headers as JSON
-func GetHeaders(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID}/headers message Headers
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	envelope, err := storage.GetMessageEnvelope(id)
+	if err == storage.ErrMessageNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(envelope)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// MessageEvents (method: GET) returns the processing events of a message
+func MessageEvents(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/events message MessageEvents
 	//
-	// # Get message headers
+	// # Get message events
 	//
-	// Returns the message headers as an array.
+	// Returns the processing events of a message in chronological order, such as when it was received,
+	// tagged, scored, delivered to webhooks, released or read. Only the most recent 100 events are kept.
 	//
-	// The ID can be set to `latest` to return the latest message headers.
+	// The ID can be set to `latest` to return the events of the latest message.
 	//
 	//	Produces:
 	//	- application/json
@@ -319,7 +1321,7 @@ func GetHeaders(w http.ResponseWriter, r *http.Request) {
 	//	    type: string
 	//
 	//	Responses:
-	//	  200: MessageHeaders
+	//	  200: MessageEventsResponse
 	//	  default: ErrorResponse
 
 	vars := mux.Vars(r)
@@ -336,25 +1338,290 @@ func GetHeaders(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data, err := storage.GetMessageRaw(id)
-	if err != nil {
+	events, err := storage.GetMessageEvents(id)
+	if err == storage.ErrMessageNotFound {
 		fourOFour(w)
 		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
 	}
 
-	reader := bytes.NewReader(data)
-	m, err := mail.ReadMessage(reader)
-	if err != nil {
+	bytes, _ := json.Marshal(events)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// MessageThread (method: GET) returns the summaries of the messages in the same conversation as a message
+func MessageThread(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/thread message MessageThread
+	//
+	// # Get message thread
+	//
+	// Returns the summaries of all messages in the same conversation as a message (including the message itself),
+	// oldest first. Messages are linked by their Message-ID, In-Reply-To & References headers, so replies still thread
+	// together if a message in the conversation was deleted. A maximum of 500 messages are returned.
+	//
+	// The ID can be set to `latest` to return the thread of the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//	  200: MessageThreadResponse
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	messages, err := storage.GetThread(id)
+	if err == storage.ErrMessageNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	bytes, err := json.Marshal(m.Header)
-	if err != nil {
+	bytes, _ := json.Marshal(messages)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// AdjacentMessages (method: GET) returns the IDs of the previous & next messages relative to a message
+func AdjacentMessages(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/adjacent message AdjacentMessages
+	//
+	// # Get adjacent messages
+	//
+	// Returns the database IDs of the previous (newer) and next (older) messages relative to a message, in the same
+	// order as the messages are listed, or as [a search](https://mailpit.axllent.org/docs/usage/search-filters/) if a
+	// query is provided. `previous` or `next` are null at the start or end of the list. Messages received at the same
+	// time are ordered consistently, so navigating never skips or repeats a message.
+	//
+	// The ID can be set to `latest` to use the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: query
+	//	    in: query
+	//	    description: Search query, if not set then all messages are navigated
+	//	    required: false
+	//	    type: string
+	//	  + name: tz
+	//	    in: query
+	//	    description: [Timezone identifier](https://en.wikipedia.org/wiki/List_of_tz_database_time_zones) used specifically for `before:` & `after:` searches (eg: "Pacific/Auckland").
+	//	    required: false
+	//	    type: string
+	//
+	//	Responses:
+	//	  200: AdjacentMessagesResponse
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("query"))
+
+	previous, next, err := storage.AdjacentMessages(id, search, r.URL.Query().Get("tz"))
+	if err == storage.ErrMessageNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
+	res := AdjacentMessagesResult{}
+	if previous != "" {
+		res.Previous = &previous
+	}
+	if next != "" {
+		res.Next = &next
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetCIDMap (method: GET) returns the Content-ID mapping of a message's parts
+func GetCIDMap(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/cid-map message CIDMap
+	//
+	// # Get message Content-ID map
+	//
+	// Returns the parts of a message which have a Content-ID (including parts nested in multipart/related
+	// structures) in the order they appear in the message, mapping each Content-ID to its part ID. This can be
+	// used to resolve `cid:` references in the message HTML without fetching the full message summary.
+	// Inline parts without a Content-ID are included with a null ContentID.
+	//
+	// The ID can be set to `latest` to return the map of the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//	  200: CIDMapResponse
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	parts, err := storage.GetCIDParts(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(parts)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetMessageParts (method: GET) returns the MIME part tree of a message
+func GetMessageParts(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/parts message MessageParts
+	//
+	// # Get message part tree
+	//
+	// Returns the MIME structure of the message as a tree of parts, as opposed to the simplified HTML, text,
+	// inline & attachment summary of the message. This is useful for debugging MIME structure problems, such as
+	// a multipart/related part nested inside a multipart/alternative part. Each non-multipart part can be
+	// downloaded using its part ID.
+	//
+	// Problems encountered while parsing the message (eg: malformed headers or boundaries) are returned as
+	// warnings, along with as much of the tree as could be recovered.
+	//
+	// The ID can be set to `latest` to return the parts of the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//	  200: MessagePartsResponse
+	//	  default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	root, warnings, err := storage.GetMessagePartTree(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	bytes, _ := json.Marshal(MessagePartsResult{Root: root, Warnings: warnings})
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
@@ -365,7 +1632,8 @@ func DownloadRaw(w http.ResponseWriter, r *http.Request) {
 	//
 	// # Get message source
 	//
-	// Returns the full email source as plain text.
+	// Returns the full email source as plain text. Range requests are supported, as are conditional requests
+	// using the `ETag` & `Last-Modified` headers.
 	//
 	// The ID can be set to `latest` to return the latest message source.
 	//
@@ -380,6 +1648,12 @@ func DownloadRaw(w http.ResponseWriter, r *http.Request) {
 	//	    description: Message database ID or "latest"
 	//	    required: true
 	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: TextResponse
@@ -400,6 +1674,10 @@ func DownloadRaw(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if trashedMessage(w, r, id) {
+		return
+	}
+
 	data, err := storage.GetMessageRaw(id)
 	if err != nil {
 		fourOFour(w)
@@ -410,7 +1688,7 @@ func DownloadRaw(w http.ResponseWriter, r *http.Request) {
 	if dl == "1" {
 		w.Header().Set("Content-Disposition", "attachment; filename=\""+id+".eml\"")
 	}
-	_, _ = w.Write(data)
+	serveContent(w, r, id, id, data)
 }
 
 // DeleteMessages (method: DELETE) deletes all messages matching IDS.
@@ -419,18 +1697,25 @@ func DeleteMessages(w http.ResponseWriter, r *http.Request) {
 	//
 	// # Delete messages
 	//
-	// Delete individual or all messages. If no IDs are provided then all messages are deleted.
+	// Delete individual or all messages. If no IDs are provided then all messages are deleted,
+	// except pinned messages unless `force=true` is set.
+	//
+	// When the request accepts JSON, the number of deleted messages and any IDs which did not match a message
+	// are returned. IDs which do not match a message do not prevent the other messages from being deleted,
+	// however a 404 is returned if none of the IDs match a message.
+	// Requests without an `Accept` header receive a plain `ok` response.
 	//
 	//	Consumes:
 	//	- application/json
 	//
 	//	Produces:
 	//	- text/plain
+	//	- application/json
 	//
 	//	Schemes: http, https
 	//
 	//	Responses:
-	//		200: OKResponse
+	//		200: DeleteMessagesResponse
 	//		default: ErrorResponse
 
 	decoder := json.NewDecoder(r.Body)
@@ -438,20 +1723,94 @@ func DeleteMessages(w http.ResponseWriter, r *http.Request) {
 		IDs []string
 	}
 	err := decoder.Decode(&data)
+
+	res := DeleteMessagesResult{NotFound: []string{}}
+	status := http.StatusOK
+
 	if err != nil || len(data.IDs) == 0 {
-		if err := storage.DeleteAllMessages(); err != nil {
+		f := r.URL.Query().Get("force")
+		res.Deleted, err = storage.DeleteAllMessages(f == "true" || f == "1")
+		if err != nil {
 			httpError(w, err.Error())
 			return
 		}
 	} else {
-		if err := storage.DeleteMessages(data.IDs); err != nil {
+		res.Deleted, res.NotFound, err = storage.DeleteMessages(data.IDs)
+		if err != nil {
 			httpError(w, err.Error())
 			return
 		}
+
+		if res.Deleted == 0 {
+			status = http.StatusNotFound
+		}
 	}
 
-	w.Header().Add("Content-Type", "application/plain")
-	_, _ = w.Write([]byte("ok"))
+	accept := r.Header.Get("Accept")
+	if !strings.Contains(accept, "application/json") && !strings.Contains(accept, "*/*") {
+		if status == http.StatusNotFound {
+			fourOFour(w)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/plain")
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
+// DeleteOldMessages (method: DELETE) will delete all messages older than an age
+func DeleteOldMessages(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/messages/old messages DeleteOldMessages
+	//
+	// # Delete old messages
+	//
+	// Delete all messages older than an age, eg: `72h` or `7d`. The cutoff is calculated by the server when the
+	// request is received. Unread messages are kept if `unread=keep` is set.
+	//
+	// The number of deleted messages and their total size in bytes are returned.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: DeleteOldMessagesResponse
+	//		400: ErrorResponse
+
+	age := strings.TrimSpace(r.URL.Query().Get("age"))
+	if age == "" {
+		httpError(w, "Error: no age provided")
+		return
+	}
+
+	d, err := tools.ParseDuration(age)
+	if err != nil || d <= 0 {
+		httpError(w, fmt.Sprintf("Error: invalid age (%s), eg: 72h or 7d", age))
+		return
+	}
+
+	unread := r.URL.Query().Get("unread")
+	if unread != "" && unread != "keep" {
+		httpError(w, fmt.Sprintf("Error: invalid unread option (%s), only \"keep\" is supported", unread))
+		return
+	}
+
+	deleted, size, err := storage.DeleteOlderThan(d, unread == "keep")
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(DeleteOldMessagesResult{Deleted: deleted, Size: size})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
 }
 
 // SetReadStatus (method: PUT) will update the status to Read/Unread for all provided IDs
@@ -506,18 +1865,14 @@ func SetReadStatus(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		if data.Read {
-			for _, id := range ids {
-				if err := storage.MarkRead(id); err != nil {
-					httpError(w, err.Error())
-					return
-				}
+			if _, err := storage.MarkReadIDs(ids); err != nil {
+				httpError(w, err.Error())
+				return
 			}
 		} else {
-			for _, id := range ids {
-				if err := storage.MarkUnread(id); err != nil {
-					httpError(w, err.Error())
-					return
-				}
+			if _, err := storage.MarkUnreadIDs(ids); err != nil {
+				httpError(w, err.Error())
+				return
 			}
 		}
 	}
@@ -526,6 +1881,48 @@ func SetReadStatus(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("ok"))
 }
 
+// SetStarredStatus (method: PUT) will star or unstar all provided IDs
+// If no IDs are provided then all messages are updated.
+func SetStarredStatus(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/messages/star messages SetStarredStatus
+	//
+	// # Set starred status
+	//
+	// Star or unstar messages, independent of the read status. If no IDs are provided then all messages are updated.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data struct {
+		Starred bool
+		IDs     []string
+	}
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if _, err := storage.SetStarred(data.IDs, data.Starred); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
 // GetAllTags (method: GET) will get all tags currently in use
 func GetAllTags(w http.ResponseWriter, _ *http.Request) {
 	// swagger:route GET /api/v1/tags tags GetAllTags
@@ -534,6 +1931,11 @@ func GetAllTags(w http.ResponseWriter, _ *http.Request) {
 	//
 	// Returns a JSON array of all unique message tags.
 	//
+	// New messages are tagged via the X-Tags header, the plus part of addresses in the message headers
+	// (eg: user+tagname@example.com), `--tag` filters and tag rules. If Mailpit is started with `--tags-from-plus-address`
+	// then messages received via SMTP are also tagged with the plus part of the envelope recipients (RCPT TO),
+	// which includes Bcc recipients.
+	//
 	//	Produces:
 	//	- application/json
 	//
@@ -555,6 +1957,40 @@ func GetAllTags(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write(data)
 }
 
+// GetTagStats (method: GET) will get all tags currently in use with their message counts
+func GetTagStats(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/tags/stats tags GetTagStats
+	//
+	// # Get tag statistics
+	//
+	// Returns all tags currently in use ordered by name, with the total & unread number of messages with each tag,
+	// and the received time of the latest message with each tag.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagStatsResponse
+	//		default: ErrorResponse
+
+	stats, err := storage.GetTagStats()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
 // SetMessageTags (method: PUT) will set the tags for all provided IDs
 func SetMessageTags(w http.ResponseWriter, r *http.Request) {
 	// swagger:route PUT /api/v1/tags tags SetTags
@@ -563,6 +1999,9 @@ func SetMessageTags(w http.ResponseWriter, r *http.Request) {
 	//
 	// This will overwrite any existing tags for selected message database IDs. To remove all tags from a message, pass an empty tags array.
 	//
+	// Tag names are trimmed, internal whitespace is collapsed, and names are compared case-insensitively (the casing of existing tags is retained).
+	// If any tag names are invalid then no tags are set, and a 400 response listing the invalid names is returned.
+	//
 	//	Consumes:
 	//	- application/json
 	//
@@ -591,162 +2030,476 @@ func SetMessageTags(w http.ResponseWriter, r *http.Request) {
 	ids := data.IDs
 
 	if len(ids) > 0 {
-		for _, id := range ids {
-			if err := storage.SetMessageTags(id, data.Tags); err != nil {
-				httpError(w, err.Error())
-				return
-			}
+		if err := storage.SetTagsForIDs(ids, data.Tags); err != nil {
+			httpError(w, err.Error())
+			return
 		}
 	}
 
-	w.Header().Add("Content-Type", "text/plain")
-	_, _ = w.Write([]byte("ok"))
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// PatchMessageTags (method: PATCH) will add or remove tags for messages, preserving their other tags
+func PatchMessageTags(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PATCH /api/v1/tags tags PatchTags
+	//
+	// # Add or remove message tags
+	//
+	// Add or remove the listed tags for selected message database IDs, preserving all other tags, unlike `PUT /api/v1/tags`
+	// which overwrites the tags. The `Action` must be either `add` or `remove`. Adding a tag which a message already has,
+	// or removing a tag which a message does not have, has no effect. Each message is updated in its own transaction.
+	//
+	// Tag names are validated in the same way as `PUT /api/v1/tags`, and if any tag names are invalid then no tags are
+	// changed, and a 400 response listing the invalid names is returned. The result for each message is returned,
+	// including the added & removed tags and the resulting tags.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: PatchTagsResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data patchTagsRequestBody
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	var results []storage.MessageTagsResult
+	var err error
+
+	switch strings.ToLower(data.Action) {
+	case "add":
+		results, err = storage.AddMessageTags(data.IDs, data.Tags)
+	case "remove":
+		results, err = storage.RemoveMessageTags(data.IDs, data.Tags)
+	default:
+		httpError(w, fmt.Sprintf("Error: invalid action \"%s\", must be either add or remove", data.Action))
+		return
+	}
+
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(results)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// SetSearchTags (method: PUT) will set the tags for all messages matching a search
+func SetSearchTags(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/tags/search tags SetSearchTags
+	//
+	// # Set message tags by search
+	//
+	// Set the tags of all messages matching [a search](https://mailpit.axllent.org/docs/usage/search-filters/).
+	// This will overwrite any existing tags of the matching messages unless `Append` is true, in which case the
+	// tags are added to the existing tags. All matching messages are updated in a single transaction.
+	//
+	// Tag names are validated in the same way as `PUT /api/v1/tags`, and if any tag names are invalid then no tags
+	// are set, and a 400 response listing the invalid names is returned. The number of matching messages, and the
+	// number of messages with changed tags, are returned.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: tz
+	//	    in: query
+	//	    description: [Timezone identifier](https://en.wikipedia.org/wiki/List_of_tz_database_time_zones) used specifically for `before:` & `after:` searches (eg: "Pacific/Auckland").
+	//	    required: false
+	//	    type: string
+	//
+	//	Responses:
+	//		200: SetSearchTagsResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data struct {
+		Query  string
+		Tags   []string
+		Append bool
+	}
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	search := strings.TrimSpace(data.Query)
+	if search == "" {
+		httpError(w, "Error: no search query")
+		return
+	}
+
+	matched, updated, err := storage.SetSearchTags(search, r.URL.Query().Get("tz"), data.Tags, data.Append)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(SetSearchTagsResult{Matched: matched, Updated: updated})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// RenameTag (method: PUT) will rename a tag across all messages
+func RenameTag(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/tags/rename tags RenameTag
+	//
+	// # Rename a tag
+	//
+	// Rename a tag across all messages in a single transaction. If a tag with the new name already exists then
+	// the tags are merged. Renaming a tag to a different case of the same name changes the case of the tag.
+	// The tag metadata (see `PUT /api/v1/tags/meta`) is moved to the new name.
+	//
+	// The new tag name is validated in the same way as `PUT /api/v1/tags`, and if it is invalid then no tags
+	// are changed, and a 400 response is returned. A 404 response is returned if the tag does not exist.
+	// The number of affected messages is returned.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: RenameTagResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data renameTagRequestBody
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if strings.TrimSpace(data.From) == "" {
+		httpError(w, "Error: no tag to rename")
+		return
+	}
+
+	updated, err := storage.RenameTag(data.From, data.To)
+	if err == storage.ErrTagNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(RenameTagResult{Updated: updated})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DeleteTag (method: DELETE) will remove a tag from all messages
+func DeleteTag(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/tags/{Tag} tags DeleteTag
+	//
+	// # Delete a tag
+	//
+	// Remove a tag from all messages in a single transaction. Tag names are compared case-insensitively.
+	// The number of affected messages is returned, which is 0 if the tag does not exist. The tag metadata is also removed.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: Tag
+	//	    in: path
+	//	    description: Tag name
+	//	    required: true
+	//	    type: string
+	//
+	//	Responses:
+	//		200: DeleteTagResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	updated, err := storage.DeleteTag(vars["tag"])
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(DeleteTagResult{Updated: updated})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
 }
 
-// ReleaseMessage (method: POST) will release a message via a pre-configured external SMTP server.
-func ReleaseMessage(w http.ResponseWriter, r *http.Request) {
-	// swagger:route POST /api/v1/message/{ID}/release message ReleaseMessage
+// SetMessageMetadata (method: PUT) will set the key/value metadata of a message
+func SetMessageMetadata(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/message/{ID}/metadata message SetMessageMetadata
+	//
+	// # Set message metadata
 	//
-	// # Release message
+	// Set the key/value metadata of a message, returning the resulting metadata.
+	// The metadata is merged with any existing metadata (keys with empty values are removed) unless `Mode` is `replace`.
 	//
-	// Release a message via a pre-configured external SMTP server. This is only enabled if message relaying has been configured.
+	// The ID can be set to `latest` to update the latest message.
+	//
+	// Keys may contain up to 64 letters, numbers, dots, dashes & underscores, values are limited to 1024 bytes,
+	// and a message can have up to 50 keys. Requests exceeding these limits return a 400 response.
 	//
 	//	Consumes:
 	//	- application/json
 	//
 	//	Produces:
-	//	- text/plain
+	//	- application/json
 	//
 	//	Schemes: http, https
 	//
 	//	Responses:
-	//		200: OKResponse
+	//		200: MetadataResponse
 	//		default: ErrorResponse
 
 	vars := mux.Vars(r)
 
 	id := vars["id"]
 
-	msg, err := storage.GetMessageRaw(id)
-	if err != nil {
-		fourOFour(w)
-		return
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			fourOFour(w)
+			return
+		}
 	}
 
 	decoder := json.NewDecoder(r.Body)
 
-	data := releaseMessageRequestBody{}
+	var data setMetadataRequestBody
 
 	if err := decoder.Decode(&data); err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	for _, to := range data.To {
-		address, err := mail.ParseAddress(to)
+	if data.Mode != "" && data.Mode != "merge" && data.Mode != "replace" {
+		httpError(w, "invalid mode, must be either merge or replace")
+		return
+	}
 
-		if err != nil {
-			httpError(w, "Invalid email address: "+to)
+	meta, err := storage.SetMessageMetadata(id, data.Metadata, data.Mode == "replace")
+	if err != nil {
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			fourOFour(w)
 			return
 		}
+		httpError(w, err.Error())
+		return
+	}
 
-		if config.SMTPRelayConfig.AllowedRecipientsRegexp != nil && !config.SMTPRelayConfig.AllowedRecipientsRegexp.MatchString(address.Address) {
-			httpError(w, "Mail address does not match allowlist: "+to)
+	bytes, _ := json.Marshal(meta)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// HTMLCheck returns a summary of the HTML client support
+func HTMLCheck(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/html-check Other HTMLCheck
+	//
+	// # HTML check (beta)
+	//
+	// Returns the summary of the message HTML checker.
+	//
+	// The tested email clients & platforms can be limited with the comma-separated `clients` & `platforms` parameters,
+	// in which case the scores are calculated from the selected clients & platforms only. If neither is set then
+	// the configured defaults are used. A 400 response listing the valid identifiers is returned for unknown identifiers.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: HTMLCheckResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
 			return
 		}
 	}
 
-	if len(data.To) == 0 {
-		httpError(w, "No valid addresses found")
-		return
-	}
-
-	reader := bytes.NewReader(msg)
-	m, err := mail.ReadMessage(reader)
-	if err != nil {
-		httpError(w, err.Error())
+	if trashedMessage(w, r, id) {
 		return
 	}
 
-	froms, err := m.Header.AddressList("From")
+	msg, err := storage.GetMessage(id)
 	if err != nil {
-		httpError(w, err.Error())
+		fourOFour(w)
 		return
 	}
 
-	if len(froms) == 0 {
-		httpError(w, "No From header found")
+	if msg.HTML == "" {
+		httpError(w, "message does not contain HTML")
 		return
 	}
 
-	from := froms[0].Address
+	var checks htmlcheck.Response
+	clients, platforms := r.URL.Query().Get("clients"), r.URL.Query().Get("platforms")
+	if clients != "" || platforms != "" {
+		filter, err := htmlcheck.ParseFilter(clients, platforms)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
 
-	// if sender is used, then change from to the sender
-	if senders, err := m.Header.AddressList("Sender"); err == nil {
-		from = senders[0].Address
+		checks, err = htmlcheck.RunTests(msg.HTML, filter)
+	} else {
+		// results using the default filter are stored with the message
+		checks, err = storage.HTMLCheck(msg)
 	}
-
-	msg, err = tools.RemoveMessageHeaders(msg, []string{"Bcc"})
 	if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	// set the Return-Path and SMTP mfrom
-	if config.SMTPRelayConfig.ReturnPath != "" {
-		if m.Header.Get("Return-Path") != "<"+config.SMTPRelayConfig.ReturnPath+">" {
-			msg, err = tools.RemoveMessageHeaders(msg, []string{"Return-Path"})
-			if err != nil {
-				httpError(w, err.Error())
-				return
-			}
-			msg = append([]byte("Return-Path: <"+config.SMTPRelayConfig.ReturnPath+">\r\n"), msg...)
-		}
+	bytes, _ := json.Marshal(checks)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// LinkCheck returns a summary of links in the email
+func LinkCheck(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/link-check Other LinkCheck
+	//
+	// # Link check (beta)
+	//
+	// Returns the summary of the message Link checker.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: LinkCheckResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+	id := vars["id"]
 
-		from = config.SMTPRelayConfig.ReturnPath
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
 	}
 
-	// update message date
-	msg, err = tools.UpdateMessageHeader(msg, "Date", time.Now().Format(time.RFC1123Z))
-	if err != nil {
-		httpError(w, err.Error())
+	if trashedMessage(w, r, id) {
 		return
 	}
 
-	// generate unique ID
-	uid := shortuuid.New() + "@mailpit"
-	// update Message-Id with unique ID
-	msg, err = tools.UpdateMessageHeader(msg, "Message-Id", "<"+uid+">")
+	msg, err := storage.GetMessage(id)
 	if err != nil {
-		httpError(w, err.Error())
+		fourOFour(w)
 		return
 	}
 
-	if err := smtpd.Send(from, data.To, msg); err != nil {
-		logger.Log().Errorf("[smtp] error sending message: %s", err.Error())
-		httpError(w, "SMTP error: "+err.Error())
+	f := r.URL.Query().Get("follow")
+	followRedirects := f == "true" || f == "1"
+
+	summary, err := linkcheck.RunTests(msg, followRedirects)
+	if err != nil {
+		httpError(w, err.Error())
 		return
 	}
 
-	w.Header().Add("Content-Type", "text/plain")
-	_, _ = w.Write([]byte("ok"))
+	bytes, _ := json.Marshal(summary)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
 }
 
-// HTMLCheck returns a summary of the HTML client support
-func HTMLCheck(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID}/html-check Other HTMLCheck
+// TrackCheck returns a summary of suspected tracking images in the email
+func TrackCheck(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/track-check Other TrackCheck
 	//
-	// # HTML check (beta)
+	// # Tracking check (beta)
 	//
-	// Returns the summary of the message HTML checker.
+	// Returns the images of the message HTML which are suspected to be trackers (eg: open-tracking pixels),
+	// with the reasons they were flagged: 1x1 or hidden images, images hosted on known tracking domains, and
+	// image URLs containing common tracking parameters (eg: utm_source). Additional tracking domains can be
+	// configured with `--tracking-domains`.
+	//
+	// Only the stored HTML is checked unless `resolve` is set, in which case each image URL is also requested
+	// (HEAD) to detect tiny images, using the same timeout as the link check.
 	//
 	//	Produces:
 	//	- application/json
 	//
 	//	Schemes: http, https
 	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: resolve
+	//	    in: query
+	//	    description: Request each image URL to detect tiny images
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
 	//	Responses:
-	//		200: HTMLCheckResponse
+	//		200: TrackCheckResponse
 	//		default: ErrorResponse
 
 	vars := mux.Vars(r)
@@ -762,7 +2515,11 @@ func HTMLCheck(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	msg, err := storage.GetMessage(id)
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	msg, err := storage.GetMessagePeek(id)
 	if err != nil {
 		fourOFour(w)
 		return
@@ -773,32 +2530,43 @@ func HTMLCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	checks, err := htmlcheck.RunTests(msg.HTML)
+	v := r.URL.Query().Get("resolve")
+	resolve := v == "true" || v == "1"
+
+	summary, err := linkcheck.RunTrackingTests(msg, resolve)
 	if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	bytes, _ := json.Marshal(checks)
+	bytes, _ := json.Marshal(summary)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
 
-// LinkCheck returns a summary of links in the email
-func LinkCheck(w http.ResponseWriter, r *http.Request) {
-	// swagger:route GET /api/v1/message/{ID}/link-check Other LinkCheck
+// ParityCheck returns a comparison of the message HTML and text parts
+func ParityCheck(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/parity-check Other ParityCheck
 	//
-	// # Link check (beta)
+	// # HTML & text parity check (beta)
 	//
-	// Returns the summary of the message Link checker.
+	// Converts the message HTML to text and compares it against the text part, returning a similarity
+	// percentage, links & text found only in the HTML, and flags for empty or placeholder text parts, and
+	// multipart/alternative messages with the text part after the HTML part.
 	//
 	//	Produces:
 	//	- application/json
 	//
 	//	Schemes: http, https
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
-	//		200: LinkCheckResponse
+	//		200: ParityCheckResponse
 	//		default: ErrorResponse
 
 	vars := mux.Vars(r)
@@ -814,16 +2582,28 @@ func LinkCheck(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if trashedMessage(w, r, id) {
+		return
+	}
+
 	msg, err := storage.GetMessage(id)
 	if err != nil {
 		fourOFour(w)
 		return
 	}
 
-	f := r.URL.Query().Get("follow")
-	followRedirects := f == "true" || f == "1"
+	if msg.HTML == "" {
+		httpError(w, "message does not contain HTML")
+		return
+	}
 
-	summary, err := linkcheck.RunTests(msg, followRedirects)
+	raw, err := storage.GetMessageRaw(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	summary, err := paritycheck.RunTests(msg, raw)
 	if err != nil {
 		httpError(w, err.Error())
 		return
@@ -849,6 +2629,12 @@ func SpamAssassinCheck(w http.ResponseWriter, r *http.Request) {
 	//	- application/json
 	//
 	//	Schemes: http, https
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: SpamAssassinResponse
@@ -867,23 +2653,108 @@ func SpamAssassinCheck(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	msg, err := storage.GetMessageRaw(id)
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	summary, err := storage.SpamCheck(id)
+	if err == storage.ErrMessageNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(summary)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// AntivirusCheck returns the ClamAV results of a message & its attachments (if enabled)
+func AntivirusCheck(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/av-check Other AntivirusCheck
+	//
+	// # ClamAV check
+	//
+	// Scans the raw message, and then each decoded inline part & attachment, using ClamAV (if enabled) and
+	// returns the verdict of each. The raw message is returned with the PartID `raw`.
+	// If clamd is unavailable or does not respond in time then the Error is set.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: AntivirusResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	raw, err := storage.GetMessageRaw(id)
 	if err != nil {
 		fourOFour(w)
 		return
 	}
 
-	summary, err := spamassassin.Check(msg)
+	parts, err := storage.GetAttachmentParts(id, true)
 	if err != nil {
 		httpError(w, err.Error())
 		return
 	}
 
-	bytes, _ := json.Marshal(summary)
+	result, err := antivirus.Check(raw, parts)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(result)
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(bytes)
 }
 
+// TrashedMessage returns a 404 response if the message is in the trash, unless the request sets `trash`
+func trashedMessage(w http.ResponseWriter, r *http.Request, id string) bool {
+	t := r.URL.Query().Get("trash")
+	if t == "true" || t == "1" || !storage.IsTrashed(id) {
+		return false
+	}
+
+	fourOFour(w)
+
+	return true
+}
+
 // FourOFour returns a basic 404 message
 func fourOFour(w http.ResponseWriter) {
 	w.Header().Set("Referrer-Policy", "no-referrer")
@@ -893,6 +2764,24 @@ func fourOFour(w http.ResponseWriter) {
 	fmt.Fprint(w, "404 page not found")
 }
 
+// LogFields returns structured log fields for an API request, including the client IP & request ID (if set)
+func logFields(r *http.Request, f logger.Fields) logger.Fields {
+	if r == nil {
+		// not triggered by a request, eg: a scheduled release
+		return f
+	}
+
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		f[logger.FieldClientIP] = ip
+	}
+
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		f[logger.FieldRequestID] = id
+	}
+
+	return f
+}
+
 // HTTPError returns a basic error message (400 response)
 func httpError(w http.ResponseWriter, msg string) {
 	w.Header().Set("Referrer-Policy", "no-referrer")
@@ -1049,7 +2938,7 @@ func CheckDomains(w http.ResponseWriter, r *http.Request) {
 
         req.Header.Set("x-apikey", apiKey)
 
-        client := &http.Client{}
+        client := httpclient.Client(30*time.Second, false)
         resp, err := client.Do(req)
         if err != nil {
             errors = append(errors, fmt.Errorf("%w", err))
@@ -1091,7 +2980,8 @@ func CheckDomains(w http.ResponseWriter, r *http.Request) {
     if len(errors) > 0 {
         // Log errors or handle them appropriately (e.g., include them in a separate response field)
         for _, err := range errors {
-            fmt.Println("Error:", err) // Log the error
+            logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "api", logger.FieldError: err.Error()})).
+                Errorf("[api] domains check: %s", err.Error())
         }
     }
 
@@ -0,0 +1,97 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/axllent/mailpit/internal/calendar"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// GetCalendar (method: GET) returns the parsed calendars (eg: meeting invitations) of a message
+func GetCalendar(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/calendar message GetCalendar
+	//
+	// # Get message calendars
+	//
+	// Returns the events & to-dos of all text/calendar parts of the message (attachments or inline),
+	// including the summary, organizer, attendees, start & end times, recurrence rule and the
+	// calendar method (eg: REQUEST, CANCEL or REPLY).
+	//
+	// Times are returned in RFC3339 format using the event timezone, resolved via the calendar VTIMEZONE
+	// definitions or the IANA timezone name. Floating times & all-day dates are returned as UTC.
+	//
+	// A 400 response is returned if the message does not contain a calendar, or a calendar cannot be parsed.
+	//
+	// The ID can be set to `latest` to return the calendars of the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: CalendarResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	parts, err := storage.GetCalendarParts(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	if len(parts) == 0 {
+		httpError(w, "Error: message does not contain a calendar")
+		return
+	}
+
+	calendars := []calendar.Calendar{}
+	for _, p := range parts {
+		// content is already decoded from quoted-printable or base64
+		cal, err := calendar.Parse(p.Content)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Error: part %s: %s", p.PartID, err.Error()))
+			return
+		}
+		cal.PartID = p.PartID
+
+		calendars = append(calendars, cal)
+	}
+
+	bytes, _ := json.Marshal(calendars)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
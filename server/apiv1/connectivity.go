@@ -0,0 +1,113 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/httpclient"
+)
+
+// ConnectivityService is the connectivity result of an external service
+type ConnectivityService struct {
+	// Service name
+	Name string
+	// URL tested
+	URL string
+	// Proxy used to connect to the service (password redacted), empty if connecting directly
+	Proxy string
+	// Whether the service responded
+	Reachable bool
+	// HTTP status code of the response
+	Status int
+	// Error message if the service was not reachable
+	Error string `json:",omitempty"`
+}
+
+// ConnectivityResult is the result of the outbound connectivity test
+type ConnectivityResult struct {
+	// Local IP address or interface used for outbound requests, empty if not set
+	Bind string
+	// Services tested
+	Services []ConnectivityService
+}
+
+// Connectivity (method: GET) tests whether external services are reachable
+func Connectivity(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/connectivity application Connectivity
+	//
+	// # Test outbound connectivity
+	//
+	// Tests whether the external services used by Mailpit are reachable using the configured outbound
+	// proxy & bind address. A service is considered reachable if any HTTP response is received.
+	// Configured webhook endpoints are included.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ConnectivityResponse
+	//		default: ErrorResponse
+
+	services := []ConnectivityService{
+		{Name: "VirusTotal", URL: "https://www.virustotal.com/"},
+		{Name: "Postmark SpamCheck", URL: "https://spamcheck.postmarkapp.com/"},
+		{Name: "GitHub", URL: "https://api.github.com/"},
+	}
+
+	if config.WebhookURL != "" {
+		services = append(services, ConnectivityService{Name: "Webhook", URL: config.WebhookURL})
+	}
+
+	for _, wh := range config.Webhooks {
+		services = append(services, ConnectivityService{Name: "Webhook", URL: wh.URL})
+	}
+
+	client := httpclient.Client(10*time.Second, false)
+
+	var wg sync.WaitGroup
+
+	for i := range services {
+		wg.Add(1)
+		go func(s *ConnectivityService) {
+			defer wg.Done()
+
+			if u, err := url.Parse(s.URL); err == nil {
+				if p, err := httpclient.Proxy(u); err == nil && p != nil {
+					s.Proxy = p.Redacted()
+				}
+			}
+
+			req, err := http.NewRequest("HEAD", s.URL, nil)
+			if err != nil {
+				s.Error = err.Error()
+				return
+			}
+
+			req.Header.Set("User-Agent", "Mailpit/"+config.Version)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				s.Error = err.Error()
+				return
+			}
+			resp.Body.Close()
+
+			s.Reachable = true
+			s.Status = resp.StatusCode
+		}(&services[i])
+	}
+
+	wg.Wait()
+
+	res := ConnectivityResult{Bind: config.OutboundBind, Services: services}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
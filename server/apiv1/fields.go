@@ -0,0 +1,102 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// summaryFieldNames are the fields of a message summary which can be selected with the `fields` parameter
+var summaryFieldNames = func() []string {
+	names := []string{}
+	t := reflect.TypeOf(storage.MessageSummary{})
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, t.Field(i).Name)
+	}
+
+	return names
+}()
+
+// SummaryFields returns the message summary fields set via the comma-separated `fields` parameter,
+// or nil if not set. Field names are case-insensitive.
+func summaryFields(r *http.Request) ([]string, error) {
+	v := strings.TrimSpace(r.URL.Query().Get("fields"))
+	if v == "" {
+		return nil, nil
+	}
+
+	fields := []string{}
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+
+		name := ""
+		for _, n := range summaryFieldNames {
+			if strings.EqualFold(f, n) {
+				name = n
+				break
+			}
+		}
+
+		if name == "" {
+			return nil, fmt.Errorf("Error: invalid field \"%s\", valid fields are: %s", f, strings.Join(summaryFieldNames, ", "))
+		}
+
+		if !inArray(name, fields) {
+			fields = append(fields, name)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return fields, nil
+}
+
+// EnvelopeRecipients returns whether the SMTP envelope recipients should be included in message summaries,
+// either with `envelope=true` or by selecting the EnvelopeTo field.
+func envelopeRecipients(r *http.Request, fields []string) bool {
+	v := r.URL.Query().Get("envelope")
+
+	return v == "true" || v == "1" || inArray("EnvelopeTo", fields)
+}
+
+// MarshalMessagesSummary returns the JSON of a messages summary. If fields are set then
+// each message only contains those fields.
+func marshalMessagesSummary(res MessagesSummary, fields []string) ([]byte, error) {
+	b, err := json.Marshal(res)
+	if err != nil || fields == nil {
+		return b, err
+	}
+
+	data := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+
+	messages := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(data["messages"], &messages); err != nil {
+		return nil, err
+	}
+
+	for i, m := range messages {
+		projected := map[string]json.RawMessage{}
+		for _, f := range fields {
+			projected[f] = m[f]
+		}
+		messages[i] = projected
+	}
+
+	if data["messages"], err = json.Marshal(messages); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(data)
+}
@@ -0,0 +1,313 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/server/smtpd"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ForwardRetries is the number of times a temporary forwarding failure is retried
+	ForwardRetries = 3
+
+	// ForwardRetryDelay is the delay before the first retry of a failed forward, doubling with each retry
+	ForwardRetryDelay = 30 * time.Second
+
+	// messages received via SMTP waiting to be matched against the forwarding rules
+	forwardQueue = make(chan string, 1000)
+)
+
+func init() {
+	smtpd.OnMessageStored = queueForwarding
+}
+
+// GetForwardRules (method: GET) returns all forwarding rules
+func GetForwardRules(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/relay/rules release GetForwardRules
+	//
+	// # Get forwarding rules
+	//
+	// Returns all forwarding rules, including the number of messages forwarded by each rule. Messages received
+	// via SMTP matching the search of a rule are automatically released to the recipients of the rule.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ForwardRulesResponse
+	//		default: ErrorResponse
+
+	rules, err := storage.GetForwardRules()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(rules)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// AddForwardRule (method: POST) adds a forwarding rule
+func AddForwardRule(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/relay/rules release AddForwardRule
+	//
+	// # Add a forwarding rule
+	//
+	// Add a forwarding rule. Messages received via SMTP matching the `Query` (using the same syntax as
+	// [a search](https://mailpit.axllent.org/docs/usage/search-filters/)) are released to the `To` recipients
+	// via the relay profile, applying the same header rewriting, allowlist & blocklist checks as releasing a message.
+	// Matching messages are forwarded in the background, and temporary failures are retried a limited number of times.
+	//
+	// Rules only apply to messages received after the rule is added, and requires message relaying to be configured.
+	// Forwarding can be disabled for all rules with the `smtp-forwarding-paused` setting.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ForwardRuleResponse
+	//		default: ErrorResponse
+
+	rule, ok := forwardRuleFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rule, err := storage.AddForwardRule(rule)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(rule)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// UpdateForwardRule (method: PUT) updates a forwarding rule
+func UpdateForwardRule(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/relay/rules/{ID} release UpdateForwardRule
+	//
+	// # Update a forwarding rule
+	//
+	// Update the search query, recipients & relay profile of a forwarding rule. The forwarded count is preserved.
+	// A 404 response is returned if the rule does not exist.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ForwardRuleResponse
+	//		default: ErrorResponse
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	rule, ok := forwardRuleFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rule, err = storage.UpdateForwardRule(id, rule)
+	if err == storage.ErrForwardRuleNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(rule)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DeleteForwardRule (method: DELETE) deletes a forwarding rule
+func DeleteForwardRule(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/relay/rules/{ID} release DeleteForwardRule
+	//
+	// # Delete a forwarding rule
+	//
+	// Delete a forwarding rule. Pending retries of the rule are cancelled.
+	// A 404 response is returned if the rule does not exist.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	if err := storage.DeleteForwardRule(id); err == storage.ErrForwardRuleNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// ForwardRuleFromRequest returns the forwarding rule of a request, validating the relay profile & recipients
+// against the relay config. An error response is written if the rule is invalid.
+func forwardRuleFromRequest(w http.ResponseWriter, r *http.Request) (storage.ForwardRule, bool) {
+	var data forwardRuleRequestBody
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return storage.ForwardRule{}, false
+	}
+
+	if !config.ReleaseEnabled {
+		httpError(w, "Message relaying is not enabled")
+		return storage.ForwardRule{}, false
+	}
+
+	if _, err := validateRelease(data.Profile, data.To, "", ""); err != nil {
+		httpError(w, err.Error())
+		return storage.ForwardRule{}, false
+	}
+
+	return storage.ForwardRule{Query: data.Query, To: data.To, Profile: data.Profile}, true
+}
+
+// RunForwarder forwards messages received via SMTP which match the forwarding rules. Messages are
+// queued when they are stored so forwarding does not delay the SMTP transaction.
+func RunForwarder() {
+	for id := range forwardQueue {
+		ProcessForwarding(id)
+	}
+}
+
+// QueueForwarding queues a stored message to be matched against the forwarding rules, without blocking
+func queueForwarding(id string) {
+	if config.Runtime().SMTPForwardingPaused || !config.ReleaseEnabled {
+		return
+	}
+
+	select {
+	case forwardQueue <- id:
+	default:
+		logger.WithFields(logger.Fields{logger.FieldComponent: "forward", logger.FieldMessageID: id}).
+			Errorf("[forward] forwarding queue is full, not forwarding message %s", id)
+	}
+}
+
+// ProcessForwarding forwards a message to the recipients of each matching forwarding rule.
+// Temporary failures are retried in the background.
+func ProcessForwarding(id string) {
+	if config.Runtime().SMTPForwardingPaused {
+		return
+	}
+
+	rules, err := storage.MatchingForwardRules(id)
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldComponent: "forward", logger.FieldMessageID: id, logger.FieldError: err.Error()}).
+			Errorf("[forward] %s", err.Error())
+		return
+	}
+
+	for _, rule := range rules {
+		forwardMessage(id, rule, 1)
+	}
+}
+
+// ForwardMessage releases a message to the recipients of a forwarding rule, re-validating the rule against the
+// current relay config. A temporary failure is retried after an exponential backoff, up to ForwardRetries times.
+func forwardMessage(id string, rule storage.ForwardRule, attempt int) {
+	fields := logger.Fields{logger.FieldComponent: "forward", logger.FieldMessageID: id, "rule": rule.ID, "to": rule.To, "attempt": attempt}
+
+	if config.Runtime().SMTPForwardingPaused {
+		logger.WithFields(fields).Debugf("[forward] forwarding is paused, not forwarding message %s", id)
+		return
+	}
+
+	opts, err := validateRelease(rule.Profile, rule.To, "", "")
+	if err != nil {
+		fields[logger.FieldError] = err.Error()
+		logger.WithFields(fields).Errorf("[forward] forwarding rule %d is invalid: %s", rule.ID, err.Error())
+		return
+	}
+
+	send := func(from string, to []string, msg []byte) error {
+		return smtpd.SendVia(opts.relay, from, to, msg)
+	}
+
+	if err := releaseMessage(nil, id, opts, send); err != nil {
+		fields[logger.FieldError] = err.Error()
+
+		var rErr *smtpd.RelayError
+		temporary := errors.As(err, &rErr) && rErr.Temporary()
+
+		if !temporary || attempt > ForwardRetries {
+			logger.WithFields(fields).Errorf("[forward] error forwarding message %s (rule %d): %s", id, rule.ID, err.Error())
+			return
+		}
+
+		delay := ForwardRetryDelay * time.Duration(1<<(attempt-1))
+		logger.WithFields(fields).Warnf("[forward] error forwarding message %s (rule %d), retrying in %s: %s", id, rule.ID, delay, err.Error())
+
+		time.AfterFunc(delay, func() {
+			retryForward(id, rule.ID, attempt+1)
+		})
+
+		return
+	}
+
+	if err := storage.IncrementForwardRuleCount(rule.ID); err != nil {
+		logger.WithFields(fields).Errorf("[db] %s", err.Error())
+	}
+
+	logger.WithFields(fields).Infof("[forward] forwarded message %s to %s (rule %d)", id, opts.to, rule.ID)
+}
+
+// RetryForward retries forwarding a message with the current version of the rule, unless it has since been deleted
+func retryForward(id string, ruleID, attempt int) {
+	rules, err := storage.GetForwardRules()
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldComponent: "forward", logger.FieldMessageID: id, logger.FieldError: err.Error()}).
+			Errorf("[forward] %s", err.Error())
+		return
+	}
+
+	for _, rule := range rules {
+		if rule.ID == ruleID {
+			forwardMessage(id, rule, attempt)
+			return
+		}
+	}
+}
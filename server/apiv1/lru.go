@@ -0,0 +1,64 @@
+package apiv1
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRUCache is a fixed size cache, removing the least recently used item when full
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+// LRUItem is a cached item
+type lruItem struct {
+	key   string
+	value []byte
+}
+
+// NewLRUCache returns a new cache holding up to size items
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// Get returns a cached item, marking it as recently used
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+
+	return e.Value.(*lruItem).value, true
+}
+
+// Add caches an item, removing the least recently used item if the cache is full
+func (c *lruCache) Add(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruItem).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruItem{key, value})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem).key)
+	}
+}
@@ -0,0 +1,67 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tools"
+)
+
+// PruneAttachments will strip attachment data from messages older than a given age
+func PruneAttachments(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/maintenance/prune-attachments maintenance PruneAttachments
+	//
+	// # Prune attachments
+	//
+	// Strips the content of attachments from messages older than the given age, replacing each attachment
+	// with a small text placeholder recording the original filename, content type and size.
+	// Message bodies and headers are retained. Inline attachments (eg: images used in the HTML) can
+	// optionally be kept.
+	//
+	// Messages are processed in chunks and processed messages are flagged, so a limit can be set to
+	// process a large mailbox in several smaller requests. The response includes the remaining number
+	// of messages to process when a limit is set.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: PruneAttachmentsResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	data := pruneAttachmentsRequestBody{}
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	olderThan, err := tools.ParseDuration(data.OlderThan)
+	if err != nil || olderThan <= 0 {
+		httpError(w, "invalid older_than duration, eg: 30d or 12h")
+		return
+	}
+
+	if data.Limit < 0 {
+		httpError(w, "limit cannot be negative")
+		return
+	}
+
+	result, err := storage.PruneAttachments(olderThan, data.KeepInline, data.Limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(result)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,32 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// Migrations (method: GET) returns the progress of background migrations
+func Migrations(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/migrations application Migrations
+	//
+	// # Background migrations
+	//
+	// Returns the progress of background migrations. After an upgrade, some data of existing messages is
+	// populated in the background at a throttled rate, resuming after a restart. Searches depending on an
+	// incomplete migration list it in `incomplete_migrations`, as their results may be incomplete.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: MigrationsResponse
+	//		default: ErrorResponse
+
+	bytes, _ := json.Marshal(storage.BackfillStatuses())
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
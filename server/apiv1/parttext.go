@@ -0,0 +1,342 @@
+package apiv1
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/html/charset"
+)
+
+// default maximum size (bytes) of returned attachment text
+const partTextMaxSize = 1024 * 1024
+
+// non-text/* media types which are text
+var textMediaTypes = map[string]bool{
+	"application/json":        true,
+	"application/xml":         true,
+	"application/javascript":  true,
+	"application/csv":         true,
+	"application/x-sh":        true,
+	"application/x-yaml":      true,
+	"application/yaml":        true,
+	"application/x-ndjson":    true,
+	"application/sql":         true,
+	"message/rfc822":          true,
+	"message/delivery-status": true,
+}
+
+// AttachmentText (method: GET) returns the text content of an attachment
+func AttachmentText(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/part/{PartID}/text message AttachmentText
+	//
+	// # Get attachment text
+	//
+	// Returns the text content of a text attachment (eg: .txt, .csv, .log) converted to UTF-8, without
+	// having to download the attachment. The type is detected from the content if the attachment
+	// has a generic content type such as application/octet-stream.
+	//
+	// Text larger than `max` bytes (default 1MB) is truncated. Binary attachments return a
+	// 415 response, unless `best-effort` is set for a PDF with a text layer.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID
+	//	    required: true
+	//	    type: string
+	//	  + name: PartID
+	//	    in: path
+	//	    description: Attachment part ID
+	//	    required: true
+	//	    type: string
+	//	  + name: max
+	//	    in: query
+	//	    description: Maximum size of the returned text in bytes
+	//	    required: false
+	//	    type: integer
+	//	    default: 1048576
+	//	  + name: best-effort
+	//	    in: query
+	//	    description: Extract the text layer of PDF attachments
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: AttachmentTextResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+	partID := vars["partID"]
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	maxSize := partTextMaxSize
+	if v := r.URL.Query().Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			httpError(w, "Error: invalid max size")
+			return
+		}
+		maxSize = n
+	}
+
+	a, err := storage.GetAttachmentPart(id, partID)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	result := AttachmentTextResult{ContentType: a.ContentType}
+	content := a.Content
+
+	bestEffort := r.URL.Query().Get("best-effort")
+	pdfText := bestEffort == "true" || bestEffort == "1"
+
+	mediaType := strings.ToLower(a.ContentType)
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		// generic content type, detect from the content
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(content))
+	}
+
+	switch {
+	case isTextMediaType(mediaType) && !bytes.Contains(content, []byte{0}) || strings.HasPrefix(mediaType, "text/plain") && isUTF16(content):
+		result.Charset = "utf-8"
+		if a.Charset != "" {
+			// text/* parts are converted to UTF-8 from the stated charset
+			result.Charset = strings.ToLower(a.Charset)
+		}
+
+		if !utf8.Valid(content) || isUTF16(content) {
+			contentType := "text/plain"
+			if a.Charset != "" {
+				contentType = contentType + "; charset=" + a.Charset
+			}
+			enc, name, _ := charset.DetermineEncoding(content, contentType)
+			if decoded, err := enc.NewDecoder().Bytes(content); err == nil {
+				content = decoded
+				result.Charset = name
+			}
+		}
+	case mediaType == "application/pdf" && pdfText:
+		content = extractPDFText(content)
+		if len(content) == 0 {
+			unsupportedMediaType(w, "Error: no text layer found in PDF attachment")
+			return
+		}
+		result.Charset = "utf-8"
+	default:
+		unsupportedMediaType(w, fmt.Sprintf("Error: attachment is not text (%s)", mediaType))
+		return
+	}
+
+	result.Size = len(content)
+	if len(content) > maxSize {
+		content = content[:maxSize]
+		// avoid splitting a multibyte character
+		for len(content) > 0 && !utf8.Valid(content) {
+			content = content[:len(content)-1]
+		}
+		result.Truncated = true
+	}
+	result.Text = string(content)
+
+	bytes, _ := json.Marshal(result)
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// IsTextMediaType returns whether a media type is text
+func isTextMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		textMediaTypes[mediaType]
+}
+
+// IsUTF16 returns whether the content starts with a UTF-16 byte order mark
+func isUTF16(content []byte) bool {
+	return bytes.HasPrefix(content, []byte{0xfe, 0xff}) || bytes.HasPrefix(content, []byte{0xff, 0xfe})
+}
+
+func unsupportedMediaType(w http.ResponseWriter, msg string) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", config.ContentSecurityPolicy)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	fmt.Fprint(w, msg)
+}
+
+var (
+	pdfStreamRe = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+	pdfTextRe   = regexp.MustCompile(`(?s)\bBT\b(.*?)\bET\b`)
+	pdfTokenRe  = regexp.MustCompile(`(?s)\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>|\[|\]|-?\d*\.?\d+|T\*|Tj|TJ|Td|TD|'|"`)
+)
+
+// ExtractPDFText is a best-effort extraction of the text layer of a PDF. Only uncompressed &
+// FlateDecode content streams with literal or single-byte hex strings are supported.
+func extractPDFText(data []byte) []byte {
+	var out bytes.Buffer
+
+	for _, m := range pdfStreamRe.FindAllSubmatchIndex(data, -1) {
+		dict := data[m[2]:m[3]]
+		start := m[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[start : start+end]
+
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// streams often have trailing bytes, so ignore read errors
+			stream, _ = io.ReadAll(io.LimitReader(zr, 10*1024*1024))
+			zr.Close()
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+
+		for _, bt := range pdfTextRe.FindAllSubmatch(stream, -1) {
+			pdfTextObject(bt[1], &out)
+		}
+	}
+
+	return bytes.TrimSpace(out.Bytes())
+}
+
+// PdfTextObject writes the text of a PDF text object (between BT & ET)
+func pdfTextObject(obj []byte, out *bytes.Buffer) {
+	var operands []string
+	last := 0.0
+	inArray := false
+
+	for _, t := range pdfTokenRe.FindAll(obj, -1) {
+		tok := string(t)
+		switch {
+		case tok[0] == '(':
+			operands = append(operands, pdfLiteralString(tok[1:len(tok)-1]))
+		case tok[0] == '<':
+			b, err := hex.DecodeString(strings.Join(strings.Fields(tok[1:len(tok)-1]), ""))
+			if err == nil {
+				operands = append(operands, string(b))
+			}
+		case tok == "[":
+			inArray = true
+			operands = nil
+		case tok == "]":
+			inArray = false
+		case tok == "Tj" || tok == "TJ":
+			pdfWriteStrings(out, operands)
+			operands = nil
+		case tok == "'" || tok == `"`:
+			out.WriteString("\n")
+			pdfWriteStrings(out, operands)
+			operands = nil
+		case tok == "T*":
+			out.WriteString("\n")
+		case tok == "Td" || tok == "TD":
+			if last != 0 {
+				out.WriteString("\n")
+			}
+		default:
+			n, err := strconv.ParseFloat(tok, 64)
+			if err != nil {
+				continue
+			}
+			// large negative kerning within a TJ array is a word gap
+			if inArray && n < -200 {
+				operands = append(operands, " ")
+			}
+			last = n
+		}
+	}
+
+	out.WriteString("\n")
+}
+
+// PdfWriteStrings writes PDF strings as UTF-8, assuming a single-byte (Latin-1) encoding.
+// Control characters (eg: from two-byte CID fonts) are skipped.
+func pdfWriteStrings(out *bytes.Buffer, strs []string) {
+	for _, s := range strs {
+		for i := 0; i < len(s); i++ {
+			if s[i] >= 0x20 || s[i] == '\n' || s[i] == '\t' {
+				out.WriteRune(rune(s[i]))
+			}
+		}
+	}
+}
+
+// PdfLiteralString decodes the escapes of a PDF literal string
+func pdfLiteralString(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i == len(s)-1 {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'b', 'f':
+		case '\r', '\n':
+			// line continuation
+		default:
+			if s[i] >= '0' && s[i] <= '7' {
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				n, _ := strconv.ParseUint(s[i:j], 8, 8)
+				b.WriteByte(byte(n))
+				i = j - 1
+			} else {
+				b.WriteByte(s[i])
+			}
+		}
+	}
+
+	return b.String()
+}
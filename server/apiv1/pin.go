@@ -0,0 +1,80 @@
+package apiv1
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// PinMessage (method: PUT) will pin a message
+func PinMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/message/{ID}/pin message PinMessage
+	//
+	// # Pin message
+	//
+	// Pin a message. Pinned messages are kept when deleting all messages, deleting messages by search,
+	// and by the automatic pruning of messages, unless `force=true` is set when deleting.
+	//
+	// The ID can be set to `latest` to pin the latest message.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	setPinned(w, r, true)
+}
+
+// UnpinMessage (method: DELETE) will unpin a message
+func UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/message/{ID}/pin message UnpinMessage
+	//
+	// # Unpin message
+	//
+	// Unpin a message. The ID can be set to `latest` to unpin the latest message.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	setPinned(w, r, false)
+}
+
+// SetPinned sets the pinned status of the message in the request
+func setPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			fourOFour(w)
+			return
+		}
+	}
+
+	if err := storage.SetPinned(id, pinned); err != nil {
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			fourOFour(w)
+			return
+		}
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
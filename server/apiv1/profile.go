@@ -0,0 +1,113 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// ProfileImportResult is the result of a profile import
+//
+// swagger:model ProfileImportResult
+type ProfileImportResult struct {
+	// Import mode, either `merge` or `replace`
+	Mode string
+	// Results of each section in the profile
+	Sections []storage.ProfileSectionResult
+}
+
+// ExportProfile (method: GET) returns the non-message configuration as a portable profile
+func ExportProfile(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/profile/export application ExportProfile
+	//
+	// # Export profile
+	//
+	// Returns the non-message configuration stored in the database (runtime setting overrides, tag colors &
+	// descriptions, tag rules and forwarding rules) as a single JSON document, which can be imported into
+	// another Mailpit instance. The forwarded count of forwarding rules is not included.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ProfileResponse
+	//		default: ErrorResponse
+
+	profile, err := storage.ExportProfile()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(profile)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// ImportProfile (method: POST) applies a profile exported by ExportProfile
+func ImportProfile(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/profile/import application ImportProfile
+	//
+	// # Import profile
+	//
+	// Applies a profile returned by `GET /api/v1/profile/export`. Each section is validated and
+	// applied individually, either completely or not at all, and the result of each section is returned.
+	// In `merge` mode the profile is merged with the existing configuration, and in `replace` mode any
+	// existing configuration not contained in the profile is removed. Importing the same profile more
+	// than once has no further effect.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: mode
+	//	    in: query
+	//	    description: Import mode, either `merge` or `replace`
+	//	    required: false
+	//	    type: string
+	//	    default: merge
+	//
+	//	Responses:
+	//		200: ProfileImportResponse
+	//		400: ErrorResponse
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+
+	if mode != "merge" && mode != "replace" {
+		httpError(w, "invalid mode: must be merge or replace")
+		return
+	}
+
+	sections := map[string]json.RawMessage{}
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&sections); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	results, err := storage.ImportProfile(sections, mode == "replace")
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "http", "mode": mode})).
+		Infof("[profile] profile imported (%s)", mode)
+
+	bytes, _ := json.Marshal(ProfileImportResult{Mode: mode, Sections: results})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,58 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/axllent/mailpit/server/smtpd"
+)
+
+// SenderQuotas returns the sender quota usage of all senders within the quota window
+func SenderQuotas(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/sender-quotas application SenderQuotas
+	//
+	// # Get sender quotas
+	//
+	// Returns the number of accepted messages per sender (or sender domain) within the sender quota window,
+	// ordered by the most messages. Senders exceeding the quota receive a temporary 452 SMTP rejection.
+	// The list is empty if sender quotas are not enabled.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: SenderQuotasResponse
+	//		default: ErrorResponse
+
+	bytes, _ := json.Marshal(smtpd.SenderQuotas())
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// RecipientRejections returns the recipients recently rejected by the SMTP recipient policies
+func RecipientRejections(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/smtp/rejections application RecipientRejections
+	//
+	// # Get rejected recipients
+	//
+	// Returns the total number of recipients rejected at RCPT TO by the `--smtp-allowed-recipients` or
+	// `--smtp-denied-recipients` policies since Mailpit was started, along with the most recent (up to 100)
+	// rejections, newest first. Rejections are not persisted across restarts.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: RecipientRejectionsResponse
+	//		default: ErrorResponse
+
+	bytes, _ := json.Marshal(smtpd.GetRecipientRejections())
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
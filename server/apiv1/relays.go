@@ -0,0 +1,53 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/axllent/mailpit/config"
+)
+
+// GetRelayProfiles (method: GET) returns the configured relay profiles.
+func GetRelayProfiles(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/relays release GetRelayProfiles
+	//
+	// # List relay profiles
+	//
+	// Returns the relay profiles which messages can be released via, starting with the main relay config ("default")
+	// followed by any named `profiles` in the relay config. Credentials are never returned.
+	// An empty list is returned if message relaying is not configured.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: RelayProfilesResponse
+	//		default: ErrorResponse
+
+	profiles := []RelayProfile{}
+
+	if config.ReleaseEnabled {
+		for _, name := range config.RelayProfileNames() {
+			p, err := config.RelayProfile(name)
+			if err != nil {
+				continue
+			}
+
+			profiles = append(profiles, RelayProfile{
+				Name:              name,
+				SMTPServer:        fmt.Sprintf("%s:%d", p.Host, p.Port),
+				ReturnPath:        p.ReturnPath,
+				AllowedRecipients: p.AllowedRecipients,
+				BlockedRecipients: p.BlockedRecipients,
+				AllowedSenders:    p.AllowedSenders,
+			})
+		}
+	}
+
+	bytes, _ := json.Marshal(profiles)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
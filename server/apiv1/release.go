@@ -0,0 +1,578 @@
+package apiv1
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tools"
+	"github.com/axllent/mailpit/server/smtpd"
+	"github.com/gorilla/mux"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// ReleaseMessage (method: POST) will release a message via a pre-configured external SMTP server.
+func ReleaseMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/message/{ID}/release message ReleaseMessage
+	//
+	// # Release message
+	//
+	// Release a message via a pre-configured external SMTP server. This is only enabled if message relaying has been configured.
+	//
+	// An optional `from` address replaces the message From header & is used as the SMTP envelope sender,
+	// however a Return-Path set in the relay config always takes precedence for the envelope sender.
+	// An optional `subject` replaces the message Subject header. Overrides only apply to the released copy,
+	// the stored message is not modified.
+	//
+	// Internationalised (UTF-8) email addresses can only be released via a relay server supporting SMTPUTF8,
+	// else the release fails with a permanent error.
+	//
+	// If `use_original_recipients` is set then the message is released to its original recipients instead of `to`,
+	// being the SMTP envelope recipients if recorded, else the To, Cc & Bcc addresses of the message. The recipients
+	// must still match the allowlist in the relay config, and the resolved recipients are returned as JSON.
+	// Otherwise a plain `ok` response is returned.
+	//
+	// If `delete_after_release` is set (or enabled by default in the relay config) then the message is
+	// deleted once it has been successfully sent. The message is left untouched if sending fails.
+	//
+	// If either `at` (RFC3339 timestamp) or `delay` (duration, eg: 30m, 2h, 1d) is set then the release is
+	// scheduled instead of being sent immediately, and the scheduled release is returned as JSON. Scheduled
+	// releases are stored in the database, see "Get scheduled releases".
+	//
+	// If `dry_run` is set then the release is validated without being sent or scheduled, and a report of what
+	// would be sent (the envelope sender, rewritten headers & each recipient) is returned as JSON. Recipients are
+	// validated individually, so each rejected recipient is reported with its error. If `probe` is also set then
+	// the relay is asked whether it would accept each recipient (MAIL FROM & RCPT TO, followed by RSET & QUIT),
+	// without sending the message data.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- text/plain
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ReleaseMessageResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
+
+	if _, err := storage.GetMessageRaw(id); err != nil {
+		fourOFour(w)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	data := releaseMessageRequestBody{}
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if data.UseOriginalRecipients {
+		to, err := originalRecipients(id)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+		data.To = to
+	}
+
+	if data.DryRun {
+		res, err := releaseDryRun(id, data)
+		if err != nil {
+			if errors.Is(err, storage.ErrMessageNotFound) {
+				fourOFour(w)
+				return
+			}
+			httpError(w, err.Error())
+			return
+		}
+
+		bytes, _ := json.Marshal(res)
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+		return
+	}
+
+	opts, err := validateRelease(data.Profile, data.To, data.From, data.Subject)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if data.At != "" || data.Delay != "" {
+		due, err := releaseDue(data.At, data.Delay)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+
+		job, err := storage.AddReleaseJob(storage.ReleaseJob{
+			MessageID:          id,
+			Due:                due,
+			To:                 data.To,
+			From:               data.From,
+			Subject:            data.Subject,
+			Profile:            opts.relay.Name,
+			DeleteAfterRelease: deleteAfterRelease(data.DeleteAfterRelease),
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrMessageNotFound) {
+				fourOFour(w)
+				return
+			}
+			httpError(w, err.Error())
+			return
+		}
+
+		wakeReleaseScheduler()
+
+		bytes, _ := json.Marshal(job)
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+		return
+	}
+
+	send := func(from string, to []string, msg []byte) error {
+		return smtpd.SendVia(opts.relay, from, to, msg)
+	}
+
+	if err := releaseMessage(r, id, opts, send); err != nil {
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			fourOFour(w)
+			return
+		}
+		httpError(w, err.Error())
+		return
+	}
+
+	if deleteAfterRelease(data.DeleteAfterRelease) {
+		if _, _, err := storage.DeleteMessages([]string{id}); err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	}
+
+	if data.UseOriginalRecipients {
+		bytes, _ := json.Marshal(ReleaseMessageResult{To: data.To})
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(bytes)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// ReleaseMessages (method: POST) will release multiple messages via a pre-configured external SMTP server.
+func ReleaseMessages(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/messages/release messages ReleaseMessages
+	//
+	// # Release messages
+	//
+	// Release multiple messages via a pre-configured external SMTP server. This is only enabled if message relaying has been configured.
+	//
+	// The messages are either set by their database IDs, or by a [search](https://mailpit.axllent.org/docs/usage/search-filters/)
+	// `query` if no IDs are provided. Each message is released individually over a single relay connection, and the
+	// result of each is returned, so a failed message does not prevent the other messages from being released.
+	// The `to`, `from`, `subject` and `delete_after_release` options apply to every message, see "Release message" for details.
+	//
+	// Releases are limited to `release-rate-limit` messages per second if set in the relay config.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ReleaseMessagesResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	data := releaseMessagesRequestBody{}
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if len(data.IDs) == 0 && strings.TrimSpace(data.Query) != "" {
+		ids, err := storage.SearchIDs(strings.TrimSpace(data.Query), data.TZ)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+		data.IDs = ids
+
+		if len(data.IDs) == 0 {
+			httpError(w, "No messages match the search query")
+			return
+		}
+	}
+
+	if len(data.IDs) == 0 {
+		httpError(w, "No message IDs provided")
+		return
+	}
+
+	opts, err := validateRelease(data.Profile, data.To, data.From, data.Subject)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	deleteAfter := deleteAfterRelease(data.DeleteAfterRelease)
+
+	results := []ReleaseResult{}
+
+	batch := smtpd.NewRelayBatch(opts.relay)
+	defer batch.Close()
+
+	for _, id := range data.IDs {
+		res := ReleaseResult{ID: id}
+
+		if err := releaseMessage(r, id, opts, batch.Send); err != nil {
+			res.Error = err.Error()
+			results = append(results, res)
+			continue
+		}
+
+		res.Sent = true
+
+		if deleteAfter {
+			if _, _, err := storage.DeleteMessages([]string{id}); err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Deleted = true
+			}
+		}
+
+		results = append(results, res)
+	}
+
+	bytes, _ := json.Marshal(results)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DeleteAfterRelease returns whether a released message should be deleted,
+// using the relay config default if the request does not specify it.
+func deleteAfterRelease(v *bool) bool {
+	if v != nil {
+		return *v
+	}
+
+	return config.SMTPRelayConfig.DeleteAfterRelease
+}
+
+// ReleaseDue returns the due time of a scheduled release, set by either an RFC3339 timestamp or a duration
+func releaseDue(at, delay string) (time.Time, error) {
+	if at != "" && delay != "" {
+		return time.Time{}, errors.New("Only one of at or delay can be set")
+	}
+
+	if delay != "" {
+		d, err := tools.ParseDuration(delay)
+		if err != nil || d <= 0 {
+			return time.Time{}, errors.New("Invalid delay: " + delay)
+		}
+
+		return time.Now().Add(d), nil
+	}
+
+	due, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid at timestamp, expected RFC3339: " + at)
+	}
+
+	if !due.After(time.Now()) {
+		return time.Time{}, errors.New("The at timestamp must be in the future")
+	}
+
+	return due, nil
+}
+
+// OriginalRecipients returns the original recipients of a message, being the SMTP envelope recipients
+// if recorded, else the To, Cc & Bcc addresses of the message
+func originalRecipients(id string) ([]string, error) {
+	envelope, err := storage.GetMessageEnvelope(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.To) > 0 {
+		return envelope.To, nil
+	}
+
+	msg, err := storage.GetMessageRaw(id)
+	if err != nil {
+		return nil, storage.ErrMessageNotFound
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	to := []string{}
+	seen := map[string]bool{}
+	for _, h := range []string{"To", "Cc", "Bcc"} {
+		addresses, err := m.Header.AddressList(h)
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addresses {
+			if !seen[strings.ToLower(a.Address)] {
+				seen[strings.ToLower(a.Address)] = true
+				to = append(to, a.Address)
+			}
+		}
+	}
+
+	return to, nil
+}
+
+// ReleaseOptions are the validated options of a release
+type releaseOptions struct {
+	// the relay profile to release via
+	relay *config.SMTPRelayConfigStruct
+	// the recipients to release to
+	to []string
+	// optional From override, replacing the From header & envelope sender
+	from *mail.Address
+	// optional Subject override
+	subject string
+}
+
+// ValidateRelease resolves the relay profile & validates the release recipients & optional
+// From & Subject overrides against it
+func validateRelease(profile string, to []string, fromOverride, subject string) (releaseOptions, error) {
+	opts := releaseOptions{to: to, subject: subject}
+
+	relay, err := config.RelayProfile(profile)
+	if err != nil {
+		return opts, err
+	}
+	opts.relay = relay
+
+	for _, t := range to {
+		if err := validateReleaseRecipient(relay, t); err != nil {
+			return opts, err
+		}
+	}
+
+	if len(to) == 0 {
+		return opts, errors.New("No valid addresses found")
+	}
+
+	opts.from, err = validateReleaseOverrides(relay, fromOverride, subject)
+
+	return opts, err
+}
+
+// ValidateReleaseRecipient validates a release recipient against the blocklist & allowlist of a relay profile
+func validateReleaseRecipient(relay *config.SMTPRelayConfigStruct, to string) error {
+	address, err := mail.ParseAddress(to)
+	if err != nil {
+		return errors.New("Invalid email address: " + to)
+	}
+
+	if err := smtpd.CheckBlockedRecipient(relay, address.Address); err != nil {
+		return err
+	}
+
+	if relay.AllowedRecipientsRegexp != nil && !relay.AllowedRecipientsRegexp.MatchString(address.Address) {
+		return errors.New("Mail address does not match allowlist: " + to)
+	}
+
+	return nil
+}
+
+// ValidateReleaseOverrides validates the optional From & Subject overrides of a release, returning the parsed From
+// override (nil if not set)
+func validateReleaseOverrides(relay *config.SMTPRelayConfigStruct, fromOverride, subject string) (*mail.Address, error) {
+	if strings.ContainsAny(subject, "\r\n") {
+		return nil, errors.New("Invalid Subject: must be a single line")
+	}
+
+	if fromOverride == "" {
+		return nil, nil
+	}
+
+	address, err := mail.ParseAddress(fromOverride)
+	if err != nil {
+		return nil, errors.New("Invalid From address: " + fromOverride)
+	}
+
+	if relay.AllowedSendersRegexp != nil && !relay.AllowedSendersRegexp.MatchString(address.Address) {
+		return nil, errors.New("From address does not match allowed senders: " + fromOverride)
+	}
+
+	return address, nil
+}
+
+// ReleaseMessage sends a single stored message via the relay profile of the release options using send.
+// The From & Subject overrides (if set) replace the headers of the sent copy only, and the From override
+// is also used as the envelope sender unless the relay profile sets a Return-Path.
+func releaseMessage(r *http.Request, id string, opts releaseOptions, send func(string, []string, []byte) error) error {
+	from, msg, err := prepareRelease(id, opts)
+	if err != nil {
+		return err
+	}
+
+	details := map[string]string{
+		"from":  from,
+		"to":    strings.Join(opts.to, ", "),
+		"relay": fmt.Sprintf("%s:%d", opts.relay.Host, opts.relay.Port),
+	}
+
+	// scheduled releases have no client
+	var clientIP string
+	if r != nil {
+		clientIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+
+	if err := send(from, opts.to, msg); err != nil {
+		logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "smtp", logger.FieldMessageID: id, logger.FieldError: err.Error()})).
+			Errorf("[smtp] error sending message: %s", err.Error())
+		details["error"] = err.Error()
+		storage.AddMessageEvent(id, storage.EventReleaseFailed, details)
+		storage.AddReleaseHistory(id, opts.to, from, err.Error(), clientIP)
+		return fmt.Errorf("SMTP error: %w", err)
+	}
+
+	storage.AddMessageEvent(id, storage.EventReleased, details)
+	storage.AddReleaseHistory(id, opts.to, from, "", clientIP)
+
+	return nil
+}
+
+// PrepareRelease returns the envelope sender & the message as it would be released, with the headers rewritten
+// (From & Subject overrides, Bcc removed, Return-Path, Date & a new Message-Id) and DKIM signed if configured
+func prepareRelease(id string, opts releaseOptions) (string, []byte, error) {
+	msg, err := storage.GetMessageRaw(id)
+	if err != nil {
+		return "", nil, storage.ErrMessageNotFound
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var from string
+
+	if opts.from != nil {
+		// explicit From override, used for both the From header & SMTP mfrom
+		from = opts.from.Address
+
+		// the Sender header would otherwise no longer match the From
+		msg, err = tools.RemoveMessageHeaders(msg, []string{"Sender"})
+		if err != nil {
+			return "", nil, err
+		}
+
+		if m.Header.Get("From") != "" {
+			msg, err = tools.UpdateMessageHeader(msg, "From", opts.from.String())
+			if err != nil {
+				return "", nil, err
+			}
+		} else {
+			msg = append([]byte("From: "+opts.from.String()+"\r\n"), msg...)
+		}
+	} else {
+		froms, err := m.Header.AddressList("From")
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(froms) == 0 {
+			return "", nil, errors.New("No From header found")
+		}
+
+		from = froms[0].Address
+
+		// if sender is used, then change from to the sender
+		if senders, err := m.Header.AddressList("Sender"); err == nil {
+			from = senders[0].Address
+		}
+	}
+
+	if opts.subject != "" {
+		// encode non-ASCII subjects (RFC 2047)
+		encoded := mime.QEncoding.Encode("utf-8", opts.subject)
+		if m.Header.Get("Subject") != "" {
+			msg, err = tools.UpdateMessageHeader(msg, "Subject", encoded)
+			if err != nil {
+				return "", nil, err
+			}
+		} else {
+			msg = append([]byte("Subject: "+encoded+"\r\n"), msg...)
+		}
+	}
+
+	msg, err = tools.RemoveMessageHeaders(msg, []string{"Bcc"})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// set the Return-Path and SMTP mfrom
+	if opts.relay.ReturnPath != "" {
+		if m.Header.Get("Return-Path") != "<"+opts.relay.ReturnPath+">" {
+			msg, err = tools.RemoveMessageHeaders(msg, []string{"Return-Path"})
+			if err != nil {
+				return "", nil, err
+			}
+			msg = append([]byte("Return-Path: <"+opts.relay.ReturnPath+">\r\n"), msg...)
+		}
+
+		from = opts.relay.ReturnPath
+	}
+
+	// update message date
+	msg, err = tools.UpdateMessageHeader(msg, "Date", time.Now().Format(time.RFC1123Z))
+	if err != nil {
+		return "", nil, err
+	}
+
+	// generate unique ID
+	uid := shortuuid.New() + "@mailpit"
+	// update Message-Id with unique ID
+	msg, err = tools.UpdateMessageHeader(msg, "Message-Id", "<"+uid+">")
+	if err != nil {
+		return "", nil, err
+	}
+
+	// sign last as the signed headers & body must not change
+	if opts.relay.DKIMSigner != nil {
+		msg, err = opts.relay.DKIMSigner.Sign(msg)
+		if err != nil {
+			return "", nil, fmt.Errorf("DKIM signing error: %s", err.Error())
+		}
+	}
+
+	return from, msg, nil
+}
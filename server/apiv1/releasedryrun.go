@@ -0,0 +1,112 @@
+package apiv1
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/tools"
+	"github.com/axllent/mailpit/server/smtpd"
+)
+
+// ReleaseDryRun validates a release without sending it, applying the same checks & header rewrites as a
+// release. Recipients are validated individually so the report identifies each rejected recipient, and if
+// probe is set then the accepted recipients are also checked with the relay via MAIL FROM & RCPT TO.
+func releaseDryRun(id string, data releaseMessageRequestBody) (ReleaseDryRunResult, error) {
+	res := ReleaseDryRunResult{Recipients: []ReleaseRecipientResult{}}
+
+	for _, t := range data.To {
+		res.Recipients = append(res.Recipients, ReleaseRecipientResult{Address: t})
+	}
+
+	if !config.ReleaseEnabled {
+		res.Error = "Message relaying is not enabled"
+		return res, nil
+	}
+
+	relay, err := config.RelayProfile(data.Profile)
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil
+	}
+
+	res.Profile = relay.Name
+	res.SMTPServer = fmt.Sprintf("%s:%d", relay.Host, relay.Port)
+
+	accepted := []string{}
+	for i, t := range data.To {
+		if err := validateReleaseRecipient(relay, t); err != nil {
+			res.Recipients[i].Error = err.Error()
+			continue
+		}
+
+		res.Recipients[i].Accepted = true
+		accepted = append(accepted, t)
+	}
+
+	if len(data.To) == 0 {
+		res.Error = "No valid addresses found"
+		return res, nil
+	}
+
+	if data.At != "" || data.Delay != "" {
+		if _, err := releaseDue(data.At, data.Delay); err != nil {
+			res.Error = err.Error()
+			return res, nil
+		}
+	}
+
+	from, err := validateReleaseOverrides(relay, data.From, data.Subject)
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil
+	}
+
+	sender, msg, err := prepareRelease(id, releaseOptions{relay: relay, to: accepted, from: from, subject: data.Subject})
+	if err != nil {
+		return res, err
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return res, err
+	}
+
+	res.From = sender
+	res.FromHeader = tools.DecodeHeader(m.Header.Get("From"))
+	res.Subject = tools.DecodeHeader(m.Header.Get("Subject"))
+	res.MessageID = strings.Trim(m.Header.Get("Message-Id"), "<>")
+
+	if data.Probe && len(accepted) > 0 {
+		res.Probed = true
+
+		rejected, err := smtpd.ProbeVia(relay, sender, accepted)
+		for i, r := range res.Recipients {
+			if !r.Accepted {
+				continue
+			}
+
+			// a failed connection or MAIL command rejects every recipient
+			if err != nil {
+				res.Recipients[i].Accepted = false
+				res.Recipients[i].Error = "SMTP error: " + err.Error()
+			} else if rErr, ok := rejected[r.Address]; ok {
+				res.Recipients[i].Accepted = false
+				res.Recipients[i].Error = "SMTP error: " + rErr.Error()
+			}
+		}
+
+		if err != nil {
+			res.Error = "SMTP error: " + err.Error()
+		}
+	}
+
+	res.OK = res.Error == ""
+	for _, r := range res.Recipients {
+		res.OK = res.OK && r.Accepted
+	}
+
+	return res, nil
+}
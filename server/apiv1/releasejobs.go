@@ -0,0 +1,273 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/server/smtpd"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// wakes the release scheduler when a release is scheduled
+	releaseSchedulerWake = make(chan struct{}, 1)
+
+	// prevents scheduled releases from being sent concurrently
+	releaseJobsMu sync.Mutex
+)
+
+// GetReleaseJobs (method: GET) returns the scheduled releases.
+func GetReleaseJobs(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/releases release GetReleaseJobs
+	//
+	// # Get scheduled releases
+	//
+	// Returns the scheduled releases which have not yet been sent, ordered by their due time.
+	// Failed releases are not retried, and are returned with their SMTP error until cancelled.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ReleaseJobsResponse
+	//		default: ErrorResponse
+
+	jobs, err := storage.GetReleaseJobs()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(jobs)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// CancelReleaseJob (method: DELETE) cancels a scheduled release.
+func CancelReleaseJob(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/releases/{ID} release CancelReleaseJob
+	//
+	// # Cancel scheduled release
+	//
+	// Cancels a scheduled release, or removes a failed release.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	id := mux.Vars(r)["id"]
+
+	if err := storage.DeleteReleaseJob(id); err != nil {
+		if errors.Is(err, storage.ErrReleaseJobNotFound) {
+			fourOFour(w)
+			return
+		}
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// RunReleaseScheduler sends scheduled releases when they are due. Releases are stored in
+// the database, so any releases which became due while Mailpit was stopped are sent on startup.
+func RunReleaseScheduler() {
+	for {
+		ProcessReleaseJobs()
+
+		wait := time.Hour
+		if next, err := storage.NextReleaseJobDue(); err != nil {
+			logger.Log().Errorf("[release] %s", err.Error())
+		} else if !next.IsZero() {
+			wait = min(max(time.Until(next), 0), wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-releaseSchedulerWake:
+			timer.Stop()
+		}
+	}
+}
+
+// ProcessReleaseJobs sends all scheduled releases which are due. Sent releases are removed,
+// and failed releases are kept with their error.
+func ProcessReleaseJobs() {
+	releaseJobsMu.Lock()
+	defer releaseJobsMu.Unlock()
+
+	jobs, err := storage.DueReleaseJobs()
+	if err != nil {
+		logger.Log().Errorf("[release] %s", err.Error())
+		return
+	}
+
+	for _, job := range jobs {
+		if err := sendReleaseJob(job); err != nil {
+			logger.Log().Errorf("[release] scheduled release %s of message %s failed: %s", job.ID, job.MessageID, err.Error())
+			if err := storage.SetReleaseJobError(job.ID, err.Error()); err != nil {
+				logger.Log().Errorf("[release] %s", err.Error())
+			}
+			continue
+		}
+
+		if err := storage.DeleteReleaseJob(job.ID); err != nil && !errors.Is(err, storage.ErrReleaseJobNotFound) {
+			logger.Log().Errorf("[release] %s", err.Error())
+		}
+
+		if job.DeleteAfterRelease {
+			if _, _, err := storage.DeleteMessages([]string{job.MessageID}); err != nil {
+				logger.Log().Errorf("[release] %s", err.Error())
+			}
+		}
+	}
+}
+
+// SendReleaseJob releases a scheduled message, re-validating the relay profile, recipients
+// & From address against the current relay config
+func sendReleaseJob(job storage.ReleaseJob) error {
+	opts, err := validateRelease(job.Profile, job.To, job.From, job.Subject)
+	if err != nil {
+		return err
+	}
+
+	send := func(from string, to []string, msg []byte) error {
+		return smtpd.SendVia(opts.relay, from, to, msg)
+	}
+
+	return releaseMessage(nil, job.MessageID, opts, send)
+}
+
+// WakeReleaseScheduler triggers the release scheduler to recalculate the next due release
+func wakeReleaseScheduler() {
+	select {
+	case releaseSchedulerWake <- struct{}{}:
+	default:
+	}
+}
+
+// GetMessageReleaseHistory (method: GET) returns the release history of a message.
+func GetMessageReleaseHistory(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/releases message GetMessageReleaseHistory
+	//
+	// # Get message release history
+	//
+	// Returns every release attempt of a message, newest first, including failed attempts with their SMTP error.
+	// Scheduled releases are recorded when they are sent.
+	//
+	// The ID can be set to `latest` to return the release history of the latest message.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: ID
+	//	    in: path
+	//	    description: Message database ID or "latest"
+	//	    required: true
+	//	    type: string
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
+	//
+	//	Responses:
+	//		200: ReleaseHistoryResponse
+	//		default: ErrorResponse
+
+	id := mux.Vars(r)["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			fourOFour(w)
+			return
+		}
+	}
+
+	start, limit := getStartLimit(r)
+
+	history, total, err := storage.GetReleaseHistory(id, start, limit)
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(ReleaseHistorySummary{Total: total, Start: start, History: history})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// GetReleaseHistory (method: GET) returns the release history of all messages.
+func GetReleaseHistory(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/releases/history release GetReleaseHistory
+	//
+	// # Get release history
+	//
+	// Returns every release attempt of all messages, newest first, including failed attempts with their SMTP error.
+	// The release history of a message is deleted with the message unless `keep-release-history` is set in the
+	// relay config, in which case the attempts of deleted messages are returned as orphaned.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
+	//
+	//	Responses:
+	//		200: ReleaseHistoryResponse
+	//		default: ErrorResponse
+
+	start, limit := getStartLimit(r)
+
+	history, total, err := storage.GetReleaseHistory("", start, limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(ReleaseHistorySummary{Total: total, Start: start, History: history})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
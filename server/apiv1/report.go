@@ -0,0 +1,301 @@
+package apiv1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/htmlcheck"
+	"github.com/axllent/mailpit/internal/linkcheck"
+	"github.com/axllent/mailpit/internal/paritycheck"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// default & maximum report deadline in seconds
+	reportTimeout    = 30
+	reportMaxTimeout = 120
+
+	// how long analysis results are cached, and the maximum number of cached results
+	analysisCacheTTL  = 5 * time.Minute
+	analysisCacheSize = 500
+)
+
+// Report section statuses
+const (
+	reportStatusOK          = "ok"
+	reportStatusError       = "error"
+	reportStatusTimeout     = "timeout"
+	reportStatusUnavailable = "unavailable"
+)
+
+// reportSections are the available report sections
+var reportSections = []string{"summary", "html-check", "link-check", "parity-check", "spam-check", "authentication"}
+
+// errAnalysisUnavailable wraps errors for analyses which cannot run for a message
+type errAnalysisUnavailable struct {
+	msg string
+}
+
+func (e errAnalysisUnavailable) Error() string {
+	return e.msg
+}
+
+type reportResult struct {
+	name    string
+	section ReportSection
+}
+
+type cachedAnalysis struct {
+	result  interface{}
+	expires time.Time
+}
+
+var (
+	analysisCacheMu sync.Mutex
+	analysisCache   = map[string]cachedAnalysis{}
+)
+
+// MessageReport (method: GET) returns a combined report of all message analyses
+func MessageReport(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/message/{ID}/report message MessageReport
+	//
+	// # Message report
+	//
+	// Returns a combined report of the message summary, HTML check, link check, HTML & text parity check,
+	// SpamAssassin check (if enabled), and upstream spam & authentication (SPF, DKIM & DMARC) results.
+	//
+	// The analyses run concurrently within the `timeout` (default 30 seconds). Each section has a status of
+	// `ok`, `error`, `timeout` or `unavailable` (eg: the message has no HTML, or SpamAssassin is not enabled),
+	// and a section failing does not fail the report. Analysis results are cached for 5 minutes, so repeated
+	// reports are fast.
+	//
+	// The ID can be set to `latest` to return the latest message report.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//
+	//	Responses:
+	//		200: MessageReportResponse
+	//		default: ErrorResponse
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if id == "latest" {
+		var err error
+		id, err = storage.LatestID(r)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	sections := reportSections
+	if s := strings.TrimSpace(r.URL.Query().Get("sections")); s != "" {
+		sections = []string{}
+		for _, section := range strings.Split(s, ",") {
+			section = strings.ToLower(strings.TrimSpace(section))
+			if section == "" {
+				continue
+			}
+			if !inArray(section, reportSections) {
+				httpError(w, fmt.Sprintf("Error: invalid section \"%s\", valid sections are: %s", section, strings.Join(reportSections, ", ")))
+				return
+			}
+			if !inArray(section, sections) {
+				sections = append(sections, section)
+			}
+		}
+	}
+
+	timeout := reportTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 1 || n > reportMaxTimeout {
+			httpError(w, fmt.Sprintf("Error: timeout must be between 1 and %d seconds", reportMaxTimeout))
+			return
+		}
+		timeout = n
+	}
+
+	f := r.URL.Query().Get("follow")
+	followRedirects := f == "true" || f == "1"
+
+	clients, platforms := r.URL.Query().Get("clients"), r.URL.Query().Get("platforms")
+	filter := htmlcheck.DefaultFilter()
+	filterErr := error(nil)
+	if clients != "" || platforms != "" {
+		filter, filterErr = htmlcheck.ParseFilter(clients, platforms)
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	analyses := map[string]func() (interface{}, error){
+		"summary": func() (interface{}, error) {
+			return storage.GetMessageSummary(id)
+		},
+		"html-check": func() (interface{}, error) {
+			if msg.HTML == "" {
+				return nil, errAnalysisUnavailable{"message does not contain HTML"}
+			}
+			if filterErr != nil {
+				return nil, filterErr
+			}
+			if clients == "" && platforms == "" {
+				return storage.HTMLCheck(msg)
+			}
+			return cached(id+":html-check:"+clients+":"+platforms, func() (interface{}, error) {
+				return htmlcheck.RunTests(msg.HTML, filter)
+			})
+		},
+		"link-check": func() (interface{}, error) {
+			return cached(fmt.Sprintf("%s:link-check:%v", id, followRedirects), func() (interface{}, error) {
+				return linkcheck.RunTests(msg, followRedirects)
+			})
+		},
+		"parity-check": func() (interface{}, error) {
+			if msg.HTML == "" {
+				return nil, errAnalysisUnavailable{"message does not contain HTML"}
+			}
+			return cached(id+":parity-check", func() (interface{}, error) {
+				raw, err := storage.GetMessageRaw(id)
+				if err != nil {
+					return nil, err
+				}
+				return paritycheck.RunTests(msg, raw)
+			})
+		},
+		"spam-check": func() (interface{}, error) {
+			if config.EnableSpamAssassin == "" {
+				return nil, errAnalysisUnavailable{"SpamAssassin is not enabled"}
+			}
+			return storage.SpamCheck(id)
+		},
+		"authentication": func() (interface{}, error) {
+			if msg.Upstream.Spam == nil && len(msg.Upstream.AuthenticationResults) == 0 {
+				return nil, errAnalysisUnavailable{"message does not contain X-Spam-* or Authentication-Results headers"}
+			}
+			return msg.Upstream, nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	report := MessageReportResult{ID: id, Sections: map[string]ReportSection{}}
+	results := make(chan reportResult, len(sections))
+
+	for _, name := range sections {
+		go func(name string, fn func() (interface{}, error)) {
+			section := ReportSection{Status: reportStatusOK}
+			res, err := fn()
+			var unavailable errAnalysisUnavailable
+			if errors.As(err, &unavailable) {
+				section = ReportSection{Status: reportStatusUnavailable, Error: err.Error()}
+			} else if err != nil {
+				section = ReportSection{Status: reportStatusError, Error: err.Error()}
+			} else {
+				section.Result = res
+			}
+			results <- reportResult{name, section}
+		}(name, analyses[name])
+	}
+
+	for range sections {
+		select {
+		case res := <-results:
+			report.Sections[res.name] = res.section
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	// sections which did not complete within the deadline continue in the background, and are cached when done
+	for _, name := range sections {
+		if _, ok := report.Sections[name]; !ok {
+			report.Sections[name] = ReportSection{Status: reportStatusTimeout, Error: "the analysis did not complete within the timeout"}
+		}
+	}
+
+	bytes, _ := json.Marshal(report)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// Cached returns the cached result of an analysis, or runs & caches the analysis. Errors are not cached.
+func cached(key string, fn func() (interface{}, error)) (interface{}, error) {
+	analysisCacheMu.Lock()
+	c, ok := analysisCache[key]
+	analysisCacheMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.result, nil
+	}
+
+	res, err := fn()
+	if err != nil {
+		return nil, err
+	}
+
+	analysisCacheMu.Lock()
+	defer analysisCacheMu.Unlock()
+
+	now := time.Now()
+	if len(analysisCache) >= analysisCacheSize {
+		var oldest string
+		for k, v := range analysisCache {
+			if now.After(v.expires) {
+				delete(analysisCache, k)
+				continue
+			}
+			if oldest == "" || v.expires.Before(analysisCache[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(analysisCache) >= analysisCacheSize && oldest != "" {
+			delete(analysisCache, oldest)
+		}
+	}
+
+	analysisCache[key] = cachedAnalysis{result: res, expires: now.Add(analysisCacheTTL)}
+
+	return res, nil
+}
+
+// Tests if a string is within an array
+func inArray(k string, arr []string) bool {
+	for _, v := range arr {
+		if v == k {
+			return true
+		}
+	}
+
+	return false
+}
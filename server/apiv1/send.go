@@ -0,0 +1,332 @@
+package apiv1
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/server/smtpd"
+	"github.com/jhillyerd/enmime"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// the maximum decoded size of a single attachment of a sent message
+const sendMaxAttachmentSize = 25 * 1024 * 1024
+
+var (
+	// printable ASCII excluding the colon (RFC 5322 2.2)
+	headerNameRe = regexp.MustCompile(`^[!-9;-~]+$`)
+
+	// headers which are set from the request fields, or by the message structure
+	sendReservedHeaders = []string{
+		"From", "To", "Cc", "Bcc", "Subject", "Date", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	}
+)
+
+// SendMessage (method: POST) builds a new message, stores it in the mailbox & optionally releases it.
+func SendMessage(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/send message SendMessage
+	//
+	// # Send a message
+	//
+	// Build a new message from the request, and store it in the mailbox as if it had been received via SMTP.
+	// The message contains a text and/or HTML body (multipart/alternative if both are set) plus any attachments.
+	//
+	// If `Release` is set then the stored message is also released to all of its recipients (To, Cc & Bcc)
+	// via the relay profile, applying the same allowlist & blocklist checks as releasing a message. This
+	// requires message relaying to be configured. If the message is stored but cannot be sent then the
+	// SMTP error is returned as `ReleaseError`.
+	//
+	// Validation errors are returned as JSON with the invalid `Field` (eg: `To[1]` or `Attachments[0].ContentBase64`).
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: SendMessageResponse
+	//		400: SendMessageErrorResponse
+	//		413: SendMessageErrorResponse
+	//		500: SendMessageErrorResponse
+
+	if config.MaxMessageSizeBytes > 0 {
+		// allow for the base64 encoding of attachments & JSON escaping
+		r.Body = http.MaxBytesReader(w, r.Body, int64(config.MaxMessageSizeBytes)*2)
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	data := sendMessageRequestBody{}
+
+	if err := decoder.Decode(&data); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			httpFieldErrorStatus(w, http.StatusRequestEntityTooLarge, "", "Request body too large")
+			return
+		}
+		httpFieldError(w, "", err.Error())
+		return
+	}
+
+	builder, recipients, fieldErr := buildSendMessage(data)
+	if fieldErr != nil {
+		httpFieldError(w, fieldErr.Field, fieldErr.Error)
+		return
+	}
+
+	var opts releaseOptions
+	if data.Release {
+		if !config.ReleaseEnabled {
+			httpFieldError(w, "Release", "Message relaying is not enabled")
+			return
+		}
+
+		if _, err := config.RelayProfile(data.Profile); err != nil {
+			httpFieldError(w, "Profile", err.Error())
+			return
+		}
+
+		// validate each address individually to identify the field
+		for _, f := range sendRecipientFields(data) {
+			for i, a := range f.addresses {
+				if _, err := validateRelease(data.Profile, []string{a}, "", ""); err != nil {
+					httpFieldError(w, fmt.Sprintf("%s[%d]", f.name, i), err.Error())
+					return
+				}
+			}
+		}
+
+		var err error
+		opts, err = validateRelease(data.Profile, recipients, "", "")
+		if err != nil {
+			httpFieldError(w, "To", err.Error())
+			return
+		}
+	}
+
+	part, err := builder.Build()
+	if err != nil {
+		httpFieldErrorStatus(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := part.Encode(&buf); err != nil {
+		httpFieldErrorStatus(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	msg := buf.Bytes()
+	if config.MaxMessageSizeBytes > 0 && len(msg) > config.MaxMessageSizeBytes {
+		httpFieldErrorStatus(w, http.StatusRequestEntityTooLarge, "",
+			fmt.Sprintf("Message size %d exceeds the maximum message size (%d)", len(msg), config.MaxMessageSizeBytes))
+		return
+	}
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	id, err := storage.StoreWithOptions(&msg, storage.StoreOptions{
+		Via:      storage.ViaHTTPAPI,
+		From:     builder.GetFrom().Address,
+		To:       recipients,
+		ClientIP: clientIP,
+	})
+	if err != nil {
+		httpFieldErrorStatus(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	if len(data.Tags) > 0 {
+		if _, err := storage.AddMessageTags([]string{id}, data.Tags); err != nil {
+			logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "db", logger.FieldMessageID: id, logger.FieldError: err.Error()})).
+				Errorf("[db] error tagging sent message: %s", err.Error())
+		}
+	}
+
+	logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "http", logger.FieldMessageID: id})).
+		Debugf("[http] stored message %s sent via the API", id)
+
+	res := SendMessageResult{ID: id}
+
+	if data.Release {
+		send := func(from string, to []string, msg []byte) error {
+			return smtpd.SendVia(opts.relay, from, to, msg)
+		}
+
+		if err := releaseMessage(r, id, opts, send); err != nil {
+			res.ReleaseError = err.Error()
+		} else {
+			res.Released = true
+		}
+	}
+
+	bytes, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// SendFieldError is a validation error of a send request field
+type sendFieldError struct {
+	Field string
+	Error string
+}
+
+// SendRecipientField is a recipient field of a send request
+type sendRecipientField struct {
+	name      string
+	addresses []string
+}
+
+// SendRecipientFields returns the recipient fields of a send request in order
+func sendRecipientFields(data sendMessageRequestBody) []sendRecipientField {
+	return []sendRecipientField{{"To", data.To}, {"Cc", data.Cc}, {"Bcc", data.Bcc}}
+}
+
+// BuildSendMessage validates a send request & returns the message builder and all recipients (To, Cc & Bcc)
+func buildSendMessage(data sendMessageRequestBody) (enmime.MailBuilder, []string, *sendFieldError) {
+	builder := enmime.Builder()
+	recipients := []string{}
+
+	from, err := mail.ParseAddress(data.From)
+	if err != nil {
+		return builder, recipients, &sendFieldError{"From", "Invalid From address: " + data.From}
+	}
+	builder = builder.From(from.Name, from.Address)
+
+	addresses := map[string][]mail.Address{}
+	for _, f := range sendRecipientFields(data) {
+		for i, a := range f.addresses {
+			address, err := mail.ParseAddress(a)
+			if err != nil {
+				return builder, recipients, &sendFieldError{fmt.Sprintf("%s[%d]", f.name, i), "Invalid email address: " + a}
+			}
+			addresses[f.name] = append(addresses[f.name], *address)
+			recipients = append(recipients, address.Address)
+		}
+	}
+
+	builder = builder.ToAddrs(addresses["To"]).CCAddrs(addresses["Cc"])
+
+	// stored like the Bcc header Mailpit adds to received messages, & removed when released
+	if len(addresses["Bcc"]) > 0 {
+		bcc := []string{}
+		for _, a := range addresses["Bcc"] {
+			bcc = append(bcc, a.String())
+		}
+		builder = builder.Header("Bcc", strings.Join(bcc, ", "))
+	}
+
+	if len(recipients) == 0 {
+		return builder, recipients, &sendFieldError{"To", "At least one To, Cc or Bcc recipient is required"}
+	}
+
+	if strings.ContainsAny(data.Subject, "\r\n") {
+		return builder, recipients, &sendFieldError{"Subject", "Invalid Subject: must be a single line"}
+	}
+	builder = builder.Subject(data.Subject)
+
+	if data.Text != "" || data.HTML == "" {
+		builder = builder.Text([]byte(data.Text))
+	}
+
+	if data.HTML != "" {
+		builder = builder.HTML([]byte(data.HTML))
+	}
+
+	for i, a := range data.Attachments {
+		field := fmt.Sprintf("Attachments[%d]", i)
+
+		if strings.TrimSpace(a.Filename) == "" || strings.ContainsAny(a.Filename, "\r\n") {
+			return builder, recipients, &sendFieldError{field + ".Filename", "Invalid attachment filename"}
+		}
+
+		b, err := base64.StdEncoding.DecodeString(a.ContentBase64)
+		if err != nil {
+			return builder, recipients, &sendFieldError{field + ".ContentBase64", "Invalid base64 content: " + err.Error()}
+		}
+
+		if len(b) > sendMaxAttachmentSize {
+			return builder, recipients, &sendFieldError{field + ".ContentBase64", fmt.Sprintf("Attachment exceeds the maximum size of %d bytes", sendMaxAttachmentSize)}
+		}
+
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return builder, recipients, &sendFieldError{field + ".ContentType", "Invalid content type: " + contentType}
+		}
+
+		builder = builder.AddAttachment(b, contentType, a.Filename)
+	}
+
+	hasMessageID := false
+	for name, value := range data.Headers {
+		field := "Headers." + name
+
+		if !headerNameRe.MatchString(name) {
+			return builder, recipients, &sendFieldError{field, "Invalid header name: " + name}
+		}
+
+		for _, h := range sendReservedHeaders {
+			if strings.EqualFold(h, name) {
+				return builder, recipients, &sendFieldError{field, "Header cannot be set, use the request fields instead: " + name}
+			}
+		}
+
+		if strings.ContainsAny(value, "\r\n") {
+			return builder, recipients, &sendFieldError{field, "Invalid header value: must be a single line"}
+		}
+
+		if strings.EqualFold(name, "Message-Id") {
+			hasMessageID = true
+		}
+
+		builder = builder.Header(name, value)
+	}
+
+	if !hasMessageID {
+		builder = builder.Header("Message-Id", "<"+shortuuid.New()+"@mailpit>")
+	}
+
+	for i, t := range data.Tags {
+		if !storage.ValidTag(storage.NormaliseTag(t)) {
+			return builder, recipients, &sendFieldError{fmt.Sprintf("Tags[%d]", i), storage.InvalidTagsError{Tags: []string{t}}.Error()}
+		}
+	}
+
+	return builder, recipients, nil
+}
+
+// HTTPFieldError returns a JSON validation error identifying the invalid field (if known) with a 400 response
+func httpFieldError(w http.ResponseWriter, field, msg string) {
+	httpFieldErrorStatus(w, http.StatusBadRequest, field, msg)
+}
+
+// HTTPFieldErrorStatus returns a JSON error identifying the invalid field (if known) with the response status
+func httpFieldErrorStatus(w http.ResponseWriter, status int, field, msg string) {
+	bytes, _ := json.Marshal(SendMessageError{Field: field, Error: msg})
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", config.ContentSecurityPolicy)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
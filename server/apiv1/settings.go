@@ -0,0 +1,104 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// GetSettings (method: GET) returns the runtime settings
+func GetSettings(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/settings application GetSettings
+	//
+	// # Get runtime settings
+	//
+	// Returns the settings which can be changed at runtime, and their current values.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: SettingsResponse
+	//		default: ErrorResponse
+
+	bytes, _ := json.Marshal(config.RuntimeSettings())
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// UpdateSettings (method: PATCH) changes runtime settings
+func UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PATCH /api/v1/settings application UpdateSettings
+	//
+	// # Update runtime settings
+	//
+	// Changes one or more runtime settings without a restart. Only the settings returned by
+	// `GET /api/v1/settings` can be changed, and either all changes are applied or none.
+	// Changes are stored in the database and are restored when Mailpit is restarted.
+	//
+	// The following settings are available:
+	//
+	// - `max-messages` (number): maximum number of messages to store, 0 for unlimited
+	// - `prune-attachments-after` (string): strip attachments from messages older than this duration (eg: 30d), empty to disable
+	// - `smtp-allowed-recipients` (string): only accept recipients matching this regular expression, empty to allow all
+	// - `smtp-denied-recipients` (string): reject recipients matching this regular expression, empty to disable
+	// - `smtp-sender-quota` (number): maximum messages per sender within the quota window, 0 for unlimited
+	// - `smtp-sender-quota-window` (string): rolling sender quota window (eg: 1h)
+	// - `smtp-relay-all` (boolean): auto-relay all new messages, requires a relay configuration
+	// - `smtp-relay-matching` (string): auto-relay new messages to recipients matching this regular expression, requires a relay configuration
+	// - `smtp-relay-paused` (boolean): temporarily pause auto-relaying
+	// - `smtp-max-connections` (number): maximum concurrent SMTP connections, 0 for unlimited (applies to new connections)
+	// - `smtp-max-connections-per-ip` (number): maximum concurrent SMTP connections per IP address, 0 for unlimited (applies to new connections)
+	// - `tag-retention` (string): delete messages with a tag once older than a duration (eg: loadtest=1h,ci=2d), empty to disable
+	// - `webhook-retries` (number): number of times a failed webhook delivery is retried
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: SettingsResponse
+	//		400: ErrorResponse
+
+	changes := map[string]interface{}{}
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&changes); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if len(changes) == 0 {
+		httpError(w, "no settings provided")
+		return
+	}
+
+	if err := storage.UpdateRuntimeSettings(changes); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	keys := []string{}
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "http", "settings": keys})).
+		Infof("[settings] runtime settings updated: %s", strings.Join(keys, ", "))
+
+	bytes, _ := json.Marshal(config.RuntimeSettings())
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -1,6 +1,9 @@
 package apiv1
 
 import (
+	"time"
+
+	"github.com/axllent/mailpit/internal/antivirus"
 	"github.com/axllent/mailpit/internal/htmlcheck"
 	"github.com/axllent/mailpit/internal/linkcheck"
 	"github.com/axllent/mailpit/internal/spamassassin"
@@ -15,6 +18,9 @@ type MessagesSummary struct {
 	// Total number of unread messages in mailbox
 	Unread float64 `json:"unread"`
 
+	// Total number of pinned messages in mailbox
+	Pinned float64 `json:"pinned"`
+
 	// Legacy - now undocumented in API specs but left for backwards compatibility.
 	// Removed from API documentation 2023-07-12
 	// swagger:ignore
@@ -26,14 +32,270 @@ type MessagesSummary struct {
 	// Pagination offset
 	Start int `json:"start"`
 
+	// ID of the last returned message to pass as `after_id` for the next page,
+	// only set when listing messages & more messages exist
+	NextCursor string `json:"next_cursor,omitempty"`
+
 	// All current tags
 	Tags []string `json:"tags"`
 
+	// Background migrations which the search depends on that have not completed yet,
+	// the search results may be incomplete until they complete
+	IncompleteMigrations []string `json:"incomplete_migrations,omitempty"`
+
 	// Messages summary
 	// in: body
 	Messages []storage.MessageSummary `json:"messages"`
 }
 
+// AttachmentsList is a paginated list of the attachments of all messages
+type AttachmentsList struct {
+	// Total number of matching attachments
+	Total float64 `json:"total"`
+
+	// Pagination offset
+	Start int `json:"start"`
+
+	// Attachments with the details of their messages
+	Attachments []storage.MessageAttachment `json:"attachments"`
+}
+
+// DeleteMessagesResult is the result of deleting messages by ID
+type DeleteMessagesResult struct {
+	// Number of deleted messages
+	Deleted int
+	// Message database IDs which did not match any message
+	NotFound []string
+}
+
+// DeleteOldMessagesResult is the result of deleting messages older than an age
+type DeleteOldMessagesResult struct {
+	// Number of deleted messages
+	Deleted int
+	// Total size in bytes of the deleted messages
+	Size int64
+}
+
+// TrashSummary is a page of trashed messages
+type TrashSummary struct {
+	// Total number of messages in the trash
+	Total float64 `json:"total"`
+
+	// Pagination offset
+	Start int `json:"start"`
+
+	// Trashed messages, most recently trashed first
+	Messages []storage.MessageSummary `json:"messages"`
+}
+
+// RelayProfile is a configured relay profile, excluding any credentials
+type RelayProfile struct {
+	// Relay profile name, "default" for the main relay config
+	Name string
+	// The SMTP server address
+	SMTPServer string
+	// Enforced Return-Path (if set) for relay bounces
+	ReturnPath string
+	// Only allow relaying to these recipients (regex)
+	AllowedRecipients string
+	// Never allow relaying to these recipients (regex)
+	BlockedRecipients string
+	// Only allow these From overrides (regex)
+	AllowedSenders string
+}
+
+// ReleaseDryRunResult is the report of a release dry run, being what would be sent
+type ReleaseDryRunResult struct {
+	// Whether the release would be sent to all recipients
+	OK bool
+	// Error preventing the release which is not specific to a recipient, eg: an invalid From override
+	Error string `json:",omitempty"`
+	// Relay profile name
+	Profile string
+	// The SMTP server address of the relay profile
+	SMTPServer string
+	// The SMTP envelope sender (MAIL FROM)
+	From string
+	// The From header of the released message
+	FromHeader string
+	// The Subject of the released message
+	Subject string
+	// The rewritten Message-Id of the released message
+	MessageID string
+	// Whether the recipients were probed via an SMTP connection to the relay
+	Probed bool
+	// The result of each recipient
+	Recipients []ReleaseRecipientResult
+}
+
+// ReleaseRecipientResult is the dry run result of a release recipient
+type ReleaseRecipientResult struct {
+	// Recipient address
+	Address string
+	// Whether the recipient would be accepted
+	Accepted bool
+	// Reason the recipient would be rejected, by the relay config or the relay (if probed)
+	Error string `json:",omitempty"`
+}
+
+// SendMessageResult is the result of sending a message via the API
+type SendMessageResult struct {
+	// Database ID of the stored message
+	ID string
+	// Whether the message was released via the relay (`Release` only)
+	Released bool
+	// Error message if the message was stored but could not be released
+	ReleaseError string `json:",omitempty"`
+}
+
+// SendMessageError is a send request validation error
+type SendMessageError struct {
+	// The invalid request field, eg: `To[1]`, empty if the error is not specific to a field
+	Field string
+	// Error message
+	Error string
+}
+
+// ReleaseHistorySummary is a page of release attempts
+type ReleaseHistorySummary struct {
+	// Total number of release attempts
+	Total int `json:"total"`
+
+	// Pagination offset
+	Start int `json:"start"`
+
+	// Release attempts, newest first
+	History []storage.ReleaseHistory `json:"history"`
+}
+
+// RestoreTrashResult is the result of restoring messages from the trash
+type RestoreTrashResult struct {
+	// Number of restored messages
+	Restored int
+}
+
+// PurgeTrashResult is the result of permanently deleting messages from the trash
+type PurgeTrashResult struct {
+	// Number of deleted messages
+	Deleted int
+}
+
+// DeleteSearchResult is the result of deleting messages by search
+type DeleteSearchResult struct {
+	// Number of messages matching the search
+	Matched int `json:"matched"`
+	// Number of deleted messages, 0 for a dry run
+	Deleted int `json:"deleted"`
+}
+
+// SetSearchTagsResult is the result of setting tags by search
+type SetSearchTagsResult struct {
+	// Number of messages matching the search
+	Matched int
+	// Number of messages with changed tags
+	Updated int
+}
+
+// RenameTagResult is the result of renaming a tag
+type RenameTagResult struct {
+	// Number of messages with the renamed tag
+	Updated int
+}
+
+// DeleteTagResult is the result of deleting a tag
+type DeleteTagResult struct {
+	// Number of messages the tag was removed from
+	Updated int
+}
+
+// ApplyTagRulesResult is the result of applying the tag rules to existing messages
+type ApplyTagRulesResult struct {
+	// Number of messages with added tags
+	Updated int
+}
+
+// TagRetentionRule deletes messages with the tag once they are older than the retention
+type TagRetentionRule struct {
+	// Tag name
+	Tag string
+	// Retention duration, eg: 1h, 30d or 2w
+	Retention string
+}
+
+// MessagePartsResult is the MIME part tree of a message
+type MessagePartsResult struct {
+	// The root part of the message
+	Root storage.MessagePart
+	// Problems encountered while parsing the message
+	Warnings []string
+}
+
+// LatestMessageIDResult is the ID & received time of the latest message
+type LatestMessageIDResult struct {
+	// Database ID
+	ID string
+	// Time the message was received
+	Created time.Time
+}
+
+// AdjacentMessagesResult is the previous & next messages relative to a message
+type AdjacentMessagesResult struct {
+	// Database ID of the previous (newer) message, null if this is the first message
+	Previous *string `json:"previous"`
+	// Database ID of the next (older) message, null if this is the last message
+	Next *string `json:"next"`
+}
+
+// ReleaseMessageResult is the result of releasing a message to its original recipients
+type ReleaseMessageResult struct {
+	// The resolved recipients the message was sent to
+	To []string
+}
+
+// ReleaseResult is the result of releasing a single message
+type ReleaseResult struct {
+	// Message database ID
+	ID string
+	// Whether the message was sent
+	Sent bool
+	// Whether the message was deleted after being sent
+	Deleted bool
+	// Error message if the release or deletion failed
+	Error string `json:",omitempty"`
+}
+
+// AttachmentTextResult is the text content of an attachment
+type AttachmentTextResult struct {
+	// Attachment content type
+	ContentType string
+	// Original charset of the text
+	Charset string
+	// Size in bytes of the full UTF-8 text
+	Size int
+	// Whether the text was truncated to the maximum size
+	Truncated bool
+	// UTF-8 text content
+	Text string
+}
+
+// MessageReportResult is a combined report of the message analyses
+type MessageReportResult struct {
+	// Message database ID
+	ID string
+	// Report sections: summary, html-check, link-check, parity-check, spam-check & authentication
+	Sections map[string]ReportSection
+}
+
+// ReportSection is the result of a single report analysis
+type ReportSection struct {
+	// Section status: ok, error, timeout or unavailable
+	Status string
+	// Error message if the status is not ok
+	Error string `json:",omitempty"`
+	// Section result, null unless the status is ok
+	Result interface{}
+}
+
 // The following structs & aliases are provided for easy import
 // and understanding of the JSON structure.
 
@@ -52,5 +314,11 @@ type HTMLCheckResponse = htmlcheck.Response
 // LinkCheckResponse summary
 type LinkCheckResponse = linkcheck.Response
 
+// TrackCheckResponse summary
+type TrackCheckResponse = linkcheck.TrackingResponse
+
 // SpamAssassinResponse summary
 type SpamAssassinResponse = spamassassin.Result
+
+// AntivirusResponse summary
+type AntivirusResponse = antivirus.Result
@@ -1,6 +1,11 @@
 package apiv1
 
-import "github.com/axllent/mailpit/internal/stats"
+import (
+	"github.com/axllent/mailpit/internal/calendar"
+	"github.com/axllent/mailpit/internal/stats"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/server/smtpd"
+)
 
 // These structs are for the purpose of defining swagger HTTP parameters & responses
 
@@ -22,6 +27,117 @@ type webUIConfigurationResponse struct {
 	Body webUIConfiguration
 }
 
+// Websocket ticket
+// swagger:response WebsocketTicketResponse
+type websocketTicketResponse struct {
+	// Websocket ticket
+	//
+	// in: body
+	Body websocketTicket
+}
+
+// Sender quota usage
+// swagger:response SenderQuotasResponse
+type senderQuotasResponse struct {
+	// Sender quota usage
+	//
+	// in: body
+	Body []smtpd.SenderQuotaUsage
+}
+
+// Rejected recipients
+// swagger:response RecipientRejectionsResponse
+type recipientRejectionsResponse struct {
+	// Rejected recipients
+	//
+	// in: body
+	Body smtpd.RecipientRejections
+}
+
+// Outbound connectivity
+// swagger:response ConnectivityResponse
+type connectivityResponse struct {
+	// Outbound connectivity result
+	//
+	// in: body
+	Body ConnectivityResult
+}
+
+// Background migrations
+// swagger:response MigrationsResponse
+type migrationsResponse struct {
+	// Background migration progress
+	//
+	// in: body
+	Body []storage.BackfillStatus
+}
+
+// Runtime settings
+// swagger:response SettingsResponse
+type settingsResponse struct {
+	// Runtime settings & their current values
+	//
+	// in: body
+	Body map[string]interface{}
+}
+
+// swagger:parameters UpdateSettings
+type updateSettingsParams struct {
+	// in: body
+	Body map[string]interface{}
+}
+
+// Exported profile
+// swagger:response ProfileResponse
+type profileResponse struct {
+	// The non-message configuration
+	//
+	// in: body
+	Body storage.Profile
+}
+
+// swagger:parameters ImportProfile
+type importProfileParams struct {
+	// in: body
+	Body storage.Profile
+}
+
+// Profile import result
+// swagger:response ProfileImportResponse
+type profileImportResponse struct {
+	// The result of each section
+	//
+	// in: body
+	Body ProfileImportResult
+}
+
+// Attachment text
+// swagger:response AttachmentTextResponse
+type attachmentTextResponse struct {
+	// Attachment text
+	//
+	// in: body
+	Body AttachmentTextResult
+}
+
+// Attachment checksum
+// swagger:response AttachmentChecksumResponse
+type attachmentChecksumResponse struct {
+	// Attachment size & digests
+	//
+	// in: body
+	Body storage.AttachmentChecksum
+}
+
+// Message envelope
+// swagger:response MessageEnvelopeResponse
+type messageEnvelopeResponse struct {
+	// SMTP envelope & connection details
+	//
+	// in: body
+	Body storage.MessageEnvelope
+}
+
 // Message summary
 // swagger:response MessagesSummaryResponse
 type messagesSummaryResponse struct {
@@ -30,6 +146,32 @@ type messagesSummaryResponse struct {
 	Body MessagesSummary
 }
 
+// Attachments list
+// swagger:response AttachmentsListResponse
+type attachmentsListResponse struct {
+	// The attachments list
+	//
+	// in: body
+	Body AttachmentsList
+}
+
+// Message calendars
+// swagger:response CalendarResponse
+type calendarResponse struct {
+	// The parsed calendars of the message
+	//
+	// in: body
+	Body []calendar.Calendar
+}
+
+// Message summary, or an array of message summaries if the Message-ID is not unique
+// swagger:response MessageSummaryResponse
+type messageSummaryResponse struct {
+	// The message summary
+	// in: body
+	Body storage.MessageSummary
+}
+
 // Message headers
 // swagger:model MessageHeaders
 type messageHeaders map[string][]string
@@ -38,6 +180,67 @@ type messageHeaders map[string][]string
 type deleteMessagesParams struct {
 	// in: body
 	Body *deleteMessagesRequestBody
+
+	// Also delete pinned messages when deleting all messages
+	//
+	// in: query
+	// required: false
+	// default: false
+	Force bool `json:"force"`
+}
+
+// Message Content-ID map
+// swagger:response CIDMapResponse
+type cidMapResponse struct {
+	// The message parts with a Content-ID or displayed inline
+	//
+	// in: body
+	Body []storage.CIDPart
+}
+
+// Message part tree
+// swagger:response MessagePartsResponse
+type messagePartsResponse struct {
+	// The MIME part tree of the message
+	//
+	// in: body
+	Body MessagePartsResult
+}
+
+// Message events
+// swagger:response MessageEventsResponse
+type messageEventsResponse struct {
+	// The message events in chronological order
+	//
+	// in: body
+	Body []storage.MessageEvent
+}
+
+// Message thread
+// swagger:response MessageThreadResponse
+type messageThreadResponse struct {
+	// The message summaries of the conversation, oldest first
+	//
+	// in: body
+	Body []storage.MessageSummary
+}
+
+// Latest message ID
+// swagger:response LatestMessageIDResponse
+type latestMessageIDResponse struct {
+	// The latest message database ID & received time
+	//
+	// in: body
+	Body LatestMessageIDResult
+}
+
+// Adjacent messages
+// swagger:response AdjacentMessagesResponse
+type adjacentMessagesResponse struct {
+	// The previous & next message database IDs
+	//
+	// in: body
+	Body AdjacentMessagesResult
 }
 
 // Delete request
@@ -73,6 +276,29 @@ type setReadStatusRequestBody struct {
 	IDs []string `json:"ids"`
 }
 
+// swagger:parameters SetStarredStatus
+type setStarredStatusParams struct {
+	// in: body
+	Body *setStarredStatusRequestBody
+}
+
+// Set starred status request
+// swagger:model setStarredStatusRequestBody
+type setStarredStatusRequestBody struct {
+	// Starred status
+	//
+	// required: false
+	// default: false
+	// example: true
+	Starred bool `json:"starred"`
+
+	// Array of message database IDs
+	//
+	// required: false
+	// example: ["5dec4247-812e-4b77-9101-e25ad406e9ea", "8ac66bbc-2d9a-4c41-ad99-00aa75fa674e"]
+	IDs []string `json:"ids"`
+}
+
 // swagger:parameters SetTags
 type setTagsParams struct {
 	// in: body
@@ -95,31 +321,84 @@ type setTagsRequestBody struct {
 	IDs []string `json:"ids"`
 }
 
-// swagger:parameters ReleaseMessage
-type releaseMessageParams struct {
-	// Message database ID
+// swagger:parameters PatchTags
+type patchTagsParams struct {
+	// in: body
+	Body *patchTagsRequestBody
+}
+
+// Add or remove tags request
+// swagger:model patchTagsRequestBody
+type patchTagsRequestBody struct {
+	// Either add or remove
+	//
+	// required: true
+	// enum: add,remove
+	// example: add
+	Action string `json:"action"`
+
+	// Array of tag names to add or remove
+	//
+	// required: true
+	// example: ["Tag 1", "Tag 2"]
+	Tags []string `json:"tags"`
+
+	// Array of message database IDs
+	//
+	// required: true
+	// example: ["5dec4247-812e-4b77-9101-e25ad406e9ea", "8ac66bbc-2d9a-4c41-ad99-00aa75fa674e"]
+	IDs []string `json:"ids"`
+}
+
+// Add or remove tags result
+// swagger:response PatchTagsResponse
+type patchTagsResponse struct {
+	// The result for each message
+	//
+	// in: body
+	Body []storage.MessageTagsResult
+}
+
+// swagger:parameters SetMessageMetadata
+type setMetadataParams struct {
+	// Message database ID or "latest"
 	//
 	// in: path
-	// description: Message database ID
+	// description: Message database ID or "latest"
 	// required: true
 	ID string
 
 	// in: body
-	Body *releaseMessageRequestBody
+	Body *setMetadataRequestBody
 }
 
-// Release request
-// swagger:model releaseMessageRequestBody
-type releaseMessageRequestBody struct {
-	// Array of email addresses to relay the message to
+// Set metadata request
+// swagger:model setMetadataRequestBody
+type setMetadataRequestBody struct {
+	// Key/value metadata to set
 	//
 	// required: true
-	// example: ["user1@example.com", "user2@example.com"]
-	To []string `json:"to"`
+	// example: {"build": "1234", "test-case": "signup-welcome"}
+	Metadata map[string]string `json:"metadata"`
+
+	// Whether to merge with (default) or replace the existing metadata
+	//
+	// enum: merge,replace
+	// example: merge
+	Mode string `json:"mode"`
 }
 
-// swagger:parameters HTMLCheck
-type htmlCheckParams struct {
+// Message metadata
+// swagger:response MetadataResponse
+type metadataResponse struct {
+	// The resulting message metadata
+	//
+	// in: body
+	Body map[string]string
+}
+
+// swagger:parameters PinMessage UnpinMessage
+type pinMessageParams struct {
 	// Message database ID or "latest"
 	//
 	// in: path
@@ -128,53 +407,860 @@ type htmlCheckParams struct {
 	ID string
 }
 
-// swagger:parameters LinkCheck
-type linkCheckParams struct {
-	// Message database ID or "latest"
+// swagger:parameters ReleaseMessage
+type releaseMessageParams struct {
+	// Message database ID
 	//
 	// in: path
-	// description: Message database ID or "latest"
+	// description: Message database ID
 	// required: true
 	ID string
 
-	// Follow redirects
+	// in: body
+	Body *releaseMessageRequestBody
+}
+
+// Release request
+// swagger:model releaseMessageRequestBody
+type releaseMessageRequestBody struct {
+	// Array of email addresses to relay the message to, required unless `use_original_recipients` is set
 	//
-	// in: query
-	// description: Follow redirects
 	// required: false
-	// default: false
-	Follow string `json:"follow"`
+	// example: ["user1@example.com", "user2@example.com"]
+	To []string `json:"to"`
+
+	// Release the message to its original recipients instead of `to`, being the SMTP envelope recipients
+	// if recorded, else the To, Cc & Bcc addresses of the message
+	//
+	// required: false
+	// example: true
+	UseOriginalRecipients bool `json:"use_original_recipients"`
+
+	// Optional From address to release the message as. If set, this replaces the From header and is used as
+	// the SMTP envelope sender (unless a Return-Path is set in the relay config, which is always used for the envelope).
+	// The address must match `allowed-senders` in the relay config if set.
+	//
+	// example: "Mailpit QA <qa@example.com>"
+	From string `json:"from"`
+
+	// Optional Subject to release the message with, replacing the Subject header of the released copy only
+	//
+	// required: false
+	// example: "[TEST] Welcome to Mailpit"
+	Subject string `json:"subject"`
+
+	// Optional relay profile to release the message via, see "List relay profiles". Defaults to the main relay config.
+	//
+	// required: false
+	// example: mailgun
+	Profile string `json:"profile"`
+
+	// Delete the message after it has been successfully released. Defaults to `delete-after-release` in the relay config.
+	//
+	// required: false
+	// example: true
+	DeleteAfterRelease *bool `json:"delete_after_release"`
+
+	// Optional RFC3339 timestamp to schedule the release for, cannot be used with `delay`
+	//
+	// required: false
+	// example: 2025-01-02T09:00:00+13:00
+	At string `json:"at"`
+
+	// Optional duration (eg: 30m, 2h, 1d) to delay the release by, cannot be used with `at`
+	//
+	// required: false
+	// example: 2h
+	Delay string `json:"delay"`
+
+	// Validate the release without sending (or scheduling) it, returning a report of what would be sent
+	//
+	// required: false
+	// example: true
+	DryRun bool `json:"dry_run"`
+
+	// Probe the recipients via an SMTP connection to the relay during a dry run (MAIL FROM & RCPT TO, then RSET),
+	// without sending the message data
+	//
+	// required: false
+	// example: true
+	Probe bool `json:"probe"`
 }
 
-// swagger:parameters SpamAssassinCheck
-type spamAssassinCheckParams struct {
-	// Message database ID or "latest"
+// Release message result
+// swagger:response ReleaseMessageResponse
+type releaseMessageResponse struct {
+	// The recipients the message was released to (`use_original_recipients` only)
+	//
+	// in: body
+	Body ReleaseMessageResult
+}
+
+// Release dry run result
+// swagger:response ReleaseDryRunResponse
+type releaseDryRunResponse struct {
+	// What would be sent, and whether each recipient would be accepted
+	//
+	// in: body
+	Body ReleaseDryRunResult
+}
+
+// swagger:parameters CancelReleaseJob
+type cancelReleaseJobParams struct {
+	// Scheduled release ID
 	//
 	// in: path
-	// description: Message database ID or "latest"
 	// required: true
 	ID string
 }
 
-// Binary data response inherits the attachment's content type
-// swagger:response BinaryResponse
-type binaryResponse string
+// Scheduled releases
+// swagger:response ReleaseJobsResponse
+type releaseJobsResponse struct {
+	// The scheduled releases
+	//
+	// in: body
+	Body []storage.ReleaseJob
+}
 
-// Plain text response
-// swagger:response TextResponse
-type textResponse string
+// Relay profiles
+// swagger:response RelayProfilesResponse
+type relayProfilesResponse struct {
+	// The relay profiles
+	//
+	// in: body
+	Body []RelayProfile
+}
 
-// HTML response
-// swagger:response HTMLResponse
-type htmlResponse string
+// Release history
+// swagger:response ReleaseHistoryResponse
+type releaseHistoryResponse struct {
+	// The release attempts
+	//
+	// in: body
+	Body ReleaseHistorySummary
+}
 
-// HTTP error response will return with a >= 400 response code
-// swagger:response ErrorResponse
-type errorResponse string
+// swagger:parameters ReleaseMessages
+type releaseMessagesParams struct {
+	// in: body
+	Body *releaseMessagesRequestBody
+}
 
-// Plain text "ok" response
-// swagger:response OKResponse
-type okResponse string
+// Release messages request
+// swagger:model releaseMessagesRequestBody
+type releaseMessagesRequestBody struct {
+	// Array of message database IDs, required unless `query` is set
+	//
+	// required: false
+	// example: ["5dec4247-812e-4b77-9101-e25ad406e9ea", "8ac66bbc-2d9a-4c41-ad99-00aa75fa674e"]
+	IDs []string `json:"ids"`
+
+	// Search query to release all matching messages, used if no IDs are provided
+	//
+	// required: false
+	// example: subject:"Password reset"
+	Query string `json:"query"`
+
+	// [Timezone identifier](https://en.wikipedia.org/wiki/List_of_tz_database_time_zones) used specifically for `before:` & `after:` searches (eg: "Pacific/Auckland").
+	//
+	// required: false
+	TZ string `json:"tz"`
+
+	// Array of email addresses to relay the messages to
+	//
+	// required: true
+	// example: ["user1@example.com", "user2@example.com"]
+	To []string `json:"to"`
+
+	// Optional From address to release the messages as, see releaseMessageRequestBody
+	//
+	// example: "Mailpit QA <qa@example.com>"
+	From string `json:"from"`
+
+	// Optional Subject to release the messages with, see releaseMessageRequestBody
+	//
+	// required: false
+	// example: "[TEST] Welcome to Mailpit"
+	Subject string `json:"subject"`
+
+	// Optional relay profile to release the messages via, see releaseMessageRequestBody
+	//
+	// required: false
+	// example: mailgun
+	Profile string `json:"profile"`
+
+	// Delete each message after it has been successfully released. Defaults to `delete-after-release` in the relay config.
+	//
+	// required: false
+	// example: true
+	DeleteAfterRelease *bool `json:"delete_after_release"`
+}
+
+// Release messages result
+// swagger:response ReleaseMessagesResponse
+type releaseMessagesResponse struct {
+	// The result of each released message
+	//
+	// in: body
+	Body []ReleaseResult
+}
+
+// swagger:parameters SendMessage
+type sendMessageParams struct {
+	// in: body
+	Body *sendMessageRequestBody
+}
+
+// Send message request
+// swagger:model sendMessageRequestBody
+type sendMessageRequestBody struct {
+	// From address
+	//
+	// required: true
+	// example: "Mailpit QA <qa@example.com>"
+	From string
+
+	// To addresses
+	//
+	// required: false
+	// example: ["Jane Doe <jane@example.com>"]
+	To []string
+
+	// Cc addresses
+	//
+	// required: false
+	// example: ["manager@example.com"]
+	Cc []string
+
+	// Bcc addresses
+	//
+	// required: false
+	// example: ["audit@example.com"]
+	Bcc []string
+
+	// Message subject
+	//
+	// required: false
+	// example: Mailpit message via the HTTP API
+	Subject string
+
+	// Message body (text)
+	//
+	// required: false
+	// example: Mailpit is awesome!
+	Text string
+
+	// Message body (HTML)
+	//
+	// required: false
+	// example: <p>Mailpit is <b>awesome</b>!</p>
+	HTML string
+
+	// Attachments
+	//
+	// required: false
+	Attachments []struct {
+		// Attachment filename
+		//
+		// required: true
+		// example: file.txt
+		Filename string
+
+		// Optional attachment content type, detected from the filename if not set
+		//
+		// required: false
+		// example: text/plain
+		ContentType string
+
+		// Base64-encoded attachment content
+		//
+		// required: true
+		// example: TWFpbHBpdCBpcyBhd2Vzb21lIQ==
+		ContentBase64 string
+	}
+
+	// Optional headers in {"key":"value"} format, excluding the address, subject, date & MIME structure headers
+	//
+	// required: false
+	// example: {"X-IP":"1.2.3.4"}
+	Headers map[string]string
+
+	// Optional tags to add to the stored message
+	//
+	// required: false
+	// example: ["Tag 1","Tag 2"]
+	Tags []string
+
+	// Release the stored message to all of its recipients via the relay
+	//
+	// required: false
+	// example: true
+	Release bool
+
+	// Optional relay profile to release the message via, see "List relay profiles". Defaults to the main relay config.
+	//
+	// required: false
+	// example: mailgun
+	Profile string
+}
+
+// Send message result
+// swagger:response SendMessageResponse
+type sendMessageResponse struct {
+	// The stored message ID & release result
+	//
+	// in: body
+	Body SendMessageResult
+}
+
+// Send message error
+// swagger:response SendMessageErrorResponse
+type sendMessageErrorResponse struct {
+	// The validation or server error
+	//
+	// in: body
+	Body SendMessageError
+}
+
+// swagger:parameters PruneAttachments
+type pruneAttachmentsParams struct {
+	// in: body
+	Body *pruneAttachmentsRequestBody
+}
+
+// Prune attachments request
+// swagger:model pruneAttachmentsRequestBody
+type pruneAttachmentsRequestBody struct {
+	// Strip attachments from messages older than this duration (eg: 30d, 2w, 12h)
+	//
+	// required: true
+	// example: 30d
+	OlderThan string `json:"older_than"`
+
+	// Keep inline attachments such as images referenced in the HTML
+	//
+	// required: false
+	// default: false
+	KeepInline bool `json:"keep_inline"`
+
+	// Maximum number of messages to process in this request (0 = all)
+	//
+	// required: false
+	// default: 0
+	Limit int `json:"limit"`
+}
+
+// Prune attachments result
+// swagger:response PruneAttachmentsResponse
+type pruneAttachmentsResponse struct {
+	// The prune attachments result
+	//
+	// in: body
+	Body storage.PruneAttachmentsResult
+}
+
+// swagger:parameters HTMLCheck
+type htmlCheckParams struct {
+	// Message database ID or "latest"
+	//
+	// in: path
+	// description: Message database ID or "latest"
+	// required: true
+	ID string
+
+	// Comma-separated email client identifiers to test, eg: gmail,outlook,apple-mail
+	//
+	// in: query
+	// description: Comma-separated email client identifiers to test
+	// required: false
+	Clients string `json:"clients"`
+
+	// Comma-separated platform identifiers to test, eg: desktop-app,webmail
+	//
+	// in: query
+	// description: Comma-separated platform identifiers to test
+	// required: false
+	Platforms string `json:"platforms"`
+}
+
+// swagger:parameters LinkCheck
+type linkCheckParams struct {
+	// Message database ID or "latest"
+	//
+	// in: path
+	// description: Message database ID or "latest"
+	// required: true
+	ID string
+
+	// Follow redirects
+	//
+	// in: query
+	// description: Follow redirects
+	// required: false
+	// default: false
+	Follow string `json:"follow"`
+}
+
+// swagger:parameters MessageReport
+type messageReportParams struct {
+	// Message database ID or "latest"
+	//
+	// in: path
+	// description: Message database ID or "latest"
+	// required: true
+	ID string
+
+	// Comma-separated report sections, eg: html-check,link-check. Defaults to all sections.
+	//
+	// in: query
+	// description: Comma-separated report sections
+	// required: false
+	Sections string `json:"sections"`
+
+	// Follow redirects in the link check
+	//
+	// in: query
+	// description: Follow redirects
+	// required: false
+	// default: false
+	Follow string `json:"follow"`
+
+	// Comma-separated email client identifiers for the HTML check
+	//
+	// in: query
+	// description: Comma-separated email client identifiers to test
+	// required: false
+	Clients string `json:"clients"`
+
+	// Comma-separated platform identifiers for the HTML check
+	//
+	// in: query
+	// description: Comma-separated platform identifiers to test
+	// required: false
+	Platforms string `json:"platforms"`
+
+	// Maximum time in seconds to wait for the analyses (1-120)
+	//
+	// in: query
+	// description: Report timeout in seconds
+	// required: false
+	// default: 30
+	Timeout int `json:"timeout"`
+}
+
+// Message report
+// swagger:response MessageReportResponse
+type messageReportResponse struct {
+	// The message report
+	//
+	// in: body
+	Body MessageReportResult
+}
+
+// swagger:parameters ParityCheck
+type parityCheckParams struct {
+	// Message database ID or "latest"
+	//
+	// in: path
+	// description: Message database ID or "latest"
+	// required: true
+	ID string
+}
+
+// swagger:parameters SpamAssassinCheck
+type spamAssassinCheckParams struct {
+	// Message database ID or "latest"
+	//
+	// in: path
+	// description: Message database ID or "latest"
+	// required: true
+	ID string
+}
+
+// Binary data response inherits the attachment's content type
+// swagger:response BinaryResponse
+type binaryResponse string
+
+// Plain text response
+// swagger:response TextResponse
+type textResponse string
+
+// HTML response
+// swagger:response HTMLResponse
+type htmlResponse string
+
+// HTTP error response will return with a >= 400 response code
+// swagger:response ErrorResponse
+type errorResponse string
+
+// Delete messages result
+// swagger:response DeleteMessagesResponse
+type deleteMessagesResponse struct {
+	// The number of deleted messages & any IDs which were not found
+	//
+	// in: body
+	Body DeleteMessagesResult
+}
+
+// swagger:parameters DeleteOldMessages
+type deleteOldMessagesParams struct {
+	// Delete messages older than this age, eg: 72h or 7d
+	//
+	// in: query
+	// description: Delete messages older than this age, eg: 72h or 7d
+	// required: true
+	Age string `json:"age"`
+
+	// Set to `keep` to keep unread messages
+	//
+	// in: query
+	// description: Set to `keep` to keep unread messages
+	// required: false
+	Unread string `json:"unread"`
+}
+
+// Delete old messages result
+// swagger:response DeleteOldMessagesResponse
+type deleteOldMessagesResponse struct {
+	// The number of deleted messages & their total size
+	//
+	// in: body
+	Body DeleteOldMessagesResult
+}
+
+// swagger:parameters RestoreTrash
+type restoreTrashParams struct {
+	// in: body
+	Body *trashRequestBody
+}
+
+// swagger:parameters PurgeTrash
+type purgeTrashParams struct {
+	// in: body
+	Body *trashRequestBody
+}
+
+// Trashed message IDs request
+// swagger:model trashRequestBody
+type trashRequestBody struct {
+	// Message database IDs
+	//
+	// required: false
+	// example: ["5dec4247-812e-4b77-9101-e25ad406e9ea", "8ac66bbc-2d9a-4c41-ad99-00aa75fa674e"]
+	IDs []string
+}
+
+// Trashed messages
+// swagger:response TrashSummaryResponse
+type trashSummaryResponse struct {
+	// The trashed messages
+	//
+	// in: body
+	Body TrashSummary
+}
+
+// Restore trashed messages result
+// swagger:response RestoreTrashResponse
+type restoreTrashResponse struct {
+	// The number of restored messages
+	//
+	// in: body
+	Body RestoreTrashResult
+}
+
+// Purge trashed messages result
+// swagger:response PurgeTrashResponse
+type purgeTrashResponse struct {
+	// The number of deleted messages
+	//
+	// in: body
+	Body PurgeTrashResult
+}
+
+// Delete search result
+// swagger:response DeleteSearchResponse
+type deleteSearchResponse struct {
+	// The number of matched & deleted messages
+	//
+	// in: body
+	Body DeleteSearchResult
+}
+
+// swagger:parameters SetSearchTags
+type setSearchTagsParams struct {
+	// in: body
+	Body *setSearchTagsRequestBody
+}
+
+// Set search tags request
+// swagger:model setSearchTagsRequestBody
+type setSearchTagsRequestBody struct {
+	// Search query
+	//
+	// required: true
+	// example: from:sender@example.com
+	Query string `json:"query"`
+
+	// Array of tag names to set
+	//
+	// required: true
+	// example: ["Tag 1", "Tag 2"]
+	Tags []string `json:"tags"`
+
+	// Add the tags to any existing tags instead of replacing them
+	//
+	// required: false
+	Append bool `json:"append"`
+}
+
+// Set search tags result
+// swagger:response SetSearchTagsResponse
+type setSearchTagsResponse struct {
+	// The number of matched & updated messages
+	//
+	// in: body
+	Body SetSearchTagsResult
+}
+
+// swagger:parameters RenameTag
+type renameTagParams struct {
+	// in: body
+	Body *renameTagRequestBody
+}
+
+// Rename tag request
+// swagger:model renameTagRequestBody
+type renameTagRequestBody struct {
+	// Current tag name
+	//
+	// required: true
+	// example: Staging
+	From string `json:"from"`
+
+	// New tag name
+	//
+	// required: true
+	// example: Production
+	To string `json:"to"`
+}
+
+// Rename tag result
+// swagger:response RenameTagResponse
+type renameTagResponse struct {
+	// The number of affected messages
+	//
+	// in: body
+	Body RenameTagResult
+}
+
+// Delete tag result
+// swagger:response DeleteTagResponse
+type deleteTagResponse struct {
+	// The number of affected messages
+	//
+	// in: body
+	Body DeleteTagResult
+}
+
+// swagger:parameters AddTagRule
+type addTagRuleParams struct {
+	// in: body
+	Body *tagRuleRequestBody
+}
+
+// swagger:parameters UpdateTagRule
+type updateTagRuleParams struct {
+	// Tag rule ID
+	//
+	// in: path
+	// required: true
+	ID int
+
+	// in: body
+	Body *tagRuleRequestBody
+}
+
+// swagger:parameters DeleteTagRule
+type deleteTagRuleParams struct {
+	// Tag rule ID
+	//
+	// in: path
+	// required: true
+	ID int
+}
+
+// Tag rule request
+// swagger:model tagRuleRequestBody
+type tagRuleRequestBody struct {
+	// Search query
+	//
+	// required: true
+	// example: subject:"Reset your password"
+	Query string `json:"query"`
+
+	// Array of tag names to add to matching messages
+	//
+	// required: true
+	// example: ["Password reset"]
+	Tags []string `json:"tags"`
+}
+
+// Tag statistics
+// swagger:response TagStatsResponse
+type tagStatsResponse struct {
+	// Tags with their message counts
+	//
+	// in: body
+	Body []storage.TagStats
+}
+
+// Tag rules
+// swagger:response TagRulesResponse
+type tagRulesResponse struct {
+	// Tag rules in the order they are applied
+	//
+	// in: body
+	Body []storage.TagRule
+}
+
+// Tag rule
+// swagger:response TagRuleResponse
+type tagRuleResponse struct {
+	// The tag rule
+	//
+	// in: body
+	Body storage.TagRule
+}
+
+// Apply tag rules result
+// swagger:response ApplyTagRulesResponse
+type applyTagRulesResponse struct {
+	// The number of messages with added tags
+	//
+	// in: body
+	Body ApplyTagRulesResult
+}
+
+// swagger:parameters AddForwardRule
+type addForwardRuleParams struct {
+	// in: body
+	Body *forwardRuleRequestBody
+}
+
+// swagger:parameters UpdateForwardRule
+type updateForwardRuleParams struct {
+	// Forwarding rule ID
+	//
+	// in: path
+	// required: true
+	ID int
+
+	// in: body
+	Body *forwardRuleRequestBody
+}
+
+// swagger:parameters DeleteForwardRule
+type deleteForwardRuleParams struct {
+	// Forwarding rule ID
+	//
+	// in: path
+	// required: true
+	ID int
+}
+
+// Forwarding rule request
+// swagger:model forwardRuleRequestBody
+type forwardRuleRequestBody struct {
+	// Search query
+	//
+	// required: true
+	// example: tag:uat
+	Query string `json:"query"`
+
+	// Array of email addresses to forward matching messages to
+	//
+	// required: true
+	// example: ["qa@example.com"]
+	To []string `json:"to"`
+
+	// Optional relay profile to forward messages via, see "List relay profiles". Defaults to the main relay config.
+	//
+	// required: false
+	// example: mailgun
+	Profile string `json:"profile"`
+}
+
+// Forwarding rules
+// swagger:response ForwardRulesResponse
+type forwardRulesResponse struct {
+	// Forwarding rules
+	//
+	// in: body
+	Body []storage.ForwardRule
+}
+
+// Forwarding rule
+// swagger:response ForwardRuleResponse
+type forwardRuleResponse struct {
+	// The forwarding rule
+	//
+	// in: body
+	Body storage.ForwardRule
+}
+
+// swagger:parameters SetTagMeta
+type setTagMetaParams struct {
+	// in: body
+	Body *storage.TagMeta
+}
+
+// Tag metadata
+// swagger:response TagMetaListResponse
+type tagMetaListResponse struct {
+	// The metadata of all tags with metadata
+	//
+	// in: body
+	Body []storage.TagMeta
+}
+
+// Tag metadata
+// swagger:response TagMetaResponse
+type tagMetaResponse struct {
+	// The tag metadata
+	//
+	// in: body
+	Body storage.TagMeta
+}
+
+// swagger:parameters SetTagRetention
+type setTagRetentionParams struct {
+	// Tag retention rules, replacing all existing rules
+	//
+	// in: body
+	Body []TagRetentionRule
+}
+
+// Tag retention rules
+// swagger:response TagRetentionResponse
+type tagRetentionResponse struct {
+	// The tag retention rules
+	//
+	// in: body
+	Body []TagRetentionRule
+}
+
+// Plain text "ok" response
+// swagger:response OKResponse
+type okResponse string
+
+// No content response (no body)
+// swagger:response NoContentResponse
+type noContentResponse struct{}
+
+// Not modified response (no body)
+// swagger:response NotModifiedResponse
+type notModifiedResponse struct{}
 
 // Plain JSON array response
 // swagger:response ArrayResponse
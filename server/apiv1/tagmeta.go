@@ -0,0 +1,80 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// GetTagMeta (method: GET) returns the metadata of all tags
+func GetTagMeta(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/tags/meta tags GetTagMeta
+	//
+	// # Get tag metadata
+	//
+	// Returns the color & description of all tags with metadata, ordered by tag name. Metadata is shared by all
+	// users, and is kept when a tag is no longer used by any messages.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagMetaListResponse
+	//		default: ErrorResponse
+
+	meta, err := storage.GetTagMeta()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(meta)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// SetTagMeta (method: PUT) sets the metadata of a tag
+func SetTagMeta(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/tags/meta tags SetTagMeta
+	//
+	// # Set tag metadata
+	//
+	// Set the color & description of a tag, replacing any existing metadata. The `Color` must be in the `#RRGGBB`
+	// format, and the `Description` can be up to 200 characters. Setting both to an empty value removes the metadata.
+	// The tag does not need to be in use, and the tag name is validated in the same way as `PUT /api/v1/tags`.
+	// An invalid tag name, color or description returns a 400 response.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagMetaResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data storage.TagMeta
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	meta, err := storage.SetTagMeta(data.Tag, data.Color, data.Description)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(meta)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -0,0 +1,100 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// GetTagRetention (method: GET) returns the tag retention rules
+func GetTagRetention(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/tags/retention tags GetTagRetention
+	//
+	// # Get tag retention rules
+	//
+	// Returns the tag retention rules. Messages with a tag are automatically deleted once they are older than
+	// the retention of the tag, regardless of `--max`. Messages with multiple retention tags are kept for the
+	// longest retention.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagRetentionResponse
+	//		default: ErrorResponse
+
+	bytes, _ := json.Marshal(tagRetentionRules())
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// SetTagRetention (method: PUT) replaces the tag retention rules
+func SetTagRetention(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/tags/retention tags SetTagRetention
+	//
+	// # Set tag retention rules
+	//
+	// Replaces all tag retention rules, an empty array removes all rules. The `Retention` is a duration such as
+	// `1h`, `30d` or `2w`. The rules are stored as the `tag-retention` runtime setting, and are restored when
+	// Mailpit is restarted. An invalid tag name or duration returns a 400 response.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagRetentionResponse
+	//		400: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data []TagRetentionRule
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	pairs := []string{}
+	for _, rule := range data {
+		if strings.ContainsAny(rule.Tag, ",=") {
+			httpError(w, fmt.Sprintf("invalid tag (%s) - can only contain spaces, letters, numbers, - & _", rule.Tag))
+			return
+		}
+
+		pairs = append(pairs, rule.Tag+"="+rule.Retention)
+	}
+
+	if err := storage.UpdateRuntimeSettings(map[string]interface{}{"tag-retention": strings.Join(pairs, ",")}); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "http"})).
+		Infof("[settings] tag retention updated: %s", config.Runtime().TagRetention)
+
+	bytes, _ := json.Marshal(tagRetentionRules())
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// TagRetentionRules returns the current tag retention rules
+func tagRetentionRules() []TagRetentionRule {
+	rules := []TagRetentionRule{}
+	for _, r := range config.Runtime().TagRetentionRules {
+		rules = append(rules, TagRetentionRule{Tag: r.Tag, Retention: r.Retention})
+	}
+
+	return rules
+}
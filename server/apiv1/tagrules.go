@@ -0,0 +1,200 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// GetTagRules (method: GET) returns all tag rules
+func GetTagRules(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/tags/rules tags GetTagRules
+	//
+	// # Get tag rules
+	//
+	// Returns all tag rules in the order they are applied. Received messages matching the search of a rule
+	// have the tags of the rule added, in addition to any tags set via the X-Tags header or `--tag` rules.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagRulesResponse
+	//		default: ErrorResponse
+
+	rules, err := storage.GetTagRules()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(rules)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// AddTagRule (method: POST) adds a tag rule
+func AddTagRule(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/tags/rules tags AddTagRule
+	//
+	// # Add a tag rule
+	//
+	// Add a tag rule, which is applied after all existing rules. The `Query` uses the same syntax as
+	// [a search](https://mailpit.axllent.org/docs/usage/search-filters/), and tag names are validated in the
+	// same way as `PUT /api/v1/tags`. An invalid query or tag name returns a 400 response.
+	//
+	// Rules only apply to messages received after the rule is added, see `POST /api/v1/tags/rules/apply`
+	// to apply the rules to existing messages.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagRuleResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data tagRuleRequestBody
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	rule, err := storage.AddTagRule(data.Query, data.Tags)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(rule)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// UpdateTagRule (method: PUT) updates a tag rule
+func UpdateTagRule(w http.ResponseWriter, r *http.Request) {
+	// swagger:route PUT /api/v1/tags/rules/{ID} tags UpdateTagRule
+	//
+	// # Update a tag rule
+	//
+	// Update the search query & tags of a tag rule. Tags which have already been applied are not changed.
+	// An invalid query or tag name returns a 400 response, and a 404 response is returned if the rule does not exist.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: TagRuleResponse
+	//		default: ErrorResponse
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data tagRuleRequestBody
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	rule, err := storage.UpdateTagRule(id, data.Query, data.Tags)
+	if err == storage.ErrTagRuleNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(rule)
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// DeleteTagRule (method: DELETE) deletes a tag rule
+func DeleteTagRule(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/tags/rules/{ID} tags DeleteTagRule
+	//
+	// # Delete a tag rule
+	//
+	// Delete a tag rule. Tags which have already been applied are not removed.
+	// A 404 response is returned if the rule does not exist.
+	//
+	//	Produces:
+	//	- text/plain
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: OKResponse
+	//		default: ErrorResponse
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		fourOFour(w)
+		return
+	}
+
+	if err := storage.DeleteTagRule(id); err == storage.ErrTagRuleNotFound {
+		fourOFour(w)
+		return
+	} else if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// ApplyTagRules (method: POST) applies all tag rules to existing messages
+func ApplyTagRules(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route POST /api/v1/tags/rules/apply tags ApplyTagRules
+	//
+	// # Apply tag rules
+	//
+	// Apply all tag rules to the existing messages, in the order the rules are applied to received messages.
+	// The tags of each rule are added to the messages matching its search, and existing tags are preserved.
+	// The number of messages with added tags is returned.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: ApplyTagRulesResponse
+	//		default: ErrorResponse
+
+	updated, err := storage.ApplyTagRules()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(ApplyTagRulesResult{Updated: updated})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -3,6 +3,7 @@ package apiv1
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
@@ -15,11 +16,20 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/jhillyerd/enmime"
 	"github.com/kovidgoyal/imaging"
+
+	// WebP image decoding
+	_ "golang.org/x/image/webp"
 )
 
 var (
 	thumbWidth  = 180
 	thumbHeight = 120
+
+	// thumbContentTypes are the image types which thumbnails are generated for
+	thumbContentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+	// thumbCache is a cache of the most recently generated thumbnails
+	thumbCache = newLRUCache(250)
 )
 
 // Thumbnail returns a thumbnail image for an attachment (images only)
@@ -28,8 +38,12 @@ func Thumbnail(w http.ResponseWriter, r *http.Request) {
 	//
 	// # Get an attachment image thumbnail
 	//
-	// This will return a cropped 180x120 JPEG thumbnail of an image attachment.
-	// If the image is smaller than 180x120 then the image is padded. If the attachment is not an image then a blank image is returned.
+	// This will return a JPEG thumbnail of a PNG, JPEG, GIF or WebP image attachment, resized to fit within 180x120
+	// preserving its aspect ratio. With `fit=false` the image is cropped to 180x120 instead, and padded if it is
+	// smaller than 180x120. Only the first frame of animated images is used.
+	//
+	// A 404 is returned if the attachment is not a supported image, and a 400 if the image cannot be decoded,
+	// unless `placeholder` is set in which case a blank image is returned.
 	//
 	//	Produces:
 	//	- image/jpeg
@@ -47,6 +61,24 @@ func Thumbnail(w http.ResponseWriter, r *http.Request) {
 	//	    description: Attachment part ID
 	//	    required: true
 	//	    type: string
+	//	  + name: fit
+	//	    in: query
+	//	    description: Resize the image to fit within 180x120 preserving its aspect ratio, without cropping or padding
+	//	    required: false
+	//	    type: boolean
+	//	    default: true
+	//	  + name: placeholder
+	//	    in: query
+	//	    description: Return a blank image if the attachment is not a supported image or cannot be decoded
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: BinaryResponse
@@ -56,6 +88,15 @@ func Thumbnail(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 	partID := vars["partID"]
 
+	if trashedMessage(w, r, id) {
+		return
+	}
+
+	f := r.URL.Query().Get("fit")
+	fit := f != "false" && f != "0"
+	p := r.URL.Query().Get("placeholder")
+	placeholder := p == "true" || p == "1"
+
 	a, err := storage.GetAttachmentPart(id, partID)
 	if err != nil {
 		httpError(w, err.Error())
@@ -67,46 +108,79 @@ func Thumbnail(w http.ResponseWriter, r *http.Request) {
 		fileName = a.ContentID
 	}
 
-	if !strings.HasPrefix(a.ContentType, "image/") {
-		blankImage(a, w)
+	if !inArray(strings.ToLower(a.ContentType), thumbContentTypes) {
+		if placeholder {
+			blankImage(a, w)
+			return
+		}
+		fourOFour(w)
 		return
 	}
 
-	buf := bytes.NewBuffer(a.Content)
+	key := fmt.Sprintf("%s:%s:%v", id, partID, fit)
+
+	thumb, ok := thumbCache.Get(key)
+	if !ok {
+		thumb, err = createThumbnail(a.Content, fit)
+		if err != nil {
+			logger.WithFields(logFields(r, logger.Fields{logger.FieldComponent: "image", logger.FieldMessageID: id, logger.FieldError: err.Error()})).
+				Warnf("[image] %s", err.Error())
+			if placeholder {
+				blankImage(a, w)
+				return
+			}
+			httpError(w, "unable to create thumbnail: "+err.Error())
+			return
+		}
+
+		thumbCache.Add(key, thumb)
+	}
+
+	w.Header().Add("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Disposition", "filename=\""+fileName+"\"")
+	_, _ = w.Write(thumb)
+}
 
-	img, err := imaging.Decode(buf, imaging.AutoOrientation(true))
+// CreateThumbnail returns a JPEG thumbnail of an image. The image is cropped to the thumbnail
+// size, or if fit is true resized to fit within the thumbnail size preserving the aspect ratio.
+func createThumbnail(data []byte, fit bool) ([]byte, error) {
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
 	if err != nil {
-		// it's not an image, return default
-		logger.Log().Warnf("[image] %s", err.Error())
-		blankImage(a, w)
-		return
+		return nil, err
 	}
 
 	var b bytes.Buffer
 	foo := bufio.NewWriter(&b)
 
-	var dstImageFill *image.NRGBA
+	var dst *image.NRGBA
 
-	if img.Bounds().Dx() < thumbWidth || img.Bounds().Dy() < thumbHeight {
-		dstImageFill = imaging.Fit(img, thumbWidth, thumbHeight, imaging.Lanczos)
+	if fit {
+		if img.Bounds().Dx() > thumbWidth || img.Bounds().Dy() > thumbHeight {
+			dst = imaging.Fit(img, thumbWidth, thumbHeight, imaging.Lanczos)
+		} else {
+			dst = imaging.Clone(img)
+		}
+		// paste over a white image, preventing black backgrounds for transparent GIF/PNG images
+		dst = imaging.OverlayCenter(imaging.New(dst.Bounds().Dx(), dst.Bounds().Dy(), color.White), dst, 1.0)
 	} else {
-		dstImageFill = imaging.Fill(img, thumbWidth, thumbHeight, imaging.Center, imaging.Lanczos)
+		var dstImageFill *image.NRGBA
+		if img.Bounds().Dx() < thumbWidth || img.Bounds().Dy() < thumbHeight {
+			dstImageFill = imaging.Fit(img, thumbWidth, thumbHeight, imaging.Lanczos)
+		} else {
+			dstImageFill = imaging.Fill(img, thumbWidth, thumbHeight, imaging.Center, imaging.Lanczos)
+		}
+		// create white image and paste image over the top
+		// preventing black backgrounds for transparent GIF/PNG images
+		dst = imaging.New(thumbWidth, thumbHeight, color.White)
+		// paste the original over the top
+		dst = imaging.OverlayCenter(dst, dstImageFill, 1.0)
 	}
-	// create white image and paste image over the top
-	// preventing black backgrounds for transparent GIF/PNG images
-	dst := imaging.New(thumbWidth, thumbHeight, color.White)
-	// paste the original over the top
-	dst = imaging.OverlayCenter(dst, dstImageFill, 1.0)
 
 	if err := jpeg.Encode(foo, dst, &jpeg.Options{Quality: 70}); err != nil {
-		logger.Log().Warnf("[image] %s", err.Error())
-		blankImage(a, w)
-		return
+		return nil, err
 	}
 
-	w.Header().Add("Content-Type", "image/jpeg")
-	w.Header().Set("Content-Disposition", "filename=\""+fileName+"\"")
-	_, _ = w.Write(b.Bytes())
+	return b.Bytes(), nil
 }
 
 // Return a blank image instead of an error when file or image not supported
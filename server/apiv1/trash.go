@@ -0,0 +1,139 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+// GetTrash (method: GET) returns the messages in the trash
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	// swagger:route GET /api/v1/trash trash GetTrash
+	//
+	// # List trashed messages
+	//
+	// Returns the messages in the trash, most recently trashed first. Messages are only moved to the trash when
+	// deleted if Mailpit is started with `--trash`, and are permanently deleted after `--trash-purge-after`.
+	// Trashed messages are hidden from the mailbox, searches & stats.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Parameters:
+	//	  + name: start
+	//	    in: query
+	//	    description: Pagination offset
+	//	    required: false
+	//	    type: integer
+	//	    default: 0
+	//	  + name: limit
+	//	    in: query
+	//	    description: Limit results
+	//	    required: false
+	//	    type: integer
+	//	    default: 50
+	//
+	//	Responses:
+	//		200: TrashSummaryResponse
+	//		default: ErrorResponse
+
+	start, limit := getStartLimit(r)
+
+	messages, total, err := storage.ListTrash(start, limit)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(TrashSummary{Total: total, Start: start, Messages: messages})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// RestoreTrash (method: POST) restores messages from the trash
+func RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	// swagger:route POST /api/v1/trash/restore trash RestoreTrash
+	//
+	// # Restore trashed messages
+	//
+	// Restore messages from the trash. IDs which do not match a trashed message are ignored,
+	// and the number of restored messages is returned.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: RestoreTrashResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data trashRequestBody
+
+	if err := decoder.Decode(&data); err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	if len(data.IDs) == 0 {
+		httpError(w, "Error: no IDs provided")
+		return
+	}
+
+	restored, err := storage.RestoreMessages(data.IDs)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(RestoreTrashResult{Restored: restored})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// PurgeTrash (method: DELETE) permanently deletes messages in the trash
+func PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	// swagger:route DELETE /api/v1/trash trash PurgeTrash
+	//
+	// # Purge trashed messages
+	//
+	// Permanently delete messages in the trash. If no IDs are provided then all trashed messages are deleted.
+	// IDs which do not match a trashed message are ignored, and the number of deleted messages is returned.
+	//
+	//	Consumes:
+	//	- application/json
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: PurgeTrashResponse
+	//		default: ErrorResponse
+
+	decoder := json.NewDecoder(r.Body)
+
+	var data trashRequestBody
+
+	// the body is optional
+	_ = decoder.Decode(&data)
+
+	deleted, err := storage.PurgeTrash(data.IDs)
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(PurgeTrashResult{Deleted: deleted})
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
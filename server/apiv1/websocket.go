@@ -0,0 +1,50 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/axllent/mailpit/internal/auth"
+)
+
+// Websocket ticket
+//
+// swagger:model WebsocketTicket
+type websocketTicket struct {
+	// Single-use ticket, passed to the websocket as `?ticket=<ticket>`
+	Ticket string
+	// Time the ticket expires
+	Expires time.Time
+}
+
+// WebsocketTicket returns a short-lived ticket to authenticate the websocket connection
+func WebsocketTicket(w http.ResponseWriter, _ *http.Request) {
+	// swagger:route GET /api/v1/ws-ticket application WebsocketTicket
+	//
+	// # Get websocket ticket
+	//
+	// Returns a short-lived, single-use ticket to authenticate the websocket connection (`/api/events?ticket=<ticket>`).
+	// Browsers cannot set authentication headers when opening a websocket, so the ticket is required
+	// when the web UI & API are protected by authentication.
+	//
+	//	Produces:
+	//	- application/json
+	//
+	//	Schemes: http, https
+	//
+	//	Responses:
+	//		200: WebsocketTicketResponse
+	//		default: ErrorResponse
+
+	ticket, expires, err := auth.NewWebsocketTicket()
+	if err != nil {
+		httpError(w, err.Error())
+		return
+	}
+
+	bytes, _ := json.Marshal(websocketTicket{Ticket: ticket, Expires: expires})
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
@@ -12,6 +12,9 @@ import (
 //
 // swagger:model WebUIConfiguration
 type webUIConfiguration struct {
+	// Optional label to identify the Mailpit instance
+	Label string
+
 	// Message Relay information
 	MessageRelay struct {
 		// Whether message relaying (release) is enabled
@@ -22,6 +25,8 @@ type webUIConfiguration struct {
 		ReturnPath string
 		// Only allow relaying to these recipients (regex)
 		AllowedRecipients string
+		// Never allow relaying to these recipients (regex)
+		BlockedRecipients string
 		// DEPRECATED 2024/03/12
 		// swagger:ignore
 		RecipientAllowlist string
@@ -53,11 +58,14 @@ func WebUIConfig(w http.ResponseWriter, _ *http.Request) {
 	//		default: ErrorResponse
 	conf := webUIConfiguration{}
 
+	conf.Label = config.Label
+
 	conf.MessageRelay.Enabled = config.ReleaseEnabled
 	if config.ReleaseEnabled {
 		conf.MessageRelay.SMTPServer = fmt.Sprintf("%s:%d", config.SMTPRelayConfig.Host, config.SMTPRelayConfig.Port)
 		conf.MessageRelay.ReturnPath = config.SMTPRelayConfig.ReturnPath
 		conf.MessageRelay.AllowedRecipients = config.SMTPRelayConfig.AllowedRecipients
+		conf.MessageRelay.BlockedRecipients = config.SMTPRelayConfig.BlockedRecipients
 		// DEPRECATED 2024/03/12
 		conf.MessageRelay.RecipientAllowlist = config.SMTPRelayConfig.AllowedRecipients
 	}
@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
 	"github.com/axllent/mailpit/internal/storage"
 	"github.com/gorilla/mux"
 )
@@ -25,7 +25,7 @@ func RedirectToLatestMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		messages, err = storage.List(0, 1)
+		messages, err = storage.List(0, 1, "")
 		if err != nil {
 			httpError(w, err.Error())
 			return
@@ -55,6 +55,8 @@ func GetMessageHTML(w http.ResponseWriter, r *http.Request) {
 	// Attached inline images are modified to link to the API provided they exist.
 	// Note that is the message does not contain a HTML part then an 404 error is returned.
 	//
+	// Set `embedCID` to `link` to rewrite inline images to absolute URLs, or to `base64` to embed them as data URIs.
+	//
 	// The ID can be set to `latest` to return the latest message.
 	//
 	//	Produces:
@@ -68,6 +70,18 @@ func GetMessageHTML(w http.ResponseWriter, r *http.Request) {
 	//	    description: Database ID or latest
 	//	    required: true
 	//	    type: string
+	//	  + name: embedCID
+	//	    in: query
+	//	    description: Rewrite cid: references to absolute part URLs (link) or base64 data URIs (base64)
+	//	    required: false
+	//	    type: string
+	//	    enum: link, base64
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: HTMLResponse
@@ -87,6 +101,16 @@ func GetMessageHTML(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if trashedMessage(r, id) {
+		w.WriteHeader(404)
+		fmt.Fprint(w, "Message not found")
+		return
+	}
+
+	if err := storage.MarkOpened(id); err != nil {
+		logger.Log().Errorf("[db] %s", err.Error())
+	}
+
 	msg, err := storage.GetMessage(id)
 	if err != nil {
 		w.WriteHeader(404)
@@ -100,6 +124,14 @@ func GetMessageHTML(w http.ResponseWriter, r *http.Request) {
 	}
 
 	html := linkInlineImages(msg)
+	if mode := r.URL.Query().Get("embedCID"); mode != "" {
+		html, err = EmbedCIDs(r, msg, mode)
+		if err != nil {
+			httpError(w, err.Error())
+			return
+		}
+	}
+
 	w.Header().Add("Content-Type", "text/html; charset=utf-8")
 	_, _ = w.Write([]byte(html))
 }
@@ -125,6 +157,12 @@ func GetMessageText(w http.ResponseWriter, r *http.Request) {
 	//	    description: Database ID or latest
 	//	    required: true
 	//	    type: string
+	//	  + name: trash
+	//	    in: query
+	//	    description: Return the message if it is in the trash
+	//	    required: false
+	//	    type: boolean
+	//	    default: false
 	//
 	//	Responses:
 	//		200: TextResponse
@@ -144,6 +182,12 @@ func GetMessageText(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if trashedMessage(r, id) {
+		w.WriteHeader(404)
+		fmt.Fprint(w, "Message not found")
+		return
+	}
+
 	msg, err := storage.GetMessage(id)
 	if err != nil {
 		w.WriteHeader(404)
@@ -157,29 +201,49 @@ func GetMessageText(w http.ResponseWriter, r *http.Request) {
 
 // This will rewrite all inline image paths to API URLs
 func linkInlineImages(msg *storage.Message) string {
-	html := msg.HTML
-
-	for _, a := range msg.Inline {
-		if a.ContentID != "" {
-			re := regexp.MustCompile(`(?i)(=["\']?)(cid:` + regexp.QuoteMeta(a.ContentID) + `)(["|\'|\\s|\\/|>|;])`)
-			u := config.Webroot + "api/v1/message/" + msg.ID + "/part/" + a.PartID
-			matches := re.FindAllStringSubmatch(html, -1)
-			for _, m := range matches {
-				html = strings.ReplaceAll(html, m[0], m[1]+u+m[3])
-			}
-		}
+	return storage.ReplaceCIDs(msg, func(a storage.Attachment) (string, bool) {
+		return config.Webroot + "api/v1/message/" + msg.ID + "/part/" + a.PartID, true
+	})
+}
+
+// EmbedCIDs returns the message HTML with cid: references rewritten using the embed mode,
+// either `link` (absolute part download URLs) or `base64` (data URIs).
+// Unresolvable cid: references are left untouched.
+func EmbedCIDs(r *http.Request, msg *storage.Message, mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "link":
+		base := baseURL(r)
+		return storage.ReplaceCIDs(msg, func(a storage.Attachment) (string, bool) {
+			return base + "api/v1/message/" + msg.ID + "/part/" + a.PartID, true
+		}), nil
+	case "base64":
+		return storage.EmbedCIDs(msg)
+	default:
+		return "", fmt.Errorf("invalid embedCID value \"%s\", must be either link or base64", mode)
 	}
+}
 
-	for _, a := range msg.Attachments {
-		if a.ContentID != "" {
-			re := regexp.MustCompile(`(?i)(=["\']?)(cid:` + regexp.QuoteMeta(a.ContentID) + `)(["|\'|\\s|\\/|>|;])`)
-			u := config.Webroot + "api/v1/message/" + msg.ID + "/part/" + a.PartID
-			matches := re.FindAllStringSubmatch(html, -1)
-			for _, m := range matches {
-				html = strings.ReplaceAll(html, m[0], m[1]+u+m[3])
-			}
-		}
+// Return the absolute base URL (including the webroot) of the request, respecting proxy headers
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = strings.TrimSpace(strings.Split(h, ",")[0])
 	}
 
-	return html
+	return scheme + "://" + host + config.Webroot
+}
+
+// TrashedMessage returns true if the message is in the trash, unless the request sets `trash`
+func trashedMessage(r *http.Request, id string) bool {
+	t := r.URL.Query().Get("trash")
+
+	return t != "true" && t != "1" && storage.IsTrashed(id)
 }
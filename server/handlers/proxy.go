@@ -2,7 +2,6 @@
 package handlers
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +11,7 @@ import (
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/httpclient"
 	"github.com/axllent/mailpit/internal/logger"
 )
 
@@ -32,16 +32,7 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tr := &http.Transport{}
-
-	if config.AllowUntrustedTLS {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // #nosec
-	}
-
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   10 * time.Second,
-	}
+	client := httpclient.Client(10*time.Second, config.AllowUntrustedTLS)
 
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
@@ -28,7 +28,7 @@ func sendData(c net.Conn, m string) {
 
 func getMessages() ([]message, error) {
 	messages := []message{}
-	list, err := storage.List(0, 100)
+	list, err := storage.List(0, 100, "")
 	if err != nil {
 		return messages, err
 	}
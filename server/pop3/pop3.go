@@ -91,7 +91,7 @@ func handleClient(conn net.Conn) {
 	defer func() {
 		if state == UPDATE {
 			for _, id := range toDelete {
-				_ = storage.DeleteMessages([]string{id})
+				_, _, _ = storage.DeleteMessages([]string{id})
 			}
 			if len(toDelete) > 0 {
 				// update web UI to remove deleted messages
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -38,7 +37,7 @@ var AccessControlAllowOrigin string
 // Listen will start the httpd
 func Listen() {
 	if err := godotenv.Load(); err != nil {
-        log.Print("No .env file found")
+        logger.Log().Debug("[http] no .env file found")
     }
 	
 	isReady := &atomic.Value{}
@@ -57,6 +56,10 @@ func Listen() {
 
 	go pop3.Run()
 
+	go apiv1.RunReleaseScheduler()
+
+	go apiv1.RunForwarder()
+
 	r := apiRoutes()
 
 	// kubernetes probes
@@ -133,23 +136,87 @@ func apiRoutes() *mux.Router {
 	r.HandleFunc(config.Webroot+"api/v1/messages", middleWareFunc(apiv1.GetMessages)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/messages", middleWareFunc(apiv1.SetReadStatus)).Methods("PUT")
 	r.HandleFunc(config.Webroot+"api/v1/messages", middleWareFunc(apiv1.DeleteMessages)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/messages/old", middleWareFunc(apiv1.DeleteOldMessages)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/messages/star", middleWareFunc(apiv1.SetStarredStatus)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/messages/latest-id", middleWareFunc(apiv1.LatestMessageID)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/wait", middleWareFunc(apiv1.WaitForMessage)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/messages/release", middleWareFunc(apiv1.ReleaseMessages)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/send", middleWareFunc(apiv1.SendMessage)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/relay/rules", middleWareFunc(apiv1.GetForwardRules)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/relay/rules", middleWareFunc(apiv1.AddForwardRule)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/relay/rules/{id}", middleWareFunc(apiv1.UpdateForwardRule)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/relay/rules/{id}", middleWareFunc(apiv1.DeleteForwardRule)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/relays", middleWareFunc(apiv1.GetRelayProfiles)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/releases", middleWareFunc(apiv1.GetReleaseJobs)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/releases/history", middleWareFunc(apiv1.GetReleaseHistory)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/releases/{id}", middleWareFunc(apiv1.CancelReleaseJob)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/attachments", middleWareFunc(apiv1.ListAttachments)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/trash", middleWareFunc(apiv1.GetTrash)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/trash", middleWareFunc(apiv1.PurgeTrash)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/trash/restore", middleWareFunc(apiv1.RestoreTrash)).Methods("POST")
 	r.HandleFunc(config.Webroot+"api/v1/tags", middleWareFunc(apiv1.GetAllTags)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/tags/stats", middleWareFunc(apiv1.GetTagStats)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/tags", middleWareFunc(apiv1.SetMessageTags)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/tags", middleWareFunc(apiv1.PatchMessageTags)).Methods("PATCH")
+	r.HandleFunc(config.Webroot+"api/v1/tags/search", middleWareFunc(apiv1.SetSearchTags)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/tags/rename", middleWareFunc(apiv1.RenameTag)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/tags/meta", middleWareFunc(apiv1.GetTagMeta)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/tags/meta", middleWareFunc(apiv1.SetTagMeta)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/tags/retention", middleWareFunc(apiv1.GetTagRetention)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/tags/retention", middleWareFunc(apiv1.SetTagRetention)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/tags/rules", middleWareFunc(apiv1.GetTagRules)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/tags/rules", middleWareFunc(apiv1.AddTagRule)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/tags/rules/apply", middleWareFunc(apiv1.ApplyTagRules)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/tags/rules/{id}", middleWareFunc(apiv1.UpdateTagRule)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/tags/rules/{id}", middleWareFunc(apiv1.DeleteTagRule)).Methods("DELETE")
+	r.HandleFunc(config.Webroot+"api/v1/tags/{tag}", middleWareFunc(apiv1.DeleteTag)).Methods("DELETE")
 	r.HandleFunc(config.Webroot+"api/v1/search", middleWareFunc(apiv1.Search)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/search", middleWareFunc(apiv1.DeleteSearch)).Methods("DELETE")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/part/{partID}", middleWareFunc(apiv1.DownloadAttachment)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/attachments.zip", middleWareFunc(apiv1.DownloadAttachmentsZip)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/calendar", middleWareFunc(apiv1.GetCalendar)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/html", middleWareFunc(apiv1.GetMessageHTML)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/part/{partID}/thumb", middleWareFunc(apiv1.Thumbnail)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/part/{partID}/text", middleWareFunc(apiv1.AttachmentText)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/part/{partID}/checksum", middleWareFunc(apiv1.AttachmentChecksum)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/report", middleWareFunc(apiv1.MessageReport)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/headers", middleWareFunc(apiv1.GetHeaders)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/envelope", middleWareFunc(apiv1.GetMessageEnvelope)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/events", middleWareFunc(apiv1.MessageEvents)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/thread", middleWareFunc(apiv1.MessageThread)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/adjacent", middleWareFunc(apiv1.AdjacentMessages)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/cid-map", middleWareFunc(apiv1.GetCIDMap)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/parts", middleWareFunc(apiv1.GetMessageParts)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/raw", middleWareFunc(apiv1.DownloadRaw)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/release", middleWareFunc(apiv1.ReleaseMessage)).Methods("POST")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/releases", middleWareFunc(apiv1.GetMessageReleaseHistory)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/metadata", middleWareFunc(apiv1.SetMessageMetadata)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/pin", middleWareFunc(apiv1.PinMessage)).Methods("PUT")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/pin", middleWareFunc(apiv1.UnpinMessage)).Methods("DELETE")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/html-check", middleWareFunc(apiv1.HTMLCheck)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}/link-check", middleWareFunc(apiv1.LinkCheck)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/track-check", middleWareFunc(apiv1.TrackCheck)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message/{id}/parity-check", middleWareFunc(apiv1.ParityCheck)).Methods("GET")
 	if config.EnableSpamAssassin != "" {
 		r.HandleFunc(config.Webroot+"api/v1/message/{id}/sa-check", middleWareFunc(apiv1.SpamAssassinCheck)).Methods("GET")
 	}
+	if config.EnableClamAV != "" {
+		r.HandleFunc(config.Webroot+"api/v1/message/{id}/av-check", middleWareFunc(apiv1.AntivirusCheck)).Methods("GET")
+	}
 	r.HandleFunc(config.Webroot+"api/v1/message/{id}", middleWareFunc(apiv1.GetMessage)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/message-id/{messageID:.+}", middleWareFunc(apiv1.GetMessageByMessageID)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/maintenance/prune-attachments", middleWareFunc(apiv1.PruneAttachments)).Methods("POST")
 	r.HandleFunc(config.Webroot+"api/v1/info", middleWareFunc(apiv1.AppInfo)).Methods("GET")
 	r.HandleFunc(config.Webroot+"api/v1/webui", middleWareFunc(apiv1.WebUIConfig)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/ws-ticket", middleWareFunc(apiv1.WebsocketTicket)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/sender-quotas", middleWareFunc(apiv1.SenderQuotas)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/smtp/rejections", middleWareFunc(apiv1.RecipientRejections)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/connectivity", middleWareFunc(apiv1.Connectivity)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/settings", middleWareFunc(apiv1.GetSettings)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/migrations", middleWareFunc(apiv1.Migrations)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/settings", middleWareFunc(apiv1.UpdateSettings)).Methods("PATCH")
+	r.HandleFunc(config.Webroot+"api/v1/profile/export", middleWareFunc(apiv1.ExportProfile)).Methods("GET")
+	r.HandleFunc(config.Webroot+"api/v1/profile/import", middleWareFunc(apiv1.ImportProfile)).Methods("POST")
 	r.HandleFunc(config.Webroot+"api/v1/swagger.json", middleWareFunc(swaggerBasePath)).Methods("GET")
 
 	r.HandleFunc(config.Webroot+"api/v1/report/phishing", middleWareFunc(apiv1.ReportPhishing)).Methods("POST")
@@ -183,6 +250,17 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// WriteHeader removes the Content-Length header, as it is the length of the uncompressed content
+func (w gzipResponseWriter) WriteHeader(statusCode int) {
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (w gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // MiddleWareFunc http middleware adds optional basic authentication
 // and gzip compression.
 func middleWareFunc(fn http.HandlerFunc) http.HandlerFunc {
@@ -192,10 +270,14 @@ func middleWareFunc(fn http.HandlerFunc) http.HandlerFunc {
 
 		if AccessControlAllowOrigin != "" && strings.HasPrefix(r.RequestURI, config.Webroot+"api/") {
 			w.Header().Set("Access-Control-Allow-Origin", AccessControlAllowOrigin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, PUT, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, PUT, PATCH, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "*")
 		}
 
+		if config.Label != "" && strings.HasPrefix(r.RequestURI, config.Webroot+"api/") {
+			w.Header().Set("X-Mailpit-Instance", config.Label)
+		}
+
 		if auth.UICredentials != nil {
 			user, pass, ok := r.BasicAuth()
 
@@ -210,7 +292,8 @@ func middleWareFunc(fn http.HandlerFunc) http.HandlerFunc {
 			}
 		}
 
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// range requests refer to the uncompressed content
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Header.Get("Range") != "" {
 			fn(w, r)
 			return
 		}
@@ -231,10 +314,14 @@ func middlewareHandler(h http.Handler) http.Handler {
 
 		if AccessControlAllowOrigin != "" && strings.HasPrefix(r.RequestURI, config.Webroot+"api/") {
 			w.Header().Set("Access-Control-Allow-Origin", AccessControlAllowOrigin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, PUT, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, PUT, PATCH, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "*")
 		}
 
+		if config.Label != "" && strings.HasPrefix(r.RequestURI, config.Webroot+"api/") {
+			w.Header().Set("X-Mailpit-Instance", config.Label)
+		}
+
 		if auth.UICredentials != nil {
 			user, pass, ok := r.BasicAuth()
 
@@ -249,7 +336,8 @@ func middlewareHandler(h http.Handler) http.Handler {
 			}
 		}
 
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// range requests refer to the uncompressed content
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Header.Get("Range") != "" {
 			h.ServeHTTP(w, r)
 			return
 		}
@@ -1,21 +1,55 @@
 package server
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/calendar"
 	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/paritycheck"
 	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tools"
 	"github.com/axllent/mailpit/server/apiv1"
+	"github.com/axllent/mailpit/server/handlers"
+	"github.com/axllent/mailpit/server/smtpd"
+	"github.com/axllent/mailpit/server/websockets"
+	"github.com/gorilla/websocket"
 	"github.com/jhillyerd/enmime"
 )
 
@@ -78,6 +112,25 @@ func TestAPIv1Messages(t *testing.T) {
 	// 10 should be marked as read
 	assertStatsEqual(t, ts.URL+"/api/v1/messages", 90, 100)
 
+	// filtered messages count
+	m, err = fetchMessages(ts.URL + "/api/v1/messages?filter=unread&limit=10")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	assertEqual(t, m.MessagesCount, float64(90), "wrong unread messages count")
+	assertEqual(t, m.Total, float64(100), "wrong total messages")
+	assertEqual(t, len(m.Messages), 10, "wrong number of unread messages")
+
+	m, err = fetchMessages(ts.URL + "/api/v1/messages?filter=read")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	assertEqual(t, m.MessagesCount, float64(10), "wrong read messages count")
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?filter=invalid"); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+
 	// delete all
 	t.Log("Delete all messages")
 	_, err = clientDelete(ts.URL+"/api/v1/messages", "{}")
@@ -200,6 +253,27 @@ func TestAPIv1Search(t *testing.T) {
 	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"Test tag 065\"", 1)
 	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"TEST TAG 065\"", 1)
 	assertSearchEqual(t, ts.URL+"/api/v1/search", "!tag:\"Test tag 023\"", 99)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "after:10m", 100)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "before:1d", 0)
+
+	t.Log("Invalid relative date")
+	resp, err := http.Get(ts.URL + "/api/v1/search?query=after:10y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest, "wrong status")
+	assertEqual(t, strings.Contains(string(body), "invalid relative date"), true, "wrong error")
+
+	if _, err := clientDelete(ts.URL+"/api/v1/search?query=before:7x", ""); err == nil {
+		t.Error("expected an error deleting an invalid relative date")
+	}
+
+	if _, err := clientDelete(ts.URL+"/api/v1/search?query=before:7d", ""); err != nil {
+		t.Fatal(err)
+	}
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
 }
 
 func setup() {
@@ -211,7 +285,7 @@ func setup() {
 		panic(err)
 	}
 
-	if err := storage.DeleteAllMessages(); err != nil {
+	if _, err := storage.DeleteAllMessages(true); err != nil {
 		panic(err)
 	}
 }
@@ -254,97 +328,4738 @@ func assertSearchEqual(t *testing.T, uri, query string, count int) {
 	assertEqual(t, float64(count), m.MessagesCount, "wrong search results count")
 }
 
-func insertEmailData(t *testing.T) {
-	for i := 0; i < 100; i++ {
-		msg := enmime.Builder().
-			From(fmt.Sprintf("From %d", i), fmt.Sprintf("from-%d@example.com", i)).
-			Subject(fmt.Sprintf("Subject line %d end", i)).
-			Text([]byte(fmt.Sprintf("This is the email body %d <jdsauk;dwqmdqw;>.", i))).
-			To(fmt.Sprintf("To %d", i), fmt.Sprintf("to-%d@example.com", i))
+func TestAPIv1SearchETag(t *testing.T) {
+	setup()
+	defer storage.Close()
 
-		env, err := msg.Build()
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: ETag\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	searchURL := ts.URL + "/api/v1/search?query=" + url.QueryEscape("subject:etag")
+
+	conditionalGet := func(etag string) *http.Response {
+		req, err := http.NewRequest("GET", searchURL, nil)
 		if err != nil {
-			t.Log("error ", err)
-			t.Fail()
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
 		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
 
-		buf := new(bytes.Buffer)
+		return resp
+	}
 
-		if err := env.Encode(buf); err != nil {
-			t.Log("error ", err)
-			t.Fail()
+	resp := conditionalGet("")
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+	etag := resp.Header.Get("ETag")
+	assertEqual(t, etag != "", true, "missing ETag")
+
+	t.Log("Unchanged results")
+	resp = conditionalGet(etag)
+	assertEqual(t, resp.StatusCode, http.StatusNotModified, "wrong status")
+
+	t.Log("Read status changed")
+	if err := storage.MarkRead(id); err != nil {
+		t.Fatal(err)
+	}
+	resp = conditionalGet(etag)
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+	etag = resp.Header.Get("ETag")
+
+	t.Log("Tags changed")
+	if err := storage.SetMessageTags(id, []string{"Polled"}); err != nil {
+		t.Fatal(err)
+	}
+	resp = conditionalGet(etag)
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+	etag = resp.Header.Get("ETag")
+
+	assertChanged := func(name string, err error) {
+		if err != nil {
+			t.Fatal(err)
 		}
+		resp := conditionalGet(etag)
+		assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status after "+name+" changed")
+		etag = resp.Header.Get("ETag")
+	}
 
-		bufBytes := buf.Bytes()
+	t.Log("Pinned, starred, metadata & opened changed")
+	assertChanged("pinned", storage.SetPinned(id, true))
+	_, err = storage.SetStarred([]string{id}, true)
+	assertChanged("starred", err)
+	_, err = storage.SetMessageMetadata(id, map[string]string{"key": "value"}, false)
+	assertChanged("metadata", err)
+	assertChanged("opened", storage.MarkOpened(id))
 
-		id, err := storage.Store(&bufBytes)
+	t.Log("New matching message")
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+	resp = conditionalGet(etag)
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+}
+
+func TestAPIv1MessagesCursor(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	seen := map[string]bool{}
+	pages := 0
+	next := ts.URL + "/api/v1/messages?limit=30"
+	for next != "" {
+		m, err := fetchMessages(next)
 		if err != nil {
-			t.Log("error ", err)
-			t.Fail()
+			t.Fatal(err)
 		}
+		pages++
 
-		if err := storage.SetMessageTags(id, []string{fmt.Sprintf("Test tag %03d", i)}); err != nil {
-			t.Log("error ", err)
-			t.Fail()
+		for _, msg := range m.Messages {
+			assertEqual(t, seen[msg.ID], false, "duplicate message across pages")
+			seen[msg.ID] = true
+		}
+
+		next = ""
+		if m.NextCursor != "" {
+			assertEqual(t, m.NextCursor, m.Messages[len(m.Messages)-1].ID, "wrong next cursor")
+			next = ts.URL + "/api/v1/messages?limit=30&after_id=" + m.NextCursor
 		}
 	}
 
+	assertEqual(t, pages, 4, "wrong number of pages")
+	assertEqual(t, len(seen), 100, "wrong number of messages")
+
+	t.Log("Invalid cursor")
+	if _, err := clientGet(ts.URL + "/api/v1/messages?after_id=missing"); err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
 }
 
-func fetchMessages(url string) (apiv1.MessagesSummary, error) {
-	m := apiv1.MessagesSummary{}
+func TestAPIv1MessagesAttachmentsSize(t *testing.T) {
+	setup()
+	defer storage.Close()
 
-	data, err := clientGet(url)
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Two attachments").
+		Text([]byte("See attached")).
+		AddAttachment(bytes.Repeat([]byte("a"), 1500), "text/plain", "first.txt").
+		AddAttachment(bytes.Repeat([]byte("b"), 2500), "application/octet-stream", "second.bin").
+		Build()
 	if err != nil {
-		return m, err
+		t.Fatal(err)
 	}
 
-	if err := json.Unmarshal(data, &m); err != nil {
-		return m, err
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
 	}
 
-	return m, nil
+	raw := buf.Bytes()
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{"/api/v1/messages", "/api/v1/search?query=" + url.QueryEscape("has:attachment")} {
+		m, err := fetchMessages(ts.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, len(m.Messages), 1, "wrong number of messages")
+		assertEqual(t, m.Messages[0].Attachments, 2, "wrong number of attachments")
+		assertEqual(t, m.Messages[0].AttachmentsSize, float64(4000), "wrong attachments size")
+	}
 }
 
-func clientGet(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func TestAPIv1DeleteSearch(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	deleteSearch := func(query, accept string) (string, apiv1.DeleteSearchResult) {
+		req, err := http.NewRequest("DELETE", ts.URL+"/api/v1/search?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := apiv1.DeleteSearchResult{}
+		if strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
+			if err := json.Unmarshal(data, &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return string(data), res
+	}
+
+	t.Log("Dry run")
+	for _, search := range []string{"from:from-1@example.com", "subject:\"Subject line\"", "tag:\"Test tag 065\"", "thisdoesnotexist"} {
+		m, err := fetchMessages(ts.URL + "/api/v1/search?query=" + url.QueryEscape(search))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, res := deleteSearch("dry_run=true&query="+url.QueryEscape(search), "")
+		assertEqual(t, res.Matched, int(m.MessagesCount), "dry run count does not match search for "+search)
+		assertEqual(t, res.Deleted, 0, "dry run deleted messages")
+	}
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
+
+	t.Log("Delete")
+	_, res := deleteSearch("query="+url.QueryEscape("from:from-1@example.com"), "")
+	assertEqual(t, res.Matched, 1, "wrong matched count")
+	assertEqual(t, res.Deleted, 1, "wrong deleted count")
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 99, 99)
+
+	_, res = deleteSearch("query=thisdoesnotexist", "application/json")
+	assertEqual(t, res.Matched, 0, "wrong matched count")
+	assertEqual(t, res.Deleted, 0, "wrong deleted count")
+
+	t.Log("Plain text response")
+	body, _ := deleteSearch("query="+url.QueryEscape("from:from-2@example.com"), "text/plain")
+	assertEqual(t, body, "ok", "wrong plain text response")
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 98, 98)
+}
+
+func TestAPIv1DeleteOldMessages(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	data, err := clientDelete(ts.URL+"/api/v1/messages/old?age=1h", "")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	assertEqual(t, string(data), `{"Deleted":0,"Size":0}`, "recent messages were deleted")
+
+	time.Sleep(5 * time.Millisecond)
+
+	data, err = clientDelete(ts.URL+"/api/v1/messages/old?age=1ms&unread=keep", "")
+	if err != nil {
+		t.Fatal(err)
 	}
+	assertEqual(t, string(data), `{"Deleted":0,"Size":0}`, "unread messages were deleted")
 
-	defer resp.Body.Close()
+	data, err = clientDelete(ts.URL+"/api/v1/messages/old?age=1ms", "")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	data, err := io.ReadAll(resp.Body)
+	res := apiv1.DeleteOldMessagesResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Deleted, 100, "incorrect number of deleted messages")
+	assertEqual(t, res.Size > 0, true, "deleted size not returned")
+	assertEqual(t, storage.CountTotal(), float64(0), "messages not deleted")
 
-	return data, err
+	t.Log("Invalid options")
+	for _, q := range []string{"", "?age=soon", "?age=-1h", "?age=0", "?age=7d&unread=delete"} {
+		if _, err := clientDelete(ts.URL+"/api/v1/messages/old"+q, ""); err == nil {
+			t.Errorf("expected an error for %s", q)
+		}
+	}
 }
 
-func clientDelete(url, body string) ([]byte, error) {
-	client := new(http.Client)
+func TestAPIv1Trash(t *testing.T) {
+	setup()
+	defer storage.Close()
 
-	b := strings.NewReader(body)
-	req, err := http.NewRequest("DELETE", url, b)
+	config.Trash = true
+	defer func() { config.Trash = false }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages?limit=2")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
+	id := m.Messages[0].ID
 
-	resp, err := client.Do(req)
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", `{"IDs": ["`+id+`"]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 99, 99)
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/" + id + "/raw"); err == nil {
+		t.Error("expected a 404 for a trashed message")
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/" + id + "/raw?trash=1"); err != nil {
+		t.Errorf("trashed message not returned: %s", err.Error())
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/trash")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
+	trash := apiv1.TrashSummary{}
+	if err := json.Unmarshal(data, &trash); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, trash.Total, float64(1), "incorrect number of trashed messages")
+	assertEqual(t, trash.Messages[0].ID, id, "incorrect trashed message")
 
-	defer resp.Body.Close()
+	data, err = clientPost(ts.URL+"/api/v1/trash/restore", `{"IDs": ["`+id+`", "does-not-exist"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `{"Restored":1}`, "incorrect restore result")
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
+
+	if _, err := clientDelete(ts.URL+"/api/v1/search?query="+url.QueryEscape(`subject:"Subject line 1 end"`), ""); err != nil {
+		t.Fatal(err)
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 99, 99)
 
-	return data, err
+	data, err = clientDelete(ts.URL+"/api/v1/trash", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `{"Deleted":1}`, "incorrect purge result")
+
+	data, err = clientGet(ts.URL + "/api/v1/trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `{"total":0,"start":0,"messages":[]}`, "trash not purged")
+}
+
+func TestAPIv1TrashedMessageHandlers(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	config.Trash = true
+	defer func() { config.Trash = false }()
+
+	r := apiRoutes()
+	r.HandleFunc("/view/{id}.html", handlers.GetMessageHTML).Methods("GET")
+	r.HandleFunc("/view/{id}.txt", handlers.GetMessageText).Methods("GET")
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	pngData := new(bytes.Buffer)
+	if err := png.Encode(pngData, img); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Trashed").
+		Text([]byte("Trashed text")).
+		HTML([]byte("<p>Trashed HTML</p>")).
+		AddAttachment(pngData.Bytes(), "image/png", "image.png").
+		AddAttachment([]byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:trash-1\r\nSUMMARY:Trash\r\nDTSTART:20240116T090000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"), "application/ics", "invite.ics").
+		AddAttachment([]byte("Trashed notes"), "text/plain", "notes.txt").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagePart := msg.Attachments[0].PartID
+	textPart := msg.Attachments[2].PartID
+
+	if _, _, err := storage.DeleteMessages([]string{id}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uri := range []string{
+		"/api/v1/message/" + id,
+		"/api/v1/message/" + id + "/raw",
+		"/api/v1/message/" + id + "/html",
+		"/api/v1/message/" + id + "/headers",
+		"/api/v1/message/" + id + "/envelope",
+		"/api/v1/message/" + id + "/parts",
+		"/api/v1/message/" + id + "/cid-map",
+		"/api/v1/message/" + id + "/calendar",
+		"/api/v1/message/" + id + "/report",
+		"/api/v1/message/" + id + "/thread",
+		"/api/v1/message/" + id + "/html-check",
+		"/api/v1/message/" + id + "/link-check",
+		"/api/v1/message/" + id + "/track-check",
+		"/api/v1/message/" + id + "/parity-check",
+		"/api/v1/message/" + id + "/attachments.zip",
+		"/api/v1/message/" + id + "/part/" + imagePart,
+		"/api/v1/message/" + id + "/part/" + imagePart + "/thumb",
+		"/api/v1/message/" + id + "/part/" + imagePart + "/checksum",
+		"/api/v1/message/" + id + "/part/" + textPart + "/text",
+		"/view/" + id + ".html",
+		"/view/" + id + ".txt",
+	} {
+		if _, err := clientGet(ts.URL + uri); err == nil || !strings.HasSuffix(err.Error(), "status 404") {
+			t.Errorf("expected a 404 for trashed message %s, got %v", uri, err)
+		}
+
+		if _, err := clientGet(ts.URL + uri + "?trash=1"); err != nil {
+			t.Errorf("trashed message not returned: %s", err.Error())
+		}
+	}
+}
+
+func TestAPIv1PinMessage(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages?limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1, id2 := m.Messages[0].ID, m.Messages[1].ID
+
+	for _, id := range []string{id1, id2} {
+		if _, err := clientPut(ts.URL+"/api/v1/message/"+id+"/pin", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := clientPut(ts.URL+"/api/v1/message/does-not-exist/pin", ""); err == nil {
+		t.Error("expected a 404 for an unknown message")
+	}
+
+	m, err = fetchMessages(ts.URL + "/api/v1/messages?limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, m.Pinned, float64(2), "incorrect pinned count")
+	assertEqual(t, m.Messages[0].Pinned, true, "message summary not pinned")
+
+	m, err = fetchMessages(ts.URL + "/api/v1/search?query=is:pinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, m.MessagesCount, float64(2), "incorrect is:pinned search results")
+
+	if _, err := clientDelete(ts.URL+"/api/v1/message/"+id2+"/pin", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := storage.Message{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Pinned, false, "message not unpinned")
+
+	if _, err := clientDelete(ts.URL+"/api/v1/search?query=subject", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 1, 1)
+
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 1, 1)
+
+	if _, err := clientDelete(ts.URL+"/api/v1/messages?force=true", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 0, 0)
+}
+
+func TestAPIv1SetStarredStatus(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages?limit=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientPut(ts.URL+"/api/v1/messages/star", `{"Starred": true, "IDs": ["`+m.Messages[0].ID+`", "`+m.Messages[2].ID+`"]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = fetchMessages(ts.URL + "/api/v1/search?query=is:starred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, m.MessagesCount, float64(2), "incorrect is:starred search results")
+	assertEqual(t, m.Messages[0].Starred, true, "message summary not starred")
+
+	// unread status is not affected
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
+
+	if _, err := clientPut(ts.URL+"/api/v1/messages/star", `{"Starred": false}`); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = fetchMessages(ts.URL + "/api/v1/search?query=is:starred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, m.MessagesCount, float64(0), "messages not unstarred")
+
+	if _, err := clientPut(ts.URL+"/api/v1/messages/star", `invalid`); err == nil {
+		t.Error("expected an error for an invalid request")
+	}
+}
+
+func TestAPIv1SetSearchTags(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	data, err := clientPut(ts.URL+"/api/v1/tags/search", `{"Query": "subject:\"Subject line 1\"", "Tags": ["Staging"], "Append": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := apiv1.SetSearchTagsResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Matched, 11, "wrong number of matched messages")
+	assertEqual(t, res.Updated, 11, "wrong number of updated messages")
+
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Staging", 11)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Staging tag:\"Test tag 010\"", 1)
+
+	for _, body := range []string{`{"Query": "", "Tags": ["Staging"]}`, `{"Query": "subject:test", "Tags": ["Invalid!"]}`, `[]`} {
+		if _, err := clientPut(ts.URL+"/api/v1/tags/search", body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestAPIv1PatchTags(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nSubject: tags\r\n\r\nHello\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.SetMessageTags(id, []string{"Job A"}); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(action string, tags string) storage.MessageTagsResult {
+		data, err := clientPatch(ts.URL+"/api/v1/tags", `{"Action": "`+action+`", "Tags": `+tags+`, "IDs": ["`+id+`"]}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := []storage.MessageTagsResult{}
+		if err := json.Unmarshal(data, &results); err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, len(results), 1, "wrong number of results")
+
+		return results[0]
+	}
+
+	res := patch("add", `["Job B", "Job A"]`)
+	assertEqual(t, strings.Join(res.Added, ","), "Job B", "wrong added tags")
+	assertEqual(t, strings.Join(res.Tags, ","), "Job A,Job B", "wrong tags")
+
+	res = patch("remove", `["Job A", "Job C"]`)
+	assertEqual(t, strings.Join(res.Removed, ","), "Job A", "wrong removed tags")
+	assertEqual(t, strings.Join(res.Tags, ","), "Job B", "wrong tags")
+
+	for _, body := range []string{`{"Action": "set", "Tags": ["Job A"], "IDs": ["` + id + `"]}`, `{"Action": "add", "Tags": ["Invalid!"], "IDs": ["` + id + `"]}`, `[]`} {
+		if _, err := clientPatch(ts.URL+"/api/v1/tags", body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestAPIv1RenameTag(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	if _, err := clientPut(ts.URL+"/api/v1/tags/search", `{"Query": "subject:\"Subject line 1\"", "Tags": ["Staging"], "Append": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	rename := func(body string) int {
+		data, err := clientPut(ts.URL+"/api/v1/tags/rename", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := apiv1.RenameTagResult{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		return res.Updated
+	}
+
+	assertEqual(t, rename(`{"From": "staging", "To": "Production"}`), 11, "wrong number of updated messages")
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Production", 11)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Staging", 0)
+
+	t.Log("Merge with an existing tag")
+	assertEqual(t, rename(`{"From": "Test tag 010", "To": "production"}`), 1, "wrong number of updated messages")
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Production", 11)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"Test tag 010\"", 0)
+
+	assertEqual(t, rename(`{"From": "Test tag 020", "To": "Production"}`), 1, "wrong number of updated messages")
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Production", 12)
+
+	for _, body := range []string{`{"From": "Production", "To": "Invalid!"}`, `{"From": "Production", "To": " "}`, `{"From": "", "To": "Other"}`, `{"From": "Missing", "To": "Other"}`, `[]`} {
+		if _, err := clientPut(ts.URL+"/api/v1/tags/rename", body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Production", 12)
+}
+
+func TestAPIv1DeleteTag(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	if _, err := clientPut(ts.URL+"/api/v1/tags/search", `{"Query": "subject:\"Subject line 1\"", "Tags": ["Staging"], "Append": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteTag := func(tag string) int {
+		data, err := clientDelete(ts.URL+"/api/v1/tags/"+url.PathEscape(tag), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := apiv1.DeleteTagResult{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		return res.Updated
+	}
+
+	assertEqual(t, deleteTag("staging"), 11, "wrong number of updated messages")
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Staging", 0)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "subject:\"Subject line 1\"", 11)
+
+	assertEqual(t, deleteTag("Test tag 010"), 1, "wrong number of updated messages")
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:\"Test tag 011\"", 1)
+
+	data, err := clientGet(ts.URL + "/api/v1/tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := []string{}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if tag == "Staging" || tag == "Test tag 010" {
+			t.Errorf("deleted tag %s is still listed", tag)
+		}
+	}
+
+	// a missing tag is not an error
+	assertEqual(t, deleteTag("Missing"), 0, "wrong number of updated messages")
+}
+
+func TestAPIv1TagStats(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	if _, err := clientPut(ts.URL+"/api/v1/tags/search", `{"Query": "subject:\"Subject line 1\"", "Tags": ["Billing"], "Append": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	billing := func() storage.TagStats {
+		data, err := clientGet(ts.URL + "/api/v1/tags/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats := []storage.TagStats{}
+		if err := json.Unmarshal(data, &stats); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range stats {
+			if s.Name == "Billing" {
+				return s
+			}
+		}
+
+		return storage.TagStats{}
+	}
+
+	s := billing()
+	assertEqual(t, s.Total, 11, "wrong total")
+	assertEqual(t, s.Unread, 11, "wrong unread")
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		m, err := fetchMessages(ts.URL + "/api/v1/search?query=" + url.QueryEscape(fmt.Sprintf("subject:\"Subject line 1%d end\"", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.Messages[0].ID)
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{"IDs": ids, "Read": true})
+	if _, err := clientPut(ts.URL+"/api/v1/messages", string(b)); err != nil {
+		t.Fatal(err)
+	}
+	s = billing()
+	assertEqual(t, s.Total, 11, "wrong total after marking read")
+	assertEqual(t, s.Unread, 8, "wrong unread after marking read")
+
+	b, _ = json.Marshal(map[string]interface{}{"IDs": ids[0:2]})
+	if _, err := clientDelete(ts.URL+"/api/v1/messages", string(b)); err != nil {
+		t.Fatal(err)
+	}
+	s = billing()
+	assertEqual(t, s.Total, 9, "wrong total after deleting messages")
+	assertEqual(t, s.Unread, 8, "wrong unread after deleting messages")
+
+	if _, err := clientDelete(ts.URL+"/api/v1/search?query="+url.QueryEscape(`subject:"Subject line 1 end"`), ""); err != nil {
+		t.Fatal(err)
+	}
+	s = billing()
+	assertEqual(t, s.Total, 8, "wrong total after deleting by search")
+	assertEqual(t, s.Unread, 7, "wrong unread after deleting by search")
+}
+
+func TestAPIv1TagRetention(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	defer func() { config.TagRetention, config.TagRetentionRules = "", nil }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	data, err := clientGet(ts.URL + "/api/v1/tags/retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "[]", "wrong tag retention rules")
+
+	data, err = clientPut(ts.URL+"/api/v1/tags/retention", `[{"Tag": "loadtest", "Retention": "1h"}, {"Tag": "ci", "Retention": "2d"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `[{"Tag":"loadtest","Retention":"1h"},{"Tag":"ci","Retention":"2d"}]`, "wrong tag retention rules")
+	assertEqual(t, len(config.TagRetentionRules), 2, "tag retention rules not applied")
+	assertEqual(t, config.TagRetentionRules[1].Duration, 48*time.Hour, "wrong tag retention duration")
+
+	data, err = clientGet(ts.URL + "/api/v1/settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]interface{}{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, settings["tag-retention"], "loadtest=1h,ci=2d", "wrong tag-retention setting")
+
+	t.Log("Invalid rules")
+	for _, body := range []string{`[{"Tag": "loadtest", "Retention": "soon"}]`, `[{"Tag": "", "Retention": "1h"}]`,
+		`[{"Tag": "a=1h,b", "Retention": "1h"}]`, `[{"Tag": "ci", "Retention": "1h"}, {"Tag": "CI", "Retention": "2h"}]`, `{}`} {
+		if _, err := clientPut(ts.URL+"/api/v1/tags/retention", body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+	assertEqual(t, config.TagRetention, "loadtest=1h,ci=2d", "changes applied despite an error")
+
+	data, err = clientPut(ts.URL+"/api/v1/tags/retention", `[]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "[]", "tag retention rules not removed")
+	assertEqual(t, len(config.TagRetentionRules), 0, "tag retention rules not removed")
+}
+
+func TestAPIv1TagMeta(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	data, err := clientGet(ts.URL + "/api/v1/tags/meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "[]", "wrong tag metadata")
+
+	data, err = clientPut(ts.URL+"/api/v1/tags/meta", `{"Tag": "Billing", "Color": "#1E90FF", "Description": "Invoices"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `{"Tag":"Billing","Color":"#1e90ff","Description":"Invoices"}`, "wrong tag metadata")
+
+	t.Log("Invalid metadata")
+	for _, body := range []string{`{"Tag": "Billing", "Color": "blue"}`, `{"Tag": "", "Color": "#1e90ff"}`,
+		`{"Tag": "Billing", "Description": "` + strings.Repeat("x", storage.MaxTagDescriptionLength+1) + `"}`} {
+		if _, err := clientPut(ts.URL+"/api/v1/tags/meta", body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+
+	insertEmailData(t)
+
+	if _, err := clientPut(ts.URL+"/api/v1/tags/search", `{"Query": "subject:\"Subject line 1 end\"", "Tags": ["Billing"], "Append": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientPut(ts.URL+"/api/v1/tags/rename", `{"From": "Billing", "To": "Invoices"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = clientGet(ts.URL + "/api/v1/tags/meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `[{"Tag":"Invoices","Color":"#1e90ff","Description":"Invoices"}]`, "metadata not renamed")
+}
+
+func TestAPIv1MessagesTagFilter(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	if _, err := clientPut(ts.URL+"/api/v1/tags/search", `{"Query": "subject:\"Subject line 1\"", "Tags": ["Staging"], "Append": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	for query, expected := range map[string]float64{
+		"tag=staging":                      11,
+		"tag=Staging&tag=Test%20tag%20010": 1,
+		"tag=Test%20tag%20010&tag=Test%20tag%20020&tag_mode=any": 2,
+		"tag=Staging&tag=Test%20tag%20020":                       0,
+		"tag=staging&filter=unread":                              11,
+	} {
+		m, err := fetchMessages(ts.URL + "/api/v1/messages?limit=5&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, m.MessagesCount, expected, "wrong messages count for "+query)
+		assertEqual(t, m.Total, float64(100), "wrong total for "+query)
+
+		n := int(expected)
+		if n > 5 {
+			n = 5
+		}
+		assertEqual(t, len(m.Messages), n, "wrong number of messages for "+query)
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/messages?tag=Staging&tag_mode=some"); err == nil {
+		t.Error("expected an error for an invalid tag_mode")
+	}
+}
+
+func TestAPIv1TagRules(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	data, err := clientPost(ts.URL+"/api/v1/tags/rules", `{"Query": "subject:\"Subject line 1\"", "Tags": ["Rule"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := storage.TagRule{}
+	if err := json.Unmarshal(data, &rule); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, rule.Query, `subject:"Subject line 1"`, "wrong rule query")
+
+	ruleURL := fmt.Sprintf("%s/api/v1/tags/rules/%d", ts.URL, rule.ID)
+
+	if _, err := clientPut(ruleURL, `{"Query": "subject:\"Subject line 2\"", "Tags": ["Rule", "Other"]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = clientGet(ts.URL + "/api/v1/tags/rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []storage.TagRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(rules), 1, "wrong number of rules")
+	assertEqual(t, strings.Join(rules[0].Tags, ","), "Rule,Other", "rule was not updated")
+
+	data, err = clientPost(ts.URL+"/api/v1/tags/rules/apply", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := apiv1.ApplyTagRulesResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Updated, 11, "wrong number of updated messages")
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Rule tag:Other", 11)
+
+	// new messages are tagged when received
+	raw := []byte("From: sender@example.com\r\nSubject: Subject line 2\r\n\r\nHello\r\n")
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:Rule", 12)
+
+	if _, err := clientDelete(ruleURL, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{ruleURL, ts.URL + "/api/v1/tags/rules/abc"} {
+		if _, err := clientDelete(u, ""); err == nil {
+			t.Errorf("expected an error deleting %s", u)
+		}
+	}
+
+	for _, body := range []string{`{"Query": "", "Tags": ["Rule"]}`, `{"Query": "subject:test", "Tags": ["Invalid!"]}`, `[]`} {
+		if _, err := clientPost(ts.URL+"/api/v1/tags/rules", body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestAPIv1SearchAttachments(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Invoice").
+		HTML([]byte(`<p>Invoice <img src="cid:logo@example.com"></p>`)).
+		AddInline([]byte("png"), "image/png", "", "logo@example.com").
+		AddAttachment([]byte("pdf"), "application/pdf", "invoice_2024_03.pdf").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	insertEmailData(t)
+
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "attachment:invoice", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "attachment:INVOICE_2024_03.PDF", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "-attachment:invoice", 100)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "attachment-type:image/png", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "attachment-type:image/jpeg", 0)
+
+	t.Log("Listing attachments")
+	list := func(query string) apiv1.AttachmentsList {
+		data, err := clientGet(ts.URL + "/api/v1/attachments" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := apiv1.AttachmentsList{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	res := list("")
+	assertEqual(t, res.Total, float64(2), "wrong number of attachments")
+	assertEqual(t, res.Attachments[0].FileName, "logo@example.com", "expected the Content-ID as the file name")
+
+	res = list("?type=pdf")
+	assertEqual(t, res.Total, float64(1), "wrong number of pdf attachments")
+	assertEqual(t, res.Attachments[0].FileName, "invoice_2024_03.pdf", "wrong file name")
+	assertEqual(t, res.Attachments[0].Subject, "Invoice", "wrong subject")
+
+	data, err := clientGet(ts.URL + "/api/v1/message/" + res.Attachments[0].MessageID + "/part/" + res.Attachments[0].PartID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "pdf", "wrong attachment content")
+
+	res = list("?start=1&limit=1")
+	assertEqual(t, len(res.Attachments), 1, "wrong number of paginated attachments")
+	assertEqual(t, res.Attachments[0].FileName, "invoice_2024_03.pdf", "wrong paginated attachment")
+}
+
+func TestAPIv1AttachmentsZip(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Reports").
+		HTML([]byte(`<p>Reports <img src="cid:logo@example.com"></p>`)).
+		AddInline([]byte("png"), "image/png", "", "logo@example.com").
+		AddAttachment([]byte("first"), "application/pdf", "report.pdf").
+		AddAttachment([]byte("second"), "application/pdf", "report.pdf").
+		AddAttachment([]byte("third"), "text/plain", "../notes.txt").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := func(uri string) map[string]string {
+		resp, err := http.Get(ts.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+		assertEqual(t, resp.Header.Get("Content-Disposition"), `attachment; filename="`+id+`.zip"`, "wrong Content-Disposition")
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := map[string]string{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			res[f.Name] = string(b)
+		}
+
+		return res
+	}
+
+	res := files("/api/v1/message/" + id + "/attachments.zip")
+	assertEqual(t, len(res), 3, "wrong number of files")
+	assertEqual(t, res["report.pdf"], "first", "wrong report.pdf content")
+	assertEqual(t, res["report-2.pdf"], "second", "wrong report-2.pdf content")
+	assertEqual(t, res[".._notes.txt"], "third", "wrong notes content")
+
+	res = files("/api/v1/message/latest/attachments.zip?inline=true")
+	assertEqual(t, len(res), 4, "wrong number of files including inline parts")
+	assertEqual(t, res["logo@example.com"], "png", "wrong inline part content")
+
+	insertEmailData(t)
+
+	resp, err := http.Get(ts.URL + "/api/v1/message/latest/attachments.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusNotFound, "expected a 404 for a message without attachments")
+}
+
+func TestAPIv1AttachmentChecksum(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Report").
+		Text([]byte("See attached")).
+		AddAttachment([]byte("golden"), "application/pdf", "report.pdf").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id + "/part/" + msg.Attachments[0].PartID + "/checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := storage.AttachmentChecksum{}
+	if err := json.Unmarshal(data, &checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, checksum.Size, float64(6), "wrong size")
+	assertEqual(t, checksum.MD5, fmt.Sprintf("%x", md5.Sum([]byte("golden"))), "wrong md5")
+	assertEqual(t, checksum.SHA1, fmt.Sprintf("%x", sha1.Sum([]byte("golden"))), "wrong sha1")
+	assertEqual(t, checksum.SHA256, fmt.Sprintf("%x", sha256.Sum256([]byte("golden"))), "wrong sha256")
+
+	for _, uri := range []string{"/api/v1/message/" + id + "/part/99/checksum", "/api/v1/message/missing/part/1/checksum"} {
+		resp, err := http.Get(ts.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assertEqual(t, resp.StatusCode, http.StatusNotFound, "expected a 404 for "+uri)
+	}
+}
+func TestAPIv1Calendar(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// quoted-printable invitation alternative with soft line breaks & a folded line, and an .ics attachment
+	raw := []byte(strings.ReplaceAll(`From: Organizer <organizer@example.com>
+To: Attendee <attendee@example.com>
+Subject: Invitation: Planning
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="mixed"
+
+--mixed
+Content-Type: multipart/alternative; boundary="alt"
+
+--alt
+Content-Type: text/plain; charset=utf-8
+
+You have been invited to Planning.
+--alt
+Content-Type: text/calendar; charset=utf-8; method=REQUEST
+Content-Transfer-Encoding: quoted-printable
+
+BEGIN:VCALENDAR
+METHOD:REQUEST
+BEGIN:VEVENT
+UID:planning-1
+SUMMARY:Plan=
+ning
+ORGANIZER;CN=3DOrganizer:mailto:organizer@example.com
+ATTENDEE;CN=3DAttendee;PARTSTAT=3DNEEDS-ACTION;RSVP=3DTRUE:mailto:attendee@
+ example.com
+DTSTART;TZID=3DEurope/Paris:20240115T140000
+DTEND;TZID=3DEurope/Paris:20240115T150000
+RRULE:FREQ=3DWEEKLY;COUNT=3D4
+END:VEVENT
+END:VCALENDAR
+--alt--
+--mixed
+Content-Type: application/ics; name="cancel.ics"
+Content-Disposition: attachment; filename="cancel.ics"
+
+BEGIN:VCALENDAR
+METHOD:CANCEL
+BEGIN:VEVENT
+UID:standup-1
+SUMMARY:Standup
+DTSTART:20240116T090000Z
+END:VEVENT
+END:VCALENDAR
+--mixed--
+`, "\n", "\r\n"))
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id + "/calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calendars := []calendar.Calendar{}
+	if err := json.Unmarshal(data, &calendars); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(calendars), 2, "wrong number of calendars")
+	assertEqual(t, calendars[0].Method, "REQUEST", "wrong method")
+	assertEqual(t, calendars[1].Method, "CANCEL", "wrong method")
+
+	e := calendars[0].Events[0]
+	assertEqual(t, e.Summary, "Planning", "wrong summary")
+	assertEqual(t, e.RRule, "FREQ=WEEKLY;COUNT=4", "wrong rrule")
+	assertEqual(t, e.Organizer.Email, "organizer@example.com", "wrong organizer")
+	assertEqual(t, e.Attendees[0].Email, "attendee@example.com", "wrong attendee")
+	assertEqual(t, e.Start.Format(time.RFC3339), "2024-01-15T14:00:00+01:00", "wrong start")
+	assertEqual(t, calendars[1].Events[0].Start.Format(time.RFC3339), "2024-01-16T09:00:00Z", "wrong start")
+
+	// latest
+	data, err = clientGet(ts.URL + "/api/v1/message/latest/calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &calendars); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(calendars), 2, "wrong number of calendars")
+
+	// malformed calendar
+	raw = []byte("From: sender@example.com\r\nSubject: Broken\r\nContent-Type: text/calendar\r\n\r\nBEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VCALENDAR\r\n")
+	id, err = storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest, "wrong status")
+	assertEqual(t, strings.Contains(string(body), "unexpected END:VCALENDAR"), true, "wrong error: "+string(body))
+
+	// no calendar
+	raw = []byte("From: sender@example.com\r\nSubject: Text\r\n\r\nHello\r\n")
+	id, err = storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/v1/message/" + id + "/calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest, "wrong status")
+}
+
+func TestAPIv1MessageHTML(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// the same image is referenced twice, using a different case to the Content-ID header
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Report\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=\"related\"\r\n\r\n" +
+		"--related\r\nContent-Type: text/html\r\n\r\n" +
+		"<img src=\"cid:Logo@Example.com\"><div style=\"background: url(cid:logo@example.com)\"></div><img src=\"cid:missing\">\r\n" +
+		"--related\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("png")) + "\r\n" +
+		"--related--\r\n")
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partID := msg.Inline[0].PartID
+
+	resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+	assertEqual(t, resp.Header.Get("Content-Type"), "text/html; charset=utf-8", "wrong Content-Type")
+	assertEqual(t, resp.Header.Get("Content-Security-Policy"), config.ContentSecurityPolicy, "wrong Content-Security-Policy")
+
+	link := ts.URL + "/api/v1/message/" + id + "/part/" + partID
+	assertEqual(t, string(body), "<img src=\""+link+"\"><div style=\"background: url("+link+")\"></div><img src=\"cid:missing\">", "wrong html")
+
+	data, err := clientGet(ts.URL + "/api/v1/message/latest/html?embed=datauri")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("png"))
+	assertEqual(t, string(data), "<img src=\""+uri+"\"><div style=\"background: url("+uri+")\"></div><img src=\"cid:missing\">", "wrong html")
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/" + id + "/html?embed=invalid"); err == nil {
+		t.Error("expected error for invalid embed value")
+	}
+}
+
+func TestAPIv1MessageParts(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// multipart/related nested inside multipart/alternative
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Nested\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n\r\n" +
+		"--mixed\r\nContent-Type: multipart/alternative; boundary=\"alt\"\r\n\r\n" +
+		"--alt\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nCaf=C3=A9\r\n" +
+		"--alt\r\nContent-Type: multipart/related; boundary=\"related\"\r\n\r\n" +
+		"--related\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<p>Hello <img src=\"cid:logo@example.com\"></p>\r\n" +
+		"--related\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("png")) + "\r\n" +
+		"--related--\r\n" +
+		"--alt--\r\n" +
+		"--mixed\r\nContent-Type: text/csv; name=\"data.csv\"\r\nContent-Disposition: attachment; filename=\"data.csv\"\r\n\r\na,b\r\n" +
+		"--mixed--\r\n")
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id + "/parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := apiv1.MessagePartsResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(res.Warnings), 0, "unexpected warnings")
+	assertEqual(t, res.Root.ContentType, "multipart/mixed", "wrong root content type")
+	assertEqual(t, len(res.Root.Children), 2, "wrong number of root children")
+
+	alt := res.Root.Children[0]
+	assertEqual(t, alt.ContentType, "multipart/alternative", "wrong content type")
+	assertEqual(t, alt.Children[0].TransferEncoding, "quoted-printable", "wrong transfer encoding")
+	assertEqual(t, alt.Children[0].Charset, "utf-8", "wrong charset")
+
+	related := alt.Children[1]
+	assertEqual(t, related.ContentType, "multipart/related", "wrong content type")
+	assertEqual(t, len(related.Children), 2, "wrong number of related children")
+	assertEqual(t, related.Children[1].ContentID, "logo@example.com", "wrong Content-ID")
+	assertEqual(t, related.Children[1].Size, float64(3), "wrong size")
+
+	csv := res.Root.Children[1]
+	assertEqual(t, csv.FileName, "data.csv", "wrong file name")
+	assertEqual(t, csv.Disposition, "attachment", "wrong disposition")
+
+	// any leaf part can be downloaded using its part ID
+	html := related.Children[0]
+	data, err = clientGet(ts.URL + "/api/v1/message/" + id + "/part/" + html.PartID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "<p>Hello <img src=\"cid:logo@example.com\"></p>", "wrong html part content")
+
+	data, err = clientGet(ts.URL + "/api/v1/message/" + id + "/part/" + related.Children[1].PartID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "png", "wrong inline part content")
+
+	// malformed message with a missing closing boundary & invalid base64
+	raw = []byte("From: sender@example.com\r\nSubject: Broken\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n\r\n" +
+		"--mixed\r\nContent-Type: text/plain\r\n\r\nHello\r\n" +
+		"--mixed\r\nContent-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\n!!not base64!!\r\n")
+
+	id, err = storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = clientGet(ts.URL + "/api/v1/message/latest/parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = apiv1.MessagePartsResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(res.Root.Children), 2, "wrong number of recovered parts")
+	if len(res.Warnings) == 0 {
+		t.Error("expected warnings for a malformed message")
+	}
+}
+
+func TestAPIv1OrderedHeaders(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("Received: from relay2.example.com by mx.example.net\r\n" +
+		"Received: from relay1.example.com\r\n by relay2.example.com\r\n" +
+		"From: sender@example.com\r\nx-trace-ID: abc\r\nSubject: =?ISO-8859-1?Q?Caf=E9?= chain\r\n\r\nHello\r\n")
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the default map format groups repeated headers
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id + "/headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string][]string{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(m["Received"]), 2, "wrong number of Received headers")
+	assertEqual(t, len(m["X-Trace-Id"]), 1, "expected a canonical header name")
+
+	data, err = clientGet(ts.URL + "/api/v1/message/" + id + "/headers?format=ordered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := []tools.MessageHeader{}
+	if err := json.Unmarshal(data, &headers); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(headers), 5, "wrong number of headers")
+	assertEqual(t, headers[0].Value, "from relay2.example.com by mx.example.net", "wrong header order")
+	assertEqual(t, headers[1].Value, "from relay1.example.com by relay2.example.com", "wrong unfolded value")
+	assertEqual(t, headers[1].Raw, "Received: from relay1.example.com\r\n by relay2.example.com", "wrong raw header")
+	assertEqual(t, headers[3].Name, "x-trace-ID", "header name case was not preserved")
+
+	assertEqual(t, headers[4].Value, "=?ISO-8859-1?Q?Caf=E9?= chain", "header should not be decoded")
+
+	data, err = clientGet(ts.URL + "/api/v1/message/" + id + "/headers?format=ordered&decode=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &headers); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, headers[4].Value, "Café chain", "wrong decoded header")
+	assertEqual(t, headers[4].Raw, "Subject: =?ISO-8859-1?Q?Caf=E9?= chain", "raw header should not be decoded")
+
+	data, err = clientGet(ts.URL + "/api/v1/message/" + id + "/headers?decode=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, m["Subject"][0], "Café chain", "wrong decoded header")
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/" + id + "/headers?format=invalid"); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
+
+func TestAPIv1MessageEnvelope(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nTo: to@example.com\r\nSubject: Bcc test\r\n\r\nHello\r\n")
+
+	id, err := storage.StoreWithOptions(&raw, storage.StoreOptions{
+		Via:           storage.ViaSMTP,
+		Authenticated: true,
+		From:          "bounces@example.com",
+		To:            []string{"to@example.com", "bcc@example.com"},
+		ClientIP:      "127.0.0.1",
+		Helo:          "client.example.com",
+		AuthUser:      "billing-service",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msgID := range []string{id, "latest"} {
+		data, err := clientGet(ts.URL + "/api/v1/message/" + msgID + "/envelope")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := storage.MessageEnvelope{}
+		if err := json.Unmarshal(data, &e); err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, e.ID, id, "wrong message ID")
+		assertEqual(t, e.From, "bounces@example.com", "wrong envelope sender")
+		assertEqual(t, strings.Join(e.To, ","), "to@example.com,bcc@example.com", "wrong envelope recipients")
+		assertEqual(t, e.ClientIP, "127.0.0.1", "wrong client IP")
+		assertEqual(t, e.Helo, "client.example.com", "wrong HELO")
+		assertEqual(t, e.Authenticated, true, "wrong authenticated")
+		assertEqual(t, e.AuthUser, "billing-service", "wrong AUTH username")
+	}
+
+	t.Log("Server info")
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := storage.Message{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.ServerInfo, storage.ServerInfo{ClientIP: "127.0.0.1", Helo: "client.example.com", AuthUser: "billing-service"}, "wrong server info")
+
+	unauthID, err := storage.StoreWithOptions(&raw, storage.StoreOptions{Via: storage.ViaSMTP, ClientIP: "127.0.0.2", Helo: "other.example.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = clientGet(ts.URL + "/api/v1/message/" + unauthID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"ServerInfo":{"ClientIP":"127.0.0.2","Helo":"other.example.net","AuthUser":""}`) {
+		t.Errorf("expected empty AUTH username in server info: %s", data)
+	}
+
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "auth:billing", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "-auth:billing", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "helo:example.net", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "helo:example", 2)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "auth:billing helo:other.example.net", 0)
+
+	if _, _, err := storage.DeleteMessages([]string{unauthID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/missing/envelope"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+
+	// envelope recipients are only included in summaries when requested
+	data, err = clientGet(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "EnvelopeTo") {
+		t.Error("unexpected envelope recipients in summary")
+	}
+
+	for _, u := range []string{"/api/v1/messages?envelope=true", "/api/v1/search?query=bcc&envelope=1", "/api/v1/messages?fields=ID,EnvelopeTo"} {
+		data, err := clientGet(ts.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := apiv1.MessagesSummary{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, len(res.Messages), 1, "wrong number of messages")
+		assertEqual(t, strings.Join(res.Messages[0].EnvelopeTo, ","), "to@example.com,bcc@example.com", "wrong summary envelope recipients")
+	}
+}
+
+func TestAPIv1Thumbnail(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// a 400x100 red PNG
+	pngImg := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	draw.Draw(pngImg, pngImg.Bounds(), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.Point{}, draw.Src)
+	pngData := new(bytes.Buffer)
+	if err := png.Encode(pngData, pngImg); err != nil {
+		t.Fatal(err)
+	}
+
+	// an animated GIF with a blue first frame & a green second frame
+	palette := color.Palette{color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255}}
+	anim := &gif.GIF{}
+	for i := 0; i < 2; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 200, 200), palette)
+		draw.Draw(frame, frame.Bounds(), &image.Uniform{palette[i]}, image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	gifData := new(bytes.Buffer)
+	if err := gif.EncodeAll(gifData, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Images").
+		Text([]byte("Images")).
+		AddAttachment(pngData.Bytes(), "image/png", "wide.png").
+		AddAttachment(gifData.Bytes(), "image/gif", "animated.gif").
+		AddAttachment([]byte("not an image"), "image/png", "corrupt.png").
+		AddAttachment([]byte("pdf"), "application/pdf", "document.pdf").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := map[string]string{}
+	for _, a := range msg.Attachments {
+		parts[a.FileName] = a.PartID
+	}
+
+	thumb := func(name, query string) (int, string, image.Image) {
+		resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/part/" + parts[name] + "/thumb" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, string(data), nil
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, "", img
+	}
+
+	// images are resized to fit by default
+	_, _, img := thumb("wide.png", "")
+	assertEqual(t, img.Bounds().Dx(), 180, "wrong fitted thumbnail width")
+	assertEqual(t, img.Bounds().Dy(), 45, "wrong fitted thumbnail height")
+
+	// cached
+	_, _, img = thumb("wide.png", "")
+	assertEqual(t, img.Bounds().Dy(), 45, "wrong cached thumbnail height")
+
+	_, _, img = thumb("wide.png", "?fit=false")
+	assertEqual(t, img.Bounds().Dx(), 180, "wrong cropped thumbnail width")
+	assertEqual(t, img.Bounds().Dy(), 120, "wrong cropped thumbnail height")
+
+	// only the first frame of an animated image is used
+	_, _, img = thumb("animated.gif", "?fit=false")
+	red, green, blue, _ := img.At(90, 60).RGBA()
+	if blue>>8 < 200 || green>>8 > 50 || red>>8 > 50 {
+		t.Errorf("expected a blue thumbnail from the first frame, got %d,%d,%d", red>>8, green>>8, blue>>8)
+	}
+
+	status, body, _ := thumb("corrupt.png", "")
+	assertEqual(t, status, http.StatusBadRequest, "expected a 400 for a corrupt image")
+	if !strings.Contains(body, "unable to create thumbnail") {
+		t.Errorf("expected a useful error message, got %s", body)
+	}
+
+	status, _, _ = thumb("corrupt.png", "?placeholder=true")
+	assertEqual(t, status, http.StatusOK, "expected a placeholder for a corrupt image")
+
+	status, _, _ = thumb("document.pdf", "")
+	assertEqual(t, status, http.StatusNotFound, "expected a 404 for a non-image")
+
+	status, _, img = thumb("document.pdf", "?placeholder=true")
+	assertEqual(t, status, http.StatusOK, "expected a placeholder for a non-image")
+	assertEqual(t, img.Bounds().Dx(), 180, "wrong placeholder width")
+}
+
+func TestAPIv1RangeRequests(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	env, err := enmime.Builder().
+		From("Sender", "sender@example.com").
+		To("Recipient", "recipient@example.com").
+		Subject("Video").
+		Text([]byte("Video")).
+		AddAttachment(content, "video/mp4", "video.mp4").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := env.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := buf.Bytes()
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(uri string, headers map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", ts.URL+uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, string(data)
+	}
+
+	part := "/api/v1/message/" + id + "/part/" + msg.Attachments[0].PartID
+
+	resp, body := get(part, map[string]string{"Range": "bytes=10-19"})
+	assertEqual(t, resp.StatusCode, http.StatusPartialContent, "expected a partial response")
+	assertEqual(t, body, "abcdefghij", "wrong partial content")
+	assertEqual(t, resp.Header.Get("Content-Range"), fmt.Sprintf("bytes 10-19/%d", len(content)), "wrong Content-Range")
+	assertEqual(t, resp.Header.Get("Content-Disposition"), `filename="video.mp4"`, "wrong Content-Disposition")
+	assertEqual(t, resp.Header.Get("Content-Type"), "video/mp4", "wrong Content-Type")
+
+	resp, body = get(part, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+	assertEqual(t, body, string(content), "wrong content")
+	assertEqual(t, resp.Header.Get("Accept-Ranges"), "bytes", "wrong Accept-Ranges")
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") == "" {
+		t.Fatal("expected ETag & Last-Modified headers")
+	}
+
+	resp, _ = get(part, map[string]string{"If-None-Match": etag})
+	assertEqual(t, resp.StatusCode, http.StatusNotModified, "expected a not modified response")
+
+	// the full content is returned if the If-Range does not match
+	resp, body = get(part, map[string]string{"Range": "bytes=0-9", "If-Range": `"other"`})
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+	assertEqual(t, body, string(content), "wrong content")
+
+	resp, body = get("/api/v1/message/"+id+"/raw?dl=1", map[string]string{"Range": "bytes=0-4"})
+	assertEqual(t, resp.StatusCode, http.StatusPartialContent, "expected a partial response")
+	assertEqual(t, body, string(raw[0:5]), "wrong partial raw content")
+	assertEqual(t, resp.Header.Get("Content-Disposition"), `attachment; filename="`+id+`.eml"`, "wrong Content-Disposition")
+
+	resp, body = get("/api/v1/message/"+id+"/raw", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK, "wrong status")
+	assertEqual(t, body, string(raw), "wrong raw content")
+	assertEqual(t, resp.Header.Get("Content-Disposition"), "", "unexpected Content-Disposition")
+
+	resp, _ = get("/api/v1/message/"+id+"/raw", map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)})
+	assertEqual(t, resp.StatusCode, http.StatusNotModified, "expected a not modified response")
+}
+
+func TestAPIv1Settings(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	maxMessages, retries := config.MaxMessages, config.WebhookRetries
+	maxConnections, maxConnectionsPerIP := config.SMTPMaxConnections, config.SMTPMaxConnectionsPerIP
+	defer func() {
+		config.MaxMessages, config.WebhookRetries = maxMessages, retries
+		config.SMTPMaxConnections, config.SMTPMaxConnectionsPerIP = maxConnections, maxConnectionsPerIP
+		config.SMTPAllowedRecipients, config.SMTPAllowedRecipientsRegexp = "", nil
+		config.ConnectionLimitsChanged = nil
+	}()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	patch := func(body string) (int, map[string]interface{}) {
+		req, err := http.NewRequest("PATCH", ts.URL+"/api/v1/settings", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		settings := map[string]interface{}{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return resp.StatusCode, settings
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Contains(strings.ToLower(string(data)), "password"), false, "settings leak secrets")
+
+	status, settings := patch(`{"max-messages": 25, "smtp-allowed-recipients": "@example\\.com$"}`)
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, settings["max-messages"], float64(25), "wrong max-messages")
+	assertEqual(t, config.MaxMessages, 25, "max-messages not applied")
+	assertEqual(t, config.SMTPAllowedRecipientsRegexp.MatchString("user@example.com"), true, "regexp not applied")
+
+	t.Log("Unknown setting")
+	status, _ = patch(`{"max-messages": 10, "smtp-relay-config": {"password": "secret"}}`)
+	assertEqual(t, status, http.StatusBadRequest, "wrong status")
+	assertEqual(t, config.MaxMessages, 25, "changes applied despite an error")
+
+	t.Log("Connection limits")
+	limits := []int{}
+	config.ConnectionLimitsChanged = func(max, perIP int) { limits = []int{max, perIP} }
+	status, settings = patch(`{"smtp-max-connections": 50, "smtp-max-connections-per-ip": 5}`)
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, settings["smtp-max-connections-per-ip"], float64(5), "wrong smtp-max-connections-per-ip")
+	assertEqual(t, fmt.Sprint(limits), "[50 5]", "connection limits not applied to the SMTP server")
+
+	t.Log("Invalid values")
+	for _, body := range []string{`{"max-messages": -1}`, `{"max-messages": "10"}`, `{"webhook-retries": 1.5}`, `{"smtp-max-connections": -1}`,
+		`{"smtp-allowed-recipients": "("}`, `{"smtp-relay-all": true}`, `{"prune-attachments-after": "soon"}`, `{}`} {
+		status, _ = patch(body)
+		assertEqual(t, status, http.StatusBadRequest, "wrong status for "+body)
+	}
+}
+
+func TestAPIv1ProfileRoundTrip(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	maxMessages := config.MaxMessages
+	defer func() {
+		config.MaxMessages = maxMessages
+		config.SMTPAllowedRecipients, config.SMTPAllowedRecipientsRegexp = "", nil
+	}()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	if _, err := clientPatch(ts.URL+"/api/v1/settings", `{"max-messages": 25, "smtp-allowed-recipients": "@example\\.com$"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storage.SetTagMeta("Alerts", "#1E90FF", "Alert messages"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.AddTagRule("subject:alert", []string{"Alerts"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.AddTagRule("from:ci@example.com", []string{"CI", "Builds"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.AddForwardRule(storage.ForwardRule{Query: "tag:Alerts", To: []string{"oncall@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := clientGet(ts.URL + "/api/v1/profile/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := storage.Profile{}
+	if err := json.Unmarshal(exported, &profile); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, profile.Settings["max-messages"], float64(25), "wrong exported max-messages")
+	assertEqual(t, len(profile.TagMeta), 1, "wrong number of exported tag metadata")
+	assertEqual(t, profile.TagMeta[0].Color, "#1e90ff", "wrong exported tag color")
+	assertEqual(t, len(profile.TagRules), 2, "wrong number of exported tag rules")
+	assertEqual(t, profile.TagRules[1].Query, "from:ci@example.com", "wrong exported tag rule order")
+	assertEqual(t, len(profile.ForwardRules), 1, "wrong number of exported forwarding rules")
+	assertEqual(t, profile.ForwardRules[0].To[0], "oncall@example.com", "wrong exported forwarding rule")
+
+	t.Log("Wipe")
+	if _, err := clientPost(ts.URL+"/api/v1/profile/import?mode=replace", `{"Version": 1, "Settings": {}, "TagMeta": [], "TagRules": [], "ForwardRules": []}`); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, config.MaxMessages, maxMessages, "max-messages not reset")
+	assertEqual(t, config.SMTPAllowedRecipientsRegexp == nil, true, "smtp-allowed-recipients not reset")
+
+	wiped, err := clientGet(ts.URL + "/api/v1/profile/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(wiped), `{"Version":1,"Settings":{},"TagMeta":[],"TagRules":[],"ForwardRules":[]}`, "profile not wiped")
+
+	t.Log("Import")
+	for i := 0; i < 2; i++ {
+		data, err := clientPost(ts.URL+"/api/v1/profile/import", string(exported))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := apiv1.ProfileImportResult{}
+		if err := json.Unmarshal(data, &result); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, result.Mode, "merge", "wrong mode")
+		assertEqual(t, len(result.Sections), 4, "wrong number of sections")
+		for j, expected := range []int{1, 2, 1, 2} {
+			assertEqual(t, result.Sections[j].Applied, expected, "wrong number of applied "+result.Sections[j].Section)
+			assertEqual(t, result.Sections[j].Error, "", "unexpected error")
+		}
+	}
+	assertEqual(t, config.MaxMessages, 25, "max-messages not imported")
+
+	rules, err := storage.GetTagRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(rules), 2, "tag rules imported more than once")
+
+	reexported, err := clientGet(ts.URL + "/api/v1/profile/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(reexported), string(exported), "profile changed after round trip")
+
+	t.Log("Invalid sections")
+	data, err := clientPost(ts.URL+"/api/v1/profile/import", `{"Version": 1, "Settings": {"max-messages": 10, "webhook-retries": -1}, "Unknown": []}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := apiv1.ProfileImportResult{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(result.Sections), 2, "wrong number of sections")
+	assertEqual(t, result.Sections[0].Section, "Settings", "wrong section")
+	assertEqual(t, result.Sections[0].Error != "", true, "expected a settings error")
+	assertEqual(t, result.Sections[1].Error, "unknown section", "expected an unknown section error")
+	assertEqual(t, config.MaxMessages, 25, "invalid settings section partially applied")
+
+	data, err = clientPost(ts.URL+"/api/v1/profile/import?mode=replace", `{"Version": 1, "TagRules": [{"Query": "subject:new", "Tags": ["New"]}, {"Query": "", "Tags": ["Empty"]}], "TagMeta": [{"Tag": "Alerts", "Color": "blue"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result = apiv1.ProfileImportResult{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, result.Sections[0].Section, "TagMeta", "wrong section")
+	assertEqual(t, result.Sections[0].Error != "", true, "expected a tag metadata error")
+	assertEqual(t, result.Sections[1].Error != "", true, "expected a tag rules error")
+
+	reexported, err = clientGet(ts.URL + "/api/v1/profile/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(reexported), string(exported), "invalid sections partially applied")
+
+	for _, body := range []string{`{"Settings": {}}`, `{"Version": 99}`, `[]`} {
+		if _, err := clientPost(ts.URL+"/api/v1/profile/import", body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+
+	if _, err := clientPost(ts.URL+"/api/v1/profile/import?mode=overwrite", string(exported)); err == nil {
+		t.Error("expected an error for an invalid mode")
+	}
+}
+
+func TestAPIv1MessageEvents(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Events\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.MarkRead(id); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/message/" + id + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []storage.MessageEvent{}
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(events), 2, "wrong number of events")
+	assertEqual(t, events[0].Type, storage.EventReceived, "wrong first event")
+	assertEqual(t, events[1].Type, storage.EventRead, "wrong second event")
+
+	t.Log("Missing message")
+	resp, err := http.Get(ts.URL + "/api/v1/message/missing/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusNotFound, "wrong status")
+}
+
+func TestAPIv1MessageThread(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	original := []byte("From: from@example.com\r\nTo: to@example.com\r\nSubject: Question\r\nMessage-ID: <q@example.com>\r\n\r\nbody\r\n")
+	reply := []byte("From: to@example.com\r\nTo: from@example.com\r\nSubject: Re: Question\r\nMessage-ID: <r@example.com>\r\n" +
+		"In-Reply-To: <q@example.com>\r\nReferences: <q@example.com>\r\n\r\nbody\r\n")
+
+	if _, err := storage.Store(&original); err != nil {
+		t.Fatal(err)
+	}
+	insertEmailData(t)
+	if _, err := storage.Store(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clientGet(ts.URL + "/api/v1/message/latest/thread")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread := []storage.MessageSummary{}
+	if err := json.Unmarshal(data, &thread); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(thread), 2, "wrong number of thread messages")
+	assertEqual(t, thread[0].Subject, "Question", "wrong thread order")
+	assertEqual(t, thread[1].Subject, "Re: Question", "wrong thread order")
+
+	resp, err := http.Get(ts.URL + "/api/v1/message/does-not-exist/thread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusNotFound, "wrong status")
+}
+
+func TestAPIv1AdjacentMessages(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages?limit=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adjacent := func(id, query string) map[string]interface{} {
+		data, err := clientGet(ts.URL + "/api/v1/message/" + id + "/adjacent" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := map[string]interface{}{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	res := adjacent("latest", "")
+	assertEqual(t, res["previous"], nil, "expected a null previous message")
+	assertEqual(t, res["next"], m.Messages[1].ID, "wrong next message")
+
+	res = adjacent(m.Messages[1].ID, "")
+	assertEqual(t, res["previous"], m.Messages[0].ID, "wrong previous message")
+	assertEqual(t, res["next"], m.Messages[2].ID, "wrong next message")
+
+	res = adjacent(m.Messages[0].ID, "?query="+url.QueryEscape("from:from-99@example.com"))
+	assertEqual(t, res["previous"], nil, "expected a null previous message")
+	assertEqual(t, res["next"], nil, "expected a null next message")
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/" + m.Messages[0].ID + "/adjacent?query=larger:big"); err == nil {
+		t.Error("expected an error for an invalid search")
+	}
+}
+
+func TestAPIv1LatestMessageID(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/messages/latest-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusNotFound, "expected a 404 for an empty mailbox")
+
+	insertEmailData(t)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages?limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest := func(query string) apiv1.LatestMessageIDResult {
+		data, err := clientGet(ts.URL + "/api/v1/messages/latest-id" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := apiv1.LatestMessageIDResult{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	res := latest("")
+	assertEqual(t, res.ID, m.Messages[0].ID, "wrong latest message ID")
+	assertEqual(t, res.Created.Equal(m.Messages[0].Created), true, "wrong latest message created time")
+
+	s, err := fetchMessages(ts.URL + "/api/v1/search?query=" + url.QueryEscape("from:from-5@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(s.Messages), 1, "wrong number of search results")
+
+	res = latest("?query=" + url.QueryEscape("from:from-5@example.com"))
+	assertEqual(t, res.ID, s.Messages[0].ID, "wrong latest search message ID")
+
+	resp, err = http.Get(ts.URL + "/api/v1/messages/latest-id?query=" + url.QueryEscape("from:nobody@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusNotFound, "expected a 404 for a search without results")
+}
+
+func TestAPIv1WaitForMessage(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	store := func(from string) string {
+		env, err := enmime.Builder().
+			From("Sender", from).
+			Subject("Wait test").
+			Text([]byte("Test")).
+			To("Recipient", "to@example.com").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := env.Encode(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		b := buf.Bytes()
+		id, err := storage.Store(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return id
+	}
+
+	type result struct {
+		status int
+		id     string
+	}
+
+	wait := func(query, timeout string) result {
+		resp, err := http.Get(ts.URL + "/api/v1/messages/wait?timeout=" + timeout + "&query=" + url.QueryEscape(query))
+		if err != nil {
+			t.Error(err)
+			return result{}
+		}
+		defer resp.Body.Close()
+
+		m := storage.MessageSummary{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+				t.Error(err)
+			}
+		}
+
+		return result{resp.StatusCode, m.ID}
+	}
+
+	// no matching message before the timeout
+	res := wait("from:waiting@example.com", "500ms")
+	assertEqual(t, res.status, http.StatusNoContent, "expected a 204 after the timeout")
+
+	// concurrent waiters are released when a matching message arrives, a non-matching message is ignored
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- wait("from:waiting@example.com", "10s") }()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	store("other@example.com")
+	id := store("waiting@example.com")
+
+	for i := 0; i < 2; i++ {
+		res := <-results
+		assertEqual(t, res.status, http.StatusOK, "wrong status")
+		assertEqual(t, res.id, id, "wrong message returned")
+	}
+
+	// an existing message is returned immediately
+	res = wait("from:waiting@example.com", "10s")
+	assertEqual(t, res.status, http.StatusOK, "wrong status")
+	assertEqual(t, res.id, id, "wrong message returned")
+
+	resp, err := http.Get(ts.URL + "/api/v1/messages/wait?timeout=invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest, "expected a 400 for an invalid timeout")
+}
+
+func TestAPIv1SummaryFields(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+
+	get := func(uri string) map[string]interface{} {
+		data, err := clientGet(ts.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := map[string]interface{}{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	for _, uri := range []string{
+		"/api/v1/messages?limit=5&fields=ID,subject,%20From,Created,Read,ID",
+		"/api/v1/search?limit=5&query=" + url.QueryEscape("from:example.com") + "&fields=ID,subject,%20From,Created,Read,ID",
+	} {
+		res := get(uri)
+		assertEqual(t, res["total"], float64(100), "wrong total")
+
+		messages := res["messages"].([]interface{})
+		assertEqual(t, len(messages), 5, "wrong number of messages")
+
+		m := messages[0].(map[string]interface{})
+		assertEqual(t, len(m), 5, "wrong number of fields")
+		for _, f := range []string{"ID", "Subject", "From", "Created", "Read"} {
+			if _, ok := m[f]; !ok {
+				t.Errorf("expected field %s in %s", f, uri)
+			}
+		}
+		assertEqual(t, m["Subject"], "Subject line 99 end", "wrong subject")
+	}
+
+	// the default response contains all fields
+	m := get("/api/v1/messages?limit=1")["messages"].([]interface{})[0].(map[string]interface{})
+	if _, ok := m["To"]; !ok {
+		t.Error("expected all fields without fields set")
+	}
+
+	resp, err := http.Get(ts.URL + "/api/v1/messages?fields=ID,Nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest, "expected a 400 for an invalid field")
+	if !strings.Contains(string(data), `"Nope"`) {
+		t.Errorf("expected the invalid field in the error, got %s", string(data))
+	}
+
+	// the swagger documentation lists all valid fields
+	_, valid, _ := strings.Cut(strings.TrimSpace(string(data)), "valid fields are: ")
+	src, err := os.ReadFile(filepath.Join("apiv1", "api.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := regexp.MustCompile(`Valid fields are (.*)\.`).FindAllStringSubmatch(string(src), -1)
+	assertEqual(t, len(documented), 2, "wrong number of documented fields parameters")
+	for _, d := range documented {
+		assertEqual(t, strings.Replace(d[1], " & ", ", ", 1), valid, "documented fields differ")
+	}
+}
+
+func TestAPIv1MessagePeek(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	insertEmailData(t)
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
+
+	getMessage := func(uri string) storage.Message {
+		data, err := clientGet(ts.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := storage.Message{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		return msg
+	}
+
+	for _, uri := range []string{"/api/v1/message/latest?mark_read=false", "/api/v1/message/latest?mark_read=0"} {
+		msg := getMessage(uri)
+		assertEqual(t, msg.Subject, "Subject line 99 end", "wrong message")
+		assertEqual(t, msg.FirstOpened == nil, true, "peeking set the first opened time")
+		assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
+	}
+
+	msg := getMessage("/api/v1/message/" + getMessage("/api/v1/message/latest?mark_read=false").ID + "?mark_read=false")
+	assertEqual(t, msg.Subject, "Subject line 99 end", "wrong message")
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 100, 100)
+
+	t.Log("Messages are marked as read by default")
+	for _, uri := range []string{"/api/v1/message/latest", "/api/v1/message/latest?mark_read=true"} {
+		msg := getMessage(uri)
+		assertEqual(t, msg.FirstOpened != nil, true, "first opened time not set")
+		assertStatsEqual(t, ts.URL+"/api/v1/messages", 99, 100)
+	}
+}
+
+func TestAPIv1MessageByMessageID(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, messageID := range []string{"unique@example.com", "dup/licate@example.com", "dup/licate@example.com"} {
+		raw := []byte("Message-ID: <" + messageID + ">\r\nFrom: sender@example.com\r\nTo: recipient@example.com\r\nSubject: " +
+			messageID + "\r\n\r\nBody\r\n")
+		if _, err := storage.Store(&raw); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+	t.Log("Unique Message-ID with angle brackets")
+	data, err := clientGet(ts.URL + "/api/v1/message-id/" + url.PathEscape("<unique@example.com>"))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	summary := storage.MessageSummary{}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Errorf(err.Error())
+	}
+	assertEqual(t, summary.MessageID, "unique@example.com", "wrong message returned")
+
+	t.Log("Duplicate Message-ID")
+	data, err = clientGet(ts.URL + "/api/v1/message-id/" + url.PathEscape("dup/licate@example.com"))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	summaries := []storage.MessageSummary{}
+	if err := json.Unmarshal(data, &summaries); err != nil {
+		t.Errorf(err.Error())
+	}
+	assertEqual(t, len(summaries), 2, "wrong number of messages returned")
+
+	t.Log("Unknown Message-ID")
+	if _, err := clientGet(ts.URL + "/api/v1/message-id/" + url.PathEscape("missing@example.com")); err == nil {
+		t.Error("expected 404 for unknown Message-ID")
+	}
+}
+
+func TestAPIv1InstanceLabel(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Log("No instance label")
+	resp, err := http.Get(ts.URL + "/api/v1/webui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.Header.Get("X-Mailpit-Instance"), "", "expected no instance header")
+
+	t.Log("Instance label")
+	config.Label = "staging-eu"
+	defer func() { config.Label = "" }()
+
+	resp, err = http.Get(ts.URL + "/api/v1/webui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assertEqual(t, resp.Header.Get("X-Mailpit-Instance"), "staging-eu", "wrong instance header")
+
+	conf := struct{ Label string }{}
+	if err := json.NewDecoder(resp.Body).Decode(&conf); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, conf.Label, "staging-eu", "wrong instance label")
+}
+
+func TestAPIv1ReleaseFromOverride(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	type relayed struct {
+		from string
+		data string
+	}
+
+	received := make(chan relayed, 1)
+	relay := &smtpd.Server{
+		Appname:           "Relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, from string, _ []string, data []byte) error {
+			received <- relayed{from, string(data)}
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	defer func() { config.SMTPRelayConfig = origRelayConfig }()
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	raw := []byte("From: Original <original@example.com>\r\nSender: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Release\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseURL := ts.URL + "/api/v1/message/" + id + "/release"
+
+	assertRelayed := func(from, header string) {
+		select {
+		case m := <-received:
+			assertEqual(t, m.from, from, "wrong envelope sender")
+			msg, err := mail.ReadMessage(strings.NewReader(m.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, msg.Header.Get("From"), header, "wrong From header")
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not relayed")
+		}
+	}
+
+	t.Log("Default sender")
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"]}`); err != nil {
+		t.Fatal(err)
+	}
+	assertRelayed("sender@example.com", "Original <original@example.com>")
+
+	t.Log("From override")
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"from":"QA <qa@example.net>"}`); err != nil {
+		t.Fatal(err)
+	}
+	assertRelayed("qa@example.net", `"QA" <qa@example.net>`)
+
+	t.Log("From override with Return-Path")
+	config.SMTPRelayConfig.ReturnPath = "bounces@example.net"
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"from":"qa@example.net"}`); err != nil {
+		t.Fatal(err)
+	}
+	assertRelayed("bounces@example.net", "<qa@example.net>")
+	config.SMTPRelayConfig.ReturnPath = ""
+
+	t.Log("Invalid From override")
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"from":"not an address"}`); err == nil {
+		t.Error("expected an error for an invalid From address")
+	}
+
+	t.Log("From override not matching allowed senders")
+	config.SMTPRelayConfig.AllowedSendersRegexp = regexp.MustCompile(`@example\.org$`)
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"from":"qa@example.net"}`); err == nil {
+		t.Error("expected an error for a From address not matching allowed senders")
+	}
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"from":"qa@example.org"}`); err != nil {
+		t.Fatal(err)
+	}
+	assertRelayed("qa@example.org", "<qa@example.org>")
+	config.SMTPRelayConfig.AllowedSendersRegexp = nil
+
+	t.Log("Subject override")
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"from":"qa@example.net","subject":"[TEST] Release ✓"}`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		msg, err := mail.ReadMessage(strings.NewReader(m.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, msg.Header.Get("Subject"), "=?utf-8?q?[TEST]_Release_=E2=9C=93?=", "wrong Subject header")
+		assertEqual(t, msg.Header.Get("From"), "<qa@example.net>", "wrong From header")
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not relayed")
+	}
+
+	t.Log("Invalid Subject override")
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"subject":"Test\r\nBcc: victim@example.com"}`); err == nil {
+		t.Error("expected an error for a multi-line Subject")
+	}
+
+	t.Log("Stored message is not modified")
+	stored, err := storage.GetMessageRaw(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(stored), string(raw), "stored message was modified")
+}
+
+func TestAPIv1ReleaseDryRun(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var relayed int32
+	relay := &smtpd.Server{
+		Appname:           "Relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, _ []string, _ []byte) error {
+			atomic.AddInt32(&relayed, 1)
+			return nil
+		},
+		HandlerRcpt: func(_ net.Addr, _ string, to string) error {
+			if to == "rejected@example.com" {
+				return errors.New("550 5.1.1 Mailbox unavailable")
+			}
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	origReleaseEnabled := config.ReleaseEnabled
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		config.ReleaseEnabled = origReleaseEnabled
+	}()
+	config.ReleaseEnabled = true
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{
+		Name:                    config.DefaultRelayProfile,
+		Host:                    "127.0.0.1",
+		Port:                    ln.Addr().(*net.TCPAddr).Port,
+		AllowedRecipients:       `@example\.com$`,
+		AllowedRecipientsRegexp: regexp.MustCompile(`@example\.com$`),
+	}
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Release\r\nMessage-Id: <original@example.com>\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := storage.GetMessageEvents(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseURL := ts.URL + "/api/v1/message/" + id + "/release"
+
+	dryRun := func(body string) apiv1.ReleaseDryRunResult {
+		b, err := clientPost(releaseURL, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := apiv1.ReleaseDryRunResult{}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	t.Log("Validation")
+	res := dryRun(`{"to":["one@example.com","other@example.net"],"from":"QA <qa@example.com>","subject":"Test","dry_run":true}`)
+	assertEqual(t, res.OK, false, "dry run should fail")
+	assertEqual(t, res.Error, "", "unexpected error")
+	assertEqual(t, res.Profile, config.DefaultRelayProfile, "wrong profile")
+	assertEqual(t, res.From, "qa@example.com", "wrong envelope sender")
+	assertEqual(t, res.FromHeader, `"QA" <qa@example.com>`, "wrong From header")
+	assertEqual(t, res.Subject, "Test", "wrong Subject")
+	assertEqual(t, res.Probed, false, "should not be probed")
+	if res.MessageID == "" || res.MessageID == "original@example.com" {
+		t.Errorf("Message-Id not rewritten: %s", res.MessageID)
+	}
+	assertEqual(t, len(res.Recipients), 2, "wrong number of recipients")
+	assertEqual(t, res.Recipients[0].Accepted, true, "recipient should be accepted")
+	assertEqual(t, res.Recipients[1].Accepted, false, "recipient should be rejected")
+	assertEqual(t, res.Recipients[1].Error, "Mail address does not match allowlist: other@example.net", "wrong recipient error")
+
+	t.Log("Invalid override")
+	res = dryRun(`{"to":["one@example.com"],"from":"not an address","dry_run":true}`)
+	assertEqual(t, res.OK, false, "dry run should fail")
+	if res.Error == "" {
+		t.Error("expected an error for an invalid From address")
+	}
+
+	t.Log("SMTP probe")
+	res = dryRun(`{"to":["one@example.com","rejected@example.com"],"dry_run":true,"probe":true}`)
+	assertEqual(t, res.OK, false, "dry run should fail")
+	assertEqual(t, res.Probed, true, "should be probed")
+	assertEqual(t, res.Recipients[0].Accepted, true, "recipient should be accepted")
+	assertEqual(t, res.Recipients[1].Accepted, false, "recipient should be rejected by the relay")
+	if !strings.HasPrefix(res.Recipients[1].Error, "SMTP error: ") {
+		t.Errorf("unexpected recipient error: %s", res.Recipients[1].Error)
+	}
+
+	res = dryRun(`{"to":["one@example.com"],"dry_run":true,"probe":true}`)
+	assertEqual(t, res.OK, true, "dry run should pass")
+
+	t.Log("Unreachable relay")
+	config.SMTPRelayConfig.Port = 1
+	res = dryRun(`{"to":["one@example.com"],"dry_run":true,"probe":true}`)
+	assertEqual(t, res.OK, false, "dry run should fail")
+	assertEqual(t, res.Recipients[0].Accepted, false, "recipient should fail")
+	if !strings.HasPrefix(res.Error, "SMTP error: ") {
+		t.Errorf("unexpected error: %s", res.Error)
+	}
+
+	assertEqual(t, atomic.LoadInt32(&relayed), int32(0), "no message should be relayed")
+
+	events, err := storage.GetMessageEvents(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(events), len(stored), "dry run should not record events")
+}
+
+func TestAPIv1Internationalised(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	relayed := make(chan []string, 10)
+	relay := &smtpd.Server{
+		Appname:           "Relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, from string, to []string, _ []byte) error {
+			relayed <- append([]string{from}, to...)
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	origReleaseEnabled := config.ReleaseEnabled
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		config.ReleaseEnabled = origReleaseEnabled
+	}()
+	config.ReleaseEnabled = true
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{
+		Name: config.DefaultRelayProfile,
+		Host: "127.0.0.1",
+		Port: ln.Addr().(*net.TCPAddr).Port,
+	}
+
+	raw := []byte("From: 发送 <发送@例え.jp>\r\nTo: 用户@例え.jp\r\nSubject: 测试\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n你好\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("Message")
+	b, err := clientGet(ts.URL + "/api/v1/message/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := storage.Message{}
+	if err := json.Unmarshal(b, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.From.Address, "发送@例え.jp", "wrong From address")
+	assertEqual(t, msg.To[0].Address, "用户@例え.jp", "wrong To address")
+	assertEqual(t, msg.Subject, "测试", "wrong Subject")
+
+	t.Log("Search")
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "to:用户@例え.jp", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "to:用户@xn--r8jz45g.jp", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "from:发送", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "你好", 1)
+
+	t.Log("Release")
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/release", `{"to":["用户@例え.jp"]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case envelope := <-relayed:
+		assertEqual(t, strings.Join(envelope, ","), "发送@例え.jp,用户@例え.jp", "wrong relayed envelope")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected message to be relayed")
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	origLMTPListen, origLMTPNetwork := config.LMTPListen, config.LMTPNetwork
+	origTLSCert, origTLSKey, origRequireTLS := config.SMTPTLSCert, config.SMTPTLSKey, config.SMTPRequireTLS
+	defer func() {
+		config.LMTPListen, config.LMTPNetwork = origLMTPListen, origLMTPNetwork
+		config.SMTPTLSCert, config.SMTPTLSKey, config.SMTPRequireTLS = origTLSCert, origTLSKey, origRequireTLS
+	}()
+	config.LMTPListen = filepath.Join(t.TempDir(), "lmtp.sock")
+	config.LMTPNetwork = "unix"
+
+	// the SMTP TLS settings do not apply to LMTP
+	config.SMTPTLSCert, config.SMTPTLSKey = writeTestCertificate(t)
+	config.SMTPRequireTLS = true
+
+	go func() {
+		if err := smtpd.ListenLMTP(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", config.LMTPListen); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := textproto.NewConn(conn)
+	cmd := func(expectCode int, format string, args ...interface{}) string {
+		if err := c.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := c.ReadResponse(expectCode)
+		if err != nil {
+			t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+		}
+		return msg
+	}
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if lhlo := cmd(250, "LHLO localhost"); strings.Contains(lhlo, "STARTTLS") {
+		t.Error("LMTP should not offer STARTTLS with the SMTP certificate")
+	}
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	for _, to := range []string{"user+lmtp@example.com", "other@example.com"} {
+		cmd(250, "RCPT TO:<%s>", to)
+	}
+	cmd(354, "DATA")
+
+	w := c.DotWriter()
+	// the ingress source cannot be set by the client
+	_, _ = w.Write([]byte("From: sender@example.com\r\nTo: user+lmtp@example.com\r\nX-Mailpit-Via: import\r\nSubject: LMTP\r\n\r\nDelivered via LMTP\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("A response for each recipient")
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Errorf("recipient %d rejected: %v", i+1, err)
+		}
+	}
+
+	cmd(221, "QUIT")
+
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "via:lmtp", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "tag:lmtp", 1)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(m.Messages), 1, "wrong number of messages")
+
+	b, err := clientGet(ts.URL + "/api/v1/message/" + m.Messages[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := storage.Message{}
+	if err := json.Unmarshal(b, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Via, storage.ViaLMTP, "wrong ingress source")
+	assertEqual(t, msg.Subject, "LMTP", "wrong subject")
+	assertEqual(t, len(msg.Bcc), 1, "missing envelope recipient should be added to Bcc")
+}
+
+// WriteTestCertificate writes a self-signed certificate & key for localhost, returning the file paths
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestAPIv1RelayProfiles(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	startRelay := func(name string, received chan string) int {
+		relay := &smtpd.Server{
+			Appname:           name,
+			Hostname:          "localhost",
+			DisableReverseDNS: true,
+			Handler: func(_ net.Addr, from string, _ []string, _ []byte) error {
+				received <- name + ":" + from
+				return nil
+			},
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = relay.Serve(ln) }()
+		t.Cleanup(func() { _ = relay.Close() })
+
+		return ln.Addr().(*net.TCPAddr).Port
+	}
+
+	received := make(chan string, 1)
+
+	origRelayConfig := config.SMTPRelayConfig
+	origReleaseEnabled := config.ReleaseEnabled
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		config.ReleaseEnabled = origReleaseEnabled
+	}()
+	config.ReleaseEnabled = true
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{
+		Name: config.DefaultRelayProfile,
+		Host: "127.0.0.1",
+		Port: startRelay("default", received),
+		Profiles: map[string]*config.SMTPRelayConfigStruct{
+			"sandbox": {
+				Name:       "sandbox",
+				Host:       "127.0.0.1",
+				Port:       startRelay("sandbox", received),
+				Username:   "user",
+				Password:   "secret",
+				ReturnPath: "bounces@sandbox.example.com",
+			},
+		},
+	}
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Release\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseURL := ts.URL + "/api/v1/message/" + id + "/release"
+
+	assertReceived := func(expected string) {
+		select {
+		case m := <-received:
+			assertEqual(t, m, expected, "released via the wrong relay")
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not relayed")
+		}
+	}
+
+	t.Log("List relay profiles")
+	data, err := clientGet(ts.URL + "/api/v1/relays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Error("relay profiles include credentials")
+	}
+	profiles := []apiv1.RelayProfile{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(profiles), 2, "wrong number of relay profiles")
+	assertEqual(t, profiles[0].Name, "default", "wrong first relay profile")
+	assertEqual(t, profiles[1].Name, "sandbox", "wrong second relay profile")
+
+	t.Log("Release via the default relay")
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"]}`); err != nil {
+		t.Fatal(err)
+	}
+	assertReceived("default:sender@example.com")
+
+	t.Log("Release via a relay profile")
+	if _, err := clientPost(releaseURL, `{"to":["tester@example.com"],"profile":"sandbox"}`); err != nil {
+		t.Fatal(err)
+	}
+	assertReceived("sandbox:bounces@sandbox.example.com")
+
+	t.Log("Release via an unknown relay profile")
+	resp, err := http.Post(releaseURL, "application/json", strings.NewReader(`{"to":["tester@example.com"],"profile":"missing"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest, "wrong status for an unknown relay profile")
+	assertEqual(t, string(body), `Unknown relay profile "missing", valid profiles are: default, sandbox`, "wrong unknown relay profile error")
+}
+
+func TestAPIv1SendMessage(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	received := make(chan []string, 1)
+	relay := &smtpd.Server{
+		Appname:           "relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, to []string, data []byte) error {
+			if bytes.Contains(data, []byte("Bcc:")) {
+				t.Error("released message contains a Bcc header")
+			}
+			received <- to
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	origReleaseEnabled := config.ReleaseEnabled
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		config.ReleaseEnabled = origReleaseEnabled
+	}()
+	config.ReleaseEnabled = false
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{
+		Name:                    config.DefaultRelayProfile,
+		Host:                    "127.0.0.1",
+		Port:                    ln.Addr().(*net.TCPAddr).Port,
+		AllowedRecipientsRegexp: regexp.MustCompile(`@example\.com$`),
+	}
+
+	sendURL := ts.URL + "/api/v1/send"
+
+	assertSendStatus := func(body string, status int, field string) {
+		resp, err := http.Post(sendURL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		res := apiv1.SendMessageError{}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, resp.StatusCode, status, "wrong status for an invalid request")
+		assertEqual(t, res.Field, field, "wrong invalid field: "+res.Error)
+	}
+
+	assertSendError := func(body, field string) {
+		assertSendStatus(body, http.StatusBadRequest, field)
+	}
+
+	t.Log("Send a message")
+	data, err := clientPost(sendURL, `{
+		"From": "Sender <sender@example.com>",
+		"To": ["Recipient <recipient@example.com>"],
+		"Cc": ["cc@example.com"],
+		"Bcc": ["bcc@example.com"],
+		"Subject": "Sent via the API",
+		"Text": "Plain text",
+		"HTML": "<p>HTML text</p>",
+		"Attachments": [{"Filename": "note.txt", "ContentBase64": "TWFpbHBpdCBpcyBhd2Vzb21lIQ=="}],
+		"Headers": {"X-Test": "value"},
+		"Tags": ["API", "Sent"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := apiv1.SendMessageResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Released, false, "message should not be released")
+
+	msg, err := storage.GetMessage(res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.From.Address, "sender@example.com", "wrong From")
+	assertEqual(t, msg.To[0].String(), `"Recipient" <recipient@example.com>`, "wrong To")
+	assertEqual(t, msg.Cc[0].Address, "cc@example.com", "wrong Cc")
+	assertEqual(t, msg.Bcc[0].Address, "bcc@example.com", "wrong Bcc")
+	assertEqual(t, msg.Subject, "Sent via the API", "wrong Subject")
+	assertEqual(t, strings.TrimSpace(msg.Text), "Plain text", "wrong text body")
+	assertEqual(t, msg.HTML, "<p>HTML text</p>", "wrong HTML body")
+	assertEqual(t, len(msg.Attachments), 1, "wrong number of attachments")
+	assertEqual(t, msg.Attachments[0].FileName, "note.txt", "wrong attachment filename")
+	assertEqual(t, msg.Attachments[0].ContentType, "text/plain", "wrong attachment content type")
+	assertEqual(t, strings.Join(msg.Tags, ","), "API,Sent", "wrong tags")
+	assertEqual(t, msg.Via, storage.ViaHTTPAPI, "wrong ingress source")
+
+	raw, err := storage.GetMessageRaw(res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte("X-Test: value\r\n")) || !bytes.Contains(raw, []byte("Message-Id: <")) {
+		t.Errorf("message headers not set: %s", raw)
+	}
+
+	t.Log("Validation errors")
+	assertSendError(`{"From": "invalid", "To": ["recipient@example.com"]}`, "From")
+	assertSendError(`{"From": "sender@example.com"}`, "To")
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com", "invalid"]}`, "To[1]")
+	assertSendError(`{"From": "sender@example.com", "Bcc": ["invalid"]}`, "Bcc[0]")
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Attachments": [{"Filename": "a.txt", "ContentBase64": "!"}]}`, "Attachments[0].ContentBase64")
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Headers": {"Subject": "x"}}`, "Headers.Subject")
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Tags": ["ok", "in/valid"]}`, "Tags[1]")
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Release": true}`, "Release")
+
+	oversized := base64.StdEncoding.EncodeToString(make([]byte, 25*1024*1024+1))
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Attachments": [{"Filename": "a.bin", "ContentBase64": "`+oversized+`"}]}`, "Attachments[0].ContentBase64")
+
+	t.Log("Messages exceeding the maximum message size")
+	origMaxSize := config.MaxMessageSizeBytes
+	config.MaxMessageSizeBytes = 1024
+	assertSendStatus(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Text": "`+strings.Repeat("a", 1200)+`"}`, http.StatusRequestEntityTooLarge, "")
+	assertSendStatus(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Text": "`+strings.Repeat("a", 3000)+`"}`, http.StatusRequestEntityTooLarge, "")
+	config.MaxMessageSizeBytes = origMaxSize
+
+	t.Log("Send & release a message")
+	config.ReleaseEnabled = true
+
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Cc": ["user@example.org"], "Release": true}`, "Cc[0]")
+	assertSendError(`{"From": "sender@example.com", "To": ["recipient@example.com"], "Release": true, "Profile": "missing"}`, "Profile")
+
+	data, err = clientPost(sendURL, `{"From": "sender@example.com", "To": ["recipient@example.com"], "Bcc": ["bcc@example.com"], "Subject": "Release", "Release": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = apiv1.SendMessageResult{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Released, true, "message was not released: "+res.ReleaseError)
+
+	select {
+	case to := <-received:
+		assertEqual(t, strings.Join(to, ","), "recipient@example.com,bcc@example.com", "released to the wrong recipients")
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not relayed")
+	}
+}
+
+func TestAPIv1ForwardRules(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	received := make(chan []string, 5)
+	failures := int32(0)
+	relay := &smtpd.Server{
+		Appname:           "relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, to []string, _ []byte) error {
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				return errors.New("451 4.3.0 try again later")
+			}
+			received <- to
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	origReleaseEnabled := config.ReleaseEnabled
+	origRetryDelay := apiv1.ForwardRetryDelay
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		config.ReleaseEnabled = origReleaseEnabled
+		config.SMTPForwardingPaused = false
+		apiv1.ForwardRetryDelay = origRetryDelay
+	}()
+	config.ReleaseEnabled = true
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{
+		Name:                    config.DefaultRelayProfile,
+		Host:                    "127.0.0.1",
+		Port:                    ln.Addr().(*net.TCPAddr).Port,
+		AllowedRecipientsRegexp: regexp.MustCompile(`@example\.com$`),
+	}
+	apiv1.ForwardRetryDelay = 10 * time.Millisecond
+
+	rulesURL := ts.URL + "/api/v1/relay/rules"
+
+	assertForwarded := func(expected string) {
+		select {
+		case to := <-received:
+			assertEqual(t, strings.Join(to, ","), expected, "forwarded to the wrong recipients")
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not forwarded")
+		}
+	}
+
+	assertForwardedCount := func(id, count int) {
+		// the counter is updated after the message has been sent
+		for i := 0; i < 50; i++ {
+			rules, err := storage.GetForwardRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rule := range rules {
+				if rule.ID == id && rule.Forwarded == count {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("forwarding rule %d did not forward %d messages", id, count)
+	}
+
+	t.Log("Add forwarding rules")
+	data, err := clientPost(rulesURL, `{"query": "tag:uat", "to": ["qa@example.com"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagRule := storage.ForwardRule{}
+	if err := json.Unmarshal(data, &tagRule); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, tagRule.Query, "tag:uat", "wrong rule query")
+
+	data, err = clientPost(rulesURL, `{"query": "to:@uat.example.com", "to": ["other@example.com"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressRule := storage.ForwardRule{}
+	if err := json.Unmarshal(data, &addressRule); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{`{"query": "", "to": ["qa@example.com"]}`, `{"query": "tag:uat", "to": []}`,
+		`{"query": "tag:uat", "to": ["qa@example.org"]}`, `{"query": "tag:uat", "to": ["qa@example.com"], "profile": "missing"}`} {
+		if _, err := clientPost(rulesURL, body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+
+	t.Log("Forward matching messages")
+	raw := []byte("From: sender@example.com\r\nTo: user@example.com\r\nX-Tags: uat\r\nSubject: UAT\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiv1.ProcessForwarding(id)
+	assertForwarded("qa@example.com")
+	assertForwardedCount(tagRule.ID, 1)
+
+	raw = []byte("From: sender@example.com\r\nTo: user@UAT.example.com\r\nSubject: UAT address\r\n\r\nBody\r\n")
+	id, err = storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiv1.ProcessForwarding(id)
+	assertForwarded("other@example.com")
+	assertForwardedCount(addressRule.ID, 1)
+
+	raw = []byte("From: sender@example.com\r\nTo: user@example.com\r\nSubject: Not matching\r\n\r\nBody\r\n")
+	otherID, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiv1.ProcessForwarding(otherID)
+
+	t.Log("Retry temporary failures")
+	atomic.StoreInt32(&failures, 2)
+	raw = []byte("From: sender@example.com\r\nTo: user@example.com\r\nX-Tags: uat\r\nSubject: Retry\r\n\r\nBody\r\n")
+	id, err = storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiv1.ProcessForwarding(id)
+	assertForwarded("qa@example.com")
+	assertForwardedCount(tagRule.ID, 2)
+
+	t.Log("Pause forwarding")
+	config.SMTPForwardingPaused = true
+	apiv1.ProcessForwarding(id)
+	config.SMTPForwardingPaused = false
+
+	select {
+	case to := <-received:
+		t.Errorf("unexpected message forwarded to %v", to)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	t.Log("Update & delete forwarding rules")
+	ruleURL := fmt.Sprintf("%s/%d", rulesURL, tagRule.ID)
+	data, err = clientPut(ruleURL, `{"query": "tag:uat2", "to": ["qa2@example.com"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagRule = storage.ForwardRule{}
+	if err := json.Unmarshal(data, &tagRule); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, tagRule.Query, "tag:uat2", "rule was not updated")
+	assertEqual(t, tagRule.Forwarded, 2, "forwarded count was not preserved")
+
+	if _, err := clientDelete(ruleURL, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = clientGet(rulesURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []storage.ForwardRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(rules), 1, "wrong number of rules")
+	assertEqual(t, rules[0].ID, addressRule.ID, "wrong rule deleted")
+
+	for _, u := range []string{ruleURL, rulesURL + "/abc"} {
+		if _, err := clientDelete(u, ""); err == nil {
+			t.Errorf("expected an error deleting %s", u)
+		}
+	}
+}
+
+func TestAPIv1ReleaseOriginalRecipients(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	type relayed struct {
+		to   []string
+		data string
+	}
+
+	received := make(chan relayed, 1)
+	relay := &smtpd.Server{
+		Appname:           "Relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, to []string, data []byte) error {
+			received <- relayed{to, string(data)}
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	defer func() { config.SMTPRelayConfig = origRelayConfig }()
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	raw := []byte("From: sender@example.com\r\nTo: One <one@example.com>\r\nCc: two@example.com, ONE@example.com\r\nBcc: three@example.com\r\nSubject: Release\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelopeID, err := storage.StoreWithOptions(&raw, storage.StoreOptions{From: "sender@example.com", To: []string{"envelope@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRelayed := func(to string) {
+		select {
+		case m := <-received:
+			assertEqual(t, strings.Join(m.to, ","), to, "wrong envelope recipients")
+			msg, err := mail.ReadMessage(strings.NewReader(m.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, msg.Header.Get("Bcc"), "", "Bcc header not removed")
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not relayed")
+		}
+	}
+
+	t.Log("Recipients from the message headers")
+	data, err := clientPost(ts.URL+"/api/v1/message/"+id+"/release", `{"use_original_recipients":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `{"To":["one@example.com","two@example.com","three@example.com"]}`, "wrong resolved recipients")
+	assertRelayed("one@example.com,two@example.com,three@example.com")
+
+	t.Log("Recipients from the SMTP envelope")
+	data, err = clientPost(ts.URL+"/api/v1/message/"+envelopeID+"/release", `{"use_original_recipients":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), `{"To":["envelope@example.com"]}`, "wrong resolved recipients")
+	assertRelayed("envelope@example.com")
+
+	t.Log("Recipients not matching the allowlist")
+	config.SMTPRelayConfig.AllowedRecipientsRegexp = regexp.MustCompile(`^(one|two)@example\.com$`)
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/release", `{"use_original_recipients":true}`); err == nil {
+		t.Error("expected an error for recipients not matching the allowlist")
+	}
+
+	t.Log("Recipients matching the blocklist take precedence over the allowlist")
+	config.SMTPRelayConfig.BlockedRecipientsRegexp = regexp.MustCompile(`^two@example\.com$`)
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/release", `{"to":["one@example.com"]}`); err != nil {
+		t.Fatal(err)
+	}
+	assertRelayed("one@example.com")
+
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+id+"/release", `{"to":["two@example.com"]}`); err == nil {
+		t.Error("expected an error for a blocked recipient matching the allowlist")
+	}
+}
+
+func TestAPIv1ReleaseDelete(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	relay := &smtpd.Server{
+		Appname:           "Relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, _ []string, _ []byte) error {
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	defer func() { config.SMTPRelayConfig = origRelayConfig }()
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Release\r\n\r\nBody\r\n")
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := storage.Store(&raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	messagesURL := ts.URL + "/api/v1/messages"
+
+	t.Log("Release and keep")
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+ids[0]+"/release", `{"to":["tester@example.com"]}`); err != nil {
+		t.Fatal(err)
+	}
+	assertStatsEqual(t, messagesURL, 3, 3)
+
+	t.Log("Release history")
+	data, err := clientGet(ts.URL + "/api/v1/message/" + ids[0] + "/releases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := apiv1.ReleaseHistorySummary{}
+	if err := json.Unmarshal(data, &history); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, history.Total, 1, "wrong release history total")
+	assertEqual(t, history.History[0].Success, true, "release not recorded as successful")
+	assertEqual(t, history.History[0].MailFrom, "sender@example.com", "wrong release MAIL FROM")
+	assertEqual(t, history.History[0].ClientIP, "127.0.0.1", "wrong release client IP")
+
+	msg := storage.Message{}
+	data, err = clientGet(ts.URL + "/api/v1/message/" + ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.ReleaseCount, 1, "wrong message release count")
+
+	data, err = clientGet(ts.URL + "/api/v1/releases/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, history.Total, 1, "wrong global release history total")
+
+	t.Log("Release and delete")
+	if _, err := clientPost(ts.URL+"/api/v1/message/"+ids[0]+"/release", `{"to":["tester@example.com"],"delete_after_release":true}`); err != nil {
+		t.Fatal(err)
+	}
+	assertStatsEqual(t, messagesURL, 2, 2)
+
+	t.Log("Batch release with config default")
+	config.SMTPRelayConfig.DeleteAfterRelease = true
+	body := `{"ids":["` + ids[1] + `","` + ids[0] + `"],"to":["tester@example.com"]}`
+	data, err = clientPost(ts.URL+"/api/v1/messages/release", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := []apiv1.ReleaseResult{}
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(results), 2, "wrong number of results")
+	assertEqual(t, results[0].Sent && results[0].Deleted, true, "message not sent & deleted")
+	assertEqual(t, results[1].Sent || results[1].Error == "", false, "missing message not failed")
+	assertStatsEqual(t, messagesURL, 1, 1)
+
+	t.Log("Batch release overriding config default")
+	body = `{"ids":["` + ids[2] + `"],"to":["tester@example.com"],"delete_after_release":false}`
+	data, err = clientPost(ts.URL+"/api/v1/messages/release", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(results), 1, "wrong number of results")
+	assertEqual(t, results[0].Sent && !results[0].Deleted, true, "message not sent & kept")
+	assertStatsEqual(t, messagesURL, 1, 1)
+
+	t.Log("Batch release by search query")
+	body = `{"query":"subject:release","to":["tester@example.com"],"delete_after_release":false}`
+	data, err = clientPost(ts.URL+"/api/v1/messages/release", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(results), 1, "wrong number of results")
+	assertEqual(t, results[0].ID, ids[2], "wrong message released")
+	assertEqual(t, results[0].Sent, true, "message not sent")
+
+	if _, err := clientPost(ts.URL+"/api/v1/messages/release", `{"query":"subject:missing","to":["tester@example.com"]}`); err == nil {
+		t.Error("expected an error for a search query without matches")
+	}
+}
+
+func TestAPIv1ScheduledRelease(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	received := make(chan []string, 1)
+	relay := &smtpd.Server{
+		Appname:           "Relay",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, to []string, _ []byte) error {
+			received <- to
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = relay.Serve(ln) }()
+	defer relay.Close()
+
+	origRelayConfig := config.SMTPRelayConfig
+	defer func() { config.SMTPRelayConfig = origRelayConfig }()
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Release\r\n\r\nBody\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseURL := ts.URL + "/api/v1/message/" + id + "/release"
+	releasesURL := ts.URL + "/api/v1/releases"
+
+	t.Log("Invalid schedules")
+	for _, body := range []string{
+		`{"to":["tester@example.com"],"delay":"soon"}`,
+		`{"to":["tester@example.com"],"delay":"-1h"}`,
+		`{"to":["tester@example.com"],"at":"tomorrow"}`,
+		`{"to":["tester@example.com"],"at":"` + time.Now().Add(-time.Minute).Format(time.RFC3339) + `"}`,
+		`{"to":["tester@example.com"],"at":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `","delay":"1h"}`,
+		`{"to":["invalid"],"delay":"1h"}`,
+	} {
+		if _, err := clientPost(releaseURL, body); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+
+	t.Log("Schedule a release")
+	data, err := clientPost(releaseURL, `{"to":["later@example.com"],"delay":"1h"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := storage.ReleaseJob{}
+	if err := json.Unmarshal(data, &later); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, later.MessageID, id, "wrong scheduled message")
+
+	data, err = clientPost(releaseURL, `{"to":["soon@example.com"],"at":"`+time.Now().Add(time.Second).Format(time.RFC3339Nano)+`"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soon := storage.ReleaseJob{}
+	if err := json.Unmarshal(data, &soon); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = clientGet(releasesURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := []storage.ReleaseJob{}
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(jobs), 2, "wrong number of scheduled releases")
+	assertEqual(t, jobs[0].ID, soon.ID, "scheduled releases not ordered by due time")
+
+	t.Log("Send due releases")
+	apiv1.ProcessReleaseJobs()
+	select {
+	case <-received:
+		t.Fatal("release sent before it was due")
+	default:
+	}
+
+	time.Sleep(time.Until(soon.Due) + 100*time.Millisecond)
+	apiv1.ProcessReleaseJobs()
+	select {
+	case to := <-received:
+		assertEqual(t, strings.Join(to, ","), "soon@example.com", "wrong recipients")
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled release not sent")
+	}
+
+	data, err = clientGet(releasesURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(jobs), 1, "sent release was not removed")
+	assertEqual(t, jobs[0].ID, later.ID, "wrong remaining release")
+
+	t.Log("Cancel a release")
+	if _, err := clientDelete(releasesURL+"/"+later.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientDelete(releasesURL+"/"+later.ID, ""); err == nil {
+		t.Error("expected an error cancelling a missing release")
+	}
+
+	data, err = clientGet(releasesURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "[]", "release was not cancelled")
+}
+
+func TestAPIv1FirstOpened(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, subject := range []string{"First", "Second"} {
+		raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: " + subject + "\r\n\r\nBody\r\n")
+		if _, err := storage.Store(&raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "opened:no", 2)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "opened:yes", 0)
+
+	t.Log("Latest message is opened")
+	data, err := clientGet(ts.URL + "/api/v1/message/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := storage.Message{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Subject, "Second", "wrong latest message")
+	if msg.FirstOpened == nil {
+		t.Fatal("expected FirstOpened to be set")
+	}
+	firstOpened := *msg.FirstOpened
+
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "opened:yes", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "-opened:yes", 1)
+
+	t.Log("FirstOpened is not updated when reopened")
+	time.Sleep(5 * time.Millisecond)
+	data, err = clientGet(ts.URL + "/api/v1/message/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.FirstOpened.Equal(firstOpened), true, "FirstOpened changed")
+
+	t.Log("Marking all read does not open messages")
+	if err := storage.MarkAllRead(); err != nil {
+		t.Fatal(err)
+	}
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "opened:no", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "is:read", 2)
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(m.Messages), 2, "wrong number of messages")
+	assertEqual(t, m.Messages[0].FirstOpened != nil, true, "expected latest message summary to be opened")
+	assertEqual(t, m.Messages[1].FirstOpened == nil, true, "expected other message summary not to be opened")
+}
+
+func TestAPIv1MessageMetadata(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	config.MetadataHeaderPrefix = "X-Mailpit-Meta-"
+	defer func() { config.MetadataHeaderPrefix = "" }()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Metadata\r\nX-Mailpit-Meta-Build: 1234\r\n\r\nBody\r\n")
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("Metadata headers are harvested & stripped")
+	data, err := clientGet(ts.URL + "/api/v1/message/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := storage.Message{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, msg.Metadata["build"], "1234", "wrong harvested metadata")
+
+	headers, err := clientGet(ts.URL + "/api/v1/message/" + msg.ID + "/headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Contains(string(headers), "X-Mailpit-Meta-Build"), false, "metadata header was not stripped")
+
+	t.Log("Metadata is merged")
+	data, err = clientPut(ts.URL+"/api/v1/message/"+msg.ID+"/metadata", `{"metadata":{"test-case":"signup","build":""}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]string{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(meta), 1, "wrong number of metadata keys")
+	assertEqual(t, meta["test-case"], "signup", "wrong merged metadata")
+
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "meta:test-case=signup", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "meta:test-case=other", 0)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "meta:test-case", 1)
+	assertSearchEqual(t, ts.URL+"/api/v1/search", "meta:build", 0)
+
+	t.Log("Metadata is replaced")
+	data, err = clientPut(ts.URL+"/api/v1/message/latest/metadata", `{"metadata":{"a":"1","b":"2"},"mode":"replace"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta = map[string]string{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(meta), 2, "wrong number of metadata keys")
+
+	m, err := fetchMessages(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, m.Messages[0].Metadata["b"], "2", "metadata not returned in message summary")
+
+	t.Log("Invalid metadata is rejected")
+	tooMany := map[string]string{}
+	for i := 0; i <= storage.MaxMetadataKeys; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	b, _ := json.Marshal(map[string]interface{}{"metadata": tooMany})
+	for _, body := range []string{
+		`{"metadata":{"invalid key":"value"}}`,
+		`{"metadata":{"key":"` + strings.Repeat("a", storage.MaxMetadataValueLength+1) + `"}}`,
+		`{"metadata":{"key":"value"},"mode":"append"}`,
+		string(b),
+	} {
+		if _, err := clientPut(ts.URL+"/api/v1/message/"+msg.ID+"/metadata", body); err == nil {
+			t.Errorf("expected an error for %.50s", body)
+		}
+	}
+
+	if _, err := clientPut(ts.URL+"/api/v1/message/does-not-exist/metadata", `{"metadata":{"a":"1"}}`); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 for a missing message, got %v", err)
+	}
+}
+
+func TestWebsocketAuth(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	websockets.MessageHub = websockets.NewHub()
+	go websockets.MessageHub.Run()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/events"
+
+	dial := func(uri string, header http.Header) int {
+		conn, resp, err := websocket.DefaultDialer.Dial(uri, header)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("no response from %s: %v", uri, err)
+		}
+		return resp.StatusCode
+	}
+
+	t.Log("Upgrades without credentials are accepted when auth is disabled")
+	assertEqual(t, dial(wsURL, nil), http.StatusSwitchingProtocols, "websocket upgrade failed")
+
+	sum := sha1.Sum([]byte("secret"))
+	if err := auth.SetUIAuth("user:{SHA}" + base64.StdEncoding.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth.UICredentials = nil }()
+
+	t.Log("Upgrades without credentials are rejected when auth is enabled")
+	assertEqual(t, dial(wsURL, nil), http.StatusUnauthorized, "unauthenticated websocket upgrade")
+	assertEqual(t, dial(wsURL+"?ticket=invalid", nil), http.StatusUnauthorized, "invalid ticket accepted")
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:wrong")))
+	assertEqual(t, dial(wsURL, header), http.StatusUnauthorized, "invalid basic auth accepted")
+
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")))
+	assertEqual(t, dial(wsURL, header), http.StatusSwitchingProtocols, "basic auth rejected")
+
+	getTicket := func() string {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/v1/ws-ticket", nil)
+		req.SetBasicAuth("user", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ticket := struct{ Ticket string }{}
+		if err := json.NewDecoder(resp.Body).Decode(&ticket); err != nil {
+			t.Fatal(err)
+		}
+		return ticket.Ticket
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/ws-ticket"); err == nil {
+		t.Error("expected unauthenticated ticket request to fail")
+	}
+
+	t.Log("Tickets are single use")
+	ticket := getTicket()
+	assertEqual(t, dial(wsURL+"?ticket="+ticket, nil), http.StatusSwitchingProtocols, "ticket rejected")
+	assertEqual(t, dial(wsURL+"?ticket="+ticket, nil), http.StatusUnauthorized, "ticket reused")
+
+	t.Log("Tickets are accepted as a bearer token")
+	header.Set("Authorization", "Bearer "+getTicket())
+	assertEqual(t, dial(wsURL, header), http.StatusSwitchingProtocols, "bearer ticket rejected")
+
+	t.Log("Expired tickets are rejected")
+	auth.WebsocketTicketTTL = 10 * time.Millisecond
+	defer func() { auth.WebsocketTicketTTL = 30 * time.Second }()
+	ticket = getTicket()
+	time.Sleep(20 * time.Millisecond)
+	assertEqual(t, dial(wsURL+"?ticket="+ticket, nil), http.StatusUnauthorized, "expired ticket accepted")
+}
+
+func TestAPIv1DeleteMessagesResult(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		raw := []byte(fmt.Sprintf("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Delete %d\r\n\r\nBody\r\n", i))
+		id, err := storage.Store(&raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	deleteIDs := func(accept string, ids ...string) (int, string) {
+		b, _ := json.Marshal(map[string][]string{"IDs": ids})
+		req, err := http.NewRequest("DELETE", ts.URL+"/api/v1/messages", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Log("Deleted & unknown IDs are reported")
+	status, body := deleteIDs("application/json", ids[0], "does-not-exist")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	res := apiv1.DeleteMessagesResult{}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Deleted, 1, "wrong deleted count")
+	assertEqual(t, len(res.NotFound), 1, "wrong number of unknown IDs")
+	assertEqual(t, res.NotFound[0], "does-not-exist", "wrong unknown ID")
+
+	t.Log("A 404 is returned when no IDs match")
+	status, body = deleteIDs("application/json", ids[0], "does-not-exist")
+	assertEqual(t, status, http.StatusNotFound, "wrong status")
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, res.Deleted, 0, "wrong deleted count")
+	assertEqual(t, len(res.NotFound), 2, "wrong number of unknown IDs")
+
+	status, _ = deleteIDs("", "does-not-exist")
+	assertEqual(t, status, http.StatusNotFound, "wrong status")
+
+	t.Log("Requests without an Accept header receive a plain response")
+	status, body = deleteIDs("", ids[1], "does-not-exist")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, body, "ok", "wrong response")
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 1, 1)
+
+	t.Log("Deleting all messages reports the number of deleted messages")
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Delete all\r\n\r\nBody\r\n")
+	if _, err := storage.Store(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	status, body = deleteIDs("application/json")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, body, `{"Deleted":2,"NotFound":[]}`, "wrong response")
+
+	assertStatsEqual(t, ts.URL+"/api/v1/messages", 0, 0)
+
+	status, body = deleteIDs("")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, body, "ok", "wrong response")
+}
+
+func TestAPIv1AttachmentText(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	pdf := "%PDF-1.4\n1 0 obj\n<< /Length 44 >>\nstream\nBT /F1 12 Tf 72 712 Td (Quarterly report) Tj ET\nendstream\nendobj\n%%EOF\n"
+
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Attachments\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/csv; charset=iso-8859-1\r\n" +
+		"Content-Disposition: attachment; filename=\"report.csv\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"name,city\r\nJos=E9,Z=FCrich\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"app.log\"\r\n" +
+		"\r\n" +
+		"2024-01-01 ERROR something failed\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"image.png\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(pdf)) + "\r\n" +
+		"--b1--\r\n")
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := storage.GetMessage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := map[string]string{}
+	for _, a := range msg.Attachments {
+		parts[a.FileName] = a.PartID
+	}
+
+	getText := func(partID, query string) (int, apiv1.AttachmentTextResult) {
+		res := apiv1.AttachmentTextResult{}
+		resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/part/" + partID + "/text" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, res
+	}
+
+	t.Log("Text attachments are converted to UTF-8")
+	status, res := getText(parts["report.csv"], "")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.Text, "name,city\r\nJosé,Zürich", "wrong text")
+	assertEqual(t, res.Charset, "iso-8859-1", "wrong charset")
+	assertEqual(t, res.Truncated, false, "unexpected truncation")
+
+	t.Log("Text is truncated to the maximum size")
+	status, res = getText(parts["report.csv"], "?max=15")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.Text, "name,city\r\nJos", "wrong truncated text")
+	assertEqual(t, res.Truncated, true, "expected truncation")
+	assertEqual(t, res.Size, 24, "wrong size")
+
+	t.Log("Text content type is detected for generic attachments")
+	status, res = getText(parts["app.log"], "")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.Text, "2024-01-01 ERROR something failed", "wrong text")
+
+	t.Log("Binary attachments are not supported")
+	status, _ = getText(parts["image.png"], "")
+	assertEqual(t, status, http.StatusUnsupportedMediaType, "wrong status")
+	status, _ = getText(parts["report.pdf"], "")
+	assertEqual(t, status, http.StatusUnsupportedMediaType, "wrong status")
+
+	resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/part/" + parts["image.png"] + "/text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.Header.Get("Content-Type"), "text/plain", "wrong content type")
+
+	t.Log("PDF text layer is returned with best-effort")
+	status, res = getText(parts["report.pdf"], "?best-effort=true")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.Text, "Quarterly report", "wrong PDF text")
+
+	status, _ = getText("99", "")
+	assertEqual(t, status, http.StatusNotFound, "wrong status")
+}
+
+func TestAPIv1MessageReport(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// a slow link, to test the report timeout
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(2 * time.Second)
+	}))
+	defer slow.Close()
+
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<html><body><p>Hello <a href=\"" + slow.URL + "/link\">link</a></p></body></html>\r\n")
+
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getReport := func(query string) (int, apiv1.MessageReportResult) {
+		report := apiv1.MessageReportResult{}
+		resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/report" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, report
+	}
+
+	t.Log("Sections which time out do not fail the report")
+	status, report := getReport("?timeout=1")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, len(report.Sections), 6, "wrong number of sections")
+	assertEqual(t, report.Sections["summary"].Status, "ok", "wrong summary status")
+	assertEqual(t, report.Sections["html-check"].Status, "ok", "wrong html-check status")
+	assertEqual(t, report.Sections["parity-check"].Status, "ok", "wrong parity-check status")
+	assertEqual(t, report.Sections["link-check"].Status, "timeout", "wrong link-check status")
+	assertEqual(t, report.Sections["spam-check"].Status, "unavailable", "wrong spam-check status")
+	assertEqual(t, report.Sections["authentication"].Status, "ok", "wrong authentication status")
+
+	t.Log("Sections can be selected")
+	start := time.Now()
+	status, report = getReport("?sections=link-check,summary")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, len(report.Sections), 2, "wrong number of sections")
+	assertEqual(t, report.Sections["link-check"].Status, "ok", "wrong link-check status")
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("report took %s", time.Since(start))
+	}
+
+	t.Log("Analyses are cached")
+	start = time.Now()
+	status, report = getReport("?sections=link-check")
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, report.Sections["link-check"].Status, "ok", "wrong link-check status")
+	if time.Since(start) > time.Second {
+		t.Error("link check was not cached")
+	}
+
+	status, _ = getReport("?sections=invalid")
+	assertEqual(t, status, http.StatusBadRequest, "wrong status")
+
+	resp, err := http.Get(ts.URL + "/api/v1/message/does-not-exist/report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusNotFound, "wrong status")
+}
+
+func TestAPIv1TrackCheck(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nContent-Type: text/html\r\n\r\n" +
+		"<p>Hello</p><img src=\"https://example.com/open.gif?id=1234567890\" width=\"1\" height=\"1\">\r\n")
+	id, err := storage.Store(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientGet(ts.URL + "/api/v1/message/" + id + "/track-check"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the check must not mark the message as read
+	m, err := fetchMessages(ts.URL + "/api/v1/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, m.Unread, float64(1), "message marked as read")
+}
+
+func TestAPIv1ParityCheck(t *testing.T) {
+	setup()
+	defer storage.Close()
+
+	r := apiRoutes()
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	store := func(raw string) string {
+		b := []byte(raw)
+		id, err := storage.Store(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	getParity := func(id string) (int, paritycheck.Response) {
+		res := paritycheck.Response{}
+		resp, err := http.Get(ts.URL + "/api/v1/message/" + id + "/parity-check")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, res
+	}
+
+	headers := "From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Parity\r\n" +
+		"MIME-Version: 1.0\r\n"
+
+	t.Log("Matching HTML & text parts")
+	id := store(headers +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Welcome!\r\n\r\nConfirm your account: https://example.com/confirm\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<h1>Welcome!</h1><p>Confirm your account: <a href=\"https://example.com/confirm\">https://example.com/confirm</a></p>\r\n" +
+		"--b1--\r\n")
+
+	status, res := getParity(id)
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.Similarity, float64(100), "wrong similarity")
+	assertEqual(t, len(res.HTMLOnlyLinks), 0, "unexpected HTML-only links")
+	assertEqual(t, len(res.HTMLOnlyText), 0, "unexpected HTML-only text")
+	assertEqual(t, res.TextEmpty, false, "unexpected empty text")
+	assertEqual(t, res.TextPlaceholder, false, "unexpected placeholder")
+	assertEqual(t, res.TextAfterHTML, false, "unexpected text after HTML")
+
+	t.Log("Placeholder text part after the HTML part")
+	id = store(headers +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Your order has shipped</p><a href=\"https://example.com/track\">Track order</a>\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This email requires an HTML viewer.\r\n" +
+		"--b1--\r\n")
+
+	status, res = getParity(id)
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.Similarity, float64(0), "wrong similarity")
+	assertEqual(t, strings.Join(res.HTMLOnlyLinks, ","), "https://example.com/track", "wrong HTML-only links")
+	assertEqual(t, strings.Join(res.HTMLOnlyText, "|"), "Your order has shipped|Track order", "wrong HTML-only text")
+	assertEqual(t, res.TextPlaceholder, true, "expected placeholder")
+	assertEqual(t, res.TextAfterHTML, true, "expected text after HTML")
+
+	t.Log("Empty text part")
+	id = store(headers +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hello</p>\r\n" +
+		"--b1--\r\n")
+
+	status, res = getParity(id)
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.TextEmpty, true, "expected empty text")
+	assertEqual(t, res.Similarity, float64(0), "wrong similarity")
+	assertEqual(t, strings.Join(res.HTMLOnlyText, "|"), "Hello", "wrong HTML-only text")
+
+	t.Log("HTML-only message")
+	id = store(headers +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hello</p>\r\n")
+
+	status, res = getParity(id)
+	assertEqual(t, status, http.StatusOK, "wrong status")
+	assertEqual(t, res.TextEmpty, true, "expected empty text")
+	assertEqual(t, res.Similarity, float64(0), "wrong similarity")
+
+	t.Log("Text-only message")
+	id = store(headers +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+
+	status, _ = getParity(id)
+	assertEqual(t, status, http.StatusBadRequest, "wrong status")
+
+	t.Log("Latest message")
+	status, _ = getParity("latest")
+	assertEqual(t, status, http.StatusBadRequest, "wrong status")
+
+	t.Log("Missing message")
+	status, _ = getParity("abc123")
+	assertEqual(t, status, http.StatusNotFound, "wrong status")
+}
+
+func insertEmailData(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		msg := enmime.Builder().
+			From(fmt.Sprintf("From %d", i), fmt.Sprintf("from-%d@example.com", i)).
+			Subject(fmt.Sprintf("Subject line %d end", i)).
+			Text([]byte(fmt.Sprintf("This is the email body %d <jdsauk;dwqmdqw;>.", i))).
+			To(fmt.Sprintf("To %d", i), fmt.Sprintf("to-%d@example.com", i))
+
+		env, err := msg.Build()
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		buf := new(bytes.Buffer)
+
+		if err := env.Encode(buf); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		bufBytes := buf.Bytes()
+
+		id, err := storage.Store(&bufBytes)
+		if err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+
+		if err := storage.SetMessageTags(id, []string{fmt.Sprintf("Test tag %03d", i)}); err != nil {
+			t.Log("error ", err)
+			t.Fail()
+		}
+	}
+
+}
+
+func fetchMessages(url string) (apiv1.MessagesSummary, error) {
+	m := apiv1.MessagesSummary{}
+
+	data, err := clientGet(url)
+	if err != nil {
+		return m, err
+	}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+func clientGet(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+
+	return data, err
+}
+
+func clientDelete(url, body string) ([]byte, error) {
+	client := new(http.Client)
+
+	b := strings.NewReader(body)
+	req, err := http.NewRequest("DELETE", url, b)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+
+	return data, err
+}
+
+func clientPost(url, body string) ([]byte, error) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+
+	return data, err
+}
+
+func clientPatch(url, body string) ([]byte, error) {
+	req, err := http.NewRequest("PATCH", url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
 }
 
 func clientPut(url, body string) ([]byte, error) {
@@ -0,0 +1,187 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// lmtpClient is a minimal LMTP (RFC 2033) client for testing, modelled on net/smtp which cannot be used
+// for LMTP as it does not support LHLO, nor the response for each recipient to the message data
+type lmtpClient struct {
+	// Text is the textproto.Conn used by the client, to allow sending other commands
+	Text *textproto.Conn
+	conn net.Conn
+	// the name sent with LHLO
+	localName string
+	// map of supported extensions
+	ext map[string]string
+	// accepted recipients of the current transaction
+	rcpts []string
+}
+
+// lmtpDial returns a new lmtpClient connected to an LMTP server at addr, either a tcp address or a unix socket
+func lmtpDial(network, addr string) (*lmtpClient, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLMTPClient(conn)
+}
+
+// newLMTPClient returns a new lmtpClient using an existing connection
+func newLMTPClient(conn net.Conn) (*lmtpClient, error) {
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		text.Close()
+		return nil, err
+	}
+
+	return &lmtpClient{Text: text, conn: conn}, nil
+}
+
+// Close closes the connection
+func (c *lmtpClient) Close() error {
+	return c.Text.Close()
+}
+
+// Cmd sends a command and returns the response message, or an error if the response code is not expectCode
+func (c *lmtpClient) Cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	return c.Text.ReadResponse(expectCode)
+}
+
+// Hello sends a LHLO command to the server, which must be called before any other command
+func (c *lmtpClient) Hello(localName string) error {
+	if strings.ContainsAny(localName, "\n\r") {
+		return errors.New("the local name must not contain CR or LF")
+	}
+
+	_, msg, err := c.Cmd(250, "LHLO %s", localName)
+	if err != nil {
+		return err
+	}
+
+	c.localName = localName
+	c.ext = map[string]string{}
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, " ")
+		c.ext[k] = v
+	}
+
+	return nil
+}
+
+// StartTLS sends the STARTTLS command and encrypts all further communication, sending LHLO again
+func (c *lmtpClient) StartTLS(config *tls.Config) error {
+	if _, _, err := c.Cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+
+	c.conn = tls.Client(c.conn, config)
+	c.Text = textproto.NewConn(c.conn)
+
+	return c.Hello(c.localName)
+}
+
+// Extension reports whether an extension is supported by the server, and its parameters
+func (c *lmtpClient) Extension(ext string) (bool, string) {
+	param, ok := c.ext[strings.ToUpper(ext)]
+
+	return ok, param
+}
+
+// Mail sends the MAIL command to start a transaction
+func (c *lmtpClient) Mail(from string) error {
+	c.rcpts = nil
+	_, _, err := c.Cmd(250, "MAIL FROM:<%s>", from)
+
+	return err
+}
+
+// Rcpt sends the RCPT command, the recipient receives a response to the message data if accepted
+func (c *lmtpClient) Rcpt(to string) error {
+	if _, _, err := c.Cmd(25, "RCPT TO:<%s>", to); err != nil {
+		return err
+	}
+
+	c.rcpts = append(c.rcpts, to)
+
+	return nil
+}
+
+type lmtpDataCloser struct {
+	c *lmtpClient
+	io.WriteCloser
+	statusCb func(rcpt string, err error)
+}
+
+// Close ends the message data & reads the response for each recipient, calling statusCb with the recipient
+// & a *textproto.Error if it was rejected. Without statusCb the first rejection is returned.
+func (d *lmtpDataCloser) Close() error {
+	if err := d.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	var rejected error
+	for _, rcpt := range d.c.rcpts {
+		_, _, err := d.c.Text.ReadResponse(250)
+		var protoErr *textproto.Error
+		if err != nil && !errors.As(err, &protoErr) {
+			return err
+		}
+
+		if d.statusCb != nil {
+			d.statusCb(rcpt, err)
+		} else if err != nil && rejected == nil {
+			rejected = err
+		}
+	}
+
+	d.c.rcpts = nil
+
+	return rejected
+}
+
+// Data sends the DATA command, returning a writer for the message, see LMTPData
+func (c *lmtpClient) Data() (io.WriteCloser, error) {
+	return c.LMTPData(nil)
+}
+
+// LMTPData sends the DATA command, returning a writer for the message. Closing the writer reads the response for
+// each accepted recipient, calling statusCb for each of them.
+func (c *lmtpClient) LMTPData(statusCb func(rcpt string, err error)) (io.WriteCloser, error) {
+	if _, _, err := c.Cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+
+	return &lmtpDataCloser{c: c, WriteCloser: c.Text.DotWriter(), statusCb: statusCb}, nil
+}
+
+// Noop sends the NOOP command
+func (c *lmtpClient) Noop() error {
+	_, _, err := c.Cmd(250, "NOOP")
+
+	return err
+}
+
+// Quit sends the QUIT command and closes the connection
+func (c *lmtpClient) Quit() error {
+	if _, _, err := c.Cmd(221, "QUIT"); err != nil {
+		return err
+	}
+
+	return c.Text.Close()
+}
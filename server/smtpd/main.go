@@ -0,0 +1,476 @@
+// Package smtpd is the SMTP daemon
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/auth"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/stats"
+	"github.com/axllent/mailpit/internal/storage"
+	"github.com/axllent/mailpit/internal/tools"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+var (
+	// DisableReverseDNS allows rDNS to be disabled
+	DisableReverseDNS bool
+
+	// OnMessageStored is an optional callback with the ID of each message stored via SMTP, which must not block
+	OnMessageStored func(id string)
+
+	// the running SMTP & LMTP servers, used to adjust connection limits at runtime
+	smtpServer atomic.Pointer[Server]
+	lmtpServer atomic.Pointer[Server]
+
+	// X-Mailpit-TTL header setting the message expiry, including folded lines
+	ttlHeaderRe = regexp.MustCompile(`(?i)(^|\n)X-Mailpit-TTL:[^\n]*\n([ \t][^\n]*\n)*`)
+)
+
+func mailHandler(origin net.Addr, from string, to []string, data []byte, info MessageInfo) error {
+	if !config.SMTPStrictRFCHeaders {
+		// replace all <CR><CR><LF> (\r\r\n) with <CR><LF> (\r\n)
+		// @see https://github.com/axllent/mailpit/issues/87 & https://github.com/axllent/mailpit/issues/153
+		data = bytes.ReplaceAll(data, []byte("\r\r\n"), []byte("\r\n"))
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(origin), logger.FieldError: err.Error()}).
+			Errorf("[smtpd] error parsing message: %s", err.Error())
+		stats.LogSMTPRejected()
+		return err
+	}
+
+	// check / set the Return-Path based on SMTP from
+	returnPath := strings.Trim(msg.Header.Get("Return-Path"), "<>")
+	if returnPath != from {
+		if returnPath != "" {
+			// replace Return-Path
+			re := regexp.MustCompile(`(?i)(^|\n)(Return\-Path: .*\n)`)
+			replaced := false
+			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
+				if replaced {
+					return r
+				}
+				replaced = true // only replace first occurrence
+
+				return re.ReplaceAll(r, []byte("${1}Return-Path: <"+from+">\r\n"))
+			})
+		} else {
+			// add Return-Path
+			data = append([]byte("Return-Path: <"+from+">\r\n"), data...)
+		}
+	}
+
+	var expires time.Time
+	if ttl := strings.TrimSpace(msg.Header.Get("X-Mailpit-TTL")); ttl != "" {
+		d, err := tools.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(origin), "ttl": ttl}).
+				Warnf("[smtpd] ignoring invalid X-Mailpit-TTL header: %s", ttl)
+		} else {
+			expires = time.Now().Add(d)
+		}
+
+		data = removeHeader(data, ttlHeaderRe)
+	}
+
+	messageID := strings.Trim(msg.Header.Get("Message-Id"), "<>")
+
+	// add a message ID if not set
+	if messageID == "" {
+		// generate unique ID
+		messageID = shortuuid.New() + "@mailpit"
+		// add unique ID
+		data = append([]byte("Message-Id: <"+messageID+">\r\n"), data...)
+	} else if config.IgnoreDuplicateIDs {
+		if storage.MessageIDExists(messageID) {
+			logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(origin), "message_id_header": messageID}).
+				Debugf("[smtpd] duplicate message found, ignoring %s", messageID)
+			stats.LogSMTPIgnored()
+			return nil
+		}
+	}
+
+	// if enabled, this may conditionally relay the email through to the preconfigured smtp server
+	relayedTo, relayErr := autoRelayMessage(from, to, &data)
+
+	// build array of all addresses in the header to compare to the []to array
+	emails, hasBccHeader := scanAddressesInHeader(msg.Header)
+
+	missingAddresses := []string{}
+	for _, a := range to {
+		// loop through passed email addresses to check if they are in the headers
+		if _, err := mail.ParseAddress(a); err == nil {
+			_, ok := emails[strings.ToLower(a)]
+			if !ok {
+				missingAddresses = append(missingAddresses, a)
+			}
+		} else {
+			logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(origin), "address": a}).
+				Warnf("[smtpd] ignoring invalid email address: %s", a)
+		}
+	}
+
+	// add missing email addresses to Bcc (eg: Laravel doesn't include these in the headers)
+	if len(missingAddresses) > 0 {
+		if hasBccHeader {
+			// email already has Bcc header, add to existing addresses
+			re := regexp.MustCompile(`(?i)(^|\n)(Bcc: )`)
+			replaced := false
+			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
+				if replaced {
+					return r
+				}
+				replaced = true // only replace first occurrence
+
+				return re.ReplaceAll(r, []byte("${1}Bcc: "+strings.Join(missingAddresses, ", ")+", "))
+			})
+
+		} else {
+			// prepend new Bcc header
+			bcc := []byte(fmt.Sprintf("Bcc: %s\r\n", strings.Join(missingAddresses, ", ")))
+			data = append(bcc, data...)
+		}
+
+		logger.Log().Debugf("[smtpd] added missing addresses to Bcc header: %s", strings.Join(missingAddresses, ", "))
+	}
+
+	if info.BareLF || info.BareCR {
+		logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(origin)}).
+			Debugf("[smtpd] normalised bare <CR> or <LF> line endings in message from %s", cleanIP(origin))
+	}
+
+	id, err := storage.StoreWithOptions(&data, storage.StoreOptions{
+		BareLineEndings: info.BareLF || info.BareCR,
+		TLS:             info.TLS,
+		Authenticated:   info.Authenticated,
+		Via:             info.Protocol,
+		Listener:        info.Listener,
+		From:            from,
+		To:              to,
+		ClientIP:        cleanIP(origin),
+		Helo:            info.Helo,
+		AuthUser:        info.AuthUser,
+		Expires:         expires,
+	})
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldComponent: "db", logger.FieldClientIP: cleanIP(origin), logger.FieldError: err.Error()}).
+			Errorf("[db] error storing message: %s", err.Error())
+		return err
+	}
+
+	stats.LogSMTPAccepted(len(data))
+	logSenderQuota(from)
+
+	data = nil // avoid memory leaks
+
+	subject := msg.Header.Get("Subject")
+	logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(origin), logger.FieldMessageID: id, "from": from, "subject": subject}).
+		Debugf("[smtpd] received (%s) from:%s subject:%q", cleanIP(origin), from, subject)
+
+	if len(relayedTo) > 0 {
+		relayDetails := map[string]string{
+			"to":    strings.Join(relayedTo, ", "),
+			"relay": fmt.Sprintf("%s:%d", config.SMTPRelayConfig.Host, config.SMTPRelayConfig.Port),
+		}
+
+		if relayErr != nil {
+			relayDetails["error"] = relayErr.Error()
+			storage.AddMessageEvent(id, storage.EventRelayFailed, relayDetails)
+		} else {
+			storage.AddMessageEvent(id, storage.EventRelayed, relayDetails)
+		}
+	}
+
+	// only messages relayed to all recipients are considered handled
+	relayed := relayErr == nil && len(relayedTo) > 0 && len(relayedTo) == len(to)
+
+	if OnMessageStored != nil && !(relayed && config.SMTPRelayConfig.DeleteAfterRelease) {
+		OnMessageStored(id)
+	}
+
+	if relayed && config.SMTPRelayConfig.DeleteAfterRelease {
+		// the message has been handled, so is not kept
+		if _, _, err := storage.DeleteMessages([]string{id}); err != nil {
+			logger.WithFields(logger.Fields{logger.FieldComponent: "db", logger.FieldMessageID: id, logger.FieldError: err.Error()}).
+				Errorf("[db] error deleting relayed message: %s", err.Error())
+		} else {
+			logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldMessageID: id}).
+				Debugf("[smtpd] deleted relayed message %s", id)
+		}
+	}
+
+	return nil
+}
+
+func authHandler(remoteAddr net.Addr, mechanism string, username []byte, password []byte, _ []byte) (bool, error) {
+	allow := auth.SMTPCredentials.Match(string(username), string(password))
+	if allow {
+		logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(remoteAddr), "mechanism": mechanism, "username": string(username)}).
+			Debugf("[smtpd] allow %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
+	} else {
+		logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(remoteAddr), "mechanism": mechanism, "username": string(username)}).
+			Warnf("[smtpd] deny %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
+	}
+
+	return allow, nil
+}
+
+// Allow any username and password
+func authHandlerAny(remoteAddr net.Addr, mechanism string, username []byte, _ []byte, _ []byte) (bool, error) {
+	logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(remoteAddr), "mechanism": mechanism, "username": string(username)}).
+		Debugf("[smtpd] allow %s login %q from %s", mechanism, string(username), cleanIP(remoteAddr))
+
+	return true, nil
+}
+
+// Listen starts the SMTPD server
+func Listen() error {
+	if config.SMTPAuthAllowInsecure {
+		if auth.SMTPCredentials != nil {
+			logger.Log().Info("[smtpd] enabling login authentication (insecure)")
+		} else if config.SMTPAuthAcceptAny {
+			logger.Log().Info("[smtpd] enabling any authentication (insecure)")
+		}
+	} else {
+		if auth.SMTPCredentials != nil {
+			logger.Log().Info("[smtpd] enabling login authentication")
+		} else if config.SMTPAuthAcceptAny {
+			logger.Log().Info("[smtpd] enabling any authentication")
+		}
+	}
+
+	smtpType := "no encryption"
+
+	if config.SMTPTLSCert != "" {
+		if config.SMTPRequireSTARTTLS {
+			smtpType = "STARTTLS required"
+		} else if config.SMTPRequireTLS {
+			smtpType = "SSL/TLS required"
+		} else {
+			smtpType = "STARTTLS optional"
+			if !config.SMTPAuthAllowInsecure && auth.SMTPCredentials != nil {
+				smtpType = "STARTTLS required"
+			}
+		}
+
+	}
+
+	logger.Log().Infof("[smtpd] starting on %s (%s)", config.SMTPListen, smtpType)
+
+	config.ConnectionLimitsChanged = setConnectionLimits
+	stats.TrackSMTPConnections(connectionCounts)
+	loadSenderQuotas()
+
+	return listenAndServe(config.SMTPListen, mailHandler, authHandler)
+}
+
+// ListenLMTP starts the LMTP server if enabled. It shares the SMTP server configuration & message handling,
+// so messages are stored, tagged & relayed exactly as if they were received via SMTP, except for TLS which
+// is only offered (via STARTTLS) with its own LMTP certificate.
+func ListenLMTP() error {
+	if config.LMTPListen == "" {
+		return nil
+	}
+
+	srv, err := newServer(config.LMTPListen, mailHandler, authHandler)
+	if err != nil {
+		return err
+	}
+
+	srv.LMTP = true
+	srv.Network = config.LMTPNetwork
+
+	srv.TLSConfig = nil
+	srv.TLSListener = false
+	srv.TLSRequired = false
+	srv.AuthRequireTLS = false
+	if config.LMTPTLSCert != "" {
+		srv.TLSRequired = config.LMTPRequireSTARTTLS
+		srv.AuthRequireTLS = config.SMTPRequireTLSAuth
+		if err := srv.ConfigureTLS(config.LMTPTLSCert, config.LMTPTLSKey); err != nil {
+			return err
+		}
+	}
+
+	if srv.Network == "unix" {
+		// remove a stale socket left by a previous instance
+		if fi, err := os.Stat(srv.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(srv.Addr)
+		}
+	}
+
+	lmtpServer.Store(srv)
+
+	logger.Log().Infof("[lmtp] starting on %s", config.LMTPListen)
+
+	return srv.ListenAndServe()
+}
+
+// LogSession logs the SMTP session (when smtpd.Debug is enabled) via the application logger
+func logSession(remoteIP, verb, line string) {
+	logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: remoteIP, "verb": verb, "line": line}).
+		Debugf("[smtpd] %s %s %s", remoteIP, verb, line)
+}
+
+func listenAndServe(addr string, handler InfoHandler, authHandler AuthHandler) error {
+	srv, err := newServer(addr, handler, authHandler)
+	if err != nil {
+		return err
+	}
+
+	smtpServer.Store(srv)
+
+	return srv.ListenAndServe()
+}
+
+// NewServer returns a server configured from the SMTP settings
+func newServer(addr string, handler InfoHandler, authHandler AuthHandler) (*Server, error) {
+	// log SMTP sessions with verbose logging
+	Debug = logger.VerboseLogging
+
+	srv := &Server{
+		Addr:              addr,
+		InfoHandler:       handler,
+		HandlerRcpt:       handlerRcpt,
+		Appname:           "Mailpit",
+		Hostname:          "",
+		AuthHandler:       nil,
+		AuthRequired:      false,
+		MaxRecipients:     config.SMTPMaxRecipients,
+		MaxMessages:       config.SMTPMaxMessagesPerConnection,
+		MaxSize:           config.MaxMessageSizeBytes,
+		SizeExceeded:      sizeExceeded,
+		DisableReverseDNS: DisableReverseDNS,
+		StrictLineEndings: config.SMTPStrictLineEndings,
+		ConnectionRejected: func(remoteIP, reason string) {
+			logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: remoteIP}).
+				Warnf("[smtpd] rejected connection from %s: %s", remoteIP, reason)
+			stats.LogSMTPConnectionRejected()
+		},
+		LogRead:  logSession,
+		LogWrite: logSession,
+	}
+
+	// the sender quota may be enabled at runtime, so is always checked
+	srv.HandlerSender = handlerSenderQuota
+
+	settings := config.Runtime()
+	srv.SetConnectionLimits(settings.SMTPMaxConnections, settings.SMTPMaxConnectionsPerIP)
+
+	if config.SMTPAuthAllowInsecure {
+		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
+	}
+
+	if auth.SMTPCredentials != nil {
+		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
+		srv.AuthHandler = authHandler
+		srv.AuthRequired = true
+	} else if config.SMTPAuthAcceptAny {
+		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
+		srv.AuthHandler = authHandlerAny
+	}
+
+	if config.SMTPTLSCert != "" {
+		srv.TLSRequired = config.SMTPRequireSTARTTLS
+		srv.TLSListener = config.SMTPRequireTLS // if true overrules srv.TLSRequired
+		srv.AuthRequireTLS = config.SMTPRequireTLSAuth
+		if err := srv.ConfigureTLS(config.SMTPTLSCert, config.SMTPTLSKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return srv, nil
+}
+
+// SizeExceeded logs a message rejected for exceeding the maximum message size
+func sizeExceeded(origin net.Addr, from string, to []string, size int) {
+	logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(origin), "from": from, "to": strings.Join(to, ", "), "size": size}).
+		Warnf("[smtpd] rejected message from %s to %s: size %d exceeds the maximum message size (%d)", from, strings.Join(to, ", "), size, config.MaxMessageSizeBytes)
+	stats.LogSMTPOversize()
+}
+
+// setConnectionLimits applies the maximum number of concurrent SMTP sessions (global and per IP) when changed
+// with the smtp-max-connections runtime settings. New limits apply to new connections only, existing sessions
+// are unaffected.
+func setConnectionLimits(max, perIP int) {
+	if srv := smtpServer.Load(); srv != nil {
+		srv.SetConnectionLimits(max, perIP)
+	}
+
+	if srv := lmtpServer.Load(); srv != nil {
+		srv.SetConnectionLimits(max, perIP)
+	}
+}
+
+// ConnectionCounts returns the open connections of the SMTP & LMTP servers combined, see Server.ConnectionCounts()
+func connectionCounts() (open, ips, maxPerIP int) {
+	for _, srv := range []*Server{smtpServer.Load(), lmtpServer.Load()} {
+		if srv == nil {
+			continue
+		}
+
+		o, i, m := srv.ConnectionCounts()
+		open = open + o
+		ips = ips + i
+		maxPerIP = max(maxPerIP, m)
+	}
+
+	return open, ips, maxPerIP
+}
+
+func cleanIP(i net.Addr) string {
+	parts := strings.Split(i.String(), ":")
+
+	return parts[0]
+}
+
+// Returns a list of all lowercased emails found in To, Cc and Bcc,
+// as well as whether there is a Bcc field
+func scanAddressesInHeader(h mail.Header) (map[string]bool, bool) {
+	emails := make(map[string]bool)
+	hasBccHeader := false
+
+	if recipients, err := h.AddressList("To"); err == nil {
+		for _, r := range recipients {
+			emails[strings.ToLower(r.Address)] = true
+		}
+	}
+
+	if recipients, err := h.AddressList("Cc"); err == nil {
+		for _, r := range recipients {
+			emails[strings.ToLower(r.Address)] = true
+		}
+	}
+
+	recipients, err := h.AddressList("Bcc")
+	if err == nil {
+		for _, r := range recipients {
+			emails[strings.ToLower(r.Address)] = true
+		}
+
+		hasBccHeader = true
+	}
+
+	return emails, hasBccHeader
+}
+
+// RemoveHeader removes a header matching the regular expression from the message headers, but not from the message body
+func removeHeader(data []byte, re *regexp.Regexp) []byte {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i > -1 {
+		return append(re.ReplaceAll(data[:i+2], []byte("$1")), data[i+2:]...)
+	}
+
+	return data
+}
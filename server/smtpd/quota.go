@@ -0,0 +1,248 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/stats"
+	"github.com/axllent/mailpit/internal/storage"
+)
+
+const (
+	// the sender quota window is tracked in this many buckets
+	senderQuotaBuckets = 60
+	// database setting used to persist sender quotas across restarts
+	senderQuotaSetting = "SenderQuotas"
+	// how often sender quotas are persisted
+	senderQuotaPersistInterval = time.Minute
+)
+
+var (
+	errSenderQuotaExceeded = errors.New("452 4.5.3 Too many messages from this sender, try again later")
+
+	senderQuotasMu sync.Mutex
+	senderQuotas   = map[string]*senderUsage{}
+	// whether the sender quotas have changed since they were last persisted
+	senderQuotasChanged bool
+	// sender quotas are loaded & persisted once, regardless of whether the quota is enabled, as it can
+	// be enabled at runtime
+	senderQuotasOnce sync.Once
+)
+
+// SenderUsage is the number of messages from a sender, counted in buckets of
+// the bucket start time (unix seconds)
+type senderUsage struct {
+	Buckets  map[int64]int
+	Rejected int
+}
+
+// SenderQuotaUsage is the quota usage of a sender within the current quota window
+type SenderQuotaUsage struct {
+	// Sender address or domain
+	Sender string
+	// Number of accepted messages within the quota window
+	Messages int
+	// Number of rejected SMTP commands since the sender was first seen
+	Rejected int
+	// Whether the sender has reached the quota
+	Limited bool
+}
+
+// SenderQuotas returns the sender quota usage of all senders within the quota window, ordered by most messages
+func SenderQuotas() []SenderQuotaUsage {
+	senderQuotasMu.Lock()
+	defer senderQuotasMu.Unlock()
+
+	results := []SenderQuotaUsage{}
+	now := time.Now()
+	quota := config.Runtime().SMTPSenderQuota
+
+	for sender, u := range senderQuotas {
+		n := u.count(now)
+		if n == 0 && u.Rejected == 0 {
+			continue
+		}
+
+		results = append(results, SenderQuotaUsage{
+			Sender:   sender,
+			Messages: n,
+			Rejected: u.Rejected,
+			Limited:  n >= quota,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Messages == results[j].Messages {
+			return results[i].Sender < results[j].Sender
+		}
+		return results[i].Messages > results[j].Messages
+	})
+
+	return results
+}
+
+// HandlerSenderQuota rejects RCPT & DATA commands from senders who have reached the sender quota
+func handlerSenderQuota(remoteAddr net.Addr, from string) error {
+	key, ok := senderQuotaKey(from)
+	if !ok {
+		return nil
+	}
+
+	senderQuotasMu.Lock()
+	defer senderQuotasMu.Unlock()
+
+	u, ok := senderQuotas[key]
+	if !ok || u.count(time.Now()) < config.Runtime().SMTPSenderQuota {
+		return nil
+	}
+
+	u.Rejected++
+	senderQuotasChanged = true
+	stats.LogSMTPQuotaRejected()
+
+	logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(remoteAddr), "from": from}).
+		Warnf("[smtpd] rejected message from %s (%s): sender quota exceeded", from, cleanIP(remoteAddr))
+
+	return errSenderQuotaExceeded
+}
+
+// LogSenderQuota counts an accepted message towards the sender quota
+func logSenderQuota(from string) {
+	key, ok := senderQuotaKey(from)
+	if !ok {
+		return
+	}
+
+	senderQuotasMu.Lock()
+	defer senderQuotasMu.Unlock()
+
+	u, ok := senderQuotas[key]
+	if !ok {
+		u = &senderUsage{Buckets: map[int64]int{}}
+		senderQuotas[key] = u
+	}
+
+	u.Buckets[senderQuotaBucket(time.Now())]++
+	senderQuotasChanged = true
+}
+
+// SenderQuotaKey returns the quota key of a sender, and false if the sender is not subject to the quota
+func senderQuotaKey(from string) (string, bool) {
+	if config.Runtime().SMTPSenderQuota <= 0 {
+		return "", false
+	}
+
+	if config.SMTPSenderQuotaExemptRegexp != nil && config.SMTPSenderQuotaExemptRegexp.MatchString(from) {
+		return "", false
+	}
+
+	key := strings.ToLower(strings.TrimSpace(from))
+	if key == "" {
+		// null sender (bounces)
+		return "<>", true
+	}
+
+	if config.SMTPSenderQuotaBy == "domain" {
+		if i := strings.LastIndex(key, "@"); i > -1 {
+			key = key[i+1:]
+		}
+	}
+
+	return key, true
+}
+
+func senderQuotaBucketSize() int64 {
+	size := int64(config.Runtime().SMTPSenderQuotaWindow.Seconds()) / senderQuotaBuckets
+	if size < 1 {
+		return 1
+	}
+
+	return size
+}
+
+// SenderQuotaBucket returns the start time (unix seconds) of the bucket for a time
+func senderQuotaBucket(t time.Time) int64 {
+	size := senderQuotaBucketSize()
+
+	return t.Unix() / size * size
+}
+
+// Count returns the number of messages within the quota window, removing expired buckets
+func (u *senderUsage) count(now time.Time) int {
+	oldest := senderQuotaBucket(now.Add(-config.Runtime().SMTPSenderQuotaWindow))
+	n := 0
+
+	for b, c := range u.Buckets {
+		if b <= oldest {
+			delete(u.Buckets, b)
+			continue
+		}
+		n = n + c
+	}
+
+	return n
+}
+
+// LoadSenderQuotas loads the persisted sender quotas, and periodically persists them
+// so an ongoing flood is not forgotten on restart. Subsequent calls are ignored.
+func loadSenderQuotas() {
+	senderQuotasOnce.Do(func() {
+		senderQuotasMu.Lock()
+		if s := storage.SettingGet(senderQuotaSetting); s != "" {
+			loaded := map[string]*senderUsage{}
+			if err := json.Unmarshal([]byte(s), &loaded); err != nil {
+				logger.Log().Warnf("[smtpd] error loading sender quotas: %s", err.Error())
+			} else {
+				for k, u := range loaded {
+					if u.Buckets == nil {
+						u.Buckets = map[int64]int{}
+					}
+					senderQuotas[k] = u
+				}
+			}
+		}
+		senderQuotasMu.Unlock()
+
+		go func() {
+			for range time.Tick(senderQuotaPersistInterval) {
+				persistSenderQuotas()
+			}
+		}()
+	})
+}
+
+// PersistSenderQuotas saves the sender quotas (if changed) to the database, removing inactive senders
+func persistSenderQuotas() {
+	senderQuotasMu.Lock()
+	if !senderQuotasChanged {
+		senderQuotasMu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	for k, u := range senderQuotas {
+		if u.count(now) == 0 {
+			delete(senderQuotas, k)
+		}
+	}
+
+	b, err := json.Marshal(senderQuotas)
+	senderQuotasChanged = false
+	senderQuotasMu.Unlock()
+
+	if err != nil {
+		logger.Log().Errorf("[smtpd] error saving sender quotas: %s", err.Error())
+		return
+	}
+
+	if err := storage.SettingPut(senderQuotaSetting, string(b)); err != nil {
+		logger.Log().Errorf("[smtpd] error saving sender quotas: %s", err.Error())
+	}
+}
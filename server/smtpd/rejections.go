@@ -0,0 +1,96 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/stats"
+)
+
+// the number of recent recipient rejections kept in memory
+const recipientRejectionsSize = 100
+
+var (
+	recipientRejectionsMu sync.Mutex
+	// ring of the most recent recipient rejections, recipientRejectionsNext being the next slot
+	recipientRejections     [recipientRejectionsSize]RecipientRejection
+	recipientRejectionsNext int
+	// total number of recipient rejections since startup
+	recipientRejectionsTotal int
+)
+
+// RecipientRejection is a recipient rejected at RCPT TO by a recipient policy
+type RecipientRejection struct {
+	// Time of the rejection
+	Time time.Time
+	// Client IP address
+	ClientIP string
+	// SMTP envelope sender
+	From string
+	// Rejected recipient
+	To string
+	// The policy rejecting the recipient, smtp-allowed-recipients or smtp-denied-recipients
+	Policy string
+}
+
+// RecipientRejections is the total & most recent recipient rejections
+//
+// swagger:model RecipientRejections
+type RecipientRejections struct {
+	// Total number of rejected recipients since Mailpit was started
+	Total int
+	// The most recent rejections (up to 100), newest first
+	Rejections []RecipientRejection
+}
+
+// GetRecipientRejections returns the total & most recent recipient rejections, newest first
+func GetRecipientRejections() RecipientRejections {
+	recipientRejectionsMu.Lock()
+	defer recipientRejectionsMu.Unlock()
+
+	res := RecipientRejections{Total: recipientRejectionsTotal, Rejections: []RecipientRejection{}}
+
+	for i := 1; i <= min(recipientRejectionsTotal, recipientRejectionsSize); i++ {
+		res.Rejections = append(res.Rejections, recipientRejections[(recipientRejectionsNext-i+recipientRejectionsSize)%recipientRejectionsSize])
+	}
+
+	return res
+}
+
+// HandlerRcpt rejects recipients based on `--smtp-allowed-recipients` & `--smtp-denied-recipients`,
+// the denied recipients taking precedence
+func handlerRcpt(remoteAddr net.Addr, from string, to string) error {
+	settings := config.Runtime()
+	policy := ""
+	if settings.SMTPDeniedRecipientsRegexp != nil && settings.SMTPDeniedRecipientsRegexp.MatchString(to) {
+		policy = "smtp-denied-recipients"
+	} else if settings.SMTPAllowedRecipientsRegexp != nil && !settings.SMTPAllowedRecipientsRegexp.MatchString(to) {
+		policy = "smtp-allowed-recipients"
+	}
+
+	if policy == "" {
+		return nil
+	}
+
+	logger.WithFields(logger.Fields{logger.FieldComponent: "smtpd", logger.FieldClientIP: cleanIP(remoteAddr), "from": from, "to": to, "policy": policy}).
+		Warnf("[smtpd] rejected message to %s from %s (%s): %s", to, from, cleanIP(remoteAddr), policy)
+	stats.LogSMTPRejected()
+
+	recipientRejectionsMu.Lock()
+	recipientRejections[recipientRejectionsNext] = RecipientRejection{
+		Time:     time.Now(),
+		ClientIP: cleanIP(remoteAddr),
+		From:     from,
+		To:       to,
+		Policy:   policy,
+	}
+	recipientRejectionsNext = (recipientRejectionsNext + 1) % recipientRejectionsSize
+	recipientRejectionsTotal++
+	recipientRejectionsMu.Unlock()
+
+	return fmt.Errorf("550 5.7.1 Recipient <%s> rejected by the %s policy", to, policy)
+}
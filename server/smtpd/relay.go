@@ -1,41 +1,85 @@
 package smtpd
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 )
 
-func autoRelayMessage(from string, to []string, data *[]byte) {
-	if len(to) == 0 {
-		return
+// AutoRelayMessage conditionally relays a message via the pre-configured SMTP server, returning
+// the recipients the message was relayed to (if any) and any relay error.
+func autoRelayMessage(from string, to []string, data *[]byte) ([]string, error) {
+	settings := config.Runtime()
+	if len(to) == 0 || settings.SMTPRelayPaused {
+		return nil, nil
 	}
 
-	if config.SMTPRelayAll {
-		if err := Send(from, to, *data); err != nil {
-			logger.Log().Errorf("[smtp] error relaying message: %s", err.Error())
-		} else {
-			logger.Log().Debugf("[smtp] auto-relay message to %s from %s via %s:%d",
-				strings.Join(to, ", "), from, config.SMTPRelayConfig.Host, config.SMTPRelayConfig.Port)
-		}
-	} else if config.SMTPRelayMatchingRegexp != nil {
-		filtered := []string{}
-		for _, t := range to {
-			if config.SMTPRelayMatchingRegexp.MatchString(t) {
-				filtered = append(filtered, t)
-			}
-		}
+	recipients := []string{}
 
-		if len(filtered) == 0 {
-			return
+	for _, t := range to {
+		if !settings.SMTPRelayAll && (settings.SMTPRelayMatchingRegexp == nil || !settings.SMTPRelayMatchingRegexp.MatchString(t)) {
+			continue
 		}
 
-		if err := Send(from, filtered, *data); err != nil {
-			logger.Log().Errorf("[smtp] error relaying message: %s", err.Error())
-		} else {
-			logger.Log().Debugf("[smtp] auto-relay message to %s from %s via %s:%d",
-				strings.Join(filtered, ", "), from, config.SMTPRelayConfig.Host, config.SMTPRelayConfig.Port)
+		if err := CheckBlockedRecipient(&config.SMTPRelayConfig, t); err != nil {
+			logger.WithFields(relayFields(&config.SMTPRelayConfig, from, []string{t}, err)).Errorf("[smtp] not auto-relaying message: %s", err.Error())
+			continue
 		}
+
+		recipients = append(recipients, t)
+	}
+
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	if err := Send(from, recipients, *data); err != nil {
+		logger.WithFields(relayFields(&config.SMTPRelayConfig, from, recipients, err)).Errorf("[smtp] error relaying message: %s", err.Error())
+		return recipients, err
+	}
+
+	logger.WithFields(relayFields(&config.SMTPRelayConfig, from, recipients, nil)).Debugf("[smtp] auto-relay message to %s from %s via %s:%d",
+		strings.Join(recipients, ", "), from, config.SMTPRelayConfig.Host, config.SMTPRelayConfig.Port)
+
+	return recipients, nil
+}
+
+// CheckBlockedRecipient returns an error naming the address if it matches the recipient blocklist of a relay
+// profile, which takes precedence over the allowlist. The address is also matched with a lowercase domain so
+// blocked domains cannot be bypassed by their case.
+func CheckBlockedRecipient(relay *config.SMTPRelayConfigStruct, address string) error {
+	re := relay.BlockedRecipientsRegexp
+	if re == nil {
+		return nil
 	}
+
+	normalized := address
+	if i := strings.LastIndex(address, "@"); i > -1 {
+		normalized = address[:i] + strings.ToLower(address[i:])
+	}
+
+	if re.MatchString(address) || re.MatchString(normalized) {
+		return errors.New("Mail address is blocked from being relayed: " + address)
+	}
+
+	return nil
+}
+
+// RelayFields returns the structured log fields of a relayed message
+func relayFields(relay *config.SMTPRelayConfigStruct, from string, to []string, err error) logger.Fields {
+	f := logger.Fields{
+		logger.FieldComponent: "smtp",
+		"from":                from,
+		"to":                  to,
+		"relay":               fmt.Sprintf("%s:%d", relay.Host, relay.Port),
+	}
+
+	if err != nil {
+		f[logger.FieldError] = err.Error()
+	}
+
+	return f
 }
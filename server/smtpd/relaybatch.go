@@ -0,0 +1,120 @@
+package smtpd
+
+import (
+	"net/smtp"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+// RelayBatch sends multiple messages via a relay profile over a single connection, limited
+// to `release-rate-limit` messages per second if set in the relay config. Pooled connections
+// are used instead if connection pooling is enabled for the relay profile.
+type RelayBatch struct {
+	relay    *config.SMTPRelayConfigStruct
+	client   *smtp.Client
+	interval time.Duration
+	last     time.Time
+}
+
+// NewRelayBatch returns a new RelayBatch for a relay profile, which must be closed once all messages have been sent
+func NewRelayBatch(relay *config.SMTPRelayConfigStruct) *RelayBatch {
+	b := &RelayBatch{relay: relay}
+
+	if config.SMTPRelayConfig.ReleaseRateLimit > 0 {
+		b.interval = time.Second / time.Duration(config.SMTPRelayConfig.ReleaseRateLimit)
+	}
+
+	return b
+}
+
+// Send sends a message, reusing the batch connection. If the relay has closed the connection
+// then the message is retried once over a new connection, provided the message data had not yet been sent.
+// Other temporary failures are retried according to the `retry-count` of the relay profile, and any
+// error is returned as a *RelayError.
+func (b *RelayBatch) Send(from string, to []string, msg []byte) error {
+	b.wait()
+
+	return retryRelay(b.relay, from, to, func() error {
+		return b.send(from, to, msg)
+	})
+}
+
+// Send sends a message once, reusing the batch connection
+func (b *RelayBatch) send(from string, to []string, msg []byte) error {
+	if b.relay.PoolSize > 0 {
+		return getRelayPool(b.relay).send(from, to, msg)
+	}
+
+	reused := b.client != nil
+	if reused {
+		if err := b.client.Reset(); err != nil {
+			b.discard()
+			reused = false
+		}
+	}
+
+	if b.client == nil {
+		c, err := relayDial(b.relay)
+		if err != nil {
+			return err
+		}
+		b.client = c
+	}
+
+	dataSent, err := relayTransaction(b.client, from, to, msg)
+	if err != nil && reused && !dataSent && isConnectionError(err) {
+		logger.WithFields(relayFields(b.relay, from, to, err)).Debugf("[smtp] relay connection closed by server, reconnecting: %s", err.Error())
+		b.discard()
+
+		c, err := relayDial(b.relay)
+		if err != nil {
+			return err
+		}
+		b.client = c
+
+		_, err = relayTransaction(b.client, from, to, msg)
+		if err != nil && isConnectionError(err) {
+			b.discard()
+		}
+
+		return err
+	}
+
+	if err != nil && isConnectionError(err) {
+		b.discard()
+	}
+
+	return err
+}
+
+// Close closes the batch connection
+func (b *RelayBatch) Close() {
+	if b.client == nil {
+		return
+	}
+
+	if err := b.client.Quit(); err != nil {
+		_ = b.client.Close()
+	}
+
+	b.client = nil
+}
+
+// Wait blocks until the next message may be sent according to the rate limit
+func (b *RelayBatch) wait() {
+	if b.interval > 0 && !b.last.IsZero() {
+		if d := b.interval - time.Since(b.last); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	b.last = time.Now()
+}
+
+// Discard closes a broken batch connection
+func (b *RelayBatch) discard() {
+	_ = b.client.Close()
+	b.client = nil
+}
@@ -0,0 +1,315 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+	"github.com/axllent/mailpit/internal/stats"
+)
+
+var (
+	relayPoolMu sync.Mutex
+	// relay pools by relay profile name
+	relayPools = map[string]*relayPool{}
+)
+
+// RelayPool keeps up to size authenticated connections to the SMTP relay open for reuse
+type relayPool struct {
+	mu          sync.Mutex
+	relay       *config.SMTPRelayConfigStruct
+	size        int
+	idleTimeout time.Duration
+	idle        []*pooledConn
+	// all open connections, both idle & in use
+	open int
+	// limits the number of concurrent connections to size
+	slots chan struct{}
+	done  chan struct{}
+	// closed pools no longer accept connections back
+	closed bool
+
+	reused     int
+	reconnects int
+}
+
+type pooledConn struct {
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+// GetRelayPool returns the pool of a relay profile, creating a new one if the pool settings have changed
+func getRelayPool(relay *config.SMTPRelayConfigStruct) *relayPool {
+	relayPoolMu.Lock()
+	defer relayPoolMu.Unlock()
+
+	size := relay.PoolSize
+	idleTimeout := time.Duration(relay.PoolIdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = 30 * time.Second
+	}
+
+	p := relayPools[relay.Name]
+	if p != nil && p.relay == relay && p.size == size && p.idleTimeout == idleTimeout {
+		return p
+	}
+
+	if p != nil {
+		p.close()
+	}
+
+	p = newRelayPool(relay, size, idleTimeout)
+	relayPools[relay.Name] = p
+
+	return p
+}
+
+func newRelayPool(relay *config.SMTPRelayConfigStruct, size int, idleTimeout time.Duration) *relayPool {
+	p := &relayPool{
+		relay:       relay,
+		size:        size,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, size),
+		done:        make(chan struct{}),
+	}
+
+	go p.closeIdle()
+
+	return p
+}
+
+// Send a message using a pooled connection. A reused connection is reset with RSET before use, and if
+// the relay has closed it then the message is transparently retried once over a new connection,
+// provided the message data had not yet been sent.
+func (p *relayPool) send(from string, to []string, msg []byte) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	pc, reused, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	dataSent, err := relayTransaction(pc.client, from, to, msg)
+	if err != nil && reused && !dataSent && isConnectionError(err) {
+		logger.WithFields(relayFields(p.relay, from, to, err)).Debugf("[smtp] relay connection closed by server, reconnecting: %s", err.Error())
+		p.discard(pc)
+		p.logReconnect()
+		reused = false
+
+		if pc, err = p.dial(); err != nil {
+			return err
+		}
+
+		_, err = relayTransaction(pc.client, from, to, msg)
+	}
+
+	if err != nil {
+		if isConnectionError(err) {
+			p.discard(pc)
+		} else {
+			// the connection is still usable, it is reset before it is next used
+			p.put(pc)
+		}
+		return err
+	}
+
+	if reused {
+		p.logReuse()
+	}
+
+	p.put(pc)
+
+	return nil
+}
+
+// Get returns an idle connection if one is available (reset with RSET), otherwise a new connection.
+// The returned bool is whether an existing connection is being reused.
+func (p *relayPool) get() (*pooledConn, bool, error) {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+
+		// most recently used connection
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(pc.lastUsed) > p.idleTimeout {
+			p.discard(pc)
+			continue
+		}
+
+		if err := pc.client.Reset(); err != nil {
+			logger.WithFields(logger.Fields{logger.FieldComponent: "smtp", logger.FieldError: err.Error()}).
+				Debugf("[smtp] pooled relay connection no longer usable, reconnecting: %s", err.Error())
+			p.discard(pc)
+			p.logReconnect()
+			continue
+		}
+
+		return pc, true, nil
+	}
+
+	pc, err := p.dial()
+
+	return pc, false, err
+}
+
+// Dial opens a new relay connection which is counted towards the open pool connections
+func (p *relayPool) dial() (*pooledConn, error) {
+	c, err := relayDial(p.relay)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.open++
+	open := p.open
+	p.mu.Unlock()
+
+	stats.SetRelayConnections(open)
+	logger.Log().Debugf("[smtp] opened relay connection to %s:%d (%d open)", p.relay.Host, p.relay.Port, open)
+
+	return &pooledConn{client: c, lastUsed: time.Now()}, nil
+}
+
+// Put returns a connection to the pool, or closes it if the pool is full or closed
+func (p *relayPool) put(pc *pooledConn) {
+	pc.lastUsed = time.Now()
+
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.size {
+		p.mu.Unlock()
+		p.quit(pc)
+		return
+	}
+
+	p.idle = append(p.idle, pc)
+	p.mu.Unlock()
+}
+
+// Quit politely closes a connection which is still usable
+func (p *relayPool) quit(pc *pooledConn) {
+	if err := pc.client.Quit(); err != nil {
+		_ = pc.client.Close()
+	}
+
+	p.forget()
+}
+
+// Discard closes a broken connection
+func (p *relayPool) discard(pc *pooledConn) {
+	_ = pc.client.Close()
+
+	p.forget()
+}
+
+func (p *relayPool) forget() {
+	p.mu.Lock()
+	p.open--
+	open := p.open
+	p.mu.Unlock()
+
+	stats.SetRelayConnections(open)
+}
+
+func (p *relayPool) logReuse() {
+	p.mu.Lock()
+	p.reused++
+	open, reused, reconnects := p.open, p.reused, p.reconnects
+	p.mu.Unlock()
+
+	stats.LogRelayReused()
+	logger.Log().Debugf("[smtp] reused relay connection (%d open, %d reused, %d reconnects)", open, reused, reconnects)
+}
+
+func (p *relayPool) logReconnect() {
+	p.mu.Lock()
+	p.reconnects++
+	p.mu.Unlock()
+
+	stats.LogRelayReconnect()
+}
+
+// CloseIdle periodically closes connections which have been idle for longer than the idle timeout
+func (p *relayPool) closeIdle() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			expired := []*pooledConn{}
+			active := []*pooledConn{}
+			for _, pc := range p.idle {
+				if time.Since(pc.lastUsed) > p.idleTimeout {
+					expired = append(expired, pc)
+				} else {
+					active = append(active, pc)
+				}
+			}
+			p.idle = active
+			p.mu.Unlock()
+
+			for _, pc := range expired {
+				p.quit(pc)
+			}
+
+			if len(expired) > 0 {
+				logger.Log().Debugf("[smtp] closed %d idle relay connection(s)", len(expired))
+			}
+		}
+	}
+}
+
+// Close all idle connections & stop the pool. Connections in use are closed when they are returned.
+func (p *relayPool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.done)
+
+	for _, pc := range idle {
+		p.quit(pc)
+	}
+}
+
+// IsConnectionError returns whether an error is caused by the relay connection being closed or broken,
+// rather than by the relay rejecting a command
+func isConnectionError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	// 421 Service not available, closing transmission channel
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code == 421
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,117 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+var (
+	// relayRetryDelay is the delay before the first retry, doubled for each subsequent retry
+	relayRetryDelay = time.Second
+	// relayRetryMaxDelay is the maximum delay between retries
+	relayRetryMaxDelay = 30 * time.Second
+)
+
+// RelayError is returned when a message could not be relayed, distinguishing temporary
+// failures (connection errors & 4xx responses) from permanent 5xx rejections
+type RelayError struct {
+	// Err is the last relay error
+	Err error
+	// Permanent is whether the relay permanently rejected the message
+	Permanent bool
+	// DataSent is whether the error occurred after the message data was sent, in which case the
+	// message may have been delivered and is not retried
+	DataSent bool
+	// Attempts is the number of times the message was sent
+	Attempts int
+}
+
+func (e *RelayError) Error() string {
+	if e.Permanent {
+		return fmt.Sprintf("permanent error: %s", e.Err.Error())
+	}
+
+	if e.DataSent {
+		return fmt.Sprintf("error after sending message data: %s", e.Err.Error())
+	}
+
+	if e.Attempts > 1 {
+		return fmt.Sprintf("temporary error after %d attempts: %s", e.Attempts, e.Err.Error())
+	}
+
+	return fmt.Sprintf("temporary error: %s", e.Err.Error())
+}
+
+func (e *RelayError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary returns whether the message may be relayed if sent again later
+func (e *RelayError) Temporary() bool {
+	return !e.Permanent && !e.DataSent
+}
+
+// RetryRelay calls send until it succeeds, the error is not temporary, or `retry-count` retries of the
+// relay profile have been made, with an exponential backoff between attempts. Only connection errors &
+// 4xx responses before the message data is sent are retried. Any error is returned as a *RelayError.
+func retryRelay(relay *config.SMTPRelayConfigStruct, from string, to []string, send func() error) error {
+	delay := relayRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil {
+			if attempt > 1 {
+				logger.WithFields(relayFields(relay, from, to, nil)).Infof("[smtp] relayed message after %d attempts", attempt)
+			}
+			return nil
+		}
+
+		var dsErr *dataSentError
+		rErr := &RelayError{Err: err, Permanent: isPermanentRelayError(err), DataSent: errors.As(err, &dsErr), Attempts: attempt}
+		if !rErr.Temporary() || !isRetryableRelayError(err) || attempt > relay.RetryCount {
+			return rErr
+		}
+
+		logger.WithFields(relayFields(relay, from, to, err)).
+			Warnf("[smtp] temporary relay error (attempt %d of %d), retrying in %s: %s", attempt, relay.RetryCount+1, delay, err.Error())
+
+		time.Sleep(delay)
+
+		delay = min(delay*2, relayRetryMaxDelay)
+	}
+}
+
+// IsPermanentRelayError returns whether a relay error is a permanent (5xx) rejection. Connection
+// errors & 4xx responses are temporary, as are errors without an SMTP response (eg: a failed connection).
+func isPermanentRelayError(err error) bool {
+	if errors.Is(err, ErrSMTPUTF8NotSupported) {
+		return true
+	}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 500
+	}
+
+	// an untrusted certificate will not become trusted by retrying
+	var certErr *tls.CertificateVerificationError
+
+	return errors.As(err, &certErr)
+}
+
+// IsRetryableRelayError returns whether a relay error may be retried immediately, ie: a connection error or
+// a 4xx response
+func isRetryableRelayError(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 400 && tpErr.Code < 500
+	}
+
+	return isConnectionError(err)
+}
@@ -5,80 +5,221 @@ import (
 	"errors"
 	"fmt"
 	"net/smtp"
+	"net/textproto"
+	"unicode/utf8"
 
 	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 )
 
-// Send will connect to a pre-configured SMTP server and send a message to one or more recipients.
+// ErrSMTPUTF8NotSupported is returned when relaying to or from an internationalised (UTF-8) email address
+// via a relay server which does not support the SMTPUTF8 extension (RFC 6531)
+var ErrSMTPUTF8NotSupported = errors.New("the relay server does not support SMTPUTF8, required for internationalised email addresses")
+
+// Send will connect to the pre-configured SMTP server and send a message to one or more recipients.
+// If relay connection pooling is enabled then an existing connection is reused where possible.
+// Failed messages are not retried as this is used to auto-relay messages during the SMTP transaction.
 func Send(from string, to []string, msg []byte) error {
-	addr := fmt.Sprintf("%s:%d", config.SMTPRelayConfig.Host, config.SMTPRelayConfig.Port)
+	return relaySend(&config.SMTPRelayConfig, from, to, msg)
+}
 
-	c, err := smtp.Dial(addr)
+// SendVia sends a message to one or more recipients via a relay profile, see config.RelayProfile.
+// Temporary failures are retried according to the `retry-count` of the relay profile, and any
+// error is returned as a *RelayError.
+func SendVia(relay *config.SMTPRelayConfigStruct, from string, to []string, msg []byte) error {
+	return retryRelay(relay, from, to, func() error {
+		return relaySend(relay, from, to, msg)
+	})
+}
+
+// RelaySend sends a message once via a relay profile
+func relaySend(relay *config.SMTPRelayConfigStruct, from string, to []string, msg []byte) error {
+	if relay.PoolSize > 0 {
+		return getRelayPool(relay).send(from, to, msg)
+	}
+
+	c, err := relayDial(relay)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	if _, err := relayTransaction(c, from, to, msg); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// ProbeVia checks whether the SMTP server of a relay profile would accept a message from the sender to each of the
+// recipients, without sending any message data. The transaction is reset with RSET after the RCPT commands. The RCPT
+// error of each rejected recipient is returned, and an error if the connection, authentication or MAIL command fails.
+func ProbeVia(relay *config.SMTPRelayConfigStruct, from string, to []string) (map[string]error, error) {
+	c, err := relayDial(relay)
 	if err != nil {
-		return fmt.Errorf("error connecting to %s: %s", addr, err.Error())
+		return nil, err
 	}
 
 	defer c.Close()
 
-	if config.SMTPRelayConfig.STARTTLS {
-		conf := &tls.Config{ServerName: config.SMTPRelayConfig.Host} // #nosec
+	if err := checkSMTPUTF8(c, from, to); err != nil {
+		return nil, err
+	}
+
+	if err := c.Mail(from); err != nil {
+		return nil, fmt.Errorf("error response to MAIL command: %w", err)
+	}
 
-		conf.InsecureSkipVerify = config.SMTPRelayConfig.AllowInsecure
+	rejected := map[string]error{}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			if isConnectionError(err) {
+				return nil, fmt.Errorf("error response to RCPT command: %w", err)
+			}
+			rejected[addr] = err
+		}
+	}
+
+	if err := c.Reset(); err != nil {
+		return rejected, nil
+	}
+
+	_ = c.Quit()
+
+	return rejected, nil
+}
+
+// RelayDial connects to the SMTP server of a relay profile, negotiating STARTTLS & authentication if configured
+func relayDial(relay *config.SMTPRelayConfigStruct) (*smtp.Client, error) {
+	addr := fmt.Sprintf("%s:%d", relay.Host, relay.Port)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", addr, err)
+	}
+
+	if relay.STARTTLS {
+		conf := &tls.Config{ServerName: relay.Host} // #nosec
+
+		conf.InsecureSkipVerify = relay.AllowInsecure
 
 		if err = c.StartTLS(conf); err != nil {
-			return fmt.Errorf("error creating StartTLS config: %s", err.Error())
+			c.Close()
+			return nil, fmt.Errorf("error creating StartTLS config: %w", err)
 		}
 	}
 
-	auth := relayAuthFromConfig()
+	auth := relayAuthFromConfig(relay)
 
 	if auth != nil {
 		if err = c.Auth(auth); err != nil {
-			return fmt.Errorf("error response to AUTH command: %s", err.Error())
+			c.Close()
+			return nil, fmt.Errorf("error response to AUTH command: %w", err)
 		}
 	}
 
-	if err = c.Mail(from); err != nil {
-		return fmt.Errorf("error response to MAIL command: %s", err.Error())
+	return c, nil
+}
+
+// RelayTransaction sends a single message over an established connection. The returned bool is
+// whether the message data was written, after which it is unsafe to retry the message.
+func relayTransaction(c *smtp.Client, from string, to []string, msg []byte) (bool, error) {
+	if err := checkSMTPUTF8(c, from, to); err != nil {
+		return false, err
+	}
+
+	if err := c.Mail(from); err != nil {
+		return false, fmt.Errorf("error response to MAIL command: %w", err)
 	}
 
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			logger.Log().Warnf("error response to RCPT command for %s: %s", addr, err.Error())
+		if err := c.Rcpt(addr); err != nil {
+			if isConnectionError(err) {
+				return false, fmt.Errorf("error response to RCPT command: %w", err)
+			}
+			logger.WithFields(logger.Fields{logger.FieldComponent: "smtp", "to": addr, logger.FieldError: err.Error()}).
+				Warnf("error response to RCPT command for %s: %s", addr, err.Error())
 		}
 	}
 
 	w, err := c.Data()
 	if err != nil {
-		return fmt.Errorf("error response to DATA command: %s", err.Error())
+		return false, fmt.Errorf("error response to DATA command: %w", err)
 	}
 
 	if _, err := w.Write(msg); err != nil {
-		return fmt.Errorf("error sending message: %s", err.Error())
+		return true, &dataSentError{fmt.Errorf("error sending message: %w", err)}
 	}
 
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("error closing connection: %s", err.Error())
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			// the relay responded to the message data, so the message was not delivered
+			return true, fmt.Errorf("error closing connection: %w", err)
+		}
+		return true, &dataSentError{fmt.Errorf("error closing connection: %w", err)}
 	}
 
-	return c.Quit()
+	return true, nil
+}
+
+// DataSentError is a relay error after the message data was (at least partially) written without a
+// response from the relay, so the message may have been delivered
+type dataSentError struct {
+	err error
+}
+
+func (e *dataSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dataSentError) Unwrap() error {
+	return e.err
+}
+
+// CheckSMTPUTF8 returns an error if the sender or any of the recipients is an internationalised (UTF-8) email address
+// and the relay server does not support SMTPUTF8. The net/smtp client adds the SMTPUTF8 parameter to the MAIL command
+// if the server supports it.
+func checkSMTPUTF8(c *smtp.Client, from string, to []string) error {
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		return nil
+	}
+
+	for _, addr := range append([]string{from}, to...) {
+		if !isASCII(addr) {
+			return fmt.Errorf("%w: %s", ErrSMTPUTF8NotSupported, addr)
+		}
+	}
+
+	return nil
+}
+
+// IsASCII returns whether a string only contains ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
 }
 
-// Return the SMTP relay authentication based on config
-func relayAuthFromConfig() smtp.Auth {
+// Return the SMTP relay authentication based on the relay profile
+func relayAuthFromConfig(relay *config.SMTPRelayConfigStruct) smtp.Auth {
 	var a smtp.Auth
 
-	if config.SMTPRelayConfig.Auth == "plain" {
-		a = smtp.PlainAuth("", config.SMTPRelayConfig.Username, config.SMTPRelayConfig.Password, config.SMTPRelayConfig.Host)
+	if relay.Auth == "plain" {
+		a = smtp.PlainAuth("", relay.Username, relay.Password, relay.Host)
 	}
 
-	if config.SMTPRelayConfig.Auth == "login" {
-		a = LoginAuth(config.SMTPRelayConfig.Username, config.SMTPRelayConfig.Password)
+	if relay.Auth == "login" {
+		a = LoginAuth(relay.Username, relay.Password)
 	}
 
-	if config.SMTPRelayConfig.Auth == "cram-md5" {
-		a = smtp.CRAMMD5Auth(config.SMTPRelayConfig.Username, config.SMTPRelayConfig.Secret)
+	if relay.Auth == "cram-md5" {
+		a = smtp.CRAMMD5Auth(relay.Username, relay.Secret)
 	}
 
 	return a
@@ -1,278 +1,1327 @@
-// Package smtpd is the SMTP daemon
+// Portions of this file are derived from https://github.com/mhale/smtpd, used under the MIT License:
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2016 Mark Hale
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package smtpd implements a basic SMTP server.
+//
+// This is a modified version of https://github.com/mhale/smtpd to
+// add support for connection limits and other Mailpit-specific features.
 package smtpd
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
-	"net/mail"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/axllent/mailpit/config"
-	"github.com/axllent/mailpit/internal/auth"
-	"github.com/axllent/mailpit/internal/logger"
-	"github.com/axllent/mailpit/internal/stats"
-	"github.com/axllent/mailpit/internal/storage"
-	"github.com/lithammer/shortuuid/v4"
-	"github.com/mhale/smtpd"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	// DisableReverseDNS allows rDNS to be disabled
-	DisableReverseDNS bool
+	// Debug `true` enables verbose logging.
+	Debug      = false
+	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<(.+)>`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s?<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
+	responseRE = regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)         // an SMTP response returned as an error by a handler
 )
 
-func mailHandler(origin net.Addr, from string, to []string, data []byte) error {
-	if !config.SMTPStrictRFCHeaders {
-		// replace all <CR><CR><LF> (\r\r\n) with <CR><LF> (\r\n)
-		// @see https://github.com/axllent/mailpit/issues/87 & https://github.com/axllent/mailpit/issues/153
-		data = bytes.ReplaceAll(data, []byte("\r\r\n"), []byte("\r\n"))
+// Handler function called upon successful receipt of an email.
+type Handler func(remoteAddr net.Addr, from string, to []string, data []byte) error
+
+// HandlerRcpt function called on RCPT. Return a non-nil error to reject the recipient, either an SMTP
+// response or any other error for a generic 550 response.
+type HandlerRcpt func(remoteAddr net.Addr, from string, to string) error
+
+// HandlerSender function called on RCPT and DATA. Return a non-nil error (an SMTP response) to reject the command.
+type HandlerSender func(remoteAddr net.Addr, from string) error
+
+// InfoHandler function called upon successful receipt of an email, including additional details about the message.
+// If set, it is used instead of Handler.
+type InfoHandler func(remoteAddr net.Addr, from string, to []string, data []byte, info MessageInfo) error
+
+// MessageInfo contains additional details about a received message.
+type MessageInfo struct {
+	BareLF        bool   // The message contained bare <LF> line endings (normalised to <CR><LF>)
+	BareCR        bool   // The message contained bare <CR> line endings (normalised to <CR><LF>)
+	TLS           bool   // The message was received over a TLS connection (STARTTLS or TLS listener)
+	Authenticated bool   // The session was authenticated with AUTH
+	Protocol      string // The protocol the message was received with, smtp, smtps (TLS listener) or lmtp
+	Listener      string // The address of the listener the message was received on
+	Helo          string // The hostname supplied by the client with HELO or EHLO
+	AuthUser      string // The username the session was authenticated with
+}
+
+// SizeExceededHandler function called when a message is rejected for exceeding the maximum message size, either
+// with the size declared with MAIL FROM (no recipients) or the number of bytes received with DATA.
+type SizeExceededHandler func(remoteAddr net.Addr, from string, to []string, size int)
+
+// AuthHandler function called when a login attempt is performed. Returns true if credentials are correct.
+type AuthHandler func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
+
+var ErrServerClosed = errors.New("Server has been closed")
+
+// ListenAndServe listens on the TCP network address addr
+// and then calls Serve with handler to handle requests
+// on incoming connections.
+func ListenAndServe(addr string, handler Handler, appname string, hostname string) error {
+	srv := &Server{Addr: addr, Handler: handler, Appname: appname, Hostname: hostname}
+	return srv.ListenAndServe()
+}
+
+// ListenAndServeTLS listens on the TCP network address addr
+// and then calls Serve with handler to handle requests
+// on incoming connections. Connections may be upgraded to TLS if the client requests it.
+func ListenAndServeTLS(addr string, certFile string, keyFile string, handler Handler, appname string, hostname string) error {
+	srv := &Server{Addr: addr, Handler: handler, Appname: appname, Hostname: hostname}
+	err := srv.ConfigureTLS(certFile, keyFile)
+	if err != nil {
+		return err
 	}
+	return srv.ListenAndServe()
+}
+
+type maxSizeExceededError struct {
+	limit int
+	size  int // the declared (SIZE) or received message size
+}
+
+func maxSizeExceeded(limit, size int) maxSizeExceededError {
+	return maxSizeExceededError{limit, size}
+}
+
+// Error uses the RFC 5321 response message in preference to RFC 1870.
+// RFC 3463 defines enhanced status code x.3.4 as "Message too big for system".
+func (err maxSizeExceededError) Error() string {
+	return fmt.Sprintf("552 5.3.4 Requested mail action aborted: exceeded storage allocation (%d)", err.limit)
+}
+
+type bareLineEndingsError struct{}
+
+// Error returns the response when strict line endings are enforced.
+func (err bareLineEndingsError) Error() string {
+	return "550 5.6.0 Message contains bare <CR> or <LF> line endings, only <CR><LF> is permitted"
+}
+
+// LogFunc is a function capable of logging the client-server communication.
+type LogFunc func(remoteIP, verb, line string)
+
+// Server is an SMTP server.
+type Server struct {
+	Addr              string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty, or the path of a unix socket
+	Network           string // Network to listen on, "tcp" (default) or "unix"
+	LMTP              bool   // Speak LMTP (RFC 2033) instead of SMTP, accepting LHLO instead of HELO & EHLO, with a response per recipient to the message data (including recipients rejected by HandlerRcpt)
+	Appname           string
+	AuthHandler       AuthHandler
+	AuthMechs         map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
+	AuthRequired      bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
+	DisableReverseDNS bool            // Disable reverse DNS lookups, enforces "unknown" hostname
+	Handler           Handler
+	InfoHandler       InfoHandler
+	HandlerRcpt       HandlerRcpt
+	HandlerSender     HandlerSender
+	Hostname          string
+	LogRead           LogFunc
+	LogWrite          LogFunc
+	MaxSize           int // Maximum message size allowed, in bytes
+	MaxRecipients     int // Maximum number of recipients, defaults to 100.
+	Timeout           time.Duration
+	TLSConfig         *tls.Config
+	TLSListener       bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
+	TLSRequired       bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	AuthRequireTLS    bool // Only advertise & accept AUTH once TLS is in use, rejecting plaintext AUTH with 538 as per RFC 4954. Ignored if TLS is not configured.
+
+	inShutdown   int32 // server was closed or shutdown
+	openSessions int32 // count of open sessions
+	mu           sync.Mutex
+	shutdownChan chan struct{} // let the sessions know we are shutting down
+
+	XClientAllowed []string // List of XCLIENT allowed IP addresses
+
+	StrictLineEndings bool // Reject messages containing bare <CR> or <LF> line endings, instead of normalising them
 
-	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	MaxConnections      int32                         // Maximum number of concurrent sessions, 0 for unlimited. Use SetConnectionLimits() to change while running.
+	MaxConnectionsPerIP int32                         // Maximum number of concurrent sessions per remote IP, 0 for unlimited. Use SetConnectionLimits() to change while running.
+	MaxMessages         int                           // Maximum number of messages per session, 0 for unlimited. The session is closed with a 421 on the following DATA.
+	ConnectionRejected  func(remoteIP, reason string) // Optional function called when a connection is rejected or closed due to connection or message limits
+	SizeExceeded        SizeExceededHandler           // Optional function called when a message is rejected for exceeding MaxSize
+	ipSessions          map[string]int32              // count of open sessions per remote IP
+}
+
+// ConfigureTLS creates a TLS configuration from certificate and key files.
+func (srv *Server) ConfigureTLS(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		logger.Log().Errorf("[smtpd] error parsing message: %s", err.Error())
-		stats.LogSMTPRejected()
 		return err
 	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
 
-	// check / set the Return-Path based on SMTP from
-	returnPath := strings.Trim(msg.Header.Get("Return-Path"), "<>")
-	if returnPath != from {
-		if returnPath != "" {
-			// replace Return-Path
-			re := regexp.MustCompile(`(?i)(^|\n)(Return\-Path: .*\n)`)
-			replaced := false
-			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
-				if replaced {
-					return r
-				}
-				replaced = true // only replace first occurrence
+// ConfigureTLSWithPassphrase creates a TLS configuration from a certificate,
+// an encrypted key file and the associated passphrase:
+func (srv *Server) ConfigureTLSWithPassphrase(
+	certFile string,
+	keyFile string,
+	passphrase string,
+) error {
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	keyPEMDecrypted, err := x509.DecryptPEMBlock(keyDERBlock, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+	var pemBlock pem.Block
+	pemBlock.Type = keyDERBlock.Type
+	pemBlock.Bytes = keyPEMDecrypted
+	keyPEMBlock = pem.EncodeToMemory(&pemBlock)
+	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
 
-				return re.ReplaceAll(r, []byte("${1}Return-Path: <"+from+">\r\n"))
-			})
-		} else {
-			// add Return-Path
-			data = append([]byte("Return-Path: <"+from+">\r\n"), data...)
-		}
+// ListenAndServe listens on the TCP network address srv.Addr and then
+// calls Serve to handle requests on incoming connections.  If
+// srv.Addr is blank, ":25" is used.
+func (srv *Server) ListenAndServe() error {
+	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+		return ErrServerClosed
 	}
 
-	messageID := strings.Trim(msg.Header.Get("Message-Id"), "<>")
+	if srv.Addr == "" {
+		srv.Addr = ":25"
+	}
+	if srv.Appname == "" {
+		srv.Appname = "smtpd"
+	}
+	if srv.Hostname == "" {
+		srv.Hostname, _ = os.Hostname()
+	}
+	if srv.Timeout == 0 {
+		srv.Timeout = 5 * time.Minute
+	}
 
-	// add a message ID if not set
-	if messageID == "" {
-		// generate unique ID
-		messageID = shortuuid.New() + "@mailpit"
-		// add unique ID
-		data = append([]byte("Message-Id: <"+messageID+">\r\n"), data...)
-	} else if config.IgnoreDuplicateIDs {
-		if storage.MessageIDExists(messageID) {
-			logger.Log().Debugf("[smtpd] duplicate message found, ignoring %s", messageID)
-			stats.LogSMTPIgnored()
-			return nil
-		}
+	if srv.Network == "" {
+		srv.Network = "tcp"
 	}
 
-	// if enabled, this may conditionally relay the email through to the preconfigured smtp server
-	autoRelayMessage(from, to, &data)
+	var ln net.Listener
+	var err error
 
-	// build array of all addresses in the header to compare to the []to array
-	emails, hasBccHeader := scanAddressesInHeader(msg.Header)
+	// If TLSListener is enabled, listen for TLS connections only.
+	if srv.TLSConfig != nil && srv.TLSListener {
+		ln, err = tls.Listen(srv.Network, srv.Addr, srv.TLSConfig)
+	} else {
+		ln, err = net.Listen(srv.Network, srv.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve creates a new SMTP session after a network connection is established.
+func (srv *Server) Serve(ln net.Listener) error {
+	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+		return ErrServerClosed
+	}
+
+	defer ln.Close()
+	for {
+
+		// if we are shutting down, don't accept new connections
+		select {
+		case <-srv.getShutdownChan():
+			return ErrServerClosed
+		default:
+		}
 
-	missingAddresses := []string{}
-	for _, a := range to {
-		// loop through passed email addresses to check if they are in the headers
-		if _, err := mail.ParseAddress(a); err == nil {
-			_, ok := emails[strings.ToLower(a)]
-			if !ok {
-				missingAddresses = append(missingAddresses, a)
+		conn, err := ln.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
 			}
-		} else {
-			logger.Log().Warnf("[smtpd] ignoring invalid email address: %s", a)
+			return err
+		}
+
+		// apply connection limits before spawning the session goroutine
+		remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if reason := srv.acquireConnection(remoteIP); reason != "" {
+			go srv.rejectConnection(conn, remoteIP, reason)
+			continue
 		}
+
+		session := srv.newSession(conn)
+		go session.serve()
 	}
+}
 
-	// add missing email addresses to Bcc (eg: Laravel doesn't include these in the headers)
-	if len(missingAddresses) > 0 {
-		if hasBccHeader {
-			// email already has Bcc header, add to existing addresses
-			re := regexp.MustCompile(`(?i)(^|\n)(Bcc: )`)
-			replaced := false
-			data = re.ReplaceAllFunc(data, func(r []byte) []byte {
-				if replaced {
-					return r
-				}
-				replaced = true // only replace first occurrence
+// SetConnectionLimits sets the maximum number of concurrent sessions, both globally
+// and per remote IP address. A value of 0 disables the respective limit.
+// This is safe to call while the server is running, and applies to new connections.
+func (srv *Server) SetConnectionLimits(max, perIP int) {
+	atomic.StoreInt32(&srv.MaxConnections, int32(max))
+	atomic.StoreInt32(&srv.MaxConnectionsPerIP, int32(perIP))
+}
+
+// ConnectionCounts returns the number of open sessions, the number of remote IPs with open sessions,
+// and the highest number of open sessions from a single remote IP.
+func (srv *Server) ConnectionCounts() (open, ips, maxPerIP int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, n := range srv.ipSessions {
+		maxPerIP = max(maxPerIP, int(n))
+	}
+
+	return int(atomic.LoadInt32(&srv.openSessions)), len(srv.ipSessions), maxPerIP
+}
+
+// Reserve a session slot for the remote IP, returning the reason if a connection limit has been reached.
+func (srv *Server) acquireConnection(remoteIP string) string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 
-				return re.ReplaceAll(r, []byte("${1}Bcc: "+strings.Join(missingAddresses, ", ")+", "))
-			})
+	if max := atomic.LoadInt32(&srv.MaxConnections); max > 0 && atomic.LoadInt32(&srv.openSessions) >= max {
+		return fmt.Sprintf("Too many concurrent connections (maximum %d), try again later", max)
+	}
+
+	if srv.ipSessions == nil {
+		srv.ipSessions = make(map[string]int32)
+	}
+
+	if perIP := atomic.LoadInt32(&srv.MaxConnectionsPerIP); perIP > 0 && srv.ipSessions[remoteIP] >= perIP {
+		return fmt.Sprintf("Too many concurrent connections from %s (maximum %d), try again later", remoteIP, perIP)
+	}
+
+	srv.ipSessions[remoteIP]++
+	atomic.AddInt32(&srv.openSessions, 1)
+
+	return ""
+}
+
+// Release a session slot for the remote IP.
+func (srv *Server) releaseConnection(remoteIP string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.ipSessions[remoteIP] <= 1 {
+		delete(srv.ipSessions, remoteIP)
+	} else {
+		srv.ipSessions[remoteIP]--
+	}
+
+	atomic.AddInt32(&srv.openSessions, -1)
+}
+
+// Send a 421 response to a connection exceeding the connection limits, and close it.
+// The reason is only passed to ConnectionRejected, the client always receives the same response.
+func (srv *Server) rejectConnection(conn net.Conn, remoteIP, reason string) {
+	defer conn.Close()
+
+	if srv.ConnectionRejected != nil {
+		srv.ConnectionRejected(remoteIP, reason)
+	}
+
+	// do not let a slow client hold the rejected connection open
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("421 too many connections, try again later\r\n"))
+}
+
+type session struct {
+	srv           *Server
+	conn          net.Conn
+	br            *bufio.Reader
+	bw            *bufio.Writer
+	remoteIP      string // Remote IP address
+	remoteHost    string // Remote hostname according to reverse DNS lookup
+	remoteName    string // Remote hostname as supplied with EHLO
+	xClient       string // Information string as supplied with XCLIENT
+	xClientADDR   string // Information string as supplied with XCLIENT ADDR
+	xClientNAME   string // Information string as supplied with XCLIENT NAME
+	xClientTrust  bool   // Trust XCLIENT from current IP address
+	tls           bool
+	authenticated bool
+	authUser      string // Username supplied with AUTH, once authenticated
+}
 
+// Create new session from connection.
+func (srv *Server) newSession(conn net.Conn) (s *session) {
+	s = &session{
+		srv:  srv,
+		conn: conn,
+		br:   bufio.NewReader(conn),
+		bw:   bufio.NewWriter(conn),
+	}
+
+	// Get remote end info for the Received header.
+	s.remoteIP, _, _ = net.SplitHostPort(s.conn.RemoteAddr().String())
+	if !s.srv.DisableReverseDNS {
+		names, err := net.LookupAddr(s.remoteIP)
+		if err == nil && len(names) > 0 {
+			s.remoteHost = names[0]
 		} else {
-			// prepend new Bcc header
-			bcc := []byte(fmt.Sprintf("Bcc: %s\r\n", strings.Join(missingAddresses, ", ")))
-			data = append(bcc, data...)
+			s.remoteHost = "unknown"
 		}
+	} else {
+		s.remoteHost = "unknown"
+	}
+
+	// Set tls = true if TLS is already in use.
+	_, s.tls = s.conn.(*tls.Conn)
 
-		logger.Log().Debugf("[smtpd] added missing addresses to Bcc header: %s", strings.Join(missingAddresses, ", "))
+	for _, checkIP := range srv.XClientAllowed {
+		if s.remoteIP == checkIP {
+			s.xClientTrust = true
+		}
 	}
+	return
+}
 
-	_, err = storage.Store(&data)
-	if err != nil {
-		logger.Log().Errorf("[db] error storing message: %s", err.Error())
-		return err
+func (srv *Server) getShutdownChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdownChan == nil {
+		srv.shutdownChan = make(chan struct{})
 	}
 
-	stats.LogSMTPAccepted(len(data))
+	return srv.shutdownChan
+}
 
-	data = nil // avoid memory leaks
+func (srv *Server) closeShutdownChan() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdownChan == nil {
+		srv.shutdownChan = make(chan struct{})
+	}
 
-	subject := msg.Header.Get("Subject")
-	logger.Log().Debugf("[smtpd] received (%s) from:%s subject:%q", cleanIP(origin), from, subject)
+	select {
+	case <-srv.shutdownChan:
+	default:
+		close(srv.shutdownChan)
+	}
+}
 
+// Close - closes the connection without waiting
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
 	return nil
 }
 
-func authHandler(remoteAddr net.Addr, mechanism string, username []byte, password []byte, _ []byte) (bool, error) {
-	allow := auth.SMTPCredentials.Match(string(username), string(password))
-	if allow {
-		logger.Log().Debugf("[smtpd] allow %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
-	} else {
-		logger.Log().Warnf("[smtpd] deny %s login:%q from:%s", mechanism, string(username), cleanIP(remoteAddr))
+// Shutdown - waits for current sessions to complete before closing
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
+
+	// wait for up to 30 seconds to allow the current sessions to
+	// end
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+
+	for i := 0; i < 300; i++ {
+
+		// wait for open sessions to close
+		if atomic.LoadInt32(&srv.openSessions) == 0 {
+			break
+		}
+
+		select {
+		case <-timer.C:
+			timer.Reset(100 * time.Millisecond)
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 	}
 
-	return allow, nil
+	return nil
 }
 
-// Allow any username and password
-func authHandlerAny(remoteAddr net.Addr, mechanism string, username []byte, _ []byte, _ []byte) (bool, error) {
-	logger.Log().Debugf("[smtpd] allow %s login %q from %s", mechanism, string(username), cleanIP(remoteAddr))
+// Function called to handle connection requests.
+func (s *session) serve() {
+	defer s.srv.releaseConnection(s.remoteIP)
+	defer s.conn.Close()
+
+	var from string
+	var gotFrom bool
+	var to []string
+	var rcpts []string // the response to each RCPT, empty if accepted, for the LMTP responses to the message data
+	var buffer bytes.Buffer
+	var messages int
+
+	// Send banner.
+	s.writef("220 %s %s %s Service ready", s.srv.Hostname, s.srv.Appname, s.srv.serviceName())
+
+loop:
+	for {
+		// Attempt to read a line from the socket.
+		// On timeout, send a timeout message and return from serve().
+		// On error, assume the client has gone away i.e. return from serve().
+		line, err := s.readLine()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.writef("421 4.4.2 %s %s %s Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname, s.srv.serviceName())
+			}
+			break
+		}
+
+		verb, args := s.parseLine(line)
+
+		switch verb {
+		case "HELO":
+			// RFC 2033 section 4.1 does not permit HELO or EHLO with LMTP.
+			if s.srv.LMTP {
+				s.writef("500 5.5.1 Command not permitted with LMTP, use LHLO")
+				break
+			}
+			s.remoteName = args
+			s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
+
+			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
+			from = ""
+			gotFrom = false
+			to, rcpts = nil, nil
+			buffer.Reset()
+		case "EHLO", "LHLO":
+			if s.srv.LMTP && verb == "EHLO" {
+				s.writef("500 5.5.1 Command not permitted with LMTP, use LHLO")
+				break
+			}
+			if !s.srv.LMTP && verb == "LHLO" {
+				s.writef("500 5.5.2 Syntax error, command unrecognized")
+				break
+			}
+			s.remoteName = args
+			s.writef(s.makeEHLOResponse())
+
+			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
+			from = ""
+			gotFrom = false
+			to, rcpts = nil, nil
+			buffer.Reset()
+		case "MAIL":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+
+			match := mailFromRE.FindStringSubmatch(args)
+			if match == nil {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
+			} else if err := s.validateMailParams(match[1], match[3]); err != nil {
+				s.writef(err.Error())
+			} else {
+				from = match[1]
+				gotFrom = true
+				s.writef("250 2.1.0 Ok")
+			}
+			to, rcpts = nil, nil
+			buffer.Reset()
+		case "RCPT":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+			if !gotFrom {
+				s.writef("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
+				break
+			}
+			if s.srv.HandlerSender != nil {
+				if err := s.srv.HandlerSender(s.conn.RemoteAddr(), from); err != nil {
+					s.writef(err.Error())
+					break
+				}
+			}
+
+			match := rcptToRE.FindStringSubmatch(args)
+			if match == nil {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
+			} else {
+				// RFC 5321 specifies support for minimum of 100 recipients is required.
+				if s.srv.MaxRecipients == 0 {
+					s.srv.MaxRecipients = 100
+				}
+				if len(rcpts) == s.srv.MaxRecipients {
+					s.writef("452 4.5.3 Too many recipients")
+				} else {
+					var err error
+					if s.srv.HandlerRcpt != nil {
+						err = s.srv.HandlerRcpt(s.conn.RemoteAddr(), from, match[1])
+					}
+					if err == nil {
+						to = append(to, match[1])
+						rcpts = append(rcpts, "")
+						s.writef("250 2.1.5 Ok")
+						break
+					}
+
+					response := "550 5.1.0 Requested action not taken: mailbox unavailable"
+					if responseRE.MatchString(err.Error()) {
+						response = err.Error()
+					}
+
+					if s.srv.LMTP {
+						// the rejection is returned as this recipient's response to the message data (RFC 2033 section 4.2)
+						rcpts = append(rcpts, response)
+						s.writef("250 2.1.5 Ok")
+					} else {
+						s.writef(response)
+					}
+				}
+			}
+		case "DATA":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+			if !gotFrom || len(rcpts) == 0 {
+				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
+				break
+			}
+			if s.srv.HandlerSender != nil {
+				if err := s.srv.HandlerSender(s.conn.RemoteAddr(), from); err != nil {
+					s.writef(err.Error())
+					break
+				}
+			}
+			if s.srv.MaxMessages > 0 && messages >= s.srv.MaxMessages {
+				reason := fmt.Sprintf("Too many messages in this session (maximum %d), reconnect to send more", s.srv.MaxMessages)
+				if s.srv.ConnectionRejected != nil {
+					s.srv.ConnectionRejected(s.remoteIP, reason)
+				}
+				s.writef("421 4.7.0 %s", reason)
+				break loop
+			}
+
+			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
+
+			// Attempt to read message body from the socket.
+			// On timeout, send a timeout message and return from serve().
+			// On net.Error, assume the client has gone away i.e. return from serve().
+			// On other errors, allow the client to try again.
+			data, info, err := s.readData()
+			if err != nil {
+				switch err.(type) {
+				case net.Error:
+					if err.(net.Error).Timeout() {
+						s.writef("421 4.4.2 %s %s %s Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname, s.srv.serviceName())
+					}
+					break loop
+				case maxSizeExceededError:
+					if s.srv.SizeExceeded != nil {
+						s.srv.SizeExceeded(s.conn.RemoteAddr(), from, to, err.(maxSizeExceededError).size)
+					}
+					s.writeDataResponse(rcpts, err.Error())
+
+					// the message data has been drained, the client may start a new transaction
+					from = ""
+					gotFrom = false
+					to, rcpts = nil, nil
+					continue
+				case bareLineEndingsError:
+					s.writeDataResponse(rcpts, err.Error())
+					continue
+				default:
+					s.writeDataResponse(rcpts, "451 4.3.0 Requested action aborted: local error in processing")
+					continue
+				}
+			}
+
+			if len(to) == 0 {
+				// every LMTP recipient was rejected, there is nothing to deliver
+				s.writeDataResponse(rcpts, "")
+				from = ""
+				gotFrom = false
+				to, rcpts = nil, nil
+				continue
+			}
 
-	return true, nil
+			messages++
+
+			// Create Received header & write message body into buffer.
+			buffer.Reset()
+			buffer.Write(s.makeHeaders(to))
+			buffer.Write(data)
+
+			// Pass mail on to handler.
+			if s.srv.InfoHandler != nil || s.srv.Handler != nil {
+				var err error
+				if s.srv.InfoHandler != nil {
+					info.TLS = s.tls
+					info.Authenticated = s.authenticated
+					info.AuthUser = s.authUser
+					info.Protocol = "smtp"
+					if s.srv.LMTP {
+						info.Protocol = "lmtp"
+					} else if s.srv.TLSListener {
+						info.Protocol = "smtps"
+					}
+					info.Listener = s.srv.Addr
+					info.Helo = s.remoteName
+					err = s.srv.InfoHandler(s.conn.RemoteAddr(), from, to, buffer.Bytes(), info)
+				} else {
+					err = s.srv.Handler(s.conn.RemoteAddr(), from, to, buffer.Bytes())
+				}
+				if err != nil {
+					if responseRE.MatchString(err.Error()) {
+						s.writeDataResponse(rcpts, err.Error())
+					} else {
+						s.writeDataResponse(rcpts, "451 4.3.5 Unable to process mail")
+					}
+					break
+				}
+			}
+			s.writeDataResponse(rcpts, "250 2.0.0 Ok: queued")
+
+			// Reset for next mail.
+			from = ""
+			gotFrom = false
+			to, rcpts = nil, nil
+			buffer.Reset()
+		case "QUIT":
+			s.writef("221 2.0.0 %s %s %s Service closing transmission channel", s.srv.Hostname, s.srv.Appname, s.srv.serviceName())
+			break loop
+		case "RSET":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			s.writef("250 2.0.0 Ok")
+			from = ""
+			gotFrom = false
+			to, rcpts = nil, nil
+			buffer.Reset()
+		case "NOOP":
+			s.writef("250 2.0.0 Ok")
+		case "XCLIENT":
+			s.xClient = args
+			if s.xClientTrust {
+				xCArgs := strings.Split(args, " ")
+				for _, xCArg := range xCArgs {
+					xCParse := strings.Split(strings.TrimSpace(xCArg), "=")
+					if strings.ToUpper(xCParse[0]) == "ADDR" && (net.ParseIP(xCParse[1]) != nil) {
+						s.xClientADDR = xCParse[1]
+					}
+					if strings.ToUpper(xCParse[0]) == "NAME" && len(xCParse[1]) > 0 {
+						if xCParse[1] != "[UNAVAILABLE]" {
+							s.xClientNAME = xCParse[1]
+						}
+					}
+				}
+				if len(s.xClientADDR) > 7 {
+					s.remoteIP = s.xClientADDR
+					if len(s.xClientNAME) > 4 {
+						s.remoteHost = s.xClientNAME
+					} else {
+						names, err := net.LookupAddr(s.remoteIP)
+						if err == nil && len(names) > 0 {
+							s.remoteHost = names[0]
+						} else {
+							s.remoteHost = "unknown"
+						}
+					}
+				}
+			}
+			s.writef("250 2.0.0 Ok")
+		case "HELP", "VRFY", "EXPN":
+			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+			s.writef("502 5.5.1 Command not implemented")
+		case "STARTTLS":
+			// Parameters are not allowed (RFC 3207 section 4).
+			if args != "" {
+				s.writef("501 5.5.2 Syntax error (no parameters allowed)")
+				break
+			}
+
+			// Handle case where TLS is requested but not configured (and therefore not listed as a service extension).
+			if s.srv.TLSConfig == nil {
+				s.writef("502 5.5.1 Command not implemented")
+				break
+			}
+
+			// Handle case where STARTTLS is received when TLS is already in use.
+			if s.tls {
+				s.writef("503 5.5.1 Bad sequence of commands (TLS already in use)")
+				break
+			}
+
+			s.writef("220 2.0.0 Ready to start TLS")
+
+			// Establish a TLS connection with the client.
+			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
+			err := tlsConn.Handshake()
+			if err != nil {
+				s.writef("403 4.7.0 TLS handshake failed")
+				break
+			}
+
+			// TLS handshake succeeded, switch to using the TLS connection.
+			s.conn = tlsConn
+			s.br = bufio.NewReader(s.conn)
+			s.bw = bufio.NewWriter(s.conn)
+			s.tls = true
+
+			// RFC 3207 specifies that the server must discard any prior knowledge obtained from the client.
+			s.remoteName = ""
+			from = ""
+			gotFrom = false
+			to, rcpts = nil, nil
+			buffer.Reset()
+		case "AUTH":
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			// Handle case where AUTH is requested but not configured (and therefore not listed as a service extension).
+			if s.srv.AuthHandler == nil {
+				s.writef("502 5.5.1 Command not implemented")
+				break
+			}
+
+			// RFC 4954 specifies a 538 response when encryption is required for authentication.
+			if s.srv.TLSConfig != nil && s.srv.AuthRequireTLS && !s.tls {
+				s.writef("538 5.7.11 Encryption required for requested authentication mechanism")
+				break
+			}
+
+			// Handle case where AUTH is received when already authenticated.
+			if s.authenticated {
+				s.writef("503 5.5.1 Bad sequence of commands (already authenticated for this session)")
+				break
+			}
+
+			// RFC 4954 specifies that AUTH is not permitted during mail transactions.
+			if gotFrom || len(rcpts) > 0 {
+				s.writef("503 5.5.1 Bad sequence of commands (AUTH not permitted during mail transaction)")
+				break
+			}
+
+			// RFC 4954 requires a mechanism parameter.
+			authType, authArgs := s.parseLine(args)
+			if authType == "" {
+				s.writef("501 5.5.4 Malformed AUTH input (argument required)")
+				break
+			}
+
+			// RFC 4954 requires rejecting unsupported authentication mechanisms with a 504 response.
+			allowedAuth := s.authMechs()
+			if allowed, found := allowedAuth[authType]; !found || !allowed {
+				s.writef("504 5.5.4 Unrecognized authentication type")
+				break
+			}
+
+			// RFC 4954 also specifies that ESMTP code 5.5.4 ("Invalid command arguments") should be returned
+			// when attempting to use an unsupported authentication type.
+			// Many servers return 5.7.4 ("Security features not supported") instead.
+			switch authType {
+			case "PLAIN":
+				s.authenticated, err = s.handleAuthPlain(authArgs)
+			case "LOGIN":
+				s.authenticated, err = s.handleAuthLogin(authArgs)
+			case "CRAM-MD5":
+				s.authenticated, err = s.handleAuthCramMD5()
+			}
+
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.writef("421 4.4.2 %s %s %s Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname, s.srv.serviceName())
+					break loop
+				}
+
+				s.writef(err.Error())
+				break
+			}
+
+			if s.authenticated {
+				s.writef("235 2.7.0 Authentication successful")
+			} else {
+				s.writef("535 5.7.8 Authentication credentials invalid")
+			}
+		default:
+			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+			s.writef("500 5.5.2 Syntax error, command unrecognized")
+		}
+	}
 }
 
-// HandlerRcpt used to optionally restrict recipients based on `--smtp-allowed-recipients`
-func handlerRcpt(remoteAddr net.Addr, from string, to string) bool {
-	if config.SMTPAllowedRecipientsRegexp == nil {
-		return true
+// Wrapper function for writing a complete line to the socket.
+func (s *session) writef(format string, args ...interface{}) error {
+	if s.srv.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
 	}
 
-	result := config.SMTPAllowedRecipientsRegexp.MatchString(to)
+	line := fmt.Sprintf(format, args...)
+	fmt.Fprintf(s.bw, line+"\r\n")
+	err := s.bw.Flush()
 
-	if !result {
-		logger.Log().Warnf("[smtpd] rejected message to %s from %s (%s)", to, from, cleanIP(remoteAddr))
-		stats.LogSMTPRejected()
+	if Debug {
+		verb := "WROTE"
+		if s.srv.LogWrite != nil {
+			s.srv.LogWrite(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.remoteIP, verb, line)
+		}
 	}
 
-	return result
+	return err
 }
 
-// Listen starts the SMTPD server
-func Listen() error {
-	if config.SMTPAuthAllowInsecure {
-		if auth.SMTPCredentials != nil {
-			logger.Log().Info("[smtpd] enabling login authentication (insecure)")
-		} else if config.SMTPAuthAcceptAny {
-			logger.Log().Info("[smtpd] enabling any authentication (insecure)")
+// Write the response to the message data. With LMTP a response is written for each recipient in the order of
+// the RCPT commands (RFC 2033 section 4.2), either the rejection of the recipient or the response to the data.
+func (s *session) writeDataResponse(rcpts []string, response string) {
+	if !s.srv.LMTP {
+		s.writef(response)
+		return
+	}
+
+	for _, r := range rcpts {
+		if r != "" {
+			s.writef(r)
+		} else {
+			s.writef(response)
 		}
+	}
+}
+
+// Read a complete line from the socket.
+func (s *session) readLine() (string, error) {
+	if s.srv.Timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+	}
+
+	line, err := s.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line) // Strip trailing \r\n
+
+	if Debug {
+		verb := "READ"
+		if s.srv.LogRead != nil {
+			s.srv.LogRead(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.remoteIP, verb, line)
+		}
+	}
+
+	return line, err
+}
+
+// Parse a line read from the socket.
+func (s *session) parseLine(line string) (verb string, args string) {
+	if idx := strings.Index(line, " "); idx != -1 {
+		verb = strings.ToUpper(line[:idx])
+		args = strings.TrimSpace(line[idx+1:])
 	} else {
-		if auth.SMTPCredentials != nil {
-			logger.Log().Info("[smtpd] enabling login authentication")
-		} else if config.SMTPAuthAcceptAny {
-			logger.Log().Info("[smtpd] enabling any authentication")
+		verb = strings.ToUpper(line)
+		args = ""
+	}
+	return verb, args
+}
+
+// Validate the parameters of a MAIL command. SIZE is enforced if a maximum size is set, and BODY (RFC 6152),
+// SMTPUTF8 (RFC 6531) & any unrecognised parameters are accepted without affecting how the message is stored.
+func (s *session) validateMailParams(from, params string) error {
+	for _, param := range strings.Fields(params) {
+		key, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(key, "SIZE") {
+			continue
+		}
+
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+		}
+
+		// Enforce the maximum message size if one is set.
+		if s.srv.MaxSize > 0 && size > s.srv.MaxSize {
+			if s.srv.SizeExceeded != nil {
+				s.srv.SizeExceeded(s.conn.RemoteAddr(), from, nil, size)
+			}
+			return maxSizeExceeded(s.srv.MaxSize, size)
 		}
 	}
 
-	smtpType := "no encryption"
+	return nil
+}
 
-	if config.SMTPTLSCert != "" {
-		if config.SMTPRequireSTARTTLS {
-			smtpType = "STARTTLS required"
-		} else if config.SMTPRequireTLS {
-			smtpType = "SSL/TLS required"
-		} else {
-			smtpType = "STARTTLS optional"
-			if !config.SMTPAuthAllowInsecure && auth.SMTPCredentials != nil {
-				smtpType = "STARTTLS required"
+// Read the message data following a DATA command.
+func (s *session) readData() ([]byte, MessageInfo, error) {
+	var data []byte
+	var info MessageInfo
+
+	// the DATA command line ended with <CR><LF>
+	prevCRLF := true
+
+	// the number of bytes received once the maximum message size is exceeded, after which
+	// the remaining data is drained (but not stored) so the session remains usable
+	exceeded := 0
+
+	for {
+		if s.srv.Timeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+		}
+
+		// Lines are read in bounded chunks so a long line is not buffered beyond the maximum message size.
+		// Once exceeded, only lines which could be the end of data are buffered.
+		limit := 0
+		if exceeded > 0 {
+			limit = len(".\r\n")
+		} else if s.srv.MaxSize > 0 {
+			limit = max(s.srv.MaxSize-len(data)+1, len(".\r\n"))
+		}
+
+		line, size, crlf, err := s.readDataLine(limit)
+		if err != nil {
+			return nil, info, err
+		}
+
+		if line == nil {
+			// the line exceeds the maximum message size and has been drained
+			if exceeded == 0 {
+				exceeded = len(data)
+				data = nil
 			}
+			exceeded += size
+			prevCRLF = crlf
+			continue
+		}
+
+		// Handle end of data denoted by lone period (\r\n.\r\n).
+		// The preceding line must also end with <CR><LF>, otherwise sequences such as
+		// <LF>.<CR><LF> could be used to smuggle additional SMTP commands & messages.
+		if prevCRLF && bytes.Equal(line, []byte(".\r\n")) {
+			break
 		}
 
+		if !crlf {
+			info.BareLF = true
+		}
+		if hasBareCR(line) {
+			info.BareCR = true
+		}
+		prevCRLF = crlf
+
+		// Remove leading period (RFC 5321 section 4.5.2)
+		if line[0] == '.' {
+			line = line[1:]
+		}
+
+		if !s.srv.StrictLineEndings {
+			line = normaliseLineEndings(line)
+		}
+
+		// Enforce the maximum message size limit.
+		if exceeded > 0 {
+			exceeded += len(line)
+			continue
+		}
+		if s.srv.MaxSize > 0 && len(data)+len(line) > s.srv.MaxSize {
+			exceeded = len(data) + len(line)
+			data = nil
+			continue
+		}
+
+		data = append(data, line...)
 	}
 
-	logger.Log().Infof("[smtpd] starting on %s (%s)", config.SMTPListen, smtpType)
+	if exceeded > 0 {
+		return nil, info, maxSizeExceeded(s.srv.MaxSize, exceeded)
+	}
 
-	return listenAndServe(config.SMTPListen, mailHandler, authHandler)
+	if s.srv.StrictLineEndings && (info.BareLF || info.BareCR) {
+		return nil, info, bareLineEndingsError{}
+	}
+
+	return data, info, nil
 }
 
-func listenAndServe(addr string, handler smtpd.Handler, authHandler smtpd.AuthHandler) error {
-	srv := &smtpd.Server{
-		Addr:              addr,
-		Handler:           handler,
-		HandlerRcpt:       handlerRcpt,
-		Appname:           "Mailpit",
-		Hostname:          "",
-		AuthHandler:       nil,
-		AuthRequired:      false,
-		MaxRecipients:     config.SMTPMaxRecipients,
-		DisableReverseDNS: DisableReverseDNS,
+// Read a line of message data in chunks of the reader's buffer size. If the line exceeds limit (if set),
+// the remainder of the line is drained without being buffered and a nil line is returned. The size of the
+// line, and whether it ended with <CR><LF>, are always returned.
+func (s *session) readDataLine(limit int) (line []byte, size int, crlf bool, err error) {
+	var prev byte
+	overflow := false
+
+	for {
+		chunk, err := s.br.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, size, false, err
+		}
+
+		size += len(chunk)
+		if !overflow && limit > 0 && size > limit {
+			overflow = true
+			line = nil
+		}
+		if !overflow {
+			line = append(line, chunk...)
+		}
+
+		if err == nil {
+			// the chunk ends with <LF>, which may be preceded by a <CR> at the end of the previous chunk
+			if len(chunk) > 1 {
+				prev = chunk[len(chunk)-2]
+			}
+			return line, size, prev == '\r', nil
+		}
+
+		prev = chunk[len(chunk)-1]
 	}
+}
+
+// Return whether a line contains a <CR> which is not part of the line ending.
+// Trailing <CR><CR><LF> is ignored as this is handled separately (see SMTPStrictRFCHeaders).
+func hasBareCR(line []byte) bool {
+	return bytes.IndexByte(bytes.TrimRight(line, "\r\n"), '\r') > -1
+}
+
+// Replace bare <CR> & <LF> line endings in a line with <CR><LF>.
+// Trailing <CR><CR><LF> is retained as this is handled separately (see SMTPStrictRFCHeaders).
+func normaliseLineEndings(line []byte) []byte {
+	content := bytes.TrimRight(line, "\r\n")
+	ending := line[len(content):]
 
-	if config.SMTPAuthAllowInsecure {
-		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
+	if bytes.IndexByte(content, '\r') > -1 {
+		content = bytes.ReplaceAll(content, []byte("\r"), []byte("\r\n"))
 	}
 
-	if auth.SMTPCredentials != nil {
-		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
-		srv.AuthHandler = authHandler
-		srv.AuthRequired = true
-	} else if config.SMTPAuthAcceptAny {
-		srv.AuthMechs = map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true}
-		srv.AuthHandler = authHandlerAny
+	if bytes.Equal(ending, []byte("\n")) {
+		ending = []byte("\r\n")
 	}
 
-	if config.SMTPTLSCert != "" {
-		srv.TLSRequired = config.SMTPRequireSTARTTLS
-		srv.TLSListener = config.SMTPRequireTLS // if true overrules srv.TLSRequired
-		if err := srv.ConfigureTLS(config.SMTPTLSCert, config.SMTPTLSKey); err != nil {
-			return err
+	out := make([]byte, 0, len(content)+len(ending))
+	out = append(out, content...)
+
+	return append(out, ending...)
+}
+
+// Create the Received header to comply with RFC 2821 section 3.8.2.
+// TODO: Work out what to do with multiple to addresses.
+func (s *session) makeHeaders(to []string) []byte {
+	protocol := "SMTP"
+	if s.srv.LMTP {
+		protocol = "LMTP"
+	}
+
+	var buffer bytes.Buffer
+	now := time.Now().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
+	buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, s.remoteIP))
+	buffer.WriteString(fmt.Sprintf("        by %s (%s) with %s\r\n", s.srv.Hostname, s.srv.Appname, protocol))
+	buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
+	return buffer.Bytes()
+}
+
+// Determine allowed authentication mechanisms.
+// RFC 4954 specifies that plaintext authentication mechanisms such as LOGIN and PLAIN require a TLS connection.
+// This can be explicitly overridden e.g. setting s.srv.AuthMechs["LOGIN"] = true.
+func (s *session) authMechs() (mechs map[string]bool) {
+	mechs = map[string]bool{"LOGIN": s.tls, "PLAIN": s.tls, "CRAM-MD5": true}
+
+	for mech := range mechs {
+		allowed, found := s.srv.AuthMechs[mech]
+		if found {
+			mechs[mech] = allowed
 		}
 	}
 
-	return srv.ListenAndServe()
+	return
 }
 
-func cleanIP(i net.Addr) string {
-	parts := strings.Split(i.String(), ":")
+// Return the name of the service, used in the banner & responses.
+func (srv *Server) serviceName() string {
+	if srv.LMTP {
+		return "LMTP"
+	}
 
-	return parts[0]
+	return "ESMTP"
 }
 
-// Returns a list of all lowercased emails found in To, Cc and Bcc,
-// as well as whether there is a Bcc field
-func scanAddressesInHeader(h mail.Header) (map[string]bool, bool) {
-	emails := make(map[string]bool)
-	hasBccHeader := false
+// Create the greeting string sent in response to an EHLO or LHLO command.
+func (s *session) makeEHLOResponse() (response string) {
+	response = fmt.Sprintf("250-%s greets %s\r\n", s.srv.Hostname, s.remoteName)
+
+	// RFC 1870 specifies that "SIZE 0" indicates no maximum size is in force.
+	response += fmt.Sprintf("250-SIZE %d\r\n", s.srv.MaxSize)
+
+	// RFC 6531, UTF-8 envelope addresses & headers are accepted (8BITMIME is required by SMTPUTF8).
+	response += "250-8BITMIME\r\n"
+	response += "250-SMTPUTF8\r\n"
+
+	// Only list STARTTLS if TLS is configured, but not currently in use.
+	if s.srv.TLSConfig != nil && !s.tls {
+		response += "250-STARTTLS\r\n"
+	}
 
-	if recipients, err := h.AddressList("To"); err == nil {
-		for _, r := range recipients {
-			emails[strings.ToLower(r.Address)] = true
+	// Only list AUTH if an AuthHandler is configured and at least one mechanism is allowed,
+	// and TLS is in use if required for authentication.
+	if s.srv.AuthHandler != nil && !(s.srv.TLSConfig != nil && s.srv.AuthRequireTLS && !s.tls) {
+		var mechs []string
+		for mech, allowed := range s.authMechs() {
+			if allowed {
+				mechs = append(mechs, mech)
+			}
+		}
+		if len(mechs) > 0 {
+			response += "250-AUTH " + strings.Join(mechs, " ") + "\r\n"
 		}
 	}
 
-	if recipients, err := h.AddressList("Cc"); err == nil {
-		for _, r := range recipients {
-			emails[strings.ToLower(r.Address)] = true
+	response += "250 ENHANCEDSTATUSCODES"
+	return
+}
+
+func (s *session) handleAuthLogin(arg string) (bool, error) {
+	var err error
+
+	if arg == "" {
+		s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+		arg, err = s.readLine()
+		if err != nil {
+			return false, err
 		}
 	}
 
-	recipients, err := h.AddressList("Bcc")
-	if err == nil {
-		for _, r := range recipients {
-			emails[strings.ToLower(r.Address)] = true
+	username, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+	line, err := s.readLine()
+	if err != nil {
+		return false, err
+	}
+
+	password, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "LOGIN", username, password, nil)
+	if authenticated {
+		s.authUser = string(username)
+	}
+
+	return authenticated, err
+}
+
+func (s *session) handleAuthPlain(arg string) (bool, error) {
+	var err error
+
+	// If fast mode (AUTH PLAIN [arg]) is not used, prompt for credentials.
+	if arg == "" {
+		s.writef("334 ")
+		arg, err = s.readLine()
+		if err != nil {
+			return false, err
 		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return false, errors.New("501 5.5.2 Syntax error (unable to parse)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "PLAIN", parts[1], parts[2], nil)
+	if authenticated {
+		s.authUser = string(parts[1])
+	}
+
+	return authenticated, err
+}
+
+func (s *session) handleAuthCramMD5() (bool, error) {
+	shared := "<" + strconv.Itoa(os.Getpid()) + "." + strconv.Itoa(time.Now().Nanosecond()) + "@" + s.srv.Hostname + ">"
+
+	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte(shared)))
+
+	data, err := s.readLine()
+	if err != nil {
+		return false, err
+	}
+
+	if data == "*" {
+		return false, errors.New("501 5.7.0 Authentication cancelled")
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	fields := strings.Split(string(buf), " ")
+	if len(fields) < 2 {
+		return false, errors.New("501 5.5.2 Syntax error (unable to parse)")
+	}
 
-		hasBccHeader = true
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+	if authenticated {
+		s.authUser = fields[0]
 	}
 
-	return emails, hasBccHeader
+	return authenticated, err
 }
@@ -0,0 +1,1802 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+func TestConnectionLimits(t *testing.T) {
+	logger.NoLogging = true
+
+	rejected := make(chan string, 10)
+
+	srv := &Server{
+		Appname:           "Mailpit",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, _ []string, _ []byte) error {
+			return nil
+		},
+		ConnectionRejected: func(remoteIP, _ string) {
+			rejected <- remoteIP
+		},
+	}
+	srv.SetConnectionLimits(1, 0)
+
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	t.Log("Global connection limit")
+	first := dialAndReadBanner(t, addr, "220 ")
+	dialAndReadBanner(t, addr, "421 too many connections, try again later")
+	assertRejected(t, rejected)
+
+	// closing the first session frees the slot
+	_ = first.Close()
+	waitForSessions(t, srv, 0)
+	second := dialAndReadBanner(t, addr, "220 ")
+	_ = second.Close()
+	waitForSessions(t, srv, 0)
+
+	t.Log("Per-IP connection limit")
+	srv.SetConnectionLimits(0, 2)
+	a := dialAndReadBanner(t, addr, "220 ")
+	b := dialAndReadBanner(t, addr, "220 ")
+	dialAndReadBanner(t, addr, "421 too many connections, try again later")
+	assertRejected(t, rejected)
+	open, ips, maxPerIP := srv.ConnectionCounts()
+	if open != 2 || ips != 1 || maxPerIP != 2 {
+		t.Fatalf("expected 2 open connections from 1 IP, got %d from %d (max %d)", open, ips, maxPerIP)
+	}
+	_ = a.Close()
+	_ = b.Close()
+	waitForSessions(t, srv, 0)
+
+	t.Log("Unlimited connections")
+	srv.SetConnectionLimits(0, 0)
+	conns := []net.Conn{}
+	for i := 0; i < 5; i++ {
+		conns = append(conns, dialAndReadBanner(t, addr, "220 "))
+	}
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+func TestConnectionLimitsParallel(t *testing.T) {
+	logger.NoLogging = true
+
+	srv := &Server{
+		Appname:           "Mailpit",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		Handler: func(_ net.Addr, _ string, _ []string, _ []byte) error {
+			return nil
+		},
+		ConnectionRejected: func(_, _ string) {},
+	}
+	srv.SetConnectionLimits(5, 0)
+
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	conns := []net.Conn{}
+	accepted, rejected := 0, 0
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+
+			mu.Lock()
+			defer mu.Unlock()
+			conns = append(conns, conn)
+			if err != nil {
+				t.Errorf("error reading banner: %s", err.Error())
+			} else if strings.HasPrefix(line, "220 ") {
+				accepted++
+			} else if strings.HasPrefix(line, "421 ") {
+				rejected++
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if accepted != 5 || rejected != 15 {
+		t.Fatalf("expected 5 accepted & 15 rejected connections, got %d & %d", accepted, rejected)
+	}
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	waitForSessions(t, srv, 0)
+}
+
+func TestMessagesPerConnection(t *testing.T) {
+	logger.NoLogging = true
+
+	rejected := make(chan string, 10)
+	received := make(chan []byte, 10)
+
+	srv := &Server{
+		Appname:           "Mailpit",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		MaxMessages:       2,
+		Handler: func(_ net.Addr, _ string, _ []string, data []byte) error {
+			received <- data
+			return nil
+		},
+		ConnectionRejected: func(remoteIP, _ string) {
+			rejected <- remoteIP
+		},
+	}
+
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	send := func() error {
+		if err := c.Mail("sender@example.com"); err != nil {
+			return err
+		}
+		if err := c.Rcpt("recipient@example.com"); err != nil {
+			return err
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+		<-received
+	}
+
+	err = send()
+	if err == nil || !strings.HasPrefix(err.Error(), "421 ") || !strings.Contains(err.Error(), "Too many messages in this session (maximum 2)") {
+		t.Fatalf("expected a 421 error, got %v", err)
+	}
+	assertRejected(t, rejected)
+	waitForSessions(t, srv, 0)
+
+	// a new connection can send more messages
+	c2, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c = c2
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	logger.NoLogging = true
+
+	type oversize struct {
+		from string
+		to   []string
+		size int
+	}
+
+	received := make(chan receivedMessage, 10)
+	exceeded := make(chan oversize, 10)
+
+	srv := &Server{
+		Appname:           "Mailpit",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		MaxSize:           1024,
+		InfoHandler: func(_ net.Addr, _ string, _ []string, data []byte, info MessageInfo) error {
+			received <- receivedMessage{data, info}
+			return nil
+		},
+		SizeExceeded: func(_ net.Addr, from string, to []string, size int) {
+			exceeded <- oversize{from, to, size}
+		},
+	}
+
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	assertExceeded := func(from, to string, size int) {
+		select {
+		case o := <-exceeded:
+			if o.from != from || strings.Join(o.to, ",") != to || o.size != size {
+				t.Fatalf("expected oversize message from %q to %q (%d), got %+v", from, to, size, o)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected size exceeded callback")
+		}
+	}
+
+	conn := dialAndReadBanner(t, addr, "220 ")
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if resp := sendCommand(t, conn, r, "EHLO localhost"); !strings.Contains(resp, "250-SIZE 1024\r\n") {
+		t.Fatalf("expected SIZE to be advertised, got %q", resp)
+	}
+
+	t.Log("Declared SIZE")
+	if resp := sendCommand(t, conn, r, "MAIL FROM:<sender@example.com> SIZE=2048"); !strings.HasPrefix(resp, "552 5.3.4 ") {
+		t.Fatalf("expected 552 response, got %q", resp)
+	}
+	assertExceeded("sender@example.com", "", 2048)
+
+	if resp := sendCommand(t, conn, r, "MAIL FROM:<sender@example.com> SIZE=512"); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("expected 250 response, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, r, "RSET"); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("expected 250 response, got %q", resp)
+	}
+
+	t.Log("DATA overflow")
+	sendCommand(t, conn, r, "MAIL FROM:<sender@example.com>")
+	sendCommand(t, conn, r, "RCPT TO:<recipient@example.com>")
+	sendCommand(t, conn, r, "DATA")
+
+	// the remainder of the data includes SMTP commands which must not be processed
+	body := "Subject: large\r\n\r\n" + strings.Repeat(strings.Repeat("x", 98)+"\r\n", 20) + "RSET\r\nQUIT\r\n"
+	if resp := sendCommand(t, conn, r, body+"."); !strings.HasPrefix(resp, "552 5.3.4 ") {
+		t.Fatalf("expected 552 response, got %q", resp)
+	}
+	assertExceeded("sender@example.com", "recipient@example.com", len(body))
+	assertNoneReceived(t, received)
+
+	t.Log("A long line without <LF> is drained")
+	sendCommand(t, conn, r, "MAIL FROM:<sender@example.com>")
+	sendCommand(t, conn, r, "RCPT TO:<recipient@example.com>")
+	sendCommand(t, conn, r, "DATA")
+	body = "Subject: long line\r\n\r\n" + strings.Repeat("x", 100000) + ".\r\n"
+	if resp := sendCommand(t, conn, r, body+"."); !strings.HasPrefix(resp, "552 5.3.4 ") {
+		t.Fatalf("expected 552 response, got %q", resp)
+	}
+	assertExceeded("sender@example.com", "recipient@example.com", len(body))
+	assertNoneReceived(t, received)
+
+	t.Log("Session remains usable")
+	if resp := sendCommand(t, conn, r, "DATA"); !strings.HasPrefix(resp, "503 ") {
+		t.Fatalf("expected the transaction to be reset, got %q", resp)
+	}
+	sendCommand(t, conn, r, "MAIL FROM:<sender@example.com>")
+	sendCommand(t, conn, r, "RCPT TO:<recipient@example.com>")
+	sendCommand(t, conn, r, "DATA")
+	if resp := sendCommand(t, conn, r, "Subject: small\r\n\r\nsmall\r\n."); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("expected 250 response, got %q", resp)
+	}
+	if msg := assertReceived(t, received); !strings.Contains(string(msg.data), "Subject: small") {
+		t.Fatalf("unexpected message received: %q", msg.data)
+	}
+}
+
+func TestReadDataLine(t *testing.T) {
+	tests := []struct {
+		data  string
+		limit int
+		line  string
+		size  int
+		crlf  bool
+	}{
+		{"short\r\n", 0, "short\r\n", 7, true},
+		{"bare lf\n", 0, "bare lf\n", 8, false},
+		// lines longer than the buffer are read in chunks
+		{strings.Repeat("x", 40) + "\r\n", 0, strings.Repeat("x", 40) + "\r\n", 42, true},
+		// <CR> at the end of one chunk & <LF> at the start of the next
+		{strings.Repeat("x", 15) + "\r\n", 0, strings.Repeat("x", 15) + "\r\n", 17, true},
+		{".\r\n", 3, ".\r\n", 3, true},
+		// lines exceeding the limit are drained
+		{strings.Repeat("x", 40) + "\r\n", 20, "", 42, true},
+		{strings.Repeat("x", 40) + "\n", 20, "", 41, false},
+	}
+
+	for _, test := range tests {
+		s := &session{br: bufio.NewReaderSize(strings.NewReader(test.data+"next\r\n"), 16)}
+
+		line, size, crlf, err := s.readDataLine(test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(line) != test.line || size != test.size || crlf != test.crlf {
+			t.Errorf("%q: expected %q (%d, %v), got %q (%d, %v)", test.data, test.line, test.size, test.crlf, line, size, crlf)
+		}
+
+		if next, _, _, _ := s.readDataLine(0); string(next) != "next\r\n" {
+			t.Errorf("%q: expected the next line, got %q", test.data, next)
+		}
+	}
+}
+
+func startTestServer(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Timeout = 5 * time.Second
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	return ln.Addr().String()
+}
+
+func dialAndReadBanner(t *testing.T, addr, expected string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading banner: %s", err.Error())
+	}
+
+	if !strings.HasPrefix(line, expected) {
+		t.Fatalf("expected banner to start with %q, got %q", expected, line)
+	}
+
+	return conn
+}
+
+func assertRejected(t *testing.T, rejected chan string) {
+	select {
+	case ip := <-rejected:
+		if ip != "127.0.0.1" {
+			t.Fatalf("expected rejected IP 127.0.0.1, got %s", ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected rejected connection callback")
+	}
+}
+
+func waitForSessions(t *testing.T, srv *Server, expected int32) {
+	for i := 0; i < 100; i++ {
+		srv.mu.Lock()
+		open := srv.openSessions
+		srv.mu.Unlock()
+		if open == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d open sessions", expected)
+}
+
+// Published SMTP smuggling end-of-data sequences, see https://www.postfix.org/smtp-smuggling.html
+var smugglingSequences = map[string]string{
+	"<LF>.<LF>":              "\n.\n",
+	"<LF>.<CR><LF>":          "\n.\r\n",
+	"<CR><LF>.<CR>":          "\r\n.\r",
+	"<CR>.<CR>":              "\r.\r",
+	"<CR><LF><NUL>.<CR><LF>": "\r\n\x00.\r\n",
+}
+
+const smuggledMessage = "MAIL FROM:<admin@example.com>\r\nRCPT TO:<victim@example.com>\r\nDATA\r\n" +
+	"From: admin@example.com\r\nTo: victim@example.com\r\nSubject: smuggled\r\n\r\nsmuggled\r\n.\r\n"
+
+type receivedMessage struct {
+	data []byte
+	info MessageInfo
+}
+
+func TestSMTPSmuggling(t *testing.T) {
+	logger.NoLogging = true
+
+	received := make(chan receivedMessage, 10)
+
+	srv := &Server{
+		Appname:           "Mailpit",
+		Hostname:          "localhost",
+		DisableReverseDNS: true,
+		InfoHandler: func(_ net.Addr, _ string, _ []string, data []byte, info MessageInfo) error {
+			received <- receivedMessage{data, info}
+			return nil
+		},
+	}
+
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	t.Log("Valid <CR><LF> message")
+	resp := sendRawMessage(t, addr, "Subject: test\r\n\r\nline 1\r\n..line 2\r\n.\r\n")
+	if !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("expected 250 response, got %q", resp)
+	}
+	msg := assertReceived(t, received)
+	if !strings.HasSuffix(string(msg.data), "Subject: test\r\n\r\nline 1\r\n.line 2\r\n") {
+		t.Fatalf("unexpected message data %q", msg.data)
+	}
+	if msg.info.BareLF || msg.info.BareCR {
+		t.Fatal("expected no bare line endings to be detected")
+	}
+	if msg.info.Helo != "localhost" {
+		t.Fatalf("expected HELO hostname \"localhost\", got %q", msg.info.Helo)
+	}
+	assertNoneReceived(t, received)
+
+	for name, seq := range smugglingSequences {
+		t.Logf("Smuggling sequence %s (normalised)", name)
+		resp := sendRawMessage(t, addr, "Subject: test\r\n\r\nmessage"+seq+smuggledMessage)
+		if !strings.HasPrefix(resp, "250 ") {
+			t.Fatalf("expected 250 response, got %q", resp)
+		}
+		msg := assertReceived(t, received)
+		if !strings.Contains(string(msg.data), "Subject: smuggled") {
+			t.Fatalf("expected smuggled message to be part of the first message, got %q", msg.data)
+		}
+		if name != "<CR><LF><NUL>.<CR><LF>" && !msg.info.BareLF && !msg.info.BareCR {
+			t.Fatal("expected bare line endings to be detected")
+		}
+		if strings.Contains(strings.ReplaceAll(string(msg.data), "\r\n", ""), "\r") ||
+			strings.Contains(strings.ReplaceAll(string(msg.data), "\r\n", ""), "\n") {
+			t.Fatalf("expected line endings to be normalised, got %q", msg.data)
+		}
+		// the smuggled message must not be delivered separately
+		assertNoneReceived(t, received)
+	}
+
+	srv.StrictLineEndings = true
+
+	for name, seq := range smugglingSequences {
+		if name == "<CR><LF><NUL>.<CR><LF>" {
+			continue
+		}
+		t.Logf("Smuggling sequence %s (strict)", name)
+		resp := sendRawMessage(t, addr, "Subject: test\r\n\r\nmessage"+seq+smuggledMessage)
+		if !strings.HasPrefix(resp, "550 5.6.0") {
+			t.Fatalf("expected 550 response, got %q", resp)
+		}
+		assertNoneReceived(t, received)
+	}
+
+	t.Log("Valid <CR><LF> message (strict)")
+	resp = sendRawMessage(t, addr, "Subject: test\r\n\r\nline 1\r\n.\r\n")
+	if !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("expected 250 response, got %q", resp)
+	}
+	assertReceived(t, received)
+}
+
+// Send a message over a raw TCP connection, returning the response to the message data
+func sendRawMessage(t *testing.T, addr, data string) string {
+	conn := dialAndReadBanner(t, addr, "220 ")
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	cmd := func(c, expected string) string {
+		if _, err := conn.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading response to %q: %s", c, err.Error())
+		}
+		if !strings.HasPrefix(line, expected) {
+			t.Fatalf("expected response to %q to start with %q, got %q", c, expected, line)
+		}
+		return line
+	}
+
+	cmd("HELO localhost\r\n", "250 ")
+	cmd("MAIL FROM:<sender@example.com>\r\n", "250 ")
+	cmd("RCPT TO:<recipient@example.com>\r\n", "250 ")
+	cmd("DATA\r\n", "354 ")
+	resp := cmd(data, "")
+	cmd("QUIT\r\n", "221 ")
+
+	return resp
+}
+
+func assertReceived(t *testing.T, received chan receivedMessage) receivedMessage {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected message to be received")
+	}
+
+	return receivedMessage{}
+}
+
+func assertNoneReceived(t *testing.T, received chan receivedMessage) {
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message received: %q", msg.data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRelayPool(t *testing.T) {
+	logger.NoLogging = true
+
+	origRelayConfig := config.SMTPRelayConfig
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		resetRelayPool()
+	}()
+
+	tests := map[string]struct {
+		poolSize    int
+		dropAfter   int
+		drop421     bool
+		connections int
+		reused      int
+		reconnects  int
+	}{
+		"pooling disabled":                        {poolSize: 0, connections: 5},
+		"pooling enabled":                         {poolSize: 2, connections: 1, reused: 4},
+		"relay disconnects between messages":      {poolSize: 2, dropAfter: 2, connections: 3, reused: 2, reconnects: 2},
+		"relay responds 421 before the next MAIL": {poolSize: 2, dropAfter: 2, drop421: true, connections: 3, reused: 2, reconnects: 2},
+	}
+
+	for name, test := range tests {
+		t.Log(name)
+		resetRelayPool()
+
+		relay := startFakeRelay(t, test.dropAfter, test.drop421)
+		host, port, _ := net.SplitHostPort(relay.addr)
+		config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: host, PoolSize: test.poolSize, PoolIdleTimeout: 30}
+		config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+
+		for i := 0; i < 5; i++ {
+			if err := Send("sender@example.com", []string{"recipient@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+				t.Fatalf("%s: error sending message %d: %s", name, i+1, err.Error())
+			}
+		}
+
+		if test.poolSize > 0 {
+			p := getRelayPool(&config.SMTPRelayConfig)
+			p.mu.Lock()
+			if p.reused != test.reused || p.reconnects != test.reconnects {
+				t.Errorf("%s: expected %d reused & %d reconnects, got %d & %d", name, test.reused, test.reconnects, p.reused, p.reconnects)
+			}
+			p.mu.Unlock()
+		}
+
+		relay.close()
+
+		assertFakeRelay(t, name, relay, 5, test.connections)
+	}
+
+	t.Log("Relay disconnects after the message data was sent")
+	resetRelayPool()
+	relay := startFakeRelay(t, 0, false)
+	relay.dropInData = true
+	host, port, _ := net.SplitHostPort(relay.addr)
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: host, PoolSize: 2, PoolIdleTimeout: 30}
+	config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+	if err := Send("sender@example.com", []string{"recipient@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n")); err == nil {
+		t.Error("expected an error when the relay disconnects during DATA")
+	}
+	p := getRelayPool(&config.SMTPRelayConfig)
+	p.mu.Lock()
+	if p.open != 0 {
+		t.Errorf("expected the broken connection to be discarded, %d open", p.open)
+	}
+	p.mu.Unlock()
+	// the message must not be retried as the relay may have accepted it
+	relay.close()
+	assertFakeRelay(t, "disconnect during DATA", relay, 0, 1)
+
+	t.Log("Idle connections are closed")
+	relay = startFakeRelay(t, 0, false)
+	host, port, _ = net.SplitHostPort(relay.addr)
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: host}
+	config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+	p = newRelayPool(&config.SMTPRelayConfig, 2, 100*time.Millisecond)
+	defer p.close()
+	for i := 0; i < 2; i++ {
+		if err := p.send("sender@example.com", []string{"recipient@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	p.mu.Lock()
+	if p.open != 0 || p.reused != 0 {
+		t.Errorf("expected idle connections to be closed, %d open & %d reused", p.open, p.reused)
+	}
+	p.mu.Unlock()
+	relay.close()
+	assertFakeRelay(t, "idle timeout", relay, 2, 2)
+}
+
+func TestRelayBatch(t *testing.T) {
+	logger.NoLogging = true
+
+	origRelayConfig := config.SMTPRelayConfig
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		resetRelayPool()
+	}()
+
+	tests := map[string]struct {
+		dropAfter   int
+		drop421     bool
+		rateLimit   int
+		connections int
+	}{
+		"single connection":                       {connections: 1},
+		"relay disconnects between messages":      {dropAfter: 2, connections: 3},
+		"relay responds 421 before the next MAIL": {dropAfter: 2, drop421: true, connections: 3},
+		"rate limited":                            {rateLimit: 20, connections: 1},
+	}
+
+	for name, test := range tests {
+		t.Log(name)
+
+		relay := startFakeRelay(t, test.dropAfter, test.drop421)
+		host, port, _ := net.SplitHostPort(relay.addr)
+		config.SMTPRelayConfig = config.SMTPRelayConfigStruct{Host: host, ReleaseRateLimit: test.rateLimit}
+		config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+
+		start := time.Now()
+		b := NewRelayBatch(&config.SMTPRelayConfig)
+		for i := 0; i < 5; i++ {
+			if err := b.Send("sender@example.com", []string{"recipient@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+				t.Fatalf("%s: error sending message %d: %s", name, i+1, err.Error())
+			}
+		}
+		b.Close()
+
+		if test.rateLimit > 0 && time.Since(start) < 4*time.Second/time.Duration(test.rateLimit) {
+			t.Errorf("%s: messages were not rate limited", name)
+		}
+
+		relay.close()
+
+		assertFakeRelay(t, name, relay, 5, test.connections)
+	}
+}
+
+func TestRelayRetry(t *testing.T) {
+	logger.NoLogging = true
+
+	origDelay := relayRetryDelay
+	relayRetryDelay = time.Millisecond
+	defer func() { relayRetryDelay = origDelay }()
+
+	tests := map[string]struct {
+		retries     int
+		replies     []string
+		dropInData  bool
+		permanent   bool
+		dataSent    bool
+		attempts    int
+		messages    int
+		connections int
+	}{
+		"no failures":                    {retries: 2, messages: 1, connections: 1},
+		"temporary failures then sent":   {retries: 2, replies: []string{"451 4.3.0 try again", "421 4.4.2 closing connection"}, messages: 1, connections: 3},
+		"temporary failures exhausted":   {retries: 1, replies: []string{"451 4.3.0 try again", "452 4.3.1 full"}, attempts: 2, connections: 2},
+		"retries disabled":               {replies: []string{"421 4.4.2 closing connection"}, attempts: 1, connections: 1},
+		"permanent failure not retried":  {retries: 3, replies: []string{"550 5.7.1 rejected"}, permanent: true, attempts: 1, connections: 1},
+		"dropped after data not retried": {retries: 3, dropInData: true, dataSent: true, attempts: 1, connections: 1},
+	}
+
+	for name, test := range tests {
+		relay := startFakeRelay(t, 0, false)
+		relay.mailReplies = test.replies
+		relay.dropInData = test.dropInData
+		host, port, _ := net.SplitHostPort(relay.addr)
+		profile := &config.SMTPRelayConfigStruct{Host: host, RetryCount: test.retries}
+		profile.Port, _ = strconv.Atoi(port)
+
+		err := SendVia(profile, "sender@example.com", []string{"recipient@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n"))
+
+		if test.attempts == 0 && err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+		} else if test.attempts > 0 {
+			var rErr *RelayError
+			if !errors.As(err, &rErr) {
+				t.Fatalf("%s: expected a RelayError, got %v", name, err)
+			}
+
+			if rErr.Permanent != test.permanent || rErr.DataSent != test.dataSent ||
+				rErr.Temporary() == (test.permanent || test.dataSent) || rErr.Attempts != test.attempts {
+				t.Errorf("%s: unexpected error: %+v", name, rErr)
+			}
+
+			if test.permanent && !strings.HasPrefix(err.Error(), "permanent error: ") {
+				t.Errorf("%s: unexpected error message: %s", name, err.Error())
+			}
+
+			if test.dataSent && !strings.HasPrefix(err.Error(), "error after sending message data: ") {
+				t.Errorf("%s: unexpected error message: %s", name, err.Error())
+			}
+
+			if !test.permanent && !test.dataSent && !strings.HasPrefix(err.Error(), "temporary error") {
+				t.Errorf("%s: unexpected error message: %s", name, err.Error())
+			}
+		}
+
+		relay.close()
+
+		assertFakeRelay(t, name, relay, test.messages, test.connections)
+	}
+}
+
+func TestRelayBlockedRecipients(t *testing.T) {
+	logger.NoLogging = true
+
+	origRelayConfig := config.SMTPRelayConfig
+	origRelayAll := config.SMTPRelayAll
+	defer func() {
+		config.SMTPRelayConfig = origRelayConfig
+		config.SMTPRelayAll = origRelayAll
+	}()
+
+	relay := startFakeRelay(t, 0, false)
+	host, port, _ := net.SplitHostPort(relay.addr)
+	config.SMTPRelayConfig = config.SMTPRelayConfigStruct{
+		Host:                    host,
+		AllowedRecipientsRegexp: regexp.MustCompile(`@example\.(com|org)$`),
+		BlockedRecipientsRegexp: regexp.MustCompile(`@customer\.example\.org$`),
+	}
+	config.SMTPRelayConfig.Port, _ = strconv.Atoi(port)
+	config.SMTPRelayAll = true
+
+	tests := map[string]bool{
+		"user@example.com":          false,
+		"user@example.org":          false,
+		"user@customer.example.org": true,
+		"user@Customer.Example.ORG": true,
+		"USER@CUSTOMER.EXAMPLE.ORG": true,
+	}
+
+	for address, blocked := range tests {
+		err := CheckBlockedRecipient(&config.SMTPRelayConfig, address)
+		if blocked && (err == nil || !strings.Contains(err.Error(), address)) {
+			t.Errorf("%s: expected to be blocked, got %v", address, err)
+		} else if !blocked && err != nil {
+			t.Errorf("%s: unexpected error: %s", address, err.Error())
+		}
+	}
+
+	data := []byte("Subject: test\r\n\r\ntest\r\n")
+	relayed, err := autoRelayMessage("sender@example.com", []string{"user@example.com", "user@Customer.Example.org"}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(relayed, ",") != "user@example.com" {
+		t.Errorf("blocked recipient was relayed: %v", relayed)
+	}
+
+	relayed, err = autoRelayMessage("sender@example.com", []string{"user@customer.example.org"}, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(relayed) != 0 {
+		t.Errorf("blocked recipient was relayed: %v", relayed)
+	}
+
+	relay.close()
+
+	assertFakeRelay(t, "blocked recipients", relay, 1, 1)
+}
+
+func resetRelayPool() {
+	relayPoolMu.Lock()
+	defer relayPoolMu.Unlock()
+
+	for name, p := range relayPools {
+		p.close()
+		delete(relayPools, name)
+	}
+}
+
+// FakeRelay is a scripted SMTP relay server
+type fakeRelay struct {
+	ln   net.Listener
+	addr string
+	// close the connection after this many messages per connection (0 to disable)
+	dropAfter int
+	// respond with 421 to the next MAIL command rather than silently closing the connection
+	drop421 bool
+	// close the connection after receiving the message data, without a response
+	dropInData bool
+	// replies to the first MAIL commands before they are accepted, the connection is closed after a 421
+	mailReplies []string
+
+	mu          sync.Mutex
+	wg          sync.WaitGroup
+	connections int
+	messages    int
+}
+
+func startFakeRelay(t *testing.T, dropAfter int, drop421 bool) *fakeRelay {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := &fakeRelay{ln: ln, addr: ln.Addr().String(), dropAfter: dropAfter, drop421: drop421}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			relay.mu.Lock()
+			relay.connections++
+			relay.mu.Unlock()
+			relay.wg.Add(1)
+			go relay.handle(conn)
+		}
+	}()
+
+	return relay
+}
+
+func (f *fakeRelay) handle(conn net.Conn) {
+	defer f.wg.Done()
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		_, _ = conn.Write([]byte(s + "\r\n"))
+	}
+
+	reply("220 fake ESMTP")
+	delivered := 0
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "MAIL"):
+			f.mu.Lock()
+			var failure string
+			if len(f.mailReplies) > 0 {
+				failure, f.mailReplies = f.mailReplies[0], f.mailReplies[1:]
+			}
+			f.mu.Unlock()
+			if failure != "" {
+				reply(failure)
+				if strings.HasPrefix(failure, "421") {
+					return
+				}
+				continue
+			}
+			if f.drop421 && f.dropAfter > 0 && delivered >= f.dropAfter {
+				reply("421 4.4.2 closing connection")
+				return
+			}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+			}
+			if f.dropInData {
+				return
+			}
+			f.mu.Lock()
+			f.messages++
+			f.mu.Unlock()
+			delivered++
+			reply("250 OK queued")
+			if !f.drop421 && f.dropAfter > 0 && delivered >= f.dropAfter {
+				return
+			}
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			// RCPT, RSET & NOOP
+			reply("250 OK")
+		}
+	}
+}
+
+func (f *fakeRelay) close() {
+	_ = f.ln.Close()
+	resetRelayPool()
+	f.wg.Wait()
+}
+
+func assertFakeRelay(t *testing.T, name string, f *fakeRelay, messages, connections int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.messages != messages {
+		t.Errorf("%s: expected %d messages relayed, got %d", name, messages, f.messages)
+	}
+
+	if f.connections != connections {
+		t.Errorf("%s: expected %d relay connections, got %d", name, connections, f.connections)
+	}
+}
+
+func TestRequireTLSAuth(t *testing.T) {
+	logger.NoLogging = true
+
+	received := make(chan receivedMessage, 10)
+	tlsConfig := testTLSConfig(t)
+
+	newServer := func() *Server {
+		return &Server{
+			Appname:           "Mailpit",
+			Hostname:          "localhost",
+			DisableReverseDNS: true,
+			TLSConfig:         tlsConfig,
+			AuthRequireTLS:    true,
+			AuthMechs:         map[string]bool{"CRAM-MD5": false, "PLAIN": true, "LOGIN": true},
+			AuthHandler: func(_ net.Addr, _ string, username []byte, password []byte, _ []byte) (bool, error) {
+				return string(username) == "user" && string(password) == "pass", nil
+			},
+			InfoHandler: func(_ net.Addr, _ string, _ []string, data []byte, info MessageInfo) error {
+				received <- receivedMessage{data, info}
+				return nil
+			},
+		}
+	}
+
+	srv := newServer()
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	t.Log("Plaintext AUTH is rejected")
+	conn := dialAndReadBanner(t, addr, "220 ")
+	r := bufio.NewReader(conn)
+	ehlo := sendCommand(t, conn, r, "EHLO localhost")
+	if strings.Contains(ehlo, "AUTH") || !strings.Contains(ehlo, "STARTTLS") {
+		t.Errorf("expected STARTTLS without AUTH in plaintext EHLO response, got %q", ehlo)
+	}
+	resp := sendCommand(t, conn, r, "AUTH PLAIN AHVzZXIAcGFzcw==")
+	if !strings.HasPrefix(resp, "538 5.7.11 Encryption required for requested authentication mechanism") {
+		t.Errorf("expected 538 response to plaintext AUTH, got %q", resp)
+	}
+	_ = conn.Close()
+
+	sendTestMessage(t, addr, nil, false)
+	info := assertReceived(t, received).info
+	if info.TLS || info.Authenticated || info.AuthUser != "" {
+		t.Errorf("expected plaintext, unauthenticated message info, got %+v", info)
+	}
+
+	t.Log("AUTH after STARTTLS")
+	sendTestMessage(t, addr, nil, true)
+	info = assertReceived(t, received).info
+	if !info.TLS || !info.Authenticated || info.AuthUser != "user" {
+		t.Errorf("expected TLS, authenticated message info, got %+v", info)
+	}
+
+	t.Log("AUTH with a TLS listener")
+	tlsSrv := newServer()
+	tlsSrv.Timeout = 5 * time.Second
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = tlsSrv.Serve(tls.NewListener(ln, tlsConfig))
+	}()
+	defer tlsSrv.Close()
+
+	sendTestMessage(t, ln.Addr().String(), &tls.Config{InsecureSkipVerify: true}, false) // #nosec
+	info = assertReceived(t, received).info
+	if !info.TLS || !info.Authenticated {
+		t.Errorf("expected TLS, authenticated message info, got %+v", info)
+	}
+}
+
+// SendCommand writes an SMTP command and returns the (possibly multiline) response
+func sendCommand(t *testing.T, conn net.Conn, r *bufio.Reader, cmd string) string {
+	if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading response to %q: %s", cmd, err.Error())
+		}
+		resp += line
+		if len(line) < 4 || line[3] != '-' {
+			return resp
+		}
+	}
+}
+
+// SendTestMessage sends an authenticated message, connecting with implicit TLS if tlsConfig is set,
+// else optionally negotiating STARTTLS
+func sendTestMessage(t *testing.T, addr string, tlsConfig *tls.Config, startTLS bool) {
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	if startTLS {
+		if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil { // #nosec
+			t.Fatal(err)
+		}
+	}
+
+	if ok, _ := c.Extension("AUTH"); ok != (tlsConfig != nil || startTLS) {
+		t.Fatalf("expected AUTH to be advertised only over TLS")
+	}
+
+	if tlsConfig != nil || startTLS {
+		if err := c.Auth(smtp.PlainAuth("", "user", "pass", "localhost")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("recipient@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.Quit()
+}
+
+// TestTLSConfig returns a TLS config with a self-signed certificate for localhost
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}} // #nosec
+}
+
+func TestSenderQuota(t *testing.T) {
+	logger.NoLogging = true
+	config.SMTPSenderQuota = 2
+	config.SMTPSenderQuotaWindowDuration = time.Hour
+	config.SMTPSenderQuotaBy = "domain"
+	config.SMTPSenderQuotaExemptRegexp = regexp.MustCompile(`^bulk@`)
+	senderQuotas = map[string]*senderUsage{}
+	defer func() {
+		config.SMTPSenderQuota = 0
+		config.SMTPSenderQuotaBy = "address"
+		config.SMTPSenderQuotaExemptRegexp = nil
+		senderQuotas = map[string]*senderUsage{}
+	}()
+
+	srv := &Server{
+		Hostname:      "mailpit",
+		HandlerSender: handlerSenderQuota,
+		Handler: func(_ net.Addr, from string, _ []string, _ []byte) error {
+			logSenderQuota(from)
+			return nil
+		},
+	}
+	addr := startTestServer(t, srv)
+
+	send := func(from string) string {
+		conn := dialAndReadBanner(t, addr, "220")
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		sendCommand(t, conn, r, "HELO localhost")
+		sendCommand(t, conn, r, "MAIL FROM:<"+from+">")
+		if resp := sendCommand(t, conn, r, "RCPT TO:<test@example.com>"); !strings.HasPrefix(resp, "250") {
+			return resp
+		}
+		sendCommand(t, conn, r, "DATA")
+		return sendCommand(t, conn, r, "Subject: test\r\n\r\ntest\r\n.")
+	}
+
+	for _, from := range []string{"one@example.com", "two@example.com"} {
+		if resp := send(from); !strings.HasPrefix(resp, "250") {
+			t.Fatalf("expected message from %s to be accepted, got %q", from, resp)
+		}
+	}
+
+	t.Log("Senders over the quota are temporarily rejected")
+	if resp := send("three@EXAMPLE.com"); !strings.HasPrefix(resp, "452 4.5.3") {
+		t.Errorf("expected a 452 response, got %q", resp)
+	}
+
+	t.Log("Other & exempt senders are accepted")
+	for _, from := range []string{"one@example.net", "bulk@example.com", "bulk@example.com", "bulk@example.com"} {
+		if resp := send(from); !strings.HasPrefix(resp, "250") {
+			t.Errorf("expected message from %s to be accepted, got %q", from, resp)
+		}
+	}
+
+	usage := SenderQuotas()
+	if len(usage) != 2 || usage[0].Sender != "example.com" || usage[0].Messages != 2 || usage[0].Rejected != 1 || !usage[0].Limited {
+		t.Errorf("unexpected sender quotas %+v", usage)
+	}
+
+	t.Log("Messages outside the quota window are not counted")
+	u := senderQuotas["example.com"]
+	for b, c := range u.Buckets {
+		delete(u.Buckets, b)
+		u.Buckets[b-int64(2*time.Hour/time.Second)] = c
+	}
+	if resp := send("four@example.com"); !strings.HasPrefix(resp, "250") {
+		t.Errorf("expected message to be accepted after the quota window, got %q", resp)
+	}
+}
+
+func TestSenderQuotaEnabledAtRuntime(t *testing.T) {
+	logger.NoLogging = true
+	senderQuotas = map[string]*senderUsage{}
+	defer func() {
+		_ = config.ApplyRuntimeSettings(map[string]interface{}{"smtp-sender-quota": 0})
+		senderQuotas = map[string]*senderUsage{}
+	}()
+
+	srv, err := newServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.InfoHandler = nil
+	srv.Handler = func(_ net.Addr, from string, _ []string, _ []byte) error {
+		logSenderQuota(from)
+		return nil
+	}
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	if err := config.ApplyRuntimeSettings(map[string]interface{}{"smtp-sender-quota": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []string{"250", "452 4.5.3"} {
+		conn := dialAndReadBanner(t, addr, "220")
+		r := bufio.NewReader(conn)
+		sendCommand(t, conn, r, "HELO localhost")
+		sendCommand(t, conn, r, "MAIL FROM:<sender@example.com>")
+		if resp := sendCommand(t, conn, r, "RCPT TO:<test@example.com>"); !strings.HasPrefix(resp, expected) {
+			t.Errorf("message %d: expected a %s response, got %q", i+1, expected, resp)
+		}
+		sendCommand(t, conn, r, "DATA")
+		sendCommand(t, conn, r, "Subject: test\r\n\r\ntest\r\n.")
+		conn.Close()
+	}
+}
+
+func TestSessionLogging(t *testing.T) {
+	logger.NoLogging = true
+	logger.VerboseLogging = true
+	defer func() {
+		logger.VerboseLogging = false
+		Debug = false
+	}()
+
+	srv, err := newServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	logged := []string{}
+	srv.LogRead = func(_, verb, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, verb+" "+line)
+	}
+	srv.LogWrite = srv.LogRead
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	conn := dialAndReadBanner(t, addr, "220")
+	sendCommand(t, conn, bufio.NewReader(conn), "HELO localhost")
+	conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(logged, "|") != "WROTE 220 "+srv.Hostname+" Mailpit ESMTP Service ready|READ HELO localhost|WROTE 250 "+srv.Hostname+" greets localhost" {
+		t.Errorf("unexpected session log %q", logged)
+	}
+}
+
+func TestRemoveHeader(t *testing.T) {
+	data := []byte("Subject: test\r\nX-Mailpit-TTL: 15m\r\nTo: test@example.com\r\n\r\nX-Mailpit-TTL: 1h\r\n")
+
+	res := string(removeHeader(data, ttlHeaderRe))
+	if res != "Subject: test\r\nTo: test@example.com\r\n\r\nX-Mailpit-TTL: 1h\r\n" {
+		t.Errorf("unexpected message: %q", res)
+	}
+
+	data = []byte("x-mailpit-ttl: 15m\r\n\tfolded\r\nSubject: test\r\n\r\nbody\r\n")
+
+	res = string(removeHeader(data, ttlHeaderRe))
+	if res != "Subject: test\r\n\r\nbody\r\n" {
+		t.Errorf("unexpected message: %q", res)
+	}
+}
+
+func TestRecipientPolicies(t *testing.T) {
+	logger.NoLogging = true
+	defer func() {
+		config.SMTPAllowedRecipientsRegexp = nil
+		config.SMTPDeniedRecipientsRegexp = nil
+		recipientRejectionsTotal, recipientRejectionsNext = 0, 0
+	}()
+
+	received := make(chan []string, 10)
+	srv := &Server{
+		Hostname:    "mailpit",
+		HandlerRcpt: handlerRcpt,
+		Handler: func(_ net.Addr, _ string, to []string, _ []byte) error {
+			received <- to
+			return nil
+		},
+	}
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	send := func(to ...string) []string {
+		conn := dialAndReadBanner(t, addr, "220")
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		sendCommand(t, conn, r, "HELO localhost")
+		sendCommand(t, conn, r, "MAIL FROM:<sender@example.com>")
+		responses := []string{}
+		for _, addr := range to {
+			responses = append(responses, strings.TrimSpace(sendCommand(t, conn, r, "RCPT TO:<"+addr+">")))
+		}
+		sendCommand(t, conn, r, "DATA")
+		sendCommand(t, conn, r, "Subject: test\r\n\r\ntest\r\n.")
+		return responses
+	}
+
+	assertReceived := func(to string) {
+		select {
+		case r := <-received:
+			if strings.Join(r, ",") != to {
+				t.Fatalf("expected recipients %q, got %q", to, strings.Join(r, ","))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected message to be received")
+		}
+	}
+
+	t.Log("All recipients are accepted by default")
+	send("one@example.com", "customer@real.example.net")
+	assertReceived("one@example.com,customer@real.example.net")
+
+	t.Log("Allowed & denied recipients")
+	config.SMTPAllowedRecipientsRegexp = regexp.MustCompile(`@example\.(com|net)$`)
+	config.SMTPDeniedRecipientsRegexp = regexp.MustCompile(`@real\.example\.net$`)
+	responses := send("one@example.com", "customer@real.example.net", "other@example.org", "two@example.net")
+	expected := []string{
+		"250 2.1.5 Ok",
+		"550 5.7.1 Recipient <customer@real.example.net> rejected by the smtp-denied-recipients policy",
+		"550 5.7.1 Recipient <other@example.org> rejected by the smtp-allowed-recipients policy",
+		"250 2.1.5 Ok",
+	}
+	for i, resp := range responses {
+		if resp != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], resp)
+		}
+	}
+	assertReceived("one@example.com,two@example.net")
+
+	res := GetRecipientRejections()
+	if res.Total != 2 || len(res.Rejections) != 2 {
+		t.Fatalf("expected 2 rejections, got %+v", res)
+	}
+	if r := res.Rejections[0]; r.To != "other@example.org" || r.Policy != "smtp-allowed-recipients" || r.From != "sender@example.com" || r.ClientIP != "127.0.0.1" {
+		t.Errorf("unexpected rejection %+v", r)
+	}
+	if r := res.Rejections[1]; r.To != "customer@real.example.net" || r.Policy != "smtp-denied-recipients" {
+		t.Errorf("unexpected rejection %+v", r)
+	}
+
+	t.Log("Only the most recent rejections are kept")
+	for i := 0; i < recipientRejectionsSize; i++ {
+		if err := handlerRcpt(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, "sender@example.com", strconv.Itoa(i)+"@example.org"); err == nil {
+			t.Fatal("expected recipient to be rejected")
+		}
+	}
+	res = GetRecipientRejections()
+	if res.Total != recipientRejectionsSize+2 || len(res.Rejections) != recipientRejectionsSize {
+		t.Fatalf("expected %d of %d rejections, got %d of %d", recipientRejectionsSize, recipientRejectionsSize+2, len(res.Rejections), res.Total)
+	}
+	if res.Rejections[0].To != strconv.Itoa(recipientRejectionsSize-1)+"@example.org" || res.Rejections[recipientRejectionsSize-1].To != "0@example.org" {
+		t.Errorf("unexpected rejection order: %s ... %s", res.Rejections[0].To, res.Rejections[recipientRejectionsSize-1].To)
+	}
+}
+
+func TestRuntimeSettingsConcurrency(t *testing.T) {
+	logger.NoLogging = true
+	senderQuotas = map[string]*senderUsage{}
+	defer func() {
+		_ = config.ApplyRuntimeSettings(map[string]interface{}{
+			"smtp-denied-recipients": "",
+			"smtp-sender-quota":      0,
+			"smtp-relay-paused":      false,
+			"smtp-max-connections":   0,
+		})
+		config.ConnectionLimitsChanged = nil
+		smtpServer.Store(nil)
+		senderQuotas = map[string]*senderUsage{}
+		recipientRejectionsTotal, recipientRejectionsNext = 0, 0
+	}()
+
+	srv := &Server{
+		Hostname:      "mailpit",
+		HandlerRcpt:   handlerRcpt,
+		HandlerSender: handlerSenderQuota,
+		Handler: func(_ net.Addr, from string, to []string, data []byte) error {
+			logSenderQuota(from)
+			_, err := autoRelayMessage(from, to, &data)
+			return err
+		},
+	}
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	smtpServer.Store(srv)
+	config.ConnectionLimitsChanged = setConnectionLimits
+
+	// change the settings continuously while messages are being received
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			denied := ""
+			if i%2 == 0 {
+				denied = "^denied@"
+			}
+			if err := config.ApplyRuntimeSettings(map[string]interface{}{
+				"smtp-denied-recipients": denied,
+				"smtp-sender-quota":      1000 + i%2,
+				"smtp-relay-paused":      i%2 == 0,
+				"smtp-max-connections":   100 + i%2,
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		conn := dialAndReadBanner(t, addr, "220")
+		r := bufio.NewReader(conn)
+		sendCommand(t, conn, r, "HELO localhost")
+		sendCommand(t, conn, r, "MAIL FROM:<sender@example.com>")
+		sendCommand(t, conn, r, "RCPT TO:<denied@example.com>")
+		sendCommand(t, conn, r, "RCPT TO:<recipient@example.com>")
+		sendCommand(t, conn, r, "DATA")
+		if resp := sendCommand(t, conn, r, "Subject: test\r\n\r\ntest\r\n."); !strings.HasPrefix(resp, "250") {
+			t.Errorf("expected message to be accepted, got %q", resp)
+		}
+		conn.Close()
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	logger.NoLogging = true
+
+	type envelope struct {
+		from string
+		to   []string
+		data []byte
+	}
+
+	received := make(chan envelope, 10)
+	srv := &Server{
+		Hostname: "mailpit",
+		Handler: func(_ net.Addr, from string, to []string, data []byte) error {
+			received <- envelope{from, to, data}
+			return nil
+		},
+	}
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	assertEnvelope := func(from, to string) envelope {
+		select {
+		case e := <-received:
+			if e.from != from || strings.Join(e.to, ",") != to {
+				t.Fatalf("expected %s -> %s, got %s -> %s", from, to, e.from, strings.Join(e.to, ","))
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected message to be received")
+		}
+		return envelope{}
+	}
+
+	t.Log("Internationalised addresses are accepted")
+	conn := dialAndReadBanner(t, addr, "220")
+	r := bufio.NewReader(conn)
+	ehlo := sendCommand(t, conn, r, "EHLO localhost")
+	if !strings.Contains(ehlo, "250-SMTPUTF8") || !strings.Contains(ehlo, "250-8BITMIME") {
+		t.Errorf("expected SMTPUTF8 & 8BITMIME in EHLO response, got %q", ehlo)
+	}
+	if resp := sendCommand(t, conn, r, "MAIL FROM:<发送@例え.jp> SMTPUTF8 BODY=8BITMIME"); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("expected 250 response to MAIL, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, r, "RCPT TO:<用户@例え.jp>"); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("expected 250 response to RCPT, got %q", resp)
+	}
+	sendCommand(t, conn, r, "DATA")
+	sendCommand(t, conn, r, "From: 发送@例え.jp\r\nTo: 用户@例え.jp\r\nSubject: 测试\r\n\r\ntest\r\n.")
+	_ = conn.Close()
+	e := assertEnvelope("发送@例え.jp", "用户@例え.jp")
+	if !bytes.Contains(e.data, []byte("To: 用户@例え.jp\r\n")) {
+		t.Errorf("expected UTF-8 headers to be intact, got %q", e.data)
+	}
+
+	t.Log("Relaying via a server supporting SMTPUTF8")
+	host, port, _ := net.SplitHostPort(addr)
+	profile := &config.SMTPRelayConfigStruct{Host: host}
+	profile.Port, _ = strconv.Atoi(port)
+	if err := SendVia(profile, "发送@例え.jp", []string{"用户@例え.jp", "user@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	assertEnvelope("发送@例え.jp", "用户@例え.jp,user@example.com")
+
+	t.Log("Relaying via a server without SMTPUTF8")
+	relay := startFakeRelay(t, 0, false)
+	host, port, _ = net.SplitHostPort(relay.addr)
+	profile = &config.SMTPRelayConfigStruct{Host: host, RetryCount: 2}
+	profile.Port, _ = strconv.Atoi(port)
+
+	if err := SendVia(profile, "sender@example.com", []string{"user@example.com"}, []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := SendVia(profile, "sender@example.com", []string{"用户@例え.jp"}, []byte("Subject: test\r\n\r\ntest\r\n"))
+	var rErr *RelayError
+	if !errors.Is(err, ErrSMTPUTF8NotSupported) || !errors.As(err, &rErr) || !rErr.Permanent || rErr.Attempts != 1 {
+		t.Errorf("expected a permanent SMTPUTF8 error, got %v", err)
+	} else if !strings.Contains(err.Error(), "用户@例え.jp") {
+		t.Errorf("expected the address in the error, got %s", err.Error())
+	}
+
+	if _, err := ProbeVia(profile, "发送@例え.jp", []string{"user@example.com"}); !errors.Is(err, ErrSMTPUTF8NotSupported) {
+		t.Errorf("expected an SMTPUTF8 error when probing, got %v", err)
+	}
+
+	relay.close()
+
+	assertFakeRelay(t, "SMTPUTF8", relay, 1, 3)
+}
+
+func TestLMTP(t *testing.T) {
+	logger.NoLogging = true
+	defer func() { config.SMTPDeniedRecipientsRegexp = nil }()
+	config.SMTPDeniedRecipientsRegexp = regexp.MustCompile(`^denied@`)
+
+	received := make(chan receivedMessage, 10)
+	srv := &Server{
+		Appname:           "Mailpit",
+		Hostname:          "mailpit",
+		DisableReverseDNS: true,
+		LMTP:              true,
+		HandlerRcpt:       handlerRcpt,
+		InfoHandler: func(_ net.Addr, _ string, _ []string, data []byte, info MessageInfo) error {
+			received <- receivedMessage{data, info}
+			return nil
+		},
+	}
+	addr := startTestServer(t, srv)
+	defer srv.Close()
+
+	t.Log("HELO & EHLO are not permitted")
+	conn := dialAndReadBanner(t, addr, "220 mailpit Mailpit LMTP Service ready")
+	r := bufio.NewReader(conn)
+	for _, cmd := range []string{"HELO localhost", "EHLO localhost"} {
+		if resp := sendCommand(t, conn, r, cmd); !strings.HasPrefix(resp, "500 5.5.1 ") {
+			t.Errorf("%s: expected 500 response, got %q", cmd, resp)
+		}
+	}
+	_ = conn.Close()
+
+	t.Log("A response for each recipient")
+	c := dialLMTP(t, "tcp", addr)
+	if ok, _ := c.Extension("ENHANCEDSTATUSCODES"); !ok {
+		t.Error("expected extensions in LHLO response")
+	}
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"one@example.com", "denied@example.com", "two@example.com"} {
+		if err := c.Rcpt(to); err != nil {
+			t.Fatalf("expected %s to be accepted until the message data, got %v", to, err)
+		}
+	}
+	statuses := lmtpData(t, c, "Subject: test\r\n\r\ntest\r\n")
+	expected := []string{
+		"one@example.com: 250",
+		"denied@example.com: 550 5.7.1 Recipient <denied@example.com> rejected by the smtp-denied-recipients policy",
+		"two@example.com: 250",
+	}
+	if strings.Join(statuses, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected responses %q, got %q", expected, statuses)
+	}
+	// the next response is for NOOP, not a further recipient
+	if err := c.Noop(); err != nil {
+		t.Errorf("expected NOOP response, got %v", err)
+	}
+
+	t.Log("LMTP connections are included in the connection stats")
+	lmtpServer.Store(srv)
+	if open, ips, _ := connectionCounts(); open != 1 || ips != 1 {
+		t.Errorf("expected 1 open connection from 1 IP, got %d from %d", open, ips)
+	}
+	lmtpServer.Store(nil)
+
+	msg := assertReceived(t, received)
+	if msg.info.Protocol != "lmtp" || !strings.Contains(string(msg.data), "with LMTP") {
+		t.Errorf("expected message received with LMTP, got %+v: %q", msg.info, msg.data)
+	}
+	assertNoneReceived(t, received)
+
+	t.Log("Nothing is delivered if every recipient is rejected")
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("denied@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("Subject: denied\r\n\r\ntest\r\n"))
+	var protoErr *textproto.Error
+	if err := w.Close(); !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Errorf("expected a 550 response, got %v", err)
+	}
+	assertNoneReceived(t, received)
+
+	t.Log("A response for each recipient when the message is rejected")
+	srv.MaxSize = 10
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"one@example.com", "two@example.com", "three@example.com"} {
+		if err := c.Rcpt(to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, status := range lmtpData(t, c, "Subject: too large\r\n\r\ntest\r\n") {
+		if !strings.Contains(status, ": 552 5.3.4 ") {
+			t.Errorf("unexpected response %q", status)
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	assertNoneReceived(t, received)
+
+	t.Log("LHLO is not permitted with SMTP")
+	smtpSrv := &Server{Hostname: "mailpit"}
+	smtpAddr := startTestServer(t, smtpSrv)
+	defer smtpSrv.Close()
+	c, err = lmtpDial("tcp", smtpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("localhost"); !errors.As(err, &protoErr) || protoErr.Code != 500 {
+		t.Errorf("expected 500 response to LHLO, got %v", err)
+	}
+	_ = c.Close()
+
+	t.Log("STARTTLS")
+	srv.MaxSize = 0
+	srv.TLSConfig = testTLSConfig(t)
+	srv.TLSRequired = true
+	c = dialLMTP(t, "tcp", addr)
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Error("expected STARTTLS in LHLO response")
+	}
+	if err := c.Mail("sender@example.com"); !errors.As(err, &protoErr) || protoErr.Code != 530 {
+		t.Errorf("expected STARTTLS to be required, got %v", err)
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil { // #nosec
+		t.Fatal(err)
+	}
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("one@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	lmtpData(t, c, "Subject: tls\r\n\r\ntest\r\n")
+	_ = c.Quit()
+	if msg := assertReceived(t, received); !msg.info.TLS || msg.info.Protocol != "lmtp" {
+		t.Errorf("expected message received with LMTP over TLS, got %+v", msg.info)
+	}
+
+	t.Log("Unix socket")
+	socket := filepath.Join(t.TempDir(), "lmtp.sock")
+	unixSrv := &Server{
+		Addr:        socket,
+		Network:     "unix",
+		Hostname:    "mailpit",
+		LMTP:        true,
+		Timeout:     5 * time.Second,
+		InfoHandler: srv.InfoHandler,
+	}
+	go func() { _ = unixSrv.ListenAndServe() }()
+	defer unixSrv.Close()
+
+	c = dialLMTP(t, "unix", socket)
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("one@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	lmtpData(t, c, "Subject: unix\r\n\r\ntest\r\n")
+	_ = c.Close()
+	if msg := assertReceived(t, received); !strings.Contains(string(msg.data), "Subject: unix") {
+		t.Errorf("unexpected message received: %q", msg.data)
+	}
+}
+
+// DialLMTP connects to an LMTP server & sends LHLO, retrying while a unix socket is created
+func dialLMTP(t *testing.T, network, addr string) *lmtpClient {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial(network, addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c, err := newLMTPClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// LmtpData sends the message data, returning the response for each recipient as "<recipient>: <code> [<message>]",
+// with only the code for accepted recipients
+func lmtpData(t *testing.T, c *lmtpClient, data string) []string {
+	statuses := []string{}
+	w, err := c.LMTPData(func(rcpt string, err error) {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			statuses = append(statuses, fmt.Sprintf("%s: %d %s", rcpt, protoErr.Code, protoErr.Msg))
+		} else {
+			statuses = append(statuses, rcpt+": 250")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = w.Write([]byte(data))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return statuses
+}
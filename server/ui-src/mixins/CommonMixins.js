@@ -2,6 +2,7 @@ import axios from 'axios'
 import moment from 'moment'
 import ColorHash from 'color-hash'
 import { Modal, Offcanvas } from 'bootstrap'
+import { mailbox } from '../stores/mailbox.js'
 
 // BootstrapElement is used to return a fake Bootstrap element
 // if the ID returns nothing to prevent errors.
@@ -259,9 +260,14 @@ export default {
 			return 'bi-file-arrow-down-fill'
 		},
 
-		// Returns a hex color based on a string.
+		// Returns a hex color based on a string, unless a tag color has been set.
 		// Values are stored in an array for faster lookup / processing.
 		colorHash: function (s) {
+			const meta = mailbox.tagMeta[s.toLowerCase()]
+			if (meta && meta.Color) {
+				return meta.Color
+			}
+
 			if (this.tagColorCache[s] != undefined) {
 				return this.tagColorCache[s]
 			}
@@ -9,6 +9,7 @@ export const mailbox = reactive({
 	count: 0, 				// total in mailbox or search
 	messages: [],			// current messages
 	tags: [], 				// all tags
+	tagMeta: {},			// tag metadata (color & description) by lowercase tag name
 	selected: [], 			// currently selected
 	connected: false, 		// websocket connection
 	searching: false,		// current search, false for none
@@ -0,0 +1,175 @@
+package webhook
+
+import "time"
+
+// Webhook event types
+const (
+	// MessageReceived is sent for new messages, the data is the message summary
+	MessageReceived = "message.received"
+	// MessageDeleted is sent when messages are deleted, the data is DeletedData
+	MessageDeleted = "message.deleted"
+	// MessagesPruned is sent when messages are automatically pruned, the data is PrunedData
+	MessagesPruned = "messages.pruned"
+	// MessageRead is sent when the read status of messages changes, the data is ReadData
+	MessageRead = "message.read"
+	// MessageTagsChanged is sent when message tags are changed, the data is TagsData
+	MessageTagsChanged = "message.tags_changed"
+)
+
+// EventTypes are all the supported event types
+var EventTypes = []string{MessageReceived, MessageDeleted, MessagesPruned, MessageRead, MessageTagsChanged}
+
+// Event is the payload sent to webhook endpoints
+type Event struct {
+	// Event type, eg: message.deleted
+	Type string
+	// Time of the event
+	Time time.Time
+	// Optional instance label
+	Label string `json:",omitempty"`
+	// Event data, depending on the event type
+	Data interface{}
+}
+
+// DeletedData is the data of a message.deleted event
+type DeletedData struct {
+	// Database IDs of the deleted messages, empty if all messages were deleted
+	IDs []string
+	// Number of deleted messages
+	Count int
+	// Whether all messages were deleted
+	All bool `json:",omitempty"`
+}
+
+// PrunedData is the data of a messages.pruned event
+type PrunedData struct {
+	// Database IDs of the pruned messages
+	IDs []string
+	// Number of pruned messages
+	Count int
+}
+
+// ReadData is the data of a message.read event
+type ReadData struct {
+	// Database IDs of the updated messages, empty if all messages were updated
+	IDs []string
+	// Whether the messages were marked as read (true) or unread (false)
+	Read bool
+	// Number of updated messages
+	Count int
+	// Whether all messages were updated
+	All bool `json:",omitempty"`
+}
+
+// TagsData is the data of a message.tags_changed event
+type TagsData struct {
+	// Messages & their tags
+	Messages []MessageTags
+}
+
+// MessageTags are the current tags of a message
+type MessageTags struct {
+	// Database ID
+	ID string
+	// Message tags
+	Tags []string
+}
+
+// Merger is implemented by event data which can be aggregated
+type merger interface {
+	// merge returns the aggregated data, or false if the data cannot be merged
+	merge(next interface{}) (interface{}, bool)
+}
+
+func (d DeletedData) merge(next interface{}) (interface{}, bool) {
+	n, ok := next.(DeletedData)
+	if !ok || d.All || n.All {
+		return nil, false
+	}
+
+	d.IDs = append(append([]string{}, d.IDs...), n.IDs...)
+	d.Count = d.Count + n.Count
+
+	return d, true
+}
+
+func (d PrunedData) merge(next interface{}) (interface{}, bool) {
+	n, ok := next.(PrunedData)
+	if !ok {
+		return nil, false
+	}
+
+	d.IDs = append(append([]string{}, d.IDs...), n.IDs...)
+	d.Count = d.Count + n.Count
+
+	return d, true
+}
+
+func (d ReadData) merge(next interface{}) (interface{}, bool) {
+	n, ok := next.(ReadData)
+	if !ok || d.All || n.All || d.Read != n.Read {
+		return nil, false
+	}
+
+	d.IDs = append(append([]string{}, d.IDs...), n.IDs...)
+	d.Count = d.Count + n.Count
+
+	return d, true
+}
+
+func (d TagsData) merge(next interface{}) (interface{}, bool) {
+	n, ok := next.(TagsData)
+	if !ok {
+		return nil, false
+	}
+
+	messages := []MessageTags{}
+	for _, m := range d.Messages {
+		replaced := false
+		for _, nm := range n.Messages {
+			if nm.ID == m.ID {
+				replaced = true
+				break
+			}
+		}
+		// only the latest tags of each message are sent
+		if !replaced {
+			messages = append(messages, m)
+		}
+	}
+	d.Messages = append(messages, n.Messages...)
+
+	return d, true
+}
+
+// Coalesce aggregates consecutive events of the same type, retaining the order of events
+func coalesce(events []Event) []Event {
+	result := []Event{}
+
+	for _, ev := range events {
+		if len(result) > 0 {
+			last := &result[len(result)-1]
+			if m, ok := last.Data.(merger); ok && last.Type == ev.Type {
+				if merged, ok := m.merge(ev.Data); ok {
+					last.Data = merged
+					last.Time = ev.Time
+					continue
+				}
+			}
+		}
+
+		result = append(result, ev)
+	}
+
+	return result
+}
+
+func validEvent(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
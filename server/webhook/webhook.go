@@ -1,72 +1,270 @@
-// Package webhook will optionally call a preconfigured endpoint
+// Package webhook will optionally call preconfigured endpoints
 package webhook
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/httpclient"
 	"github.com/axllent/mailpit/internal/logger"
 	"golang.org/x/time/rate"
 )
 
+const (
+	// maximum number of queued events per endpoint
+	queueSize = 1000
+	// maximum number of events aggregated into a single request
+	maxBatchEvents = 1000
+)
+
 var (
-	// RateLimit is the minimum number of seconds between requests
+	// RateLimit is the minimum number of seconds between new message requests
 	RateLimit = 1
 
+	// BatchDelay is how long events from bulk operations are collected before being aggregated & sent
+	BatchDelay = 500 * time.Millisecond
+
+	// RetryDelay is the delay before the first retry of a failed request, doubling with each retry
+	RetryDelay = time.Second
+
+	// OnDelivery is an optional callback with the final result of each event delivery to an endpoint
+	OnDelivery func(ev Event, url string, err error)
+
 	rl rate.Sometimes
 
-	rateLimiterSet bool
+	mu        sync.RWMutex
+	endpoints []*endpoint
 )
 
-// Send will post the MessageSummary to a webhook (if configured)
+// Endpoint is a webhook URL & the events it is subscribed to
+type endpoint struct {
+	url    string
+	events []string
+	secret string
+	// legacy endpoints (--webhook-url) receive the message summary of new messages only
+	legacy bool
+	queue  chan Event
+}
+
+// Init configures the webhook endpoints from the config, and must be called after config.VerifyConfig().
+// The legacy --webhook-url is subscribed to message.received only, and receives the message summary.
+func Init() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, e := range endpoints {
+		close(e.queue)
+	}
+	endpoints = nil
+
+	if RateLimit > 0 {
+		rl = rate.Sometimes{Interval: time.Duration(RateLimit) * time.Second}
+	} else {
+		// run 1000 per second - ie: do not limit
+		rl = rate.Sometimes{First: 1000, Interval: time.Second}
+	}
+
+	configured := []*endpoint{}
+
+	if config.WebhookURL != "" {
+		configured = append(configured, &endpoint{
+			url:    config.WebhookURL,
+			events: []string{MessageReceived},
+			secret: config.WebhookSecret,
+			legacy: true,
+		})
+	}
+
+	for _, w := range config.Webhooks {
+		for _, ev := range w.Events {
+			if !validEvent(ev) {
+				return fmt.Errorf("[webhook] invalid event type \"%s\" for %s, valid types are: %s", ev, w.URL, strings.Join(EventTypes, ", "))
+			}
+		}
+
+		configured = append(configured, &endpoint{url: w.URL, events: w.Events, secret: w.Secret})
+	}
+
+	for _, e := range configured {
+		e.queue = make(chan Event, queueSize)
+		go e.run()
+
+		events := "all events"
+		if len(e.events) > 0 {
+			events = strings.Join(e.events, ", ")
+		}
+		logger.Log().Infof("[webhook] sending %s to %s", events, e.url)
+	}
+
+	endpoints = configured
+
+	return nil
+}
+
+// Send will post the MessageSummary of a new message to all endpoints subscribed to message.received
 func Send(msg interface{}) {
-	if config.WebhookURL == "" {
+	Dispatch(MessageReceived, msg)
+}
+
+// Dispatch queues an event for all endpoints subscribed to the event type. New message events
+// sent to the legacy --webhook-url are rate limited.
+func Dispatch(eventType string, data interface{}) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if len(endpoints) == 0 {
 		return
 	}
 
-	if !rateLimiterSet {
-		if RateLimit > 0 {
-			rl = rate.Sometimes{Interval: time.Duration(RateLimit) * time.Second}
+	ev := Event{Type: eventType, Time: time.Now(), Label: config.Label, Data: data}
+
+	for _, e := range endpoints {
+		if !e.subscribed(eventType) {
+			continue
+		}
+
+		if e.legacy && eventType == MessageReceived {
+			rl.Do(func() { e.enqueue(ev) })
 		} else {
-			// run 1000 per second - ie: do not limit
-			rl = rate.Sometimes{First: 1000, Interval: time.Second}
+			e.enqueue(ev)
 		}
-		rateLimiterSet = true
 	}
+}
 
-	go func() {
-		rl.Do(func() {
-			b, err := json.Marshal(msg)
-			if err != nil {
-				logger.Log().Errorf("[webhook] invalid data: %s", err.Error())
-				return
-			}
+// Enqueue an event for delivery, dropping it if the queue is full
+func (e *endpoint) enqueue(ev Event) {
+	select {
+	case e.queue <- ev:
+	default:
+		logger.Log().Warnf("[webhook] queue for %s is full, dropping %s event", e.url, ev.Type)
+	}
+}
+
+func (e *endpoint) subscribed(eventType string) bool {
+	if len(e.events) == 0 {
+		return true
+	}
+
+	for _, ev := range e.events {
+		if ev == eventType {
+			return true
+		}
+	}
+
+	return false
+}
 
-			req, err := http.NewRequest("POST", config.WebhookURL, bytes.NewBuffer(b))
-			if err != nil {
-				logger.Log().Errorf("[webhook] error: %s", err.Error())
-				return
+// Run delivers queued events in order. Events from bulk operations are collected for BatchDelay and
+// consecutive events of the same type are aggregated into a single request.
+func (e *endpoint) run() {
+	for ev := range e.queue {
+		batch := []Event{ev}
+
+		if _, ok := ev.Data.(merger); ok {
+			timer := time.NewTimer(BatchDelay)
+		collect:
+			for len(batch) < maxBatchEvents {
+				select {
+				case next, ok := <-e.queue:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, next)
+				case <-timer.C:
+					break collect
+				}
 			}
+			timer.Stop()
+		}
 
-			req.Header.Set("User-Agent", "Mailpit/"+config.Version)
-			req.Header.Set("Content-Type", "application/json")
+		for _, ev := range coalesce(batch) {
+			e.deliver(ev)
+		}
+	}
+}
+
+// Deliver an event, retrying failed requests up to config.WebhookRetries times
+func (e *endpoint) deliver(ev Event) {
+	var payload interface{} = ev
+	if e.legacy {
+		payload = ev.Data
+	}
 
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				logger.Log().Errorf("[webhook] error sending data: %s", err.Error())
-				return
+	b, err := json.Marshal(payload)
+	if err != nil {
+		logger.Log().Errorf("[webhook] invalid data: %s", err.Error())
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := e.post(ev.Type, b)
+		if err == nil {
+			if OnDelivery != nil {
+				OnDelivery(ev, e.url, nil)
 			}
+			return
+		}
 
-			if resp.StatusCode < 200 || resp.StatusCode > 299 {
-				logger.Log().Warnf("[webhook] %s returned a %d status", config.WebhookURL, resp.StatusCode)
-				return
+		if !retry || attempt >= config.Runtime().WebhookRetries {
+			logger.Log().Errorf("[webhook] error sending %s event to %s: %s", ev.Type, e.url, err.Error())
+			if OnDelivery != nil {
+				OnDelivery(ev, e.url, err)
 			}
+			return
+		}
 
-			defer resp.Body.Close()
-		})
-	}()
+		delay := RetryDelay << attempt
+		logger.Log().Debugf("[webhook] error sending %s event to %s, retrying in %s: %s", ev.Type, e.url, delay, err.Error())
+		time.Sleep(delay)
+	}
+}
+
+// Post the payload, returning whether the request should be retried if it failed
+func (e *endpoint) post(eventType string, b []byte) (bool, error) {
+	req, err := http.NewRequest("POST", e.url, bytes.NewBuffer(b))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("User-Agent", "Mailpit/"+config.Version)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mailpit-Event", eventType)
+
+	if e.secret != "" {
+		req.Header.Set("X-Mailpit-Signature", "sha256="+Signature(e.secret, b))
+	}
+
+	client := httpclient.Client(30*time.Second, false)
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// retry server errors & rate limiting only
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s returned a %d status", e.url, resp.StatusCode)
+	}
+
+	return false, nil
+}
+
+// Signature returns the hex-encoded HMAC-SHA256 signature of a request body, as sent in the
+// X-Mailpit-Signature header (prefixed with "sha256=")
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
 }
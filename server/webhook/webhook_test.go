@@ -0,0 +1,196 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axllent/mailpit/config"
+	"github.com/axllent/mailpit/internal/logger"
+)
+
+type receivedRequest struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+func TestWebhookEvents(t *testing.T) {
+	logger.NoLogging = true
+	BatchDelay = 50 * time.Millisecond
+	RetryDelay = 10 * time.Millisecond
+	RateLimit = 0
+
+	var mu sync.Mutex
+	received := map[string][]receivedRequest{}
+	failures := 2
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/flaky" && failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received[r.URL.Path] = append(received[r.URL.Path], receivedRequest{r.Header.Get("X-Mailpit-Event"), r.Header.Get("X-Mailpit-Signature"), b})
+	}))
+	defer ts.Close()
+
+	config.WebhookURL = ts.URL + "/legacy"
+	config.Webhooks = []config.WebhookConfig{
+		{URL: ts.URL + "/deletions", Events: []string{MessageDeleted}, Secret: "s3cret"},
+		{URL: ts.URL + "/flaky", Events: []string{MessageRead}},
+	}
+	defer func() {
+		config.WebhookURL = ""
+		config.Webhooks = nil
+		_ = Init()
+	}()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	Send(map[string]string{"ID": "new"})
+	for _, id := range []string{"a", "b", "c"} {
+		Dispatch(MessageDeleted, DeletedData{IDs: []string{id}, Count: 1})
+	}
+	Dispatch(MessageRead, ReadData{IDs: []string{"a"}, Read: true, Count: 1})
+
+	waitFor := func(path string, n int) []receivedRequest {
+		for i := 0; i < 200; i++ {
+			mu.Lock()
+			r := received[path]
+			mu.Unlock()
+			if len(r) >= n {
+				return r
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d requests to %s", n, path)
+		return nil
+	}
+
+	t.Log("Legacy endpoint receives the message summary")
+	legacy := waitFor("/legacy", 1)
+	if string(legacy[0].body) != `{"ID":"new"}` || legacy[0].event != MessageReceived {
+		t.Errorf("unexpected legacy payload %s (%s)", legacy[0].body, legacy[0].event)
+	}
+
+	t.Log("Subscribed deletions are aggregated & signed")
+	deletions := waitFor("/deletions", 1)
+	ev := struct {
+		Type string
+		Data DeletedData
+	}{}
+	if err := json.Unmarshal(deletions[0].body, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != MessageDeleted || ev.Data.Count != 3 || len(ev.Data.IDs) != 3 {
+		t.Errorf("expected a single aggregated deletion event, got %s", deletions[0].body)
+	}
+	if deletions[0].signature != "sha256="+Signature("s3cret", deletions[0].body) {
+		t.Errorf("invalid signature %q", deletions[0].signature)
+	}
+
+	t.Log("Failed requests are retried")
+	read := waitFor("/flaky", 1)
+	if read[0].event != MessageRead || read[0].signature != "" {
+		t.Errorf("unexpected read event %s (%s)", read[0].body, read[0].signature)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received["/legacy"]) != 1 || len(received["/deletions"]) != 1 || len(received["/flaky"]) != 1 {
+		t.Errorf("unexpected requests: %d legacy, %d deletions, %d read", len(received["/legacy"]), len(received["/deletions"]), len(received["/flaky"]))
+	}
+}
+
+func TestWebhookCoalesce(t *testing.T) {
+	events := coalesce([]Event{
+		{Type: MessageTagsChanged, Data: TagsData{Messages: []MessageTags{{ID: "a", Tags: []string{"one"}}}}},
+		{Type: MessageTagsChanged, Data: TagsData{Messages: []MessageTags{{ID: "b", Tags: []string{}}}}},
+		{Type: MessageTagsChanged, Data: TagsData{Messages: []MessageTags{{ID: "a", Tags: []string{"two"}}}}},
+		{Type: MessageRead, Data: ReadData{IDs: []string{"a"}, Read: true, Count: 1}},
+		{Type: MessageRead, Data: ReadData{IDs: []string{"b"}, Read: false, Count: 1}},
+		{Type: MessageRead, Data: ReadData{IDs: []string{"c"}, Read: false, Count: 1}},
+		{Type: MessageDeleted, Data: DeletedData{Count: 10, All: true}},
+		{Type: MessageDeleted, Data: DeletedData{IDs: []string{"d"}, Count: 1}},
+	})
+
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %d", len(events))
+	}
+
+	tags := events[0].Data.(TagsData)
+	if len(tags.Messages) != 2 || tags.Messages[1].ID != "a" || tags.Messages[1].Tags[0] != "two" {
+		t.Errorf("unexpected tags data %+v", tags)
+	}
+
+	if events[2].Data.(ReadData).Count != 2 {
+		t.Errorf("expected unread events to be aggregated, got %+v", events[2].Data)
+	}
+}
+
+func TestWebhookRateLimit(t *testing.T) {
+	logger.NoLogging = true
+	RateLimit = 60
+	defer func() { RateLimit = 0 }()
+
+	var mu sync.Mutex
+	received := map[string]int{}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[r.URL.Path]++
+	}))
+	defer ts.Close()
+
+	config.WebhookURL = ts.URL + "/legacy"
+	config.Webhooks = []config.WebhookConfig{
+		{URL: ts.URL + "/received", Events: []string{MessageReceived}},
+	}
+	defer func() {
+		config.WebhookURL = ""
+		config.Webhooks = nil
+		_ = Init()
+	}()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		Send(map[string]string{"ID": id})
+	}
+
+	for i := 0; i < 200; i++ {
+		mu.Lock()
+		n := received["/received"]
+		mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+
+	t.Log("Only the legacy endpoint is rate limited")
+	if received["/legacy"] != 1 {
+		t.Errorf("expected 1 legacy request, got %d", received["/legacy"])
+	}
+	if received["/received"] != 3 {
+		t.Errorf("expected 3 message.received requests, got %d", received["/received"])
+	}
+}
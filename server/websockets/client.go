@@ -6,6 +6,7 @@ package websockets
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/axllent/mailpit/internal/auth"
@@ -112,18 +113,9 @@ func (c *Client) writePump() {
 
 // ServeWs handles websocket requests from the peer.
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	if auth.UICredentials != nil {
-		user, pass, ok := r.BasicAuth()
-
-		if !ok {
-			basicAuthResponse(w)
-			return
-		}
-
-		if !auth.UICredentials.Match(user, pass) {
-			basicAuthResponse(w)
-			return
-		}
+	if !authenticated(r) {
+		basicAuthResponse(w)
+		return
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -146,3 +138,22 @@ func basicAuthResponse(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusUnauthorized)
 	_, _ = w.Write([]byte("Unauthorised.\n"))
 }
+
+// Authenticated returns whether a websocket upgrade request is authenticated, either with basic auth,
+// or a ticket from /api/v1/ws-ticket as a bearer token or `ticket` query parameter.
+// All requests are authenticated if UI authentication is not enabled.
+func authenticated(r *http.Request) bool {
+	if auth.UICredentials == nil {
+		return true
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		return auth.UICredentials.Match(user, pass)
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return auth.ValidWebsocketTicket(strings.TrimSpace(token))
+	}
+
+	return auth.ValidWebsocketTicket(r.URL.Query().Get("ticket"))
+}
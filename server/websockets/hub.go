@@ -4,6 +4,7 @@ package websockets
 import (
 	"encoding/json"
 
+	"github.com/axllent/mailpit/config"
 	"github.com/axllent/mailpit/internal/logger"
 )
 
@@ -27,6 +28,8 @@ type Hub struct {
 type WebsocketNotification struct {
 	Type string
 	Data interface{}
+	// Optional instance label, omitted if not set
+	Label string `json:",omitempty"`
 }
 
 // NewHub returns a new hub configuration
@@ -76,6 +79,7 @@ func Broadcast(t string, msg interface{}) {
 	w := WebsocketNotification{}
 	w.Type = t
 	w.Data = msg
+	w.Label = config.Label
 	b, err := json.Marshal(w)
 
 	if err != nil {